@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// routeMatching lists the route fields that decide matching rather than
+// apply a policy, left out of the startup summary
+var routeMatching = map[string]bool{
+	"name":             true,
+	"path_prefix":      true,
+	"trailing_slash":   true,
+	"case_insensitive": true,
+}
+
+// logStartup logs a structured summary of what the gateway is about to
+// serve: listeners, TLS state, targets, routes and enabled features.
+// Secrets never appear: target URLs are logged without passwords and
+// policies by name only.
+func logStartup(log *logger.Logger, cfg *config.Config) {
+	startup := log.Component("startup")
+
+	admin, lane := "disabled", "disabled"
+	if cfg.Admin.Enabled {
+		admin = cfg.Admin.Address
+	}
+	if cfg.Server.PriorityLane.Enabled {
+		lane = cfg.Server.PriorityLane.Address
+	}
+
+	startup.Info("Listeners",
+		"proxy", fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		"tls", tlsState(cfg.Server.TLS),
+		"admin", admin,
+		"priority_lane", lane,
+		"max_connections", cfg.Server.MaxConnections,
+	)
+
+	var targets []string
+	for _, target := range cfg.Targets {
+		if target.Enabled {
+			targets = append(targets, redactURL(target.URL))
+		}
+	}
+
+	algorithm := cfg.LoadBalancing.Algorithm
+	if algorithm == "" {
+		algorithm = "round_robin"
+	}
+
+	startup.Info("Targets",
+		"count", len(targets),
+		"targets", strings.Join(targets, ","),
+		"load_balancing", algorithm,
+		"discovery", cfg.Discovery.Enabled,
+	)
+
+	for _, rc := range cfg.Routes {
+		startup.Info("Route",
+			"name", rc.Name,
+			"path_prefix", rc.PathPrefix,
+			"policies", strings.Join(routePolicies(rc), ","),
+		)
+	}
+
+	if len(cfg.Tenants) > 0 {
+		tenants := make([]string, len(cfg.Tenants))
+		for i, tenant := range cfg.Tenants {
+			tenants[i] = tenant.Name
+		}
+		startup.Info("Tenants", "count", len(tenants), "tenants", strings.Join(tenants, ","))
+	}
+
+	startup.Info("Features", "enabled", strings.Join(enabledFeatures(cfg), ","))
+}
+
+// tlsState describes how the proxy listener serves TLS
+func tlsState(cfg config.ServerTLSConfig) string {
+	revocation := ""
+	if len(cfg.Revocation.CRLFiles) > 0 || cfg.Revocation.OCSP {
+		revocation = ", checked for revocation"
+	}
+
+	switch {
+	case cfg.CertFile == "":
+		return "off"
+	case cfg.ClientCAFile != "" && cfg.ClientAuth == "optional":
+		return "on, optional client certificates" + revocation
+	case cfg.ClientCAFile != "":
+		return "on, client certificates required" + revocation
+	}
+
+	return "on"
+}
+
+// redactURL returns rawURL with its password masked
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return config.RedactedValue
+	}
+
+	return u.Redacted()
+}
+
+// routePolicies returns the YAML names of the policies a route configures
+func routePolicies(rc config.RouteConfig) []string {
+	var policies []string
+
+	v := reflect.ValueOf(rc)
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || routeMatching[name] {
+			continue
+		}
+
+		if configured(v.Field(i)) {
+			policies = append(policies, name)
+		}
+	}
+
+	return policies
+}
+
+// enabledFeatures returns the dotted YAML paths of the global sections
+// switched on with an enabled flag, plus access logging, access log sinks
+// and load shedding, which are configured otherwise
+func enabledFeatures(cfg *config.Config) []string {
+	features := enabledSections(reflect.ValueOf(*cfg), "")
+
+	if cfg.Logging.AccessLog {
+		features = append(features, "logging.access_log")
+	}
+
+	if len(cfg.Logging.AccessLogSinks) > 0 {
+		features = append(features, "logging.access_log_sinks")
+	}
+
+	if cfg.LoadShedding.MaxInFlight > 0 {
+		features = append(features, "load_shedding")
+	}
+
+	if len(cfg.Plugins) > 0 {
+		features = append(features, "plugins")
+	}
+
+	return features
+}
+
+// enabledSections walks the structs below v and returns the paths of those
+// whose Enabled field is true. Lists such as routes and targets are not
+// walked.
+func enabledSections(v reflect.Value, path string) []string {
+	var sections []string
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.Struct || !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		if path != "" {
+			name = path + "." + name
+		}
+
+		if enabled := v.Field(i).FieldByName("Enabled"); enabled.IsValid() && enabled.Kind() == reflect.Bool && enabled.Bool() {
+			sections = append(sections, name)
+		}
+
+		sections = append(sections, enabledSections(v.Field(i), name)...)
+	}
+
+	return sections
+}
+
+// configured reports whether a route policy is set: its Enabled flag for
+// sections that have one, otherwise any non-zero value
+func configured(v reflect.Value) bool {
+	if v.Kind() == reflect.Struct {
+		if enabled := v.FieldByName("Enabled"); enabled.IsValid() && enabled.Kind() == reflect.Bool {
+			return enabled.Bool()
+		}
+	}
+
+	return !v.IsZero()
+}
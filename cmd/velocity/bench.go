@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/gateway"
+	"velocity/internal/proxy"
+	"velocity/pkg/logger"
+)
+
+// Proxy modes compared by the benchmark
+const (
+	benchShared  = "shared"
+	benchSharded = "sharded"
+)
+
+// benchResult is the outcome of one benchmark run
+type benchResult struct {
+	// mode is the proxy mode benchmarked
+	mode string
+
+	// cpus is the GOMAXPROCS the run used
+	cpus int
+
+	// requests is the number of requests completed
+	requests int64
+
+	// failures is the number of requests not answered with 200
+	failures int64
+
+	// elapsed is how long the run took
+	elapsed time.Duration
+}
+
+// rate returns the completed requests per second
+func (b benchResult) rate() float64 {
+	return float64(b.requests) / b.elapsed.Seconds()
+}
+
+// runBench implements the "bench" subcommand and returns the exit code.
+//
+// It compares the default proxy, whose round-robin cursor, target
+// counters and connection pools are shared by all requests, with the
+// experimental sharded mode, for each CPU count given. Requests are
+// served in-process against a loopback upstream running in the same
+// process, so the figures include the upstream's cost: compare the modes
+// and their scaling, not the absolute rates.
+//
+// Example:
+//
+//	velocity bench -cpu 1,8,32,64 -duration 10s
+func runBench(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	cpuList := fs.String("cpu", strconv.Itoa(runtime.NumCPU()), "Comma-separated GOMAXPROCS values to run with")
+	duration := fs.Duration("duration", 5*time.Second, "Duration of each run")
+	workersPerCPU := fs.Int("workers", 4, "Concurrent clients per CPU")
+	modes := fs.String("mode", benchShared+","+benchSharded, "Comma-separated proxy modes to compare")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 || *duration <= 0 || *workersPerCPU <= 0 {
+		fmt.Fprintln(stderr, "usage: velocity bench [-cpu 1,2,4] [-duration 5s] [-workers n] [-mode shared,sharded]")
+		return 2
+	}
+
+	var cpus []int
+	for _, field := range strings.Split(*cpuList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n <= 0 {
+			fmt.Fprintf(stderr, "Invalid CPU count %q\n", field)
+			return 2
+		}
+
+		cpus = append(cpus, n)
+	}
+
+	var runModes []string
+	for _, mode := range strings.Split(*modes, ",") {
+		mode = strings.TrimSpace(mode)
+		if mode != benchShared && mode != benchSharded {
+			fmt.Fprintf(stderr, "Unknown mode %q, expected %s or %s\n", mode, benchShared, benchSharded)
+			return 2
+		}
+
+		runModes = append(runModes, mode)
+	}
+
+	upstream, err := benchUpstream()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to start upstream: %v\n", err)
+		return 1
+	}
+	defer upstream.Close()
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	var results []benchResult
+	for _, n := range cpus {
+		for _, mode := range runModes {
+			runtime.GOMAXPROCS(n)
+
+			result, err := benchRun(upstream.URL, mode, n, n**workersPerCPU, *duration)
+			if err != nil {
+				fmt.Fprintf(stderr, "Benchmark failed: %v\n", err)
+				return 1
+			}
+
+			fmt.Fprintf(stderr, "%s with %d CPUs: %.0f req/s\n", mode, n, result.rate())
+			results = append(results, result)
+		}
+	}
+
+	printBench(stdout, results)
+	return 0
+}
+
+// benchUpstream starts the loopback upstream answering every request with
+// a short body
+func benchUpstream() (*httptest.Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte("ok\n")
+	server := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "3")
+			w.Write(body)
+		})},
+	}
+	server.Start()
+
+	return server, nil
+}
+
+// benchRun runs workers concurrent clients against a gateway in mode for
+// duration. Every client acts as one connection and keeps its shard.
+func benchRun(upstreamURL, mode string, cpus, workers int, duration time.Duration) (benchResult, error) {
+	cfg := config.DefaultConfig()
+	cfg.Targets = []config.TargetConfig{{URL: upstreamURL, Enabled: true}}
+	cfg.Logging.Level = "error"
+	cfg.LoadShedding.MaxInFlight = workers * 2
+	cfg.Experimental.ShardedWorkers = config.ShardedWorkersConfig{
+		Enabled: mode == benchSharded,
+		Shards:  cpus,
+	}
+
+	gw, err := gateway.New(cfg, logger.New(logger.LoggerConfig{Level: "error", Format: "text"}))
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer gw.Close()
+
+	// A short warm-up fills the connection pools before measuring
+	benchLoad(gw, workers, 200*time.Millisecond)
+
+	start := time.Now()
+	requests, failures := benchLoad(gw, workers, duration)
+
+	return benchResult{
+		mode:     mode,
+		cpus:     cpus,
+		requests: requests,
+		failures: failures,
+		elapsed:  time.Since(start),
+	}, nil
+}
+
+// benchLoad sends requests from workers concurrent clients for duration
+// and returns the number completed and failed
+func benchLoad(handler http.Handler, workers int, duration time.Duration) (requests, failures int64) {
+	var (
+		completed, failed atomic.Int64
+		stop              atomic.Bool
+		wg                sync.WaitGroup
+	)
+
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := proxy.WithShardKey(context.Background(), uint64(i))
+			var done, bad int64
+
+			for !stop.Load() {
+				req := httptest.NewRequest(http.MethodGet, "/bench", nil).WithContext(ctx)
+				req.RemoteAddr = "127.0.0.1:1"
+
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				done++
+				if rec.Code != http.StatusOK {
+					bad++
+				}
+			}
+
+			completed.Add(done)
+			failed.Add(bad)
+		}()
+	}
+
+	time.Sleep(duration)
+	stop.Store(true)
+	wg.Wait()
+
+	return completed.Load(), failed.Load()
+}
+
+// printBench writes the results with each mode's speedup over its run on
+// the first CPU count and the sharded mode's gain over the shared one
+func printBench(w io.Writer, results []benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tCPUS\tREQ/S\tSCALING\tVS SHARED\tFAILURES")
+
+	baseline := make(map[string]float64)
+	shared := make(map[int]float64)
+
+	for _, r := range results {
+		if _, ok := baseline[r.mode]; !ok {
+			baseline[r.mode] = r.rate()
+		}
+
+		if r.mode == benchShared {
+			shared[r.cpus] = r.rate()
+		}
+
+		versus := "-"
+		if base, ok := shared[r.cpus]; ok && r.mode == benchSharded && base > 0 {
+			versus = fmt.Sprintf("%+.1f%%", (r.rate()/base-1)*100)
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%.2fx\t%s\t%d\n",
+			r.mode, r.cpus, r.rate(), r.rate()/baseline[r.mode], versus, r.failures)
+	}
+
+	tw.Flush()
+}
@@ -5,19 +5,60 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"velocity/internal/admin"
+	"velocity/internal/cluster"
 	"velocity/internal/config"
+	"velocity/internal/gateway"
+	"velocity/internal/listener"
 	"velocity/internal/proxy"
+	"velocity/internal/reload"
+	"velocity/internal/selfsigned"
+	"velocity/internal/webhook"
+	"velocity/pkg/logger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "routes" {
+		os.Exit(runRoutes(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "tls" {
+		os.Exit(runTLS(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// "velocity serve" is the explicit form of running the gateway
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	}
+
 	configFile := flag.String("config", "config.yaml", "Path to configuration file")
-	flag.Parse()
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration, secrets redacted, and exit")
+	flag.CommandLine.Parse(args)
+
+	if *printConfig {
+		os.Exit(runPrintConfig(*configFile, os.Stdout, os.Stderr))
+	}
 
 	var cfg *config.Config
 	if _, err := os.Stat(*configFile); err == nil {
@@ -29,86 +70,135 @@ func main() {
 			cfg = config.DefaultConfig()
 		} else {
 			log.Printf("Loaded configuration from %s", *configFile)
+			for _, note := range cfg.Migrations {
+				log.Printf("Warning: configuration migrated, %s", note)
+			}
 		}
 	} else {
 		cfg = config.DefaultConfig()
 		log.Printf("Config file %s not found, using default configuration", *configFile)
 	}
 
-	// Create proxy
-	var proxyHandler *proxy.Proxy
-	var proxyErr error
+	appLogger := logger.New(logger.LoggerConfig{
+		Level:  cfg.Logging.Level,
+		Format: cfg.Logging.Format,
+	})
 
-	proxyHandler, proxyErr = proxy.New(cfg)
-	if proxyErr != nil {
-		log.Printf("Failed to create proxy: %v", proxyErr)
-		log.Fatal("Cannot start gateway without proxy functionality")
+	// The cluster node outlives reloads, and must exist before the first
+	// gateway so its rate limiters share their consumption
+	if _, err := cluster.Start(cfg.Cluster, appLogger); err != nil {
+		log.Fatal("Failed to join cluster: ", err)
 	}
 
-	// Basic HTTP server to start with
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"status":"ok","service":"velocity-gateway"}`)
-	})
+	gw, err := gateway.New(cfg, appLogger)
+	if err != nil {
+		log.Printf("Failed to build gateway: %v", err)
+		log.Fatal("Cannot start gateway without proxy functionality")
+	}
+	gw.Activate()
+
+	notifier := webhook.New(cfg.Reload.Webhooks, appLogger)
+	reloader := reload.New(*configFile, gw, cfg.Reload, notifier, appLogger)
+
+	// Reload configuration on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloader.Reload(context.Background()); err != nil {
+				log.Printf("Configuration reload failed: %v", err)
+			}
+		}
+	}()
 
-	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"targets":[`)
+	if cfg.Admin.Enabled {
+		adminServer := &http.Server{
+			Addr:    cfg.Admin.Address,
+			Handler: admin.New(reloader, appLogger),
+		}
 
-		for i, target := range cfg.Targets {
-			if i > 0 {
-				fmt.Fprintf(w, `,`)
+		go func() {
+			log.Printf("Starting admin API on %s", cfg.Admin.Address)
+			if err := adminServer.ListenAndServe(); err != nil {
+				log.Fatal("Admin API failed to start: ", err)
 			}
+		}()
+	}
+
+	// The priority lane keeps health checks and metrics on their own
+	// listener and connection budget, so they are answered even while
+	// the proxy listener is saturated
+	if cfg.Server.PriorityLane.Enabled {
+		lane := cfg.Server.PriorityLane
 
-			fmt.Fprintf(w, `{"url":"%s","enabled":%t}`, target.URL, target.Enabled)
+		laneListener, err := net.Listen("tcp", lane.Address)
+		if err != nil {
+			log.Fatal("Priority lane failed to start: ", err)
 		}
 
-		fmt.Fprintf(w, `]}`)
-	})
+		laneTracker := listener.NewTracker("priority", lane.MaxConnections)
+		laneServer := &http.Server{
+			Handler:           reloader.Endpoints(),
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       time.Minute,
+			ConnState:         laneTracker.ConnState,
+		}
 
-	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+		go func() {
+			log.Printf("Starting priority lane on %s", lane.Address)
+			if err := laneServer.Serve(laneTracker.Listener(laneListener)); err != nil {
+				log.Fatal("Priority lane failed: ", err)
+			}
+		}()
+	}
 
-		if proxyHandler != nil {
-			stats := proxyHandler.GetStats()
-			fmt.Fprintf(w, `{"stats":[`)
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+	log.Printf("Starting Velocity Gateway on %s", addr)
 
-			for i, stat := range stats {
-				if i > 0 {
-					fmt.Fprintf(w, `,`)
-				}
+	proxyListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Server failed to start: ", err)
+	}
 
-				fmt.Fprintf(w, `{"target":"%s","requests":%d,"successes":%d,"failures":%d}`,
-					cfg.Targets[i].URL, stat.Requests, stat.Successes, stat.Failures)
-			}
+	tracker := listener.NewTracker("proxy", cfg.Server.MaxConnections)
+	proxyListener = tracker.Listener(proxyListener)
 
-			fmt.Fprintf(w, `]}`)
-		} else {
-			fmt.Fprintf(w, `{"error":"Proxy not configured"}`)
+	if cfg.Server.TLS.CertFile == "" && cfg.Server.TLS.AutoSelfSigned {
+		certFile, keyFile, created, err := selfsigned.LoadOrCreate(selfsigned.DefaultDir(), devHosts(cfg.Server.Host))
+		if err != nil {
+			log.Fatal("Failed to generate self-signed certificate: ", err)
 		}
-	})
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if proxyHandler != nil {
-			proxyHandler.ServeHTTP(w, r)
-		} else {
-			w.Header().Set("Content-Type", "application/json")
-			fmt.Fprintf(w, `{"message":"Velocity Gateway - Coming Soon"}`)
+		if created {
+			log.Printf("Generated self-signed certificate %s", certFile)
 		}
-	})
+		log.Printf("Warning: serving a self-signed development certificate, do not use in production")
 
-	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	log.Printf("Starting Velocity Gateway on %s", addr)
+		cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile = certFile, keyFile
+	}
+
+	tlsConfig, err := listener.ServerTLS(cfg.Server.TLS, appLogger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if tlsConfig != nil {
+		proxyListener = tls.NewListener(proxyListener, tracker.TLSConfig(tlsConfig))
+	}
+
+	logStartup(appLogger, cfg)
 
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
+		Handler:      reloader,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
+		ConnState:    tracker.ConnState,
+		ConnContext:  proxy.ConnContext,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("Server failed to start: ", err)
+	if err := server.Serve(proxyListener); err != nil {
+		log.Fatal("Server failed: ", err)
 	}
 }
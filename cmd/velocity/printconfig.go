@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"velocity/internal/config"
+)
+
+// runPrintConfig writes the effective configuration the gateway would run
+// with, after defaults, migrations and duration defaults are applied, with
+// secrets redacted, and returns the exit code.
+//
+// Example:
+//
+//	velocity serve -config config.yaml --print-config
+func runPrintConfig(configFile string, stdout, stderr io.Writer) int {
+	cfg := config.DefaultConfig()
+
+	if _, err := os.Stat(configFile); err == nil {
+		cfg, err = config.LoadFromFile(configFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+
+		for _, note := range cfg.Migrations {
+			fmt.Fprintf(stderr, "Warning: configuration migrated, %s\n", note)
+		}
+	} else {
+		fmt.Fprintf(stderr, "Config file %s not found, printing the default configuration\n", configFile)
+	}
+
+	dump, err := config.Dump(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+
+	stdout.Write(dump)
+	return 0
+}
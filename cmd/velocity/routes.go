@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+
+	"velocity/internal/config"
+	"velocity/internal/gateway"
+)
+
+// headerFlags collects repeated -H flags
+type headerFlags []string
+
+// String implements flag.Value
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+// Set implements flag.Value
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q must have the form \"Name: value\"", value)
+	}
+
+	*h = append(*h, value)
+	return nil
+}
+
+// runRoutes implements the "routes" subcommand and returns the exit code
+func runRoutes(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintln(stderr, "usage: velocity routes test [-config file] [-H 'Name: value']... [-json] METHOD URL")
+		return 2
+	}
+
+	return runRoutesTest(args[1:], stdout, stderr)
+}
+
+// runRoutesTest evaluates a request against a configuration file offline
+// and prints the matched route, target pool and applicable policies.
+//
+// Example:
+//
+//	velocity routes test -config config.yaml -H 'Authorization: Bearer ey...' GET https://api.example.com/orders/42
+func runRoutesTest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("routes test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configFile := fs.String("config", "config.yaml", "Path to configuration file")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	var headers headerFlags
+	fs.Var(&headers, "H", "Request header as 'Name: value' (repeatable)")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 2 {
+		fmt.Fprintln(stderr, "usage: velocity routes test [-config file] [-H 'Name: value']... [-json] METHOD URL")
+		return 2
+	}
+
+	cfg, err := config.LoadFromFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+
+	for _, note := range cfg.Migrations {
+		fmt.Fprintf(stderr, "Warning: configuration migrated, %s\n", note)
+	}
+
+	req, err := testRequest(fs.Arg(0), fs.Arg(1), headers)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid request: %v\n", err)
+		return 2
+	}
+
+	explanation, err := gateway.Explain(cfg, req)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(explanation)
+		return 0
+	}
+
+	printExplanation(stdout, fs.Arg(0), fs.Arg(1), explanation)
+	return 0
+}
+
+// testRequest builds the request a client would send for method and
+// rawURL. A URL without scheme and host is sent to localhost.
+func testRequest(method, rawURL string, headers []string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		u.Scheme, u.Host = "http", "localhost"
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Present the request as the server would receive it: origin-form
+	// with the authority in Host
+	req.Host = u.Host
+	req.URL.Scheme, req.URL.Host = "", ""
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+
+	if u.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{}
+	}
+
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	return req, nil
+}
+
+// printExplanation writes a human-readable explanation
+func printExplanation(w io.Writer, method, rawURL string, e *gateway.Explanation) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "%s %s\n", strings.ToUpper(method), rawURL)
+	fmt.Fprintf(tw, "  outcome:\t%s\n", e.Outcome)
+
+	if e.Reason != "" {
+		fmt.Fprintf(tw, "  reason:\t%s\n", e.Reason)
+	}
+
+	if e.Outcome == gateway.OutcomeRejected || e.Outcome == gateway.OutcomeBuiltin {
+		return
+	}
+
+	if e.Route != "" {
+		fmt.Fprintf(tw, "  route:\t%s (prefix %s)\n", e.Route, e.PathPrefix)
+	} else {
+		fmt.Fprintf(tw, "  route:\t(none, fallback)\n")
+	}
+
+	fmt.Fprintf(tw, "  path:\t%s\n", e.Path)
+
+	if e.Outcome == gateway.OutcomeRedirect {
+		return
+	}
+
+	fmt.Fprintf(tw, "  pool:\t%s\n", e.Pool)
+	if len(e.Targets) > 0 {
+		fmt.Fprintf(tw, "  targets:\t%s\n", strings.Join(e.Targets, ", "))
+	} else {
+		fmt.Fprintf(tw, "  targets:\t(no enabled static targets)\n")
+	}
+
+	if len(e.Policies) == 0 {
+		fmt.Fprintf(tw, "  policies:\t(none)\n")
+		return
+	}
+
+	// Policies are aligned separately from the summary above
+	tw.Flush()
+	fmt.Fprintln(w, "  policies:")
+
+	policies := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, policy := range e.Policies {
+		fmt.Fprintf(policies, "    %s\t%s\n", policy.Name, policy.Detail)
+	}
+	policies.Flush()
+}
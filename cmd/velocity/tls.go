@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+
+	"velocity/internal/selfsigned"
+)
+
+// runTLS implements the "tls" subcommand and returns the exit code
+func runTLS(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "self-signed" {
+		fmt.Fprintln(stderr, "usage: velocity tls self-signed [-host name]... [-dir directory]")
+		return 2
+	}
+
+	return runTLSSelfSigned(args[1:], stdout, stderr)
+}
+
+// runTLSSelfSigned generates a self-signed development certificate, or
+// reuses the cached one, and prints its files with the configuration
+// serving it.
+//
+// Example:
+//
+//	velocity tls self-signed -host localhost -host api.test
+func runTLSSelfSigned(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("tls self-signed", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	dir := fs.String("dir", selfsigned.DefaultDir(), "Directory the certificate is cached in")
+	var hosts []string
+	fs.Func("host", "DNS name or IP address the certificate is valid for (repeatable, default localhost)", func(value string) error {
+		hosts = append(hosts, value)
+		return nil
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 {
+		fmt.Fprintln(stderr, "usage: velocity tls self-signed [-host name]... [-dir directory]")
+		return 2
+	}
+
+	if len(hosts) == 0 {
+		hosts = devHosts("")
+	}
+
+	certFile, keyFile, created, err := selfsigned.LoadOrCreate(*dir, hosts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to generate certificate: %v\n", err)
+		return 1
+	}
+
+	if created {
+		fmt.Fprintln(stdout, "Generated a self-signed certificate for development use only.")
+	} else {
+		fmt.Fprintln(stdout, "Reusing the cached self-signed certificate.")
+	}
+
+	fmt.Fprintf(stdout, "\nCertificate: %s\nPrivate key: %s\n\n", certFile, keyFile)
+	fmt.Fprintf(stdout, "Serve it with:\n\n  server:\n    tls:\n      cert_file: %q\n      key_file: %q\n\n", certFile, keyFile)
+	fmt.Fprintf(stdout, "Test it with:\n\n  curl --cacert %s https://%s:8080/health\n", certFile, hosts[0])
+	return 0
+}
+
+// devHosts returns the hosts a development certificate covers: localhost
+// on both address families, plus the listen host when it names a specific
+// interface
+func devHosts(listenHost string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	switch listenHost {
+	case "", "0.0.0.0", "::":
+	default:
+		if !slices.Contains(hosts, listenHost) {
+			hosts = append(hosts, listenHost)
+		}
+	}
+
+	return hosts
+}
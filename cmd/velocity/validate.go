@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/gateway"
+	"velocity/internal/secrets"
+	"velocity/pkg/logger"
+)
+
+// Validation server defaults
+const (
+	defaultValidateListen  = "127.0.0.1:9910"
+	defaultValidateMaxBody = 1 << 20
+)
+
+// Validation is the outcome of validating one configuration document
+type Validation struct {
+	// Valid reports whether the gateway would start with the configuration
+	Valid bool `json:"valid"`
+
+	// Version is the configuration schema version the validator supports
+	Version int `json:"version"`
+
+	// Hash identifies the validated document, empty when it did not load
+	Hash string `json:"hash,omitempty"`
+
+	// Errors lists why the configuration is invalid
+	Errors []string `json:"errors"`
+
+	// Warnings lists what would be accepted but deserves attention, such as
+	// schema migrations
+	Warnings []string `json:"warnings"`
+}
+
+// validationMu serializes validations, building a gateway sets
+// process-wide state such as error limits
+var validationMu sync.Mutex
+
+// runValidate implements the "validate" subcommand and returns the exit
+// code. It validates a configuration file, or with -server answers
+// validation requests over HTTP so CI pipelines do not need a binary of
+// the gateway's exact version:
+//
+//	velocity validate -config config.yaml
+//	velocity validate -server -listen 0.0.0.0:9910
+//	curl --data-binary @config.yaml http://validator:9910/v1/validate
+//
+// Validation builds the gateway offline: nothing is probed, discovered or
+// started, and secret references are replaced by placeholders. Files the
+// configuration names, such as certificates or static roots, must exist
+// where the validator runs.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configFile := fs.String("config", "config.yaml", "Path to configuration file")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	server := fs.Bool("server", false, "Answer validation requests over HTTP instead")
+	listen := fs.String("listen", defaultValidateListen, "Address of the validation server")
+	maxBody := fs.Int64("max-body", defaultValidateMaxBody, "Largest configuration the server accepts, in bytes")
+	resolveSecrets := fs.Bool("resolve-secrets", false, "Resolve secret references instead of using placeholders (not with -server)")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: velocity validate [-config file] [-json] [-resolve-secrets] | -server [-listen address] [-max-body bytes]")
+		return 2
+	}
+
+	if *server {
+		if *resolveSecrets {
+			fmt.Fprintln(stderr, "-resolve-secrets would expose the server's own environment and files, it cannot be used with -server")
+			return 2
+		}
+
+		return serveValidation(*listen, *maxBody, stderr)
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read config: %v\n", err)
+		return 1
+	}
+
+	result := validate(data, !*resolveSecrets)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else {
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(stderr, "Warning: %s\n", warning)
+		}
+
+		for _, message := range result.Errors {
+			fmt.Fprintf(stderr, "Error: %s\n", message)
+		}
+
+		if result.Valid {
+			fmt.Fprintf(stdout, "%s: valid (hash %s)\n", *configFile, result.Hash)
+		}
+	}
+
+	if !result.Valid {
+		return 1
+	}
+
+	return 0
+}
+
+// validate checks whether the gateway would start with a configuration
+// document. With placeholders, secret references are not resolved.
+func validate(data []byte, placeholders bool) Validation {
+	result := Validation{Version: config.CurrentVersion, Errors: []string{}, Warnings: []string{}}
+
+	cfg, err := config.Load(data)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	result.Hash = cfg.Hash
+	for _, note := range cfg.Migrations {
+		result.Warnings = append(result.Warnings, "configuration migrated, "+note)
+	}
+
+	if placeholders {
+		references := make(map[string]string)
+		replaceSecrets(reflect.ValueOf(cfg).Elem(), references)
+
+		for _, reference := range slices.Sorted(maps.Keys(references)) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("secret %s not resolved, a placeholder was validated instead", reference))
+		}
+	}
+
+	cfg.Offline = true
+	quiet := logger.New(logger.LoggerConfig{Level: "error", Output: io.Discard})
+
+	validationMu.Lock()
+	defer validationMu.Unlock()
+
+	gw, err := gateway.New(cfg, quiet)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	gw.Close()
+	result.Valid = true
+	return result
+}
+
+// replaceSecrets replaces the secret references of the fields tagged
+// secret:"true" in v with placeholders, recording them in references. A
+// reference always gets the same placeholder, distinct references distinct
+// ones; every placeholder is a valid HMAC key and base64 Ed25519 seed.
+func replaceSecrets(v reflect.Value, references map[string]string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			replaceSecrets(v.Elem(), references)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := v.Field(i)
+			if !t.Field(i).IsExported() {
+				continue
+			}
+
+			if t.Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+				if reference := field.String(); secrets.IsReference(reference) {
+					field.SetString(placeholder(reference, references))
+				}
+				continue
+			}
+
+			replaceSecrets(field, references)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			replaceSecrets(v.Index(i), references)
+		}
+
+	case reflect.Map:
+		// Map values cannot be changed in place
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			replaceSecrets(value, references)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+}
+
+// placeholder returns the placeholder of a secret reference
+func placeholder(reference string, references map[string]string) string {
+	if value, ok := references[reference]; ok {
+		return value
+	}
+
+	var seed [32]byte
+	binary.BigEndian.PutUint64(seed[24:], uint64(len(references)+1))
+
+	value := base64.StdEncoding.EncodeToString(seed[:])
+	references[reference] = value
+	return value
+}
+
+// serveValidation answers validation requests until the server fails
+//
+// Endpoints:
+//
+//	POST /v1/validate  validates the YAML request body, answering 200 with
+//	                   a Validation whether the configuration is valid or not
+//	GET  /healthz      answers 200 while the server runs
+func serveValidation(listen string, maxBody int64, stderr io.Writer) int {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/validate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "validation requests must be POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("configuration exceeds %d bytes", maxBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			http.Error(w, "reading configuration failed", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(validate(data, true))
+	})
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+
+	log.Printf("Starting configuration validation server on %s", listen)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintf(stderr, "Validation server failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
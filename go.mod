@@ -1,5 +1,5 @@
 module velocity
 
-go 1.21
+go 1.24
 
 require gopkg.in/yaml.v3 v3.0.1
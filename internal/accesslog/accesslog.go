@@ -0,0 +1,204 @@
+// Package accesslog writes one structured log entry per request.
+//
+// Besides the request and response basics, each entry explains where the
+// time went: which target finally served the request, how many attempts
+// it took, how long the upstream connection and first response byte took
+// and whether the response came from a cache. Components deeper in the
+// pipeline contribute these details through the Entry stored in the
+// request context.
+//
+// Entries can also be published as JSON events to Kafka topics or NATS
+// subjects for analytics pipelines. Sinks queue events and publish them in
+// batches in the background; a broker that falls behind fills the queue,
+// after which events are dropped and counted instead of slowing requests.
+//
+// Example usage:
+//
+//	handler = middleware.Chain(handler, accesslog.Middleware(log, sinks))
+//	...
+//	if entry := accesslog.FromContext(r.Context()); entry != nil {
+//		entry.Target = target
+//	}
+package accesslog
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"velocity/internal/middleware"
+	"velocity/pkg/logger"
+)
+
+// Cache statuses
+const (
+	// CacheHit means the response was served from a cache
+	CacheHit = "hit"
+
+	// CacheMiss means the response was cacheable but fetched upstream
+	CacheMiss = "miss"
+
+	// CacheBypass means an admin caller skipped the cache
+	CacheBypass = "bypass"
+)
+
+// Entry collects per-request details contributed by the pipeline
+//
+// Thread safety: An Entry belongs to a single request and must only be
+// written from the goroutine serving it.
+type Entry struct {
+	// Route is the name of the matched route, empty for the fallback
+	Route string
+
+	// Target is the upstream that produced the response
+	Target string
+
+	// Attempts is the number of upstream attempts, including retries
+	Attempts int
+
+	// Connect is the time spent establishing the upstream connection of
+	// the final attempt, zero when a pooled connection was reused
+	Connect time.Duration
+
+	// TLS is the part of Connect spent in the TLS handshake
+	TLS time.Duration
+
+	// TTFB is the time from starting the final attempt until the first
+	// response byte arrived, including Connect
+	TTFB time.Duration
+
+	// Body is the time from the first response byte until the response
+	// was relayed to the client
+	Body time.Duration
+
+	// ConnReused reports whether the final attempt used a pooled connection
+	ConnReused bool
+
+	// Cache is CacheHit, CacheMiss or CacheBypass, empty when no cache was
+	// involved
+	Cache string
+}
+
+// entryKey is the context key for the access log entry
+type entryKey struct{}
+
+// WithEntry returns a context carrying entry
+func WithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, entry)
+}
+
+// FromContext returns the request's access log entry, or nil when access
+// logging is disabled
+func FromContext(ctx context.Context) *Entry {
+	entry, _ := ctx.Value(entryKey{}).(*Entry)
+	return entry
+}
+
+// Middleware returns a middleware logging every request once it completes
+// and publishing it to sinks. A nil log only publishes to sinks.
+func Middleware(log *logger.Logger, sinks []*Sink) middleware.Middleware {
+	var accessLogger *logger.Logger
+	if log != nil {
+		accessLogger = log.Component("access")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			// Synthetic probes bring their own entry to learn the route
+			entry := FromContext(r.Context())
+			if entry == nil {
+				entry = &Entry{}
+				r = r.WithContext(WithEntry(r.Context(), entry))
+			}
+
+			next.ServeHTTP(recorder, r)
+			duration := time.Since(start)
+
+			if len(sinks) > 0 {
+				event := newEvent(r, recorder.status, recorder.bytes, duration, entry)
+				for _, sink := range sinks {
+					sink.Enqueue(event)
+				}
+			}
+
+			if accessLogger == nil {
+				return
+			}
+
+			cache := entry.Cache
+			if cache == "" {
+				cache = "none"
+			}
+
+			accessLogger.Info("Request",
+				"method", r.Method,
+				"protocol", r.Proto,
+				"path", r.URL.Path,
+				"host", r.Host,
+				"remote", r.RemoteAddr,
+				"status", recorder.status,
+				"bytes", recorder.bytes,
+				"duration", duration,
+				"route", entry.Route,
+				"target", entry.Target,
+				"attempts", entry.Attempts,
+				"retries", max(entry.Attempts-1, 0),
+				"upstream_connect", entry.Connect,
+				"upstream_tls", entry.TLS,
+				"upstream_ttfb", entry.TTFB,
+				"upstream_body", entry.Body,
+				"conn_reused", entry.ConnReused,
+				"cache", cache,
+			)
+		})
+	}
+}
+
+// responseRecorder captures the status code and body size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+
+	// status is the response status code
+	status int
+
+	// bytes is the number of body bytes written
+	bytes int64
+
+	// wroteHeader reports whether the status was already sent
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *responseRecorder) WriteHeader(status int) {
+	// Informational responses precede the final status
+	if !r.wroteHeader && status >= http.StatusOK {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,429 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Kafka protocol API keys and versions. Produce v3 is the oldest version
+// accepting v2 record batches, supported since Kafka 0.11.
+const (
+	kafkaAPIProduce      = 0
+	kafkaAPIMetadata     = 3
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 0
+	kafkaClientID        = "velocity"
+)
+
+// Kafka error codes that call for a metadata refresh
+const (
+	kafkaUnknownTopicOrPartition = 3
+	kafkaLeaderNotAvailable      = 5
+	kafkaNotLeaderForPartition   = 6
+)
+
+// maxKafkaResponse bounds the responses read from brokers
+const maxKafkaResponse = 16 << 20
+
+// castagnoli is the CRC-32C table used by record batch checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafka publishes batches to the partition leaders of a topic, rotating
+// over the partitions batch by batch. Leaders are looked up through the
+// bootstrap brokers and looked up again when a broker fails or reports it
+// no longer leads a partition.
+type kafka struct {
+	// brokers are the bootstrap broker addresses
+	brokers []string
+
+	// topic receives the events
+	topic string
+
+	// timeout bounds dialing a broker
+	timeout time.Duration
+
+	// leaders maps partitions to the address of their leader, empty until
+	// metadata was fetched
+	leaders map[int32]string
+
+	// partitions lists the topic's partitions in order
+	partitions []int32
+
+	// next is the index of the partition receiving the next batch
+	next int
+
+	// conns holds open broker connections by address
+	conns map[string]net.Conn
+
+	// correlation numbers requests
+	correlation int32
+}
+
+// newKafka creates a Kafka transport
+func newKafka(brokers []string, topic string, timeout time.Duration) (*kafka, error) {
+	for _, broker := range brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return nil, fmt.Errorf("kafka broker must be host:port, got %q", broker)
+		}
+	}
+
+	return &kafka{
+		brokers: brokers,
+		topic:   topic,
+		timeout: timeout,
+		conns:   make(map[string]net.Conn),
+	}, nil
+}
+
+// publish implements transport
+func (k *kafka) publish(ctx context.Context, batch [][]byte) error {
+	if len(k.leaders) == 0 {
+		if err := k.refresh(ctx); err != nil {
+			return err
+		}
+	}
+
+	partition := k.partitions[k.next%len(k.partitions)]
+	k.next++
+
+	leader := k.leaders[partition]
+	resp, err := k.roundTrip(ctx, leader, kafkaAPIProduce, kafkaProduceVersion, k.produceRequest(ctx, partition, batch))
+	if err != nil {
+		k.leaders = nil
+		return err
+	}
+
+	code, err := produceError(resp)
+	if err != nil {
+		k.drop(leader)
+		k.leaders = nil
+		return err
+	}
+
+	switch code {
+	case 0:
+		return nil
+	case kafkaUnknownTopicOrPartition, kafkaLeaderNotAvailable, kafkaNotLeaderForPartition:
+		k.leaders = nil
+	}
+
+	return fmt.Errorf("kafka: producing to %s partition %d failed with error code %d", k.topic, partition, code)
+}
+
+// close implements transport
+func (k *kafka) close() {
+	for addr := range k.conns {
+		k.drop(addr)
+	}
+}
+
+// refresh looks up the topic's partition leaders from the first bootstrap
+// broker that answers
+func (k *kafka) refresh(ctx context.Context) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, k.topic)
+
+	var lastErr error
+	for _, broker := range k.brokers {
+		resp, err := k.roundTrip(ctx, broker, kafkaAPIMetadata, kafkaMetadataVersion, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		leaders, err := k.parseMetadata(resp)
+		if err != nil {
+			return err
+		}
+
+		k.leaders = leaders
+		k.partitions = k.partitions[:0]
+		for partition := range leaders {
+			k.partitions = append(k.partitions, partition)
+		}
+		slices.Sort(k.partitions)
+		return nil
+	}
+
+	return lastErr
+}
+
+// parseMetadata returns the leader addresses of the topic's partitions
+// from a v0 metadata response
+func (k *kafka) parseMetadata(resp []byte) (map[int32]string, error) {
+	d := &kafkaDecoder{buf: resp}
+
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	leaders := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topicErr := d.int16()
+		topic := d.string()
+
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			partitionErr := d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			d.skipArray(4)
+			d.skipArray(4)
+
+			if addr, ok := brokers[leader]; ok && topic == k.topic && topicErr == 0 && partitionErr == 0 {
+				leaders[partition] = addr
+			}
+		}
+
+		if topic == k.topic && topicErr != 0 {
+			return nil, fmt.Errorf("kafka: metadata for topic %s failed with error code %d", k.topic, topicErr)
+		}
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("kafka: invalid metadata response: %w", d.err)
+	}
+
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("kafka: topic %s has no partition with a leader", k.topic)
+	}
+
+	return leaders, nil
+}
+
+// produceRequest encodes a v3 produce request writing batch to a
+// partition, acknowledged by the partition leader
+func (k *kafka) produceRequest(ctx context.Context, partition int32, batch [][]byte) []byte {
+	timeout := k.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	records := recordBatch(batch, time.Now())
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 0xffff) // no transactional ID
+	body = binary.BigEndian.AppendUint16(body, 1)      // leader acknowledgement
+	body = binary.BigEndian.AppendUint32(body, uint32(max(timeout.Milliseconds(), 1)))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, k.topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(records)))
+	return append(body, records...)
+}
+
+// produceError returns the error code of the single partition in a v3
+// produce response
+func produceError(resp []byte) (int16, error) {
+	d := &kafkaDecoder{buf: resp}
+
+	var code int16
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			d.int32()
+			if c := d.int16(); c != 0 {
+				code = c
+			}
+			d.int64()
+			d.int64()
+		}
+	}
+
+	if d.err != nil {
+		return 0, fmt.Errorf("kafka: invalid produce response: %w", d.err)
+	}
+
+	return code, nil
+}
+
+// recordBatch encodes values as an uncompressed v2 record batch without
+// keys or headers
+func recordBatch(values [][]byte, now time.Time) []byte {
+	var records []byte
+	for i, value := range values {
+		var record []byte
+		record = append(record, 0)                     // attributes
+		record = binary.AppendVarint(record, 0)        // timestamp delta
+		record = binary.AppendVarint(record, int64(i)) // offset delta
+		record = binary.AppendVarint(record, -1)       // no key
+		record = binary.AppendVarint(record, int64(len(value)))
+		record = append(record, value...)
+		record = binary.AppendVarint(record, 0) // no headers
+
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	timestamp := uint64(now.UnixMilli())
+
+	// The checksum covers everything from the attributes on
+	var checked []byte
+	checked = binary.BigEndian.AppendUint16(checked, 0) // attributes
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(values)-1))
+	checked = binary.BigEndian.AppendUint64(checked, timestamp)
+	checked = binary.BigEndian.AppendUint64(checked, timestamp)
+	checked = binary.BigEndian.AppendUint64(checked, ^uint64(0)) // no producer ID
+	checked = binary.BigEndian.AppendUint16(checked, 0xffff)     // no producer epoch
+	checked = binary.BigEndian.AppendUint32(checked, ^uint32(0)) // no base sequence
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(values)))
+	checked = append(checked, records...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0) // base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(checked)))
+	batch = binary.BigEndian.AppendUint32(batch, ^uint32(0)) // partition leader epoch
+	batch = append(batch, 2)                                 // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(checked, castagnoli))
+	return append(batch, checked...)
+}
+
+// roundTrip sends a request to a broker and returns the response body
+// following its correlation ID. The connection is dropped on any error.
+func (k *kafka) roundTrip(ctx context.Context, addr string, apiKey, version int16, body []byte) ([]byte, error) {
+	conn, err := k.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	k.correlation++
+
+	var header []byte
+	header = binary.BigEndian.AppendUint16(header, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(version))
+	header = binary.BigEndian.AppendUint32(header, uint32(k.correlation))
+	header = appendKafkaString(header, kafkaClientID)
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(header)+len(body)))
+	msg = append(msg, header...)
+	msg = append(msg, body...)
+
+	resp, err := k.exchange(conn, msg)
+	if err != nil {
+		k.drop(addr)
+		return nil, fmt.Errorf("kafka: broker %s: %w", addr, err)
+	}
+
+	return resp, nil
+}
+
+// exchange writes a framed request and reads the framed response
+func (k *kafka) exchange(conn net.Conn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxKafkaResponse {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	if int32(binary.BigEndian.Uint32(resp)) != k.correlation {
+		return nil, errors.New("response does not match the request")
+	}
+
+	return resp[4:], nil
+}
+
+// conn returns the open connection to a broker, dialing it if needed
+func (k *kafka) conn(ctx context.Context, addr string) (net.Conn, error) {
+	if conn, ok := k.conns[addr]; ok {
+		return conn, nil
+	}
+
+	dialer := net.Dialer{Timeout: k.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+
+	k.conns[addr] = conn
+	return conn, nil
+}
+
+// drop closes and forgets the connection to a broker
+func (k *kafka) drop(addr string) {
+	if conn, ok := k.conns[addr]; ok {
+		conn.Close()
+		delete(k.conns, addr)
+	}
+}
+
+// appendKafkaString appends a length-prefixed string
+func appendKafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// kafkaDecoder reads big-endian protocol fields, remembering the first
+// error so callers check once at the end
+type kafkaDecoder struct {
+	// buf holds the unread bytes
+	buf []byte
+
+	// err is set when a field runs past the end of buf
+	err error
+}
+
+// take returns the next n bytes, or zeros once an error occurred
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		if d.err == nil {
+			d.err = io.ErrUnexpectedEOF
+		}
+		// Fixed-size fields read as zero
+		return make([]byte, 8)
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.take(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.take(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.take(8))) }
+
+// string reads a length-prefixed string, empty when null
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.take(int(n)))
+}
+
+// skipArray skips an array of fixed-size elements
+func (d *kafkaDecoder) skipArray(size int) {
+	if n := d.int32(); n > 0 {
+		d.take(int(n) * size)
+	}
+}
@@ -0,0 +1,210 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nats publishes batches to a NATS subject over the text protocol. A batch
+// is written as one PUB per event followed by a PING; the server's PONG
+// confirms it processed every event before it.
+type nats struct {
+	// servers are the NATS server URLs, tried in turn
+	servers []*url.URL
+
+	// subject receives the events
+	subject string
+
+	// timeout bounds dialing a server
+	timeout time.Duration
+
+	// next is the index of the server dialed next
+	next int
+
+	// conn is the open server connection, nil when disconnected
+	conn net.Conn
+
+	// reader buffers server messages read from conn
+	reader *bufio.Reader
+}
+
+// natsInfo holds the INFO fields the gateway checks before connecting
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect is the CONNECT message sent after INFO
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+// newNATS creates a NATS transport
+func newNATS(servers []string, subject string, timeout time.Duration) (*nats, error) {
+	if strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("nats subject must not contain whitespace or wildcards, got %q", subject)
+	}
+
+	n := &nats{subject: subject, timeout: timeout}
+	for _, server := range servers {
+		u, err := url.Parse(server)
+		if err != nil || u.Scheme != "nats" || u.Host == "" {
+			return nil, fmt.Errorf("nats server must be a nats://host:port URL, got %q", server)
+		}
+
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "4222")
+		}
+
+		n.servers = append(n.servers, u)
+	}
+
+	return n, nil
+}
+
+// publish implements transport
+func (n *nats) publish(ctx context.Context, batch [][]byte) error {
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		n.conn.SetDeadline(deadline)
+	}
+
+	var msg []byte
+	for _, event := range batch {
+		msg = append(msg, "PUB "+n.subject+" "+strconv.Itoa(len(event))+"\r\n"...)
+		msg = append(msg, event...)
+		msg = append(msg, "\r\n"...)
+	}
+	msg = append(msg, "PING\r\n"...)
+
+	if _, err := n.conn.Write(msg); err != nil {
+		n.close()
+		return fmt.Errorf("nats: %w", err)
+	}
+
+	if err := n.awaitPong(); err != nil {
+		n.close()
+		return fmt.Errorf("nats: %w", err)
+	}
+
+	return nil
+}
+
+// close implements transport
+func (n *nats) close() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn, n.reader = nil, nil
+	}
+}
+
+// connect dials the next server, reads its INFO and authenticates with
+// the credentials of its URL
+func (n *nats) connect(ctx context.Context) error {
+	server := n.servers[n.next%len(n.servers)]
+	n.next++
+
+	dialer := net.Dialer{Timeout: n.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", server.Host)
+	if err != nil {
+		return fmt.Errorf("nats: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	n.conn, n.reader = conn, bufio.NewReader(conn)
+	if err := n.handshake(server); err != nil {
+		n.close()
+		return fmt.Errorf("nats: server %s: %w", server.Host, err)
+	}
+
+	return nil
+}
+
+// handshake exchanges INFO and CONNECT and waits for the server to accept
+// the connection
+func (n *nats) handshake(server *url.URL) error {
+	line, err := n.readLine()
+	if err != nil {
+		return err
+	}
+
+	payload, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+
+	var info natsInfo
+	if err := json.Unmarshal([]byte(payload), &info); err != nil {
+		return fmt.Errorf("invalid INFO: %w", err)
+	}
+
+	if info.TLSRequired {
+		return errors.New("server requires TLS, which is not supported")
+	}
+
+	connect := natsConnect{Name: "velocity", Lang: "go", User: server.User.Username()}
+	connect.Pass, _ = server.User.Password()
+
+	body, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+
+	if _, err := n.conn.Write([]byte("CONNECT " + string(body) + "\r\nPING\r\n")); err != nil {
+		return err
+	}
+
+	return n.awaitPong()
+}
+
+// awaitPong reads server messages until the PONG answering our PING,
+// answering the server's own PINGs on the way
+func (n *nats) awaitPong() error {
+	for {
+		line, err := n.readLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// readLine reads one protocol line without its CRLF
+func (n *nats) readLine() (string, error) {
+	line, err := n.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
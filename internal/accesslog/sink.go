@@ -0,0 +1,351 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// Sink types
+const (
+	// SinkKafka publishes events to a Kafka topic
+	SinkKafka = "kafka"
+
+	// SinkNATS publishes events to a NATS subject
+	SinkNATS = "nats"
+)
+
+// Defaults for unset sink configuration
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultSinkTimeout   = 5 * time.Second
+)
+
+// Event is the JSON document published to sinks for every request.
+// Durations are in seconds.
+type Event struct {
+	// Time is when the request completed
+	Time time.Time `json:"time"`
+
+	Method   string `json:"method"`
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Remote   string `json:"remote"`
+	Status   int    `json:"status"`
+	Bytes    int64  `json:"bytes"`
+
+	// Duration is the time the gateway spent serving the request
+	Duration float64 `json:"duration"`
+
+	Route           string  `json:"route,omitempty"`
+	Target          string  `json:"target,omitempty"`
+	Attempts        int     `json:"attempts"`
+	UpstreamConnect float64 `json:"upstream_connect"`
+	UpstreamTLS     float64 `json:"upstream_tls"`
+	UpstreamTTFB    float64 `json:"upstream_ttfb"`
+	UpstreamBody    float64 `json:"upstream_body"`
+	ConnReused      bool    `json:"conn_reused"`
+	Cache           string  `json:"cache,omitempty"`
+}
+
+// newEvent describes a completed request
+func newEvent(r *http.Request, status int, bytes int64, duration time.Duration, entry *Entry) Event {
+	return Event{
+		Time:            time.Now().UTC(),
+		Method:          r.Method,
+		Protocol:        r.Proto,
+		Host:            r.Host,
+		Path:            r.URL.Path,
+		Remote:          r.RemoteAddr,
+		Status:          status,
+		Bytes:           bytes,
+		Duration:        duration.Seconds(),
+		Route:           entry.Route,
+		Target:          entry.Target,
+		Attempts:        entry.Attempts,
+		UpstreamConnect: entry.Connect.Seconds(),
+		UpstreamTLS:     entry.TLS.Seconds(),
+		UpstreamTTFB:    entry.TTFB.Seconds(),
+		UpstreamBody:    entry.Body.Seconds(),
+		ConnReused:      entry.ConnReused,
+		Cache:           entry.Cache,
+	}
+}
+
+// transport publishes batches of encoded events to a broker. Transports
+// are only used from their sink's publishing goroutine.
+type transport interface {
+	// publish delivers every event of the batch or returns an error
+	publish(ctx context.Context, batch [][]byte) error
+
+	// close releases the broker connections
+	close()
+}
+
+// Sink queues access log events and publishes them to a broker in batches
+//
+// Thread safety: All methods are safe for concurrent use.
+type Sink struct {
+	// name identifies the sink in metrics and logs
+	name string
+
+	// kind is SinkKafka or SinkNATS
+	kind string
+
+	// queue holds encoded events waiting to be published
+	queue chan []byte
+
+	// batchSize is the most events published at once
+	batchSize int
+
+	// flushInterval is the longest an event waits for its batch
+	flushInterval time.Duration
+
+	// timeout bounds publishing one batch
+	timeout time.Duration
+
+	// transport delivers batches to the broker
+	transport transport
+
+	// published, dropped and failed count events by outcome
+	published, dropped, failed atomic.Int64
+
+	// failing reports whether the last batch failed, so an unavailable
+	// broker is logged once rather than per batch. Only used by Run.
+	failing bool
+
+	// logger for broker failures
+	logger *logger.Logger
+}
+
+// SinkStats holds a sink's counters
+type SinkStats struct {
+	// Name identifies the sink
+	Name string
+
+	// Type is SinkKafka or SinkNATS
+	Type string
+
+	// Published is the number of events the broker accepted
+	Published int64
+
+	// Dropped is the number of events discarded because the queue was full
+	Dropped int64
+
+	// Failed is the number of events discarded because publishing their
+	// batch failed
+	Failed int64
+
+	// Queued is the number of events waiting to be published
+	Queued int
+}
+
+// NewSinks creates the configured sinks. They queue events right away but
+// publish nothing until Run is called.
+//
+// Returns an error for an unknown type, a missing topic or broker, a
+// duplicate name or negative limits.
+func NewSinks(cfgs []config.AccessLogSinkConfig, log *logger.Logger) ([]*Sink, error) {
+	sinks := make([]*Sink, 0, len(cfgs))
+	names := make(map[string]bool, len(cfgs))
+
+	for _, cfg := range cfgs {
+		sink, err := newSink(cfg, log)
+		if err != nil {
+			return nil, fmt.Errorf("access_log_sinks: %w", err)
+		}
+
+		if names[sink.name] {
+			return nil, fmt.Errorf("access_log_sinks: duplicate sink name %q", sink.name)
+		}
+		names[sink.name] = true
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// newSink creates a single sink
+func newSink(cfg config.AccessLogSinkConfig, log *logger.Logger) (*Sink, error) {
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Type
+	}
+
+	if cfg.BatchSize < 0 || cfg.QueueSize < 0 || cfg.FlushInterval < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("%s: batch_size, queue_size, flush_interval and timeout must not be negative", name)
+	}
+
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("%s: topic is required", name)
+	}
+
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("%s: at least one broker is required", name)
+	}
+
+	s := &Sink{
+		name:          name,
+		kind:          cfg.Type,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		timeout:       cfg.Timeout,
+		logger:        log.Component("access_sink").With("sink", name),
+	}
+
+	if s.batchSize == 0 {
+		s.batchSize = defaultBatchSize
+	}
+
+	if s.flushInterval == 0 {
+		s.flushInterval = defaultFlushInterval
+	}
+
+	if s.timeout == 0 {
+		s.timeout = defaultSinkTimeout
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	s.queue = make(chan []byte, queueSize)
+
+	var err error
+	switch cfg.Type {
+	case SinkKafka:
+		s.transport, err = newKafka(cfg.Brokers, cfg.Topic, s.timeout)
+	case SinkNATS:
+		s.transport, err = newNATS(cfg.Brokers, cfg.Topic, s.timeout)
+	default:
+		err = fmt.Errorf("type must be %q or %q, got %q", SinkKafka, SinkNATS, cfg.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return s, nil
+}
+
+// Name returns the sink's name
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Stats returns the sink's counters
+func (s *Sink) Stats() SinkStats {
+	return SinkStats{
+		Name:      s.name,
+		Type:      s.kind,
+		Published: s.published.Load(),
+		Dropped:   s.dropped.Load(),
+		Failed:    s.failed.Load(),
+		Queued:    len(s.queue),
+	}
+}
+
+// Enqueue queues an event for publishing without blocking. The event is
+// dropped when the queue is full.
+func (s *Sink) Enqueue(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.dropped.Add(1)
+		return
+	}
+
+	select {
+	case s.queue <- body:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run publishes queued events until ctx is canceled, then publishes what
+// is still queued and closes the broker connections
+func (s *Sink) Run(ctx context.Context) {
+	defer s.transport.close()
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, s.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain(batch)
+			return
+
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) < s.batchSize {
+				continue
+			}
+
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		s.flush(context.Background(), batch)
+		batch = batch[:0]
+	}
+}
+
+// drain publishes the events still queued when the sink is stopped, giving
+// up after one timeout
+func (s *Sink) drain(batch [][]byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	for {
+	fill:
+		for len(batch) < s.batchSize {
+			select {
+			case event := <-s.queue:
+				batch = append(batch, event)
+			default:
+				break fill
+			}
+		}
+
+		if len(batch) == 0 || ctx.Err() != nil {
+			return
+		}
+
+		s.flush(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// flush publishes one batch, counting its events by outcome
+func (s *Sink) flush(ctx context.Context, batch [][]byte) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.transport.publish(ctx, batch); err != nil {
+		s.failed.Add(int64(len(batch)))
+		if !s.failing {
+			s.logger.Warn("Access log sink unavailable, dropping events", "error", err)
+			s.failing = true
+		}
+		return
+	}
+
+	s.published.Add(int64(len(batch)))
+	if s.failing {
+		s.logger.Info("Access log sink recovered")
+		s.failing = false
+	}
+}
@@ -0,0 +1,126 @@
+// Package admin provides the operational API of Velocity Gateway.
+//
+// The admin API is served on its own listener, separate from proxied
+// traffic, and exposes runtime controls such as configuration reloads.
+//
+// Endpoints:
+//
+//	GET  /admin/reload   status of the last configuration reload
+//	POST /admin/reload   reload the configuration file
+//	GET  /admin/logging  current global and per-component log levels
+//	PUT  /admin/logging  change log levels, optionally reverting later
+//	GET  /admin/tenants  list tenants
+//	GET  /admin/tenants/{name}  routes, target stats and rate limit of a tenant
+//	GET  /admin/health-checks         whether health checks are paused, ejected targets
+//	POST /admin/health-checks/pause   stop ejecting targets, e.g. during maintenance
+//	POST /admin/health-checks/resume  eject failing targets again
+//	POST /admin/health-checks/run     run an outlier detection cycle now
+//	POST /admin/discovery/refresh     resolve discovered targets now
+//	GET  /admin/cluster               cluster members and gossip statistics
+//	GET  /admin/usage                 billable units per consumer and route
+//	POST /admin/usage/reset           report usage and start a new period
+//	GET  /admin/routes.json           effective routes, methods, policies and upstream groups
+//	GET  /admin/synthetic             results of the synthetic probes
+//	GET  /admin/ratelimits            rate limit policies and their recent rejections
+//	GET  /admin/ratelimits?key=K      remaining tokens, reset time and rejections of key K
+//
+// When admin.token is set, every endpoint requires it as a Bearer token.
+// A tenant's admin_token grants read access to that tenant's endpoint
+// only, so teams sharing the gateway can inspect their own namespace
+// without seeing or changing anything else. With admin.basic_auth enabled,
+// users of its htpasswd file sign in with Basic credentials instead, for
+// operators using a browser or curl -u.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"velocity/internal/reload"
+	"velocity/internal/secrets"
+	"velocity/pkg/logger"
+)
+
+// Server is the admin API handler
+type Server struct {
+	// reloader applies configuration changes
+	reloader *reload.Reloader
+
+	// mux routes admin requests
+	mux *http.ServeMux
+
+	// secrets resolves admin and tenant token references
+	secrets *secrets.Store
+
+	// logger for admin actions
+	logger *logger.Logger
+}
+
+// New creates the admin API
+func New(reloader *reload.Reloader, log *logger.Logger) *Server {
+	s := &Server{
+		reloader: reloader,
+		mux:      http.NewServeMux(),
+		secrets:  secrets.NewStore(time.Minute),
+		logger:   log.Component("admin"),
+	}
+
+	s.mux.HandleFunc("GET /admin/reload", s.requireAdmin(s.handleReloadStatus))
+	s.mux.HandleFunc("POST /admin/reload", s.requireAdmin(s.handleReload))
+	s.mux.HandleFunc("GET /admin/logging", s.requireAdmin(s.handleLoggingStatus))
+	s.mux.HandleFunc("PUT /admin/logging", s.requireAdmin(s.handleLogging))
+	s.mux.HandleFunc("GET /admin/tenants", s.requireAdmin(s.handleTenants))
+	s.mux.HandleFunc("GET /admin/tenants/{name}", s.requireTenant(s.handleTenant))
+	s.mux.HandleFunc("GET /admin/health-checks", s.requireAdmin(s.handleHealthChecks))
+	s.mux.HandleFunc("POST /admin/health-checks/pause", s.requireAdmin(s.handlePauseHealthChecks))
+	s.mux.HandleFunc("POST /admin/health-checks/resume", s.requireAdmin(s.handleResumeHealthChecks))
+	s.mux.HandleFunc("POST /admin/health-checks/run", s.requireAdmin(s.handleRunHealthChecks))
+	s.mux.HandleFunc("POST /admin/discovery/refresh", s.requireAdmin(s.handleRefreshDiscovery))
+	s.mux.HandleFunc("GET /admin/cluster", s.requireAdmin(s.handleCluster))
+	s.mux.HandleFunc("GET /admin/usage", s.requireAdmin(s.handleUsage))
+	s.mux.HandleFunc("POST /admin/usage/reset", s.requireAdmin(s.handleResetUsage))
+	s.mux.HandleFunc("GET /admin/routes.json", s.requireAdmin(s.handleRoutes))
+	s.mux.HandleFunc("GET /admin/synthetic", s.requireAdmin(s.handleSynthetic))
+	s.mux.HandleFunc("GET /admin/ratelimits", s.requireAdmin(s.handleRateLimits))
+
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleReloadStatus reports the outcome of the last reload
+func (s *Server) handleReloadStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.reloader.Status())
+}
+
+// handleReload triggers a configuration reload
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Configuration reload requested via admin API", "remote", r.RemoteAddr)
+
+	if err := s.reloader.Reload(r.Context()); err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, reload.ErrInProbation) {
+			status = http.StatusConflict
+		}
+
+		writeJSON(w, status, map[string]interface{}{
+			"error":  err.Error(),
+			"status": s.reloader.Status(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.reloader.Status())
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"net/http"
+
+	"velocity/internal/cluster"
+)
+
+// clusterStatus is the body of GET /admin/cluster
+type clusterStatus struct {
+	// Enabled reports whether this gateway is a cluster member
+	Enabled bool `json:"enabled"`
+
+	// Node is this member's name
+	Node string `json:"node,omitempty"`
+
+	// Leader is the member running singleton tasks
+	Leader string `json:"leader,omitempty"`
+
+	// Members lists the known members, this one included
+	Members []cluster.Member `json:"members,omitempty"`
+
+	// Gossip counts the messages exchanged
+	Gossip *cluster.Stats `json:"gossip,omitempty"`
+}
+
+// handleCluster reports the cluster membership as seen by this member
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	node := cluster.Current()
+	if node == nil {
+		writeJSON(w, http.StatusOK, clusterStatus{})
+		return
+	}
+
+	stats := node.Stats()
+	writeJSON(w, http.StatusOK, clusterStatus{
+		Enabled: true,
+		Node:    node.Name(),
+		Leader:  node.Leader(),
+		Members: node.Members(),
+		Gossip:  &stats,
+	})
+}
@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"velocity/pkg/logger"
+)
+
+// loggingRequest is the body of PUT /admin/logging
+//
+// Example:
+//
+//	{"global": "info", "components": {"proxy": "debug"}, "revert_after": "15m"}
+//
+// A component level of "" removes the override so the component inherits
+// the global level again.
+type loggingRequest struct {
+	// Global is the new global level, unchanged when empty
+	Global string `json:"global"`
+
+	// Components maps component names to their new level
+	Components map[string]string `json:"components"`
+
+	// RevertAfter restores the previous levels after this duration,
+	// e.g. "10m". Changes are permanent when empty.
+	RevertAfter string `json:"revert_after"`
+}
+
+// handleLoggingStatus reports the current log levels
+func (s *Server) handleLoggingStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.logger.Levels().Snapshot())
+}
+
+// handleLogging changes log levels at runtime.
+//
+// The request is validated completely before any level changes, so an
+// invalid entry leaves every level untouched.
+func (s *Server) handleLogging(w http.ResponseWriter, r *http.Request) {
+	var req loggingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+
+	var revertAfter time.Duration
+	if req.RevertAfter != "" {
+		d, err := time.ParseDuration(req.RevertAfter)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("invalid revert_after %q", req.RevertAfter),
+			})
+			return
+		}
+
+		revertAfter = d
+	}
+
+	var global *slog.Level
+	if req.Global != "" {
+		level, err := logger.ParseLevel(req.Global)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		global = &level
+	}
+
+	components := make(map[string]*slog.Level, len(req.Components))
+	for component, name := range req.Components {
+		if name == "" {
+			components[component] = nil
+			continue
+		}
+
+		level, err := logger.ParseLevel(name)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		components[component] = &level
+	}
+
+	levels := s.logger.Levels()
+	if global != nil {
+		levels.SetGlobal(*global, revertAfter)
+	}
+
+	for component, level := range components {
+		if level == nil {
+			levels.ResetComponent(component)
+			continue
+		}
+
+		levels.SetComponent(component, *level, revertAfter)
+	}
+
+	s.logger.Info("Log levels changed via admin API",
+		"remote", r.RemoteAddr, "global", req.Global, "components", req.Components, "revert_after", revertAfter)
+
+	writeJSON(w, http.StatusOK, levels.Snapshot())
+}
@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"velocity/internal/gateway"
+	"velocity/internal/proxy"
+)
+
+// healthCheckStatus is the body of the health check endpoints
+type healthCheckStatus struct {
+	// Paused reports whether outlier ejections are suspended
+	Paused bool `json:"paused"`
+
+	// Ejected lists the targets currently excluded from selection
+	Ejected []string `json:"ejected"`
+
+	// Down lists the targets failing their active health check
+	Down []string `json:"down"`
+}
+
+// handleHealthChecks reports whether health checks are paused
+func (s *Server) handleHealthChecks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, describeHealthChecks(s.reloader.Current()))
+}
+
+// handlePauseHealthChecks suspends outlier ejections until resumed, e.g.
+// while backends are restarted during a maintenance window
+func (s *Server) handlePauseHealthChecks(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Health check pause requested via admin API", "remote", r.RemoteAddr)
+	s.healthCheckAction(w, (*gateway.Gateway).PauseHealthChecks)
+}
+
+// handleResumeHealthChecks lets outlier detection eject targets again
+func (s *Server) handleResumeHealthChecks(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Health check resume requested via admin API", "remote", r.RemoteAddr)
+	s.healthCheckAction(w, (*gateway.Gateway).ResumeHealthChecks)
+}
+
+// handleRunHealthChecks runs an outlier detection cycle immediately
+func (s *Server) handleRunHealthChecks(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Health check cycle requested via admin API", "remote", r.RemoteAddr)
+	s.healthCheckAction(w, (*gateway.Gateway).CheckHealth)
+}
+
+// healthCheckAction applies action to the current gateway and reports the
+// resulting health check status
+func (s *Server) healthCheckAction(w http.ResponseWriter, action func(*gateway.Gateway) error) {
+	g := s.reloader.Current()
+
+	if err := action(g); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxy.ErrOutlierDetectionDisabled) {
+			status = http.StatusConflict
+		}
+
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, describeHealthChecks(g))
+}
+
+// describeHealthChecks summarizes the health check state of a gateway
+func describeHealthChecks(g *gateway.Gateway) healthCheckStatus {
+	status := healthCheckStatus{Paused: g.HealthChecksPaused(), Ejected: []string{}, Down: []string{}}
+
+	pools := []*proxy.Proxy{g.Proxy}
+	for _, tenant := range g.Tenants {
+		pools = append(pools, tenant.Proxy)
+	}
+
+	for _, group := range g.Upstreams {
+		pools = append(pools, group)
+	}
+
+	for _, pool := range pools {
+		for _, stat := range pool.GetStats() {
+			if stat.Ejected {
+				status.Ejected = append(status.Ejected, stat.Target)
+			}
+
+			if stat.Down {
+				status.Down = append(status.Down, stat.Target)
+			}
+		}
+	}
+
+	sort.Strings(status.Ejected)
+	sort.Strings(status.Down)
+	return status
+}
+
+// handleRefreshDiscovery resolves the discovery provider immediately and
+// returns the discovered targets
+func (s *Server) handleRefreshDiscovery(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Discovery refresh requested via admin API", "remote", r.RemoteAddr)
+
+	targets, err := s.reloader.Current().RefreshDiscovery(r.Context())
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, gateway.ErrDiscoveryDisabled) {
+			status = http.StatusConflict
+		}
+
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"targets": targets})
+}
+
+// handleSynthetic reports the results of the synthetic probes
+func (s *Server) handleSynthetic(w http.ResponseWriter, r *http.Request) {
+	prober := s.reloader.Current().Synthetic
+	if prober == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "synthetic probes are disabled"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"probes": prober.Stats()})
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"velocity/internal/ratelimit"
+)
+
+// defaultRejections is how many recent rejections each policy lists when
+// no key is given
+const defaultRejections = 20
+
+// handleRateLimits reports the state of the rate limit policies.
+//
+// With ?key=, it returns the key's remaining tokens, reset time and recent
+// rejections in every policy, or only in the one named by ?scope=. Keys
+// are the values the policy's key expression derives from requests, e.g.
+// a client IP, or "tenant-a|orders" for "claim.tenant_id + route".
+// Without a key, it lists each policy with its most recent rejections,
+// ?limit= of them, to find the keys being limited.
+func (s *Server) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	policies := s.reloader.Current().RateLimits
+	if len(policies) == 0 {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "rate limiting is disabled"})
+		return
+	}
+
+	query := r.URL.Query()
+	if scope := query.Get("scope"); scope != "" {
+		var matched []*ratelimit.Policy
+		for _, policy := range policies {
+			if policy.Scope() == scope {
+				matched = append(matched, policy)
+			}
+		}
+
+		if len(matched) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown rate limit scope " + strconv.Quote(scope)})
+			return
+		}
+
+		policies = matched
+	}
+
+	if query.Has("key") {
+		key := query.Get("key")
+
+		states := make([]ratelimit.State, len(policies))
+		for i, policy := range policies {
+			states[i] = policy.State(key)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"states": states})
+		return
+	}
+
+	limit := defaultRejections
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a non-negative integer"})
+			return
+		}
+
+		limit = n
+	}
+
+	summaries := make([]ratelimit.Summary, len(policies))
+	for i, policy := range policies {
+		summaries[i] = policy.Summary(limit)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"policies": summaries})
+}
@@ -0,0 +1,9 @@
+package admin
+
+import "net/http"
+
+// handleRoutes describes the routes, methods, policies and upstream groups
+// of the current configuration
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.reloader.Current().RouteTable())
+}
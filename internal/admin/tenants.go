@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"velocity/internal/config"
+	"velocity/internal/gateway"
+	"velocity/internal/proxy"
+)
+
+// access is what a request's credentials grant
+type access struct {
+	// admin grants every endpoint
+	admin bool
+
+	// tenant is the tenant whose endpoints are granted, if any
+	tenant string
+}
+
+// tenantSummary is an entry of GET /admin/tenants
+type tenantSummary struct {
+	Name    string `json:"name"`
+	Routes  int    `json:"routes"`
+	Targets int    `json:"targets"`
+}
+
+// tenantDetail is the body of GET /admin/tenants/{name}
+type tenantDetail struct {
+	Name      string                 `json:"name"`
+	Routes    []tenantRoute          `json:"routes"`
+	Targets   []proxy.TargetStats    `json:"targets"`
+	RateLimit config.RateLimitConfig `json:"rate_limit"`
+}
+
+// tenantRoute describes one of a tenant's routes
+type tenantRoute struct {
+	Name       string `json:"name"`
+	PathPrefix string `json:"path_prefix"`
+}
+
+// authenticate resolves the Bearer token of r against the admin token and
+// the tenant tokens of the active configuration. Basic credentials found
+// in the admin htpasswd file grant admin access.
+//
+// Without an admin token or htpasswd file the admin API is open, as it was
+// before tokens existed, and every request has admin access.
+func (s *Server) authenticate(r *http.Request) access {
+	gw := s.reloader.Current()
+
+	adminToken, err := s.secrets.Get(gw.Config.Admin.Token)
+	if err != nil {
+		s.logger.Error("Failed to resolve admin token", "error", err)
+		return access{}
+	}
+
+	if adminToken == "" && gw.AdminAuth == nil {
+		return access{admin: true}
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && gw.AdminAuth != nil {
+		return access{admin: gw.AdminAuth.Check(user, password)}
+	}
+
+	if adminToken == "" {
+		return access{}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return access{}
+	}
+
+	if tokenEqual(token, adminToken) {
+		return access{admin: true}
+	}
+
+	for _, tenant := range gw.Config.Tenants {
+		if tenant.AdminToken == "" {
+			continue
+		}
+
+		tenantToken, err := s.secrets.Get(tenant.AdminToken)
+		if err != nil {
+			s.logger.Error("Failed to resolve tenant admin token", "tenant", tenant.Name, "error", err)
+			continue
+		}
+
+		if tokenEqual(token, tenantToken) {
+			return access{tenant: tenant.Name}
+		}
+	}
+
+	return access{}
+}
+
+// tokenEqual compares tokens in constant time
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// requireAdmin restricts a handler to the admin token
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted := s.authenticate(r)
+
+		switch {
+		case granted.admin:
+			next(w, r)
+		case granted.tenant != "":
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+		default:
+			s.unauthorized(w)
+		}
+	}
+}
+
+// requireTenant restricts a handler to the admin token and the token of
+// the tenant named in the path
+func (s *Server) requireTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted := s.authenticate(r)
+
+		switch {
+		case granted.admin || granted.tenant == r.PathValue("name"):
+			next(w, r)
+		case granted.tenant != "":
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+		default:
+			s.unauthorized(w)
+		}
+	}
+}
+
+// unauthorized rejects a request without valid credentials, offering the
+// schemes the active configuration accepts
+func (s *Server) unauthorized(w http.ResponseWriter) {
+	gw := s.reloader.Current()
+
+	if gw.Config.Admin.Token != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="velocity-admin"`)
+	}
+
+	if gw.AdminAuth != nil {
+		w.Header().Add("WWW-Authenticate", gw.AdminAuth.Challenge())
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+}
+
+// handleTenants lists the configured tenants
+func (s *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	gw := s.reloader.Current()
+
+	tenants := make([]tenantSummary, 0, len(gw.Tenants))
+	for name, tenant := range gw.Tenants {
+		tenants = append(tenants, tenantSummary{
+			Name:    name,
+			Routes:  len(tenant.Config.Routes),
+			Targets: len(tenant.Config.Targets),
+		})
+	}
+
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+// handleTenant reports a tenant's routes, target stats and rate limit
+func (s *Server) handleTenant(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.reloader.Current().Tenants[r.PathValue("name")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "tenant not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, describeTenant(tenant))
+}
+
+// describeTenant builds the admin view of a tenant
+func describeTenant(tenant *gateway.Tenant) tenantDetail {
+	routes := make([]tenantRoute, 0, len(tenant.Config.Routes))
+	for _, rc := range tenant.Config.Routes {
+		routes = append(routes, tenantRoute{Name: rc.Name, PathPrefix: rc.PathPrefix})
+	}
+
+	return tenantDetail{
+		Name:      tenant.Name,
+		Routes:    routes,
+		Targets:   tenant.Proxy.GetStats(),
+		RateLimit: tenant.Config.RateLimit,
+	}
+}
@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"net/http"
+
+	"velocity/internal/usage"
+)
+
+// handleUsage reports the billable usage accumulated since the last
+// reset, limited to one consumer with ?consumer=
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, usage.Global().Report(r.URL.Query().Get("consumer")))
+}
+
+// handleResetUsage reports the accumulated usage and starts a new billing
+// period in one step, so no request is lost or counted twice
+func (s *Server) handleResetUsage(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("Usage reset requested via admin API", "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, usage.Global().Reset())
+}
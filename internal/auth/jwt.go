@@ -0,0 +1,445 @@
+// Package auth provides client authentication middleware for Velocity
+// Gateway.
+//
+// Authenticated identities are stored in the request context so later
+// pipeline stages (header mapping, rate limiting, routing) can make
+// decisions based on who the caller is rather than where it connects from.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Claims holds the decoded payload of a validated token
+type Claims map[string]interface{}
+
+// claimsKey is the context key for validated claims
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the validated claims of the request, if any
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(Claims)
+	return claims, ok
+}
+
+// Lookup resolves a claim by name. Dot notation descends into nested
+// objects, e.g. "org.id".
+func (c Claims) Lookup(name string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(c)
+
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// String renders a claim as a header-safe string. Arrays are joined with
+// commas; objects are rendered as compact JSON.
+func (c Claims) String(name string) (string, bool) {
+	value, ok := c.Lookup(name)
+	if !ok || value == nil {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+
+	case float64:
+		return big.NewFloat(v).Text('f', -1), true
+
+	case bool:
+		if v {
+			return "true", true
+		}
+
+		return "false", true
+
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, fmt.Sprint(item))
+		}
+
+		return strings.Join(parts, ","), true
+
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+
+		return string(data), true
+	}
+}
+
+// JWTValidator verifies signed JSON Web Tokens
+type JWTValidator struct {
+	// secret is the HMAC key, nil when a public key is used
+	secret []byte
+
+	// publicKey is the RSA or ECDSA verification key
+	publicKey crypto.PublicKey
+
+	// keys looks up the verification key by the token's key ID instead of
+	// publicKey, nil for a single key
+	keys func(kid string) (crypto.PublicKey, error)
+
+	// issuer and audience are the expected iss/aud values
+	issuer   string
+	audience string
+
+	// leeway tolerates clock skew
+	leeway time.Duration
+
+	// now is the clock, replaceable for deterministic validation
+	now func() time.Time
+}
+
+// NewJWTValidator creates a validator from configuration.
+//
+// Returns an error if neither or both of secret and public key file are
+// configured, or if the public key cannot be loaded.
+func NewJWTValidator(cfg config.JWTConfig) (*JWTValidator, error) {
+	v := &JWTValidator{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway,
+		now:      time.Now,
+	}
+
+	switch {
+	case cfg.Secret != "" && cfg.PublicKeyFile != "":
+		return nil, errors.New("jwt: configure either secret or public_key_file, not both")
+
+	case cfg.Secret != "":
+		v.secret = []byte(cfg.Secret)
+
+	case cfg.PublicKeyFile != "":
+		key, err := loadPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		v.publicKey = key
+
+	default:
+		return nil, errors.New("jwt: secret or public_key_file is required")
+	}
+
+	return v, nil
+}
+
+// loadPublicKey reads a PEM encoded PKIX public key or certificate
+func loadPublicKey(filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: failed to read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: no PEM data in %s", filename)
+	}
+
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: invalid certificate: %w", err)
+		}
+
+		return cert.PublicKey, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: invalid public key: %w", err)
+	}
+
+	return key, nil
+}
+
+// Validate checks the token signature and registered claims and returns the
+// decoded claims on success
+func (v *JWTValidator) Validate(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token signature encoding")
+	}
+
+	if err := v.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token payload: %w", err)
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verify checks the signature for the given algorithm and key ID
+func (v *JWTValidator) verify(alg, kid, signingInput string, signature []byte) error {
+	publicKey := v.publicKey
+	if v.keys != nil {
+		key, err := v.keys(kid)
+		if err != nil {
+			return err
+		}
+
+		publicKey = key
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if v.secret == nil {
+			return fmt.Errorf("algorithm %s not accepted", alg)
+		}
+
+		mac := hmac.New(newHash, v.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+
+		return nil
+
+	case "RS", "ES":
+		h := newHash()
+		h.Write([]byte(signingInput))
+		digest := h.Sum(nil)
+
+		switch key := publicKey.(type) {
+		case *rsa.PublicKey:
+			if alg[:2] != "RS" {
+				return fmt.Errorf("algorithm %s not accepted", alg)
+			}
+
+			if err := rsa.VerifyPKCS1v15(key, cryptoHash, digest, signature); err != nil {
+				return errors.New("invalid token signature")
+			}
+
+			return nil
+
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if alg[:2] != "ES" || len(signature) != 2*size {
+				return fmt.Errorf("algorithm %s not accepted", alg)
+			}
+
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("invalid token signature")
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("algorithm %s not accepted", alg)
+}
+
+// checkClaims validates exp, nbf, iss and aud
+func (v *JWTValidator) checkClaims(claims Claims) error {
+	now := v.now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+			return errors.New("token expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token not yet valid")
+		}
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return errors.New("unexpected token issuer")
+	}
+
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return errors.New("unexpected token audience")
+	}
+
+	return nil
+}
+
+// hasAudience reports whether the aud claim contains want
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+
+	case []interface{}:
+		for _, item := range a {
+			if item == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decodeSegment decodes a base64url JSON token segment
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// JWT returns a middleware that requires a valid bearer token.
+//
+// On success the claims are stored in the request context and the
+// configured claims are copied into upstream headers. Client supplied
+// values for those headers are removed first, so backends can trust them
+// as set by the gateway.
+//
+// Requests for which anonymous returns true may omit the token and pass
+// without claims; a token they do present must still be valid. anonymous
+// may be nil.
+//
+// Returns nil when JWT authentication is disabled.
+func JWT(cfg config.JWTConfig, anonymous func(*http.Request) bool) (middleware.Middleware, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	validator, err := NewJWTValidator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range cfg.ClaimHeaders {
+				r.Header.Del(header)
+			}
+
+			token, ok := bearerToken(r)
+			if !ok && anonymous != nil && anonymous(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !ok {
+				unauthorized(w, "missing bearer token")
+				return
+			}
+
+			claims, err := validator.Validate(token)
+			if err != nil {
+				unauthorized(w, err.Error())
+				return
+			}
+
+			for claim, header := range cfg.ClaimHeaders {
+				if value, ok := claims.String(claim); ok {
+					r.Header.Set(header, value)
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}, nil
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// unauthorized writes a 401 JSON response
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="velocity"`)
+	w.WriteHeader(http.StatusUnauthorized)
+
+	fmt.Fprintf(w, `{"error":"unauthorized","message":%q}`, message)
+}
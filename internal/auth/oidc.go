@@ -0,0 +1,654 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/router"
+	"velocity/internal/secrets"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset OIDC configuration
+const (
+	defaultLogoutPath      = "/oauth2/logout"
+	defaultSessionCookie   = "velocity_session"
+	defaultSessionLifetime = 8 * time.Hour
+	defaultProviderTimeout = 5 * time.Second
+)
+
+// Sign-in limits
+const (
+	// loginLifetime bounds the time between the redirect to the provider
+	// and the callback
+	loginLifetime = 10 * time.Minute
+
+	// maxSessionCookie is the largest session cookie value kept with every
+	// claim, below the 4096 bytes browsers store per cookie
+	maxSessionCookie = 3800
+
+	// providerLeeway tolerates clock skew with the provider
+	providerLeeway = time.Minute
+)
+
+// defaultScopes are requested when none are configured
+var defaultScopes = []string{"openid", "profile", "email"}
+
+// errProviderUnavailable marks sign-in failures caused by the provider
+// rather than the browser
+var errProviderUnavailable = errors.New("identity provider unavailable")
+
+// RelyingParty signs browser users in with an OpenID Connect provider and
+// keeps their sessions in encrypted cookies.
+//
+// Example usage:
+//
+//	rp, err := auth.NewRelyingParty(cfg.Auth.OIDC, log)
+//	global = middleware.Chain(global, rp.Endpoints())
+//	route = middleware.Chain(route, rp.Middleware())
+//
+// Thread safety: All methods are safe for concurrent use.
+type RelyingParty struct {
+	// clientID and clientSecret identify the gateway to the provider
+	clientID, clientSecret string
+
+	// redirectURL is the registered callback URL, callbackPath its path
+	redirectURL, callbackPath string
+
+	// logoutPath ends sessions, postLogout is where browsers go next
+	logoutPath, postLogout string
+
+	// scope is the space separated list of requested scopes
+	scope string
+
+	// cookie names the session cookie, loginCookie the cookie holding a
+	// sign-in in progress
+	cookie, loginCookie string
+
+	// cookieDomain scopes the cookies, empty for the request host
+	cookieDomain string
+
+	// secure marks the cookies Secure, for HTTPS callback URLs
+	secure bool
+
+	// lifetime is how long a session lasts
+	lifetime time.Duration
+
+	// claimHeaders maps claim names to upstream headers
+	claimHeaders map[string]string
+
+	// sealer encrypts the cookies
+	sealer *sealer
+
+	// provider discovers the provider's endpoints and keys
+	provider *provider
+
+	// validator verifies ID tokens with the provider's keys
+	validator *JWTValidator
+
+	// authenticated, redirected and rejected count protected requests by
+	// outcome; logins and failed count completed and failed sign-ins
+	authenticated, redirected, rejected, logins, failed atomic.Int64
+
+	// logger for sign-in failures
+	logger *logger.Logger
+}
+
+// OIDCStats holds a relying party's counters
+type OIDCStats struct {
+	// Authenticated is the number of requests with a valid session
+	Authenticated int64
+
+	// Redirected is the number of browser requests sent to the provider
+	Redirected int64
+
+	// Rejected is the number of other requests without a session,
+	// answered 401
+	Rejected int64
+
+	// Logins is the number of completed sign-ins
+	Logins int64
+
+	// Failed is the number of sign-ins that failed, whether the provider
+	// was unavailable or the callback invalid
+	Failed int64
+}
+
+// session is the content of the session cookie
+type session struct {
+	// Claims are the ID token's claims
+	Claims Claims `json:"claims"`
+
+	// Expires is when the session ends, in Unix seconds
+	Expires int64 `json:"exp"`
+}
+
+// loginState is the content of the cookie of a sign-in in progress
+type loginState struct {
+	// State binds the callback to the browser that started the sign-in
+	State string `json:"state"`
+
+	// Nonce binds the ID token to the sign-in
+	Nonce string `json:"nonce"`
+
+	// Verifier is the PKCE code verifier
+	Verifier string `json:"verifier"`
+
+	// ReturnTo is the request URI the browser returns to
+	ReturnTo string `json:"return_to"`
+
+	// Expires is when the sign-in is abandoned, in Unix seconds
+	Expires int64 `json:"exp"`
+}
+
+// NewRelyingParty creates a relying party, or returns nil when OIDC is
+// disabled. The provider is contacted on first use, not here.
+//
+// Returns an error for a missing or invalid issuer, client ID or redirect
+// URL, a cookie secret shorter than 32 bytes, a secret that cannot be
+// resolved, negative durations or clashing paths.
+func NewRelyingParty(cfg config.OIDCConfig, log *logger.Logger) (*RelyingParty, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if !absoluteHTTP(cfg.Issuer) {
+		return nil, fmt.Errorf("oidc: issuer must be an absolute http or https URL, got %q", cfg.Issuer)
+	}
+
+	if cfg.ClientID == "" {
+		return nil, errors.New("oidc: client_id is required")
+	}
+
+	if !absoluteHTTP(cfg.RedirectURL) {
+		return nil, fmt.Errorf("oidc: redirect_url must be an absolute http or https URL, got %q", cfg.RedirectURL)
+	}
+
+	if cfg.SessionLifetime < 0 || cfg.Timeout < 0 {
+		return nil, errors.New("oidc: session_lifetime and timeout must not be negative")
+	}
+
+	callbackPath, logoutPath := OIDCPaths(cfg)
+	if !strings.HasPrefix(logoutPath, "/") || logoutPath == callbackPath {
+		return nil, fmt.Errorf("oidc: logout_path must be a path other than the callback path, got %q", logoutPath)
+	}
+
+	store := secrets.NewStore(0)
+	clientSecret, err := store.Get(cfg.ClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: client_secret: %w", err)
+	}
+
+	cookieSecret, err := store.Get(cfg.CookieSecret)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: cookie_secret: %w", err)
+	}
+
+	cookieSealer, err := newSealer(cookieSecret)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %w", err)
+	}
+
+	rp := &RelyingParty{
+		clientID:     cfg.ClientID,
+		clientSecret: clientSecret,
+		redirectURL:  cfg.RedirectURL,
+		callbackPath: callbackPath,
+		logoutPath:   logoutPath,
+		postLogout:   cfg.PostLogoutRedirect,
+		scope:        strings.Join(defaultScopes, " "),
+		cookie:       cfg.CookieName,
+		cookieDomain: cfg.CookieDomain,
+		secure:       strings.HasPrefix(cfg.RedirectURL, "https:"),
+		lifetime:     cfg.SessionLifetime,
+		claimHeaders: cfg.ClaimHeaders,
+		sealer:       cookieSealer,
+		logger:       log.Component("oidc"),
+	}
+
+	if len(cfg.Scopes) > 0 {
+		rp.scope = strings.Join(cfg.Scopes, " ")
+	}
+
+	if rp.postLogout == "" {
+		rp.postLogout = "/"
+	}
+
+	if rp.cookie == "" {
+		rp.cookie = defaultSessionCookie
+	}
+	rp.loginCookie = rp.cookie + "_login"
+
+	if rp.lifetime == 0 {
+		rp.lifetime = defaultSessionLifetime
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultProviderTimeout
+	}
+
+	rp.provider = &provider{issuer: cfg.Issuer, client: &http.Client{Timeout: timeout}}
+	rp.validator = &JWTValidator{
+		issuer:   cfg.Issuer,
+		audience: cfg.ClientID,
+		leeway:   providerLeeway,
+		now:      time.Now,
+		keys: func(kid string) (crypto.PublicKey, error) {
+			return rp.provider.key(context.Background(), kid)
+		},
+	}
+
+	return rp, nil
+}
+
+// OIDCPaths returns the callback and logout paths the gateway serves for
+// cfg
+func OIDCPaths(cfg config.OIDCConfig) (callback, logout string) {
+	if u, err := url.Parse(cfg.RedirectURL); err == nil {
+		callback = u.Path
+	}
+
+	logout = cfg.LogoutPath
+	if logout == "" {
+		logout = defaultLogoutPath
+	}
+
+	return callback, logout
+}
+
+// absoluteHTTP reports whether rawURL is an absolute http or https URL
+func absoluteHTTP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Stats returns the relying party's counters
+func (rp *RelyingParty) Stats() OIDCStats {
+	return OIDCStats{
+		Authenticated: rp.authenticated.Load(),
+		Redirected:    rp.redirected.Load(),
+		Rejected:      rp.rejected.Load(),
+		Logins:        rp.logins.Load(),
+		Failed:        rp.failed.Load(),
+	}
+}
+
+// Endpoints returns a middleware serving the callback and logout paths,
+// which must be reachable whether or not a route matches them. Returns
+// nil when rp is nil.
+func (rp *RelyingParty) Endpoints() middleware.Middleware {
+	if rp == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case rp.callbackPath:
+				rp.callback(w, r)
+			case rp.logoutPath:
+				http.SetCookie(w, rp.newCookie(rp.cookie, "", -1, "/"))
+				http.Redirect(w, r, rp.postLogout, http.StatusFound)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// Middleware returns a middleware requiring a session. Browser navigations
+// without one are redirected to the provider, other requests answered
+// 401, except on the anonymous paths of their route, which they reach
+// without claims. Returns nil when rp is nil.
+func (rp *RelyingParty) Middleware() middleware.Middleware {
+	if rp == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range rp.claimHeaders {
+				r.Header.Del(header)
+			}
+
+			claims, ok := rp.session(r)
+			if !ok {
+				if route, matched := router.RouteFromContext(r.Context()); matched && route.Anonymous(r.URL.Path) {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				if navigation(r) {
+					rp.login(w, r)
+					return
+				}
+
+				rp.rejected.Add(1)
+				unauthorized(w, "sign-in required")
+				return
+			}
+
+			rp.authenticated.Add(1)
+			for claim, header := range rp.claimHeaders {
+				if value, ok := claims.String(claim); ok {
+					r.Header.Set(header, value)
+				}
+			}
+
+			// The session is the gateway's, upstreams get the claims
+			rp.removeCookies(r)
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// navigation reports whether r is a browser loading a page, which can
+// follow a redirect to the provider
+func navigation(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// session returns the claims of the request's session, reporting false
+// when it has no valid, unexpired session
+func (rp *RelyingParty) session(r *http.Request) (Claims, bool) {
+	cookie, err := r.Cookie(rp.cookie)
+	if err != nil {
+		return nil, false
+	}
+
+	var s session
+	if err := rp.sealer.open(rp.cookie, cookie.Value, &s); err != nil {
+		return nil, false
+	}
+
+	if time.Now().Unix() >= s.Expires {
+		return nil, false
+	}
+
+	return s.Claims, true
+}
+
+// login starts a sign-in, redirecting the browser to the provider
+func (rp *RelyingParty) login(w http.ResponseWriter, r *http.Request) {
+	metadata, err := rp.provider.discover(r.Context())
+	if err != nil {
+		rp.fail(w, r, fmt.Errorf("%w: %w", errProviderUnavailable, err))
+		return
+	}
+
+	authorize, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		rp.fail(w, r, fmt.Errorf("%w: invalid authorization_endpoint: %w", errProviderUnavailable, err))
+		return
+	}
+
+	state := loginState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: r.URL.RequestURI(),
+		Expires:  time.Now().Add(loginLifetime).Unix(),
+	}
+
+	value, err := rp.sealer.seal(rp.loginCookie, state)
+	if err != nil {
+		rp.fail(w, r, err)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", rp.clientID)
+	query.Set("redirect_uri", rp.redirectURL)
+	query.Set("scope", rp.scope)
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+
+	rp.redirected.Add(1)
+	http.SetCookie(w, rp.newCookie(rp.loginCookie, value, int(loginLifetime.Seconds()), rp.callbackPath))
+	http.Redirect(w, r, authorize.String(), http.StatusFound)
+}
+
+// callback completes a sign-in: it checks the state, exchanges the code
+// for an ID token, verifies it and starts the session
+func (rp *RelyingParty) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if code := query.Get("error"); code != "" {
+		rp.fail(w, r, fmt.Errorf("provider answered %s: %s", code, query.Get("error_description")))
+		return
+	}
+
+	cookie, err := r.Cookie(rp.loginCookie)
+	if err != nil {
+		rp.fail(w, r, errors.New("no sign-in in progress"))
+		return
+	}
+
+	var state loginState
+	if err := rp.sealer.open(rp.loginCookie, cookie.Value, &state); err != nil {
+		rp.fail(w, r, err)
+		return
+	}
+
+	// A sign-in is completed at most once
+	http.SetCookie(w, rp.newCookie(rp.loginCookie, "", -1, rp.callbackPath))
+
+	if time.Now().Unix() >= state.Expires {
+		rp.fail(w, r, errors.New("sign-in expired"))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		rp.fail(w, r, errors.New("state does not match the sign-in in progress"))
+		return
+	}
+
+	idToken, err := rp.exchange(r.Context(), query.Get("code"), state.Verifier)
+	if err != nil {
+		rp.fail(w, r, err)
+		return
+	}
+
+	claims, err := rp.validator.Validate(idToken)
+	if err != nil {
+		rp.fail(w, r, fmt.Errorf("invalid ID token: %w", err))
+		return
+	}
+
+	if _, ok := claims["exp"].(float64); !ok {
+		rp.fail(w, r, errors.New("invalid ID token: no expiry"))
+		return
+	}
+
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(state.Nonce)) != 1 {
+		rp.fail(w, r, errors.New("invalid ID token: nonce does not match the sign-in"))
+		return
+	}
+
+	s := session{Claims: claims, Expires: time.Now().Add(rp.lifetime).Unix()}
+	value, err := rp.sealer.seal(rp.cookie, s)
+	if err == nil && len(value) > maxSessionCookie {
+		s.Claims = rp.essentialClaims(claims)
+		value, err = rp.sealer.seal(rp.cookie, s)
+	}
+
+	if err == nil && len(value) > maxSessionCookie {
+		err = errors.New("ID token claims do not fit in a cookie")
+	}
+
+	if err != nil {
+		rp.fail(w, r, err)
+		return
+	}
+
+	rp.logins.Add(1)
+	http.SetCookie(w, rp.newCookie(rp.cookie, value, int(rp.lifetime.Seconds()), "/"))
+	http.Redirect(w, r, localPath(state.ReturnTo), http.StatusFound)
+}
+
+// exchange redeems an authorization code for an ID token
+func (rp *RelyingParty) exchange(ctx context.Context, code, verifier string) (string, error) {
+	metadata, err := rp.provider.discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errProviderUnavailable, err)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.redirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {rp.clientID},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errProviderUnavailable, err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if rp.clientSecret != "" {
+		// RFC 6749 section 2.3.1 form-encodes the credentials
+		req.SetBasicAuth(url.QueryEscape(rp.clientID), url.QueryEscape(rp.clientSecret))
+	}
+
+	resp, err := rp.provider.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", fmt.Errorf("%w: token endpoint answered %d", errProviderUnavailable, resp.StatusCode)
+	}
+
+	var answer struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderDocument)).Decode(&answer); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %d %s: %s", resp.StatusCode, answer.Error, answer.ErrorDescription)
+	}
+
+	if answer.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+
+	return answer.IDToken, nil
+}
+
+// fail answers a failed sign-in, 503 when the provider is to blame and 401
+// otherwise
+func (rp *RelyingParty) fail(w http.ResponseWriter, r *http.Request, err error) {
+	rp.failed.Add(1)
+	rp.logger.Warn("Sign-in failed", "method", r.Method, "path", r.URL.Path, "error", err)
+
+	if errors.Is(err, errProviderUnavailable) {
+		gwerrors.New(gwerrors.CodeIdentityProviderUnavailable, "Identity provider unavailable").WriteJSON(w)
+		return
+	}
+
+	unauthorized(w, "sign-in failed")
+}
+
+// essentialClaims keeps the claims identifying the user and those mapped
+// to headers, for ID tokens too large for a cookie
+func (rp *RelyingParty) essentialClaims(claims Claims) Claims {
+	kept := Claims{}
+	for _, name := range []string{"iss", "sub", "aud", "exp", "iat"} {
+		if value, ok := claims[name]; ok {
+			kept[name] = value
+		}
+	}
+
+	for claim := range rp.claimHeaders {
+		name, _, _ := strings.Cut(claim, ".")
+		if value, ok := claims[name]; ok {
+			kept[name] = value
+		}
+	}
+
+	return kept
+}
+
+// removeCookies removes the gateway's cookies from the request
+func (rp *RelyingParty) removeCookies(r *http.Request) {
+	cookies := r.Cookies()
+
+	var kept []string
+	for _, c := range cookies {
+		if c.Name != rp.cookie && c.Name != rp.loginCookie {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+
+	if len(kept) == len(cookies) {
+		return
+	}
+
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// newCookie returns one of the gateway's cookies; a negative maxAge
+// deletes it
+func (rp *RelyingParty) newCookie(name, value string, maxAge int, path string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   rp.cookieDomain,
+		MaxAge:   maxAge,
+		Secure:   rp.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// localPath returns uri when it is a path on this site, "/" otherwise, so
+// the callback cannot redirect elsewhere
+func localPath(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") {
+		return "/"
+	}
+
+	return uri
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider document limits
+const (
+	// maxProviderDocument caps discovery documents, key sets and token
+	// responses
+	maxProviderDocument = 1 << 20
+
+	// keysRefreshInterval is the shortest time between two key set
+	// downloads caused by unknown key IDs
+	keysRefreshInterval = time.Minute
+)
+
+// providerMetadata holds the discovered endpoints of an OpenID Connect
+// provider
+type providerMetadata struct {
+	// Issuer must match the configured issuer
+	Issuer string `json:"issuer"`
+
+	// AuthorizationEndpoint is where browsers sign in
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+
+	// TokenEndpoint exchanges authorization codes for tokens
+	TokenEndpoint string `json:"token_endpoint"`
+
+	// JWKSURI publishes the keys signing ID tokens
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// provider discovers an OpenID Connect provider's metadata and signing
+// keys on first use and caches them. Failed lookups are retried by the
+// next request.
+//
+// Thread safety: All methods are safe for concurrent use.
+type provider struct {
+	// issuer is the configured issuer URL
+	issuer string
+
+	// client sends discovery, key set and token requests
+	client *http.Client
+
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// metadata is nil until discovered
+	metadata *providerMetadata
+
+	// keys holds the signing keys by key ID
+	keys map[string]crypto.PublicKey
+
+	// keysFetched is when keys were last downloaded
+	keysFetched time.Time
+}
+
+// discover returns the provider's metadata, fetching it the first time
+func (p *provider) discover(ctx context.Context) (*providerMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata providerMetadata
+	if err := p.get(ctx, strings.TrimRight(p.issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+
+	if metadata.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovery failed: provider reports issuer %q, expected %q", metadata.Issuer, p.issuer)
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery failed: provider metadata lacks authorization_endpoint, token_endpoint or jwks_uri")
+	}
+
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// key returns the signing key with the given ID. The key set is downloaded
+// again for an unknown ID, at most once per keysRefreshInterval, so keys
+// the provider rotates in are picked up.
+func (p *provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	if !p.keysFetched.IsZero() && time.Since(p.keysFetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.get(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys failed: %w", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		// Keys that cannot be used for signatures are skipped, not fatal
+		if key, err := k.publicKey(); err == nil && (k.Use == "" || k.Use == "sig") {
+			p.keys[k.Kid] = key
+		}
+	}
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns a cached key. A token without key ID matches the only
+// key of a single-key set. Must be called with mu held.
+func (p *provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// get fetches a JSON document
+func (p *provider) get(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxProviderDocument)).Decode(out)
+}
+
+// jwk is a JSON Web Key, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes an RSA or EC key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeInt decodes a base64url encoded big-endian integer
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// minCookieSecret is the shortest secret accepted for sealing cookies
+const minCookieSecret = 32
+
+// sealer encrypts and authenticates cookie values with AES-256-GCM, so
+// clients can neither read nor forge them
+type sealer struct {
+	// aead seals and opens values
+	aead cipher.AEAD
+}
+
+// newSealer derives the cookie key from secret
+func newSealer(secret string) (*sealer, error) {
+	if len(secret) < minCookieSecret {
+		return nil, errors.New("cookie_secret must be at least 32 bytes")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{aead: aead}, nil
+}
+
+// seal encodes v as the value of the named cookie. The name is
+// authenticated with the value, so a value cannot be replayed in another
+// cookie.
+func (s *sealer) seal(name string, v any) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+// open decodes the value of the named cookie into v
+func (s *sealer) open(name, value string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errors.New("cookie was not sealed by this gateway")
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
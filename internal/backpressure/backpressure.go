@@ -0,0 +1,229 @@
+// Package backpressure measures how fast clients read responses and cuts
+// off the ones that read too slowly.
+//
+// The gateway streams upstream responses to clients as they arrive, so a
+// client that reads slowly holds the upstream connection, and the
+// upstream's worker, for as long as it takes. A Monitor wraps the response
+// writer of a route and times every write: writes that block longer than
+// the stall threshold are counted with their duration, so operators can
+// see which routes suffer from slow readers.
+//
+// With a rate floor configured the Monitor also enforces it. Every write
+// gets a fresh deadline of the grace period, replacing the server's write
+// timeout for the whole response, so a client that reads nothing for a
+// grace period fails the write. Once the grace period has passed, a
+// response read slower than the floor on average fails its next write as
+// well. The reverse proxy then aborts the response and releases the
+// upstream connection.
+//
+// Example usage:
+//
+//	monitor, err := backpressure.New(rc.Name, rc.SlowClients)
+//	handler = middleware.Chain(handler, monitor.Middleware())
+package backpressure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Defaults for unset configuration
+const (
+	defaultGracePeriod    = 10 * time.Second
+	defaultStallThreshold = 100 * time.Millisecond
+)
+
+// ErrTooSlow is returned by writes to a client reading slower than the
+// route's floor
+var ErrTooSlow = errors.New("client reads slower than the minimum rate")
+
+// Monitor tracks client writes of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Monitor struct {
+	// route is the name of the monitored route
+	route string
+
+	// minRate is the slowest tolerated average rate in bytes per second,
+	// 0 when not enforced
+	minRate int64
+
+	// grace delays the rate floor and bounds a single write
+	grace time.Duration
+
+	// stallThreshold is how long a write must block to be a stall
+	stallThreshold time.Duration
+
+	// stallNanos is the total time spent in stalled writes
+	stallNanos atomic.Int64
+
+	// stalls counts stalled writes
+	stalls atomic.Int64
+
+	// slowResponses counts responses with at least one stalled write
+	slowResponses atomic.Int64
+
+	// extensions counts write deadlines set in place of the server's
+	// write timeout
+	extensions atomic.Int64
+
+	// aborts counts responses cut off for reading below the floor
+	aborts atomic.Int64
+}
+
+// Stats is a snapshot of a monitor
+type Stats struct {
+	// StallTime is the total time writes to clients spent stalled
+	StallTime time.Duration
+
+	// Stalls counts writes that blocked longer than the threshold
+	Stalls int64
+
+	// SlowResponses counts responses with at least one stalled write
+	SlowResponses int64
+
+	// DeadlineExtensions counts write deadlines extended while enforcing
+	// the rate floor
+	DeadlineExtensions int64
+
+	// Aborts counts responses aborted for reading below the floor
+	Aborts int64
+}
+
+// New creates the monitor of a route
+func New(route string, cfg config.SlowClientConfig) (*Monitor, error) {
+	if cfg.MinBytesPerSecond < 0 {
+		return nil, fmt.Errorf("slow_clients: min_bytes_per_second must not be negative")
+	}
+
+	if cfg.GracePeriod < 0 || cfg.StallThreshold < 0 {
+		return nil, fmt.Errorf("slow_clients: durations must not be negative")
+	}
+
+	m := &Monitor{
+		route:          route,
+		minRate:        cfg.MinBytesPerSecond,
+		grace:          cfg.GracePeriod,
+		stallThreshold: cfg.StallThreshold,
+	}
+
+	if m.grace == 0 {
+		m.grace = defaultGracePeriod
+	}
+
+	if m.stallThreshold == 0 {
+		m.stallThreshold = defaultStallThreshold
+	}
+
+	return m, nil
+}
+
+// Route returns the name of the monitored route
+func (m *Monitor) Route() string {
+	return m.route
+}
+
+// Stats returns the monitor's current statistics
+func (m *Monitor) Stats() Stats {
+	return Stats{
+		StallTime:          time.Duration(m.stallNanos.Load()),
+		Stalls:             m.stalls.Load(),
+		SlowResponses:      m.slowResponses.Load(),
+		DeadlineExtensions: m.extensions.Load(),
+		Aborts:             m.aborts.Load(),
+	}
+}
+
+// Middleware returns a middleware timing response writes and enforcing the
+// rate floor. Returns nil when m is nil.
+func (m *Monitor) Middleware() middleware.Middleware {
+	if m == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&timedWriter{
+				ResponseWriter: w,
+				monitor:        m,
+				controller:     http.NewResponseController(w),
+				start:          time.Now(),
+			}, r)
+		})
+	}
+}
+
+// timedWriter times the writes of one response
+type timedWriter struct {
+	http.ResponseWriter
+
+	// monitor collects the statistics and holds the limits
+	monitor *Monitor
+
+	// controller sets write deadlines on the client connection
+	controller *http.ResponseController
+
+	// start is when the response began
+	start time.Time
+
+	// written is the number of body bytes written
+	written int64
+
+	// stalled reports whether a write of this response stalled
+	stalled bool
+}
+
+// Write implements http.ResponseWriter
+func (t *timedWriter) Write(b []byte) (int, error) {
+	m := t.monitor
+	began := time.Now()
+
+	if m.minRate > 0 {
+		if elapsed := began.Sub(t.start); elapsed > m.grace &&
+			float64(t.written) < float64(m.minRate)*elapsed.Seconds() {
+			m.aborts.Add(1)
+			return 0, ErrTooSlow
+		}
+
+		if err := t.controller.SetWriteDeadline(began.Add(m.grace)); err == nil {
+			m.extensions.Add(1)
+		}
+	}
+
+	n, err := t.ResponseWriter.Write(b)
+	t.written += int64(n)
+
+	blocked := time.Since(began)
+	if err != nil && m.minRate > 0 && blocked >= m.grace {
+		// The client read nothing for a whole grace period
+		m.aborts.Add(1)
+	}
+
+	if blocked > m.stallThreshold {
+		m.stalls.Add(1)
+		m.stallNanos.Add(int64(blocked))
+
+		if !t.stalled {
+			t.stalled = true
+			m.slowResponses.Add(1)
+		}
+	}
+
+	return n, err
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (t *timedWriter) Flush() {
+	t.controller.Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (t *timedWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
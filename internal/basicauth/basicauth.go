@@ -0,0 +1,370 @@
+// Package basicauth protects routes and the admin API with HTTP Basic
+// credentials checked against an htpasswd file.
+//
+// Small internal tools often need a password and nothing more: no
+// identity provider, no token issuance. Operators manage users with
+// Apache's htpasswd tool, and the gateway picks changes to the file up by
+// itself, checking it at most every few seconds.
+//
+// bcrypt hashes are deliberately slow, so the checks that succeeded are
+// remembered, keyed by a salted digest of the credentials, until the file
+// changes. Failures are not, so each client address may only fail a few
+// times per window before its attempts are refused unchecked; unknown
+// users pay for a hash like known ones, so response times do not reveal
+// which names exist.
+//
+// Example usage:
+//
+//	guard, err := basicauth.New("route:internal", rc.BasicAuth, log)
+//	handler = middleware.Chain(handler, guard.Middleware())
+package basicauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/auth"
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+	"velocity/internal/retryafter"
+	"velocity/internal/router"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset configuration
+const (
+	defaultRealm         = "velocity"
+	defaultMaxFailures   = 10
+	defaultFailureWindow = time.Minute
+)
+
+// checkInterval is the shortest time between two checks of the file for
+// changes
+const checkInterval = 5 * time.Second
+
+// maxVerified bounds the remembered successful checks per file version
+const maxVerified = 1024
+
+// Guard checks credentials against an htpasswd file
+//
+// Thread safety: All methods are safe for concurrent use.
+type Guard struct {
+	// scope names what the guard protects, e.g. "route:internal"
+	scope string
+
+	// path is the htpasswd file
+	path string
+
+	// challenge is the WWW-Authenticate value
+	challenge string
+
+	// userHeader carries the user name upstream, empty for none
+	userHeader string
+
+	// failures counts failed attempts by client address
+	failures *ratelimit.TokenBucket
+
+	// key salts the digests of remembered credentials
+	key [32]byte
+
+	// users is the current version of the file
+	users atomic.Pointer[userSet]
+
+	// checked is when the file was last checked, in Unix nanoseconds
+	checked atomic.Int64
+
+	// mu serializes reloads and guards the fields below
+	mu sync.Mutex
+
+	// modTime and size identify the loaded version of the file
+	modTime time.Time
+	size    int64
+
+	// allowed and denied count checks by outcome, throttled the attempts
+	// refused unchecked after too many failures
+	allowed, denied, throttled atomic.Int64
+
+	// logger for file reloads
+	logger *logger.Logger
+}
+
+// userSet is one version of the file
+type userSet struct {
+	// users holds the password verifiers by user name
+	users map[string]verifier
+
+	// mu guards verified
+	mu sync.Mutex
+
+	// verified holds the digests of credentials that matched
+	verified map[[sha256.Size]byte]struct{}
+
+	// dummy is checked for unknown users, so they cost as much as known
+	// ones
+	dummy verifier
+}
+
+// Stats holds a guard's counters
+type Stats struct {
+	// Allowed is the number of requests with valid credentials
+	Allowed int64
+
+	// Denied is the number of requests without valid credentials
+	Denied int64
+
+	// Throttled is the number of requests refused unchecked after too
+	// many failures from their address
+	Throttled int64
+}
+
+// New creates a guard, or returns nil when basic auth is disabled.
+//
+// Returns an error for a missing file or one that does not parse.
+func New(scope string, cfg config.BasicAuthConfig, log *logger.Logger) (*Guard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.File == "" {
+		return nil, fmt.Errorf("basic_auth: file is required")
+	}
+
+	if cfg.MaxFailures < 0 || cfg.FailureWindow < 0 {
+		return nil, fmt.Errorf("basic_auth: max_failures and failure_window must not be negative")
+	}
+
+	realm := cfg.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+
+	maxFailures, window := cfg.MaxFailures, cfg.FailureWindow
+	if maxFailures == 0 {
+		maxFailures = defaultMaxFailures
+	}
+
+	if window == 0 {
+		window = defaultFailureWindow
+	}
+
+	g := &Guard{
+		scope:      scope,
+		path:       cfg.File,
+		challenge:  "Basic realm=" + strconv.Quote(realm) + `, charset="UTF-8"`,
+		userHeader: cfg.UserHeader,
+		failures:   ratelimit.NewTokenBucket(float64(maxFailures)/window.Seconds(), maxFailures),
+		logger:     log.Component("basic_auth").With("scope", scope),
+	}
+	rand.Read(g.key[:])
+
+	info, err := os.Stat(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("basic_auth: %w", err)
+	}
+
+	users, err := parseFile(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("basic_auth: %w", err)
+	}
+
+	g.users.Store(newUserSet(users))
+	g.modTime, g.size = info.ModTime(), info.Size()
+	g.checked.Store(time.Now().UnixNano())
+
+	return g, nil
+}
+
+// newUserSet wraps a parsed file. The first user by name lends its hash
+// as the dummy, so misses cost what the file's hashes cost.
+func newUserSet(users map[string]verifier) *userSet {
+	s := &userSet{users: users, verified: make(map[[sha256.Size]byte]struct{})}
+
+	if names := slices.Sorted(maps.Keys(users)); len(names) > 0 {
+		s.dummy = users[names[0]]
+	}
+
+	return s
+}
+
+// Scope returns what the guard protects
+func (g *Guard) Scope() string {
+	return g.scope
+}
+
+// Stats returns the guard's counters
+func (g *Guard) Stats() Stats {
+	return Stats{Allowed: g.allowed.Load(), Denied: g.denied.Load(), Throttled: g.throttled.Load()}
+}
+
+// Challenge returns the WWW-Authenticate value asking for credentials
+func (g *Guard) Challenge() string {
+	return g.challenge
+}
+
+// Check reports whether user and password match the file, counting the
+// outcome
+func (g *Guard) Check(user, password string) bool {
+	g.reload()
+
+	if g.users.Load().check(g.key, user, password) {
+		g.allowed.Add(1)
+		return true
+	}
+
+	g.denied.Add(1)
+	return false
+}
+
+// check verifies credentials, remembering those that match
+func (s *userSet) check(key [32]byte, user, password string) bool {
+	v, ok := s.users[user]
+	if !ok {
+		if s.dummy != nil {
+			s.dummy.verify(password)
+		}
+		return false
+	}
+
+	digest := sha256.New()
+	digest.Write(key[:])
+	digest.Write([]byte(user))
+	digest.Write([]byte{0})
+	digest.Write([]byte(password))
+
+	var sum [sha256.Size]byte
+	digest.Sum(sum[:0])
+
+	s.mu.Lock()
+	_, known := s.verified[sum]
+	s.mu.Unlock()
+
+	if known {
+		return true
+	}
+
+	if !v.verify(password) {
+		return false
+	}
+
+	s.mu.Lock()
+	if len(s.verified) >= maxVerified {
+		clear(s.verified)
+	}
+	s.verified[sum] = struct{}{}
+	s.mu.Unlock()
+
+	return true
+}
+
+// reload reads the file again when it changed, at most once per
+// checkInterval. A file that cannot be read or parsed is logged and the
+// loaded users are kept.
+func (g *Guard) reload() {
+	if time.Now().UnixNano()-g.checked.Load() < int64(checkInterval) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Another request may have checked while this one waited
+	if time.Now().UnixNano()-g.checked.Load() < int64(checkInterval) {
+		return
+	}
+	g.checked.Store(time.Now().UnixNano())
+
+	info, err := os.Stat(g.path)
+	if err != nil {
+		g.logger.Error("htpasswd file unavailable, keeping the loaded users", "file", g.path, "error", err)
+		return
+	}
+
+	if info.ModTime().Equal(g.modTime) && info.Size() == g.size {
+		return
+	}
+
+	users, err := parseFile(g.path)
+	if err != nil {
+		g.logger.Error("htpasswd file invalid, keeping the loaded users", "file", g.path, "error", err)
+		return
+	}
+
+	g.users.Store(newUserSet(users))
+	g.modTime, g.size = info.ModTime(), info.Size()
+	g.logger.Info("htpasswd file reloaded", "file", g.path, "users", len(users))
+}
+
+// Middleware returns a middleware requiring valid credentials. The user
+// name becomes the sub claim of requests without claims, for the
+// middleware it wraps: rate limit keys, usage metering and script rules
+// see it only when the guard runs outside them. Requests without
+// credentials pass on the anonymous paths of their route. Returns nil when
+// g is nil.
+func (g *Guard) Middleware() middleware.Middleware {
+	if g == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if g.userHeader != "" {
+				r.Header.Del(g.userHeader)
+			}
+
+			user, password, ok := r.BasicAuth()
+			if route, matched := router.RouteFromContext(r.Context()); !ok && matched && route.Anonymous(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Too many failures from one address are refused before
+			// paying for another hash
+			client := ratelimit.ClientIP(r)
+			if state := g.failures.Inspect(client); state.Tokens < 1 {
+				g.throttled.Add(1)
+
+				seconds := retryafter.Set(w, r, state.RetryAfter)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprintf(w, `{"error":"too_many_failures","message":"too many failed attempts","retry_after":%d}`, seconds)
+				return
+			}
+
+			if !ok || !g.Check(user, password) {
+				if !ok {
+					g.denied.Add(1)
+				} else {
+					g.failures.Consume(client, 1)
+				}
+
+				w.Header().Set("WWW-Authenticate", g.challenge)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":"unauthorized","message":"valid credentials required"}`))
+				return
+			}
+
+			// The password is for the gateway only
+			r.Header.Del("Authorization")
+			if g.userHeader != "" {
+				r.Header.Set(g.userHeader, user)
+			}
+
+			if _, ok := auth.ClaimsFromContext(r.Context()); !ok {
+				r = r.WithContext(auth.WithClaims(r.Context(), auth.Claims{"sub": user}))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package basicauth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// newTestGuard creates a guard for a file with the user alice, password
+// "secret"
+func newTestGuard(t *testing.T, cfg config.BasicAuthConfig) *Guard {
+	t.Helper()
+
+	sum := sha1.Sum([]byte("secret"))
+	cfg.Enabled = true
+	cfg.File = filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(cfg.File, []byte("alice:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := New("route:test", cfg, logger.New(logger.LoggerConfig{Output: io.Discard}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return g
+}
+
+func TestRepeatedFailuresFromOneAddressAreThrottled(t *testing.T) {
+	g := newTestGuard(t, config.BasicAuthConfig{MaxFailures: 3})
+	handler := g.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(addr, password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		r.SetBasicAuth("alice", password)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send("10.0.0.1:5000", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d, want 401", i+1, code)
+		}
+	}
+
+	if code := send("10.0.0.1:5001", "guess"); code != http.StatusTooManyRequests {
+		t.Fatalf("attempt after 3 failures: status %d, want 429", code)
+	}
+
+	if code := send("10.0.0.1:5002", "secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("correct password from a throttled address: status %d, want 429", code)
+	}
+
+	if code := send("10.0.0.2:5000", "secret"); code != http.StatusOK {
+		t.Fatalf("other address: status %d, want 200", code)
+	}
+
+	if stats := g.Stats(); stats.Denied != 3 || stats.Throttled != 2 {
+		t.Fatalf("Stats() = %+v, want 3 denied and 2 throttled", stats)
+	}
+}
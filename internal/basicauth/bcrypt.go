@@ -0,0 +1,230 @@
+package basicauth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+)
+
+// bcrypt cost bounds
+const (
+	minBcryptCost = 4
+	maxBcryptCost = 31
+)
+
+// bcryptMagic is encrypted 64 times with the expensive key schedule
+const bcryptMagic = "OrpheanBeholderScryDoubt"
+
+// bcryptEncoding is bcrypt's base64 alphabet, without padding
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptHash is a parsed "$2a$", "$2b$" or "$2y$" hash
+type bcryptHash struct {
+	// cost is the base-2 logarithm of the key schedule rounds
+	cost int
+
+	// salt is the encoded 16 byte salt, 22 characters
+	salt string
+
+	// sum is the encoded 23 byte digest, 31 characters
+	sum string
+}
+
+// parseBcrypt parses a bcrypt hash
+func parseBcrypt(hash string) (*bcryptHash, error) {
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return nil, errors.New("malformed bcrypt hash")
+	}
+
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return nil, errors.New("unsupported bcrypt version")
+	}
+
+	cost, err := strconv.Atoi(hash[4:6])
+	if err != nil || cost < minBcryptCost || cost > maxBcryptCost {
+		return nil, errors.New("invalid bcrypt cost")
+	}
+
+	b := &bcryptHash{cost: cost, salt: hash[7:29], sum: hash[29:]}
+	if _, err := bcryptEncoding.DecodeString(b.salt); err != nil {
+		return nil, errors.New("invalid bcrypt salt")
+	}
+
+	return b, nil
+}
+
+// verify reports whether password matches the hash
+func (b *bcryptHash) verify(password string) bool {
+	salt, err := bcryptEncoding.DecodeString(b.salt)
+	if err != nil {
+		return false
+	}
+
+	sum := bcryptEncoding.EncodeToString(bcrypt([]byte(password), salt, b.cost))
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(b.sum)) == 1
+}
+
+// bcrypt computes the 23 byte digest of password, of which only the first
+// 72 bytes count, including the terminating NUL
+func bcrypt(password, salt []byte, cost int) []byte {
+	key := append(password[:len(password):len(password)], 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+
+	c := newBlowfish()
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	var text [6]uint32
+	j := 0
+	for i := range text {
+		text[i] = word([]byte(bcryptMagic), &j)
+	}
+
+	for i := 0; i < 64; i++ {
+		for j := 0; j < len(text); j += 2 {
+			text[j], text[j+1] = c.encrypt(text[j], text[j+1])
+		}
+	}
+
+	sum := make([]byte, 0, 24)
+	for _, w := range text {
+		sum = append(sum, byte(w>>24), byte(w>>16), byte(w>>8), byte(w))
+	}
+
+	return sum[:23]
+}
+
+// blowfish is the Blowfish cipher state
+type blowfish struct {
+	// p is the subkey array
+	p [18]uint32
+
+	// s are the substitution boxes
+	s [4][256]uint32
+}
+
+// piWords holds the fractional part of pi as the initial Blowfish state:
+// 18 subkeys followed by 4 S-boxes of 256 words
+var piWords = sync.OnceValue(func() []uint32 {
+	const words = 18 + 4*256
+
+	// pi = 16 arctan(1/5) - 4 arctan(1/239), in fixed point with guard bits
+	bits := uint(words*32 + 64)
+	pi := new(big.Int).Mul(arctanInverse(5, bits), big.NewInt(16))
+	pi.Sub(pi, new(big.Int).Mul(arctanInverse(239, bits), big.NewInt(4)))
+
+	// Drop the guard bits and the integer part, 3
+	pi.Rsh(pi, 64)
+	pi.Sub(pi, new(big.Int).Lsh(big.NewInt(3), words*32))
+
+	out := make([]uint32, words)
+	mask := big.NewInt(0xffffffff)
+	for i := words - 1; i >= 0; i-- {
+		out[i] = uint32(new(big.Int).And(pi, mask).Uint64())
+		pi.Rsh(pi, 32)
+	}
+
+	return out
+})
+
+// arctanInverse returns arctan(1/x) scaled by 2^bits
+func arctanInverse(x int64, bits uint) *big.Int {
+	sum := new(big.Int)
+	term := new(big.Int).Lsh(big.NewInt(1), bits)
+	term.Quo(term, big.NewInt(x))
+
+	x2 := big.NewInt(x * x)
+	quotient := new(big.Int)
+	for k := int64(0); term.Sign() != 0; k++ {
+		quotient.Quo(term, big.NewInt(2*k+1))
+		if k%2 == 0 {
+			sum.Add(sum, quotient)
+		} else {
+			sum.Sub(sum, quotient)
+		}
+
+		term.Quo(term, x2)
+	}
+
+	return sum
+}
+
+// newBlowfish returns the initial cipher state
+func newBlowfish() *blowfish {
+	c := &blowfish{}
+	pi := piWords()
+
+	copy(c.p[:], pi)
+	for i := range c.s {
+		copy(c.s[i][:], pi[18+256*i:])
+	}
+
+	return c
+}
+
+// expandKey mixes key, and salt unless nil, into the state
+func (c *blowfish) expandKey(key, salt []byte) {
+	j := 0
+	for i := range c.p {
+		c.p[i] ^= word(key, &j)
+	}
+
+	j = 0
+	var l, r uint32
+	next := func() {
+		if salt != nil {
+			l ^= word(salt, &j)
+			r ^= word(salt, &j)
+		}
+		l, r = c.encrypt(l, r)
+	}
+
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+
+	for i := range c.s {
+		for k := 0; k < 256; k += 2 {
+			next()
+			c.s[i][k], c.s[i][k+1] = l, r
+		}
+	}
+}
+
+// encrypt enciphers one block
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i <= 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+
+	return r ^ c.p[17], l
+}
+
+// f is the Blowfish round function
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) + c.s[3][x&0xff]
+}
+
+// word reads the next big-endian word of data at *j, cycling through data
+func word(data []byte, j *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(data[*j])
+		*j = (*j + 1) % len(data)
+	}
+
+	return w
+}
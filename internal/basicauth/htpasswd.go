@@ -0,0 +1,189 @@
+package basicauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// verifier checks passwords against one user's stored hash
+type verifier interface {
+	verify(password string) bool
+}
+
+// parseFile reads an htpasswd file into verifiers by user name.
+//
+// Returns an error for an unreadable file, a line without "user:hash", a
+// duplicate user or a hash in an unsupported format.
+func parseFile(path string) (map[string]verifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]verifier)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", path, line, user)
+		}
+
+		v, err := parseHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q: %w", path, line, user, err)
+		}
+
+		users[user] = v
+	}
+
+	return users, scanner.Err()
+}
+
+// parseHash recognizes the hash formats written by htpasswd -B, -m and -s.
+// Plain text and DES crypt passwords are refused.
+func parseHash(hash string) (verifier, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return parseBcrypt(hash)
+
+	case strings.HasPrefix(hash, apr1Magic):
+		return parseAPR1(hash)
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):])
+		if err != nil || len(sum) != sha1.Size {
+			return nil, errors.New("malformed {SHA} hash")
+		}
+
+		return shaHash(sum), nil
+	}
+
+	return nil, errors.New("unsupported hash format, expected bcrypt ($2y$), MD5 ($apr1$) or SHA-1 ({SHA})")
+}
+
+// shaHash is a "{SHA}" hash: the unsalted SHA-1 digest of the password
+type shaHash []byte
+
+// verify reports whether password matches the hash
+func (h shaHash) verify(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], h) == 1
+}
+
+// apr1Magic prefixes Apache's MD5-crypt variant
+const apr1Magic = "$apr1$"
+
+// apr1Alphabet encodes MD5-crypt digests
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Hash is an "$apr1$salt$digest" hash
+type apr1Hash struct {
+	// salt is at most 8 characters
+	salt string
+
+	// hash is the full stored hash
+	hash string
+}
+
+// parseAPR1 parses an Apache MD5 hash
+func parseAPR1(hash string) (*apr1Hash, error) {
+	salt, sum, ok := strings.Cut(hash[len(apr1Magic):], "$")
+	if !ok || len(salt) == 0 || len(salt) > 8 || len(sum) != 22 {
+		return nil, errors.New("malformed $apr1$ hash")
+	}
+
+	return &apr1Hash{salt: salt, hash: hash}, nil
+}
+
+// verify reports whether password matches the hash
+func (h *apr1Hash) verify(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(apr1(password, h.salt)), []byte(h.hash)) == 1
+}
+
+// apr1 computes the MD5-crypt hash of password, with the "$apr1$" magic
+func apr1(password, salt string) string {
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	alt := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write([]byte(salt))
+	for n := len(pw); n > 0; n -= md5.Size {
+		ctx.Write(alt[:min(n, md5.Size)])
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	// 1000 rounds slow down guessing
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+
+		sum = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(apr1Magic + salt + "$")
+
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[group[0]])<<16|uint32(sum[group[1]])<<8|uint32(sum[group[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+
+	return out.String()
+}
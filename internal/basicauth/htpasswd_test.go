@@ -0,0 +1,55 @@
+package basicauth
+
+import "testing"
+
+func TestBcryptKnownAnswers(t *testing.T) {
+	// OpenBSD bcrypt test vectors
+	tests := []struct{ password, hash string }{
+		{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+		{"a", "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"},
+		{"abc", "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+		{"abcdefghijklmnopqrstuvwxyz", "$2a$06$.rCVZVOThsIa97pEDOxvGuRRgzG64bvtJ0938xuqzv18d3ZpQhstC"},
+		{"~!@#$%^&*()      ~!@#$%^&*()PNBFRD", "$2a$06$fPIsBO8qRqkjj273rfaOI.HtSV9jLDpTbZn782DC6/t7qT67P6FfO"},
+	}
+
+	for _, tt := range tests {
+		v, err := parseHash(tt.hash)
+		if err != nil {
+			t.Fatalf("parseHash(%q) error = %v", tt.hash, err)
+		}
+
+		if !v.verify(tt.password) {
+			t.Errorf("%s does not verify %q", tt.hash, tt.password)
+		}
+
+		if v.verify(tt.password + "x") {
+			t.Errorf("%s verifies %q", tt.hash, tt.password+"x")
+		}
+	}
+}
+
+func TestAPR1KnownAnswers(t *testing.T) {
+	// Produced by openssl passwd -apr1 -salt SALT PASSWORD
+	tests := []struct{ password, hash string }{
+		{"", "$apr1$r31.....$iQoXxeL5pW.kaXVrniDCU0"},
+		{"password", "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0"},
+		{"myPassword!", "$apr1$r31.....$QPtWIsThW3EUB9qmVRmqq1"},
+		{"correct horse", "$apr1$abcdefgh$sIQmFnT1CuEXAsyjuXjUX/"},
+		{"a", "$apr1$x$16j9.5e7KiXmuYFAYpPJM/"},
+	}
+
+	for _, tt := range tests {
+		v, err := parseHash(tt.hash)
+		if err != nil {
+			t.Fatalf("parseHash(%q) error = %v", tt.hash, err)
+		}
+
+		if !v.verify(tt.password) {
+			t.Errorf("%s does not verify %q", tt.hash, tt.password)
+		}
+
+		if v.verify(tt.password + "x") {
+			t.Errorf("%s verifies %q", tt.hash, tt.password+"x")
+		}
+	}
+}
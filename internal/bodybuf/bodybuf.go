@@ -0,0 +1,157 @@
+// Package bodybuf shares one bounded buffer of a request body between the
+// components that need to inspect it.
+//
+// Retries, request signing and body validation all need the complete
+// request body. Buffering it separately in each of them reads the client
+// stream once and copies it again for every consumer, with each one
+// applying its own size limit. Instead, a Buffer travels in the request
+// context: the first consumer reads the body into it, within the memory
+// budget and the route's size cap, and every later consumer gets the same
+// bytes back with the request body rewound to its start.
+//
+// Bodies over the cap are not buffered. The first consumer puts the bytes
+// it consumed back in front of the unread stream, and every consumer is
+// told the body is not available so it can stream, skip or reject:
+//
+//	handler = middleware.Chain(handler, bodybuf.Middleware(rc.BodyInspection.MaxBytes))
+//	...
+//	data, ok, err := bodybuf.Read(r, defaultLimit)
+package bodybuf
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+)
+
+// Buffer holds the body of one request once it has been read
+//
+// Thread safety: All methods are safe for concurrent use.
+type Buffer struct {
+	// limit is the largest body buffered
+	limit int64
+
+	// once guards reading the body
+	once sync.Once
+
+	// data is the complete body when ok
+	data []byte
+
+	// ok reports whether the body fit within limit and the budget
+	ok bool
+
+	// err is the error reading the body
+	err error
+
+	// mu guards release
+	mu sync.Mutex
+
+	// release returns the buffered bytes to the memory budget
+	release func()
+}
+
+// bufferKey is the context key for the request's buffer
+type bufferKey struct{}
+
+// FromContext returns the request's buffer, or nil if none is attached
+func FromContext(ctx context.Context) *Buffer {
+	buf, _ := ctx.Value(bufferKey{}).(*Buffer)
+	return buf
+}
+
+// Attach returns a copy of r carrying a buffer capped at limit, and a
+// function releasing the buffered bytes once the request is done. A
+// request already carrying a buffer is returned unchanged with a no-op
+// release, so the outermost cap wins.
+func Attach(r *http.Request, limit int64) (*http.Request, func()) {
+	if FromContext(r.Context()) != nil {
+		return r, func() {}
+	}
+
+	buf := &Buffer{limit: limit}
+	return r.WithContext(context.WithValue(r.Context(), bufferKey{}, buf)), buf.free
+}
+
+// Middleware returns a middleware attaching a buffer capped at limit to
+// every request, or nil when limit is not positive
+func Middleware(limit int64) middleware.Middleware {
+	if limit <= 0 {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, release := Attach(r, limit)
+			defer release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Read returns the complete body of r, reading it into the request's
+// buffer on the first call. When ok, r.Body is replaced by a reader
+// positioned at the start of the body, so it can be read again.
+//
+// When r carries no buffer, the body is buffered for this caller alone
+// with fallbackLimit; the bytes then return to the memory budget when
+// r.Body is closed.
+//
+// Returns ok false when the body is too large for the cap or the memory
+// budget; r.Body then still yields the complete body as a stream, but
+// only once.
+func Read(r *http.Request, fallbackLimit int64) (data []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	buf := FromContext(r.Context())
+	shared := buf != nil
+	if !shared {
+		buf = &Buffer{limit: fallbackLimit}
+	}
+
+	buf.once.Do(func() {
+		var release func()
+		var replay io.ReadCloser
+
+		buf.data, release, replay, buf.ok, buf.err = membudget.BufferBody(
+			membudget.FromContext(r.Context()), r.Body, buf.limit)
+
+		buf.mu.Lock()
+		buf.release = release
+		buf.mu.Unlock()
+
+		if replay != nil {
+			r.Body = replay
+		}
+	})
+
+	if buf.err != nil || !buf.ok {
+		return nil, false, buf.err
+	}
+
+	if shared {
+		r.Body = io.NopCloser(bytes.NewReader(buf.data))
+	} else {
+		r.Body = membudget.NewBody(buf.data, buf.free)
+	}
+	r.ContentLength = int64(len(buf.data))
+	return buf.data, true, nil
+}
+
+// free returns the buffered bytes to the memory budget
+func (b *Buffer) free() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+}
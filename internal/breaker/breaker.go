@@ -0,0 +1,453 @@
+// Package breaker fast-fails a route while its backend service is failing.
+//
+// Outlier detection ejects single targets, which cannot help when every
+// target behind a route fails: the route keeps sending requests that wait
+// for timeouts and add load to a service trying to recover. A route's
+// breaker counts the route's outcomes across all its targets and opens
+// once they cross a threshold; requests are then answered with the
+// route's fallback without reaching the upstream. After the open duration
+// a few trial requests are let through, and the circuit closes when they
+// succeed. Other routes sharing the same targets keep their own breakers,
+// or none, and are unaffected.
+//
+// Example usage:
+//
+//	b, err := breaker.New(rc.Name, rc.CircuitBreaker, log)
+//	handler = middleware.Chain(handler, b.Middleware())
+package breaker
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/retryafter"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset configuration
+const (
+	defaultConsecutiveFailures = 5
+	defaultMinRequests         = 20
+	defaultWindow              = 10 * time.Second
+	defaultOpenDuration        = 30 * time.Second
+	defaultHalfOpenRequests    = 1
+	defaultFallbackStatus      = http.StatusServiceUnavailable
+)
+
+// State is the state of a circuit
+type State int
+
+// Circuit states
+const (
+	// Closed lets every request through
+	Closed State = iota
+
+	// Open answers every request with the fallback
+	Open
+
+	// HalfOpen lets trial requests through to decide whether to close
+	HalfOpen
+)
+
+// String returns the state's name
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// outcome is the result of a request let through the circuit
+type outcome int
+
+const (
+	success outcome = iota
+	failure
+
+	// canceled requests were abandoned by their client and say nothing
+	// about the upstream
+	canceled
+)
+
+// Breaker is the circuit breaker of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Breaker struct {
+	// route is the name of the protected route
+	route string
+
+	// consecutive opens the circuit after this many failures in a row,
+	// zero to disable
+	consecutive int
+
+	// ratio opens the circuit when this share of a window fails, zero to
+	// disable
+	ratio float64
+
+	// minRequests is the number of requests a window needs before ratio
+	// is evaluated
+	minRequests int
+
+	// window is the period requests are counted over for ratio
+	window time.Duration
+
+	// openDuration is how long the circuit stays open
+	openDuration time.Duration
+
+	// halfOpen is the number of trial requests while half-open
+	halfOpen int
+
+	// fallback answers requests while the circuit is open
+	fallback config.CircuitFallbackConfig
+
+	// mu guards the fields below it
+	mu sync.Mutex
+
+	// state is the current state of the circuit
+	state State
+
+	// generation increments on every state change, so outcomes of
+	// requests admitted in an earlier state are ignored
+	generation uint64
+
+	// inRow is the number of failures in a row while closed
+	inRow int
+
+	// windowStart is when the current counting window began
+	windowStart time.Time
+
+	// requests and failures count the current window
+	requests, failures int
+
+	// openUntil is when an open circuit becomes half-open
+	openUntil time.Time
+
+	// trials is the number of trial requests admitted while half-open,
+	// and passed the number of those that succeeded
+	trials, passed int
+
+	// opens and rejected count for Stats
+	opens, rejected atomic.Int64
+
+	// now is the clock, replaceable for deterministic behaviour
+	now func() time.Time
+
+	// logger for state changes
+	logger *logger.Logger
+}
+
+// Stats holds a breaker's state and counters
+type Stats struct {
+	// State is the current state of the circuit
+	State State
+
+	// Opens is the number of times the circuit opened
+	Opens int64
+
+	// Rejected is the number of requests answered with the fallback
+	Rejected int64
+}
+
+// ticket identifies a request let through the circuit
+type ticket struct {
+	// generation is the breaker generation that admitted the request
+	generation uint64
+
+	// trial reports whether the request is a half-open trial
+	trial bool
+}
+
+// New creates the circuit breaker of a route, or returns nil when it is
+// disabled.
+//
+// Returns an error for negative thresholds or durations, a failure ratio
+// above 1 or an invalid fallback status.
+func New(route string, cfg config.CircuitBreakerConfig, log *logger.Logger) (*Breaker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	switch {
+	case cfg.ConsecutiveFailures < 0 || cfg.MinRequests < 0 || cfg.HalfOpenRequests < 0:
+		return nil, fmt.Errorf("circuit_breaker: consecutive_failures, min_requests and half_open_requests must not be negative")
+	case cfg.FailureRatio < 0 || cfg.FailureRatio > 1:
+		return nil, fmt.Errorf("circuit_breaker: failure_ratio must be between 0 and 1")
+	case cfg.Window < 0 || cfg.OpenDuration < 0:
+		return nil, fmt.Errorf("circuit_breaker: window and open_duration must not be negative")
+	case cfg.Fallback.Status != 0 && (cfg.Fallback.Status < 200 || cfg.Fallback.Status > 599):
+		return nil, fmt.Errorf("circuit_breaker: invalid fallback status %d", cfg.Fallback.Status)
+	}
+
+	b := &Breaker{
+		route:        route,
+		consecutive:  cfg.ConsecutiveFailures,
+		ratio:        cfg.FailureRatio,
+		minRequests:  cfg.MinRequests,
+		window:       cfg.Window,
+		openDuration: cfg.OpenDuration,
+		halfOpen:     cfg.HalfOpenRequests,
+		fallback:     cfg.Fallback,
+		now:          time.Now,
+		logger:       log.Component("breaker").With("route", route),
+	}
+
+	if b.consecutive == 0 && b.ratio == 0 {
+		b.consecutive = defaultConsecutiveFailures
+	}
+
+	if b.minRequests == 0 {
+		b.minRequests = defaultMinRequests
+	}
+
+	if b.window == 0 {
+		b.window = defaultWindow
+	}
+
+	if b.openDuration == 0 {
+		b.openDuration = defaultOpenDuration
+	}
+
+	if b.halfOpen == 0 {
+		b.halfOpen = defaultHalfOpenRequests
+	}
+
+	if b.fallback.Status == 0 {
+		b.fallback.Status = defaultFallbackStatus
+	}
+
+	if b.fallback.ContentType == "" {
+		b.fallback.ContentType = "text/plain; charset=utf-8"
+	}
+
+	b.windowStart = b.now()
+	return b, nil
+}
+
+// Route returns the name of the protected route
+func (b *Breaker) Route() string {
+	return b.route
+}
+
+// Stats returns the breaker's current state and counters
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	state := b.state
+	if state == Open && !b.now().Before(b.openUntil) {
+		state = HalfOpen
+	}
+	b.mu.Unlock()
+
+	return Stats{
+		State:    state,
+		Opens:    b.opens.Load(),
+		Rejected: b.rejected.Load(),
+	}
+}
+
+// Middleware returns a middleware answering requests with the fallback
+// while the circuit is open and recording the outcome of the others.
+// Returns nil when b is nil.
+func (b *Breaker) Middleware() middleware.Middleware {
+	if b == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok, wait := b.allow()
+			if !ok {
+				b.rejected.Add(1)
+				b.reject(w, r, wait)
+				return
+			}
+
+			// A panic counts as a failure
+			result := failure
+			defer func() { b.record(t, result) }()
+
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			switch {
+			case recorder.status >= http.StatusInternalServerError:
+				result = failure
+			case r.Context().Err() != nil:
+				result = canceled
+			default:
+				result = success
+			}
+		})
+	}
+}
+
+// allow decides whether a request may be let through. When it may not,
+// the returned duration is how long until the circuit lets trial requests
+// through.
+func (b *Breaker) allow() (ticket, bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	if b.state == Open {
+		if now.Before(b.openUntil) {
+			return ticket{}, false, b.openUntil.Sub(now)
+		}
+
+		b.transition(HalfOpen)
+	}
+
+	if b.state == HalfOpen {
+		if b.trials >= b.halfOpen {
+			// Trial requests are in flight, their outcome decides when
+			// the next requests get through
+			return ticket{}, false, 0
+		}
+
+		b.trials++
+		return ticket{generation: b.generation, trial: true}, true, 0
+	}
+
+	return ticket{generation: b.generation}, true, 0
+}
+
+// record applies the outcome of a request let through the circuit
+func (b *Breaker) record(t ticket, result outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t.generation != b.generation {
+		return
+	}
+
+	if t.trial {
+		switch result {
+		case canceled:
+			// Free the slot for another trial
+			b.trials--
+		case failure:
+			b.open("trial request failed")
+		case success:
+			b.passed++
+			if b.passed >= b.halfOpen {
+				b.transition(Closed)
+				b.logger.Info("Circuit closed")
+			}
+		}
+
+		return
+	}
+
+	if result == canceled {
+		return
+	}
+
+	now := b.now()
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+
+	b.requests++
+	if result == success {
+		b.inRow = 0
+		return
+	}
+
+	b.failures++
+	b.inRow++
+
+	switch {
+	case b.consecutive > 0 && b.inRow >= b.consecutive:
+		b.open(fmt.Sprintf("%d consecutive failures", b.inRow))
+	case b.ratio > 0 && b.requests >= b.minRequests && float64(b.failures) >= b.ratio*float64(b.requests):
+		b.open(fmt.Sprintf("%d of %d requests failed", b.failures, b.requests))
+	}
+}
+
+// open opens the circuit for the open duration. Must be called with mu
+// held.
+func (b *Breaker) open(reason string) {
+	b.transition(Open)
+	b.openUntil = b.now().Add(b.openDuration)
+	b.opens.Add(1)
+
+	b.logger.Warn("Circuit opened", "reason", reason, "duration", b.openDuration)
+}
+
+// transition moves the circuit to state and resets the counters. Must be
+// called with mu held.
+func (b *Breaker) transition(state State) {
+	b.state = state
+	b.generation++
+	b.inRow, b.requests, b.failures = 0, 0, 0
+	b.windowStart = b.now()
+	b.trials, b.passed = 0, 0
+}
+
+// reject answers a request with the fallback
+func (b *Breaker) reject(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := retryafter.Set(w, r, wait)
+
+	if b.fallback.Body == "" {
+		err := gwerrors.New(gwerrors.CodeCircuitOpen, "Circuit breaker is open").
+			WithContext("route", b.route).
+			WithContext("retry_after", seconds)
+		err.StatusCode = b.fallback.Status
+		err.WriteJSON(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", b.fallback.ContentType)
+	w.WriteHeader(b.fallback.Status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(b.fallback.Body))
+	}
+}
+
+// statusRecorder captures the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+
+	// status is the final response status, zero until written
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 && status >= http.StatusOK {
+		s.status = status
+	}
+
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
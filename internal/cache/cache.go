@@ -0,0 +1,687 @@
+// Package cache provides a per-route in-memory response cache.
+//
+// Successful responses to anonymous GET requests are stored for the
+// route's TTL and served without contacting upstreams. Two headers let
+// operators and backends steer the cache:
+//
+//	X-Cache-Bypass: <admin token>   (request) skip the cache and refresh
+//	                                 the entry from the upstream
+//	X-Velocity-Cache-TTL: 30s       (response) store this response for
+//	                                 30s instead of the route TTL; "0"
+//	                                 disables caching of the response
+//
+// Bypass headers are only honored when their value matches the admin
+// token, so anonymous clients cannot force cache misses onto upstreams.
+// The TTL header is always removed before the response reaches clients.
+//
+// With negative caching enabled, 404 and 410 responses are stored for the
+// negative TTL and 5xx responses for the error TTL, both usually much
+// shorter than the route TTL. A write to a path, any POST, PUT, PATCH or
+// DELETE request, invalidates the negative entries of that path, so a
+// resource created through the gateway is found right away.
+//
+// Requests carrying credentials, an Authorization or Cookie header, are
+// never answered from the cache of a shared route: the response may be
+// meant for that consumer only. Routes marked private cache them under the
+// consumer's identity instead, taken from a key expression such as
+// "claim.sub" or from request headers, Authorization and Cookie by default.
+// Requests whose identity cannot be determined are not cached. Responses
+// setting cookies or carrying credentials are never stored unless the
+// route configures other uncacheable headers.
+//
+// Example usage:
+//
+//	c, err := cache.New(rc.Name, rc.Cache, budget, adminToken)
+//	handler = middleware.Chain(handler, c.Middleware())
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/accesslog"
+	"velocity/internal/config"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+)
+
+// TTLHeader lets upstreams override the route TTL per response
+const TTLHeader = "X-Velocity-Cache-TTL"
+
+// Defaults for unset configuration
+const (
+	defaultMaxTTL       = 24 * time.Hour
+	defaultMaxEntries   = 1000
+	defaultMaxBodyBytes = 1 << 20
+)
+
+var (
+	defaultKeyHeaders         = []string{"Authorization", "Cookie"}
+	defaultUncacheableHeaders = []string{"Set-Cookie", "Authorization"}
+)
+
+// Cache stores the responses of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Cache struct {
+	// route is the name of the cached route
+	route string
+
+	// ttl is the default lifetime of an entry
+	ttl time.Duration
+
+	// maxTTL caps upstream TTL overrides
+	maxTTL time.Duration
+
+	// negativeTTL is the lifetime of 404 and 410 entries, 0 when they are
+	// not stored
+	negativeTTL time.Duration
+
+	// errorTTL is the lifetime of 5xx entries, 0 when they are not stored
+	errorTTL time.Duration
+
+	// maxEntries bounds the number of entries
+	maxEntries int
+
+	// maxBody is the largest body stored
+	maxBody int64
+
+	// bypassHeaders are the request headers that skip the cache
+	bypassHeaders []string
+
+	// adminToken resolves the token bypass headers must carry
+	adminToken func() (string, error)
+
+	// private keys entries of requests with credentials by consumer
+	private bool
+
+	// consumerKey identifies the consumer on private routes, nil when only
+	// keyHeaders do
+	consumerKey ratelimit.KeyFunc
+
+	// keyHeaders are the canonical names of the request headers
+	// identifying the consumer on private routes
+	keyHeaders []string
+
+	// uncacheable are the response headers that keep a response out of
+	// the cache
+	uncacheable []string
+
+	// budget is charged for stored bodies
+	budget *membudget.Budget
+
+	// mu guards entries and lru
+	mu sync.Mutex
+
+	// entries indexes lru elements by key
+	entries map[string]*list.Element
+
+	// lru orders entries from most to least recently used
+	lru *list.List
+
+	// negatives indexes the keys of negative entries by host and path for
+	// invalidation
+	negatives map[string]map[string]struct{}
+
+	// hits, misses and bypasses count lookups by outcome
+	hits, misses, bypasses atomic.Int64
+
+	// invalidations counts negative entries removed by writes
+	invalidations atomic.Int64
+}
+
+// entry is a stored response
+type entry struct {
+	// key identifies the request
+	key string
+
+	// path is the host and path of the request, set for negative entries
+	path string
+
+	// status is the stored response status
+	status int
+
+	// header and body are the stored response
+	header http.Header
+	body   []byte
+
+	// stored and expires bound the entry's lifetime
+	stored, expires time.Time
+}
+
+// size is the number of budget bytes an entry holds
+func (e *entry) size() int64 {
+	return int64(len(e.body))
+}
+
+// Stats is a snapshot of a cache
+type Stats struct {
+	// Entries is the number of stored responses
+	Entries int
+
+	// Hits counts responses served from the cache
+	Hits int64
+
+	// Misses counts cacheable requests fetched upstream
+	Misses int64
+
+	// Bypasses counts requests that skipped the cache on an admin's request
+	Bypasses int64
+
+	// Invalidations counts negative entries removed by writes to their path
+	Invalidations int64
+}
+
+// New creates the cache of a route, or returns nil when caching is
+// disabled. adminToken resolves the token bypass headers must match.
+func New(route string, cfg config.CacheConfig, budget *membudget.Budget,
+	adminToken func() (string, error)) (*Cache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("cache: ttl must be positive")
+	}
+
+	if cfg.NegativeTTL < 0 || cfg.ErrorTTL < 0 {
+		return nil, fmt.Errorf("cache: negative_ttl and error_ttl must not be negative")
+	}
+
+	if !cfg.Private && (cfg.ConsumerKey != "" || len(cfg.KeyHeaders) > 0) {
+		return nil, fmt.Errorf("cache: consumer_key and key_headers require private")
+	}
+
+	c := &Cache{
+		route:         route,
+		ttl:           cfg.TTL,
+		maxTTL:        cfg.MaxTTL,
+		negativeTTL:   cfg.NegativeTTL,
+		errorTTL:      cfg.ErrorTTL,
+		maxEntries:    cfg.MaxEntries,
+		maxBody:       cfg.MaxBodyBytes,
+		bypassHeaders: cfg.BypassHeaders,
+		adminToken:    adminToken,
+		private:       cfg.Private,
+		uncacheable:   cfg.UncacheableHeaders,
+		budget:        budget,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		negatives:     make(map[string]map[string]struct{}),
+	}
+
+	if c.maxTTL <= 0 {
+		c.maxTTL = defaultMaxTTL
+	}
+
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultMaxEntries
+	}
+
+	if c.maxBody <= 0 {
+		c.maxBody = defaultMaxBodyBytes
+	}
+
+	if len(c.bypassHeaders) == 0 {
+		c.bypassHeaders = []string{"X-Cache-Bypass"}
+	}
+
+	if len(c.uncacheable) == 0 {
+		c.uncacheable = defaultUncacheableHeaders
+	}
+
+	if cfg.ConsumerKey != "" {
+		consumerKey, err := ratelimit.ParseKey(cfg.ConsumerKey)
+		if err != nil {
+			return nil, fmt.Errorf("cache: consumer_key: %w", err)
+		}
+		c.consumerKey = consumerKey
+	}
+
+	keyHeaders := cfg.KeyHeaders
+	if c.private && c.consumerKey == nil && len(keyHeaders) == 0 {
+		keyHeaders = defaultKeyHeaders
+	}
+
+	for _, name := range keyHeaders {
+		c.keyHeaders = append(c.keyHeaders, http.CanonicalHeaderKey(name))
+	}
+
+	return c, nil
+}
+
+// Route returns the name of the cached route
+func (c *Cache) Route() string {
+	return c.route
+}
+
+// Stats returns the cache's current statistics
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return Stats{
+		Entries:       entries,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Bypasses:      c.bypasses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+// Middleware returns a middleware serving cached responses and storing
+// cacheable ones. Returns nil when c is nil.
+func (c *Cache) Middleware() middleware.Middleware {
+	if c == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := c.requestKey(r)
+			if !ok {
+				next.ServeHTTP(&ttlStripper{ResponseWriter: w}, r)
+
+				if writeRequest(r) {
+					c.invalidate(pathKey(r))
+				}
+				return
+			}
+
+			logEntry := accesslog.FromContext(r.Context())
+
+			if c.bypassed(r) {
+				c.bypasses.Add(1)
+				if logEntry != nil {
+					logEntry.Cache = accesslog.CacheBypass
+				}
+			} else if cached := c.lookup(key); cached != nil {
+				c.hits.Add(1)
+				if logEntry != nil {
+					logEntry.Cache = accesslog.CacheHit
+				}
+
+				for name, values := range cached.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+				w.WriteHeader(cached.status)
+				w.Write(cached.body)
+				return
+			} else {
+				c.misses.Add(1)
+				if logEntry != nil {
+					logEntry.Cache = accesslog.CacheMiss
+				}
+			}
+
+			rec := &recorder{ttlStripper: ttlStripper{ResponseWriter: w}, cache: c}
+			next.ServeHTTP(rec, r)
+
+			// A body shorter than announced was cut off and is not stored
+			if rec.cacheable && middleware.CompleteBody(rec.header, rec.body.Len()) {
+				c.store(key, pathKey(r), rec.status, rec.header, rec.body.Bytes(), rec.ttl)
+			}
+		})
+	}
+}
+
+// requestKey identifies the response to a request, reporting false when
+// the request may not be answered from the cache. Accept-Encoding is part
+// of the key because upstreams may compress differently per client.
+//
+// On private routes the consumer's identity is part of the key too. Every
+// component is quoted so that no client can craft header values giving
+// another consumer's key.
+func (c *Cache) requestKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet {
+		return "", false
+	}
+
+	credentials := r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+	if !c.private {
+		return r.Host + "|" + r.URL.RequestURI() + "|" + r.Header.Get("Accept-Encoding"), !credentials
+	}
+
+	parts := []string{r.Host, r.URL.RequestURI(), r.Header.Get("Accept-Encoding")}
+	identified := false
+
+	if c.consumerKey != nil {
+		consumer := c.consumerKey(r)
+		identified = consumer != ""
+		parts = append(parts, consumer)
+	}
+
+	for _, name := range c.keyHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		identified = identified || value != ""
+		parts = append(parts, value)
+	}
+
+	// Credentials the key cannot tell apart must not share an entry
+	if credentials && !identified {
+		return "", false
+	}
+
+	for i, part := range parts {
+		parts[i] = strconv.Quote(part)
+	}
+
+	return strings.Join(parts, "|"), true
+}
+
+// writeRequest reports whether a request may change the resource at its
+// path
+func writeRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// pathKey identifies the resource a request addresses, regardless of its
+// query string
+func pathKey(r *http.Request) string {
+	return r.Host + "|" + r.URL.Path
+}
+
+// bypassed reports whether the request carries a bypass header set to the
+// admin token
+func (c *Cache) bypassed(r *http.Request) bool {
+	var presented string
+	for _, name := range c.bypassHeaders {
+		if presented = r.Header.Get(name); presented != "" {
+			break
+		}
+	}
+
+	if presented == "" {
+		return false
+	}
+
+	token, err := c.adminToken()
+	if err != nil || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// lookup returns the live entry for key, or nil
+func (c *Cache) lookup(key string) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	cached := element.Value.(*entry)
+	if time.Now().After(cached.expires) {
+		c.remove(element)
+		return nil
+	}
+
+	c.lru.MoveToFront(element)
+	return cached
+}
+
+// store adds or replaces the entry for key, evicting the least recently
+// used entries beyond the limit. Nothing is stored if the memory budget is
+// exhausted.
+func (c *Cache) store(key, path string, status int, header http.Header, body []byte, ttl time.Duration) {
+	now := time.Now()
+	stored := &entry{
+		key:     key,
+		status:  status,
+		header:  header,
+		body:    bytes.Clone(body),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	if status != http.StatusOK {
+		stored.path = path
+	}
+
+	if !c.budget.Reserve(stored.size()) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	c.entries[key] = c.lru.PushFront(stored)
+
+	if stored.path != "" {
+		if c.negatives[path] == nil {
+			c.negatives[path] = make(map[string]struct{})
+		}
+		c.negatives[path][key] = struct{}{}
+	}
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry and returns its memory to the budget. Must be
+// called with c.mu held.
+func (c *Cache) remove(element *list.Element) {
+	removed := c.lru.Remove(element).(*entry)
+	delete(c.entries, removed.key)
+	c.budget.Release(removed.size())
+
+	if removed.path != "" {
+		delete(c.negatives[removed.path], removed.key)
+		if len(c.negatives[removed.path]) == 0 {
+			delete(c.negatives, removed.path)
+		}
+	}
+}
+
+// invalidate removes the negative entries of a path
+func (c *Cache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.negatives[path] {
+		c.remove(c.entries[key])
+		c.invalidations.Add(1)
+	}
+}
+
+// policy decides whether a response may be stored and for how long
+func (c *Cache) policy(status int, header http.Header) (time.Duration, bool) {
+	ttl := c.ttl
+	switch {
+	case status == http.StatusOK:
+	case status == http.StatusNotFound || status == http.StatusGone:
+		ttl = c.negativeTTL
+	case status >= http.StatusInternalServerError:
+		ttl = c.errorTTL
+	default:
+		return 0, false
+	}
+
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	for _, name := range c.uncacheable {
+		if header.Get(name) != "" {
+			return 0, false
+		}
+	}
+
+	if !c.varies(header) {
+		return 0, false
+	}
+
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		switch strings.TrimSpace(directive) {
+		case "no-store", "no-cache":
+			return 0, false
+		case "private":
+			// Entries of private routes belong to one consumer
+			if !c.private {
+				return 0, false
+			}
+		}
+	}
+
+	if override := header.Get(TTLHeader); override != "" {
+		parsed, ok := parseTTL(override)
+		if !ok || parsed <= 0 {
+			return 0, false
+		}
+
+		ttl = min(parsed, c.maxTTL)
+	}
+
+	return ttl, true
+}
+
+// varies reports whether the request headers a response varies on are
+// all part of the cache key
+func (c *Cache) varies(header http.Header) bool {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "Accept-Encoding" {
+				continue
+			}
+
+			if !c.private || !slices.Contains(c.keyHeaders, name) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// parseTTL parses a TTL header given in seconds or as a Go duration
+func parseTTL(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	d, err := time.ParseDuration(value)
+	return d, err == nil
+}
+
+// ttlStripper removes the TTL header before the response reaches the
+// client
+type ttlStripper struct {
+	http.ResponseWriter
+
+	// wroteHeader reports whether the final status was sent
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *ttlStripper) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		s.wroteHeader = true
+	}
+
+	s.Header().Del(TTLHeader)
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (s *ttlStripper) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (s *ttlStripper) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (s *ttlStripper) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// recorder passes a response through to the client while keeping a copy
+// for the cache
+type recorder struct {
+	ttlStripper
+
+	// cache decides cacheability and limits the copied body
+	cache *Cache
+
+	// cacheable reports whether the response can still be stored
+	cacheable bool
+
+	// status is the response status
+	status int
+
+	// ttl is the lifetime of the stored response
+	ttl time.Duration
+
+	// header is the response header as sent to the client
+	header http.Header
+
+	// body is the copied response body
+	body bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *recorder) WriteHeader(status int) {
+	if status >= http.StatusOK && !r.wroteHeader {
+		r.status = status
+		r.ttl, r.cacheable = r.cache.policy(status, r.Header())
+	}
+
+	r.ttlStripper.WriteHeader(status)
+
+	if r.cacheable {
+		r.header = r.Header().Clone()
+		r.header.Del("Date")
+	}
+}
+
+// Write implements http.ResponseWriter
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.cacheable {
+		if int64(r.body.Len()+len(b)) > r.cache.maxBody {
+			r.cacheable = false
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+
+	return r.ttlStripper.Write(b)
+}
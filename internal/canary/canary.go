@@ -0,0 +1,203 @@
+// Package canary splits a route's traffic between its regular targets and
+// a canary pool.
+//
+// The canary share is a percentage per consumer segment. A segment is the
+// value of the route's consumer key, typically an authenticated attribute
+// such as a JWT claim, so internal consumers can be sent to the canary
+// entirely while external consumers only see a trickle of it. Consumers
+// outside every segment get the default weight.
+//
+// Clients are assigned by hashing their bucket key into 10,000 buckets,
+// so the same client lands on the same side of the split on every request
+// and raising a weight only moves additional clients to the canary.
+//
+// Example usage:
+//
+//	split, err := canary.New(rc.Name, rc.Canary, canaryProxy)
+//	handler = middleware.Chain(stableProxy, split.Middleware())
+package canary
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+)
+
+// DefaultSegment names consumers outside every configured segment
+const DefaultSegment = "default"
+
+// buckets is the resolution of the split, allowing weights like 0.01%
+const buckets = 10000
+
+// Splitter routes each request of one route to the stable or canary pool
+//
+// Thread safety: All methods are safe for concurrent use.
+type Splitter struct {
+	// route is the name of the split route
+	route string
+
+	// canary serves requests assigned to the canary pool
+	canary http.Handler
+
+	// consumerKey evaluates to a request's segment, nil without segments
+	consumerKey ratelimit.KeyFunc
+
+	// bucketKey identifies the client for a stable assignment
+	bucketKey ratelimit.KeyFunc
+
+	// segments holds the weight and counters of every segment, including
+	// the default one
+	segments map[string]*segment
+}
+
+// segment is the canary share of one consumer segment
+type segment struct {
+	// weight is the canary percentage
+	weight float64
+
+	// stable and canary count requests sent to each pool
+	stable, canary atomic.Int64
+}
+
+// SegmentStats is a snapshot of one segment's split
+type SegmentStats struct {
+	// Segment is the segment name
+	Segment string
+
+	// Weight is the configured canary percentage
+	Weight float64
+
+	// Stable counts requests sent to the regular targets
+	Stable int64
+
+	// Canary counts requests sent to the canary pool
+	Canary int64
+}
+
+// New creates the splitter of a route, or returns nil when the route has
+// no canary targets. canary serves the requests assigned to the canary
+// pool.
+func New(route string, cfg config.CanaryConfig, canary http.Handler) (*Splitter, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, nil
+	}
+
+	s := &Splitter{
+		route:    route,
+		canary:   canary,
+		segments: make(map[string]*segment, len(cfg.Segments)+1),
+	}
+
+	if err := validWeight(DefaultSegment, cfg.Weight); err != nil {
+		return nil, err
+	}
+	s.segments[DefaultSegment] = &segment{weight: cfg.Weight}
+
+	if len(cfg.Segments) > 0 {
+		if cfg.ConsumerKey == "" {
+			return nil, fmt.Errorf("canary: consumer_key is required with segments")
+		}
+
+		consumerKey, err := ratelimit.ParseKey(cfg.ConsumerKey)
+		if err != nil {
+			return nil, fmt.Errorf("canary: %w", err)
+		}
+		s.consumerKey = consumerKey
+
+		for name, weight := range cfg.Segments {
+			if name == DefaultSegment {
+				return nil, fmt.Errorf("canary: segment name %q is reserved, use weight", DefaultSegment)
+			}
+
+			if err := validWeight(name, weight); err != nil {
+				return nil, err
+			}
+
+			s.segments[name] = &segment{weight: weight}
+		}
+	}
+
+	bucketKey, err := ratelimit.ParseKey(cfg.BucketKey)
+	if err != nil {
+		return nil, fmt.Errorf("canary: %w", err)
+	}
+	s.bucketKey = bucketKey
+
+	return s, nil
+}
+
+// validWeight checks that a segment's weight is a percentage
+func validWeight(name string, weight float64) error {
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("canary: weight of segment %s must be between 0 and 100", name)
+	}
+
+	return nil
+}
+
+// Route returns the name of the split route
+func (s *Splitter) Route() string {
+	return s.route
+}
+
+// Choose returns the request's segment and whether it goes to the canary
+func (s *Splitter) Choose(r *http.Request) (string, bool) {
+	name := DefaultSegment
+	if s.consumerKey != nil {
+		if value := s.consumerKey(r); s.segments[value] != nil {
+			name = value
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(s.route + "|" + s.bucketKey(r)))
+	bucket := h.Sum32() % buckets
+
+	return name, float64(bucket) < s.segments[name].weight*buckets/100
+}
+
+// Middleware returns a middleware sending canary requests to the canary
+// pool and everything else down the chain. Returns nil when s is nil.
+func (s *Splitter) Middleware() middleware.Middleware {
+	if s == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, toCanary := s.Choose(r)
+			seg := s.segments[name]
+
+			if toCanary {
+				seg.canary.Add(1)
+				s.canary.ServeHTTP(w, r)
+				return
+			}
+
+			seg.stable.Add(1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Stats returns the split of every segment ordered by name
+func (s *Splitter) Stats() []SegmentStats {
+	stats := make([]SegmentStats, 0, len(s.segments))
+	for name, seg := range s.segments {
+		stats = append(stats, SegmentStats{
+			Segment: name,
+			Weight:  seg.weight,
+			Stable:  seg.stable.Load(),
+			Canary:  seg.canary.Load(),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Segment < stats[j].Segment })
+	return stats
+}
@@ -0,0 +1,373 @@
+// Package checksum verifies upstream response bodies against the digests
+// their upstream sent.
+//
+// A body truncated or corrupted between the upstream and the gateway, by
+// a broken proxy, a faulty NIC or a backend crashing mid response, would
+// otherwise pass through to clients as a complete response. For routes
+// with checksum verification enabled, the body of every response carrying
+// a digest is hashed while it streams to the client:
+//
+//	Content-MD5: Q2hlY2sgSW50ZWdyaXR5IQ==            (RFC 1864)
+//	Digest: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE= (RFC 3230)
+//	Content-Digest: sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=: (RFC 9530)
+//	Repr-Digest: sha-512=:...:                     (RFC 9530)
+//
+// MD5, SHA-1 (Digest only), SHA-256 and SHA-512 are supported; responses
+// with no supported digest stream unchecked. Representation digests
+// (Digest, Repr-Digest) describe the whole representation and are not
+// checked on 206 partial responses.
+//
+// The last byte of the body is held back until the digest is verified. On
+// a mismatch in enforce mode it is never sent and the response is aborted,
+// so the client sees a failed transfer instead of a silently wrong body.
+// When the route buffers the body before forwarding it, as response
+// validation does, the mismatch is known before anything is sent and the
+// client gets a 502 UPSTREAM_CHECKSUM_MISMATCH error instead.
+//
+// Like the response contract, the route middleware attaches the Verifier
+// to the request context and the proxy wraps the upstream response:
+//
+//	verifier, err := checksum.New(route, cfg.Checksums, log)
+//	...
+//	handler = middleware.Chain(handler, verifier.Middleware())
+//	...
+//	if v := checksum.FromContext(ctx); v != nil {
+//		v.Wrap(resp)
+//	}
+package checksum
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Verification modes
+const (
+	// ModeEnforce aborts responses failing verification
+	ModeEnforce = "enforce"
+
+	// ModeLog logs mismatches and forwards the response unchanged
+	ModeLog = "log"
+)
+
+// readSize is the size of the buffer a verified body is read through
+const readSize = 32 << 10
+
+// algorithms creates the hashes of supported digest algorithms by their
+// lower case name
+var algorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// Verifier checks the response bodies of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Verifier struct {
+	// route is the name of the verified route
+	route string
+
+	// enforce aborts mismatching responses instead of only logging them
+	enforce bool
+
+	// verified and mismatched count responses read to the end by outcome
+	verified, mismatched atomic.Int64
+
+	// logger receives mismatch reports
+	logger *logger.Logger
+}
+
+// Stats is a snapshot of a verifier's outcomes
+type Stats struct {
+	// Verified counts bodies matching every digest of their response
+	Verified int64 `json:"verified"`
+
+	// Mismatched counts bodies failing a digest
+	Mismatched int64 `json:"mismatched"`
+}
+
+// New creates the verifier of a route, or returns nil when checksum
+// verification is disabled
+func New(route string, cfg config.ChecksumConfig, log *logger.Logger) (*Verifier, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	v := &Verifier{route: route, logger: log.Component("checksum")}
+
+	switch cfg.Mode {
+	case "", ModeEnforce:
+		v.enforce = true
+	case ModeLog:
+	default:
+		return nil, fmt.Errorf("checksums: unknown mode %q, expected enforce or log", cfg.Mode)
+	}
+
+	return v, nil
+}
+
+// Route returns the name of the verified route
+func (v *Verifier) Route() string {
+	return v.route
+}
+
+// Stats returns the verification outcomes so far
+func (v *Verifier) Stats() Stats {
+	return Stats{
+		Verified:   v.verified.Load(),
+		Mismatched: v.mismatched.Load(),
+	}
+}
+
+// Middleware returns a middleware attaching v to every request context.
+// Returns nil when v is nil.
+func (v *Verifier) Middleware() middleware.Middleware {
+	if v == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithVerifier(r.Context(), v)))
+		})
+	}
+}
+
+// verifierKey is the context key for the verifier
+type verifierKey struct{}
+
+// WithVerifier returns a copy of ctx carrying v
+func WithVerifier(ctx context.Context, v *Verifier) context.Context {
+	return context.WithValue(ctx, verifierKey{}, v)
+}
+
+// FromContext returns the request's verifier, or nil if its route does not
+// verify checksums
+func FromContext(ctx context.Context) *Verifier {
+	v, _ := ctx.Value(verifierKey{}).(*Verifier)
+	return v
+}
+
+// Wrap replaces the body of an upstream response carrying supported
+// digests with one verifying them as it is read. Responses without a body,
+// and bodies the transport decompressed, are left alone.
+func (v *Verifier) Wrap(resp *http.Response) {
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.Uncompressed {
+		return
+	}
+
+	checks := digests(resp.Header, resp.StatusCode == http.StatusPartialContent)
+	if len(checks) == 0 {
+		return
+	}
+
+	resp.Body = &verifiedBody{
+		body:     resp.Body,
+		verifier: v,
+		target:   resp.Request.URL.Host,
+		checks:   checks,
+	}
+}
+
+// check is one digest a body must match
+type check struct {
+	// header and algorithm name the digest for reports
+	header, algorithm string
+
+	// expected is the decoded digest
+	expected []byte
+
+	// hash accumulates the body
+	hash hash.Hash
+}
+
+// digests returns the checks of every supported digest in header.
+// Representation digests are skipped for partial responses.
+func digests(header http.Header, partial bool) []*check {
+	var checks []*check
+
+	add := func(name, algorithm, encoded string) {
+		newHash, ok := algorithms[strings.ToLower(algorithm)]
+		if !ok {
+			return
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			// A malformed digest can never match
+			expected = nil
+		}
+
+		checks = append(checks, &check{header: name, algorithm: strings.ToLower(algorithm), expected: expected, hash: newHash()})
+	}
+
+	if value := header.Get("Content-MD5"); value != "" {
+		add("Content-MD5", "md5", strings.TrimSpace(value))
+	}
+
+	// Content-Digest and Repr-Digest are structured dictionaries of byte
+	// sequences, sha-256=:...:
+	for _, name := range []string{"Content-Digest", "Repr-Digest"} {
+		if partial && name == "Repr-Digest" {
+			continue
+		}
+
+		for _, member := range splitList(header.Values(name)) {
+			algorithm, value, _ := strings.Cut(member, "=")
+			if value, ok := strings.CutPrefix(value, ":"); ok {
+				add(name, algorithm, strings.TrimSuffix(value, ":"))
+			}
+		}
+	}
+
+	if !partial {
+		for _, member := range splitList(header.Values("Digest")) {
+			algorithm, value, _ := strings.Cut(member, "=")
+			add("Digest", algorithm, value)
+		}
+	}
+
+	return checks
+}
+
+// splitList splits comma separated header values into trimmed members.
+// Base64 never contains commas, so digests split cleanly.
+func splitList(values []string) []string {
+	var members []string
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			// Drop structured field parameters
+			member, _, _ = strings.Cut(member, ";")
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+	}
+
+	return members
+}
+
+// verifiedBody hashes a body as it is read and verifies it at the end.
+// The last byte read is held back until then, so a failing body never
+// reaches the client complete.
+type verifiedBody struct {
+	// body is the upstream body
+	body io.ReadCloser
+
+	// verifier counts and reports the outcome
+	verifier *Verifier
+
+	// target is the upstream that sent the body
+	target string
+
+	// checks are the digests to match
+	checks []*check
+
+	// pending holds bytes read but not yet returned, the last one held
+	// back until the body is verified
+	pending []byte
+
+	// eof reports whether the upstream body was read to the end
+	eof bool
+
+	// err is the verification failure returned instead of the last byte
+	err error
+}
+
+// Read implements io.Reader
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	for !b.eof && len(b.pending) < 2 {
+		if b.pending == nil {
+			b.pending = make([]byte, 0, readSize)
+		}
+
+		n, err := b.body.Read(b.pending[len(b.pending):cap(b.pending)])
+		for _, c := range b.checks {
+			c.hash.Write(b.pending[len(b.pending) : len(b.pending)+n])
+		}
+		b.pending = b.pending[:len(b.pending)+n]
+
+		if err == io.EOF {
+			b.eof = true
+			b.err = b.verify()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	held := 1
+	if b.eof && b.err == nil {
+		held = 0
+	}
+
+	n := copy(p, b.pending[:max(len(b.pending)-held, 0)])
+	b.pending = b.pending[:copy(b.pending, b.pending[n:])]
+
+	switch {
+	case !b.eof:
+		return n, nil
+	case b.err != nil && len(b.pending) <= held:
+		return n, b.err
+	case b.err == nil && len(b.pending) == 0:
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Close implements io.Closer
+func (b *verifiedBody) Close() error {
+	return b.body.Close()
+}
+
+// verify compares the complete body with every digest. Returns the error
+// failing the response, nil when it matches or in log mode.
+func (b *verifiedBody) verify() error {
+	v := b.verifier
+
+	for _, c := range b.checks {
+		if bytes.Equal(c.hash.Sum(nil), c.expected) {
+			continue
+		}
+
+		v.mismatched.Add(1)
+		v.logger.Warn("Upstream response failed checksum verification",
+			"route", v.route,
+			"target", b.target,
+			"header", c.header,
+			"algorithm", c.algorithm,
+			"enforced", v.enforce,
+		)
+
+		if !v.enforce {
+			return nil
+		}
+
+		return gwerrors.New(gwerrors.CodeUpstreamChecksum, "Upstream response failed checksum verification").
+			WithRoute(v.route).
+			WithContext("header", c.header).
+			WithContext("algorithm", c.algorithm)
+	}
+
+	v.verified.Add(1)
+	return nil
+}
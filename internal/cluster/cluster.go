@@ -0,0 +1,791 @@
+// Package cluster lets several gateway instances share state by gossip.
+//
+// Every member periodically sends a UDP message to the other members it
+// knows and to the configured peers. A message carries the sender's view
+// of the membership, the rate limit tokens the sender consumed and the
+// targets it ejected:
+//
+//   - Membership uses heartbeat gossip: each member increments its own
+//     heartbeat every round and relays the highest heartbeats it has seen
+//     of the others. A member whose heartbeat stops advancing is reported
+//     as suspect after SuspectTimeout and removed after twice as long.
+//   - Rate limit usage is a counter per limiter scope and key that only
+//     grows. Receivers turn the increase since the last message into
+//     remote consumption, which limiters take before admitting a request,
+//     so a limit holds across the cluster rather than per instance.
+//   - Target ejections are shared with their end time, so a target one
+//     member found failing is avoided by all of them.
+//   - The longest running alive member is the leader and runs singleton
+//     tasks, see RunSingleton.
+//
+// State is shared on a best-effort basis: lost messages delay but do not
+// corrupt it, because counters carry totals rather than increments. No
+// external store is required.
+//
+// The node is process-wide and outlives configuration reloads, like the
+// listeners. Components reach it through Current, whose methods are no-ops
+// on a nil node so callers need no cluster checks:
+//
+//	node, err := cluster.Start(cfg.Cluster, log)
+//	...
+//	cluster.Current().Consumed("route:orders", key, 1)
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+	"velocity/pkg/logger"
+)
+
+// Member states
+const (
+	// StateAlive means the member's heartbeat advanced recently
+	StateAlive = "alive"
+
+	// StateSuspect means the member has been silent for SuspectTimeout
+	StateSuspect = "suspect"
+)
+
+const (
+	// maxMessageBytes keeps messages within a single UDP datagram
+	maxMessageBytes = 60000
+
+	// retention is how long idle usage counters and unclaimed remote
+	// consumption are kept
+	retention = time.Minute
+)
+
+// current is the process-wide node, nil when clustering is disabled
+var current atomic.Pointer[Node]
+
+// Current returns the process-wide node, or nil when clustering is
+// disabled. All Node methods accept a nil receiver.
+func Current() *Node {
+	return current.Load()
+}
+
+// Node is this gateway's membership in the cluster
+//
+// Thread safety: All methods are safe for concurrent use.
+type Node struct {
+	// name identifies this member
+	name string
+
+	// address is where other members send gossip to this member
+	address string
+
+	// peers are the configured addresses contacted to join
+	peers []string
+
+	// interval is the time between gossip rounds
+	interval time.Duration
+
+	// suspectTimeout is the silence after which a member is suspect
+	suspectTimeout time.Duration
+
+	// key authenticates messages, nil when gossip is unauthenticated
+	key []byte
+
+	// started identifies this incarnation of the member; a restarted
+	// member supersedes its previous incarnation, and the longest running
+	// member leads
+	started time.Time
+
+	// conn sends and receives gossip
+	conn *net.UDPConn
+
+	// mu guards heartbeat, members, departed, ejections and leader
+	mu sync.Mutex
+
+	// heartbeat is this member's own heartbeat
+	heartbeat uint64
+
+	// members holds the other known members by name
+	members map[string]*member
+
+	// departed remembers the last heartbeat of removed members, so stale
+	// gossip about them does not bring them back
+	departed map[string]departure
+
+	// ejections holds the end of every known target ejection by target
+	// URL
+	ejections map[string]time.Time
+
+	// leader is the leader elected in the last gossip round
+	leader string
+
+	// usageMu guards usage, pending and seen
+	usageMu sync.Mutex
+
+	// usage holds this member's consumption totals by scope and key
+	usage map[usageKey]*counter
+
+	// pending holds remote consumption not yet taken by a limiter
+	pending map[usageKey]*counter
+
+	// seen holds the last total received from each member, by member
+	seen map[string]map[usageKey]*counter
+
+	// sent, received and rejected count messages
+	sent, received, rejected atomic.Int64
+
+	// stop ends the gossip loops
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// logger reports membership changes
+	logger *logger.Logger
+}
+
+// member is the state of another member
+type member struct {
+	// address is the member's gossip address
+	address string
+
+	// started identifies the member's incarnation
+	started time.Time
+
+	// heartbeat is the highest heartbeat seen of the member
+	heartbeat uint64
+
+	// updated is when the heartbeat last advanced
+	updated time.Time
+}
+
+// departure is a removed member's last incarnation and heartbeat
+type departure struct {
+	started   time.Time
+	heartbeat uint64
+	at        time.Time
+}
+
+// usageKey identifies a rate limit counter
+type usageKey struct {
+	Scope string
+	Key   string
+}
+
+// counter is a consumption amount with its last update
+type counter struct {
+	value   float64
+	updated time.Time
+}
+
+// Member describes a cluster member
+type Member struct {
+	// Name identifies the member
+	Name string `json:"name"`
+
+	// Address is the member's gossip address
+	Address string `json:"address"`
+
+	// State is StateAlive or StateSuspect
+	State string `json:"state"`
+
+	// Started is when the member started
+	Started time.Time `json:"started"`
+
+	// LastSeen is when the member's heartbeat last advanced
+	LastSeen time.Time `json:"last_seen"`
+
+	// Local marks this gateway instance
+	Local bool `json:"local,omitempty"`
+
+	// Leader marks the member running singleton tasks, as seen by this
+	// member
+	Leader bool `json:"leader,omitempty"`
+}
+
+// Stats counts gossip messages
+type Stats struct {
+	// Sent counts messages sent
+	Sent int64 `json:"sent"`
+
+	// Received counts messages accepted
+	Received int64 `json:"received"`
+
+	// Rejected counts messages dropped as malformed or unauthenticated
+	Rejected int64 `json:"rejected"`
+}
+
+// message is the gossip payload
+type message struct {
+	// From is the sender's name
+	From string `json:"from"`
+
+	// Members are the sender's heartbeats, its own included
+	Members []digest `json:"members"`
+
+	// Usage are the sender's own consumption totals
+	Usage []usage `json:"usage,omitempty"`
+
+	// Ejections map target URLs to the end of their ejection in Unix
+	// milliseconds
+	Ejections map[string]int64 `json:"ejections,omitempty"`
+}
+
+// digest is a member's heartbeat as relayed in gossip
+type digest struct {
+	Name      string `json:"n"`
+	Address   string `json:"a"`
+	Started   int64  `json:"s"`
+	Heartbeat uint64 `json:"h"`
+}
+
+// supersedes reports whether d is newer than the given incarnation and
+// heartbeat
+func (d digest) supersedes(started time.Time, heartbeat uint64) bool {
+	if d.Started != started.UnixNano() {
+		return d.Started > started.UnixNano()
+	}
+
+	return d.Heartbeat > heartbeat
+}
+
+// usage is a consumption total as sent in gossip
+type usage struct {
+	Scope string  `json:"s"`
+	Key   string  `json:"k"`
+	Total float64 `json:"t"`
+}
+
+// Start joins the cluster and makes the node the process-wide Current
+// node. Returns nil without error when clustering is disabled.
+func Start(cfg config.ClusterConfig, log *logger.Logger) (*Node, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.GossipInterval <= 0 || cfg.SuspectTimeout <= 0 {
+		return nil, fmt.Errorf("cluster: gossip_interval and suspect_timeout must be positive")
+	}
+
+	name := cfg.NodeName
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cluster: node_name is required: %w", err)
+		}
+		name = hostname
+	}
+
+	address := cfg.AdvertiseAddress
+	if address == "" {
+		address = cfg.BindAddress
+	}
+
+	if host, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("cluster: invalid advertise address %q: %w", address, err)
+	} else if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return nil, fmt.Errorf("cluster: advertise_address is required when bind_address has no specific host")
+	}
+
+	var key []byte
+	if cfg.SecretKey != "" {
+		secret, err := secrets.NewStore(0).Get(cfg.SecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("cluster: secret_key: %w", err)
+		}
+		key = []byte(secret)
+	}
+
+	bind, err := net.ResolveUDPAddr("udp", cfg.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: invalid bind address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", bind)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+
+	n := &Node{
+		name:           name,
+		address:        address,
+		peers:          cfg.Peers,
+		interval:       cfg.GossipInterval,
+		suspectTimeout: cfg.SuspectTimeout,
+		key:            key,
+		started:        time.Now(),
+		conn:           conn,
+		members:        make(map[string]*member),
+		departed:       make(map[string]departure),
+		ejections:      make(map[string]time.Time),
+		usage:          make(map[usageKey]*counter),
+		pending:        make(map[usageKey]*counter),
+		seen:           make(map[string]map[usageKey]*counter),
+		stop:           make(chan struct{}),
+		logger:         log.Component("cluster"),
+	}
+
+	go n.receive()
+	go n.run()
+
+	current.Store(n)
+	n.logger.Info("Cluster node started", "node", name, "address", address, "peers", len(cfg.Peers))
+	return n, nil
+}
+
+// Close leaves the cluster. Other members remove this one once its
+// heartbeat times out.
+func (n *Node) Close() {
+	if n == nil {
+		return
+	}
+
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		n.conn.Close()
+		current.CompareAndSwap(n, nil)
+	})
+}
+
+// Name returns this member's name, empty for a nil node
+func (n *Node) Name() string {
+	if n == nil {
+		return ""
+	}
+
+	return n.name
+}
+
+// Consumed records amount tokens consumed locally by key of the limiter
+// identified by scope, for the other members to take into account
+func (n *Node) Consumed(scope, key string, amount float64) {
+	if n == nil {
+		return
+	}
+
+	k := usageKey{scope, key}
+	now := time.Now()
+
+	n.usageMu.Lock()
+	defer n.usageMu.Unlock()
+
+	c, ok := n.usage[k]
+	if !ok {
+		c = &counter{}
+		n.usage[k] = c
+	}
+
+	c.value += amount
+	c.updated = now
+}
+
+// TakeRemote returns the tokens other members consumed by key of the
+// limiter identified by scope since the previous call
+func (n *Node) TakeRemote(scope, key string) float64 {
+	if n == nil {
+		return 0
+	}
+
+	k := usageKey{scope, key}
+
+	n.usageMu.Lock()
+	defer n.usageMu.Unlock()
+
+	c, ok := n.pending[k]
+	if !ok {
+		return 0
+	}
+
+	delete(n.pending, k)
+	return c.value
+}
+
+// ReportEjection shares that target is ejected until the given time
+func (n *Node) ReportEjection(target string, until time.Time) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if until.After(n.ejections[target]) {
+		n.ejections[target] = until
+	}
+}
+
+// Ejections returns the end of every current target ejection known to the
+// cluster, by target URL
+func (n *Node) Ejections() map[string]time.Time {
+	if n == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ejections := make(map[string]time.Time, len(n.ejections))
+	for target, until := range n.ejections {
+		if until.After(now) {
+			ejections[target] = until
+		}
+	}
+
+	return ejections
+}
+
+// Members returns the known members, this one included, ordered by name
+func (n *Node) Members() []Member {
+	if n == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	n.mu.Lock()
+	leader := n.elect(now)
+	members := []Member{{Name: n.name, Address: n.address, State: StateAlive, Started: n.started,
+		LastSeen: now, Local: true, Leader: leader == n.name}}
+	for name, m := range n.members {
+		state := StateAlive
+		if now.Sub(m.updated) > n.suspectTimeout {
+			state = StateSuspect
+		}
+
+		members = append(members, Member{Name: name, Address: m.address, State: state, Started: m.started,
+			LastSeen: m.updated, Leader: leader == name})
+	}
+	n.mu.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Stats returns the gossip message counters
+func (n *Node) Stats() Stats {
+	if n == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Sent:     n.sent.Load(),
+		Received: n.received.Load(),
+		Rejected: n.rejected.Load(),
+	}
+}
+
+// run gossips every interval until the node is closed
+func (n *Node) run() {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.gossip()
+		}
+	}
+}
+
+// gossip expires silent members and stale state, then sends this
+// member's state to every known member and configured peer
+func (n *Node) gossip() {
+	now := time.Now()
+	payload := n.encode(n.prepare(now))
+
+	n.mu.Lock()
+	targets := make(map[string]bool, len(n.members)+len(n.peers))
+	for _, m := range n.members {
+		targets[m.address] = true
+	}
+	n.mu.Unlock()
+
+	for _, peer := range n.peers {
+		targets[peer] = true
+	}
+	delete(targets, n.address)
+
+	for address := range targets {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			n.logger.Debug("Cluster peer unresolvable", "address", address, "error", err)
+			continue
+		}
+
+		if _, err := n.conn.WriteToUDP(payload, addr); err != nil {
+			n.logger.Debug("Cluster gossip failed", "address", address, "error", err)
+			continue
+		}
+
+		n.sent.Add(1)
+	}
+}
+
+// prepare advances the heartbeat, expires stale state and returns the
+// message describing this member
+func (n *Node) prepare(now time.Time) *message {
+	msg := &message{From: n.name, Ejections: make(map[string]int64)}
+
+	n.mu.Lock()
+	n.heartbeat++
+	msg.Members = append(msg.Members, digest{n.name, n.address, n.started.UnixNano(), n.heartbeat})
+
+	var removed []string
+	for name, m := range n.members {
+		if now.Sub(m.updated) > 2*n.suspectTimeout {
+			delete(n.members, name)
+			n.departed[name] = departure{started: m.started, heartbeat: m.heartbeat, at: now}
+			removed = append(removed, name)
+			continue
+		}
+
+		msg.Members = append(msg.Members, digest{name, m.address, m.started.UnixNano(), m.heartbeat})
+	}
+
+	previous := n.leader
+	n.leader = n.elect(now)
+	leader := n.leader
+
+	for name, d := range n.departed {
+		if now.Sub(d.at) > 10*n.suspectTimeout {
+			delete(n.departed, name)
+		}
+	}
+
+	for target, until := range n.ejections {
+		if !until.After(now) {
+			delete(n.ejections, target)
+			continue
+		}
+
+		msg.Ejections[target] = until.UnixMilli()
+	}
+	n.mu.Unlock()
+
+	for _, name := range removed {
+		n.logger.Warn("Cluster member removed after missing heartbeats", "node", name)
+	}
+
+	if leader != previous {
+		n.logger.Info("Cluster leader elected", "leader", leader, "local", leader == n.name)
+	}
+
+	n.usageMu.Lock()
+	for _, name := range removed {
+		delete(n.seen, name)
+	}
+
+	type entry struct {
+		usage
+		updated time.Time
+	}
+
+	entries := make([]entry, 0, len(n.usage))
+	for k, c := range n.usage {
+		if now.Sub(c.updated) > retention {
+			delete(n.usage, k)
+			continue
+		}
+
+		entries = append(entries, entry{usage{k.Scope, k.Key, c.value}, c.updated})
+	}
+
+	for k, c := range n.pending {
+		if now.Sub(c.updated) > retention {
+			delete(n.pending, k)
+		}
+	}
+
+	// Senders stop reporting idle counters after retention, so the last
+	// totals received can go a little later
+	for _, totals := range n.seen {
+		for k, c := range totals {
+			if now.Sub(c.updated) > 2*retention {
+				delete(totals, k)
+			}
+		}
+	}
+	n.usageMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].updated.After(entries[j].updated) })
+	for _, e := range entries {
+		msg.Usage = append(msg.Usage, e.usage)
+	}
+
+	return msg
+}
+
+// encode serializes and signs msg. Usage entries, ordered by recency,
+// are halved from the least recently updated end until the message fits a
+// datagram; the dropped totals are sent again with the next update.
+func (n *Node) encode(msg *message) []byte {
+	for {
+		data, _ := json.Marshal(msg)
+
+		if len(data)+sha256.Size <= maxMessageBytes || len(msg.Usage) == 0 {
+			return n.sign(data)
+		}
+
+		msg.Usage = msg.Usage[:len(msg.Usage)/2]
+	}
+}
+
+// sign prefixes data with its HMAC when a key is configured
+func (n *Node) sign(data []byte) []byte {
+	if n.key == nil {
+		return data
+	}
+
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// errUnauthenticated is returned for messages with an invalid signature
+var errUnauthenticated = errors.New("invalid message signature")
+
+// verify checks and strips the HMAC prefix of a signed message
+func (n *Node) verify(payload []byte) ([]byte, error) {
+	if n.key == nil {
+		return payload, nil
+	}
+
+	if len(payload) < sha256.Size {
+		return nil, errUnauthenticated
+	}
+
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(payload[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), payload[:sha256.Size]) {
+		return nil, errUnauthenticated
+	}
+
+	return payload[sha256.Size:], nil
+}
+
+// receive merges incoming messages until the node is closed
+func (n *Node) receive() {
+	buf := make([]byte, 64<<10)
+
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.stop:
+				return
+			default:
+				n.logger.Debug("Cluster receive failed", "error", err)
+				continue
+			}
+		}
+
+		data, err := n.verify(buf[:size])
+		if err != nil {
+			n.rejected.Add(1)
+			n.logger.Debug("Cluster message rejected", "from", from.String(), "error", err)
+			continue
+		}
+
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil || msg.From == "" {
+			n.rejected.Add(1)
+			n.logger.Debug("Cluster message rejected", "from", from.String(), "error", "malformed message")
+			continue
+		}
+
+		n.received.Add(1)
+		n.merge(&msg)
+	}
+}
+
+// merge applies a message to the local state
+func (n *Node) merge(msg *message) {
+	now := time.Now()
+	var joined []string
+
+	n.mu.Lock()
+	for _, d := range msg.Members {
+		if d.Name == n.name {
+			continue
+		}
+
+		if m, ok := n.members[d.Name]; ok {
+			if d.supersedes(m.started, m.heartbeat) {
+				m.started, m.heartbeat, m.address, m.updated = time.Unix(0, d.Started), d.Heartbeat, d.Address, now
+			}
+			continue
+		}
+
+		if gone, ok := n.departed[d.Name]; ok && !d.supersedes(gone.started, gone.heartbeat) {
+			continue
+		}
+
+		delete(n.departed, d.Name)
+		n.members[d.Name] = &member{address: d.Address, started: time.Unix(0, d.Started), heartbeat: d.Heartbeat, updated: now}
+		joined = append(joined, d.Name)
+	}
+
+	for target, millis := range msg.Ejections {
+		if until := time.UnixMilli(millis); until.After(n.ejections[target]) && until.After(now) {
+			n.ejections[target] = until
+		}
+	}
+	n.mu.Unlock()
+
+	for _, name := range joined {
+		n.logger.Info("Cluster member joined", "node", name)
+	}
+
+	if len(msg.Usage) == 0 {
+		return
+	}
+
+	n.usageMu.Lock()
+	defer n.usageMu.Unlock()
+
+	seen, ok := n.seen[msg.From]
+	if !ok {
+		seen = make(map[usageKey]*counter)
+		n.seen[msg.From] = seen
+	}
+
+	for _, u := range msg.Usage {
+		k := usageKey{u.Scope, u.Key}
+
+		last, ok := seen[k]
+		if !ok {
+			last = &counter{}
+			seen[k] = last
+		}
+
+		// A total below the last one means the member restarted or
+		// expired the counter and is counting from zero again
+		delta := u.Total - last.value
+		if u.Total < last.value {
+			delta = u.Total
+		}
+		last.value, last.updated = u.Total, now
+
+		if delta <= 0 {
+			continue
+		}
+
+		c, ok := n.pending[k]
+		if !ok {
+			c = &counter{}
+			n.pending[k] = c
+		}
+
+		c.value += delta
+		c.updated = now
+	}
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"velocity/pkg/logger"
+)
+
+// elect returns the leader among this member and the alive members: the
+// longest running one, ties broken by name. Every member applies the same
+// rule to the membership it has gossiped, so they agree on the leader once
+// their views converge. Must be called with n.mu held.
+func (n *Node) elect(now time.Time) string {
+	leader, started := n.name, n.started
+
+	for name, m := range n.members {
+		if now.Sub(m.updated) > n.suspectTimeout {
+			continue
+		}
+
+		if m.started.Before(started) || (m.started.Equal(started) && name < leader) {
+			leader, started = name, m.started
+		}
+	}
+
+	return leader
+}
+
+// Leader returns the name of the leader as seen by this member, empty for
+// a nil node
+func (n *Node) Leader() string {
+	if n == nil {
+		return ""
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.elect(time.Now())
+}
+
+// IsLeader reports whether this member should run singleton tasks.
+//
+// A member that has just started knows no other members yet and would
+// elect itself, so with peers configured it defers for SuspectTimeout to
+// learn the membership first. A nil node is a standalone gateway and
+// always leads.
+func (n *Node) IsLeader() bool {
+	if n == nil {
+		return true
+	}
+
+	if len(n.peers) > 0 && time.Since(n.started) < n.suspectTimeout {
+		return false
+	}
+
+	return n.Leader() == n.name
+}
+
+// RunSingleton runs task every interval on the cluster leader only, until
+// ctx is done. Use it for work that must happen once per cluster rather
+// than once per instance, such as certificate renewals, usage aggregation
+// or pulling configuration from a remote store.
+//
+// Leadership is checked before every run, so the task moves to another
+// member when the leader leaves or stops gossiping. Without clustering the
+// task runs on every tick. Leadership is eventually consistent: around a
+// network partition or a leader change two members may briefly both run
+// the task, so tasks should be idempotent.
+func RunSingleton(ctx context.Context, name string, interval time.Duration, log *logger.Logger, task func(context.Context)) {
+	log = log.Component("cluster")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !Current().IsLeader() {
+			log.Debug("Singleton task skipped, not the cluster leader", "task", name, "leader", Current().Leader())
+			continue
+		}
+
+		task(ctx)
+	}
+}
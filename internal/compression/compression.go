@@ -0,0 +1,486 @@
+// Package compression compresses route responses against a shared
+// dictionary.
+//
+// JSON APIs send many small responses that general purpose compression
+// barely shrinks: a 300 byte body has too little repetition of its own.
+// Across responses of one API, field names and common values repeat
+// constantly, and a zstd dictionary trained on sample payloads captures
+// exactly that. Compressed against it, small responses often shrink to a
+// fifth of their size.
+//
+// Dictionaries are negotiated as RFC 9842 (Compression Dictionary
+// Transport) describes. The dictionary is served at a path of the route
+// with a Use-As-Dictionary header, and compressible responses point to it
+// with a Link header, so browsers fetch and store it on their own. A
+// client holding it announces its SHA-256 hash in Available-Dictionary and
+// dcz in Accept-Encoding; its eligible responses are then buffered and
+// sent as Dictionary-Compressed Zstandard. Every other client gets the
+// response unchanged. Brotli dictionaries (dcb) are not offered.
+//
+// Responses larger than the configured limit, or that do not fit the
+// memory budget, are passed through uncompressed as soon as that is known.
+//
+// Example usage:
+//
+//	compressor, err := compression.New(rc)
+//	handler = middleware.Chain(handler, compressor.Middleware())
+package compression
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+	gwerrors "velocity/pkg/errors"
+)
+
+// Compression defaults
+const (
+	// defaultMinBytes is the smallest response compressed unless configured
+	defaultMinBytes = 64
+
+	// defaultMaxBodyBytes is the largest response compressed unless
+	// configured
+	defaultMaxBodyBytes = 1 << 20
+)
+
+// Encoding is the content coding of dictionary compressed responses
+const Encoding = "dcz"
+
+// defaultContentTypes are the media types compressed unless configured
+var defaultContentTypes = []string{"application/json", "application/problem+json"}
+
+// dczMagic starts a dcz stream: a zstd skippable frame of 32 bytes holding
+// the dictionary's hash, followed by the compressed frame
+var dczMagic = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// Compressor compresses the responses of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Compressor struct {
+	// route is the name of the compressed route
+	route string
+
+	// dict is the indexed dictionary
+	dict *dictionary
+
+	// hash is the dictionary's SHA-256 hash
+	hash [sha256.Size]byte
+
+	// available is the Available-Dictionary value of clients holding the
+	// dictionary
+	available string
+
+	// dictionaryPath serves the dictionary, empty when not served
+	dictionaryPath string
+
+	// match is the Use-As-Dictionary URL pattern covering the route
+	match string
+
+	// modified is the dictionary file's modification time
+	modified time.Time
+
+	// contentTypes are the compressed media types
+	contentTypes []string
+
+	// minBytes and maxBody bound the compressed responses
+	minBytes, maxBody int64
+
+	// compressed and skipped count negotiated responses by outcome
+	compressed, skipped atomic.Int64
+
+	// bytesIn and bytesOut total the bodies of compressed responses before
+	// and after compression
+	bytesIn, bytesOut atomic.Int64
+
+	// fetches counts dictionary downloads
+	fetches atomic.Int64
+}
+
+// Stats is a snapshot of a compressor
+type Stats struct {
+	// Compressed counts responses sent compressed
+	Compressed int64
+
+	// Skipped counts eligible responses to clients holding the dictionary
+	// sent uncompressed, because they were too small, too large or did not
+	// shrink
+	Skipped int64
+
+	// BytesIn totals the bodies of compressed responses
+	BytesIn int64
+
+	// BytesOut totals the compressed bodies sent in their place
+	BytesOut int64
+
+	// DictionaryFetches counts downloads of the dictionary
+	DictionaryFetches int64
+}
+
+// New loads the dictionary of a route and returns its compressor, or nil
+// when compression is disabled
+func New(rc config.RouteConfig) (*Compressor, error) {
+	cfg := rc.Compression
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Dictionary == "" {
+		return nil, errors.New("compression: dictionary is required")
+	}
+
+	if cfg.MinBytes < 0 || cfg.MaxBodyBytes < 0 {
+		return nil, errors.New("compression: min_bytes and max_body_bytes must not be negative")
+	}
+
+	if cfg.DictionaryPath != "" && !strings.HasPrefix(cfg.DictionaryPath, rc.PathPrefix) {
+		return nil, fmt.Errorf("compression: dictionary_path must be within the route's path prefix %q", rc.PathPrefix)
+	}
+
+	content, err := os.ReadFile(cfg.Dictionary)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+
+	info, err := os.Stat(cfg.Dictionary)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+
+	c := &Compressor{
+		route:          rc.Name,
+		dict:           newDictionary(content),
+		hash:           sha256.Sum256(content),
+		dictionaryPath: cfg.DictionaryPath,
+		match:          rc.PathPrefix + "*",
+		modified:       info.ModTime(),
+		contentTypes:   cfg.ContentTypes,
+		minBytes:       cfg.MinBytes,
+		maxBody:        cfg.MaxBodyBytes,
+	}
+	c.available = ":" + base64.StdEncoding.EncodeToString(c.hash[:]) + ":"
+
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultContentTypes
+	}
+
+	if c.minBytes == 0 {
+		c.minBytes = defaultMinBytes
+	}
+
+	if c.maxBody == 0 {
+		c.maxBody = defaultMaxBodyBytes
+	}
+
+	return c, nil
+}
+
+// Route returns the name of the compressed route
+func (c *Compressor) Route() string {
+	return c.route
+}
+
+// Stats returns the compressor's current statistics
+func (c *Compressor) Stats() Stats {
+	return Stats{
+		Compressed:        c.compressed.Load(),
+		Skipped:           c.skipped.Load(),
+		BytesIn:           c.bytesIn.Load(),
+		BytesOut:          c.bytesOut.Load(),
+		DictionaryFetches: c.fetches.Load(),
+	}
+}
+
+// Middleware returns a middleware serving the dictionary and compressing
+// eligible responses to clients holding it. Returns nil when c is nil.
+func (c *Compressor) Middleware() middleware.Middleware {
+	if c == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.dictionaryPath != "" && r.URL.Path == c.dictionaryPath {
+				c.serveDictionary(w, r)
+				return
+			}
+
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressingWriter{
+				ResponseWriter: w,
+				compressor:     c,
+				budget:         membudget.FromContext(r.Context()),
+				negotiated:     r.Method == http.MethodGet && r.Header.Get("Range") == "" && c.negotiated(r.Header),
+			}
+			defer cw.release()
+
+			next.ServeHTTP(cw, r)
+
+			if cw.holding {
+				cw.finish()
+			}
+		})
+	}
+}
+
+// negotiated reports whether a client accepts dcz and holds the dictionary
+func (c *Compressor) negotiated(header http.Header) bool {
+	return strings.TrimSpace(header.Get("Available-Dictionary")) == c.available &&
+		accepts(header.Values("Accept-Encoding"), Encoding)
+}
+
+// accepts reports whether Accept-Encoding values list coding with a
+// non-zero quality
+func accepts(values []string, coding string) bool {
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(entry, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), coding) {
+				continue
+			}
+
+			q := strings.TrimSpace(params)
+			if after, ok := strings.CutPrefix(q, "q="); ok {
+				if weight, err := strconv.ParseFloat(after, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveDictionary answers a request for the dictionary, marking it as one
+// for the route's responses
+func (c *Compressor) serveDictionary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		gwerrors.New(gwerrors.CodeMethodNotAllowed, "Only GET and HEAD are served for the dictionary").
+			WithRoute(c.route).
+			WriteJSON(w)
+		return
+	}
+
+	c.fetches.Add(1)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Use-As-Dictionary", `match="`+c.match+`"`)
+	w.Header().Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(c.hash[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", c.modified, bytes.NewReader(c.dict.content))
+}
+
+// eligible reports whether a response may be compressed: a body of a
+// configured media type not already encoded and not a byte range
+func (c *Compressor) eligible(status int, header http.Header) bool {
+	switch status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		if strings.TrimSpace(directive) == "no-transform" {
+			return false
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	for _, contentType := range c.contentTypes {
+		if strings.EqualFold(mediaType, contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encode returns body as a dcz stream
+func (c *Compressor) encode(body []byte) []byte {
+	out := make([]byte, 0, len(dczMagic)+len(c.hash)+len(body)/2)
+	out = append(out, dczMagic...)
+	out = append(out, c.hash[:]...)
+	return c.dict.encode(out, body)
+}
+
+// compressingWriter holds back an eligible response to a client holding
+// the dictionary until its body is complete, and passes every other
+// response through
+type compressingWriter struct {
+	http.ResponseWriter
+
+	// compressor encodes the body and counts outcomes
+	compressor *Compressor
+
+	// budget is charged for the held body
+	budget *membudget.Budget
+
+	// negotiated reports whether the client accepts the dictionary
+	negotiated bool
+
+	// wroteHeader reports whether the final status was decided
+	wroteHeader bool
+
+	// holding reports whether the response is being held back
+	holding bool
+
+	// status is the held response's status
+	status int
+
+	// body is the held response body
+	body bytes.Buffer
+
+	// reserved is the budget held for body
+	reserved int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (cw *compressingWriter) WriteHeader(status int) {
+	if status < http.StatusOK || cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.wroteHeader = true
+	if !cw.compressor.eligible(status, cw.Header()) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	// The representation depends on both negotiation headers, whichever
+	// one this client sent
+	cw.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+
+	if !cw.negotiated {
+		if path := cw.compressor.dictionaryPath; path != "" {
+			cw.Header().Add("Link", "<"+path+`>; rel="compression-dictionary"`)
+		}
+
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.holding = true
+	cw.status = status
+}
+
+// Write implements http.ResponseWriter
+func (cw *compressingWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.holding {
+		return cw.ResponseWriter.Write(b)
+	}
+
+	size := int64(len(b))
+	if int64(cw.body.Len())+size > cw.compressor.maxBody || !cw.budget.Reserve(size) {
+		if err := cw.passThrough(); err != nil {
+			return 0, err
+		}
+
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.reserved += size
+	return cw.body.Write(b)
+}
+
+// Flush implements http.Flusher. Flushing a held response does nothing
+// until it is complete or passed through.
+func (cw *compressingWriter) Flush() {
+	if cw.holding {
+		return
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// passThrough stops holding the response and sends what was held so far
+func (cw *compressingWriter) passThrough() error {
+	cw.holding = false
+	cw.compressor.skipped.Add(1)
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.body.Bytes())
+
+	cw.body = bytes.Buffer{}
+	cw.release()
+	return err
+}
+
+// finish sends the complete held response, compressed when that makes it
+// smaller
+func (cw *compressingWriter) finish() {
+	cw.holding = false
+	body := cw.body.Bytes()
+
+	// A body shorter than announced was cut off and is sent as it is
+	length := cw.Header().Get("Content-Length")
+	if int64(len(body)) < cw.compressor.minBytes || (length != "" && length != strconv.Itoa(len(body))) {
+		cw.compressor.skipped.Add(1)
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.ResponseWriter.Write(body)
+		return
+	}
+
+	compressed := cw.compressor.encode(body)
+	if len(compressed) >= len(body) {
+		cw.compressor.skipped.Add(1)
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.ResponseWriter.Write(body)
+		return
+	}
+
+	cw.compressor.compressed.Add(1)
+	cw.compressor.bytesIn.Add(int64(len(body)))
+	cw.compressor.bytesOut.Add(int64(len(compressed)))
+
+	// The compressed representation is not byte for byte the one a strong
+	// validator describes
+	header := cw.Header()
+	if tag := header.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+		header.Set("ETag", "W/"+tag)
+	}
+
+	header.Set("Content-Encoding", Encoding)
+	header.Set("Content-Length", strconv.Itoa(len(compressed)))
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.ResponseWriter.Write(compressed)
+}
+
+// release returns the held body's memory to the budget
+func (cw *compressingWriter) release() {
+	cw.budget.Release(cw.reserved)
+	cw.reserved = 0
+}
@@ -0,0 +1,521 @@
+package compression
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// This file implements a Zstandard (RFC 8878) encoder tuned for small
+// responses and a shared dictionary. Matches are found with hash chains
+// over the dictionary and the response, literals are stored raw and
+// sequences are coded with the predefined FSE distributions, so no
+// entropy tables are built or transmitted per response. Most of the gain
+// on repetitive JSON comes from matching field names and values against
+// the dictionary, which this captures.
+
+// Frame and block constants
+const (
+	// zstdMagic starts every Zstandard frame
+	zstdMagic = 0xFD2FB528
+
+	// maxBlockSize is the largest block content
+	maxBlockSize = 128 << 10
+
+	// minMatch is the shortest match searched for
+	minMatch = 4
+
+	// searchDepth bounds the candidates compared per position and source
+	searchDepth = 16
+
+	// dictionaryHashLog sizes the dictionary's hash table
+	dictionaryHashLog = 16
+
+	// maxOffsetCode is the largest offset code of the predefined
+	// distribution
+	maxOffsetCode = 28
+)
+
+// Block types
+const (
+	blockRaw        = 0
+	blockCompressed = 2
+)
+
+// Predefined distributions of RFC 8878 section 3.1.1.3.2.2
+var (
+	literalsLengthDistribution = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+
+	matchLengthDistribution = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+
+	offsetDistribution = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+// Length codes of RFC 8878 section 3.1.1.3.2.1.1: the smallest value of
+// each code and the number of extra bits following it
+var (
+	literalsLengthBase = []uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+
+	literalsLengthBits = []uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+
+	matchLengthBase = []uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+
+	matchLengthBits = []uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Encoding tables built once from the predefined distributions
+var (
+	literalsLengthTable = newFSETable(literalsLengthDistribution, 6)
+	matchLengthTable    = newFSETable(matchLengthDistribution, 6)
+	offsetTable         = newFSETable(offsetDistribution, 5)
+)
+
+// fseTable encodes symbols with one finite state entropy distribution
+type fseTable struct {
+	// log is the accuracy log, the table holds 1<<log states
+	log uint
+
+	// states maps a symbol's subrange to the next state
+	states []uint16
+
+	// symbols holds each symbol's state transformation
+	symbols []fseSymbol
+}
+
+// fseSymbol is the state transformation of one symbol
+type fseSymbol struct {
+	// deltaBits yields the number of bits flushed from a state
+	deltaBits uint32
+
+	// deltaState locates the symbol's subrange in states
+	deltaState int32
+}
+
+// newFSETable builds the encoding table of a normalized distribution,
+// spreading symbols exactly like the decoder does
+func newFSETable(distribution []int16, log uint) *fseTable {
+	size := 1 << log
+	t := &fseTable{log: log, states: make([]uint16, size), symbols: make([]fseSymbol, len(distribution))}
+
+	// Symbols of probability "less than one" take the top of the table
+	cumulative := make([]int, len(distribution)+1)
+	spread := make([]int, size)
+	high := size - 1
+	for s, count := range distribution {
+		if count == -1 {
+			cumulative[s+1] = cumulative[s] + 1
+			spread[high] = s
+			high--
+		} else {
+			cumulative[s+1] = cumulative[s] + int(count)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for s, count := range distribution {
+		for range max(count, 0) {
+			spread[position] = s
+			position = (position + step) & (size - 1)
+			for position > high {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+
+	for u, s := range spread {
+		t.states[cumulative[s]] = uint16(size + u)
+		cumulative[s]++
+	}
+
+	total := int32(0)
+	for s, count := range distribution {
+		switch count {
+		case 0:
+		case -1, 1:
+			t.symbols[s] = fseSymbol{deltaBits: uint32(log<<16) - uint32(size), deltaState: total - 1}
+			total++
+		default:
+			outBits := uint32(log) - uint32(bits.Len16(uint16(count-1))-1)
+			t.symbols[s] = fseSymbol{
+				deltaBits:  outBits<<16 - uint32(count)<<outBits,
+				deltaState: total - int32(count),
+			}
+			total += int32(count)
+		}
+	}
+
+	return t
+}
+
+// init returns the first state, which decodes to symbol
+func (t *fseTable) init(symbol uint8) uint32 {
+	tt := t.symbols[symbol]
+	outBits := (tt.deltaBits + 1<<15) >> 16
+	value := outBits<<16 - tt.deltaBits
+	return uint32(t.states[int32(value>>outBits)+tt.deltaState])
+}
+
+// encode writes the low bits of state and moves it to a state decoding to
+// symbol
+func (t *fseTable) encode(w *bitWriter, state uint32, symbol uint8) uint32 {
+	tt := t.symbols[symbol]
+	outBits := (state + tt.deltaBits) >> 16
+	w.add(state, uint(outBits))
+	return uint32(t.states[int32(state>>outBits)+tt.deltaState])
+}
+
+// bitWriter writes a bitstream read backwards by the decoder
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint
+}
+
+// add appends the low n bits of value
+func (w *bitWriter) add(value uint32, n uint) {
+	w.bits |= (uint64(value) & (1<<n - 1)) << w.n
+	w.n += n
+
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// close appends the end mark and the last partial byte
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+
+	return w.out
+}
+
+// sequence copies literals then a match
+type sequence struct {
+	literals, match, offset uint32
+}
+
+// dictionary is a raw content dictionary with an index of its 4-byte
+// prefixes
+//
+// Thread safety: Immutable once built, safe for concurrent use.
+type dictionary struct {
+	// content precedes every compressed response
+	content []byte
+
+	// head holds the last position of each hash, or -1
+	head []int32
+
+	// chain links each position to the previous one with the same hash
+	chain []int32
+}
+
+// newDictionary indexes content for matching
+func newDictionary(content []byte) *dictionary {
+	d := &dictionary{content: content, head: make([]int32, 1<<dictionaryHashLog), chain: make([]int32, len(content))}
+	for i := range d.head {
+		d.head[i] = -1
+	}
+
+	for i := 0; i+minMatch <= len(content); i++ {
+		h := hash4(content[i:], dictionaryHashLog)
+		d.chain[i] = d.head[h]
+		d.head[h] = int32(i)
+	}
+
+	return d
+}
+
+// hash4 hashes the first four bytes of b to log bits
+func hash4(b []byte, log uint) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - log)
+}
+
+// encode appends a single segment frame holding src, compressed against
+// the dictionary, to dst. The frame carries no dictionary ID: the decoder
+// is told which dictionary to use out of band.
+func (d *dictionary) encode(dst, src []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, zstdMagic)
+
+	// Single segment frames have no window descriptor, the window is the
+	// content size
+	size := uint64(len(src))
+	switch {
+	case size < 256:
+		dst = append(dst, 1<<5, byte(size))
+	case size < 65536+256:
+		dst = append(dst, 1<<6|1<<5)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(size-256))
+	case size < 1<<32:
+		dst = append(dst, 2<<6|1<<5)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(size))
+	default:
+		dst = append(dst, 3<<6|1<<5)
+		dst = binary.LittleEndian.AppendUint64(dst, size)
+	}
+
+	if len(src) == 0 {
+		return appendBlockHeader(dst, blockRaw, 0, true)
+	}
+
+	m := matcher{dict: d, src: src}
+	m.log = uint(min(max(bits.Len(uint(len(src))), 8), 16))
+	m.head = make([]int32, 1<<m.log)
+	m.chain = make([]int32, len(src))
+	for i := range m.head {
+		m.head[i] = -1
+	}
+
+	for start := 0; start < len(src); start += maxBlockSize {
+		end := min(start+maxBlockSize, len(src))
+		literals, sequences := m.block(start, end)
+		dst = appendBlock(dst, src[start:end], literals, sequences, end == len(src))
+	}
+
+	return dst
+}
+
+// matcher finds matches in the dictionary and earlier response bytes
+type matcher struct {
+	dict *dictionary
+	src  []byte
+
+	// log sizes head
+	log uint
+
+	// head and chain index the response like dictionary does
+	head, chain []int32
+}
+
+// block parses src[start:end] into literals and sequences
+func (m *matcher) block(start, end int) ([]byte, []sequence) {
+	var literals []byte
+	var sequences []sequence
+
+	anchor := start
+	for i := start; i+minMatch <= end; {
+		length, offset := m.find(i, end)
+		if length < minMatch {
+			m.insert(i)
+			i++
+			continue
+		}
+
+		literals = append(literals, m.src[anchor:i]...)
+		sequences = append(sequences, sequence{literals: uint32(i - anchor), match: uint32(length), offset: uint32(offset)})
+
+		for j := i; j < i+length; j++ {
+			m.insert(j)
+		}
+
+		i += length
+		anchor = i
+	}
+
+	return append(literals, m.src[anchor:end]...), sequences
+}
+
+// insert indexes the response position i
+func (m *matcher) insert(i int) {
+	if i+minMatch > len(m.src) {
+		return
+	}
+
+	h := hash4(m.src[i:], m.log)
+	m.chain[i] = m.head[h]
+	m.head[h] = int32(i)
+}
+
+// find returns the longest match at position i ending before end, and its
+// distance back from i through the dictionary's end
+func (m *matcher) find(i, end int) (int, int) {
+	target := m.src[i:end]
+	bestLength, bestOffset := 0, 0
+
+	candidate := m.head[hash4(m.src[i:], m.log)]
+	for depth := 0; candidate >= 0 && depth < searchDepth; depth++ {
+		if length := commonPrefix(m.src[candidate:], target); length > bestLength {
+			bestLength, bestOffset = length, i-int(candidate)
+		}
+		candidate = m.chain[candidate]
+	}
+
+	candidate = m.dict.head[hash4(m.src[i:], dictionaryHashLog)]
+	for depth := 0; candidate >= 0 && depth < searchDepth; depth++ {
+		offset := i + len(m.dict.content) - int(candidate)
+		if length := commonPrefix(m.dict.content[candidate:], target); length > bestLength && bits.Len(uint(offset+3))-1 <= maxOffsetCode {
+			bestLength, bestOffset = length, offset
+		}
+		candidate = m.dict.chain[candidate]
+	}
+
+	return bestLength, bestOffset
+}
+
+// commonPrefix returns the length of the common prefix of a and b
+func commonPrefix(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
+
+// appendBlockHeader appends the header of a block of size bytes
+func appendBlockHeader(dst []byte, blockType int, size int, last bool) []byte {
+	header := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		header |= 1
+	}
+
+	return append(dst, byte(header), byte(header>>8), byte(header>>16))
+}
+
+// appendBlock appends a compressed block, or the raw block when
+// compression does not make it smaller
+func appendBlock(dst, raw, literals []byte, sequences []sequence, last bool) []byte {
+	body := appendLiterals(nil, literals)
+	body = appendSequences(body, sequences)
+
+	if len(body) >= len(raw) {
+		dst = appendBlockHeader(dst, blockRaw, len(raw), last)
+		return append(dst, raw...)
+	}
+
+	dst = appendBlockHeader(dst, blockCompressed, len(body), last)
+	return append(dst, body...)
+}
+
+// appendLiterals appends a raw literals section
+func appendLiterals(dst, literals []byte) []byte {
+	n := len(literals)
+	switch {
+	case n < 32:
+		dst = append(dst, byte(n<<3))
+	case n < 4096:
+		dst = append(dst, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		header := 3<<2 | n<<4
+		dst = append(dst, byte(header), byte(header>>8), byte(header>>16))
+	}
+
+	return append(dst, literals...)
+}
+
+// appendSequences appends a sequences section coded with the predefined
+// distributions
+func appendSequences(dst []byte, sequences []sequence) []byte {
+	n := len(sequences)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7F00:
+		dst = append(dst, byte(n>>8+0x80), byte(n))
+	default:
+		dst = append(dst, 0xFF, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+
+	if n == 0 {
+		return dst
+	}
+
+	// Predefined mode for all three symbol types
+	dst = append(dst, 0)
+
+	type coded struct {
+		ll, ml, of                uint8
+		llExtra, mlExtra, ofExtra uint32
+	}
+
+	codes := make([]coded, n)
+	for i, s := range sequences {
+		ll := lengthCode(literalsLengthBase, s.literals)
+		ml := lengthCode(matchLengthBase, s.match)
+
+		// Offsets above 3 are sent as offset+3, values 1 to 3 being
+		// repeat codes this encoder does not use
+		offset := s.offset + 3
+		of := uint8(bits.Len32(offset) - 1)
+
+		codes[i] = coded{
+			ll: ll, ml: ml, of: of,
+			llExtra: s.literals - literalsLengthBase[ll],
+			mlExtra: s.match - matchLengthBase[ml],
+			ofExtra: offset - 1<<of,
+		}
+	}
+
+	// The decoder reads backwards, so the last sequence is written first
+	w := bitWriter{out: dst}
+	last := codes[n-1]
+	llState := literalsLengthTable.init(last.ll)
+	mlState := matchLengthTable.init(last.ml)
+	ofState := offsetTable.init(last.of)
+
+	w.add(last.llExtra, uint(literalsLengthBits[last.ll]))
+	w.add(last.mlExtra, uint(matchLengthBits[last.ml]))
+	w.add(last.ofExtra, uint(last.of))
+
+	for i := n - 2; i >= 0; i-- {
+		c := codes[i]
+		ofState = offsetTable.encode(&w, ofState, c.of)
+		mlState = matchLengthTable.encode(&w, mlState, c.ml)
+		llState = literalsLengthTable.encode(&w, llState, c.ll)
+
+		w.add(c.llExtra, uint(literalsLengthBits[c.ll]))
+		w.add(c.mlExtra, uint(matchLengthBits[c.ml]))
+		w.add(c.ofExtra, uint(c.of))
+	}
+
+	w.add(mlState, matchLengthTable.log)
+	w.add(ofState, offsetTable.log)
+	w.add(llState, literalsLengthTable.log)
+
+	return w.close()
+}
+
+// lengthCode returns the code of a length given the codes' smallest values
+func lengthCode(base []uint32, length uint32) uint8 {
+	code := len(base) - 1
+	for base[code] > length {
+		code--
+	}
+
+	return uint8(code)
+}
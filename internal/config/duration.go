@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// durationType is the type of every duration field in the configuration
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// checkDurations validates every duration value of a configuration
+// document before it is decoded into a value of type t.
+//
+// Durations are written as Go duration strings: "500ms", "2m", "1h30m".
+// A bare number is ambiguous and rejected with a hint, except 0, which is
+// rewritten to "0s" so it decodes. Errors name the line and the field
+// path, e.g. "line 4: server.read_timeout"; without this check the YAML
+// decoder only reports that a value cannot be decoded into a Duration.
+func checkDurations(node *yaml.Node, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch {
+	case t == durationType:
+		return checkDuration(node, path)
+
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field, ok := fieldByTag(t, node.Content[i].Value)
+			if !ok {
+				continue
+			}
+
+			if err := checkDurations(node.Content[i+1], field.Type, join(path, node.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			if err := checkDurations(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := checkDurations(node.Content[i+1], t.Elem(), join(path, node.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDuration validates a single duration value
+func checkDuration(node *yaml.Node, path string) error {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return nil
+	}
+
+	value := strings.TrimSpace(node.Value)
+
+	switch node.Tag {
+	case "!!int", "!!float":
+		if value == "0" {
+			node.Tag, node.Value = "!!str", "0s"
+			return nil
+		}
+
+		return fmt.Errorf("line %d: %s: duration %s has no unit, write it as e.g. \"%ss\" or \"%sms\"",
+			node.Line, path, value, value, value)
+	}
+
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("line %d: %s: invalid duration %q, expected a number with a unit such as \"500ms\", \"2m\" or \"1h30m\"",
+			node.Line, path, node.Value)
+	}
+
+	return nil
+}
+
+// fieldByTag returns the struct field decoded from a YAML key
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// join appends a key to a field path
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// ApplyDurationDefaults resets the zero durations of a configuration built
+// in code to their defaults, as loading a file does
+func ApplyDurationDefaults(cfg *Config) {
+	applyDurationDefaults(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(DefaultConfig()).Elem())
+}
+
+// applyDurationDefaults resets zero durations of cfg to their value in
+// defaults, so a timeout written as 0 falls back to its documented
+// default instead of disabling the timeout. Only fields present in
+// defaults are covered: durations inside routes, targets and other lists
+// are defaulted by the components reading them.
+func applyDurationDefaults(cfg, defaults reflect.Value) {
+	for i := 0; i < cfg.NumField(); i++ {
+		if !cfg.Type().Field(i).IsExported() {
+			continue
+		}
+
+		field, fallback := cfg.Field(i), defaults.Field(i)
+
+		switch {
+		case field.Type() == durationType:
+			if field.Int() == 0 && fallback.Int() != 0 {
+				field.SetInt(fallback.Int())
+			}
+		case field.Kind() == reflect.Struct:
+			applyDurationDefaults(field, fallback)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expandRouteGroups replaces the route_groups of a configuration document
+// with the routes they define, appended to routes.
+//
+// A route group is written like a route with a routes list of children.
+// Every setting of the group other than name, path_prefix and routes is
+// inherited by its children, which override it key by key: nested
+// mappings are merged, while scalars and lists set by a child replace the
+// group's. A child's path_prefix is relative to the group's and its name
+// is prefixed "<group>/". Children with routes of their own are groups
+// in turn:
+//
+//	route_groups:
+//	  - name: orders
+//	    path_prefix: /api/orders
+//	    upstream: orders
+//	    timeout: 5s
+//	    routes:
+//	      - name: list              # orders/list at /api/orders
+//	      - name: exports           # orders/exports at /api/orders/exports
+//	        path_prefix: /exports
+//	        timeout: 2m
+//
+// Groups are expanded before the document is decoded, so the rest of the
+// gateway, /admin/routes.json included, sees only the resulting routes.
+func expandRouteGroups(root *yaml.Node) error {
+	groups := resolveAlias(mappingValue(root, "route_groups"))
+	if groups == nil {
+		return nil
+	}
+
+	if groups.Kind != yaml.SequenceNode {
+		if groups.Tag == "!!null" {
+			deleteMappingKey(root, "route_groups")
+			return nil
+		}
+
+		return fmt.Errorf("route_groups: expected a list")
+	}
+
+	var expanded []*yaml.Node
+	for i, group := range groups.Content {
+		routes, err := expandGroup(resolveAlias(group), &yaml.Node{Kind: yaml.MappingNode}, "", "", fmt.Sprintf("route_groups[%d]", i))
+		if err != nil {
+			return err
+		}
+
+		expanded = append(expanded, routes...)
+	}
+
+	deleteMappingKey(root, "route_groups")
+
+	routes := resolveAlias(mappingValue(root, "routes"))
+	switch {
+	case routes == nil:
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "routes"},
+			&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: expanded},
+		)
+	case routes.Kind == yaml.SequenceNode:
+		routes.Content = append(routes.Content, expanded...)
+	case routes.Tag == "!!null":
+		*routes = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: expanded}
+	default:
+		return fmt.Errorf("routes: expected a list")
+	}
+
+	return nil
+}
+
+// expandGroup returns the routes defined by group, whose settings are
+// merged over inherited. prefix and name are the parent group's path
+// prefix and name, empty at the top level.
+func expandGroup(group, inherited *yaml.Node, prefix, name, path string) ([]*yaml.Node, error) {
+	if group == nil || group.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expected a mapping", path)
+	}
+
+	var groupName, groupPrefix string
+	var children *yaml.Node
+	settings := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+
+	for i := 0; i+1 < len(group.Content); i += 2 {
+		key, value := group.Content[i], resolveAlias(group.Content[i+1])
+
+		switch key.Value {
+		case "name":
+			groupName = value.Value
+		case "path_prefix":
+			groupPrefix = value.Value
+		case "routes":
+			children = value
+		default:
+			settings.Content = append(settings.Content, key, value)
+		}
+	}
+
+	merged := mergeNodes(inherited, settings)
+	fullPrefix := joinPrefix(prefix, groupPrefix)
+	fullName := joinName(name, groupName)
+
+	// A member without routes is a route
+	if children == nil {
+		route := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: append([]*yaml.Node(nil), merged.Content...)}
+		if fullName != "" {
+			setMappingString(route, "name", fullName)
+		}
+		if fullPrefix != "" {
+			setMappingString(route, "path_prefix", fullPrefix)
+		}
+
+		return []*yaml.Node{route}, nil
+	}
+
+	if children.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s.routes: expected a list", path)
+	}
+
+	var routes []*yaml.Node
+	for i, child := range children.Content {
+		childPath := fmt.Sprintf("%s.routes[%d]", path, i)
+
+		// Unnamed children get the name the router would give them,
+		// scoped to the group
+		child = resolveAlias(child)
+		if child != nil && child.Kind == yaml.MappingNode && mappingValue(child, "name") == nil && fullName != "" {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: append([]*yaml.Node(nil), child.Content...)}
+			setMappingString(child, "name", fmt.Sprintf("route-%d", i))
+		}
+
+		expanded, err := expandGroup(child, merged, fullPrefix, fullName, childPath)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, expanded...)
+	}
+
+	return routes, nil
+}
+
+// mergeNodes returns base with override merged over it. Mappings are
+// merged key by key; any other override replaces the base value.
+func mergeNodes(base, override *yaml.Node) *yaml.Node {
+	base, override = resolveAlias(base), resolveAlias(override)
+	if base == nil || base.Kind != yaml.MappingNode || override.Kind != yaml.MappingNode {
+		return override
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: append([]*yaml.Node(nil), base.Content...)}
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+
+		replaced := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				merged.Content[j+1] = mergeNodes(merged.Content[j+1], value)
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+
+	return merged
+}
+
+// joinPrefix appends a child path prefix to its group's
+func joinPrefix(group, child string) string {
+	switch {
+	case group == "":
+		return child
+	case child == "" || child == "/":
+		return group
+	}
+
+	return strings.TrimRight(group, "/") + "/" + strings.TrimLeft(child, "/")
+}
+
+// joinName scopes a child name to its group's
+func joinName(group, child string) string {
+	if group == "" || child == "" {
+		return group + child
+	}
+
+	return group + "/" + child
+}
+
+// resolveAlias returns the node an alias refers to, or node itself
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	return node
+}
+
+// setMappingString sets key to a string scalar in a mapping node, adding
+// the key if it is missing
+func setMappingString(mapping *yaml.Node, key, value string) {
+	scalar := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = scalar
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, scalar)
+}
+
+// deleteMappingKey removes key from a mapping node
+func deleteMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
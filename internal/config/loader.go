@@ -1,32 +1,20 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"reflect"
 
 	"gopkg.in/yaml.v3"
 )
 
 // LoadFromFile loads configuration from a YAML file and merges it with
-// defaults.
-//
-// This function:
-//  1. Start with default configuration values
-//  2. Reads the specified YAML file
-//  3. Unmarshals YAML data over the defaults
-//  4. Returns the merged configuration
+// defaults, see Load.
 //
 // The file path can be absolute or relative to the current working directory.
-// If the file doesn't exist or has invalid YAML syntax, an error is returned.
-//
-// Parameters:
-//
-//	filename: Path to the YAML configuration file
-//
-// Returns:
-//
-//	*Config: Loaded configuration with defaults applied
-//	error: File reading or YAML parsing error
+// If the file doesn't exist or its contents are invalid, an error is returned.
 //
 // Example:
 //
@@ -35,15 +23,73 @@ import (
 //	   log.Fatalf("Failed to load config: %v", err)
 //	}
 func LoadFromFile(filename string) (*Config, error) {
-	cfg := DefaultConfig()
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read configuration file: %w", err)
 	}
 
-	if err := yaml.Unmarshal(data, cfg); err != nil {
+	return Load(data)
+}
+
+// Load parses a YAML configuration document and merges it with defaults.
+//
+// This function:
+//  1. Start with default configuration values
+//  2. Migrates documents written for an older schema version to
+//     CurrentVersion, recording a note per migration in Migrations
+//  3. Expands route groups into the routes they define
+//  4. Validates every duration, which must carry a unit ("500ms", "2m",
+//     "1h30m")
+//  5. Unmarshals YAML data over the defaults, then resets durations
+//     written as 0 to their defaults
+//  6. Records the document's hash so running versions can be told apart
+//  7. Returns the merged configuration
+//
+// If the document has invalid YAML syntax, contains an invalid duration or
+// declares a version newer than CurrentVersion, an error is returned.
+//
+// Parameters:
+//
+//	data: YAML configuration document
+//
+// Returns:
+//
+//	*Config: Loaded configuration with defaults applied
+//	error: YAML parsing error
+func Load(data []byte) (*Config, error) {
+	cfg := DefaultConfig()
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
 		return nil, fmt.Errorf("failed to parse YAML: %w", err)
 	}
 
+	// An empty file leaves the defaults untouched
+	if len(document.Content) > 0 {
+		root := document.Content[0]
+
+		var err error
+		if cfg.Migrations, err = migrate(root); err != nil {
+			return nil, fmt.Errorf("failed to migrate configuration: %w", err)
+		}
+
+		if err := expandRouteGroups(root); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		if err := checkDurations(root, reflect.TypeOf(cfg), ""); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		if err := root.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+
+		ApplyDurationDefaults(cfg)
+	}
+
+	sum := sha256.Sum256(data)
+	cfg.Hash = hex.EncodeToString(sum[:6])
+
 	return cfg, nil
 }
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the configuration schema version this gateway reads.
+// Bump it together with a new migration whenever a release renames,
+// moves or reinterprets a configuration field.
+const CurrentVersion = 1
+
+// migration upgrades a configuration document by one schema version
+type migration struct {
+	// from is the version the migration upgrades from
+	from int
+
+	// summary describes the change, reported as a warning on load
+	summary string
+
+	// apply rewrites the document's top-level mapping in place
+	apply func(root *yaml.Node) error
+}
+
+// migrations holds one migration per version before CurrentVersion,
+// ordered by from. Migrations work on the YAML tree rather than on Config
+// so they can read fields the current schema no longer has.
+var migrations = []migration{
+	{
+		from:    0,
+		summary: "the file has no version field; its fields are read unchanged, add \"version: 1\" to silence this warning",
+		apply:   func(*yaml.Node) error { return nil },
+	},
+}
+
+// migrate upgrades the top-level mapping of a configuration document to
+// CurrentVersion and sets its version field accordingly.
+//
+// A document without a version field is version 0, the schema before
+// versioning was introduced. Returns one note per migration applied, or
+// an error if the version is invalid or newer than CurrentVersion.
+func migrate(root *yaml.Node) ([]string, error) {
+	version := 0
+
+	if node := mappingValue(root, "version"); node != nil {
+		if err := node.Decode(&version); err != nil {
+			return nil, fmt.Errorf("version: %w", err)
+		}
+
+		if version < 0 {
+			return nil, fmt.Errorf("version: must not be negative, got %d", version)
+		}
+
+		if version > CurrentVersion {
+			return nil, fmt.Errorf("version: configuration version %d is newer than the supported version %d, upgrade the gateway",
+				version, CurrentVersion)
+		}
+	}
+
+	var notes []string
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+
+		if err := m.apply(root); err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %w", m.from, err)
+		}
+
+		notes = append(notes, fmt.Sprintf("version %d to %d: %s", m.from, m.from+1, m.summary))
+		version = m.from + 1
+	}
+
+	setMappingValue(root, "version", fmt.Sprint(version))
+	return notes, nil
+}
+
+// mappingValue returns the value of key in a mapping node, or nil if the
+// node is not a mapping or has no such key
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// setMappingValue sets key to a scalar value in a mapping node, adding the
+// key if it is missing. Does nothing if the node is not a mapping.
+func setMappingValue(mapping *yaml.Node, key, value string) {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return
+	}
+
+	if node := mappingValue(mapping, key); node != nil {
+		*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value}
+		return
+	}
+
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value},
+	)
+}
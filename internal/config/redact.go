@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+
+	"velocity/internal/secrets"
+)
+
+// RedactedValue replaces secret values in configuration dumps
+const RedactedValue = "[redacted]"
+
+// Dump returns cfg as YAML, with every field tagged secret:"true" replaced
+// by RedactedValue and the passwords of URLs tagged secret:"url" masked.
+// Secret references such as "env:NAME" are kept, as they name where a
+// secret lives rather than holding it.
+func Dump(cfg *Config) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+
+	redact(&node, reflect.TypeOf(cfg))
+
+	return yaml.Marshal(&node)
+}
+
+// redact replaces the secret values of a node encoded from a value of
+// type t
+func redact(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field, ok := fieldByTag(t, node.Content[i].Value)
+			if !ok {
+				continue
+			}
+
+			value := node.Content[i+1]
+			if value.Kind == yaml.ScalarNode && value.Value != "" && !secrets.IsReference(value.Value) {
+				switch field.Tag.Get("secret") {
+				case "true":
+					value.Value, value.Tag, value.Style = RedactedValue, "!!str", 0
+					continue
+				case "url":
+					if u, err := url.Parse(value.Value); err == nil {
+						value.Value = u.Redacted()
+					}
+					continue
+				}
+			}
+
+			// Lists of URLs, such as broker addresses
+			if value.Kind == yaml.SequenceNode && field.Tag.Get("secret") == "url" {
+				for _, item := range value.Content {
+					if u, err := url.Parse(item.Value); err == nil && item.Kind == yaml.ScalarNode {
+						item.Value = u.Redacted()
+					}
+				}
+				continue
+			}
+
+			redact(value, field.Type)
+		}
+
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			redact(item, t.Elem())
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			redact(node.Content[i], t.Elem())
+		}
+	}
+}
@@ -20,6 +20,10 @@ import "time"
 // It contains all settings needed to run the gateway including server
 // configuration and backend target definitions.
 type Config struct {
+	// Version is the schema version the file was written for. Files
+	// without it are version 0 and are migrated on load.
+	Version int `yaml:"version"`
+
 	// Server contains HTTP server settings like port and timeouts
 	Server ServerConfig `yaml:"server"`
 
@@ -28,6 +32,552 @@ type Config struct {
 
 	// Logging configures log output format and verbosity
 	Logging LoggingConfig `yaml:"logging"`
+
+	// UpstreamTLS configures TLS for connections from the gateway to targets
+	UpstreamTLS UpstreamTLSConfig `yaml:"upstream_tls"`
+
+	// UpstreamDial configures how connections to targets are established
+	UpstreamDial UpstreamDialConfig `yaml:"upstream_dial"`
+
+	// EgressProxy sends upstream connections through a forward proxy
+	EgressProxy EgressProxyConfig `yaml:"egress_proxy"`
+
+	// ConnectionPool limits the upstream connections of the gateway's
+	// targets, and of tenant and upstream group targets unless they
+	// override it
+	ConnectionPool ConnectionPoolConfig `yaml:"connection_pool"`
+
+	// Auth configures client authentication in front of the proxy
+	Auth AuthConfig `yaml:"auth"`
+
+	// ExtAuthz asks an external service whether each request may proceed
+	ExtAuthz ExtAuthzConfig `yaml:"ext_authz"`
+
+	// RateLimit is the default rate limit policy for all proxied traffic
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// LoadShedding protects the gateway under overload by QoS class
+	LoadShedding LoadSheddingConfig `yaml:"load_shedding"`
+
+	// OutlierDetection passively ejects failing or slow targets
+	OutlierDetection OutlierDetectionConfig `yaml:"outlier_detection"`
+
+	// RetryBudget caps retries to a share of requests
+	RetryBudget RetryBudgetConfig `yaml:"retry_budget"`
+
+	// SessionAffinity pins clients to a target with a cookie
+	SessionAffinity SessionAffinityConfig `yaml:"session_affinity"`
+
+	// LoadBalancing selects how requests are spread over the targets
+	LoadBalancing LoadBalancingConfig `yaml:"load_balancing"`
+
+	// Discovery adds targets resolved from an external source
+	Discovery DiscoveryConfig `yaml:"discovery"`
+
+	// Cluster shares rate limit usage and target health between gateway
+	// instances
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	// Memory bounds the bytes buffered in memory across the gateway
+	Memory MemoryConfig `yaml:"memory"`
+
+	// RequestNormalization canonicalizes request targets and Host headers
+	RequestNormalization NormalizationConfig `yaml:"request_normalization"`
+
+	// Errors bounds the context carried by structured errors
+	Errors ErrorsConfig `yaml:"errors"`
+
+	// Admin configures the operational API listener
+	Admin AdminConfig `yaml:"admin"`
+
+	// Reload controls hot reload probation and rollback
+	Reload ReloadConfig `yaml:"reload"`
+
+	// Upstreams defines named target pools routes forward to, so routes
+	// of one gateway can reach different backends
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+
+	// Routes defines path based routes with per-route policies.
+	// Requests matching no route are handled by Fallback. Routes defined
+	// in route_groups, which share a base path and settings, are appended
+	// when the file is loaded.
+	Routes []RouteConfig `yaml:"routes"`
+
+	// Fallback handles requests matching no route, by default proxying
+	// them to Targets
+	Fallback FallbackConfig `yaml:"fallback"`
+
+	// Tenants groups routes, targets and policies into isolated namespaces
+	// so one gateway can be shared by several teams
+	Tenants []TenantConfig `yaml:"tenants"`
+
+	// Debug enables the ping and request echo endpoints
+	Debug DebugConfig `yaml:"debug"`
+
+	// Endpoints restricts who may call the built-in endpoints on the
+	// proxy listener
+	Endpoints EndpointsConfig `yaml:"endpoints"`
+
+	// Experimental holds features under evaluation whose behavior and
+	// configuration may change between releases
+	Experimental ExperimentalConfig `yaml:"experimental"`
+
+	// CorrelationHeaders tells upstreams which route, target and attempt
+	// the gateway chose for each request
+	CorrelationHeaders CorrelationHeadersConfig `yaml:"correlation_headers"`
+
+	// RequestSigning signs upstream requests so backends can verify they
+	// came through the gateway
+	RequestSigning RequestSigningConfig `yaml:"request_signing"`
+
+	// IPBinding binds consumer credentials to the networks they may be
+	// used from and flags use from unexpected networks
+	IPBinding IPBindingConfig `yaml:"ip_binding"`
+
+	// Synthetic sends probe requests through the gateway's own pipeline
+	// to verify routes end to end
+	Synthetic SyntheticConfig `yaml:"synthetic"`
+
+	// GSLB reports this instance's health and capacity to external DNS
+	// and global load balancers, so they weight regions by it
+	GSLB GSLBConfig `yaml:"gslb"`
+
+	// Plugins declares third-party middleware loaded from shared objects
+	// or run as separate processes
+	Plugins []PluginConfig `yaml:"plugins"`
+
+	// Hash identifies the configuration file contents, empty for the
+	// built-in defaults. Set by Load.
+	Hash string `yaml:"-"`
+
+	// Migrations describes the schema migrations applied while loading,
+	// one note per version upgraded. Set by Load.
+	Migrations []string `yaml:"-"`
+
+	// Offline builds the gateway without reaching outside the process: no
+	// health checks, discovery, synthetic probes or SPIFFE workload API,
+	// and plugins are declared but not loaded. Set when validating a
+	// configuration.
+	Offline bool `yaml:"-"`
+}
+
+// CorrelationHeadersConfig defines the X-Velocity-Route, X-Velocity-Target
+// and X-Velocity-Attempt headers added to upstream requests, so backend
+// logs can be lined up with gateway decisions during incident analysis.
+type CorrelationHeadersConfig struct {
+	// Enabled adds the headers to every upstream request. Values sent by
+	// clients are always replaced.
+	Enabled bool `yaml:"enabled"`
+
+	// StripFromResponses removes the headers from upstream responses in
+	// case a backend echoes them back to clients
+	StripFromResponses bool `yaml:"strip_from_responses"`
+}
+
+// RequestSigningConfig defines the HTTP Message Signature (RFC 9421) the
+// gateway attaches to every upstream request, so a backend can verify
+// that a request transited the gateway rather than being sent to it
+// directly from inside the network. The signature covers the method,
+// authority, path and query, any listed headers the request carries, and
+// its creation time:
+//
+//	Signature-Input: velocity=("@method" "@authority" "@path" "@query" "x-request-id");created=1700000000;keyid="velocity";alg="ed25519"
+//	Signature: velocity=:...:
+//
+// Signature and Signature-Input headers sent by clients are replaced.
+type RequestSigningConfig struct {
+	// Enabled signs every upstream request
+	Enabled bool `yaml:"enabled"`
+
+	// Algorithm is "hmac-sha256" (default) or "ed25519"
+	Algorithm string `yaml:"algorithm"`
+
+	// Key is the HMAC secret, at least 32 bytes, or the Ed25519 private
+	// key as a PKCS#8 PEM block or a base64 encoded 32 byte seed.
+	// Supports secret references ("env:NAME", "file:/path"), resolved
+	// when the configuration is loaded.
+	Key string `yaml:"key" secret:"true"`
+
+	// KeyID is sent as the keyid parameter, default "velocity"
+	KeyID string `yaml:"key_id"`
+
+	// Headers are additional request headers covered when present, e.g.
+	// "content-type", "content-digest" or "x-request-id"
+	Headers []string `yaml:"headers"`
+
+	// Validity adds an expires parameter this long after creation, so
+	// captured requests cannot be replayed indefinitely. Zero omits it.
+	Validity time.Duration `yaml:"validity"`
+}
+
+// IPBindingConfig defines a lightweight defense against stolen
+// credentials. A credential, identified like a rate limit key, can be
+// bound to the networks its consumer calls from; use from any other
+// network is a violation. Credentials without a binding can be watched
+// for anomalies instead: the networks a credential is used from during a
+// learning period are remembered, and use from a new network afterwards
+// is flagged.
+//
+// Violations and anomalies are logged, counted and posted to Webhooks.
+// Anomalies are never blocked, since a learned profile is only a guess.
+type IPBindingConfig struct {
+	// Enabled turns IP binding on
+	Enabled bool `yaml:"enabled"`
+
+	// Consumer identifies the credential, written like a rate limit key,
+	// default "header.X-API-Key". Requests where it is empty are not
+	// checked.
+	Consumer string `yaml:"consumer"`
+
+	// Mode is "flag" (default) to report violations and forward the
+	// request, or "block" to also reject it with 403
+	Mode string `yaml:"mode"`
+
+	// Bindings restrict credentials to networks
+	Bindings []IPBindingRule `yaml:"bindings"`
+
+	// Anomalies learns where unbound credentials are used from
+	Anomalies AnomalyDetectionConfig `yaml:"anomalies"`
+
+	// Webhooks receive ip_binding.violation and ip_binding.anomaly events
+	Webhooks []string `yaml:"webhooks"`
+
+	// NotifyInterval is the least time between two notifications for the
+	// same credential and network, default 1h
+	NotifyInterval time.Duration `yaml:"notify_interval"`
+}
+
+// IPBindingRule binds one credential to client networks
+type IPBindingRule struct {
+	// Name identifies the consumer in logs, metrics and notifications,
+	// which never include the credential itself
+	Name string `yaml:"name"`
+
+	// Key is the credential's value as evaluated by Consumer. Supports
+	// secret references ("env:NAME", "file:/path"), resolved when the
+	// configuration is loaded.
+	Key string `yaml:"key" secret:"true"`
+
+	// Networks are the CIDRs the credential may be used from
+	Networks []string `yaml:"networks"`
+}
+
+// AnomalyDetectionConfig defines how unbound credentials are profiled
+type AnomalyDetectionConfig struct {
+	// Enabled profiles credentials without a binding
+	Enabled bool `yaml:"enabled"`
+
+	// LearningPeriod is how long after its first request a credential's
+	// networks are learned rather than flagged, default 24h
+	LearningPeriod time.Duration `yaml:"learning_period"`
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths grouping client
+	// addresses into networks, default 24 and 48
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+
+	// MaxConsumers bounds the credentials profiled, default 10000. Past
+	// it, the profile of an arbitrary credential is forgotten.
+	MaxConsumers int `yaml:"max_consumers"`
+
+	// MaxNetworks bounds the networks remembered per credential, default
+	// 32. A credential seen from more networks stops being flagged.
+	MaxNetworks int `yaml:"max_networks"`
+}
+
+// GSLBConfig feeds the gateway's view of its own health to external DNS
+// or global server load balancers (GSLB). /capacity reports a weight
+// derived from the share of healthy targets and the spare request and
+// memory capacity, and answers 503 once the instance should receive no
+// traffic, so balancers that only check the status work as well. The
+// same report can be pushed to a collector.
+type GSLBConfig struct {
+	// Enabled serves /capacity
+	Enabled bool `yaml:"enabled"`
+
+	// Instance names this instance in reports, default the hostname
+	Instance string `yaml:"instance"`
+
+	// Region and Zone locate the instance for multi-region weighting
+	Region string `yaml:"region"`
+	Zone   string `yaml:"zone"`
+
+	// MaxWeight is the weight of a fully healthy, idle instance,
+	// default 100
+	MaxWeight int `yaml:"max_weight"`
+
+	// MinWeight is the least weight of an instance that is not
+	// unhealthy, so a busy instance is not dropped entirely, default 1
+	MinWeight int `yaml:"min_weight"`
+
+	// MinHealthyShare is the share of healthy targets, from 0 to 1, below
+	// which the instance reports itself unhealthy. 0, the default, does
+	// so only once no target is healthy.
+	MinHealthyShare float64 `yaml:"min_healthy_share"`
+
+	// Push posts the report to a collector periodically
+	Push GSLBPushConfig `yaml:"push"`
+}
+
+// GSLBPushConfig posts capacity reports as JSON to a collector, e.g. a
+// service updating DNS weights
+type GSLBPushConfig struct {
+	// URL receives the reports. Empty disables pushing.
+	URL string `yaml:"url" secret:"url"`
+
+	// Token, when set, is sent as a Bearer token. Supports secret
+	// references ("env:NAME", "file:/path").
+	Token string `yaml:"token" secret:"true"`
+
+	// Interval is the time between reports, default 30s
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout bounds each report, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// SyntheticConfig defines synthetic probes: requests the gateway sends
+// periodically through its own middleware and proxy pipeline, exactly as
+// if a client had sent them. Active health checks only tell whether a
+// target answers; a probe also fails when the route is misconfigured,
+// matches the wrong route, is rejected by its own policies or rewritten
+// to a path the backend does not serve.
+//
+// Probes count toward rate limits and usage like any other request, and
+// carry an X-Velocity-Synthetic header with the probe name so backends
+// can tell them apart.
+type SyntheticConfig struct {
+	// Enabled runs the probes
+	Enabled bool `yaml:"enabled"`
+
+	// Interval is the time between runs of each probe, default 30s
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout bounds each probe request, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Probes lists the requests to send
+	Probes []SyntheticProbeConfig `yaml:"probes"`
+}
+
+// SyntheticProbeConfig defines one synthetic probe
+type SyntheticProbeConfig struct {
+	// Name identifies the probe in logs, metrics and the admin API
+	Name string `yaml:"name"`
+
+	// Route is the route the probe must match, "<tenant>/<name>" for a
+	// tenant route. A probe matching another route fails.
+	Route string `yaml:"route"`
+
+	// Method is the request method, default GET
+	Method string `yaml:"method"`
+
+	// Path is the request path and query, default the route's path prefix
+	Path string `yaml:"path"`
+
+	// Host is the Host header, default localhost
+	Host string `yaml:"host"`
+
+	// Headers are sent with the request, e.g. credentials the route
+	// requires
+	Headers []HeaderValueConfig `yaml:"headers"`
+
+	// Body is the request body
+	Body string `yaml:"body"`
+
+	// ExpectStatus lists the response statuses counting as success,
+	// default any 2xx
+	ExpectStatus []int `yaml:"expect_status"`
+
+	// Interval overrides SyntheticConfig.Interval for this probe
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ExtAuthzConfig delegates authorization decisions to an external HTTP
+// service, in the style of Envoy's ext_authz filter.
+//
+// For every request of a route that does not opt out, the gateway sends a
+// GET request to URL, without the body, carrying the original method,
+// scheme, host, URI, client address and route in X-Forwarded-Method,
+// X-Forwarded-Proto, X-Forwarded-Host, X-Forwarded-Uri, X-Forwarded-For
+// and X-Velocity-Route, the request headers listed in RequestHeaders and
+// the configured Headers. The service answers:
+//
+//   - 2xx to allow the request. The headers listed in UpstreamHeaders are
+//     copied from the answer to the upstream request, e.g. the identity
+//     the service resolved. Clients can never set them themselves.
+//   - 3xx or 4xx to deny it. The client receives the status, the body and
+//     the headers listed in ClientHeaders, e.g. a login redirect or a
+//     WWW-Authenticate challenge.
+//   - anything else, or no answer within Timeout, is a failure: requests
+//     proceed when FailOpen is set and are answered 503 AUTHZ_UNAVAILABLE
+//     otherwise.
+//
+// The check runs after rate limiting, so floods are limited before they
+// reach the service, and after JWT validation.
+type ExtAuthzConfig struct {
+	// Enabled turns the authorization check on
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the address of the authorization service
+	URL string `yaml:"url"`
+
+	// Timeout bounds each check, default 1s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// FailOpen lets requests proceed when the service fails or times out,
+	// instead of answering them 503
+	FailOpen bool `yaml:"fail_open"`
+
+	// RequestHeaders are the client request headers sent to the service,
+	// default Authorization and Cookie
+	RequestHeaders []string `yaml:"request_headers"`
+
+	// UpstreamHeaders are copied from an allowing answer to the upstream
+	// request
+	UpstreamHeaders []string `yaml:"upstream_headers"`
+
+	// ClientHeaders are copied from a denying answer to the client
+	// response, default WWW-Authenticate, Location, Set-Cookie and
+	// Content-Type
+	ClientHeaders []string `yaml:"client_headers"`
+
+	// Headers are sent with every check, e.g. a credential proving the
+	// gateway's identity to the service
+	Headers []HeaderValueConfig `yaml:"headers"`
+}
+
+// RouteExtAuthzConfig adjusts the external authorization check for a
+// route
+type RouteExtAuthzConfig struct {
+	// Disabled skips the check for the route, e.g. for public endpoints or
+	// the authorization service's own login pages
+	Disabled bool `yaml:"disabled"`
+}
+
+// HeaderValueConfig is a header the gateway sends with its own requests,
+// such as synthetic probes and authorization checks
+type HeaderValueConfig struct {
+	// Name is the header name
+	Name string `yaml:"name"`
+
+	// Value is the header value. Supports secret references ("env:NAME",
+	// "file:/path"), resolved when the configuration is loaded.
+	Value string `yaml:"value" secret:"true"`
+}
+
+// PluginConfig declares a plugin: third-party middleware extending request
+// handling without changes to the gateway.
+//
+// A "go" plugin is a shared object built with "go build -buildmode=plugin"
+// against the gateway's Go version, exporting
+//
+//	func Middleware(config map[string]string) (func(http.Handler) http.Handler, error)
+//
+// A "process" plugin is an executable the gateway starts and talks to over
+// its standard input and output, usually written with velocity/pkg/plugin.
+// It sees the headers of every request and may modify them or answer the
+// request itself. A crashed process is restarted.
+//
+// Plugins run on the routes listing them in RouteConfig.Plugins, or on
+// every request when Global is set.
+type PluginConfig struct {
+	// Name identifies the plugin in routes and logs
+	Name string `yaml:"name"`
+
+	// Type is "go" or "process"
+	Type string `yaml:"type"`
+
+	// Path is the shared object or executable
+	Path string `yaml:"path"`
+
+	// Args are passed to a process plugin's executable
+	Args []string `yaml:"args"`
+
+	// Config is passed to the plugin when it is loaded
+	Config map[string]string `yaml:"config"`
+
+	// Global runs the plugin on every request, after authentication and
+	// before routing
+	Global bool `yaml:"global"`
+
+	// Timeout bounds each call to a process plugin, default 1s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// FailOpen lets requests continue when a process plugin fails or times
+	// out, instead of answering 502
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// ExperimentalConfig groups features under evaluation
+type ExperimentalConfig struct {
+	// ShardedWorkers splits the proxy's hot state into shards
+	ShardedWorkers ShardedWorkersConfig `yaml:"sharded_workers"`
+}
+
+// ShardedWorkersConfig defines the shared-nothing proxy mode.
+//
+// By default every request updates the same round-robin cursor and target
+// counters, and all requests to a target share one connection pool. On
+// machines with many cores these shared cache lines limit scaling. In
+// sharded mode each client connection is assigned to one of Shards worker
+// groups with its own cursor, counters and upstream connection pools;
+// statistics are merged when reported. Each target then holds up to
+// Shards times as many idle upstream connections. Compare both modes on
+// the target hardware with "velocity bench" before enabling it.
+type ShardedWorkersConfig struct {
+	// Enabled turns sharding on
+	Enabled bool `yaml:"enabled"`
+
+	// Shards is the number of worker groups, default GOMAXPROCS
+	Shards int `yaml:"shards"`
+}
+
+// EndpointsConfig defines access to the built-in endpoints served on the
+// proxy listener. /targets, /stats and /metrics reveal the upstream
+// topology and traffic, so by default they answer only clients on
+// loopback and private networks; /health stays open for load balancers.
+// The priority lane listener is not restricted, as it is meant to be
+// bound to an internal address.
+type EndpointsConfig struct {
+	// Health controls /health
+	Health EndpointAccessConfig `yaml:"health"`
+
+	// Targets controls /targets
+	Targets EndpointAccessConfig `yaml:"targets"`
+
+	// Stats controls /stats
+	Stats EndpointAccessConfig `yaml:"stats"`
+
+	// Metrics controls /metrics
+	Metrics EndpointAccessConfig `yaml:"metrics"`
+
+	// Capacity controls /capacity, served when GSLB is enabled
+	Capacity EndpointAccessConfig `yaml:"capacity"`
+}
+
+// EndpointAccessConfig restricts access to one built-in endpoint. Denied
+// requests are answered with 404 so the endpoint's existence is not
+// revealed, or 401 when only the token is missing.
+type EndpointAccessConfig struct {
+	// Allow lists the client networks in CIDR notation allowed to call
+	// the endpoint. An empty list allows any client.
+	Allow []string `yaml:"allow"`
+
+	// Token, when set, is additionally required as a Bearer token.
+	// Supports secret references ("env:NAME", "file:/path").
+	Token string `yaml:"token" secret:"true"`
+}
+
+// DebugConfig defines the debug endpoints served on the proxy listener.
+// They reveal routing and credential configuration details and should
+// stay disabled in production.
+type DebugConfig struct {
+	// Enabled serves <prefix>/ping and <prefix>/echo/<path>
+	Enabled bool `yaml:"enabled"`
+
+	// Prefix is the path under which the endpoints are served
+	Prefix string `yaml:"prefix"`
 }
 
 // ServerConfig defines HTTP server configuration parameters.
@@ -43,11 +593,128 @@ type ServerConfig struct {
 
 	// ReadTimeout limits the time spent reading request headers and body.
 	// Prevents slow clients from holding connections open indefinitely.
+	// Default 30s.
 	ReadTimeout time.Duration `yaml:"read_timeout"`
 
 	// WriteTimeout limits the time spent writing the response.
-	// Prevents slow clients from causing resource exhaustion.
+	// Prevents slow clients from causing resource exhaustion. Default 30s.
 	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// MaxConnections caps concurrent client connections on the proxy
+	// listener. Further connections wait in the accept queue. 0 means
+	// unlimited.
+	MaxConnections int `yaml:"max_connections"`
+
+	// TLS terminates TLS on the proxy listener when a certificate is set
+	TLS ServerTLSConfig `yaml:"tls"`
+
+	// PriorityLane serves health checks and metrics on a dedicated
+	// listener that proxy traffic cannot starve
+	PriorityLane PriorityLaneConfig `yaml:"priority_lane"`
+}
+
+// ServerTLSConfig defines the certificate served to clients and how
+// client certificates are verified
+type ServerTLSConfig struct {
+	// CertFile and KeyFile are PEM files of the server certificate chain
+	// and its private key. TLS is disabled when CertFile is empty.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// AutoSelfSigned serves a generated self-signed certificate for
+	// localhost and the listen host when CertFile is empty. The
+	// certificate is cached in the user's cache directory. For local
+	// development only.
+	AutoSelfSigned bool `yaml:"auto_self_signed"`
+
+	// ClientCAFile is a PEM bundle of the CAs that issue client
+	// certificates. Setting it enables client certificate authentication
+	// (mTLS).
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// ClientAuth is "require", the default, to reject clients without a
+	// valid certificate, or "optional" to verify certificates only when
+	// clients present one
+	ClientAuth string `yaml:"client_auth"`
+
+	// Revocation rejects client certificates revoked by their CA
+	Revocation ClientRevocationConfig `yaml:"revocation"`
+
+	// ForwardClientCert describes verified client certificates to
+	// upstreams in the X-Forwarded-Client-Cert header
+	ForwardClientCert ForwardClientCertConfig `yaml:"forward_client_cert"`
+}
+
+// ClientRevocationConfig defines how client certificates are checked for
+// revocation during the TLS handshake. Every certificate of the verified
+// chain below the root is looked up in the CRLs of its issuer and, when no
+// CRL covers the issuer, with the OCSP responder the certificate names.
+// Certificates covered by neither are accepted.
+type ClientRevocationConfig struct {
+	// CRLFiles are PEM or DER certificate revocation lists issued by the
+	// client CAs. Changed files are picked up at most every
+	// RefreshInterval.
+	CRLFiles []string `yaml:"crl_files"`
+
+	// RefreshInterval is how often CRL files are checked for changes,
+	// default 5m
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// OCSP queries the OCSP responder of certificates whose issuer has no
+	// CRL. Answers are cached until the responder's next update, at most
+	// an hour.
+	OCSP bool `yaml:"ocsp"`
+
+	// OCSPTimeout bounds each OCSP query, default 2s
+	OCSPTimeout time.Duration `yaml:"ocsp_timeout"`
+
+	// FailOpen accepts certificates whose status cannot be determined,
+	// because their CRL expired or their OCSP responder failed or does
+	// not know them, instead of failing the handshake
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// ForwardClientCertConfig defines the X-Forwarded-Client-Cert (XFCC)
+// header sent to upstreams, in the format Envoy uses.
+//
+// The header is always removed from requests of untrusted clients, so a
+// client cannot impersonate another by sending its own. With client
+// certificates enabled, the verified certificate of each request is
+// described in a fresh header. Requests from trusted proxies keep the
+// elements those proxies added, and the gateway appends its own.
+type ForwardClientCertConfig struct {
+	// Details are the certificate fields described: "Hash", "Subject",
+	// "URI", "DNS", "Cert" and "Validity". Default Hash, Subject, URI, DNS
+	// and Validity.
+	Details []string `yaml:"details"`
+
+	// TrustedProxies are the CIDRs of proxies in front of the gateway
+	// whose XFCC headers are kept
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// SubjectHeader, when set, names a header carrying the subject of the
+	// verified client certificate, e.g. "X-Client-Cert-Subject", for
+	// upstreams that do not parse XFCC
+	SubjectHeader string `yaml:"subject_header"`
+
+	// FingerprintHeader, when set, names a header carrying the hex SHA-256
+	// fingerprint of the verified client certificate
+	FingerprintHeader string `yaml:"fingerprint_header"`
+}
+
+// PriorityLaneConfig defines the dedicated listener for /health, /targets,
+// /stats and /metrics. It has its own accept loop and connection limit, so
+// probes and scrapes keep being answered while the proxy listener is
+// saturated.
+type PriorityLaneConfig struct {
+	// Enabled starts the priority lane listener
+	Enabled bool `yaml:"enabled"`
+
+	// Address is the host:port of the priority lane listener
+	Address string `yaml:"address"`
+
+	// MaxConnections caps concurrent connections on the priority lane
+	MaxConnections int `yaml:"max_connections"`
 }
 
 // TargetConfig defines configuration for a single backend target service.
@@ -55,11 +722,76 @@ type ServerConfig struct {
 type TargetConfig struct {
 	// URL is the complete backend service URL including scheme, host, and port.
 	// Examples: "http://backend1.com:3000", "https://api.service.com"
-	URL string `yaml:"url"`
+	URL string `yaml:"url" secret:"url"`
 
 	// Enabled determines if this target is currently active for load balancing.
 	// Disabled targets are excluded from request routing but kept in config.
 	Enabled bool `yaml:"enabled"`
+
+	// Protocol selects the upstream HTTP version: "http/1.1", "h2"
+	// (HTTP/2 over TLS only), "h2c" (HTTP/2 over cleartext) or "auto",
+	// the default, which negotiates HTTP/2 via ALPN on https targets and
+	// uses HTTP/1.1 otherwise.
+	Protocol string `yaml:"protocol"`
+
+	// HealthCheck actively probes the target and takes it out of rotation
+	// while it fails
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+
+	// TLS configures the connections to an https target, e.g. the client
+	// certificate authenticating the gateway to a backend requiring mTLS
+	TLS TargetTLSConfig `yaml:"tls"`
+}
+
+// TargetTLSConfig configures TLS towards one https target. Settings given
+// here replace the upstream SPIFFE identity for the target. Certificate
+// files are read when the configuration loads, so rotated files take
+// effect on the next reload.
+type TargetTLSConfig struct {
+	// CertFile and KeyFile are the PEM client certificate and key the
+	// gateway presents to the target
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// CAFile is a PEM bundle of the CAs trusted to sign the target's
+	// certificate. Empty trusts the system roots.
+	CAFile string `yaml:"ca_file"`
+
+	// ServerName overrides the SNI name sent to the target and the name
+	// its certificate is verified against, by default the target's host,
+	// e.g. for targets addressed by IP
+	ServerName string `yaml:"server_name"`
+
+	// InsecureSkipVerify accepts any certificate from the target. Meant
+	// for development against self-signed backends only.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// HealthCheckConfig defines an active health check of one target. Unlike
+// outlier detection, which judges targets by the requests they serve,
+// active checks also notice targets that fail while receiving no traffic.
+type HealthCheckConfig struct {
+	// Type selects the probe: "http" requests Path and expects a 2xx or
+	// 3xx response, "tcp" only opens a connection, for targets without an
+	// HTTP health endpoint. Empty disables the check.
+	Type string `yaml:"type"`
+
+	// Path is the endpoint requested by http checks, default "/health"
+	Path string `yaml:"path"`
+
+	// Interval is the time between probes, default 10s
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout bounds each probe, default 2s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// UnhealthyThreshold is the number of consecutive failed probes that
+	// take the target out of rotation, default 3
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+
+	// HealthyThreshold is the number of consecutive successful probes that
+	// return it, default 2
+	HealthyThreshold int `yaml:"healthy_threshold"`
 }
 
 // LoggingConfig defines logging output format and verbosity settings
@@ -69,34 +801,1889 @@ type LoggingConfig struct {
 
 	// Format specifies the log output format (text, json)
 	Format string `yaml:"format"`
+
+	// AccessLog writes one entry per request, including the serving
+	// target, attempts and upstream timings
+	AccessLog bool `yaml:"access_log"`
+
+	// AccessLogSinks publish access log events to message brokers for
+	// real-time analytics, independently of AccessLog
+	AccessLogSinks []AccessLogSinkConfig `yaml:"access_log_sinks"`
+
+	// SlowRequests logs requests slower than a threshold with their phase
+	// timings
+	SlowRequests SlowRequestConfig `yaml:"slow_requests"`
 }
 
-// DefaultConfig returns a configuration with sensible default values.
-// This configuration works out of the box for development and testing.
-//
-// Default values:
-//   - Server listens on 0.0.0.0:8000
-//   - 30 second read/write timeouts
-//   - Single target pointing to localhost:3000
+// AccessLogSinkConfig defines a message broker receiving one JSON event
+// per request. Events are queued and published in batches in the
+// background; when the broker falls behind, the queue fills up and new
+// events are dropped and counted rather than slowing requests down.
+type AccessLogSinkConfig struct {
+	// Name identifies the sink in metrics and logs, default the type
+	Name string `yaml:"name"`
+
+	// Type selects the broker: "kafka" or "nats"
+	Type string `yaml:"type"`
+
+	// Brokers are the addresses to connect to: "host:port" bootstrap
+	// brokers for Kafka, "nats://[user:password@]host:port" servers for
+	// NATS
+	Brokers []string `yaml:"brokers" secret:"url"`
+
+	// Topic is the Kafka topic or NATS subject events are published to.
+	// Kafka batches rotate over the topic's partitions.
+	Topic string `yaml:"topic"`
+
+	// BatchSize is the most events published at once, default 100
+	BatchSize int `yaml:"batch_size"`
+
+	// FlushInterval is the longest an event waits for its batch to fill
+	// up, default 1s
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// QueueSize is the number of events waiting to be published before
+	// new ones are dropped, default 10000
+	QueueSize int `yaml:"queue_size"`
+
+	// Timeout bounds connecting to the broker and publishing a batch,
+	// default 5s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// SlowRequestConfig defines the slow request log. Requests taking longer
+// than Threshold are logged as warnings with the time spent connecting to
+// the upstream, waiting for its first byte, relaying the body and inside
+// the gateway, and counted per route in velocity_slow_requests_total.
+type SlowRequestConfig struct {
+	// Threshold is the latency above which a request is slow, e.g. "2s".
+	// 0 disables the slow request log.
+	Threshold time.Duration `yaml:"threshold"`
+
+	// TraceURL links slow requests carrying a W3C traceparent header to
+	// their trace, with "{trace_id}" replaced by the trace ID, e.g.
+	// "https://jaeger.example.com/trace/{trace_id}"
+	TraceURL string `yaml:"trace_url"`
+
+	// CaptureStacks logs the stack of the goroutine serving a slow request,
+	// captured when it crosses the threshold, at most once per second.
+	// Capturing dumps every goroutine, which pauses the process briefly.
+	CaptureStacks bool `yaml:"capture_stacks"`
+}
+
+// NormalizationConfig defines how ambiguous request targets are handled
+// before routing, guarding against host-header confusion
+type NormalizationConfig struct {
+	// AbsoluteURI selects the policy for absolute-form request URIs such as
+	// "GET http://host/path": "normalize" (default) rewrites them to
+	// origin-form using the URI's authority as Host, "reject" answers 400
+	AbsoluteURI string `yaml:"absolute_uri"`
+
+	// AllowedHosts, when set, limits accepted Host values. An entry
+	// without a port allows the host on any port, one with a port only
+	// that port, the scheme's default when the request names none.
+	// Requests for other hosts receive 421.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// AdminConfig defines the admin API listener. The admin API is served on a
+// separate address so it can be bound to a private interface.
+type AdminConfig struct {
+	// Enabled starts the admin listener
+	Enabled bool `yaml:"enabled"`
+
+	// Address is the host:port to listen on
+	Address string `yaml:"address"`
+
+	// Token, when set, is required as a Bearer token for every admin
+	// endpoint and grants access to all of them. Supports secret
+	// references ("env:NAME", "file:/path").
+	Token string `yaml:"token" secret:"true"`
+
+	// BasicAuth grants access to every admin endpoint to the users of an
+	// htpasswd file, alongside Token
+	BasicAuth BasicAuthConfig `yaml:"basic_auth"`
+}
+
+// BasicAuthConfig requires HTTP Basic credentials checked against an
+// htpasswd file, as written by Apache's htpasswd with -B (bcrypt), -m
+// (MD5) or -s (SHA-1). Plain text and crypt passwords are refused.
 //
-// Returns a pointer to a new Config instance.
-func DefaultConfig() *Config {
-	return &Config{
-		Server: ServerConfig{
-			Host:         "0.0.0.0",
-			Port:         8080,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-		},
-		Targets: []TargetConfig{
-			{
-				URL:     "http://localhost:3000",
-				Enabled: true,
-			},
-		},
-		Logging: LoggingConfig{
-			Level:  "info",
-			Format: "text",
-		},
+// The file is read again when it changes, checked at most every few
+// seconds, so users are added or removed without a reload; a change that
+// does not parse is logged and the previous users are kept. Credentials
+// are not forwarded upstream.
+type BasicAuthConfig struct {
+	// Enabled requires credentials
+	Enabled bool `yaml:"enabled"`
+
+	// File is the path of the htpasswd file
+	File string `yaml:"file"`
+
+	// Realm is announced in the WWW-Authenticate challenge, default
+	// "velocity"
+	Realm string `yaml:"realm"`
+
+	// UserHeader, when set, carries the authenticated user name to the
+	// upstream. Client supplied values are always removed.
+	UserHeader string `yaml:"user_header"`
+
+	// MaxFailures bounds the failed attempts of one client address per
+	// FailureWindow, default 10. Further attempts are answered 429
+	// without checking the password, before any rate limit of the route.
+	MaxFailures int `yaml:"max_failures"`
+
+	// FailureWindow is the period over which failures are counted,
+	// default 1m
+	FailureWindow time.Duration `yaml:"failure_window"`
+}
+
+// TenantConfig defines a tenant: a named group of routes with its own
+// target pool, rate limit pool and admin credentials. Tenants share the
+// listener and global protections such as load shedding, but not stats,
+// connection pools or rate limit budgets.
+type TenantConfig struct {
+	// Name identifies the tenant in route names, stats and the admin API
+	Name string `yaml:"name"`
+
+	// AdminToken grants access to this tenant's admin endpoints only.
+	// Supports secret references ("env:NAME", "file:/path").
+	AdminToken string `yaml:"admin_token" secret:"true"`
+
+	// Targets is the tenant's backend pool
+	Targets []TargetConfig `yaml:"targets"`
+
+	// EgressProxy replaces the gateway's egress proxy for the tenant's
+	// targets when its URL is set
+	EgressProxy EgressProxyConfig `yaml:"egress_proxy"`
+
+	// ConnectionPool overrides the gateway's connection pool limits for
+	// the tenant's targets, setting by setting
+	ConnectionPool ConnectionPoolConfig `yaml:"connection_pool"`
+
+	// RateLimit is shared by all of the tenant's routes and replaces the
+	// global rate limit for them
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// Routes are the tenant's routes. Their names are prefixed with the
+	// tenant name, their path prefixes must not equal, contain or lie
+	// under another owner's, and priorities above 0 are lowered to 0.
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// UpstreamConfig is a named pool of targets. Routes naming it in their
+// upstream field forward to its targets instead of the gateway's Targets,
+// e.g. "/api/users/" to the users service and "/api/orders/" to the
+// orders service. Groups inherit the gateway-wide upstream settings, such
+// as load balancing, outlier detection and TLS, and keep their own stats
+// and connection pools. Targets are never discovered.
+type UpstreamConfig struct {
+	// Name identifies the group in routes, stats and metrics
+	Name string `yaml:"name"`
+
+	// Targets is the group's backend pool
+	Targets []TargetConfig `yaml:"targets"`
+
+	// EgressProxy replaces the gateway's egress proxy for the group's
+	// targets when its URL is set
+	EgressProxy EgressProxyConfig `yaml:"egress_proxy"`
+
+	// ConnectionPool overrides the gateway's connection pool limits for
+	// the group's targets, setting by setting
+	ConnectionPool ConnectionPoolConfig `yaml:"connection_pool"`
+}
+
+// ReloadConfig defines how hot reloads are validated after being applied.
+// A reloaded configuration stays on probation while the previous one is
+// kept on standby; failing the checks below rolls it back automatically.
+type ReloadConfig struct {
+	// Probation is how long a new configuration is evaluated, default 30s
+	Probation time.Duration `yaml:"probation"`
+
+	// CheckTargets rolls back immediately if no target accepts connections
+	CheckTargets bool `yaml:"check_targets"`
+
+	// MinRequests is the number of upstream requests needed during
+	// probation before the error ratio is considered
+	MinRequests int `yaml:"min_requests"`
+
+	// MaxErrorRatio rolls back when upstream failures / requests reaches it
+	MaxErrorRatio float64 `yaml:"max_error_ratio"`
+
+	// Webhooks receive reload events (applied, rejected, rolled back)
+	Webhooks []string `yaml:"webhooks"`
+
+	// Throttle limits request admission while a configuration or a large
+	// discovery update is applied
+	Throttle ApplyThrottleConfig `yaml:"throttle"`
+}
+
+// ApplyThrottleConfig defines the admission throttle opened when routing
+// tables, pools or TLS material are swapped, so the swap never coincides
+// with a burst of new requests that would pile up behind cold connection
+// pools and amplify tail latency.
+type ApplyThrottleConfig struct {
+	// Enabled turns the throttle on
+	Enabled bool `yaml:"enabled"`
+
+	// Window is how long the throttle stays open after a swap, default 2s
+	Window time.Duration `yaml:"window"`
+
+	// MaxInFlight is the number of requests admitted concurrently while
+	// the throttle is open, default 100
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// MaxWait is how long a request waits for admission before being
+	// answered 503, default 1s
+	MaxWait time.Duration `yaml:"max_wait"`
+
+	// MinDiscoveryChanges is the number of targets a discovery update must
+	// add or remove to open the throttle, default 10
+	MinDiscoveryChanges int `yaml:"min_discovery_changes"`
+}
+
+// MemoryConfig defines the global memory budget for buffered payloads.
+// Request bodies buffered for retries and signing, cached responses and
+// transformed bodies all draw from the same budget.
+type MemoryConfig struct {
+	// MaxBufferedBytes is the budget in bytes; 0 disables accounting
+	MaxBufferedBytes int64 `yaml:"max_buffered_bytes"`
+
+	// MaxRetryBodyBytes is the largest request body buffered so it can be
+	// replayed on retries. Larger bodies are streamed to a single target.
+	MaxRetryBodyBytes int64 `yaml:"max_retry_body_bytes"`
+
+	// MaxResponseHeaderBytes is the largest upstream response header
+	// section read, status line included. Larger headers fail the request
+	// with 502 UPSTREAM_HEADERS_TOO_LARGE. Default 64 KiB; 0 uses Go's
+	// limit of 10 MiB.
+	MaxResponseHeaderBytes int64 `yaml:"max_response_header_bytes"`
+
+	// MaxResponseHeaders is the largest number of header fields in an
+	// upstream response, repeated fields counted once per value. More fail
+	// the request like oversized headers. Default 100; 0 disables the
+	// limit.
+	MaxResponseHeaders int `yaml:"max_response_headers"`
+}
+
+// DiscoveryConfig defines dynamic target discovery.
+// Discovered targets are served alongside the static Targets. When a
+// target disappears from discovery, in-flight requests complete on it and
+// its connections are closed once drained or after DrainTimeout.
+type DiscoveryConfig struct {
+	// Enabled turns discovery on
+	Enabled bool `yaml:"enabled"`
+
+	// Provider selects the source: dns or file
+	Provider string `yaml:"provider"`
+
+	// RefreshInterval is the time between resolutions, default 30s
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// DrainTimeout bounds how long removed targets keep their connection
+	// pools open for in-flight requests, default 30s
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// Protocol is the upstream protocol of every discovered target, as
+	// for TargetConfig.Protocol
+	Protocol string `yaml:"protocol"`
+
+	// DNS configures the dns provider
+	DNS DNSDiscoveryConfig `yaml:"dns"`
+
+	// File configures the file provider
+	File FileDiscoveryConfig `yaml:"file"`
+}
+
+// ClusterConfig defines the optional cluster of gateway instances.
+//
+// Members gossip over UDP: each one periodically sends its membership
+// view, the rate limit tokens it consumed and the targets it ejected to
+// the others, so limits hold across the cluster and a failing target is
+// avoided by every instance once one of them notices. State is shared on
+// a best-effort basis and converges within a few gossip intervals; no
+// external store is required. Cluster settings are read at startup only.
+type ClusterConfig struct {
+	// Enabled joins the cluster
+	Enabled bool `yaml:"enabled"`
+
+	// NodeName identifies this instance, default the hostname
+	NodeName string `yaml:"node_name"`
+
+	// BindAddress is the UDP address gossip is received on
+	BindAddress string `yaml:"bind_address"`
+
+	// AdvertiseAddress is the address other members send gossip to,
+	// default BindAddress. Set it when binding to all interfaces.
+	AdvertiseAddress string `yaml:"advertise_address"`
+
+	// Peers are the gossip addresses contacted to join the cluster.
+	// Further members are learned from them.
+	Peers []string `yaml:"peers"`
+
+	// GossipInterval is the time between gossip rounds, default 1s
+	GossipInterval time.Duration `yaml:"gossip_interval"`
+
+	// SuspectTimeout is how long a member may stay silent before it is
+	// reported as suspect, default 5s. Members silent for twice as long
+	// are removed.
+	SuspectTimeout time.Duration `yaml:"suspect_timeout"`
+
+	// SecretKey authenticates gossip messages with HMAC-SHA256. Every
+	// member must use the same key. Supports secret references such as
+	// "env:VELOCITY_CLUSTER_KEY". Empty accepts unauthenticated gossip.
+	SecretKey string `yaml:"secret_key" secret:"true"`
+}
+
+// DNSDiscoveryConfig resolves a hostname into one target per A/AAAA record,
+// or an SRV name into one target per SRV record. SRV records provide the
+// port, weight and priority of each target, which load balancing honors.
+type DNSDiscoveryConfig struct {
+	// Name is the hostname to resolve, or the SRV name such as
+	// _http._tcp.orders.service.consul
+	Name string `yaml:"name"`
+
+	// Port is the backend port on every resolved address, unused with SRV
+	Port int `yaml:"port"`
+
+	// Scheme is http or https, default http
+	Scheme string `yaml:"scheme"`
+
+	// SRV looks up SRV records instead of addresses
+	SRV bool `yaml:"srv"`
+}
+
+// FileDiscoveryConfig reads target URLs from a file, one per line. A URL
+// may be followed by "weight=N" and "priority=N" to weight the target in
+// load balancing and rank it for failover.
+type FileDiscoveryConfig struct {
+	// Path is the file location
+	Path string `yaml:"path"`
+}
+
+// UpstreamTLSConfig defines how the gateway authenticates itself to backend
+// targets and how it verifies their certificates.
+type UpstreamTLSConfig struct {
+	// SPIFFE enables workload identity based mTLS using the SPIFFE Workload API
+	SPIFFE SPIFFEConfig `yaml:"spiffe"`
+}
+
+// RetryBudgetConfig caps the retries a pool sends relative to the requests
+// it receives over a sliding window. When backends fail together, every
+// failed attempt turning into another attempt multiplies the load on an
+// already struggling fleet; with a budget, requests beyond it fail fast
+// with their first error instead. Tenant pools keep budgets of their own.
+type RetryBudgetConfig struct {
+	// Enabled turns the retry budget on
+	Enabled bool `yaml:"enabled"`
+
+	// Ratio is the share of requests that may be retried, e.g. 0.2 for
+	// one retry per five requests
+	Ratio float64 `yaml:"ratio"`
+
+	// Window is the sliding window requests and retries are counted over
+	Window time.Duration `yaml:"window"`
+
+	// MinRetries is allowed per window regardless of Ratio, so pools with
+	// little traffic can still retry
+	MinRetries int `yaml:"min_retries"`
+}
+
+// OutlierDetectionConfig defines passive health checking based on the
+// outcome of proxied requests.
+// A target is ejected from selection when it fails repeatedly or when its
+// latency deviates significantly from the rest of the pool, since a
+// slow-but-200 backend is often worse than a failing one.
+type OutlierDetectionConfig struct {
+	// Enabled turns outlier detection on
+	Enabled bool `yaml:"enabled"`
+
+	// ConsecutiveFailures ejects a target after this many consecutive
+	// transport errors or 5xx responses. Zero disables error ejection.
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+
+	// FailureWindow only counts consecutive failures occurring within this
+	// duration of the first one, so a target failing now and then over
+	// hours is not ejected. Zero counts failures regardless of time.
+	FailureWindow time.Duration `yaml:"failure_window"`
+
+	// Interval is how often latency is evaluated and ejections expire,
+	// default 10s
+	Interval time.Duration `yaml:"interval"`
+
+	// LatencyMultiplier ejects a target whose mean latency over the last
+	// interval exceeds this multiple of the pool median. Zero disables
+	// latency ejection.
+	LatencyMultiplier float64 `yaml:"latency_multiplier"`
+
+	// MinSamples is the number of requests a target needs within an
+	// interval before its latency is evaluated or counted in the median
+	MinSamples int `yaml:"min_samples"`
+
+	// BaseEjectionTime is how long a first ejection lasts. Repeated
+	// ejections last proportionally longer. Default 30s.
+	BaseEjectionTime time.Duration `yaml:"base_ejection_time"`
+
+	// MaxEjectionTime caps the duration of repeated ejections, default 5m
+	MaxEjectionTime time.Duration `yaml:"max_ejection_time"`
+
+	// RecoveryTime readmits a target gradually once its ejection ends: its
+	// share of traffic ramps up from a tenth to full over this duration.
+	// Zero readmits it at full share.
+	RecoveryTime time.Duration `yaml:"recovery_time"`
+
+	// MaxEjectionPercent is the largest share of the pool that may be
+	// ejected at once
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+}
+
+// SessionAffinityConfig pins each client to the target that served its
+// first request, for backends that keep session state in memory.
+// The affinity cookie names the target by an opaque hash, never by its
+// address. When the pinned target is removed, ejected or fails, the
+// failover strategy decides whether the session moves to another target
+// or the client is told to start over.
+type SessionAffinityConfig struct {
+	// Enabled turns session affinity on
+	Enabled bool `yaml:"enabled"`
+
+	// Cookie is the name of the affinity cookie
+	Cookie string `yaml:"cookie"`
+
+	// TTL is the cookie lifetime. Zero issues a cookie that lasts for
+	// the browser session.
+	TTL time.Duration `yaml:"ttl"`
+
+	// Failover is "rehash", which moves the session to another target and
+	// updates the cookie, or "reject", which answers with RejectStatus and
+	// clears the cookie so the client can log in again
+	Failover string `yaml:"failover"`
+
+	// RejectStatus is the status returned by the reject strategy
+	RejectStatus int `yaml:"reject_status"`
+}
+
+// LoadBalancingConfig selects how requests are spread over the targets
+type LoadBalancingConfig struct {
+	// Algorithm is "round_robin" (default), which rotates through the
+	// targets, "consistent_hash", which sends requests with the same key
+	// to the same target, or "p2c", which samples two random targets and
+	// picks the one with less load: response latency EWMA times requests
+	// in flight
+	Algorithm string `yaml:"algorithm"`
+
+	// ConsistentHash configures the consistent_hash algorithm
+	ConsistentHash ConsistentHashConfig `yaml:"consistent_hash"`
+}
+
+// ConsistentHashConfig defines consistent hashing, for cache-friendly
+// routing to stateful backends. Targets are placed on a hash ring with
+// many virtual nodes each, so adding or removing a target only moves the
+// keys next to its nodes, about 1/N of them, to other targets. Session
+// affinity cookies take precedence over the hash key.
+type ConsistentHashConfig struct {
+	// Key is the hash key, written like a rate limit key: "client_ip"
+	// (default), "header.X-User-ID", "cookie.session" or terms joined
+	// by "+". Requests missing the value all share the empty key.
+	Key string `yaml:"key"`
+
+	// VirtualNodes is the number of ring points per target, default 160.
+	// More points spread keys more evenly at the cost of memory.
+	VirtualNodes int `yaml:"virtual_nodes"`
+}
+
+// ErrorsConfig bounds the context attached to structured gateway errors,
+// which is logged with every failure
+type ErrorsConfig struct {
+	// ContextSoftLimit is the number of context keys after which further
+	// keys are counted as soft limit violations
+	ContextSoftLimit int `yaml:"context_soft_limit"`
+
+	// ContextHardLimit is the maximum number of context keys; further keys
+	// are dropped
+	ContextHardLimit int `yaml:"context_hard_limit"`
+
+	// MaxContextValueBytes truncates longer string context values
+	MaxContextValueBytes int `yaml:"max_context_value_bytes"`
+}
+
+// EgressProxyConfig routes upstream connections through a forward proxy,
+// for targets only reachable via a corporate proxy. Every connection is
+// tunneled, whatever the target's scheme and protocol, so TLS to the
+// target is still negotiated end to end.
+type EgressProxyConfig struct {
+	// URL of the proxy. "http://proxy:3128" and "https://proxy:3128"
+	// tunnel with HTTP CONNECT, "socks5://proxy:1080" uses SOCKS5. Empty
+	// disables the proxy.
+	URL string `yaml:"url" secret:"url"`
+
+	// Username authenticates to the proxy, with basic authentication for
+	// HTTP CONNECT and username/password authentication for SOCKS5
+	Username string `yaml:"username"`
+
+	// Password authenticates to the proxy. Supports secret references
+	// ("env:NAME", "file:/path").
+	Password string `yaml:"password" secret:"true"`
+
+	// NoProxy lists target hosts dialed directly. An entry starting with
+	// a dot matches every subdomain, e.g. ".internal".
+	NoProxy []string `yaml:"no_proxy"`
+}
+
+// ConnectionPoolConfig limits the upstream connections of a pool of
+// targets.
+//
+// Every pool of targets, the gateway's own, each tenant's and each
+// upstream group's, keeps its own connections, and every target in it its
+// own pool of them. Without limits a slow target accumulates connections
+// for as long as requests keep arriving; with MaxConnsPerTarget set,
+// requests beyond the limit wait for one of the target's connections to
+// become free, within the route's timeout, while other targets and pools
+// are unaffected.
+type ConnectionPoolConfig struct {
+	// MaxConnsPerTarget caps the connections to each target, including
+	// those being dialed and in use, 0 for no limit. In sharded mode the
+	// cap applies per target and shard.
+	MaxConnsPerTarget int `yaml:"max_conns_per_target"`
+
+	// MaxIdleConnsPerTarget is the number of idle connections kept per
+	// target for reuse, default 2
+	MaxIdleConnsPerTarget int `yaml:"max_idle_conns_per_target"`
+
+	// IdleTimeout closes connections idle for this long, default 90s
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// UpstreamDialConfig defines how the gateway connects to targets.
+// Host names are dialed with Happy Eyeballs (RFC 8305): IPv6 and IPv4
+// addresses are raced so a blackholed family does not stall requests until
+// the connect timeout.
+//
+// Host names are resolved for every new connection. When resolution fails,
+// e.g. during a DNS outage, the addresses last resolved successfully keep
+// being dialed for StaleGrace, so the pool does not lose every target at
+// once. Names the DNS server reports as nonexistent are not covered.
+type UpstreamDialConfig struct {
+	// PreferredFamily is the address family attempted first: ipv6 or ipv4
+	PreferredFamily string `yaml:"preferred_family"`
+
+	// FallbackDelay is how long a connection attempt runs before the next
+	// address is tried in parallel (RFC 8305 Connection Attempt Delay),
+	// default 250ms
+	FallbackDelay time.Duration `yaml:"fallback_delay"`
+
+	// ResolutionDelay is how long to wait for AAAA records once the A
+	// records have arrived, default 50ms
+	ResolutionDelay time.Duration `yaml:"resolution_delay"`
+
+	// Timeout bounds each individual connection attempt, default 30s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// KeepAlive is the TCP keep-alive period of upstream connections,
+	// default 30s
+	KeepAlive time.Duration `yaml:"keep_alive"`
+
+	// StaleGrace is how long after their last successful resolution the
+	// addresses of a host name are dialed while resolving it fails,
+	// default 5m. Negative turns the fallback off.
+	StaleGrace time.Duration `yaml:"stale_grace"`
+}
+
+// SPIFFEConfig defines SPIFFE/SPIRE workload identity settings.
+// When enabled, the gateway fetches X.509 SVIDs from the local Workload API,
+// presents them as client certificates to upstreams and verifies upstream
+// server SVIDs against the trust bundle instead of the system roots.
+type SPIFFEConfig struct {
+	// Enabled turns on SPIFFE based upstream mTLS
+	Enabled bool `yaml:"enabled"`
+
+	// WorkloadAPISocket is the Workload API endpoint, e.g.
+	// "unix:///run/spire/sockets/agent.sock". Falls back to the
+	// SPIFFE_ENDPOINT_SOCKET environment variable when empty.
+	WorkloadAPISocket string `yaml:"workload_api_socket"`
+
+	// TrustDomain restricts accepted upstream SVIDs to a single trust domain.
+	// Defaults to the trust domain of the gateway's own SVID.
+	TrustDomain string `yaml:"trust_domain"`
+
+	// AllowedIDs lists the SPIFFE IDs upstreams may present.
+	// An empty list accepts any ID within the trust domain.
+	AllowedIDs []string `yaml:"allowed_ids"`
+
+	// FetchTimeout bounds how long startup waits for the first SVID,
+	// default 10s
+	FetchTimeout time.Duration `yaml:"fetch_timeout"`
+}
+
+// AuthConfig groups the client authentication mechanisms
+type AuthConfig struct {
+	// JWT enables bearer token validation
+	JWT JWTConfig `yaml:"jwt"`
+
+	// OIDC signs browser users in with an OpenID Connect provider
+	OIDC OIDCConfig `yaml:"oidc"`
+}
+
+// OIDCConfig makes the gateway an OpenID Connect relying party for browser
+// traffic, so web applications behind it need no login code of their own.
+//
+// A request of a route that does not opt out must carry a session cookie.
+// Without one, browser navigations (GET or HEAD accepting text/html) are
+// redirected to the provider with the authorization code flow and PKCE,
+// and other requests are answered 401. The provider sends the browser back
+// to RedirectURL, whose path the gateway serves: it exchanges the code,
+// verifies the ID token against the provider's published keys and sets the
+// session cookie, which holds the token's claims encrypted with
+// CookieSecret. Requests with a valid session reach the upstream with the
+// claims in context, for rate limit keys and script rules, and in the
+// headers named by ClaimHeaders. The gateway's cookies are removed from
+// upstream requests.
+//
+// The provider's metadata is discovered from Issuer on first use. Routes
+// authenticated with bearer tokens should opt out, and OIDC routes be
+// anonymous when JWT validation is enabled.
+type OIDCConfig struct {
+	// Enabled turns browser sign-in on
+	Enabled bool `yaml:"enabled"`
+
+	// Issuer is the provider's issuer URL, e.g.
+	// "https://accounts.example.com"
+	Issuer string `yaml:"issuer"`
+
+	// ClientID is the gateway's client identifier at the provider
+	ClientID string `yaml:"client_id"`
+
+	// ClientSecret authenticates the gateway to the provider's token
+	// endpoint. Supports secret references ("env:NAME", "file:/path"),
+	// resolved when the configuration is loaded.
+	ClientSecret string `yaml:"client_secret" secret:"true"`
+
+	// RedirectURL is the absolute callback URL registered at the provider,
+	// e.g. "https://app.example.com/oauth2/callback"
+	RedirectURL string `yaml:"redirect_url"`
+
+	// LogoutPath ends the session and redirects to PostLogoutRedirect,
+	// default "/oauth2/logout"
+	LogoutPath string `yaml:"logout_path"`
+
+	// PostLogoutRedirect is where browsers go after logging out,
+	// default "/"
+	PostLogoutRedirect string `yaml:"post_logout_redirect"`
+
+	// Scopes are requested from the provider, default openid, profile and
+	// email
+	Scopes []string `yaml:"scopes"`
+
+	// CookieName names the session cookie, default "velocity_session"
+	CookieName string `yaml:"cookie_name"`
+
+	// CookieDomain scopes the session cookie to a domain and its
+	// subdomains, the request host when empty
+	CookieDomain string `yaml:"cookie_domain"`
+
+	// CookieSecret encrypts the session cookies, at least 32 bytes.
+	// Changing it ends every session. Supports secret references.
+	CookieSecret string `yaml:"cookie_secret" secret:"true"`
+
+	// SessionLifetime is how long a session lasts before the user signs
+	// in again, default 8h
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+
+	// Timeout bounds each request to the provider, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// ClaimHeaders maps claim names to upstream header names, like
+	// JWTConfig.ClaimHeaders. Client supplied values of these headers are
+	// always removed.
+	ClaimHeaders map[string]string `yaml:"claim_headers"`
+}
+
+// RouteOIDCConfig adjusts browser sign-in for a route
+type RouteOIDCConfig struct {
+	// Disabled lets the route's requests through without a session, e.g.
+	// for APIs authenticated with bearer tokens or public assets
+	Disabled bool `yaml:"disabled"`
+}
+
+// JWTConfig defines JSON Web Token validation and identity propagation.
+// Exactly one of Secret (HMAC) or PublicKeyFile (RSA/ECDSA) must be set
+// when enabled.
+type JWTConfig struct {
+	// Enabled requires a valid bearer token on every proxied request
+	Enabled bool `yaml:"enabled"`
+
+	// Secret is the shared key for HS256/HS384/HS512 tokens
+	Secret string `yaml:"secret" secret:"true"`
+
+	// PublicKeyFile is a PEM encoded RSA or ECDSA public key for
+	// RS*/ES* tokens
+	PublicKeyFile string `yaml:"public_key_file"`
+
+	// Issuer, when set, must match the token's "iss" claim
+	Issuer string `yaml:"issuer"`
+
+	// Audience, when set, must be present in the token's "aud" claim
+	Audience string `yaml:"audience"`
+
+	// Leeway tolerates clock skew when checking exp/nbf
+	Leeway time.Duration `yaml:"leeway"`
+
+	// ClaimHeaders maps claim names to upstream header names.
+	// Nested claims use dot notation, e.g. "org.id: X-Org-ID".
+	// Client supplied values of these headers are always removed.
+	ClaimHeaders map[string]string `yaml:"claim_headers"`
+}
+
+// FallbackConfig defines how requests matching no route are handled. With
+// neither field set they are proxied to the gateway's Targets.
+type FallbackConfig struct {
+	// Route names the route serving unmatched requests, "<tenant>/<name>"
+	// for a tenant route. Its policies apply and the path is forwarded
+	// unchanged.
+	Route string `yaml:"route"`
+
+	// Status answers unmatched requests directly, e.g. 404
+	Status int `yaml:"status"`
+
+	// Body is the response body sent with Status, a JSON NO_ROUTE error
+	// when empty
+	Body string `yaml:"body"`
+
+	// ContentType is the Content-Type of Body, default
+	// "text/plain; charset=utf-8"
+	ContentType string `yaml:"content_type"`
+}
+
+// RouteMatchConfig lists conditions a request must meet, besides its path,
+// to match a route. Unlike RouteConfig.Methods, which answers other
+// methods with 405, a request failing a condition is matched against the
+// remaining routes as if the route did not exist.
+//
+// Among routes with the same PathPrefix, routes with conditions are tried
+// before routes without, so a conditional route overrides a catch-all:
+//
+//	routes:
+//	  - name: orders-v2
+//	    path_prefix: /api/orders
+//	    upstream: orders-v2
+//	    match:
+//	      headers:
+//	        - name: X-Api-Version
+//	          value: "2"
+//	  - name: orders
+//	    path_prefix: /api/orders
+type RouteMatchConfig struct {
+	// Methods are the request methods the route matches. GET implies
+	// HEAD. Empty matches every method.
+	Methods []string `yaml:"methods"`
+
+	// Headers must all match
+	Headers []HeaderMatchConfig `yaml:"headers"`
+}
+
+// HeaderMatchConfig matches a request header. With neither Value nor
+// Regex set, the header only has to be present. A header sent several
+// times matches when any of its values does.
+type HeaderMatchConfig struct {
+	// Name is the header name, case-insensitive
+	Name string `yaml:"name"`
+
+	// Value is the exact value the header must have
+	Value string `yaml:"value"`
+
+	// Regex is a regular expression the header value must match,
+	// unanchored unless written with ^ and $
+	Regex string `yaml:"regex"`
+}
+
+// RouteConfig defines a single route and the policies applied to requests
+// matching it
+type RouteConfig struct {
+	// Name identifies the route in logs and stats
+	Name string `yaml:"name"`
+
+	// PathPrefix matches request paths on segment boundaries, so "/api"
+	// matches "/api" and "/api/users" but not "/apiv2".
+	// The longest matching prefix wins.
+	PathPrefix string `yaml:"path_prefix"`
+
+	// Priority orders routes that could match the same request: routes
+	// with a higher priority are evaluated first, whatever their prefix
+	// length. Routes of equal priority, 0 by default, are evaluated
+	// longest prefix first.
+	Priority int `yaml:"priority"`
+
+	// Type selects what answers the route: "proxy" (default) forwards to
+	// the targets, "static" serves files from Static.Root and "respond"
+	// answers with the response configured in Respond
+	Type string `yaml:"type"`
+
+	// Upstream names the upstream group the route forwards to. Empty
+	// forwards to the gateway's Targets, or the tenant's for tenant
+	// routes, which cannot name a group.
+	Upstream string `yaml:"upstream"`
+
+	// Methods lists the request methods the route accepts. GET implies
+	// HEAD. Other methods are answered 405 Method Not Allowed with an
+	// Allow header, and OPTIONS with 204 and the Allow header, including
+	// CORS preflights, without reaching the backend; list OPTIONS to
+	// forward it instead. Empty forwards every method.
+	Methods []string `yaml:"methods"`
+
+	// Match narrows the route to requests with given methods or header
+	// values. Requests under PathPrefix failing it fall through to the
+	// next matching route.
+	Match RouteMatchConfig `yaml:"match"`
+
+	// Static configures the files served by a static route
+	Static StaticConfig `yaml:"static"`
+
+	// Respond configures the response of a respond route
+	Respond RespondConfig `yaml:"respond"`
+
+	// TrailingSlash controls whether "/foo" and "/foo/" are equivalent:
+	// strict (default) treats them as different paths, redirect answers
+	// 308 Permanent Redirect to the canonical form and rewrite forwards the
+	// canonical form. The canonical form follows PathPrefix: a prefix
+	// ending in "/" makes the route root "/foo/", otherwise trailing
+	// slashes are removed.
+	TrailingSlash string `yaml:"trailing_slash"`
+
+	// CaseInsensitive matches PathPrefix regardless of case. The path is
+	// forwarded as received.
+	CaseInsensitive bool `yaml:"case_insensitive"`
+
+	// Headers restricts which headers cross the gateway in each direction
+	Headers HeaderPolicyConfig `yaml:"headers"`
+
+	// UpstreamAuth attaches gateway-owned credentials to proxied requests
+	UpstreamAuth UpstreamAuthConfig `yaml:"upstream_auth"`
+
+	// RateLimit adds a route specific limit on top of the global one
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// Anonymous exempts some of the route's paths from client
+	// authentication and limits unauthenticated requests to them
+	Anonymous AnonymousConfig `yaml:"anonymous"`
+
+	// ResponseValidation checks upstream responses against a JSON Schema
+	ResponseValidation ResponseValidationConfig `yaml:"response_validation"`
+
+	// Checksums verifies upstream response bodies against the digests
+	// sent with them
+	Checksums ChecksumConfig `yaml:"checksums"`
+
+	// Tenant is the owning tenant, set by the gateway for tenant routes
+	Tenant string `yaml:"-"`
+
+	// QoSClass assigns the route's priority under overload:
+	// critical, normal or best_effort
+	QoSClass string `yaml:"qos_class"`
+
+	// MaxRetryAfter caps the Retry-After advertised when the route's
+	// requests are shed or rate limited, e.g. "30s". Defaults to 60s.
+	MaxRetryAfter time.Duration `yaml:"max_retry_after"`
+
+	// Timeout bounds the whole request, retries included. 0 leaves it
+	// bounded by the server's write timeout only.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// DeadlinePropagation tells upstreams how long the gateway will still
+	// wait for their response
+	DeadlinePropagation DeadlinePropagationConfig `yaml:"deadline_propagation"`
+
+	// ClientDeadline lets clients shorten the route's requests
+	ClientDeadline ClientDeadlineConfig `yaml:"client_deadline"`
+
+	// Canary splits the route's traffic between the regular targets and a
+	// canary pool
+	Canary CanaryConfig `yaml:"canary"`
+
+	// Origin serves the route from an object storage bucket instead of
+	// the targets
+	Origin OriginConfig `yaml:"origin"`
+
+	// Cache stores the route's successful GET responses in memory
+	Cache CacheConfig `yaml:"cache"`
+
+	// BodyInspection bounds the request body buffered once and shared by
+	// every consumer on the route, such as retries and request signing
+	BodyInspection BodyInspectionConfig `yaml:"body_inspection"`
+
+	// Dedup collapses identical requests from the same client arriving
+	// close together
+	Dedup DedupConfig `yaml:"dedup"`
+
+	// ETag generates validators for upstream responses that carry none
+	ETag ETagConfig `yaml:"etag"`
+
+	// Compression compresses the route's responses against a shared
+	// dictionary for clients holding it
+	Compression CompressionConfig `yaml:"compression"`
+
+	// SlowClients bounds how slowly clients may read the route's
+	// responses
+	SlowClients SlowClientConfig `yaml:"slow_clients"`
+
+	// Protocols restricts the HTTP versions clients may use on the route
+	Protocols ProtocolPolicyConfig `yaml:"protocols"`
+
+	// Upgrades lists the protocols clients may switch the connection to
+	// with an Upgrade request, e.g. "websocket" or "h2c". Requests asking
+	// for any other protocol, on this route or without one, are forwarded
+	// as plain requests with their upgrade headers removed.
+	Upgrades []string `yaml:"upgrades"`
+
+	// Deprecation announces the route's deprecation and sunset to clients
+	// and can retire it once the sunset date passes
+	Deprecation DeprecationConfig `yaml:"deprecation"`
+
+	// Cost charges the route's requests to their consumer for billing
+	Cost CostConfig `yaml:"cost"`
+
+	// Plugins names the plugins run on the route's requests, in order,
+	// after rate limiting and before the route's header policy
+	Plugins []string `yaml:"plugins"`
+
+	// CircuitBreaker fast-fails the route while its backend service is
+	// failing as a whole
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+
+	// Script holds rules inspecting and modifying the route's requests,
+	// run after its plugins
+	Script []ScriptRuleConfig `yaml:"script"`
+
+	// ExtAuthz adjusts the external authorization check for the route
+	ExtAuthz RouteExtAuthzConfig `yaml:"ext_authz"`
+
+	// OIDC adjusts browser sign-in for the route
+	OIDC RouteOIDCConfig `yaml:"oidc"`
+
+	// BasicAuth requires HTTP Basic credentials on the route
+	BasicAuth BasicAuthConfig `yaml:"basic_auth"`
+
+	// GRPCRetry retries the route's gRPC calls on the gRPC statuses their
+	// upstream answers with
+	GRPCRetry GRPCRetryConfig `yaml:"grpc_retry"`
+}
+
+// GRPCRetryConfig retries gRPC calls on the status their upstream
+// answered with.
+//
+// gRPC reports failures in the grpc-status trailer of a 200 response, so
+// the gateway's HTTP status based handling sees every call succeed. For
+// routes with gRPC retries enabled, a call answered without messages and
+// with one of Statuses, e.g. by a server shedding load, is retried on
+// another target of the pool, after the delay the upstream asked for in
+// grpc-retry-pushback-ms. A pushback that is negative, invalid or longer
+// than MaxPushback means the upstream asks not to be retried, and its
+// answer is passed to the client. When no retry succeeds, the client gets
+// the last upstream answer unchanged.
+//
+// Calls failing with one of Statuses after response messages were
+// streamed cannot be retried, but count as failures of their target for
+// outlier detection like HTTP 5xx responses.
+type GRPCRetryConfig struct {
+	// Enabled turns gRPC status based retries on
+	Enabled bool `yaml:"enabled"`
+
+	// Statuses are the gRPC status codes retried, by name, default
+	// UNAVAILABLE and RESOURCE_EXHAUSTED
+	Statuses []string `yaml:"statuses"`
+
+	// MaxPushback is the longest grpc-retry-pushback-ms delay waited
+	// before a retry, default 1s
+	MaxPushback time.Duration `yaml:"max_pushback"`
+}
+
+// AnonymousConfig opens paths of an authenticated route to clients without
+// credentials, such as documentation or a public catalog, so they need no
+// route of their own.
+type AnonymousConfig struct {
+	// Paths are prefixes within the route's path_prefix, matched on
+	// segment boundaries, that requests may reach without a bearer token,
+	// Basic credentials or a sign-in session. Requests presenting
+	// credentials are still authenticated.
+	Paths []string `yaml:"paths"`
+
+	// RateLimit replaces the route's rate limit for unauthenticated
+	// requests to Paths, usually with a stricter one. When disabled they
+	// share the route's rate limit.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// CostConfig annotates a route's requests with billable units. Totals
+// accumulate per consumer and route and are read from the admin API at
+// /admin/usage.
+type CostConfig struct {
+	// Units charged per request, e.g. 1. A route with neither Units nor
+	// Methods is not metered.
+	Units float64 `yaml:"units"`
+
+	// Methods overrides Units per request method, e.g. {"POST": 5}
+	Methods map[string]float64 `yaml:"methods"`
+
+	// Consumer identifies who is charged, written like a rate limit key:
+	// "client_ip" (default), "claim.sub", "header.X-API-Key"
+	Consumer string `yaml:"consumer"`
+
+	// ChargeFailures also charges requests answered with a 4xx or 5xx
+	// status, which are free by default
+	ChargeFailures bool `yaml:"charge_failures"`
+}
+
+// ProtocolPolicyConfig defines the HTTP versions a route accepts.
+// Versions are written "1.0", "1.1", "2" or "3"; requests over other
+// versions are answered 505 HTTP Version Not Supported.
+type ProtocolPolicyConfig struct {
+	// MinVersion is the oldest accepted version, e.g. "2" for APIs with
+	// streaming semantics that break over HTTP/1.x. Empty accepts all.
+	MinVersion string `yaml:"min_version"`
+
+	// Deny lists versions rejected regardless of MinVersion, e.g. ["1.0"]
+	Deny []string `yaml:"deny"`
+}
+
+// SlowClientConfig defines how a route treats clients that read its
+// responses slowly.
+//
+// Writes to every client are timed: a write blocking longer than
+// StallThreshold is a stall, and the stall time is reported per route.
+// With MinBytesPerSecond set, responses are no longer bound by the
+// server's write timeout; instead every write gets a fresh deadline of
+// GracePeriod, and once GracePeriod has passed a response whose client
+// reads slower than the floor on average is aborted. This frees the
+// upstream connection a slow reader would otherwise hold for as long as
+// it likes, while large responses to fast clients can take as long as
+// they need.
+type SlowClientConfig struct {
+	// MinBytesPerSecond is the slowest average read rate tolerated, 0 to
+	// never abort
+	MinBytesPerSecond int64 `yaml:"min_bytes_per_second"`
+
+	// GracePeriod is how long a response may run before the rate floor
+	// applies, and the longest a single write may block. Default 10s.
+	GracePeriod time.Duration `yaml:"grace_period"`
+
+	// StallThreshold is how long a write must block to count as a stall,
+	// default 100ms
+	StallThreshold time.Duration `yaml:"stall_threshold"`
+}
+
+// ETagConfig defines ETag generation for a route.
+//
+// Successful GET responses without an ETag or Last-Modified header are
+// buffered and tagged with a hash of their body. Requests whose
+// If-None-Match matches the tag get 304 Not Modified without the body, so
+// clients save bandwidth even when the backend knows nothing about
+// conditional requests. The upstream is still called for every request.
+type ETagConfig struct {
+	// Enabled turns ETag generation on
+	Enabled bool `yaml:"enabled"`
+
+	// Weak marks generated tags as weak (W/"..."), for backends whose
+	// responses can differ in insignificant bytes
+	Weak bool `yaml:"weak"`
+
+	// MaxBodyBytes is the largest response buffered for hashing, default
+	// 1 MiB. Larger responses are streamed without a tag.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// CompressionConfig defines dictionary compression for a route.
+//
+// Small JSON responses barely compress on their own, but responses of one
+// API repeat the same field names and values. Compressed against a zstd
+// dictionary trained on sample payloads ("zstd --train samples/* -o
+// api.dict"), they often shrink to a fraction of what gzip achieves.
+// Responses are sent with Content-Encoding dcz, Dictionary-Compressed
+// Zstandard of RFC 9842, to clients announcing the dictionary's hash in
+// Available-Dictionary. Browsers fetch the dictionary themselves from
+// DictionaryPath; other clients download it once from there. Everyone
+// else gets the response unchanged.
+type CompressionConfig struct {
+	// Enabled turns dictionary compression on
+	Enabled bool `yaml:"enabled"`
+
+	// Dictionary is the path of the dictionary file. Its whole content is
+	// the dictionary, as RFC 9842 requires.
+	Dictionary string `yaml:"dictionary"`
+
+	// DictionaryPath serves the dictionary at this request path within
+	// the route's path prefix, e.g. "/api/orders/.dictionary", and
+	// advertises it in a Link header of compressible responses. Empty
+	// leaves distributing the dictionary to clients.
+	DictionaryPath string `yaml:"dictionary_path"`
+
+	// ContentTypes are the media types compressed, default
+	// ["application/json", "application/problem+json"]
+	ContentTypes []string `yaml:"content_types"`
+
+	// MinBytes is the smallest response compressed, default 64
+	MinBytes int64 `yaml:"min_bytes"`
+
+	// MaxBodyBytes is the largest response buffered for compression,
+	// default 1 MiB. Larger responses are streamed uncompressed.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// StaticConfig serves a route's GET and HEAD requests from a local
+// directory, e.g. a single page application next to its API. The file
+// path is the request path below the route's path prefix. Content types
+// follow file extensions, and range and conditional requests are answered
+// from the file's size and modification time. Requests cannot reach files
+// outside Root, through ".." or symbolic links, nor dotfiles.
+type StaticConfig struct {
+	// Root is the directory served
+	Root string `yaml:"root"`
+
+	// Index is the file served for directories, default "index.html"
+	Index string `yaml:"index"`
+
+	// Fallback is a file served with status 200 for paths that match no
+	// file, e.g. "index.html" so client-side routes of a single page
+	// application load the application. Empty answers 404.
+	Fallback string `yaml:"fallback"`
+
+	// CacheControl is the Cache-Control header of served files, e.g.
+	// "public, max-age=3600". Empty sends none.
+	CacheControl string `yaml:"cache_control"`
+}
+
+// DeprecationConfig announces that a route is deprecated. Its responses
+// carry a Deprecation header (RFC 9745), a Sunset header (RFC 8594) and
+// Link headers to the documentation and the successor API. Dates are
+// RFC 3339 timestamps or plain dates such as "2026-06-30", taken as
+// midnight UTC.
+type DeprecationConfig struct {
+	// Since is when the route is or was deprecated. A future date
+	// announces an upcoming deprecation.
+	Since string `yaml:"since"`
+
+	// Sunset is when the route stops being served
+	Sunset string `yaml:"sunset"`
+
+	// Link is the URL of the deprecation notice or migration guide
+	Link string `yaml:"link"`
+
+	// Successor is the URL of the API replacing the route
+	Successor string `yaml:"successor"`
+
+	// Warning is sent in a Warning header, for clients that log it, from
+	// Since, or from WarnBefore ahead of the sunset when set
+	Warning string `yaml:"warning"`
+
+	// WarnBefore starts sending Warning this long before the sunset
+	WarnBefore time.Duration `yaml:"warn_before"`
+
+	// Shutoff answers requests after the sunset with 410 Gone instead of
+	// forwarding them
+	Shutoff bool `yaml:"shutoff"`
+}
+
+// RespondConfig answers a route's requests with a fixed response from the
+// gateway itself, for stub endpoints, robots.txt, security.txt or
+// deprecation notices of retired APIs. Bodies are omitted for HEAD
+// requests.
+type RespondConfig struct {
+	// Status is the response status, default 200
+	Status int `yaml:"status"`
+
+	// ContentType is the Content-Type of the body, default
+	// "text/plain; charset=utf-8"
+	ContentType string `yaml:"content_type"`
+
+	// Headers are set on the response, e.g. Cache-Control or Sunset
+	Headers map[string]string `yaml:"headers"`
+
+	// Body is the response body
+	Body string `yaml:"body"`
+
+	// BodyFile is read when the configuration loads and replaces Body
+	BodyFile string `yaml:"body_file"`
+
+	// Template evaluates "{{ expression }}" placeholders in the body and
+	// header values for each request, with the expression language of
+	// script rules, e.g. "Moved to https://api.example.com{{ path }}".
+	// A placeholder failing to evaluate fails the request with status 500.
+	Template bool `yaml:"template"`
+}
+
+// OriginConfig serves a route's GET and HEAD requests from an S3 or GCS
+// bucket, for static assets or maintenance pages that would otherwise
+// need a file server behind the gateway. Requests to the bucket are signed
+// with AWS Signature Version 4; GCS is reached through its S3 compatible
+// XML API with HMAC keys.
+//
+// The object key is the request path below the route's path prefix,
+// appended to KeyPrefix. Conditional and range requests are passed to the
+// bucket, so clients get 304 and 206 responses as from a file server.
+type OriginConfig struct {
+	// Type selects the bucket's service: "s3" or "gcs". Empty routes to
+	// the targets.
+	Type string `yaml:"type"`
+
+	// Bucket is the bucket name
+	Bucket string `yaml:"bucket"`
+
+	// Region is the bucket's region, required for S3
+	Region string `yaml:"region"`
+
+	// Endpoint replaces the service's default endpoint, e.g. for S3
+	// compatible stores such as MinIO. Buckets are addressed path-style.
+	Endpoint string `yaml:"endpoint"`
+
+	// KeyPrefix is prepended to every object key, e.g. "site/"
+	KeyPrefix string `yaml:"key_prefix"`
+
+	// Index is the object served for paths ending in a slash, default
+	// "index.html"
+	Index string `yaml:"index"`
+
+	// NotFound is the key of an object served with status 404 when the
+	// requested one does not exist, e.g. "404.html". S3 answers 403 for
+	// missing keys unless the credentials may list the bucket.
+	NotFound string `yaml:"not_found"`
+
+	// Profile selects a shared credentials file profile for S3
+	Profile string `yaml:"profile"`
+
+	// AccessKeyID and SecretAccessKey set static credentials, the HMAC
+	// key for GCS. Both accept secret store references. S3 falls back to
+	// the environment, the shared credentials file and instance metadata.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" secret:"true"`
+}
+
+// DeadlinePropagationConfig defines the header carrying the remaining
+// request time budget to upstreams.
+//
+// The budget is the route timeout, or the server's write timeout when the
+// route has none, minus the time already spent, including earlier
+// attempts. Backends can stop working on a request once its budget is
+// spent, since the gateway will have abandoned it.
+type DeadlinePropagationConfig struct {
+	// Header is the request header set on every attempt, e.g.
+	// "X-Request-Timeout-Ms" or "grpc-timeout". Propagation is disabled
+	// when empty. Values sent by clients are replaced.
+	Header string `yaml:"header"`
+
+	// Format is "milliseconds", the default, "seconds" with millisecond
+	// decimals, or "grpc" for the gRPC timeout format ("250m"). Defaults
+	// to "grpc" when Header is grpc-timeout.
+	Format string `yaml:"format"`
+}
+
+// ClientDeadlineConfig honors the time clients say they are still willing
+// to wait, e.g. "X-Request-Timeout: 2s" or "grpc-timeout: 500m", so work
+// whose result nobody will read is abandoned early.
+//
+// A hint only ever shortens a request: it is capped by the route timeout,
+// or the server's write timeout when the route has none. Invalid and
+// non-positive hints are ignored. With deadline propagation, upstreams
+// are told the shortened budget.
+type ClientDeadlineConfig struct {
+	// Enabled honors client deadline hints
+	Enabled bool `yaml:"enabled"`
+
+	// Headers are the request headers read, the first valid one winning,
+	// default X-Request-Timeout and grpc-timeout. grpc-timeout is read in
+	// the gRPC timeout format, other headers as a duration with a unit
+	// ("1.5s", "250ms") or as plain milliseconds.
+	Headers []string `yaml:"headers"`
+}
+
+// DedupConfig defines duplicate request suppression for a route.
+//
+// Requests with the same method, host, path, query, body and client key
+// are duplicates. While the first one is in flight and for Window after
+// its response, duplicates are not forwarded: they wait for the first
+// response and receive a copy of it, marked with X-Velocity-Duplicate.
+// This protects backends from clients that double-submit forms or retry
+// too eagerly. Requests whose body exceeds the route's body inspection
+// limit are never deduplicated.
+type DedupConfig struct {
+	// Enabled turns deduplication on
+	Enabled bool `yaml:"enabled"`
+
+	// Window is how long after a response identical requests still
+	// receive it, default 2s
+	Window time.Duration `yaml:"window"`
+
+	// Key identifies the client, as a rate limit key expression.
+	// Default "client_ip".
+	Key string `yaml:"key"`
+
+	// CredentialHeaders are further request headers carrying client
+	// credentials, such as API keys. Authorization, Proxy-Authorization,
+	// Cookie, X-API-Key and any header read by Key are always part of
+	// the fingerprint, as is the authenticated subject.
+	CredentialHeaders []string `yaml:"credential_headers"`
+
+	// Methods are the deduplicated methods, default POST, PUT, PATCH and
+	// DELETE
+	Methods []string `yaml:"methods"`
+
+	// MaxBodyBytes is the largest response kept for duplicates, default
+	// 1 MiB. Duplicates of a larger response are answered with 409.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// ScriptRuleConfig is one rule of a route script.
+//
+// Rules run in order on every request of the route. A rule whose When
+// expression holds either changes the request, removing and setting
+// headers and rewriting the path, or answers it with Respond, so later
+// rules and the upstream never see it. Each rule sees the changes of the
+// rules before it:
+//
+//	script:
+//	  - when: 'header["X-Api-Version"] == "" && starts_with(path, "/api/v1/")'
+//	    set_headers:
+//	      X-Api-Version: '"1"'
+//	  - when: 'starts_with(path, "/api/internal/") && !cidr(client_ip, "10.0.0.0/8")'
+//	    respond:
+//	      status: 403
+//	      body: '"internal endpoint"'
+//
+// When, the values of SetHeaders, SetPath and Respond.Body are
+// expressions: string literals must be quoted inside the YAML string. See
+// package velocity/internal/script for the expression language.
+type ScriptRuleConfig struct {
+	// When is the condition of the rule, an expression yielding a bool.
+	// Empty applies the rule to every request.
+	When string `yaml:"when"`
+
+	// RemoveHeaders deletes request headers
+	RemoveHeaders []string `yaml:"remove_headers"`
+
+	// SetHeaders replaces request headers with the values of expressions,
+	// all evaluated before any is set
+	SetHeaders map[string]string `yaml:"set_headers"`
+
+	// SetPath rewrites the request path to the value of an expression,
+	// which must start with "/"
+	SetPath string `yaml:"set_path"`
+
+	// Respond answers the request instead of forwarding it when Status is
+	// set
+	Respond ScriptResponseConfig `yaml:"respond"`
+}
+
+// ScriptResponseConfig is the response a script rule answers with
+type ScriptResponseConfig struct {
+	// Status is the response status, zero to continue instead
+	Status int `yaml:"status"`
+
+	// Body is an expression giving the response body, empty for none
+	Body string `yaml:"body"`
+
+	// ContentType is the Content-Type of Body, default
+	// "text/plain; charset=utf-8"
+	ContentType string `yaml:"content_type"`
+}
+
+// CircuitBreakerConfig defines a route-level circuit breaker.
+//
+// Outlier detection ejects single targets from their pool, which protects
+// every route sharing the pool from a bad instance but cannot help when
+// the whole service behind a route is failing. The route's circuit breaker
+// counts the route's own outcomes across all its targets: once they cross
+// a threshold the circuit opens and requests are answered immediately with
+// the fallback, without reaching the upstream, so clients fail fast and
+// the service gets room to recover. After OpenDuration the circuit is
+// half-open and lets HalfOpenRequests through; their success closes it,
+// a failure opens it again. Routes sharing the targets are unaffected.
+//
+// A 5xx response, including the gateway's own for an unreachable or
+// timed-out upstream, is a failure. Cached responses never reach the
+// breaker and are still served while it is open.
+type CircuitBreakerConfig struct {
+	// Enabled turns the circuit breaker on
+	Enabled bool `yaml:"enabled"`
+
+	// ConsecutiveFailures opens the circuit after this many failures in
+	// a row. Default 5 when FailureRatio is not set either.
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+
+	// FailureRatio opens the circuit when this share of the requests in
+	// a window fail, between 0 and 1. Zero disables the ratio.
+	FailureRatio float64 `yaml:"failure_ratio"`
+
+	// MinRequests is the number of requests a window needs before its
+	// failure ratio is evaluated, default 20
+	MinRequests int `yaml:"min_requests"`
+
+	// Window is the period requests are counted over for FailureRatio,
+	// default 10s
+	Window time.Duration `yaml:"window"`
+
+	// OpenDuration is how long the circuit stays open before letting
+	// trial requests through, default 30s
+	OpenDuration time.Duration `yaml:"open_duration"`
+
+	// HalfOpenRequests is the number of trial requests let through while
+	// half-open, all of which must succeed to close the circuit, default 1
+	HalfOpenRequests int `yaml:"half_open_requests"`
+
+	// Fallback answers requests while the circuit is open, a JSON
+	// CIRCUIT_OPEN error with status 503 when not set
+	Fallback CircuitFallbackConfig `yaml:"fallback"`
+}
+
+// CircuitFallbackConfig is the response sent while a circuit is open.
+// Every fallback carries a Retry-After header with the time left until
+// the circuit lets trial requests through.
+type CircuitFallbackConfig struct {
+	// Status is the response status, default 503
+	Status int `yaml:"status"`
+
+	// Body is the response body, a JSON CIRCUIT_OPEN error when empty
+	Body string `yaml:"body"`
+
+	// ContentType is the Content-Type of Body, default
+	// "text/plain; charset=utf-8"
+	ContentType string `yaml:"content_type"`
+}
+
+// BodyInspectionConfig defines how much of a route's request bodies may be
+// held in memory for inspection.
+//
+// The body is read from the client once into a buffer charged to the
+// memory budget, and every consumer reads that buffer instead of keeping
+// its own copy. Bodies over the limit are streamed: they are sent to a
+// single target without retries, and routes signing requests with
+// aws_sigv4 reject them.
+type BodyInspectionConfig struct {
+	// MaxBytes is the largest request body buffered. 0 uses 64 MiB on
+	// routes signing with aws_sigv4 and memory.max_retry_body_bytes on all
+	// other routes.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// CacheConfig defines a route's in-memory response cache.
+//
+// Only anonymous GET requests are cached, i.e. without Authorization or
+// Cookie headers, and only 200 responses that set no cookie and do not
+// forbid shared caching. Cached bodies are charged to the memory budget.
+type CacheConfig struct {
+	// Enabled turns the cache on
+	Enabled bool `yaml:"enabled"`
+
+	// TTL is how long responses are served from the cache
+	TTL time.Duration `yaml:"ttl"`
+
+	// MaxTTL caps the TTL an upstream can request with the
+	// X-Velocity-Cache-TTL response header. Defaults to 24h.
+	MaxTTL time.Duration `yaml:"max_ttl"`
+
+	// NegativeTTL caches 404 Not Found and 410 Gone responses for this
+	// long, so repeated lookups of missing resources do not reach
+	// upstreams. 0 disables negative caching.
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+
+	// ErrorTTL caches 5xx responses for this long, usually a few seconds,
+	// to shield a failing upstream from repeated requests. 0 disables it.
+	// Cached 404, 410 and 5xx responses are invalidated by any POST, PUT,
+	// PATCH or DELETE request to the same path.
+	ErrorTTL time.Duration `yaml:"error_ttl"`
+
+	// MaxEntries bounds the number of cached responses; the least
+	// recently used are evicted first. Defaults to 1000.
+	MaxEntries int `yaml:"max_entries"`
+
+	// MaxBodyBytes is the largest response body cached. Defaults to 1MiB.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+
+	// BypassHeaders skip the cache and refresh the entry when a request
+	// carries one of them set to the admin token. Defaults to
+	// X-Cache-Bypass. Without an admin token bypass is unavailable.
+	BypassHeaders []string `yaml:"bypass_headers"`
+
+	// Private marks a route whose responses depend on who asks. Requests
+	// carrying credentials are then cached under the consumer's identity,
+	// so consumers never share entries, and Cache-Control: private
+	// responses may be stored. On other routes requests with an
+	// Authorization or Cookie header are never answered from the cache.
+	Private bool `yaml:"private"`
+
+	// ConsumerKey identifies the consumer on a private route, using the
+	// rate limit key syntax, e.g. "claim.sub"
+	ConsumerKey string `yaml:"consumer_key"`
+
+	// KeyHeaders are request headers whose values identify the consumer on
+	// a private route, alone or with ConsumerKey. Responses may vary on
+	// them. Default Authorization and Cookie when ConsumerKey is not set.
+	KeyHeaders []string `yaml:"key_headers"`
+
+	// UncacheableHeaders are response headers that keep a response out of
+	// the cache. Default Set-Cookie and Authorization.
+	UncacheableHeaders []string `yaml:"uncacheable_headers"`
+}
+
+// CanaryConfig sends a share of a route's traffic to a separate canary
+// pool. The share can differ per consumer segment, e.g. internal API keys
+// get the whole canary while external consumers get 1%.
+//
+// Each client is assigned to a side of the split by hashing its bucket
+// key, so it keeps seeing the same version while the weight is unchanged.
+type CanaryConfig struct {
+	// Targets is the canary pool. Traffic is split only when set.
+	Targets []TargetConfig `yaml:"targets"`
+
+	// Weight is the percentage of requests from consumers outside every
+	// segment that go to the canary, 0 to 100
+	Weight float64 `yaml:"weight"`
+
+	// ConsumerKey evaluates to the request's segment name, using the
+	// rate limit key syntax, e.g. "claim.consumer_type" or
+	// "header.X-Consumer-Segment"
+	ConsumerKey string `yaml:"consumer_key"`
+
+	// Segments maps segment names to their canary percentage
+	Segments map[string]float64 `yaml:"segments"`
+
+	// BucketKey identifies a client for a stable assignment, using the
+	// rate limit key syntax. Defaults to client_ip.
+	BucketKey string `yaml:"bucket_key"`
+}
+
+// ResponseValidationConfig defines contract checks of upstream responses.
+// Successful (2xx) responses with a body are decoded and validated against
+// a JSON Schema, catching backend regressions at the gateway before
+// clients notice them.
+type ResponseValidationConfig struct {
+	// Schema is the path of the JSON Schema file. Empty disables
+	// validation.
+	Schema string `yaml:"schema"`
+
+	// Mode is "log" (default) to only log violations, suited to canary
+	// rollouts, or "enforce" to replace violating responses with a 502
+	Mode string `yaml:"mode"`
+
+	// SampleRate is the fraction of responses validated, between 0 and 1.
+	// Zero validates every response.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// MaxBodyBytes is the largest body validated; larger responses are
+	// streamed unchecked. Defaults to 1 MiB.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// ChecksumConfig defines checksum verification of upstream responses.
+// Bodies of responses carrying a Content-MD5, Digest, Content-Digest or
+// Repr-Digest header are hashed while streaming and compared with it, so
+// truncated or corrupted replies do not reach clients as if complete.
+type ChecksumConfig struct {
+	// Enabled turns verification on
+	Enabled bool `yaml:"enabled"`
+
+	// Mode is "enforce" (default) to abort mismatching responses, which
+	// withholds their last byte, or "log" to only log and count them
+	Mode string `yaml:"mode"`
+}
+
+// HeaderPolicyConfig defines which headers a route forwards upstream and
+// which it returns to clients
+type HeaderPolicyConfig struct {
+	// Request filters client headers before they are forwarded upstream
+	Request HeaderFilterConfig `yaml:"request"`
+
+	// Response filters upstream headers before they are returned
+	Response HeaderFilterConfig `yaml:"response"`
+}
+
+// HeaderFilterConfig defines a header allow/deny list for one direction.
+// Patterns are case-insensitive header names; a trailing "*" matches a
+// prefix, e.g. "X-Internal-*". Deny always wins over allow.
+type HeaderFilterConfig struct {
+	// Default is allow (only denied headers are removed) or deny (only
+	// allowed headers pass). Framing headers such as Content-Type and
+	// Content-Length always pass.
+	Default string `yaml:"default"`
+
+	// Allow lists headers that pass under deny-by-default
+	Allow []string `yaml:"allow"`
+
+	// Deny lists headers that never pass
+	Deny []string `yaml:"deny"`
+}
+
+// LoadSheddingConfig defines priority-aware admission control.
+// Each QoS class is admitted only while the number of requests in flight is
+// below its share of MaxInFlight, so lower priority traffic is shed first.
+type LoadSheddingConfig struct {
+	// Enabled turns load shedding on
+	Enabled bool `yaml:"enabled"`
+
+	// MaxInFlight is the gateway wide concurrency capacity
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// Thresholds sets the utilization at which each class starts being shed
+	Thresholds QoSThresholds `yaml:"thresholds"`
+
+	// DefaultClass applies to requests without a route or consumer class
+	DefaultClass string `yaml:"default_class"`
+
+	// ConsumerKey is a key expression identifying the consumer, e.g.
+	// "claim.sub" or "header.X-Api-Key"
+	ConsumerKey string `yaml:"consumer_key"`
+
+	// Consumers assigns QoS classes to specific consumers, overriding the
+	// route's class
+	Consumers map[string]string `yaml:"consumers"`
+}
+
+// QoSThresholds defines per-class utilization ceilings as fractions of
+// capacity. Critical traffic may always use the full capacity.
+type QoSThresholds struct {
+	// BestEffort is shed above this utilization
+	BestEffort float64 `yaml:"best_effort"`
+
+	// Normal is shed above this utilization
+	Normal float64 `yaml:"normal"`
+}
+
+// RateLimitConfig defines a token bucket rate limit policy
+type RateLimitConfig struct {
+	// Enabled turns the policy on
+	Enabled bool `yaml:"enabled"`
+
+	// Mode selects the algorithm: "token_bucket" (default) allows bursts
+	// up to Burst, "spike_arrest" spaces requests evenly so that e.g.
+	// 100 per minute is enforced as one request every 600ms
+	Mode string `yaml:"mode"`
+
+	// RequestsPerSecond is the sustained rate allowed per key
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+
+	// Requests and Window express the rate as a count per period, e.g.
+	// 100 per 1m. Takes precedence over RequestsPerSecond when Window is set.
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+
+	// Burst is the number of requests allowed above the sustained rate.
+	// Ignored in spike_arrest mode.
+	Burst int `yaml:"burst"`
+
+	// Key is an expression selecting the bucket for a request, e.g.
+	// "client_ip", "header.X-Api-Key" or "claim.tenant_id + route".
+	// Defaults to "client_ip".
+	Key string `yaml:"key"`
+}
+
+// UpstreamAuthConfig defines credentials injected towards the upstream.
+// Credential values may reference the secret store using "env:NAME" or
+// "file:/path/to/secret" instead of literal values.
+type UpstreamAuthConfig struct {
+	// Type selects the mechanism: bearer, basic, header, aws_sigv4 or
+	// oauth2.
+	// Empty disables credential injection.
+	Type string `yaml:"type"`
+
+	// Token is the bearer token (type: bearer)
+	Token string `yaml:"token" secret:"true"`
+
+	// Username and Password are the basic auth credentials (type: basic)
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+
+	// Header and Value define a custom credential header (type: header),
+	// e.g. "X-Api-Key"
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
+
+	// AWS configures request signing (type: aws_sigv4)
+	AWS AWSSigV4Config `yaml:"aws"`
+
+	// OAuth2 configures client-credentials tokens (type: oauth2)
+	OAuth2 OAuth2ClientConfig `yaml:"oauth2"`
+}
+
+// OAuth2ClientConfig defines an OAuth2 client-credentials grant used to
+// obtain access tokens for upstream requests
+type OAuth2ClientConfig struct {
+	// TokenURL is the authorization server's token endpoint
+	TokenURL string `yaml:"token_url"`
+
+	// ClientID and ClientSecret authenticate the gateway.
+	// Both accept secret store references.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret" secret:"true"`
+
+	// Scopes are requested with every token
+	Scopes []string `yaml:"scopes"`
+
+	// Audience is sent as the "audience" parameter when set
+	Audience string `yaml:"audience"`
+
+	// AuthStyle selects how client credentials are sent: "basic"
+	// (Authorization header, default) or "body" (form parameters)
+	AuthStyle string `yaml:"auth_style"`
+
+	// RefreshBefore starts a background refresh this long before the
+	// token expires. Defaults to one minute.
+	RefreshBefore time.Duration `yaml:"refresh_before"`
+}
+
+// AWSSigV4Config defines AWS Signature Version 4 request signing.
+// Without explicit keys, credentials are taken from the AWS_* environment
+// variables, the shared credentials file, or EC2 instance metadata, in
+// that order.
+type AWSSigV4Config struct {
+	// Region is the AWS region of the upstream, e.g. "us-east-1"
+	Region string `yaml:"region"`
+
+	// Service is the signing name of the service, e.g. "execute-api",
+	// "s3" or "es"
+	Service string `yaml:"service"`
+
+	// Profile selects a shared credentials file profile
+	Profile string `yaml:"profile"`
+
+	// AccessKeyID and SecretAccessKey set static credentials.
+	// Both accept secret store references.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" secret:"true"`
+}
+
+// DefaultConfig returns a configuration with sensible default values.
+// This configuration works out of the box for development and testing.
+//
+// Default values:
+//   - Server listens on 0.0.0.0:8000
+//   - 30 second read/write timeouts
+//   - Single target pointing to localhost:3000
+//
+// Returns a pointer to a new Config instance.
+func DefaultConfig() *Config {
+	return &Config{
+		Version: CurrentVersion,
+		Server: ServerConfig{
+			Host:         "0.0.0.0",
+			Port:         8080,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			PriorityLane: PriorityLaneConfig{
+				Address:        "127.0.0.1:9902",
+				MaxConnections: 64,
+			},
+		},
+		Targets: []TargetConfig{
+			{
+				URL:     "http://localhost:3000",
+				Enabled: true,
+			},
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		UpstreamTLS: UpstreamTLSConfig{
+			SPIFFE: SPIFFEConfig{
+				FetchTimeout: 10 * time.Second,
+			},
+		},
+		OutlierDetection: OutlierDetectionConfig{
+			ConsecutiveFailures: 5,
+			Interval:            10 * time.Second,
+			LatencyMultiplier:   3,
+			MinSamples:          20,
+			BaseEjectionTime:    30 * time.Second,
+			MaxEjectionTime:     5 * time.Minute,
+			MaxEjectionPercent:  50,
+		},
+		RetryBudget: RetryBudgetConfig{
+			Ratio:      0.2,
+			Window:     10 * time.Second,
+			MinRetries: 10,
+		},
+		SessionAffinity: SessionAffinityConfig{
+			Cookie:       "velocity_affinity",
+			Failover:     "rehash",
+			RejectStatus: 401,
+		},
+		LoadBalancing: LoadBalancingConfig{
+			Algorithm: "round_robin",
+			ConsistentHash: ConsistentHashConfig{
+				Key:          "client_ip",
+				VirtualNodes: 160,
+			},
+		},
+		UpstreamDial: UpstreamDialConfig{
+			PreferredFamily: "ipv6",
+			FallbackDelay:   250 * time.Millisecond,
+			ResolutionDelay: 50 * time.Millisecond,
+			Timeout:         30 * time.Second,
+			KeepAlive:       30 * time.Second,
+			StaleGrace:      5 * time.Minute,
+		},
+		Errors: ErrorsConfig{
+			ContextSoftLimit:     16,
+			ContextHardLimit:     32,
+			MaxContextValueBytes: 1024,
+		},
+		Debug: DebugConfig{
+			Prefix: "/debug",
+		},
+		Endpoints: EndpointsConfig{
+			Targets: EndpointAccessConfig{Allow: PrivateNetworks()},
+			Stats:   EndpointAccessConfig{Allow: PrivateNetworks()},
+			Metrics: EndpointAccessConfig{Allow: PrivateNetworks()},
+		},
+		CorrelationHeaders: CorrelationHeadersConfig{
+			StripFromResponses: true,
+		},
+		Admin: AdminConfig{
+			Address: "127.0.0.1:9901",
+		},
+		Reload: ReloadConfig{
+			Probation:     30 * time.Second,
+			CheckTargets:  true,
+			MinRequests:   20,
+			MaxErrorRatio: 0.5,
+			Throttle: ApplyThrottleConfig{
+				Window:              2 * time.Second,
+				MaxInFlight:         100,
+				MaxWait:             time.Second,
+				MinDiscoveryChanges: 10,
+			},
+		},
+		Memory: MemoryConfig{
+			MaxBufferedBytes:       256 << 20,
+			MaxRetryBodyBytes:      1 << 20,
+			MaxResponseHeaderBytes: 64 << 10,
+			MaxResponseHeaders:     100,
+		},
+		Discovery: DiscoveryConfig{
+			RefreshInterval: 30 * time.Second,
+			DrainTimeout:    30 * time.Second,
+		},
+		Synthetic: SyntheticConfig{
+			Interval: 30 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		Cluster: ClusterConfig{
+			BindAddress:    "0.0.0.0:7946",
+			GossipInterval: time.Second,
+			SuspectTimeout: 5 * time.Second,
+		},
+		LoadShedding: LoadSheddingConfig{
+			MaxInFlight: 1000,
+			Thresholds: QoSThresholds{
+				BestEffort: 0.7,
+				Normal:     0.9,
+			},
+			DefaultClass: "normal",
+		},
+	}
+}
+
+// PrivateNetworks returns the loopback and private address ranges, the
+// default audience of endpoints revealing gateway internals
+func PrivateNetworks() []string {
+	return []string{
+		"127.0.0.0/8", "::1/128",
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
 	}
 }
@@ -0,0 +1,272 @@
+// Package contract validates upstream responses against per-route JSON
+// Schemas.
+//
+// A route's contract catches backend regressions at the gateway: a
+// response missing a required field or returning the wrong type is
+// reported with the offending JSON path before clients trip over it. In
+// log mode, meant for canary rollouts and development, violations are
+// only logged and counted. In enforce mode the violating response is
+// replaced with a 502 UPSTREAM_CONTRACT_VIOLATION error and the target is
+// charged with a failure, so outlier detection can eject a regressed
+// canary.
+//
+// The route middleware attaches the Validator to the request context and
+// the proxy checks the upstream response before it is copied to the
+// client:
+//
+//	validator, err := contract.New(route, cfg.ResponseValidation, log)
+//	...
+//	handler = middleware.Chain(handler, validator.Middleware())
+//	...
+//	if v := contract.FromContext(ctx); v != nil {
+//		return v.Check(resp)
+//	}
+package contract
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+	"velocity/internal/schema"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Validation modes
+const (
+	// ModeLog logs violations and forwards the response unchanged
+	ModeLog = "log"
+
+	// ModeEnforce replaces violating responses with a 502
+	ModeEnforce = "enforce"
+)
+
+// defaultMaxBodyBytes is the largest body validated when unconfigured
+const defaultMaxBodyBytes = 1 << 20
+
+// maxReportedViolations bounds the violations attached to logs and errors
+const maxReportedViolations = 5
+
+// Validator checks the responses of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Validator struct {
+	// route is the name of the validated route
+	route string
+
+	// schema is the compiled response contract
+	schema *schema.Schema
+
+	// enforce rejects violating responses instead of only logging them
+	enforce bool
+
+	// sampleRate is the fraction of responses validated
+	sampleRate float64
+
+	// maxBody is the largest body buffered for validation
+	maxBody int64
+
+	// checked, violations and skipped count validation outcomes
+	checked, violations, skipped atomic.Int64
+
+	// logger receives violation reports
+	logger *logger.Logger
+}
+
+// Stats is a snapshot of a validator's outcomes
+type Stats struct {
+	// Checked counts responses that were validated
+	Checked int64 `json:"checked"`
+
+	// Violations counts validated responses that broke the contract
+	Violations int64 `json:"violations"`
+
+	// Skipped counts sampled responses that could not be validated
+	// because they were compressed, too large or over the memory budget
+	Skipped int64 `json:"skipped"`
+}
+
+// New creates the validator of a route, or returns nil when the route has
+// no response schema
+func New(route string, cfg config.ResponseValidationConfig, log *logger.Logger) (*Validator, error) {
+	if cfg.Schema == "" {
+		return nil, nil
+	}
+
+	v := &Validator{
+		route:      route,
+		sampleRate: cfg.SampleRate,
+		maxBody:    cfg.MaxBodyBytes,
+		logger:     log.Component("contract"),
+	}
+
+	switch cfg.Mode {
+	case "", ModeLog:
+	case ModeEnforce:
+		v.enforce = true
+	default:
+		return nil, fmt.Errorf("response_validation: unknown mode %q, expected log or enforce", cfg.Mode)
+	}
+
+	if v.sampleRate < 0 || v.sampleRate > 1 {
+		return nil, fmt.Errorf("response_validation: sample_rate must be between 0 and 1")
+	}
+
+	if v.sampleRate == 0 {
+		v.sampleRate = 1
+	}
+
+	if v.maxBody <= 0 {
+		v.maxBody = defaultMaxBodyBytes
+	}
+
+	compiled, err := schema.Load(cfg.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("response_validation: %w", err)
+	}
+	v.schema = compiled
+
+	return v, nil
+}
+
+// Route returns the name of the validated route
+func (v *Validator) Route() string {
+	return v.route
+}
+
+// Stats returns the validation outcomes so far
+func (v *Validator) Stats() Stats {
+	return Stats{
+		Checked:    v.checked.Load(),
+		Violations: v.violations.Load(),
+		Skipped:    v.skipped.Load(),
+	}
+}
+
+// Middleware returns a middleware attaching v to every request context.
+// Returns nil when v is nil.
+func (v *Validator) Middleware() middleware.Middleware {
+	if v == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithValidator(r.Context(), v)))
+		})
+	}
+}
+
+// validatorKey is the context key for the validator
+type validatorKey struct{}
+
+// WithValidator returns a copy of ctx carrying v
+func WithValidator(ctx context.Context, v *Validator) context.Context {
+	return context.WithValue(ctx, validatorKey{}, v)
+}
+
+// FromContext returns the request's validator, or nil if its route has no
+// response contract
+func FromContext(ctx context.Context) *Validator {
+	v, _ := ctx.Value(validatorKey{}).(*Validator)
+	return v
+}
+
+// Check validates an upstream response.
+//
+// Only successful responses with a body are checked. The body is
+// buffered within the request's memory budget and replaced by the
+// buffered copy, so the client still receives it in full. Returns a
+// CodeUpstreamContract GatewayError for a violating response in enforce
+// mode and nil otherwise.
+func (v *Validator) Check(resp *http.Response) error {
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices ||
+		resp.StatusCode == http.StatusNoContent || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	if v.sampleRate < 1 && rand.Float64() >= v.sampleRate {
+		return nil
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		v.skipped.Add(1)
+		return nil
+	}
+
+	data, release, replay, ok, err := membudget.BufferBody(
+		membudget.FromContext(resp.Request.Context()), resp.Body, v.maxBody)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		resp.Body = replay
+		v.skipped.Add(1)
+		return nil
+	}
+
+	v.checked.Add(1)
+
+	violations := v.validate(resp.Header.Get("Content-Type"), data)
+	if len(violations) == 0 {
+		resp.Body = membudget.NewBody(data, release)
+		return nil
+	}
+
+	v.violations.Add(1)
+
+	reported := make([]string, 0, maxReportedViolations)
+	for _, violation := range violations[:min(len(violations), maxReportedViolations)] {
+		reported = append(reported, violation.String())
+	}
+
+	summary := strings.Join(reported, "; ")
+
+	if v.enforce {
+		release()
+		return gwerrors.New(gwerrors.CodeUpstreamContract, "Upstream response violated its contract").
+			WithRoute(v.route).
+			WithContext("violations", summary).
+			WithContext("violation_count", len(violations))
+	}
+
+	resp.Body = membudget.NewBody(data, release)
+	v.logger.Warn("Upstream response violated its contract",
+		"route", v.route,
+		"target", resp.Request.URL.Host,
+		"status", resp.StatusCode,
+		"violation_count", len(violations),
+		"violations", summary,
+	)
+
+	return nil
+}
+
+// validate decodes a response body and checks it against the schema
+func (v *Validator) validate(contentType string, data []byte) []schema.Violation {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return []schema.Violation{{Message: fmt.Sprintf("expected a JSON response, got content type %q", contentType)}}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return []schema.Violation{{Message: "invalid JSON: " + err.Error()}}
+	}
+
+	return v.schema.Validate(document)
+}
@@ -0,0 +1,253 @@
+// Package deadline bounds how long a route's requests may take and tells
+// upstreams how much of that time is left.
+//
+// The route middleware derives the request's deadline from the route
+// timeout, or from the server's write timeout, after which the client
+// connection is abandoned anyway. The proxy then calls Apply before every
+// attempt, which sets the configured header to the time remaining:
+//
+//	X-Request-Timeout-Ms: 2750
+//	grpc-timeout: 2750m
+//
+// so a backend can give up on work whose result nobody will wait for.
+//
+// Clients can shorten the deadline the same way: with client deadlines
+// enabled, a hint such as "X-Request-Timeout: 2s" or "grpc-timeout: 500m"
+// bounds the request too, within the route's own limit. The shorter
+// deadline reaches the upstream through the request context and the
+// propagated header.
+//
+// Example usage:
+//
+//	mw, err := deadline.Middleware(rc.Timeout, cfg.Server.WriteTimeout, rc.DeadlinePropagation, rc.ClientDeadline)
+//	handler = middleware.Chain(handler, mw)
+//	...
+//	deadline.Apply(outgoing)
+package deadline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Header value formats
+const (
+	FormatMilliseconds = "milliseconds"
+	FormatSeconds      = "seconds"
+	FormatGRPC         = "grpc"
+)
+
+// propagation is the header a request's remaining budget is written to
+type propagation struct {
+	// header is the name of the header
+	header string
+
+	// format is the value format
+	format string
+}
+
+// propagationKey is the context key for the request's propagation
+type propagationKey struct{}
+
+// defaultHintHeaders are the client deadline hints read by default
+var defaultHintHeaders = []string{"X-Request-Timeout", "grpc-timeout"}
+
+// Middleware returns a middleware bounding requests by timeout, or by
+// fallback when timeout is zero, shortening them to the deadline hinted by
+// clients and propagating the remaining time as configured. Returns nil
+// when there is neither a route timeout, a header to propagate nor a hint
+// to honor.
+func Middleware(timeout, fallback time.Duration, cfg config.DeadlinePropagationConfig,
+	client config.ClientDeadlineConfig) (middleware.Middleware, error) {
+	if timeout < 0 {
+		return nil, fmt.Errorf("timeout: must not be negative")
+	}
+
+	var hints []string
+	if client.Enabled {
+		hints = client.Headers
+		if len(hints) == 0 {
+			hints = defaultHintHeaders
+		}
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = FormatMilliseconds
+		if strings.EqualFold(cfg.Header, "grpc-timeout") {
+			format = FormatGRPC
+		}
+	}
+
+	switch format {
+	case FormatMilliseconds, FormatSeconds, FormatGRPC:
+	default:
+		return nil, fmt.Errorf("deadline_propagation: unknown format %q, expected milliseconds, seconds or grpc", cfg.Format)
+	}
+
+	// The fallback only matters to upstreams told about it
+	var prop *propagation
+	if cfg.Header != "" {
+		prop = &propagation{header: cfg.Header, format: format}
+		if timeout == 0 {
+			timeout = fallback
+		}
+	}
+
+	// Hints never outlast the route's limit
+	limit := timeout
+	if limit == 0 {
+		limit = fallback
+	}
+
+	if timeout == 0 && prop == nil && hints == nil {
+		return nil, nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			if hint, ok := clientHint(r.Header, hints); ok && (limit == 0 || hint < limit) {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, hint)
+				defer cancel()
+			}
+
+			if prop != nil {
+				ctx = context.WithValue(ctx, propagationKey{}, prop)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, nil
+}
+
+// Apply sets the propagation header of an outgoing request to the time
+// left until its deadline. Does nothing when the request's route does not
+// propagate deadlines or the request has no deadline; a client-sent value
+// of the header is removed in that case, so upstreams never act on it.
+func Apply(r *http.Request) {
+	prop, _ := r.Context().Value(propagationKey{}).(*propagation)
+	if prop == nil {
+		return
+	}
+
+	end, ok := r.Context().Deadline()
+	if !ok {
+		r.Header.Del(prop.header)
+		return
+	}
+
+	r.Header.Set(prop.header, Format(time.Until(end), prop.format))
+}
+
+// clientHint returns the first valid deadline hint among headers
+func clientHint(h http.Header, headers []string) (time.Duration, bool) {
+	for _, name := range headers {
+		value := strings.TrimSpace(h.Get(name))
+		if value == "" {
+			continue
+		}
+
+		var (
+			hint time.Duration
+			err  error
+		)
+		if strings.EqualFold(name, "grpc-timeout") {
+			hint, err = parseGRPC(value)
+		} else {
+			hint, err = parseHint(value)
+		}
+
+		if err == nil && hint > 0 {
+			return hint, true
+		}
+	}
+
+	return 0, false
+}
+
+// parseHint parses a duration with a unit, or plain milliseconds
+func parseHint(value string) (time.Duration, error) {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.ParseDuration(value)
+	}
+
+	if millis > math.MaxInt64/int64(time.Millisecond) {
+		return 0, fmt.Errorf("timeout %q out of range", value)
+	}
+
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// grpcUnits maps gRPC timeout units to durations
+var grpcUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPC parses a timeout in the gRPC format: at most 8 digits followed
+// by a unit, e.g. "250m" or "3S"
+func parseGRPC(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	unit, ok := grpcUnits[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", value)
+	}
+
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	// Only hours can overflow a Duration with 8 digits
+	if unit == time.Hour && n > math.MaxInt64/uint64(time.Hour) {
+		return 0, fmt.Errorf("grpc-timeout %q out of range", value)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// Format renders a remaining duration in a header format. Durations are
+// rounded down, and negative ones reported as zero.
+func Format(remaining time.Duration, format string) string {
+	remaining = max(remaining, 0)
+	millis := remaining.Milliseconds()
+
+	switch format {
+	case FormatSeconds:
+		return strconv.FormatFloat(float64(millis)/1000, 'f', 3, 64)
+	case FormatGRPC:
+		// gRPC allows at most 8 digits, so long budgets switch to seconds
+		if millis < 1e8 {
+			return strconv.FormatInt(millis, 10) + "m"
+		}
+
+		return strconv.FormatInt(int64(remaining/time.Second), 10) + "S"
+	default:
+		return strconv.FormatInt(millis, 10)
+	}
+}
@@ -0,0 +1,255 @@
+// Package debug provides ping and request-inspection endpoints for
+// debugging routing and transform configuration.
+//
+// When enabled, two endpoints are served under the configured prefix
+// (default "/debug") on the proxy listener:
+//
+//	GET <prefix>/ping          answers immediately without touching routes
+//	ANY <prefix>/echo/<path>   runs <path> through the full pipeline but,
+//	                           instead of contacting an upstream, returns
+//	                           the request as it would be forwarded
+//
+// The echo report names the matched route and the target the balancer would
+// pick, shows the request as received and as forwarded, and lists the
+// transforms applied in between (normalization, trailing slash rewrites,
+// header policies, injected credentials). Credential values are redacted,
+// both in the well-known headers and in the headers configured to carry
+// credentials. Echo requests pass through authentication, rate limits and
+// load shedding like normal traffic, so they show exactly what a real
+// request would experience, but never reach a backend or affect target
+// statistics.
+//
+// The endpoints expose configuration details and should only be enabled
+// in development or on trusted networks.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// redacted replaces credential values in echo reports
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders hold credentials whose values are never echoed,
+// whatever the configuration
+var sensitiveHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"X-Api-Key":            true,
+	"X-Amz-Security-Token": true,
+}
+
+// Echo marks a request as an echo request and remembers it as received
+type Echo struct {
+	// received is the request before any gateway transform
+	received snapshot
+
+	// sensitive are the headers redacted in the report
+	sensitive map[string]bool
+}
+
+// snapshot is the inspectable part of a request
+type snapshot struct {
+	Method  string      `json:"method"`
+	Host    string      `json:"host"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	Headers http.Header `json:"headers"`
+}
+
+// report is the body of an echo response
+type report struct {
+	// Route is the matched route, empty when the fallback handled it
+	Route string `json:"route"`
+
+	// Target is the upstream the request would be sent to
+	Target string `json:"target"`
+
+	// Received is the request as the gateway received it
+	Received snapshot `json:"received"`
+
+	// Forwarded is the request as it would leave the gateway
+	Forwarded snapshot `json:"forwarded"`
+
+	// BodyBytes is the size of the request body
+	BodyBytes int64 `json:"body_bytes"`
+
+	// Transforms lists the differences between both requests
+	Transforms []string `json:"transforms"`
+}
+
+// echoKey is the context key for the echo marker
+type echoKey struct{}
+
+// FromContext returns the echo marker of an echo request, or nil for
+// normal traffic
+func FromContext(ctx context.Context) *Echo {
+	echo, _ := ctx.Value(echoKey{}).(*Echo)
+	return echo
+}
+
+// Middleware returns a middleware serving the debug endpoints, or nil
+// when they are disabled. It must run before any middleware that
+// transforms requests so echo reports can show those transforms.
+// credentials names further headers whose values are redacted, such as
+// injected upstream credentials and API keys.
+func Middleware(cfg config.DebugConfig, credentials []string) (middleware.Middleware, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	sensitive := maps.Clone(sensitiveHeaders)
+	for _, name := range credentials {
+		sensitive[http.CanonicalHeaderKey(name)] = true
+	}
+
+	prefix := strings.TrimRight(cfg.Prefix, "/")
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("debug: prefix must start with /")
+	}
+
+	pingPath := prefix + "/ping"
+	echoPrefix := prefix + "/echo"
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == pingPath {
+				writeJSON(w, http.StatusOK, map[string]string{
+					"status": "pong",
+					"time":   time.Now().UTC().Format(time.RFC3339Nano),
+				})
+				return
+			}
+
+			path, ok := strings.CutPrefix(r.URL.Path, echoPrefix)
+			if !ok || (path != "" && !strings.HasPrefix(path, "/")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if path == "" {
+				path = "/"
+			}
+
+			r.URL.Path = path
+			if r.URL.RawPath != "" {
+				r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, echoPrefix)
+			}
+			r.RequestURI = r.URL.RequestURI()
+
+			echo := &Echo{received: capture(r), sensitive: sensitive}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), echoKey{}, echo)))
+		})
+	}, nil
+}
+
+// Write answers an echo request with the request that would have been
+// sent to target through route. outgoing is the fully prepared upstream
+// request.
+func (e *Echo) Write(w http.ResponseWriter, outgoing *http.Request, route string, target *url.URL) {
+	forwarded := capture(outgoing)
+	forwarded.URL = outgoing.URL.String()
+
+	// Diff before redacting so replaced credentials show as changed
+	transforms := diff(e.received, forwarded)
+
+	writeJSON(w, http.StatusOK, report{
+		Route:      route,
+		Target:     target.String(),
+		Received:   e.received.redacted(e.sensitive),
+		Forwarded:  forwarded.redacted(e.sensitive),
+		BodyBytes:  outgoing.ContentLength,
+		Transforms: transforms,
+	})
+}
+
+// capture snapshots a request. Headers are copied because later
+// middleware modify them in place.
+func capture(r *http.Request) snapshot {
+	return snapshot{
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Query:   r.URL.RawQuery,
+		Headers: r.Header.Clone(),
+	}
+}
+
+// redacted returns a copy of s with the values of sensitive headers
+// replaced
+func (s snapshot) redacted(sensitive map[string]bool) snapshot {
+	headers := make(map[string][]string, len(s.Headers))
+	for name, values := range s.Headers {
+		if sensitive[name] {
+			values = []string{redacted}
+		}
+		headers[name] = values
+	}
+
+	s.Headers = headers
+	return s
+}
+
+// diff describes how the forwarded request differs from the received one
+func diff(received, forwarded snapshot) []string {
+	transforms := []string{}
+
+	if received.Path != forwarded.Path {
+		transforms = append(transforms, fmt.Sprintf("path rewritten from %s to %s", received.Path, forwarded.Path))
+	}
+
+	if received.Query != forwarded.Query {
+		transforms = append(transforms, fmt.Sprintf("query rewritten from %q to %q", received.Query, forwarded.Query))
+	}
+
+	if received.Host != forwarded.Host {
+		transforms = append(transforms, fmt.Sprintf("host rewritten from %s to %s", received.Host, forwarded.Host))
+	}
+
+	names := make([]string, 0, len(received.Headers)+len(forwarded.Headers))
+	for name := range received.Headers {
+		names = append(names, name)
+	}
+	for name := range forwarded.Headers {
+		if _, ok := received.Headers[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		before, hadBefore := received.Headers[name]
+		after, hasAfter := forwarded.Headers[name]
+
+		switch {
+		case !hadBefore:
+			transforms = append(transforms, "header "+name+" added")
+		case !hasAfter:
+			transforms = append(transforms, "header "+name+" removed")
+		case strings.Join(before, "\x00") != strings.Join(after, "\x00"):
+			transforms = append(transforms, "header "+name+" changed")
+		}
+	}
+
+	return transforms
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
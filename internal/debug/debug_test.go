@@ -0,0 +1,45 @@
+package debug
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"velocity/internal/config"
+)
+
+func TestEchoRedactsConfiguredCredentialHeaders(t *testing.T) {
+	mw, err := Middleware(config.DebugConfig{Enabled: true, Prefix: "/debug"}, []string{"x-partner-key", "X-Upstream-Token"})
+	if err != nil {
+		t.Fatalf("Middleware() error = %v", err)
+	}
+
+	target, _ := url.Parse("http://backend:8080")
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stand-in for upstream_auth injecting a credential
+		outgoing := r.Clone(r.Context())
+		outgoing.Header.Set("X-Upstream-Token", "injected-secret")
+		FromContext(r.Context()).Write(w, outgoing, "api", target)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/echo/api/orders", nil)
+	r.Header.Set("X-Partner-Key", "partner-secret")
+	r.Header.Set("Authorization", "Bearer token-secret")
+	r.Header.Set("X-Request-Id", "visible")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	for _, secret := range []string{"partner-secret", "injected-secret", "token-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("echo report contains %q: %s", secret, body)
+		}
+	}
+
+	if !strings.Contains(body, "visible") || !strings.Contains(body, redacted) {
+		t.Errorf("echo report should keep other headers and mark redactions: %s", body)
+	}
+}
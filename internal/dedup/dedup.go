@@ -0,0 +1,395 @@
+// Package dedup suppresses exact duplicate requests on a route.
+//
+// Buggy clients double-submit forms and aggressive retry loops resend a
+// request before the first attempt has been answered. For a non-idempotent
+// backend each copy is a new order, payment or message. The deduplicator
+// fingerprints every request by method, host, path, query, client key,
+// credentials and a hash of the body. Credential headers and the
+// authenticated subject are always included, so clients sharing an address
+// never receive each other's responses. The first request with a
+// fingerprint is forwarded while its response is recorded; identical
+// requests arriving while it is in flight, or within the window after its
+// response, wait for it and receive a copy marked with the
+// X-Velocity-Duplicate header instead of reaching the upstream.
+//
+// Responses larger than the configured limit, or that do not fit the
+// memory budget, are not kept; their duplicates are answered with 409
+// DUPLICATE_REQUEST so the client knows the original went through. The
+// request body is read through the route's shared body buffer, and
+// requests whose body does not fit it are never deduplicated.
+//
+// Example usage:
+//
+//	d, err := dedup.New(rc.Name, rc.Dedup, budget)
+//	handler = middleware.Chain(handler, bodybuf.Middleware(limit), d.Middleware())
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/auth"
+	"velocity/internal/bodybuf"
+	"velocity/internal/config"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+	gwerrors "velocity/pkg/errors"
+)
+
+// DuplicateHeader marks responses replayed to duplicate requests
+const DuplicateHeader = "X-Velocity-Duplicate"
+
+// Defaults for unset configuration
+const (
+	defaultWindow       = 2 * time.Second
+	defaultMaxBodyBytes = 1 << 20
+)
+
+// credentialHeaders are the request headers always part of a fingerprint
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-API-Key"}
+
+// defaultMethods are the methods deduplicated unless configured otherwise.
+// Safe methods are left alone because repeating them is harmless.
+var defaultMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// Deduplicator collapses duplicate requests of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Deduplicator struct {
+	// route is the name of the deduplicated route
+	route string
+
+	// window is how long a response is kept after it completes
+	window time.Duration
+
+	// key identifies the client of a request
+	key ratelimit.KeyFunc
+
+	// credentials are the request headers carrying client credentials
+	credentials []string
+
+	// methods are the deduplicated methods
+	methods map[string]bool
+
+	// maxBody is the largest response body kept
+	maxBody int64
+
+	// budget is charged for kept response bodies
+	budget *membudget.Budget
+
+	// mu guards entries
+	mu sync.Mutex
+
+	// entries holds the requests in flight or within their window, by
+	// fingerprint
+	entries map[string]*entry
+
+	// forwarded, replayed and rejected count requests by outcome
+	forwarded, replayed, rejected atomic.Int64
+}
+
+// entry is a request in flight or recently answered
+type entry struct {
+	// done is closed once the response is complete
+	done chan struct{}
+
+	// status, header and body are the response, set before done is closed
+	status int
+	header http.Header
+	body   []byte
+
+	// kept reports whether the response was kept and can be replayed
+	kept bool
+}
+
+// Stats is a snapshot of a deduplicator
+type Stats struct {
+	// Entries is the number of fingerprints currently tracked
+	Entries int
+
+	// Forwarded counts requests forwarded as the first of their kind
+	Forwarded int64
+
+	// Replayed counts duplicates answered with the original response
+	Replayed int64
+
+	// Rejected counts duplicates answered with 409 because the original
+	// response was not kept
+	Rejected int64
+}
+
+// New creates the deduplicator of a route, or returns nil when
+// deduplication is disabled
+func New(route string, cfg config.DedupConfig, budget *membudget.Budget) (*Deduplicator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Window < 0 {
+		return nil, fmt.Errorf("dedup: window must not be negative")
+	}
+
+	if cfg.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("dedup: max_body_bytes must not be negative")
+	}
+
+	key, err := ratelimit.ParseKey(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("dedup: %w", err)
+	}
+
+	d := &Deduplicator{
+		route:   route,
+		window:  cfg.Window,
+		key:     key,
+		methods: make(map[string]bool),
+		maxBody: cfg.MaxBodyBytes,
+		budget:  budget,
+		entries: make(map[string]*entry),
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range slices.Concat(credentialHeaders, ratelimit.KeyHeaders(cfg.Key), cfg.CredentialHeaders) {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			d.credentials = append(d.credentials, name)
+		}
+	}
+
+	if d.window == 0 {
+		d.window = defaultWindow
+	}
+
+	if d.maxBody == 0 {
+		d.maxBody = defaultMaxBodyBytes
+	}
+
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+
+	for _, method := range methods {
+		d.methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+
+	return d, nil
+}
+
+// Route returns the name of the deduplicated route
+func (d *Deduplicator) Route() string {
+	return d.route
+}
+
+// Stats returns the deduplicator's current statistics
+func (d *Deduplicator) Stats() Stats {
+	d.mu.Lock()
+	entries := len(d.entries)
+	d.mu.Unlock()
+
+	return Stats{
+		Entries:   entries,
+		Forwarded: d.forwarded.Load(),
+		Replayed:  d.replayed.Load(),
+		Rejected:  d.rejected.Load(),
+	}
+}
+
+// Middleware returns a middleware forwarding the first of identical
+// requests and answering the others with its response. Returns nil when d
+// is nil.
+func (d *Deduplicator) Middleware() middleware.Middleware {
+	if d == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !d.methods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Without a buffered body there is nothing to fingerprint
+			body, ok, err := bodybuf.Read(r, defaultMaxBodyBytes)
+			if err != nil || !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			fingerprint := d.fingerprint(r, body)
+			original, first := d.claim(fingerprint)
+
+			if first {
+				d.forwarded.Add(1)
+
+				rec := &recorder{ResponseWriter: w, maxBody: d.maxBody}
+				defer d.finish(fingerprint, original, rec)
+
+				next.ServeHTTP(rec, r)
+				return
+			}
+
+			select {
+			case <-original.done:
+			case <-r.Context().Done():
+				return
+			}
+
+			if !original.kept {
+				d.rejected.Add(1)
+				gwerrors.New(gwerrors.CodeDuplicateRequest, "An identical request was just handled").
+					WithRoute(d.route).
+					WriteJSON(w)
+				return
+			}
+
+			d.replayed.Add(1)
+			for name, values := range original.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(DuplicateHeader, "true")
+			w.WriteHeader(original.status)
+			w.Write(original.body)
+		})
+	}
+}
+
+// fingerprint identifies a request by everything that makes it distinct,
+// including who sent it
+func (d *Deduplicator) fingerprint(r *http.Request, body []byte) string {
+	parts := []string{r.Method, r.Host, r.URL.RequestURI(), d.key(r)}
+	for _, name := range d.credentials {
+		parts = append(parts, strings.Join(r.Header.Values(name), "\n"))
+	}
+
+	var subject string
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+		subject, _ = claims.String("sub")
+	}
+	parts = append(parts, subject)
+
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claim returns the entry for a fingerprint and whether the caller created
+// it and must forward the request
+func (d *Deduplicator) claim(fingerprint string) (*entry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if existing, ok := d.entries[fingerprint]; ok {
+		return existing, false
+	}
+
+	created := &entry{done: make(chan struct{})}
+	d.entries[fingerprint] = created
+	return created, true
+}
+
+// finish publishes the recorded response to waiting duplicates and
+// forgets the fingerprint once the window has passed. Runs even when the
+// handler panics, in which case the response is not kept.
+func (d *Deduplicator) finish(fingerprint string, e *entry, rec *recorder) {
+	size := int64(rec.body.Len())
+
+	if rec.keep && rec.wroteHeader && middleware.CompleteBody(rec.header, rec.body.Len()) && d.budget.Reserve(size) {
+		e.status = rec.status
+		e.header = rec.header
+		e.body = bytes.Clone(rec.body.Bytes())
+		e.kept = true
+	}
+	close(e.done)
+
+	time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		delete(d.entries, fingerprint)
+		d.mu.Unlock()
+
+		if e.kept {
+			d.budget.Release(size)
+		}
+	})
+}
+
+// recorder passes a response through to the client while keeping a copy
+// for duplicates
+type recorder struct {
+	http.ResponseWriter
+
+	// maxBody is the largest body copied
+	maxBody int64
+
+	// wroteHeader reports whether the final status was sent
+	wroteHeader bool
+
+	// keep reports whether the response can still be kept
+	keep bool
+
+	// status and header are the response as sent to the client
+	status int
+	header http.Header
+
+	// body is the copied response body
+	body bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *recorder) WriteHeader(status int) {
+	if status >= http.StatusOK && !r.wroteHeader {
+		r.wroteHeader = true
+		r.keep = true
+		r.status = status
+		r.header = r.Header().Clone()
+		r.header.Del("Date")
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.keep {
+		if int64(r.body.Len()+len(b)) > r.maxBody {
+			r.keep = false
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
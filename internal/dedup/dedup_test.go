@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"velocity/internal/auth"
+	"velocity/internal/config"
+)
+
+// serve sends POST /orders from 10.0.0.1 through handler, after setup
+// adds the client's credentials
+func serve(handler http.Handler, setup func(*http.Request) *http.Request) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"item":1}`))
+	r.RemoteAddr = "10.0.0.1:5000"
+	r = setup(r)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCredentialsSharingAnAddressAreNotDeduplicated(t *testing.T) {
+	header := func(name, value string) func(*http.Request) *http.Request {
+		return func(r *http.Request) *http.Request {
+			r.Header.Set(name, value)
+			return r
+		}
+	}
+
+	subject := func(sub string) func(*http.Request) *http.Request {
+		return func(r *http.Request) *http.Request {
+			return r.WithContext(auth.WithClaims(r.Context(), auth.Claims{"sub": sub}))
+		}
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.DedupConfig
+		alice, bob func(*http.Request) *http.Request
+	}{
+		{name: "authorization", alice: header("Authorization", "Bearer alice"), bob: header("Authorization", "Bearer bob")},
+		{name: "cookie", alice: header("Cookie", "session=alice"), bob: header("Cookie", "session=bob")},
+		{name: "api key", alice: header("X-API-Key", "alice"), bob: header("X-API-Key", "bob")},
+		{
+			name:  "configured header",
+			cfg:   config.DedupConfig{CredentialHeaders: []string{"X-Tenant-Token"}},
+			alice: header("X-Tenant-Token", "alice"),
+			bob:   header("X-Tenant-Token", "bob"),
+		},
+		{name: "subject", alice: subject("alice"), bob: subject("bob")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Enabled = true
+			d, err := New("orders", tt.cfg, nil)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			calls := 0
+			handler := d.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Write([]byte("order for " + r.Header.Get("X-Caller")))
+			}))
+
+			withCaller := func(setup func(*http.Request) *http.Request, caller string) func(*http.Request) *http.Request {
+				return func(r *http.Request) *http.Request {
+					r.Header.Set("X-Caller", caller)
+					return setup(r)
+				}
+			}
+
+			serve(handler, withCaller(tt.alice, "alice"))
+			w := serve(handler, withCaller(tt.bob, "bob"))
+
+			if calls != 2 {
+				t.Fatalf("upstream called %d times, want 2", calls)
+			}
+
+			if w.Header().Get(DuplicateHeader) != "" || w.Body.String() != "order for bob" {
+				t.Fatalf("bob received %q (duplicate %q), want his own response",
+					w.Body.String(), w.Header().Get(DuplicateHeader))
+			}
+		})
+	}
+}
+
+func TestSameCredentialsAreDeduplicated(t *testing.T) {
+	d, err := New("orders", config.DedupConfig{Enabled: true}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	calls := 0
+	handler := d.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("created"))
+	}))
+
+	alice := func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", "Bearer alice")
+		return r
+	}
+
+	serve(handler, alice)
+	w := serve(handler, alice)
+
+	if calls != 1 {
+		t.Fatalf("upstream called %d times, want 1", calls)
+	}
+
+	if w.Header().Get(DuplicateHeader) != "true" || w.Body.String() != "created" {
+		t.Fatalf("duplicate received %q (duplicate %q), want the replayed response",
+			w.Body.String(), w.Header().Get(DuplicateHeader))
+	}
+}
@@ -0,0 +1,325 @@
+// Package deprecation announces the deprecation and sunset of routes.
+//
+// Retiring an API is easier when clients learn about it from the API
+// itself rather than from a changelog nobody reads. A deprecated route's
+// responses carry the standard lifecycle headers:
+//
+//	Deprecation: @1782777600                        (RFC 9745)
+//	Sunset: Tue, 30 Jun 2026 00:00:00 GMT           (RFC 8594)
+//	Link: <https://docs.example.com/v1>; rel="deprecation"
+//	Link: <https://api.example.com/v2>; rel="successor-version"
+//
+// The route can escalate as the sunset approaches: a Warning header from
+// a configured time before the sunset, then, once the sunset passes,
+// 410 Gone answered by the gateway instead of the upstream.
+//
+// Example usage:
+//
+//	policy, err := deprecation.New(rc.Name, rc.Deprecation)
+//	handler = middleware.Chain(handler, policy.Middleware())
+package deprecation
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	gwerrors "velocity/pkg/errors"
+)
+
+// dateLayout is the layout of plain dates, taken as midnight UTC
+const dateLayout = "2006-01-02"
+
+// quoteEscaper escapes the Warning text as an HTTP quoted-string
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Policy announces the deprecation of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Policy struct {
+	// route is the name of the route
+	route string
+
+	// since is when the route is deprecated, zero when not given
+	since time.Time
+
+	// sunset is when the route stops being served, zero when not given
+	sunset time.Time
+
+	// headers are set on every response of the route
+	headers http.Header
+
+	// warning is the Warning header value, empty for none
+	warning string
+
+	// warnFrom is when the Warning header starts being sent
+	warnFrom time.Time
+
+	// shutoff answers requests after the sunset with 410 Gone
+	shutoff bool
+
+	// served, warned and rejected count requests by outcome
+	served, warned, rejected atomic.Int64
+}
+
+// Stats counts a route's requests since it was configured as deprecated
+type Stats struct {
+	// Served counts requests forwarded with the deprecation headers only
+	Served int64
+
+	// Warned counts requests forwarded with a Warning header as well
+	Warned int64
+
+	// Rejected counts requests answered 410 Gone after the sunset
+	Rejected int64
+}
+
+// New creates the deprecation policy of a route, or returns nil when the
+// route is not deprecated
+//
+// Returns an error for invalid dates or URLs, a sunset before the
+// deprecation, and escalations that need a sunset date without one.
+func New(route string, cfg config.DeprecationConfig) (*Policy, error) {
+	if cfg == (config.DeprecationConfig{}) {
+		return nil, nil
+	}
+
+	if cfg.Since == "" && cfg.Sunset == "" {
+		return nil, errors.New("deprecation: since or sunset is required")
+	}
+
+	since, err := parseDate(cfg.Since)
+	if err != nil {
+		return nil, fmt.Errorf("deprecation: since: %w", err)
+	}
+
+	sunset, err := parseDate(cfg.Sunset)
+	if err != nil {
+		return nil, fmt.Errorf("deprecation: sunset: %w", err)
+	}
+
+	if !since.IsZero() && !sunset.IsZero() && sunset.Before(since) {
+		return nil, errors.New("deprecation: sunset must not be before since")
+	}
+
+	if cfg.WarnBefore < 0 {
+		return nil, errors.New("deprecation: warn_before must not be negative")
+	}
+
+	if (cfg.WarnBefore > 0 || cfg.Shutoff) && sunset.IsZero() {
+		return nil, errors.New("deprecation: warn_before and shutoff require a sunset date")
+	}
+
+	if cfg.WarnBefore > 0 && cfg.Warning == "" {
+		return nil, errors.New("deprecation: warn_before requires a warning")
+	}
+
+	if strings.ContainsFunc(cfg.Warning, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return nil, errors.New("deprecation: warning must not contain control characters")
+	}
+
+	p := &Policy{
+		route:   route,
+		since:   since,
+		sunset:  sunset,
+		headers: make(http.Header),
+		shutoff: cfg.Shutoff,
+	}
+
+	if !since.IsZero() {
+		p.headers.Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+	}
+
+	if !sunset.IsZero() {
+		p.headers.Set("Sunset", sunset.Format(http.TimeFormat))
+	}
+
+	for _, link := range []struct{ target, rel string }{{cfg.Link, "deprecation"}, {cfg.Successor, "successor-version"}} {
+		if link.target == "" {
+			continue
+		}
+
+		if err := checkLink(link.target); err != nil {
+			return nil, fmt.Errorf("deprecation: %s link: %w", link.rel, err)
+		}
+
+		p.headers.Add("Link", "<"+link.target+`>; rel="`+link.rel+`"`)
+	}
+
+	if cfg.Warning != "" {
+		p.warning = `299 - "` + quoteEscaper.Replace(cfg.Warning) + `"`
+		p.warnFrom = since
+		if cfg.WarnBefore > 0 {
+			p.warnFrom = sunset.Add(-cfg.WarnBefore)
+		}
+	}
+
+	return p, nil
+}
+
+// Route returns the name of the route
+func (p *Policy) Route() string {
+	return p.route
+}
+
+// Sunset returns when the route stops being served, zero when no date is
+// set
+func (p *Policy) Sunset() time.Time {
+	return p.sunset
+}
+
+// Stats returns the policy's counters
+func (p *Policy) Stats() Stats {
+	return Stats{
+		Served:   p.served.Load(),
+		Warned:   p.warned.Load(),
+		Rejected: p.rejected.Load(),
+	}
+}
+
+// Middleware returns a middleware adding the deprecation headers to the
+// route's responses, and answering 410 Gone once the route is shut off
+func (p *Policy) Middleware() middleware.Middleware {
+	if p == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+
+			if p.shutoff && !now.Before(p.sunset) {
+				p.rejected.Add(1)
+				p.apply(w.Header(), "")
+
+				gwerrors.New(gwerrors.CodeRouteSunset, "This API was retired on "+p.sunset.Format(dateLayout)).
+					WithRoute(p.route).
+					WriteJSON(w)
+				return
+			}
+
+			warning := ""
+			if p.warning != "" && !now.Before(p.warnFrom) {
+				warning = p.warning
+				p.warned.Add(1)
+			} else {
+				p.served.Add(1)
+			}
+
+			next.ServeHTTP(&annotatingWriter{ResponseWriter: w, policy: p, warning: warning}, r)
+		})
+	}
+}
+
+// apply adds the deprecation headers to a response's headers, replacing
+// any the upstream sent except its own Link headers
+func (p *Policy) apply(header http.Header, warning string) {
+	for name, values := range p.headers {
+		if name != "Link" {
+			header.Del(name)
+		}
+
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+
+	if warning != "" {
+		header.Add("Warning", warning)
+	}
+}
+
+// annotatingWriter adds the deprecation headers just before the response
+// headers are sent
+type annotatingWriter struct {
+	http.ResponseWriter
+
+	// policy is the route's deprecation policy
+	policy *Policy
+
+	// warning is the Warning header of this response, empty for none
+	warning string
+
+	// applied reports whether the headers were already added
+	applied bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (aw *annotatingWriter) WriteHeader(status int) {
+	// Informational responses carry their own headers
+	if status >= http.StatusOK {
+		aw.applyOnce()
+	}
+
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (aw *annotatingWriter) Write(b []byte) (int, error) {
+	aw.applyOnce()
+	return aw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (aw *annotatingWriter) Flush() {
+	aw.applyOnce()
+
+	if flusher, ok := aw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (aw *annotatingWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// applyOnce adds the headers before the response headers are sent
+func (aw *annotatingWriter) applyOnce() {
+	if aw.applied {
+		return
+	}
+
+	aw.applied = true
+	aw.policy.apply(aw.ResponseWriter.Header(), aw.warning)
+}
+
+// parseDate parses an RFC 3339 timestamp or a plain date, or returns the
+// zero time for an empty string
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(dateLayout, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+	}
+
+	return t.UTC(), nil
+}
+
+// checkLink validates a Link target: an absolute URL or an absolute path
+func checkLink(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(target, "<> \t") || (u.Scheme == "" && !strings.HasPrefix(target, "/")) {
+		return fmt.Errorf("invalid URL %q, expected an absolute URL or path", target)
+	}
+
+	return nil
+}
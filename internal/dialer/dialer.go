@@ -0,0 +1,496 @@
+// Package dialer establishes upstream connections using Happy Eyeballs.
+//
+// In dual-stack environments an IPv6 route can silently blackhole: the
+// connection attempt neither succeeds nor fails until it times out. The
+// Dialer implements RFC 8305 (Happy Eyeballs Version 2) so a broken family
+// costs at most the connection attempt delay instead of the full timeout:
+//
+//   - AAAA and A records are resolved concurrently
+//   - When the A answer arrives first, the dialer waits briefly for AAAA
+//     (resolution delay) before starting
+//   - Addresses are interleaved by family, starting with the preferred one
+//   - A new attempt starts every fallback delay, or immediately when the
+//     previous attempt fails, and the first connection to succeed wins
+//
+// Per-family counters make it visible when one family is consistently
+// losing or failing.
+//
+// The addresses of every successful lookup are remembered. When a later
+// lookup fails, for instance because the DNS servers are unreachable, the
+// remembered addresses are dialed instead until they are older than the
+// stale grace period, so a DNS outage does not take every target of a
+// pool down with it.
+//
+// Example usage:
+//
+//	d, err := dialer.New(cfg.UpstreamDial)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	transport.DialContext = d.DialContext
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+)
+
+// Address families
+const (
+	// IPv4 is the IPv4 address family
+	IPv4 = "ipv4"
+
+	// IPv6 is the IPv6 address family
+	IPv6 = "ipv6"
+)
+
+// Dialer dials TCP connections racing IPv6 and IPv4 addresses
+//
+// Thread safety: All methods are safe for concurrent use.
+type Dialer struct {
+	// dialer performs individual connection attempts to IP addresses
+	dialer net.Dialer
+
+	// resolver looks up A and AAAA records
+	resolver *net.Resolver
+
+	// fallbackDelay is the delay between staggered connection attempts
+	fallbackDelay time.Duration
+
+	// resolutionDelay is how long to wait for AAAA once A has answered
+	resolutionDelay time.Duration
+
+	// preferred is the family attempted first
+	preferred string
+
+	// v4 and v6 hold per-family dial counters
+	v4, v6 familyCounters
+
+	// staleGrace is how long remembered addresses stand in for failed
+	// lookups, 0 when they do not
+	staleGrace time.Duration
+
+	// mu guards resolved
+	mu sync.Mutex
+
+	// resolved holds the last successful lookup by host name and family
+	resolved map[resolvedKey]*resolvedAddrs
+
+	// fallbacks counts failed lookups answered with remembered addresses
+	fallbacks atomic.Int64
+}
+
+// resolvedKey identifies the lookup of one address family of a host name
+type resolvedKey struct {
+	host   string
+	family string
+}
+
+// resolvedAddrs is the answer of a successful lookup
+type resolvedAddrs struct {
+	// ips are the resolved addresses
+	ips []net.IP
+
+	// at is when they were resolved
+	at time.Time
+
+	// stale is set while lookups fail and ips are dialed instead
+	stale bool
+}
+
+// familyCounters holds the dial counters of one address family
+type familyCounters struct {
+	attempts  atomic.Int64
+	successes atomic.Int64
+	failures  atomic.Int64
+}
+
+// FamilyStats holds dial statistics for one address family
+type FamilyStats struct {
+	// Attempts is the number of connection attempts started
+	Attempts int64
+
+	// Successes is the number of connections used for requests
+	Successes int64
+
+	// Failures is the number of attempts that failed. Attempts abandoned
+	// because another attempt won are not counted as failures.
+	Failures int64
+}
+
+// Stats holds dial statistics by address family
+type Stats struct {
+	// IPv4 holds statistics for IPv4 connection attempts
+	IPv4 FamilyStats
+
+	// IPv6 holds statistics for IPv6 connection attempts
+	IPv6 FamilyStats
+
+	// StaleFallbacks is the number of failed lookups answered with the
+	// addresses of the last successful one
+	StaleFallbacks int64
+
+	// StaleHosts is the number of host names currently dialed with the
+	// addresses of their last successful lookup
+	StaleHosts int
+}
+
+// lookupResult is the answer to one address family lookup
+type lookupResult struct {
+	family string
+	ips    []net.IP
+	err    error
+}
+
+// dialResult is the outcome of one connection attempt
+type dialResult struct {
+	family string
+	conn   net.Conn
+	err    error
+}
+
+// New creates a dialer from configuration.
+//
+// Parameters:
+//
+//	cfg: Upstream dial settings
+//
+// Returns:
+//
+//	*Dialer: Dialer ready for use as http.Transport.DialContext
+//	error: Invalid configuration
+func New(cfg config.UpstreamDialConfig) (*Dialer, error) {
+	preferred := cfg.PreferredFamily
+	switch preferred {
+	case "":
+		preferred = IPv6
+	case IPv4, IPv6:
+	default:
+		return nil, fmt.Errorf("upstream_dial: unknown preferred_family %q", cfg.PreferredFamily)
+	}
+
+	if cfg.FallbackDelay < 0 || cfg.ResolutionDelay < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("upstream_dial: delays and timeout must not be negative")
+	}
+
+	fallbackDelay := cfg.FallbackDelay
+	if fallbackDelay == 0 {
+		fallbackDelay = 250 * time.Millisecond
+	}
+
+	staleGrace := cfg.StaleGrace
+	switch {
+	case staleGrace == 0:
+		staleGrace = 5 * time.Minute
+	case staleGrace < 0:
+		staleGrace = 0
+	}
+
+	return &Dialer{
+		dialer: net.Dialer{
+			Timeout:   cfg.Timeout,
+			KeepAlive: cfg.KeepAlive,
+		},
+		resolver:        net.DefaultResolver,
+		fallbackDelay:   fallbackDelay,
+		resolutionDelay: cfg.ResolutionDelay,
+		preferred:       preferred,
+		staleGrace:      staleGrace,
+		resolved:        make(map[resolvedKey]*resolvedAddrs),
+	}, nil
+}
+
+// Stats returns a snapshot of the per-family dial counters and of the
+// stale address fallbacks
+func (d *Dialer) Stats() Stats {
+	d.mu.Lock()
+	stale := make(map[string]bool)
+	for key, addrs := range d.resolved {
+		if addrs.stale {
+			stale[key.host] = true
+		}
+	}
+	d.mu.Unlock()
+
+	return Stats{
+		IPv4:           d.v4.snapshot(),
+		IPv6:           d.v6.snapshot(),
+		StaleFallbacks: d.fallbacks.Load(),
+		StaleHosts:     len(stale),
+	}
+}
+
+// DialContext connects to address on the named network.
+//
+// Host names on "tcp" are resolved and raced per RFC 8305. IP literals and
+// family-specific networks such as "tcp4" are dialed directly.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network != "tcp" || net.ParseIP(host) != nil {
+		return d.dialDirect(ctx, network, address, host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lookups := make(chan lookupResult, 2)
+	for _, family := range []string{IPv6, IPv4} {
+		go d.lookup(ctx, family, host, lookups)
+	}
+
+	var (
+		queue      = newAddrQueue(d.preferred)
+		results    = make(chan dialResult)
+		pending    = 2
+		inFlight   = 0
+		ready      = false
+		resolution <-chan time.Time
+		next       *time.Timer
+		nextC      <-chan time.Time
+		lastErr    error
+	)
+
+	defer func() {
+		if next != nil {
+			next.Stop()
+		}
+	}()
+
+	for {
+		if ready && nextC == nil && queue.len() > 0 {
+			family, ip := queue.pop()
+			inFlight++
+			go d.attempt(ctx, family, net.JoinHostPort(ip.String(), port), results)
+
+			next = time.NewTimer(d.fallbackDelay)
+			nextC = next.C
+		}
+
+		if pending == 0 && inFlight == 0 && queue.len() == 0 {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no addresses found for %s", host)
+			}
+
+			return nil, lastErr
+		}
+
+		select {
+		case res := <-lookups:
+			pending--
+			if res.err != nil {
+				lastErr = res.err
+			} else {
+				queue.push(res.family, res.ips)
+			}
+
+			if !ready {
+				if pending == 0 || (res.family == d.preferred && len(res.ips) > 0) {
+					ready = true
+				} else if resolution == nil {
+					resolution = time.After(d.resolutionDelay)
+				}
+			}
+
+		case <-resolution:
+			ready = true
+			resolution = nil
+
+		case <-nextC:
+			nextC = nil
+
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				d.counters(res.family).successes.Add(1)
+				return res.conn, nil
+			}
+
+			lastErr = res.err
+
+			// A failed attempt starts the next one without waiting
+			if next != nil {
+				next.Stop()
+			}
+			nextC = nil
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialDirect dials without racing and records the address family
+func (d *Dialer) dialDirect(ctx context.Context, network, address, host string) (net.Conn, error) {
+	family := IPv4
+	if ip := net.ParseIP(host); (ip != nil && ip.To4() == nil) || network == "tcp6" {
+		family = IPv6
+	}
+
+	counters := d.counters(family)
+	counters.attempts.Add(1)
+
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		counters.failures.Add(1)
+		return nil, err
+	}
+
+	counters.successes.Add(1)
+	return conn, nil
+}
+
+// lookup resolves one address family and delivers the answer
+func (d *Dialer) lookup(ctx context.Context, family, host string, out chan<- lookupResult) {
+	network := "ip4"
+	if family == IPv6 {
+		network = "ip6"
+	}
+
+	// A failed lookup only matters if the other family yields no
+	// connection either, in which case it is reported as the dial error
+	ips, err := d.resolver.LookupIP(ctx, network, host)
+	if err == nil {
+		d.remember(resolvedKey{host, family}, ips)
+	} else if stale, ok := d.stale(ctx, resolvedKey{host, family}, err); ok {
+		ips, err = stale, nil
+	}
+
+	out <- lookupResult{family: family, ips: ips, err: err}
+}
+
+// remember records the addresses of a successful lookup
+func (d *Dialer) remember(key resolvedKey, ips []net.IP) {
+	if d.staleGrace == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.resolved[key] = &resolvedAddrs{ips: ips, at: time.Now()}
+}
+
+// stale returns the remembered addresses standing in for a failed lookup.
+// Lookups canceled by the caller, names reported as nonexistent and
+// addresses older than the grace period get none.
+func (d *Dialer) stale(ctx context.Context, key resolvedKey, err error) ([]net.IP, bool) {
+	if d.staleGrace == 0 || ctx.Err() != nil {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addrs, ok := d.resolved[key]
+	if !ok {
+		return nil, false
+	}
+
+	var dnsErr *net.DNSError
+	if (errors.As(err, &dnsErr) && dnsErr.IsNotFound) || time.Since(addrs.at) > d.staleGrace {
+		delete(d.resolved, key)
+		return nil, false
+	}
+
+	addrs.stale = true
+	d.fallbacks.Add(1)
+	return addrs.ips, true
+}
+
+// attempt makes one connection attempt and delivers the outcome. A
+// connection established after another attempt has won is closed.
+func (d *Dialer) attempt(ctx context.Context, family, address string, out chan<- dialResult) {
+	counters := d.counters(family)
+	counters.attempts.Add(1)
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", address)
+	if err != nil && ctx.Err() == nil {
+		counters.failures.Add(1)
+	}
+
+	select {
+	case out <- dialResult{family: family, conn: conn, err: err}:
+	case <-ctx.Done():
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// counters returns the counters for family
+func (d *Dialer) counters(family string) *familyCounters {
+	if family == IPv6 {
+		return &d.v6
+	}
+
+	return &d.v4
+}
+
+// snapshot returns the current counter values
+func (c *familyCounters) snapshot() FamilyStats {
+	return FamilyStats{
+		Attempts:  c.attempts.Load(),
+		Successes: c.successes.Load(),
+		Failures:  c.failures.Load(),
+	}
+}
+
+// addrQueue hands out addresses alternating between families, starting
+// with the preferred one
+type addrQueue struct {
+	turn     string
+	byFamily map[string][]net.IP
+}
+
+// newAddrQueue creates an empty queue
+func newAddrQueue(preferred string) *addrQueue {
+	return &addrQueue{
+		turn:     preferred,
+		byFamily: make(map[string][]net.IP, 2),
+	}
+}
+
+// push adds the addresses of one family
+func (q *addrQueue) push(family string, ips []net.IP) {
+	q.byFamily[family] = append(q.byFamily[family], ips...)
+}
+
+// len returns the number of queued addresses
+func (q *addrQueue) len() int {
+	return len(q.byFamily[IPv4]) + len(q.byFamily[IPv6])
+}
+
+// pop returns the next address. It must only be called on a non-empty
+// queue.
+func (q *addrQueue) pop() (string, net.IP) {
+	family := q.turn
+	if len(q.byFamily[family]) == 0 {
+		family = other(family)
+	}
+
+	ip := q.byFamily[family][0]
+	q.byFamily[family] = q.byFamily[family][1:]
+	q.turn = other(family)
+
+	return family, ip
+}
+
+// other returns the opposite address family
+func other(family string) string {
+	if family == IPv6 {
+		return IPv4
+	}
+
+	return IPv6
+}
@@ -0,0 +1,197 @@
+// Package discovery resolves backend targets dynamically.
+//
+// A Provider returns the current set of targets from an external source
+// such as DNS or a file maintained by a deployment tool. The Watcher polls
+// the provider and reports changes, leaving it to the proxy to add new
+// targets and drain removed ones gracefully.
+//
+// Sources that rank their endpoints, such as DNS SRV records, report a
+// weight and a priority with every target. The proxy's load balancer
+// gives targets traffic in proportion to their weight and only sends
+// requests to the lowest priority with available targets, falling back
+// to the next priority when none are left.
+//
+// Example usage:
+//
+//	provider, err := discovery.NewProvider(cfg.Discovery)
+//	watcher := discovery.NewWatcher(provider, cfg.Discovery.RefreshInterval, log,
+//		func(targets []discovery.Target) { proxy.UpdateTargets(targets) })
+//	go watcher.Run(ctx)
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// Target is a discovered backend target
+type Target struct {
+	// URL is the target base URL
+	URL *url.URL
+
+	// Weight is the target's share of traffic relative to the other
+	// targets of its priority, at least 1
+	Weight int
+
+	// Priority ranks the target, lower first: targets only receive
+	// requests while no target of a lower priority is available
+	Priority int
+}
+
+// String returns the target URL, followed by its weight and priority when
+// they differ from the defaults
+func (t Target) String() string {
+	s := t.URL.String()
+	if t.Weight > 1 {
+		s += " weight=" + strconv.Itoa(t.Weight)
+	}
+	if t.Priority != 0 {
+		s += " priority=" + strconv.Itoa(t.Priority)
+	}
+
+	return s
+}
+
+// Provider resolves the current set of targets
+type Provider interface {
+	// Name identifies the provider in logs
+	Name() string
+
+	// Resolve returns the targets currently registered with the source
+	Resolve(ctx context.Context) ([]Target, error)
+}
+
+// NewProvider creates the provider selected in configuration
+func NewProvider(cfg config.DiscoveryConfig) (Provider, error) {
+	switch cfg.Provider {
+	case "dns":
+		return newDNSProvider(cfg.DNS)
+
+	case "file":
+		return newFileProvider(cfg.File)
+
+	default:
+		return nil, fmt.Errorf("unknown discovery provider %q", cfg.Provider)
+	}
+}
+
+// Watcher periodically resolves a provider and reports target set changes
+type Watcher struct {
+	// provider is the discovery source
+	provider Provider
+
+	// interval is the time between resolutions
+	interval time.Duration
+
+	// onChange receives the new target set when it differs from the last
+	onChange func([]Target)
+
+	// mu serializes refreshes between Run and on-demand callers
+	mu sync.Mutex
+
+	// last is the sorted string form of the last reported set
+	last []string
+
+	// logger for resolution failures and changes
+	logger *logger.Logger
+}
+
+// NewWatcher creates a watcher. onChange is called from the watcher's
+// goroutine whenever the resolved target set changes.
+func NewWatcher(provider Provider, interval time.Duration, log *logger.Logger,
+	onChange func([]Target)) *Watcher {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &Watcher{
+		provider: provider,
+		interval: interval,
+		onChange: onChange,
+		logger:   log,
+	}
+}
+
+// Refresh resolves the provider once and reports a change if the target
+// set, weights and priorities included, differs from the previous
+// resolution.
+//
+// Resolution failures keep the previous target set in place rather than
+// emptying the pool. Refresh may be called while Run is active to force an
+// immediate resolution.
+func (w *Watcher) Refresh(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	targets, err := w.provider.Resolve(ctx)
+	if err != nil {
+		w.logger.Warn("Discovery resolution failed", "provider", w.provider.Name(), "error", err)
+		return err
+	}
+
+	current := make([]string, len(targets))
+	for i, target := range targets {
+		current[i] = target.String()
+	}
+	sort.Strings(current)
+
+	if equal(current, w.last) {
+		return nil
+	}
+
+	w.logger.Info("Discovery targets changed",
+		"provider", w.provider.Name(),
+		"targets", current,
+	)
+
+	w.last = current
+	w.onChange(targets)
+	return nil
+}
+
+// Targets returns the target set of the last successful resolution
+func (w *Watcher) Targets() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]string(nil), w.last...)
+}
+
+// Run refreshes at the configured interval until ctx is canceled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.Refresh(ctx)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// equal reports whether two sorted string slices are identical
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
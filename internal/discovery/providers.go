@@ -0,0 +1,182 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"velocity/internal/config"
+)
+
+// dnsProvider resolves a hostname into one target per address, or an SRV
+// name into one target per record
+type dnsProvider struct {
+	// cfg holds the name, port, scheme and record type
+	cfg config.DNSDiscoveryConfig
+
+	// resolver performs the lookups
+	resolver *net.Resolver
+}
+
+// newDNSProvider validates configuration and creates a DNS provider
+func newDNSProvider(cfg config.DNSDiscoveryConfig) (*dnsProvider, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("dns discovery requires name")
+	}
+
+	// SRV records carry their own ports
+	if !cfg.SRV && (cfg.Port <= 0 || cfg.Port > 65535) {
+		return nil, fmt.Errorf("dns discovery port %d out of range", cfg.Port)
+	}
+
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+
+	return &dnsProvider{cfg: cfg, resolver: net.DefaultResolver}, nil
+}
+
+// Name implements Provider
+func (p *dnsProvider) Name() string {
+	return "dns:" + p.cfg.Name
+}
+
+// Resolve implements Provider
+func (p *dnsProvider) Resolve(ctx context.Context) ([]Target, error) {
+	if p.cfg.SRV {
+		return p.resolveSRV(ctx)
+	}
+
+	addrs, err := p.resolver.LookupHost(ctx, p.cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(addrs)
+	port := strconv.Itoa(p.cfg.Port)
+
+	targets := make([]Target, 0, len(addrs))
+	for _, addr := range addrs {
+		targets = append(targets, Target{
+			URL: &url.URL{
+				Scheme: p.cfg.Scheme,
+				Host:   net.JoinHostPort(addr, port),
+			},
+			Weight: 1,
+		})
+	}
+
+	return targets, nil
+}
+
+// resolveSRV returns one target per SRV record, carrying the record's
+// weight and priority. A weight of 0 is raised to 1: RFC 2782 gives such
+// records a very small chance of selection rather than none.
+func (p *dnsProvider) resolveSRV(ctx context.Context) ([]Target, error) {
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(records))
+	for _, record := range records {
+		// A single "." target means the service is decidedly not available
+		host := strings.TrimSuffix(record.Target, ".")
+		if host == "" {
+			continue
+		}
+
+		targets = append(targets, Target{
+			URL: &url.URL{
+				Scheme: p.cfg.Scheme,
+				Host:   net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+			},
+			Weight:   max(int(record.Weight), 1),
+			Priority: int(record.Priority),
+		})
+	}
+
+	// LookupSRV randomizes records of equal priority by weight; the
+	// watcher compares ordered sets
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].URL.String() < targets[j].URL.String()
+	})
+
+	return targets, nil
+}
+
+// fileProvider reads target URLs from a file, one per line
+type fileProvider struct {
+	// path is the file location
+	path string
+}
+
+// newFileProvider validates configuration and creates a file provider
+func newFileProvider(cfg config.FileDiscoveryConfig) (*fileProvider, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file discovery requires path")
+	}
+
+	return &fileProvider{path: cfg.Path}, nil
+}
+
+// Name implements Provider
+func (p *fileProvider) Name() string {
+	return "file:" + p.path
+}
+
+// Resolve implements Provider. Blank lines and lines starting with "#"
+// are ignored. A target URL may be followed by its weight and priority:
+//
+//	http://10.0.0.1:8080 weight=3
+//	http://10.0.0.2:8080
+//	http://10.1.0.1:8080 priority=1
+func (p *fileProvider) Resolve(context.Context) ([]Target, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []Target
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		u, err := url.Parse(fields[0])
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid target %q in %s", fields[0], p.path)
+		}
+
+		target := Target{URL: u, Weight: 1}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, err := strconv.Atoi(value)
+
+			switch {
+			case key == "weight" && err == nil && n >= 1:
+				target.Weight = n
+			case key == "priority" && err == nil && n >= 0:
+				target.Priority = n
+			default:
+				return nil, fmt.Errorf("invalid option %q for target %s in %s, expected weight=N or priority=N", field, fields[0], p.path)
+			}
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets, scanner.Err()
+}
@@ -0,0 +1,406 @@
+// Package egress tunnels upstream connections through a forward proxy.
+//
+// Some targets are only reachable through a corporate proxy. The Dialer
+// connects to the proxy instead of the target and asks it to open a tunnel,
+// either with HTTP CONNECT (RFC 9110 section 9.3.6) or SOCKS5 (RFC 1928,
+// with RFC 1929 username/password authentication). The tunnel is handed to
+// the transport like a direct connection, so TLS to the target and HTTP/2
+// are negotiated end to end and the proxy only sees the target's address.
+//
+// Target names are sent to the proxy unresolved: the proxy's resolver is
+// the one that knows the hosts behind it.
+//
+// Example usage:
+//
+//	d, err := egress.New(cfg.EgressProxy, upstreamDialer.DialContext)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	transport.DialContext = d.DialContext
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+)
+
+// DialFunc establishes a connection, with the signature of
+// http.Transport.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dialer opens connections to targets through the egress proxy
+//
+// Thread safety: All methods are safe for concurrent use.
+type Dialer struct {
+	// direct connects to the proxy and to the hosts in noProxy
+	direct DialFunc
+
+	// proxy is the parsed proxy URL
+	proxy *url.URL
+
+	// address is the proxy's host:port
+	address string
+
+	// username and password authenticate to the proxy. password may be a
+	// secret reference resolved through store.
+	username, password string
+
+	// store resolves the password
+	store *secrets.Store
+
+	// noProxy lists hosts dialed directly, lower case. Entries starting
+	// with a dot match subdomains.
+	noProxy []string
+}
+
+// New validates the configuration and returns a dialer tunneling through
+// the proxy, using direct to reach it. Returns nil when no proxy is
+// configured.
+func New(cfg config.EgressProxyConfig, direct DialFunc) (*Dialer, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+
+	proxy, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("egress_proxy: invalid url: %w", err)
+	}
+
+	var defaultPort string
+	switch proxy.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	case "socks5":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("egress_proxy: unsupported scheme %q, expected http, https or socks5", proxy.Scheme)
+	}
+
+	if proxy.Hostname() == "" {
+		return nil, errors.New("egress_proxy: url has no host")
+	}
+
+	port := proxy.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	d := &Dialer{
+		direct:   direct,
+		proxy:    proxy,
+		address:  net.JoinHostPort(proxy.Hostname(), port),
+		username: cfg.Username,
+		password: cfg.Password,
+		store:    secrets.NewStore(time.Minute),
+	}
+
+	// Credentials in the URL apply unless given separately
+	if proxy.User != nil {
+		if d.username == "" {
+			d.username = proxy.User.Username()
+		}
+
+		if password, ok := proxy.User.Password(); ok && d.password == "" {
+			d.password = password
+		}
+	}
+
+	if proxy.Scheme == "socks5" && (len(d.username) > 255 || len(d.password) > 255) {
+		return nil, errors.New("egress_proxy: SOCKS5 username and password are limited to 255 bytes")
+	}
+
+	for _, host := range cfg.NoProxy {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			d.noProxy = append(d.noProxy, host)
+		}
+	}
+
+	return d, nil
+}
+
+// Proxy returns the proxy URL without credentials
+func (d *Dialer) Proxy() string {
+	redacted := *d.proxy
+	redacted.User = nil
+	return redacted.String()
+}
+
+// DialContext connects to address through the proxy, or directly when the
+// host is listed in no_proxy
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.bypass(host) {
+		return d.direct(ctx, network, address)
+	}
+
+	conn, err := d.direct(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy %s unreachable: %w", d.address, err)
+	}
+
+	// Bound the handshake by the dial's deadline and cancellation
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tunnel, err := d.handshake(ctx, conn, address)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy %s: %w", d.address, err)
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// handshake opens the tunnel to address over a connection to the proxy
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	password, err := d.store.Get(d.password)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d.proxy.Scheme {
+	case "socks5":
+		return conn, d.socks5(conn, address, password)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return d.connect(conn, address, password)
+}
+
+// connect asks an HTTP proxy to tunnel to address
+func (d *Dialer) connect(conn net.Conn, address, password string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if d.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s refused: %s", address, resp.Status)
+	}
+
+	// Bytes the target sent right after the response are already buffered
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// SOCKS5 protocol constants
+const (
+	socksVersion        = 5
+	socksAuthNone       = 0
+	socksAuthPassword   = 2
+	socksAuthNoAccept   = 0xff
+	socksCommandConnect = 1
+	socksAddressIPv4    = 1
+	socksAddressDomain  = 3
+	socksAddressIPv6    = 4
+)
+
+// socksReplies describes SOCKS5 reply codes
+var socksReplies = [...]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5 negotiates authentication and asks a SOCKS5 proxy to connect to
+// address
+func (d *Dialer) socks5(conn net.Conn, address, password string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portText)
+	}
+
+	method := byte(socksAuthNone)
+	if d.username != "" {
+		method = socksAuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case method:
+	case socksAuthNoAccept:
+		return errors.New("SOCKS5 proxy accepted no authentication method")
+	default:
+		return fmt.Errorf("SOCKS5 proxy selected unoffered method %d", reply[1])
+	}
+
+	if method == socksAuthPassword {
+		auth := []byte{1, byte(len(d.username))}
+		auth = append(auth, d.username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksCommandConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long for SOCKS5", host)
+		}
+		req = append(req, socksAddressDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddressIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddressIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Version, reply, reserved, address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0 {
+		reason := "unknown error"
+		if int(header[1]) < len(socksReplies) {
+			reason = socksReplies[header[1]]
+		}
+		return fmt.Errorf("SOCKS5 connect to %s failed: %s", address, reason)
+	}
+
+	// Skip the bound address and port
+	var skip int
+	switch header[3] {
+	case socksAddressIPv4:
+		skip = net.IPv4len + 2
+	case socksAddressIPv6:
+		skip = net.IPv6len + 2
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// bypass reports whether host is listed in no_proxy
+func (d *Dialer) bypass(host string) bool {
+	host = strings.ToLower(host)
+
+	for _, entry := range d.noProxy {
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bufferedConn is a connection whose first bytes were read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read drains the buffered bytes before reading from the connection
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
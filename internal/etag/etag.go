@@ -0,0 +1,308 @@
+// Package etag generates entity tags for upstream responses that carry no
+// validator.
+//
+// Conditional requests only save bandwidth when the response has a
+// validator, and many backends never send one. For routes with ETag
+// generation enabled, successful GET responses without an ETag or
+// Last-Modified header are held back, hashed and sent with an ETag
+// derived from the body. A client presenting that tag in If-None-Match
+// receives 304 Not Modified without the body.
+//
+// Responses larger than the configured limit, or that do not fit the
+// memory budget, are passed through untagged as soon as that is known.
+// Event streams are never held back. Flushes of other responses are
+// deferred until the body is complete or over the limit, since the
+// reverse proxy flushes every chunk of a response without Content-Length.
+//
+// Example usage:
+//
+//	tagger, err := etag.New(rc.Name, rc.ETag)
+//	handler = middleware.Chain(handler, tagger.Middleware())
+package etag
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+)
+
+// defaultMaxBodyBytes is the largest response hashed unless configured
+const defaultMaxBodyBytes = 1 << 20
+
+// Tagger adds generated ETags to the responses of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Tagger struct {
+	// route is the name of the tagged route
+	route string
+
+	// weak marks generated tags as weak
+	weak bool
+
+	// maxBody is the largest body hashed
+	maxBody int64
+
+	// tagged, notModified and skipped count eligible responses by outcome
+	tagged, notModified, skipped atomic.Int64
+}
+
+// Stats is a snapshot of a tagger
+type Stats struct {
+	// Tagged counts full responses sent with a generated ETag
+	Tagged int64
+
+	// NotModified counts 304 responses to matching If-None-Match requests
+	NotModified int64
+
+	// Skipped counts eligible responses passed through untagged because
+	// they were too large
+	Skipped int64
+}
+
+// New creates the tagger of a route, or returns nil when ETag generation
+// is disabled
+func New(route string, cfg config.ETagConfig) (*Tagger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("etag: max_body_bytes must not be negative")
+	}
+
+	t := &Tagger{route: route, weak: cfg.Weak, maxBody: cfg.MaxBodyBytes}
+	if t.maxBody == 0 {
+		t.maxBody = defaultMaxBodyBytes
+	}
+
+	return t, nil
+}
+
+// Route returns the name of the tagged route
+func (t *Tagger) Route() string {
+	return t.route
+}
+
+// Stats returns the tagger's current statistics
+func (t *Tagger) Stats() Stats {
+	return Stats{
+		Tagged:      t.tagged.Load(),
+		NotModified: t.notModified.Load(),
+		Skipped:     t.skipped.Load(),
+	}
+}
+
+// Middleware returns a middleware tagging eligible responses and answering
+// matching conditional requests with 304. Returns nil when t is nil.
+func (t *Tagger) Middleware() middleware.Middleware {
+	if t == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hw := &holdingWriter{ResponseWriter: w, tagger: t, budget: membudget.FromContext(r.Context())}
+			defer hw.release()
+
+			next.ServeHTTP(hw, r)
+
+			if hw.holding {
+				hw.finish(r.Header.Get("If-None-Match"))
+			}
+		})
+	}
+}
+
+// eligible reports whether a response may be tagged: a success without
+// validators of its own that may be stored at all and is not an event
+// stream
+func eligible(status int, header http.Header) bool {
+	if status != http.StatusOK || header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+		return false
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		if strings.TrimSpace(directive) == "no-store" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tag returns the entity tag of a body
+func (t *Tagger) tag(body []byte) string {
+	sum := sha256.Sum256(body)
+	opaque := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	if t.weak {
+		return "W/" + opaque
+	}
+
+	return opaque
+}
+
+// matches reports whether an If-None-Match header value matches tag.
+// If-None-Match uses the weak comparison, so W/ prefixes are ignored.
+func matches(ifNoneMatch, tag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// holdingWriter holds back an eligible response until its body is
+// complete, and passes every other response through
+type holdingWriter struct {
+	http.ResponseWriter
+
+	// tagger hashes the body and counts outcomes
+	tagger *Tagger
+
+	// budget is charged for the held body
+	budget *membudget.Budget
+
+	// wroteHeader reports whether the final status was decided
+	wroteHeader bool
+
+	// holding reports whether the response is being held back
+	holding bool
+
+	// body is the held response body
+	body bytes.Buffer
+
+	// reserved is the budget held for body
+	reserved int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (h *holdingWriter) WriteHeader(status int) {
+	if status < http.StatusOK || h.wroteHeader {
+		h.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	h.wroteHeader = true
+	if eligible(status, h.Header()) {
+		h.holding = true
+		return
+	}
+
+	h.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (h *holdingWriter) Write(b []byte) (int, error) {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+
+	if !h.holding {
+		return h.ResponseWriter.Write(b)
+	}
+
+	size := int64(len(b))
+	if int64(h.body.Len())+size > h.tagger.maxBody || !h.budget.Reserve(size) {
+		if err := h.passThrough(); err != nil {
+			return 0, err
+		}
+
+		return h.ResponseWriter.Write(b)
+	}
+
+	h.reserved += size
+	return h.body.Write(b)
+}
+
+// Flush implements http.Flusher. Flushing a held response does nothing
+// until it is complete or passed through.
+func (h *holdingWriter) Flush() {
+	if h.holding {
+		return
+	}
+
+	if flusher, ok := h.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (h *holdingWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// passThrough stops holding the response and sends what was held so far
+func (h *holdingWriter) passThrough() error {
+	h.holding = false
+	h.tagger.skipped.Add(1)
+
+	h.ResponseWriter.WriteHeader(http.StatusOK)
+	_, err := h.ResponseWriter.Write(h.body.Bytes())
+
+	h.body = bytes.Buffer{}
+	h.release()
+	return err
+}
+
+// finish tags the complete held response, then sends it or a 304 when the
+// client already has it
+func (h *holdingWriter) finish(ifNoneMatch string) {
+	h.holding = false
+
+	// A body shorter than announced was cut off and is not tagged
+	if !middleware.CompleteBody(h.Header(), h.body.Len()) {
+		h.ResponseWriter.WriteHeader(http.StatusOK)
+		h.ResponseWriter.Write(h.body.Bytes())
+		return
+	}
+
+	tag := h.tagger.tag(h.body.Bytes())
+	h.Header().Set("ETag", tag)
+
+	if matches(ifNoneMatch, tag) {
+		h.tagger.notModified.Add(1)
+		h.Header().Del("Content-Length")
+		h.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.tagger.tagged.Add(1)
+	h.ResponseWriter.WriteHeader(http.StatusOK)
+	h.ResponseWriter.Write(h.body.Bytes())
+}
+
+// release returns the held body's memory to the budget
+func (h *holdingWriter) release() {
+	h.budget.Release(h.reserved)
+	h.reserved = 0
+}
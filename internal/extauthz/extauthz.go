@@ -0,0 +1,323 @@
+// Package extauthz delegates authorization decisions to an external HTTP
+// service.
+//
+// Authorization rules that depend on data the gateway does not hold, such
+// as an entitlement database or a session store, belong in a dedicated
+// service. Before a request is forwarded, the gateway describes it to the
+// service in a bodiless GET request; a 2xx answer allows it, optionally
+// adding headers for the upstream, and a 3xx or 4xx answer is passed to
+// the client instead. When the service fails, requests are either let
+// through or answered 503, depending on the configuration.
+//
+// Only HTTP services are supported; gRPC authorization services need an
+// HTTP adapter in front of them.
+//
+// Example usage:
+//
+//	authz, err := extauthz.New(cfg.ExtAuthz, log)
+//	handler = middleware.Chain(handler, authz.Middleware())
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+	"velocity/internal/router"
+	"velocity/internal/secrets"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset configuration
+const defaultTimeout = time.Second
+
+// maxDenialBody caps the body of a denying answer passed to the client
+const maxDenialBody = 64 << 10
+
+// Headers describing the original request to the service
+const (
+	HeaderMethod = "X-Forwarded-Method"
+	HeaderProto  = "X-Forwarded-Proto"
+	HeaderHost   = "X-Forwarded-Host"
+	HeaderURI    = "X-Forwarded-Uri"
+	HeaderFor    = "X-Forwarded-For"
+	HeaderRoute  = "X-Velocity-Route"
+)
+
+var (
+	defaultRequestHeaders = []string{"Authorization", "Cookie"}
+	defaultClientHeaders  = []string{"WWW-Authenticate", "Location", "Set-Cookie", "Content-Type"}
+)
+
+// Authorizer checks requests against the authorization service
+//
+// Thread safety: All methods are safe for concurrent use.
+type Authorizer struct {
+	// url is the address of the authorization service
+	url string
+
+	// timeout bounds each check
+	timeout time.Duration
+
+	// failOpen lets requests through when the service fails
+	failOpen bool
+
+	// requestHeaders are the canonical names of the client headers sent to
+	// the service
+	requestHeaders []string
+
+	// upstreamHeaders are the canonical names of the headers copied from an
+	// allowing answer to the upstream request
+	upstreamHeaders []string
+
+	// clientHeaders are the canonical names of the headers copied from a
+	// denying answer to the client
+	clientHeaders []string
+
+	// static holds the configured headers sent with every check
+	static http.Header
+
+	// client sends the checks
+	client *http.Client
+
+	// allowed, denied and failed count the checks by outcome
+	allowed, denied, failed atomic.Int64
+
+	// logger for service failures
+	logger *logger.Logger
+}
+
+// Stats holds the authorizer's counters
+type Stats struct {
+	// Allowed is the number of requests the service allowed
+	Allowed int64
+
+	// Denied is the number of requests the service denied
+	Denied int64
+
+	// Failed is the number of checks that failed or timed out, whether
+	// the request was then let through or not
+	Failed int64
+}
+
+// New creates an authorizer, or returns nil when the check is disabled.
+//
+// Returns an error for a missing or invalid URL, a negative timeout or a
+// header secret that cannot be resolved.
+func New(cfg config.ExtAuthzConfig, log *logger.Logger) (*Authorizer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ext_authz: url must be an absolute http or https URL, got %q", cfg.URL)
+	}
+
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("ext_authz: timeout must not be negative")
+	}
+
+	a := &Authorizer{
+		url:             cfg.URL,
+		timeout:         cfg.Timeout,
+		failOpen:        cfg.FailOpen,
+		requestHeaders:  canonical(cfg.RequestHeaders, defaultRequestHeaders),
+		upstreamHeaders: canonical(cfg.UpstreamHeaders, nil),
+		clientHeaders:   canonical(cfg.ClientHeaders, defaultClientHeaders),
+		static:          make(http.Header),
+		logger:          log.Component("ext_authz"),
+	}
+
+	if a.timeout == 0 {
+		a.timeout = defaultTimeout
+	}
+
+	store := secrets.NewStore(0)
+	for _, h := range cfg.Headers {
+		value, err := store.Get(h.Value)
+		if err != nil {
+			return nil, fmt.Errorf("ext_authz: header %s: %w", h.Name, err)
+		}
+
+		a.static.Add(h.Name, value)
+	}
+
+	// Redirects are answers for the client, not for the gateway to follow
+	a.client = &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return a, nil
+}
+
+// canonical returns the canonical form of names, or fallback when there
+// are none
+func canonical(names, fallback []string) []string {
+	if len(names) == 0 {
+		names = fallback
+	}
+
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = http.CanonicalHeaderKey(name)
+	}
+
+	return out
+}
+
+// Stats returns the authorizer's counters
+func (a *Authorizer) Stats() Stats {
+	return Stats{
+		Allowed: a.allowed.Load(),
+		Denied:  a.denied.Load(),
+		Failed:  a.failed.Load(),
+	}
+}
+
+// Middleware returns a middleware checking every request with the
+// authorization service. Returns nil when a is nil.
+func (a *Authorizer) Middleware() middleware.Middleware {
+	if a == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Clients must not choose the headers the service vouches for
+			for _, name := range a.upstreamHeaders {
+				r.Header.Del(name)
+			}
+
+			resp, err := a.check(r)
+			if err != nil {
+				if r.Context().Err() != nil {
+					// The client left, nobody is waiting for an answer
+					return
+				}
+
+				a.failed.Add(1)
+				a.logger.Warn("Authorization check failed", "method", r.Method, "path", r.URL.Path, "error", err, "fail_open", a.failOpen)
+
+				if a.failOpen {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				gwerrors.New(gwerrors.CodeAuthzUnavailable, "Authorization service unavailable").WriteJSON(w)
+				return
+			}
+
+			if resp.StatusCode < http.StatusMultipleChoices {
+				// Release the connection before the upstream call
+				io.Copy(io.Discard, io.LimitReader(resp.Body, maxDenialBody))
+				resp.Body.Close()
+
+				a.allowed.Add(1)
+				for _, name := range a.upstreamHeaders {
+					if values := resp.Header.Values(name); len(values) > 0 {
+						r.Header[name] = values
+					}
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			a.denied.Add(1)
+			a.deny(w, r, resp)
+			resp.Body.Close()
+		})
+	}
+}
+
+// check sends the authorization request for r. A status of 500 or above is
+// returned as an error.
+func (a *Authorizer) check(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	req.Header = a.static.Clone()
+	for _, name := range a.requestHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Header[name] = values
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	req.Header.Set(HeaderMethod, r.Method)
+	req.Header.Set(HeaderProto, proto)
+	req.Header.Set(HeaderHost, r.Host)
+	req.Header.Set(HeaderURI, r.URL.RequestURI())
+	req.Header.Set(HeaderFor, ratelimit.ClientIP(r))
+	if route, ok := router.RouteFromContext(r.Context()); ok {
+		req.Header.Set(HeaderRoute, route.Config.Name)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("authorization service answered %d", resp.StatusCode)
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// deny passes a denying answer to the client
+func (a *Authorizer) deny(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDenialBody))
+	if err != nil {
+		a.logger.Warn("Reading authorization denial failed", "error", err)
+		body = nil
+	}
+
+	for _, name := range a.clientHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			w.Header()[name] = values
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// cancelBody releases the check's context once the answer is closed
+type cancelBody struct {
+	io.ReadCloser
+
+	// cancel releases the context
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
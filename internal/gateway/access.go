@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+)
+
+// endpointAccess restricts who may call a built-in endpoint
+type endpointAccess struct {
+	// allow are the permitted client networks, empty for any client
+	allow []netip.Prefix
+
+	// token is the secret reference of the required Bearer token, empty
+	// when none is required
+	token string
+
+	// secrets resolves token
+	secrets *secrets.Store
+}
+
+// endpointAccessRules parses the access rules of the built-in endpoints
+// by endpoint name
+func endpointAccessRules(cfg config.EndpointsConfig) (map[string]*endpointAccess, error) {
+	store := secrets.NewStore(time.Minute)
+	rules := make(map[string]*endpointAccess, 5)
+
+	for name, endpoint := range map[string]config.EndpointAccessConfig{
+		"health":   cfg.Health,
+		"targets":  cfg.Targets,
+		"stats":    cfg.Stats,
+		"metrics":  cfg.Metrics,
+		"capacity": cfg.Capacity,
+	} {
+		access, err := newEndpointAccess(name, endpoint, store)
+		if err != nil {
+			return nil, err
+		}
+
+		rules[name] = access
+	}
+
+	return rules, nil
+}
+
+// newEndpointAccess parses the access configuration of an endpoint
+func newEndpointAccess(name string, cfg config.EndpointAccessConfig, store *secrets.Store) (*endpointAccess, error) {
+	access := &endpointAccess{token: cfg.Token, secrets: store}
+
+	for _, cidr := range cfg.Allow {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("endpoints: %s: invalid allow entry: %w", name, err)
+		}
+
+		access.allow = append(access.allow, prefix.Masked())
+	}
+
+	return access, nil
+}
+
+// wrap returns handler guarded by the access rules. A nil access leaves
+// the handler unrestricted.
+func (a *endpointAccess) wrap(handler http.HandlerFunc) http.Handler {
+	if a == nil || (len(a.allow) == 0 && a.token == "") {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="velocity"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// allowed reports whether the client address is in an allowed network
+func (a *endpointAccess) allowed(r *http.Request) bool {
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range a.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized reports whether the request carries the required token. A
+// token that cannot be resolved denies every request.
+func (a *endpointAccess) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+
+	want, err := a.secrets.Get(a.token)
+	if err != nil || want == "" {
+		return false
+	}
+
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(presented), []byte(want)) == 1
+}
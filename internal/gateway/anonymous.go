@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"net/http"
+
+	"velocity/internal/auth"
+	"velocity/internal/middleware"
+	"velocity/internal/router"
+)
+
+// anonymousTier returns a middleware applying the anonymous rate limit to
+// unauthenticated requests on the route's anonymous paths and the route's
+// own limit to every other request. Either limit may be nil; without an
+// anonymous limit every request shares the route's.
+func anonymousTier(authenticated, anonymous middleware.Middleware) middleware.Middleware {
+	if anonymous == nil {
+		return authenticated
+	}
+
+	return func(next http.Handler) http.Handler {
+		limited, open := middleware.Chain(next, authenticated), anonymous(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isAnonymous(r) {
+				open.ServeHTTP(w, r)
+				return
+			}
+
+			limited.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isAnonymous reports whether the request reached an anonymous path of its
+// route without authenticating
+func isAnonymous(r *http.Request) bool {
+	if _, ok := auth.ClaimsFromContext(r.Context()); ok {
+		return false
+	}
+
+	route, ok := router.RouteFromContext(r.Context())
+	return ok && route.Anonymous(r.URL.Path)
+}
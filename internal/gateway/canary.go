@@ -0,0 +1,37 @@
+package gateway
+
+import (
+	"fmt"
+
+	"velocity/internal/canary"
+	"velocity/internal/config"
+	"velocity/internal/proxy"
+)
+
+// buildCanary creates the traffic splitter of a route and the proxy of its
+// canary pool, or returns nil when the route has no canary. The canary
+// proxy inherits the upstream settings of the gateway but uses only the
+// canary targets and never discovery.
+func (g *Gateway) buildCanary(rc config.RouteConfig) (*canary.Splitter, error) {
+	if len(rc.Canary.Targets) == 0 {
+		return nil, nil
+	}
+
+	canaryCfg := *g.Config
+	canaryCfg.Targets = rc.Canary.Targets
+	canaryCfg.Discovery.Enabled = false
+
+	canaryProxy, err := proxy.New(&canaryCfg, g.logger.With("canary", rc.Name))
+	if err != nil {
+		return nil, fmt.Errorf("canary: failed to create proxy: %w", err)
+	}
+	g.canaryProxies = append(g.canaryProxies, canaryProxy)
+
+	split, err := canary.New(rc.Name, rc.Canary, canaryProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	g.Canaries = append(g.Canaries, split)
+	return split, nil
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"net/http"
+
+	"velocity/internal/config"
+	"velocity/internal/ratelimit"
+)
+
+// credentialHeaders returns the configured request headers that carry
+// credentials: those injected by upstream_auth and those that identify
+// API consumers in key expressions, such as "header.X-Partner-Key"
+func credentialHeaders(cfg *config.Config) []string {
+	routes := append([]config.RouteConfig(nil), cfg.Routes...)
+	keys := []string{cfg.RateLimit.Key, cfg.IPBinding.Consumer, cfg.LoadShedding.ConsumerKey}
+
+	for _, tc := range cfg.Tenants {
+		routes = append(routes, tc.Routes...)
+		keys = append(keys, tc.RateLimit.Key)
+	}
+
+	var names []string
+	for _, rc := range routes {
+		if rc.UpstreamAuth.Type == "header" {
+			names = append(names, rc.UpstreamAuth.Header)
+		}
+
+		names = append(names, rc.Dedup.CredentialHeaders...)
+		keys = append(keys, rc.RateLimit.Key, rc.Anonymous.RateLimit.Key, rc.Cost.Consumer, rc.Cache.ConsumerKey, rc.Dedup.Key)
+	}
+
+	for _, key := range keys {
+		names = append(names, ratelimit.KeyHeaders(key)...)
+	}
+
+	seen := make(map[string]bool, len(names))
+	unique := names[:0]
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"slices"
+	"testing"
+
+	"velocity/internal/config"
+)
+
+func TestCredentialHeaders(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{Key: "header.x-partner-key + route"},
+		Routes: []config.RouteConfig{{
+			Name:         "api",
+			UpstreamAuth: config.UpstreamAuthConfig{Type: "header", Header: "X-Upstream-Token", Value: "env:TOKEN"},
+			Cost:         config.CostConfig{Consumer: "header.X-Partner-Key"},
+		}},
+		Tenants: []config.TenantConfig{{
+			Name:      "alpha",
+			RateLimit: config.RateLimitConfig{Key: "header.X-Alpha-Key"},
+		}},
+	}
+
+	got := credentialHeaders(cfg)
+	want := []string{"X-Upstream-Token", "X-Partner-Key", "X-Alpha-Key"}
+	for _, name := range want {
+		if !slices.Contains(got, name) {
+			t.Errorf("credentialHeaders() = %v, missing %s", got, name)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("credentialHeaders() = %v, want exactly %v", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"velocity/internal/gslb"
+	"velocity/internal/shedding"
+)
+
+// builtinEndpoints mounts /health, /targets, /stats, /metrics and, when
+// GSLB reporting is enabled, /capacity in front of the proxied handler,
+// each guarded by its access rules if any
+func (g *Gateway) builtinEndpoints(proxied http.Handler, access map[string]*endpointAccess) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/health", access["health"].wrap(g.handleHealth))
+	mux.Handle("/targets", access["targets"].wrap(g.handleTargets))
+	mux.Handle("/stats", access["stats"].wrap(g.handleStats))
+	mux.Handle("/metrics", access["metrics"].wrap(g.handleMetrics))
+	if g.GSLB != nil {
+		mux.Handle("/capacity", access["capacity"].wrap(g.GSLB.ServeHTTP))
+	}
+	mux.Handle("/", proxied)
+
+	return mux
+}
+
+// Endpoints returns a handler serving only the built-in endpoints, for the
+// priority lane listener. Other paths are answered with 404 rather than
+// proxied, so the lane never waits on upstreams.
+func (g *Gateway) Endpoints() http.Handler {
+	return g.endpoints
+}
+
+// handleHealth reports gateway liveness and the running configuration, so
+// instances serving a stale configuration stand out
+func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":"ok","service":"velocity-gateway","config_hash":"%s","config_loaded_at":"%s"}`,
+		g.Config.Hash, g.Created.UTC().Format(time.RFC3339))
+}
+
+// handleTargets lists the configured targets
+func (g *Gateway) handleTargets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"targets":[`)
+
+	for i, target := range g.Config.Targets {
+		if i > 0 {
+			fmt.Fprintf(w, `,`)
+		}
+
+		fmt.Fprintf(w, `{"url":"%s","enabled":%t}`, target.URL, target.Enabled)
+	}
+
+	fmt.Fprintf(w, `]}`)
+}
+
+// handleStats reports per-target, dial, memory and QoS statistics. Target
+// latencies are broken out by phase and status class as count and mean;
+// /metrics has their full distribution.
+func (g *Gateway) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := g.Proxy.GetStats()
+	fmt.Fprintf(w, `{"stats":[`)
+
+	for i, stat := range stats {
+		if i > 0 {
+			fmt.Fprintf(w, `,`)
+		}
+
+		fmt.Fprintf(w, `{"target":"%s","protocol":"%s","requests":%d,"successes":%d,"failures":%d,"ejected":%t,"ejections":%d,"phases":[`,
+			stat.Target, stat.Protocol, stat.Requests, stat.Successes, stat.Failures, stat.Ejected, stat.Ejections)
+
+		for j, phase := range stat.Phases {
+			if j > 0 {
+				fmt.Fprintf(w, `,`)
+			}
+
+			fmt.Fprintf(w, `{"phase":"%s","class":"%s","count":%d,"mean_seconds":%g}`,
+				phase.Phase, phase.Class, phase.Latency.Count, phase.Latency.Sum/float64(phase.Latency.Count))
+		}
+
+		fmt.Fprintf(w, `]}`)
+	}
+
+	fmt.Fprintf(w, `]`)
+
+	dial := g.Proxy.DialStats()
+	fmt.Fprintf(w, `,"dial":{"ipv4":{"attempts":%d,"successes":%d,"failures":%d},`+
+		`"ipv6":{"attempts":%d,"successes":%d,"failures":%d}}`,
+		dial.IPv4.Attempts, dial.IPv4.Successes, dial.IPv4.Failures,
+		dial.IPv6.Attempts, dial.IPv6.Successes, dial.IPv6.Failures)
+
+	if g.Budget != nil {
+		mem := g.Budget.Stats()
+		fmt.Fprintf(w, `,"memory":{"limit_bytes":%d,"used_bytes":%d,"rejected":%d}`,
+			mem.Limit, mem.Used, mem.Rejected)
+	}
+
+	if g.Shedder != nil {
+		qos := g.Shedder.Stats()
+		fmt.Fprintf(w, `,"qos":{`)
+
+		for class := shedding.BestEffort; class <= shedding.Critical; class++ {
+			if class > shedding.BestEffort {
+				fmt.Fprintf(w, `,`)
+			}
+
+			stat := qos[class]
+			fmt.Fprintf(w, `"%s":{"admitted":%d,"shed":%d,"in_flight":%d}`,
+				class, stat.Admitted, stat.Shed, stat.InFlight)
+		}
+
+		fmt.Fprintf(w, `}`)
+	}
+
+	fmt.Fprintf(w, `}`)
+}
+
+// capacity samples the target pools and resource usage for GSLB reports.
+// Targets of every pool count, tenant pools and upstream groups included.
+func (g *Gateway) capacity() gslb.Capacity {
+	var c gslb.Capacity
+	for _, p := range g.proxies() {
+		for _, stat := range p.GetStats() {
+			c.Targets++
+			if stat.Down || stat.Weight == 0 {
+				continue
+			}
+
+			c.Healthy++
+			c.HealthyWeight += stat.Weight
+		}
+	}
+
+	c.Utilization = g.Shedder.Utilization()
+	if g.Budget != nil {
+		mem := g.Budget.Stats()
+		c.Utilization = max(c.Utilization, float64(mem.Used)/float64(mem.Limit))
+	}
+
+	return c
+}
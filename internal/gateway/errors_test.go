@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"testing"
+
+	"velocity/internal/config"
+	"velocity/pkg/errors"
+)
+
+func TestNewRejectsInvalidErrorLimits(t *testing.T) {
+	for name, limits := range map[string]config.ErrorsConfig{
+		"negative":        {ContextSoftLimit: -1, ContextHardLimit: 32},
+		"soft above hard": {ContextSoftLimit: 64, ContextHardLimit: 32},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Errors = limits
+
+			if _, err := New(cfg, nil); err == nil {
+				t.Fatal("New() accepted invalid error context limits")
+			}
+		})
+	}
+}
+
+func TestErrorLimitsApplyOnActivate(t *testing.T) {
+	t.Cleanup(func() { errors.SetLimits(errors.DefaultLimits) })
+
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Errors = config.ErrorsConfig{ContextSoftLimit: 2, ContextHardLimit: 4, MaxContextValueBytes: 8}
+	})
+
+	if got := errors.CurrentLimits(); got != errors.DefaultLimits {
+		t.Fatalf("limits after New() = %+v, want them untouched", got)
+	}
+
+	g.Activate()
+	if got, want := errors.CurrentLimits(), (errors.Limits{SoftKeys: 2, HardKeys: 4, MaxValueBytes: 8}); got != want {
+		t.Fatalf("limits after Activate() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,623 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"velocity/internal/auth"
+	"velocity/internal/canary"
+	"velocity/internal/config"
+	"velocity/internal/httpversion"
+	"velocity/internal/ipbinding"
+	"velocity/internal/normalize"
+	"velocity/internal/origin"
+	"velocity/internal/provenance"
+	"velocity/internal/router"
+	"velocity/internal/shedding"
+)
+
+// Request outcomes reported by Explain
+const (
+	// OutcomeProxy means the request is forwarded to an upstream
+	OutcomeProxy = "proxy"
+
+	// OutcomeRedirect means the route redirects to the canonical path
+	OutcomeRedirect = "redirect"
+
+	// OutcomeBuiltin means a built-in endpoint answers the request
+	OutcomeBuiltin = "builtin"
+
+	// OutcomeRejected means the gateway rejects the request
+	OutcomeRejected = "rejected"
+)
+
+// builtinPaths are served by the gateway itself before routing
+var builtinPaths = map[string]bool{
+	"/health":  true,
+	"/targets": true,
+	"/stats":   true,
+	"/metrics": true,
+}
+
+// Explanation describes how the gateway would handle a request
+type Explanation struct {
+	// Outcome is one of the Outcome constants
+	Outcome string `json:"outcome"`
+
+	// Reason explains a rejection or a built-in response
+	Reason string `json:"reason,omitempty"`
+
+	// Route is the matched route, empty for the fallback
+	Route string `json:"route,omitempty"`
+
+	// PathPrefix is the matched route's prefix
+	PathPrefix string `json:"path_prefix,omitempty"`
+
+	// Tenant owns the matched route, empty for gateway routes
+	Tenant string `json:"tenant,omitempty"`
+
+	// Path is the path forwarded upstream or redirected to
+	Path string `json:"path,omitempty"`
+
+	// Pool names the target pool: "default", "tenant:<name>",
+	// "upstream:<name>" or "canary:<route>", the bucket origin as "<type>:<bucket>" or the
+	// directory of a static route as "static:<root>"
+	Pool string `json:"pool,omitempty"`
+
+	// Targets are the enabled static targets of the pool
+	Targets []string `json:"targets,omitempty"`
+
+	// Policies lists the policies applied to the request, in order
+	Policies []Policy `json:"policies"`
+}
+
+// Policy is a policy that applies to an explained request
+type Policy struct {
+	// Name identifies the policy, e.g. "rate_limit (route)"
+	Name string `json:"name"`
+
+	// Detail summarizes its configuration or effect on this request
+	Detail string `json:"detail"`
+}
+
+// Explain evaluates a request against cfg offline, without contacting
+// upstreams or starting background tasks, and reports which route and
+// target pool would receive it and which policies would apply. It is the
+// dry run behind "velocity routes test".
+//
+// Request normalization and JWT validation are executed for real, so a
+// request they would reject is reported as rejected. Stateful policies
+// such as rate limits and load shedding are described, not evaluated.
+func Explain(cfg *config.Config, r *http.Request) (*Explanation, error) {
+	e := &Explanation{Policies: []Policy{}}
+
+	if cfg.Debug.Enabled && strings.HasPrefix(r.URL.Path, strings.TrimRight(cfg.Debug.Prefix, "/")+"/") {
+		e.Outcome, e.Reason = OutcomeBuiltin, "debug endpoint"
+		return e, nil
+	}
+
+	normalization, err := normalize.Middleware(cfg.RequestNormalization)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, err = passes(r, normalization); err != nil {
+		e.Outcome, e.Reason = OutcomeRejected, "request normalization: "+err.Error()
+		return e, nil
+	}
+
+	if builtinPaths[r.URL.Path] {
+		e.Outcome, e.Reason = OutcomeBuiltin, "built-in endpoint "+r.URL.Path
+
+		access := map[string]config.EndpointAccessConfig{
+			"/health":  cfg.Endpoints.Health,
+			"/targets": cfg.Endpoints.Targets,
+			"/stats":   cfg.Endpoints.Stats,
+			"/metrics": cfg.Endpoints.Metrics,
+		}[r.URL.Path]
+		if len(access.Allow) > 0 {
+			e.Policies = append(e.Policies, Policy{"endpoint_access", "clients from " + strings.Join(access.Allow, ", ")})
+		}
+		if access.Token != "" {
+			e.Policies = append(e.Policies, Policy{"endpoint_access", "Bearer token required"})
+		}
+		return e, nil
+	}
+
+	if cfg.Auth.OIDC.Enabled {
+		callback, logout := auth.OIDCPaths(cfg.Auth.OIDC)
+		switch r.URL.Path {
+		case callback:
+			e.Outcome, e.Reason = OutcomeBuiltin, "OIDC sign-in callback"
+			return e, nil
+		case logout:
+			e.Outcome, e.Reason = OutcomeBuiltin, "OIDC logout"
+			return e, nil
+		}
+	}
+
+	routes, err := routeConfigs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := router.New(routes, http.NotFoundHandler(),
+		func(config.RouteConfig) (http.Handler, error) { return http.NotFoundHandler(), nil })
+	if err != nil {
+		return nil, fmt.Errorf("invalid route configuration: %w", err)
+	}
+
+	if err := validateFallback(cfg.Fallback); err != nil {
+		return nil, err
+	}
+
+	if cfg.Fallback.Route != "" {
+		if err := table.SetFallbackRoute(cfg.Fallback.Route); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Auth.JWT.Enabled {
+		jwt, err := auth.JWT(cfg.Auth.JWT, table.Anonymous)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT configuration: %w", err)
+		}
+
+		if r, err = passes(r, jwt); err != nil {
+			e.Outcome, e.Reason = OutcomeRejected, "JWT authentication: "+err.Error()
+			return e, nil
+		}
+
+		if _, ok := auth.ClaimsFromContext(r.Context()); ok {
+			e.Policies = append(e.Policies, Policy{"jwt", "token valid"})
+		} else {
+			e.Policies = append(e.Policies, Policy{"jwt", "anonymous path, no token required"})
+		}
+	}
+
+	if cfg.RequestSigning.Enabled {
+		algorithm, keyID := cfg.RequestSigning.Algorithm, cfg.RequestSigning.KeyID
+		if algorithm == "" {
+			algorithm = provenance.AlgorithmHMAC
+		}
+		if keyID == "" {
+			keyID = provenance.Label
+		}
+		e.Policies = append(e.Policies, Policy{"request_signing", fmt.Sprintf("%s signature, keyid %q", algorithm, keyID)})
+	}
+
+	if cfg.IPBinding.Enabled {
+		detail := fmt.Sprintf("%d bound credentials", len(cfg.IPBinding.Bindings))
+		if cfg.IPBinding.Mode == ipbinding.ModeBlock {
+			detail += ", requests from other networks rejected"
+		}
+		if cfg.IPBinding.Anomalies.Enabled {
+			detail += ", unbound credentials profiled"
+		}
+		e.Policies = append(e.Policies, Policy{"ip_binding", detail})
+	}
+
+	e.Outcome, e.Path, e.Pool = OutcomeProxy, r.URL.Path, "default"
+	targets, poolLimit := cfg.Targets, cfg.RateLimit
+
+	route := table.Match(r)
+	fallback := route == nil
+	if fallback && cfg.Fallback.Status != 0 {
+		e.Outcome, e.Reason = OutcomeBuiltin, fmt.Sprintf("%d, no route matches", cfg.Fallback.Status)
+		e.Path, e.Pool = "", ""
+		return e, nil
+	}
+
+	if fallback {
+		route = table.FallbackRoute()
+	}
+
+	if route != nil {
+		rc := route.Config
+		e.Route, e.PathPrefix, e.Tenant = rc.Name, rc.PathPrefix, rc.Tenant
+
+		if fallback {
+			e.Policies = append(e.Policies, Policy{"fallback", "no route matches, served by the fallback route"})
+		}
+
+		if conditions := route.Conditions(); len(conditions) > 0 && !fallback {
+			e.Policies = append(e.Policies, Policy{"match", strings.Join(conditions, "; ")})
+		}
+
+		if rc.TrailingSlash != router.TrailingSlashStrict && !fallback {
+			if canonical := route.CanonicalPath(r.URL.Path); canonical != r.URL.Path {
+				e.Path = canonical
+				if rc.TrailingSlash == router.TrailingSlashRedirect {
+					e.Outcome, e.Reason = OutcomeRedirect, "308 to the canonical trailing slash form"
+					return e, nil
+				}
+
+				e.Policies = append(e.Policies, Policy{"trailing_slash", "path rewritten to " + canonical})
+			}
+		}
+
+		if !route.Allows(r.Method) {
+			if r.Method == http.MethodOptions {
+				e.Outcome, e.Reason = OutcomeBuiltin, "204 with Allow: "+route.Allow()
+			} else {
+				e.Outcome, e.Reason = OutcomeRejected, "405, the route allows "+route.Allow()
+			}
+			return e, nil
+		}
+
+		if rc.Tenant != "" {
+			for _, tenant := range cfg.Tenants {
+				if tenant.Name == rc.Tenant {
+					targets, poolLimit = tenant.Targets, tenant.RateLimit
+				}
+			}
+			e.Pool = "tenant:" + rc.Tenant
+		}
+
+		if rc.Upstream != "" && rc.Tenant == "" {
+			for _, group := range cfg.Upstreams {
+				if group.Name == rc.Upstream {
+					targets = group.Targets
+				}
+			}
+			e.Pool = "upstream:" + rc.Upstream
+		}
+
+		if rc.Origin.Type != "" {
+			e.Pool, targets = rc.Origin.Type+":"+rc.Origin.Bucket, nil
+		}
+
+		if rc.Type == origin.RouteStatic {
+			e.Pool, targets = "static:"+rc.Static.Root, nil
+		}
+
+		if rc.Type == origin.RouteRespond {
+			e.Pool, targets = "respond", nil
+		}
+	}
+
+	for _, target := range targets {
+		if target.Enabled {
+			e.Targets = append(e.Targets, target.URL)
+		}
+	}
+
+	if cfg.LoadShedding.Enabled {
+		var routeClass *shedding.Class
+		if route != nil && route.Config.QoSClass != "" {
+			class, err := shedding.ParseClass(route.Config.QoSClass)
+			if err != nil {
+				return nil, err
+			}
+			routeClass = &class
+		}
+
+		shedder, err := shedding.New(cfg.LoadShedding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid load shedding configuration: %w", err)
+		}
+
+		e.Policies = append(e.Policies, Policy{"load_shedding", "qos class " + shedder.Classify(r, routeClass).String()})
+	}
+
+	if poolLimit.Enabled {
+		scope := "rate_limit (global)"
+		if e.Tenant != "" {
+			scope = "rate_limit (tenant)"
+		}
+		e.Policies = append(e.Policies, Policy{scope, describeRateLimit(poolLimit)})
+	}
+
+	if route == nil {
+		return e, nil
+	}
+
+	rc := route.Config
+
+	_, authenticated := auth.ClaimsFromContext(r.Context())
+	if rc.Anonymous.RateLimit.Enabled && !authenticated && route.Anonymous(r.URL.Path) {
+		e.Policies = append(e.Policies, Policy{"rate_limit (anonymous)", describeRateLimit(rc.Anonymous.RateLimit)})
+	} else if rc.RateLimit.Enabled {
+		e.Policies = append(e.Policies, Policy{"rate_limit (route)", describeRateLimit(rc.RateLimit)})
+	}
+
+	if rc.BasicAuth.Enabled {
+		e.Policies = append(e.Policies, Policy{"basic_auth", "credentials checked against " + rc.BasicAuth.File})
+	}
+
+	if cfg.Auth.OIDC.Enabled && !rc.OIDC.Disabled {
+		e.Policies = append(e.Policies, Policy{"oidc", "session required, browsers sign in with " + cfg.Auth.OIDC.Issuer})
+	}
+
+	if cfg.ExtAuthz.Enabled && !rc.ExtAuthz.Disabled {
+		detail := "checked by " + cfg.ExtAuthz.URL + ", rejected when it fails"
+		if cfg.ExtAuthz.FailOpen {
+			detail = "checked by " + cfg.ExtAuthz.URL + ", allowed when it fails"
+		}
+		e.Policies = append(e.Policies, Policy{"ext_authz", detail})
+	}
+
+	e.Policies = append(e.Policies, routePolicies(rc)...)
+
+	if len(rc.Canary.Targets) > 0 {
+		split, err := canary.New(rc.Name, rc.Canary, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		segment, toCanary := split.Choose(r)
+		detail := fmt.Sprintf("segment %s, stable pool", segment)
+		if toCanary {
+			detail = fmt.Sprintf("segment %s, canary pool", segment)
+			e.Pool, e.Targets = "canary:"+rc.Name, nil
+			for _, target := range rc.Canary.Targets {
+				if target.Enabled {
+					e.Targets = append(e.Targets, target.URL)
+				}
+			}
+		}
+
+		e.Policies = append(e.Policies, Policy{"canary", detail})
+	}
+
+	return e, nil
+}
+
+// routePolicies describes the policies a route applies to every request,
+// in the order they apply
+func routePolicies(rc config.RouteConfig) []Policy {
+	var policies []Policy
+
+	if rc.MaxRetryAfter > 0 {
+		policies = append(policies, Policy{"max_retry_after", rc.MaxRetryAfter.String()})
+	}
+
+	if len(rc.Plugins) > 0 {
+		policies = append(policies, Policy{"plugins", strings.Join(rc.Plugins, ", ")})
+	}
+
+	if len(rc.Script) > 0 {
+		policies = append(policies, Policy{"script", fmt.Sprintf("%d rules", len(rc.Script))})
+	}
+
+	if detail := describeHeaderFilter(rc.Headers.Request); detail != "" {
+		policies = append(policies, Policy{"headers.request", detail})
+	}
+
+	if detail := describeHeaderFilter(rc.Headers.Response); detail != "" {
+		policies = append(policies, Policy{"headers.response", detail})
+	}
+
+	if rc.BodyInspection.MaxBytes > 0 {
+		policies = append(policies, Policy{"body_inspection", fmt.Sprintf("request bodies buffered up to %d bytes", rc.BodyInspection.MaxBytes)})
+	}
+
+	if rc.UpstreamAuth.Type != "" {
+		policies = append(policies, Policy{"upstream_auth", rc.UpstreamAuth.Type})
+	}
+
+	if rc.Dedup.Enabled {
+		window := "2s"
+		if rc.Dedup.Window > 0 {
+			window = rc.Dedup.Window.String()
+		}
+		policies = append(policies, Policy{"dedup", fmt.Sprintf("identical requests within %s share one upstream response", window)})
+	}
+
+	if versions, err := httpversion.New(rc.Name, rc.Protocols); err == nil && versions.Restricted() {
+		policies = append(policies, Policy{"protocols", "only " + strings.Join(versions.Allowed(), ", ") + " accepted, others answered 505"})
+	}
+
+	if len(rc.Upgrades) > 0 {
+		policies = append(policies, Policy{"upgrades", "connections may upgrade to " + strings.Join(rc.Upgrades, ", ") + ", other upgrade requests are forwarded as plain requests"})
+	}
+
+	if d := rc.Deprecation; d.Since != "" || d.Sunset != "" {
+		var lifecycle []string
+		if d.Since != "" {
+			lifecycle = append(lifecycle, "deprecated since "+d.Since)
+		}
+		if d.Sunset != "" {
+			lifecycle = append(lifecycle, "sunset "+d.Sunset)
+		}
+		if d.Shutoff {
+			lifecycle = append(lifecycle, "answered 410 after the sunset")
+		}
+		policies = append(policies, Policy{"deprecation", strings.Join(lifecycle, ", ")})
+	}
+
+	if rc.Cost.Units > 0 || len(rc.Cost.Methods) > 0 {
+		consumer := rc.Cost.Consumer
+		if consumer == "" {
+			consumer = "client_ip"
+		}
+		policies = append(policies, Policy{"cost", fmt.Sprintf("%g units per request charged to %s", rc.Cost.Units, consumer)})
+	}
+
+	if rc.Timeout > 0 {
+		policies = append(policies, Policy{"timeout", fmt.Sprintf("request abandoned after %s, retries included", rc.Timeout)})
+	}
+
+	if rc.DeadlinePropagation.Header != "" {
+		policies = append(policies, Policy{"deadline_propagation", "remaining time budget sent in " + rc.DeadlinePropagation.Header})
+	}
+
+	if rc.ClientDeadline.Enabled {
+		detail := "clients may shorten the request deadline"
+		if len(rc.ClientDeadline.Headers) > 0 {
+			detail += " with " + strings.Join(rc.ClientDeadline.Headers, " or ")
+		}
+		policies = append(policies, Policy{"client_deadline", detail})
+	}
+
+	if rc.SlowClients.MinBytesPerSecond > 0 {
+		policies = append(policies, Policy{"slow_clients", fmt.Sprintf("responses aborted when clients read slower than %d bytes/s", rc.SlowClients.MinBytesPerSecond)})
+	}
+
+	if rc.ETag.Enabled {
+		policies = append(policies, Policy{"etag", "ETags generated for GET 200 responses without validators"})
+	}
+
+	if rc.Compression.Enabled {
+		policies = append(policies, Policy{"compression", "dcz against dictionary " + rc.Compression.Dictionary + " for clients holding it"})
+	}
+
+	if rc.Cache.Enabled {
+		detail := fmt.Sprintf("ttl %s for anonymous GET 200 responses", rc.Cache.TTL)
+		if rc.Cache.Private {
+			detail = fmt.Sprintf("ttl %s for GET 200 responses, per consumer", rc.Cache.TTL)
+		}
+		policies = append(policies, Policy{"cache", detail})
+
+		if rc.Cache.NegativeTTL > 0 || rc.Cache.ErrorTTL > 0 {
+			policies = append(policies, Policy{"cache.negative", fmt.Sprintf("ttl %s for 404/410, %s for 5xx, invalidated by writes to the path",
+				rc.Cache.NegativeTTL, rc.Cache.ErrorTTL)})
+		}
+	}
+
+	if rc.CircuitBreaker.Enabled {
+		policies = append(policies, Policy{"circuit_breaker", describeCircuitBreaker(rc.CircuitBreaker)})
+	}
+
+	if rc.GRPCRetry.Enabled {
+		statuses := rc.GRPCRetry.Statuses
+		if len(statuses) == 0 {
+			statuses = []string{"UNAVAILABLE", "RESOURCE_EXHAUSTED"}
+		}
+		policies = append(policies, Policy{"grpc_retry", "gRPC calls retried on " + strings.Join(statuses, ", ")})
+	}
+
+	if rc.ResponseValidation.Schema != "" {
+		mode := rc.ResponseValidation.Mode
+		if mode == "" {
+			mode = "log"
+		}
+		policies = append(policies, Policy{"response_validation",
+			fmt.Sprintf("%s against %s", mode, rc.ResponseValidation.Schema)})
+	}
+
+	if rc.Checksums.Enabled {
+		mode := rc.Checksums.Mode
+		if mode == "" {
+			mode = "enforce"
+		}
+		policies = append(policies, Policy{"checksums", mode + " upstream body digests"})
+	}
+
+	return policies
+}
+
+// passes runs r through mw and returns the request as mw passed it on,
+// or an error carrying the rejection status and message
+func passes(r *http.Request, mw func(http.Handler) http.Handler) (*http.Request, error) {
+	var passed *http.Request
+	rejection := &rejectionRecorder{header: make(http.Header)}
+
+	mw(http.HandlerFunc(func(_ http.ResponseWriter, next *http.Request) {
+		passed = next
+	})).ServeHTTP(rejection, r)
+
+	if passed == nil {
+		return nil, fmt.Errorf("%d %s", rejection.status, strings.TrimSpace(rejection.body.String()))
+	}
+
+	return passed, nil
+}
+
+// rejectionRecorder captures the response of a middleware that rejected
+// a request
+type rejectionRecorder struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+// Header implements http.ResponseWriter
+func (rr *rejectionRecorder) Header() http.Header {
+	return rr.header
+}
+
+// WriteHeader implements http.ResponseWriter
+func (rr *rejectionRecorder) WriteHeader(status int) {
+	rr.status = status
+}
+
+// Write implements http.ResponseWriter
+func (rr *rejectionRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.body.Write(b)
+}
+
+// describeRateLimit summarizes a rate limit policy
+func describeRateLimit(cfg config.RateLimitConfig) string {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = "token_bucket"
+	}
+
+	key := cfg.Key
+	if key == "" {
+		key = "client_ip"
+	}
+
+	rate := fmt.Sprintf("%g/s burst %d", cfg.RequestsPerSecond, cfg.Burst)
+	if cfg.Window > 0 {
+		rate = fmt.Sprintf("%d per %s", cfg.Requests, cfg.Window)
+	}
+
+	return fmt.Sprintf("%s %s keyed by %s", mode, rate, key)
+}
+
+// describeCircuitBreaker summarizes when a route's circuit opens, with
+// the breaker's defaults applied
+func describeCircuitBreaker(cfg config.CircuitBreakerConfig) string {
+	var thresholds []string
+	if cfg.ConsecutiveFailures > 0 || cfg.FailureRatio == 0 {
+		failures := 5
+		if cfg.ConsecutiveFailures > 0 {
+			failures = cfg.ConsecutiveFailures
+		}
+		thresholds = append(thresholds, fmt.Sprintf("%d consecutive failures", failures))
+	}
+
+	if cfg.FailureRatio > 0 {
+		minRequests, window := 20, "10s"
+		if cfg.MinRequests > 0 {
+			minRequests = cfg.MinRequests
+		}
+		if cfg.Window > 0 {
+			window = cfg.Window.String()
+		}
+		thresholds = append(thresholds, fmt.Sprintf("%g%% of at least %d requests failing within %s", cfg.FailureRatio*100, minRequests, window))
+	}
+
+	open := "30s"
+	if cfg.OpenDuration > 0 {
+		open = cfg.OpenDuration.String()
+	}
+
+	return fmt.Sprintf("opens for %s on %s", open, strings.Join(thresholds, " or "))
+}
+
+// describeHeaderFilter summarizes a header filter, or returns "" when it
+// filters nothing
+func describeHeaderFilter(cfg config.HeaderFilterConfig) string {
+	var parts []string
+
+	if cfg.Default == "deny" {
+		parts = append(parts, "deny by default")
+	}
+
+	if len(cfg.Allow) > 0 {
+		parts = append(parts, "allow "+strings.Join(cfg.Allow, ", "))
+	}
+
+	if len(cfg.Deny) > 0 {
+		parts = append(parts, "deny "+strings.Join(cfg.Deny, ", "))
+	}
+
+	return strings.Join(parts, "; ")
+}
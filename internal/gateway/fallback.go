@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+
+	"velocity/internal/config"
+	gwerrors "velocity/pkg/errors"
+)
+
+// validateFallback checks that at most one way of handling unmatched
+// requests is configured
+func validateFallback(cfg config.FallbackConfig) error {
+	switch {
+	case cfg.Route != "" && cfg.Status != 0:
+		return fmt.Errorf("fallback: route and status are mutually exclusive")
+	case cfg.Status == 0 && (cfg.Body != "" || cfg.ContentType != ""):
+		return fmt.Errorf("fallback: body requires status")
+	case cfg.Status != 0 && (cfg.Status < 200 || cfg.Status > 599):
+		return fmt.Errorf("fallback: invalid status %d", cfg.Status)
+	}
+
+	return nil
+}
+
+// fallbackResponse answers every request with the configured status and
+// body, or a NO_ROUTE error without a body
+func fallbackResponse(cfg config.FallbackConfig) http.Handler {
+	contentType := cfg.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Body == "" {
+			err := gwerrors.New(gwerrors.CodeNoRoute, "No route matches the request")
+			err.StatusCode = cfg.Status
+			err.WriteJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(cfg.Status)
+		if r.Method != http.MethodHead {
+			w.Write([]byte(cfg.Body))
+		}
+	})
+}
@@ -0,0 +1,872 @@
+// Package gateway assembles the complete request pipeline from
+// configuration.
+//
+// A Gateway owns every component built from a single configuration
+// snapshot: the proxy and its connection pools, discovery watchers,
+// middleware chains, routes and the built-in endpoints. Building a new
+// Gateway is how a configuration is validated and applied; swapping the
+// Gateway served by the listener is how it is hot reloaded.
+//
+// Example usage:
+//
+//	gw, err := gateway.New(cfg, log)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer gw.Close()
+//	gw.Activate()
+//	http.ListenAndServe(":8080", gw)
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"velocity/internal/accesslog"
+	"velocity/internal/auth"
+	"velocity/internal/backpressure"
+	"velocity/internal/basicauth"
+	"velocity/internal/bodybuf"
+	"velocity/internal/breaker"
+	"velocity/internal/cache"
+	"velocity/internal/canary"
+	"velocity/internal/checksum"
+	"velocity/internal/compression"
+	"velocity/internal/config"
+	"velocity/internal/contract"
+	"velocity/internal/deadline"
+	"velocity/internal/debug"
+	"velocity/internal/dedup"
+	"velocity/internal/deprecation"
+	"velocity/internal/discovery"
+	"velocity/internal/etag"
+	"velocity/internal/extauthz"
+	"velocity/internal/grpcretry"
+	"velocity/internal/gslb"
+	"velocity/internal/headers"
+	"velocity/internal/httpversion"
+	"velocity/internal/ipbinding"
+	"velocity/internal/membudget"
+	"velocity/internal/middleware"
+	"velocity/internal/normalize"
+	"velocity/internal/origin"
+	"velocity/internal/plugins"
+	"velocity/internal/proxy"
+	"velocity/internal/ratelimit"
+	"velocity/internal/retryafter"
+	"velocity/internal/router"
+	"velocity/internal/script"
+	"velocity/internal/secrets"
+	"velocity/internal/shedding"
+	"velocity/internal/slowlog"
+	"velocity/internal/synthetic"
+	"velocity/internal/throttle"
+	"velocity/internal/upgrade"
+	"velocity/internal/upstreamauth"
+	"velocity/internal/usage"
+	"velocity/internal/xfcc"
+	"velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Gateway is a fully assembled request pipeline for one configuration
+type Gateway struct {
+	// Config is the configuration this gateway was built from
+	Config *config.Config
+
+	// Proxy forwards requests to backend targets
+	Proxy *proxy.Proxy
+
+	// Shedder performs priority-aware load shedding, nil when disabled
+	Shedder *shedding.Shedder
+
+	// Budget bounds buffered memory, nil when disabled
+	Budget *membudget.Budget
+
+	// Recovery turns panics into 500 responses and counts them
+	Recovery *middleware.Recovery
+
+	// SlowRequests logs and counts slow requests, nil when disabled
+	SlowRequests *slowlog.Recorder
+
+	// IPBinding checks the networks credentials are used from, nil when
+	// disabled
+	IPBinding *ipbinding.Guard
+
+	// ExtAuthz checks requests with the external authorization service,
+	// nil when disabled
+	ExtAuthz *extauthz.Authorizer
+
+	// OIDC signs browser users in with an OpenID Connect provider, nil
+	// when disabled
+	OIDC *auth.RelyingParty
+
+	// AdminAuth checks basic credentials for the admin API, nil when
+	// disabled
+	AdminAuth *basicauth.Guard
+
+	// AccessLogSinks publish access log events to message brokers
+	AccessLogSinks []*accesslog.Sink
+
+	// Synthetic probes routes through the pipeline, nil when disabled
+	Synthetic *synthetic.Prober
+
+	// Plugins holds the loaded plugins, nil when none are declared
+	Plugins *plugins.Registry
+
+	// Tenants holds the isolated tenant namespaces by name
+	Tenants map[string]*Tenant
+
+	// Upstreams holds the proxies of the named upstream groups
+	Upstreams map[string]*proxy.Proxy
+
+	// Contracts holds the response validators of routes with a schema
+	Contracts []*contract.Validator
+
+	// Verifiers holds the checksum verifiers of routes verifying upstream
+	// response bodies
+	Verifiers []*checksum.Verifier
+
+	// Origins holds the buckets, directories and configured responses
+	// serving routes in place of targets
+	Origins []origin.Origin
+
+	// Canaries holds the traffic splitters of routes with a canary pool
+	Canaries []*canary.Splitter
+
+	// Caches holds the response caches of routes with caching enabled
+	Caches []*cache.Cache
+
+	// Scripts holds the rule scripts of routes with a script
+	Scripts []*script.Script
+
+	// Breakers holds the circuit breakers of routes with one enabled
+	Breakers []*breaker.Breaker
+
+	// BasicAuths holds the basic auth guards of routes with one enabled
+	BasicAuths []*basicauth.Guard
+
+	// GRPCRetries holds the gRPC retry policies of routes with one enabled
+	GRPCRetries []*grpcretry.Policy
+
+	// Dedups holds the duplicate suppressors of routes with deduplication
+	// enabled
+	Dedups []*dedup.Deduplicator
+
+	// Taggers holds the ETag generators of routes with ETag generation
+	// enabled
+	Taggers []*etag.Tagger
+
+	// Compressors holds the dictionary compressors of routes with
+	// compression enabled
+	Compressors []*compression.Compressor
+
+	// ClientWrites holds the client write monitors of all routes
+	ClientWrites []*backpressure.Monitor
+
+	// Protocols holds the HTTP version policies of all routes
+	Protocols []*httpversion.Policy
+
+	// Upgrades holds the protocol upgrade policies of all routes, the
+	// policy of requests matching no route first
+	Upgrades []*upgrade.Policy
+
+	// Deprecations holds the deprecation policies of deprecated routes
+	Deprecations []*deprecation.Policy
+
+	// GSLB reports the instance's health and capacity to external load
+	// balancers, nil when disabled
+	GSLB *gslb.Reporter
+
+	// RateLimits holds the enabled rate limit policies, global, tenant and
+	// route, in the order they were built
+	RateLimits []*ratelimit.Policy
+
+	// Created is when the gateway was built from its configuration
+	Created time.Time
+
+	// canaryProxies forward canary traffic and close with the gateway
+	canaryProxies []*proxy.Proxy
+
+	// errorLimits are the error context limits applied by Activate
+	errorLimits errors.Limits
+
+	// routes is the compiled route table
+	routes *router.Router
+
+	// handler serves built-in endpoints and proxied traffic
+	handler http.Handler
+
+	// endpoints serves the built-in endpoints without proxying
+	endpoints http.Handler
+
+	// watcher resolves discovered targets, nil when discovery is disabled
+	watcher *discovery.Watcher
+
+	// cancel stops background tasks such as discovery and synthetic probes
+	cancel context.CancelFunc
+
+	// logger for pipeline events
+	logger *logger.Logger
+}
+
+// New builds a gateway from configuration.
+//
+// Every component is constructed up front, so any configuration error is
+// reported here rather than on the first request. Background tasks are
+// started only once the whole pipeline has been built successfully.
+//
+// Parameters:
+//
+//	cfg: Configuration to build from
+//	log: Logger for pipeline events
+//
+// Returns:
+//
+//	*Gateway: Gateway ready to serve requests
+//	error: Invalid configuration
+func New(cfg *config.Config, log *logger.Logger) (*Gateway, error) {
+	limits, err := errorLimits(cfg.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyHandler, err := proxy.New(cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy: %w", err)
+	}
+
+	g := &Gateway{
+		Config:       cfg,
+		Proxy:        proxyHandler,
+		Budget:       membudget.New(cfg.Memory.MaxBufferedBytes),
+		Recovery:     middleware.NewRecovery(log),
+		SlowRequests: slowlog.New(cfg.Logging.SlowRequests, log),
+		Created:      time.Now(),
+		errorLimits:  limits,
+		cancel:       func() {},
+		logger:       log.Component("gateway"),
+	}
+
+	if err := g.buildTenants(log); err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	if err := g.buildUpstreams(log); err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	handler, err := g.buildPipeline()
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	normalization, err := normalize.Middleware(cfg.RequestNormalization)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	forwardClientCert, err := xfcc.Middleware(cfg.Server.TLS)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	debugEndpoints, err := debug.Middleware(cfg.Debug, credentialHeaders(cfg))
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	g.AccessLogSinks, err = accesslog.NewSinks(cfg.Logging.AccessLogSinks, log)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	var accessLog middleware.Middleware
+	switch {
+	case cfg.Logging.AccessLog:
+		accessLog = accesslog.Middleware(log, g.AccessLogSinks)
+	case len(g.AccessLogSinks) > 0:
+		accessLog = accesslog.Middleware(nil, g.AccessLogSinks)
+	}
+
+	g.GSLB, err = gslb.New(cfg.GSLB, cfg.Hash, g.capacity, log)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	access, err := endpointAccessRules(cfg.Endpoints)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	g.handler = middleware.Chain(g.builtinEndpoints(handler, access),
+		accessLog, g.SlowRequests.Middleware(), g.Recovery.Middleware(), forwardClientCert, debugEndpoints, normalization)
+	g.endpoints = middleware.Chain(g.builtinEndpoints(http.NotFoundHandler(), nil),
+		g.Recovery.Middleware())
+
+	// Probes go through the same pipeline as client requests
+	g.Synthetic, err = synthetic.New(cfg.Synthetic, g.routes, g.handler, log)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+
+	if cfg.Discovery.Enabled {
+		if err := g.startDiscovery(ctx); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+
+	if g.Synthetic != nil && !cfg.Offline {
+		go g.Synthetic.Run(ctx)
+	}
+
+	if !cfg.Offline {
+		for _, sink := range g.AccessLogSinks {
+			go sink.Run(ctx)
+		}
+	}
+
+	if g.GSLB != nil && !cfg.Offline {
+		go g.GSLB.Run(ctx)
+	}
+
+	// Backends need the public key to verify Ed25519 signatures
+	if signer := g.Proxy.Signer(); signer != nil {
+		attrs := []any{"algorithm", signer.Algorithm(), "key_id", signer.KeyID()}
+		if signer.PublicKey() != "" {
+			attrs = append(attrs, "public_key", signer.PublicKey())
+		}
+		g.logger.Info("Signing upstream requests", attrs...)
+	}
+
+	return g, nil
+}
+
+// errorLimits validates the error context limits
+func errorLimits(cfg config.ErrorsConfig) (errors.Limits, error) {
+	limits := errors.Limits{
+		SoftKeys:      cfg.ContextSoftLimit,
+		HardKeys:      cfg.ContextHardLimit,
+		MaxValueBytes: cfg.MaxContextValueBytes,
+	}
+
+	switch {
+	case limits.SoftKeys < 0 || limits.HardKeys < 0 || limits.MaxValueBytes < 0:
+		return limits, fmt.Errorf("errors: context limits must not be negative")
+	case limits.HardKeys > 0 && limits.SoftKeys > limits.HardKeys:
+		return limits, fmt.Errorf("errors: context_soft_limit %d exceeds context_hard_limit %d", limits.SoftKeys, limits.HardKeys)
+	}
+
+	return limits, nil
+}
+
+// Activate applies the gateway's process-wide settings, the error context
+// limits. New leaves them alone so a gateway that is built but never
+// serves, such as a rejected reload or a validation run, changes nothing;
+// call Activate when the gateway starts serving, including after a
+// rollback to it.
+func (g *Gateway) Activate() {
+	errors.SetLimits(g.errorLimits)
+}
+
+// rateLimit creates the rate limit policy of a scope and keeps it for
+// inspection, returning its middleware, nil when the policy is disabled
+func (g *Gateway) rateLimit(cfg config.RateLimitConfig, scope string) (middleware.Middleware, error) {
+	policy, err := ratelimit.NewPolicy(cfg, scope)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+
+	g.RateLimits = append(g.RateLimits, policy)
+	return policy.Middleware(), nil
+}
+
+// buildPipeline assembles the middleware chains and route table in front
+// of the proxy
+func (g *Gateway) buildPipeline() (http.Handler, error) {
+	cfg := g.Config
+
+	globalLimit, err := g.rateLimit(cfg.RateLimit, "global")
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+
+	g.Shedder, err = shedding.New(cfg.LoadShedding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid load shedding configuration: %w", err)
+	}
+
+	tenantLimits := make(map[string]middleware.Middleware, len(g.Tenants))
+	for name, tenant := range g.Tenants {
+		tenantLimits[name], err = g.rateLimit(tenant.Config.RateLimit, "tenant:"+name)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: invalid rate limit configuration: %w", name, err)
+		}
+	}
+
+	routeConfigs, err := routeConfigs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Offline {
+		g.Plugins, err = plugins.Declare(cfg.Plugins)
+	} else {
+		g.Plugins, err = plugins.Load(cfg.Plugins, g.logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g.ExtAuthz, err = extauthz.New(cfg.ExtAuthz, g.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	g.OIDC, err = auth.NewRelyingParty(cfg.Auth.OIDC, g.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	g.AdminAuth, err = basicauth.New("admin", cfg.Admin.BasicAuth, g.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	secretStore := secrets.NewStore(time.Minute)
+	adminToken := func() (string, error) { return secretStore.Get(cfg.Admin.Token) }
+	if err := validateFallback(cfg.Fallback); err != nil {
+		return nil, err
+	}
+
+	// Requests matching no route may not upgrade their connection
+	fallbackUpgrades, err := upgrade.New("", nil)
+	if err != nil {
+		return nil, err
+	}
+	g.Upgrades = append(g.Upgrades, fallbackUpgrades)
+
+	fallback := middleware.Chain(g.Proxy, fallbackUpgrades.Middleware(), g.Shedder.Middleware(nil), globalLimit)
+	if cfg.Fallback.Status != 0 {
+		fallback = fallbackResponse(cfg.Fallback)
+	}
+
+	routes, err := router.New(routeConfigs, fallback,
+		func(rc config.RouteConfig) (http.Handler, error) {
+			// Tenant routes use the tenant's pool and rate limit budget
+			// instead of the shared ones
+			upstream, poolLimit := http.Handler(g.Proxy), globalLimit
+			if rc.Tenant != "" {
+				upstream, poolLimit = g.Tenants[rc.Tenant].Proxy, tenantLimits[rc.Tenant]
+			}
+
+			group, err := g.routeUpstream(rc)
+			if err != nil {
+				return nil, err
+			}
+
+			if group != nil {
+				upstream = group
+			}
+
+			var routeClass *shedding.Class
+			if rc.QoSClass != "" {
+				class, err := shedding.ParseClass(rc.QoSClass)
+				if err != nil {
+					return nil, err
+				}
+
+				routeClass = &class
+			}
+
+			budget, err := deadline.Middleware(rc.Timeout, cfg.Server.WriteTimeout, rc.DeadlinePropagation, rc.ClientDeadline)
+			if err != nil {
+				return nil, err
+			}
+
+			versions, err := httpversion.New(rc.Name, rc.Protocols)
+			if err != nil {
+				return nil, err
+			}
+			g.Protocols = append(g.Protocols, versions)
+
+			upgrades, err := upgrade.New(rc.Name, rc.Upgrades)
+			if err != nil {
+				return nil, err
+			}
+			g.Upgrades = append(g.Upgrades, upgrades)
+
+			lifecycle, err := deprecation.New(rc.Name, rc.Deprecation)
+			if err != nil {
+				return nil, err
+			}
+
+			if lifecycle != nil {
+				g.Deprecations = append(g.Deprecations, lifecycle)
+			}
+
+			meter, err := usage.Middleware(rc.Name, rc.Cost, usage.Global())
+			if err != nil {
+				return nil, err
+			}
+
+			clientWrites, err := backpressure.New(rc.Name, rc.SlowClients)
+			if err != nil {
+				return nil, err
+			}
+			g.ClientWrites = append(g.ClientWrites, clientWrites)
+
+			routeLimit, err := g.rateLimit(rc.RateLimit, "route:"+rc.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			anonymousLimit, err := g.rateLimit(rc.Anonymous.RateLimit, "route:"+rc.Name+":anonymous")
+			if err != nil {
+				return nil, fmt.Errorf("anonymous: %w", err)
+			}
+
+			headerPolicy, err := headers.Middleware(rc.Headers)
+			if err != nil {
+				return nil, err
+			}
+
+			credentials, err := upstreamauth.Middleware(rc.UpstreamAuth, secretStore)
+			if err != nil {
+				return nil, err
+			}
+
+			extensions, err := g.Plugins.Route(rc.Plugins)
+			if err != nil {
+				return nil, err
+			}
+
+			rules, err := script.New(rc.Name, rc.Script, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if rules != nil {
+				g.Scripts = append(g.Scripts, rules)
+			}
+
+			grpcRetry, err := grpcretry.New(rc.Name, rc.GRPCRetry)
+			if err != nil {
+				return nil, err
+			}
+
+			if grpcRetry != nil {
+				g.GRPCRetries = append(g.GRPCRetries, grpcRetry)
+			}
+
+			basicAuth, err := basicauth.New("route:"+rc.Name, rc.BasicAuth, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if basicAuth != nil {
+				g.BasicAuths = append(g.BasicAuths, basicAuth)
+			}
+
+			// Checking a session never calls the identity provider, while
+			// authorization runs after rate limiting so floods do not
+			// reach the authorization service
+			var signIn, authorization middleware.Middleware
+			if !rc.OIDC.Disabled {
+				signIn = g.OIDC.Middleware()
+			}
+
+			if !rc.ExtAuthz.Disabled {
+				authorization = g.ExtAuthz.Middleware()
+			}
+
+			// Signing needs the whole body, so signed routes buffer more
+			// than the retry limit unless told otherwise
+			inspection := rc.BodyInspection.MaxBytes
+			switch {
+			case inspection < 0:
+				return nil, fmt.Errorf("body_inspection: max_bytes must not be negative")
+			case inspection == 0 && rc.UpstreamAuth.Type == "aws_sigv4":
+				inspection = upstreamauth.MaxSignedBody
+			case inspection == 0:
+				inspection = cfg.Memory.MaxRetryBodyBytes
+			}
+
+			validator, err := contract.New(rc.Name, rc.ResponseValidation, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if validator != nil {
+				g.Contracts = append(g.Contracts, validator)
+			}
+
+			verifier, err := checksum.New(rc.Name, rc.Checksums, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if verifier != nil {
+				g.Verifiers = append(g.Verifiers, verifier)
+			}
+
+			split, err := g.buildCanary(rc)
+			if err != nil {
+				return nil, err
+			}
+
+			// Bucket, static and respond routes are answered by their origin
+			// instead of a pool
+			var routeOrigin origin.Origin
+			bucket, err := origin.New(rc, secretStore, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if bucket != nil {
+				routeOrigin = bucket
+			}
+
+			directory, err := origin.NewDirectory(rc, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if directory != nil {
+				routeOrigin = directory
+			}
+
+			response, err := origin.NewResponse(rc, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if response != nil {
+				routeOrigin = response
+			}
+
+			if routeOrigin != nil {
+				g.Origins = append(g.Origins, routeOrigin)
+
+				if split != nil {
+					return nil, fmt.Errorf("canary requires targets, the route is served by its origin")
+				}
+
+				if group != nil {
+					return nil, fmt.Errorf("upstream requires a proxy route, the route is served by its origin")
+				}
+
+				upstream = routeOrigin
+			}
+
+			responses, err := cache.New(rc.Name, rc.Cache, g.Budget, adminToken)
+			if err != nil {
+				return nil, err
+			}
+
+			if responses != nil {
+				g.Caches = append(g.Caches, responses)
+			}
+
+			circuit, err := breaker.New(rc.Name, rc.CircuitBreaker, g.logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if circuit != nil {
+				g.Breakers = append(g.Breakers, circuit)
+			}
+
+			duplicates, err := dedup.New(rc.Name, rc.Dedup, g.Budget)
+			if err != nil {
+				return nil, err
+			}
+
+			if duplicates != nil {
+				g.Dedups = append(g.Dedups, duplicates)
+			}
+
+			tagger, err := etag.New(rc.Name, rc.ETag)
+			if err != nil {
+				return nil, err
+			}
+
+			if tagger != nil {
+				g.Taggers = append(g.Taggers, tagger)
+			}
+
+			compressor, err := compression.New(rc)
+			if err != nil {
+				return nil, err
+			}
+
+			if compressor != nil {
+				g.Compressors = append(g.Compressors, compressor)
+			}
+
+			// Stages run outer to inner
+			return middleware.Chain(upstream,
+				// Admission: protocol, upgrade and lifecycle policy
+				versions.Middleware(),
+				upgrades.Middleware(),
+				lifecycle.Middleware(),
+
+				// Identity: credentials and sessions are verified before
+				// metering and rate limiting, so the user name or subject
+				// keys usage and buckets
+				basicAuth.Middleware(),
+				signIn,
+
+				// Limits and metering, then authorization
+				meter,
+				clientWrites.Middleware(),
+				budget,
+				retryafter.Middleware(rc.MaxRetryAfter),
+				g.Shedder.Middleware(routeClass),
+				poolLimit,
+				anonymousTier(routeLimit, anonymousLimit),
+				authorization,
+
+				// Inspection: the body is buffered once for plugins,
+				// scripts, deduplication and header policy
+				bodybuf.Middleware(inspection),
+				extensions,
+				rules.Middleware(),
+				duplicates.Middleware(),
+				headerPolicy,
+
+				// Upstream: credentials, response handling and target
+				// selection
+				credentials,
+				compressor.Middleware(),
+				tagger.Middleware(),
+				responses.Middleware(),
+				circuit.Middleware(),
+				validator.Middleware(),
+				verifier.Middleware(),
+				grpcRetry.Middleware(),
+				split.Middleware(),
+			), nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("invalid route configuration: %w", err)
+	}
+	g.routes = routes
+
+	if cfg.Fallback.Route != "" {
+		if err := routes.SetFallbackRoute(cfg.Fallback.Route); err != nil {
+			return nil, err
+		}
+	}
+
+	// Routes taking Basic credentials authenticate their requests
+	// themselves, so those need no bearer token either
+	jwtMiddleware, err := auth.JWT(cfg.Auth.JWT, func(r *http.Request) bool {
+		if routes.Anonymous(r) {
+			return true
+		}
+
+		route := routes.Serving(r)
+		return route != nil && route.Config.BasicAuth.Enabled
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT configuration: %w", err)
+	}
+
+	admission, err := throttle.Global().Middleware(cfg.Reload.Throttle)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bindings are checked after JWT validation so claims can identify
+	// the consumer
+	g.IPBinding, err = ipbinding.New(cfg.IPBinding, g.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Global plugins see authenticated requests before they are routed.
+	// The sign-in callback comes back without a bearer token.
+	return middleware.Chain(routes, admission, membudget.Middleware(g.Budget), g.OIDC.Endpoints(), jwtMiddleware, g.IPBinding.Middleware(), g.Plugins.Global()), nil
+}
+
+// updateTargets applies discovered targets, under the admission throttle
+// when enough of them change
+func (g *Gateway) updateTargets(discovered []discovery.Target) {
+	limits := g.Config.Reload.Throttle
+	if limits.Enabled && g.Proxy.Changes(discovered) >= max(limits.MinDiscoveryChanges, 1) {
+		throttle.Global().Open(throttle.ReasonDiscovery, limits)
+	}
+
+	g.Proxy.UpdateTargets(discovered)
+}
+
+// startDiscovery resolves discovered targets once and keeps watching them
+// until ctx is canceled when the gateway is closed. An offline gateway only
+// validates the provider configuration.
+func (g *Gateway) startDiscovery(ctx context.Context) error {
+	provider, err := discovery.NewProvider(g.Config.Discovery)
+	if err != nil {
+		return fmt.Errorf("invalid discovery configuration: %w", err)
+	}
+
+	if g.Config.Offline {
+		return nil
+	}
+
+	g.watcher = discovery.NewWatcher(provider, g.Config.Discovery.RefreshInterval,
+		g.logger.Component("discovery"), g.updateTargets)
+
+	if err := g.watcher.Refresh(ctx); err != nil {
+		g.logger.Warn("Initial discovery failed", "error", err)
+	}
+
+	go g.watcher.Run(ctx)
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.handler.ServeHTTP(w, r)
+}
+
+// Close stops background tasks and releases upstream connections.
+// Requests already in flight complete normally.
+func (g *Gateway) Close() {
+	g.cancel()
+	g.Proxy.Close()
+
+	for _, tenant := range g.Tenants {
+		tenant.Proxy.Close()
+	}
+
+	for _, groupProxy := range g.Upstreams {
+		groupProxy.Close()
+	}
+
+	for _, canaryProxy := range g.canaryProxies {
+		canaryProxy.Close()
+	}
+
+	for _, o := range g.Origins {
+		o.Close()
+	}
+
+	g.Plugins.Close()
+}
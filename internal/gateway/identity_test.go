@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// newTestGateway builds an offline gateway forwarding to a backend that
+// answers 200, after configure adjusts the configuration
+func newTestGateway(t *testing.T, configure func(*config.Config)) *Gateway {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := config.DefaultConfig()
+	cfg.Offline = true
+	cfg.Targets = []config.TargetConfig{{URL: backend.URL, Enabled: true}}
+	configure(cfg)
+
+	g, err := New(cfg, logger.New(logger.LoggerConfig{Level: "error", Output: io.Discard}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+// perUserLimit allows each subject one request per minute
+var perUserLimit = config.RateLimitConfig{
+	Enabled:  true,
+	Requests: 1,
+	Window:   time.Minute,
+	Burst:    1,
+	Key:      "claim.sub",
+}
+
+// send makes a request to path from one client address and returns the
+// status, after prepare adds credentials
+func send(g *Gateway, path string, prepare func(*http.Request)) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	prepare(r)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	return w.Code
+}
+
+// htpasswdFile writes an htpasswd file in which each user's password is
+// their name followed by "-secret"
+func htpasswdFile(t *testing.T, users ...string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	var lines string
+	for _, user := range users {
+		sum := sha1.Sum([]byte(user + "-secret"))
+		lines += user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+	}
+	if err := os.WriteFile(file, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestBasicAuthUsersHaveSeparateRateLimitBuckets(t *testing.T) {
+	file := htpasswdFile(t, "alice", "bob")
+
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Routes = []config.RouteConfig{{
+			Name:       "internal",
+			PathPrefix: "/internal",
+			BasicAuth:  config.BasicAuthConfig{Enabled: true, File: file},
+			RateLimit:  perUserLimit,
+		}}
+	})
+
+	as := func(user string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, user+"-secret") }
+	}
+
+	if code := send(g, "/internal", as("alice")); code != http.StatusOK {
+		t.Fatalf("alice's first request: status %d, want 200", code)
+	}
+
+	if code := send(g, "/internal", as("bob")); code != http.StatusOK {
+		t.Fatalf("bob's first request: status %d, want 200 from his own bucket", code)
+	}
+
+	if code := send(g, "/internal", as("alice")); code != http.StatusTooManyRequests {
+		t.Fatalf("alice's second request: status %d, want 429", code)
+	}
+}
+
+func TestBasicAuthRoutesPassJWTAuthentication(t *testing.T) {
+	file := htpasswdFile(t, "alice")
+
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Auth.JWT = config.JWTConfig{Enabled: true, Secret: "0123456789abcdef0123456789abcdef"}
+		cfg.Routes = []config.RouteConfig{
+			{
+				Name:       "internal",
+				PathPrefix: "/internal",
+				BasicAuth:  config.BasicAuthConfig{Enabled: true, File: file},
+			},
+			{Name: "api", PathPrefix: "/api"},
+		}
+	})
+
+	alice := func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") }
+	if code := send(g, "/internal", alice); code != http.StatusOK {
+		t.Fatalf("basic auth route with Basic credentials: status %d, want 200", code)
+	}
+
+	if code := send(g, "/internal", func(*http.Request) {}); code != http.StatusUnauthorized {
+		t.Fatalf("basic auth route without credentials: status %d, want 401", code)
+	}
+
+	if code := send(g, "/api", alice); code != http.StatusUnauthorized {
+		t.Fatalf("JWT route with Basic credentials: status %d, want 401", code)
+	}
+}
+
+func TestAnonymousPathsNeedNoBasicCredentials(t *testing.T) {
+	file := htpasswdFile(t, "alice")
+
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Routes = []config.RouteConfig{{
+			Name:       "internal",
+			PathPrefix: "/internal",
+			BasicAuth:  config.BasicAuthConfig{Enabled: true, File: file},
+			Anonymous:  config.AnonymousConfig{Paths: []string{"/internal/docs"}},
+		}}
+	})
+
+	none := func(*http.Request) {}
+	if code := send(g, "/internal/docs", none); code != http.StatusOK {
+		t.Fatalf("anonymous path without credentials: status %d, want 200", code)
+	}
+
+	if code := send(g, "/internal", none); code != http.StatusUnauthorized {
+		t.Fatalf("protected path without credentials: status %d, want 401", code)
+	}
+
+	wrong := func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }
+	if code := send(g, "/internal/docs", wrong); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous path with wrong credentials: status %d, want 401", code)
+	}
+}
+
+// sessionCookie seals an OIDC session for sub the way the gateway does
+func sessionCookie(t *testing.T, secret, sub string) *http.Cookie {
+	t.Helper()
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := json.Marshal(map[string]any{
+		"claims": map[string]any{"sub": sub},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	const name = "velocity_session"
+	value := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(name)))
+	return &http.Cookie{Name: name, Value: value}
+}
+
+func TestOIDCSubjectsHaveSeparateRateLimitBuckets(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Auth.OIDC = config.OIDCConfig{
+			Enabled:      true,
+			Issuer:       "https://idp.example.com",
+			ClientID:     "velocity",
+			RedirectURL:  "https://gateway.example.com/oauth2/callback",
+			CookieSecret: secret,
+		}
+		cfg.Routes = []config.RouteConfig{{
+			Name:       "app",
+			PathPrefix: "/app",
+			RateLimit:  perUserLimit,
+		}}
+	})
+
+	as := func(sub string) func(*http.Request) {
+		cookie := sessionCookie(t, secret, sub)
+		return func(r *http.Request) { r.AddCookie(cookie) }
+	}
+
+	if code := send(g, "/app", as("alice")); code != http.StatusOK {
+		t.Fatalf("alice's first request: status %d, want 200", code)
+	}
+
+	if code := send(g, "/app", as("bob")); code != http.StatusOK {
+		t.Fatalf("bob's first request: status %d, want 200 from his own bucket", code)
+	}
+
+	if code := send(g, "/app", as("alice")); code != http.StatusTooManyRequests {
+		t.Fatalf("alice's second request: status %d, want 429", code)
+	}
+}
+
+func TestAnonymousPathsNeedNoSession(t *testing.T) {
+	g := newTestGateway(t, func(cfg *config.Config) {
+		cfg.Auth.OIDC = config.OIDCConfig{
+			Enabled:      true,
+			Issuer:       "https://idp.example.com",
+			ClientID:     "velocity",
+			RedirectURL:  "https://gateway.example.com/oauth2/callback",
+			CookieSecret: "0123456789abcdef0123456789abcdef",
+		}
+		cfg.Routes = []config.RouteConfig{{
+			Name:       "app",
+			PathPrefix: "/app",
+			Anonymous:  config.AnonymousConfig{Paths: []string{"/app/public"}},
+		}}
+	})
+
+	none := func(*http.Request) {}
+	if code := send(g, "/app/public", none); code != http.StatusOK {
+		t.Fatalf("anonymous path without a session: status %d, want 200", code)
+	}
+
+	if code := send(g, "/app", none); code != http.StatusUnauthorized {
+		t.Fatalf("protected path without a session: status %d, want 401", code)
+	}
+}
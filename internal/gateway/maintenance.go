@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+
+	"velocity/internal/proxy"
+)
+
+// ErrDiscoveryDisabled is returned when refreshing discovery on a gateway
+// without a discovery provider
+var ErrDiscoveryDisabled = errors.New("discovery is disabled")
+
+// proxies returns the default proxy followed by every tenant and upstream
+// group proxy
+func (g *Gateway) proxies() []*proxy.Proxy {
+	proxies := []*proxy.Proxy{g.Proxy}
+	for _, tenant := range g.Tenants {
+		proxies = append(proxies, tenant.Proxy)
+	}
+
+	for _, group := range g.Upstreams {
+		proxies = append(proxies, group)
+	}
+
+	return proxies
+}
+
+// PauseHealthChecks suspends outlier ejections on every target pool,
+// including tenant pools and upstream groups. Returns
+// proxy.ErrOutlierDetectionDisabled when no pool has outlier detection.
+func (g *Gateway) PauseHealthChecks() error {
+	return g.eachDetector((*proxy.Proxy).PauseHealthChecks)
+}
+
+// ResumeHealthChecks lets every target pool eject outliers again
+func (g *Gateway) ResumeHealthChecks() error {
+	return g.eachDetector((*proxy.Proxy).ResumeHealthChecks)
+}
+
+// CheckHealth runs an outlier detection cycle on every target pool now
+func (g *Gateway) CheckHealth() error {
+	return g.eachDetector((*proxy.Proxy).CheckHealth)
+}
+
+// HealthChecksPaused reports whether ejections are suspended on any pool
+func (g *Gateway) HealthChecksPaused() bool {
+	for _, p := range g.proxies() {
+		if p.HealthChecksPaused() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eachDetector applies fn to every proxy with outlier detection
+func (g *Gateway) eachDetector(fn func(*proxy.Proxy) error) error {
+	applied := false
+	for _, p := range g.proxies() {
+		if err := fn(p); err == nil {
+			applied = true
+		}
+	}
+
+	if !applied {
+		return proxy.ErrOutlierDetectionDisabled
+	}
+
+	return nil
+}
+
+// RefreshDiscovery resolves the discovery provider immediately instead of
+// waiting for the next refresh interval, and returns the resulting target
+// set. On failure the previous target set stays in place.
+func (g *Gateway) RefreshDiscovery(ctx context.Context) ([]string, error) {
+	if g.watcher == nil {
+		return nil, ErrDiscoveryDisabled
+	}
+
+	if err := g.watcher.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return g.watcher.Targets(), nil
+}
@@ -0,0 +1,712 @@
+package gateway
+
+import (
+	"net/http"
+	"sort"
+
+	"velocity/internal/basicauth"
+	"velocity/internal/breaker"
+	"velocity/internal/cluster"
+	"velocity/internal/dialer"
+	"velocity/internal/listener"
+	"velocity/internal/metrics"
+	"velocity/internal/proxy"
+	"velocity/internal/revocation"
+	"velocity/internal/shedding"
+	"velocity/pkg/errors"
+)
+
+// handleMetrics exports target health, balancer state and resource usage
+// in the Prometheus text format.
+//
+// Every target metric carries a target label, so dashboards can show which
+// backend is degrading and why: failing (failures), slow or broken enough
+// to be ejected (ejected, ejections) or simply overloaded (in_flight).
+// Outlier ejection acts as the target's circuit breaker, so the circuit is
+// reported open while a target is ejected and its effective weight drops
+// to zero. The tenant label names the tenant owning the target's pool and
+// is empty for the gateway's own targets.
+func (g *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	m := metrics.NewWriter(w)
+
+	pools := g.targetPools()
+
+	m.Family("velocity_target_requests_total", "Requests proxied to a target by outcome", metrics.Counter)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_requests_total", float64(stat.Successes),
+				"tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target, "outcome", "success")
+			m.Sample("velocity_target_requests_total", float64(stat.Failures),
+				"tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target, "outcome", "failure")
+		}
+	}
+
+	m.Family("velocity_target_in_flight", "Requests currently being proxied to a target", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_in_flight", float64(stat.InFlight), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_connections", "Open connections to a target", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_connections", float64(stat.Connections), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_ejections_total", "Times a target was ejected by outlier detection", metrics.Counter)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_ejections_total", float64(stat.Ejections), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_circuit_open", "Whether the target's circuit is open (1) because it is ejected", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_circuit_open", boolValue(stat.Ejected), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_effective_weight", "Weight of the target in load balancing, 0 while ejected and ramping up after readmission", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_effective_weight", stat.Weight, "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_balancer_weight", "Weight of the target relative to the other targets of its priority, as reported by discovery", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_balancer_weight", float64(stat.BalancerWeight), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_target_priority", "Failover priority of the target, lower first, as reported by discovery", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			m.Sample("velocity_target_priority", float64(stat.Priority), "tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target)
+		}
+	}
+
+	m.Family("velocity_upstream_phase_seconds", "Upstream latency of each request phase by target and response status class", metrics.Histogram)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			for _, phase := range stat.Phases {
+				m.Histogram("velocity_upstream_phase_seconds", phase.Latency,
+					"tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target, "phase", phase.Phase, "class", phase.Class)
+			}
+		}
+	}
+
+	m.Family("velocity_target_health_check_up", "Whether the target passes its active health check (1), for targets with one", metrics.Gauge)
+	for _, pool := range pools {
+		for _, stat := range pool.stats {
+			if stat.HealthCheck != "" {
+				m.Sample("velocity_target_health_check_up", 1-boolValue(stat.Down),
+					"tenant", pool.tenant, "upstream", pool.upstream, "target", stat.Target, "type", stat.HealthCheck)
+			}
+		}
+	}
+
+	m.Family("velocity_affinity_breaks_total", "Sticky sessions whose pinned target was unusable, by reason and failover strategy", metrics.Counter)
+	for _, pool := range pools {
+		if pool.affinity == nil {
+			continue
+		}
+
+		for _, reason := range []string{proxy.AffinityRemoved, proxy.AffinityEjected, proxy.AffinityFailed} {
+			m.Sample("velocity_affinity_breaks_total", float64(pool.affinity.Breaks[reason]),
+				"tenant", pool.tenant, "upstream", pool.upstream, "reason", reason, "failover", pool.affinity.Failover)
+		}
+	}
+
+	m.Family("velocity_retry_budget_retries_total", "Retries of pools with a retry budget, by whether the budget allowed them", metrics.Counter)
+	for _, pool := range pools {
+		if pool.retries == nil {
+			continue
+		}
+
+		m.Sample("velocity_retry_budget_retries_total", float64(pool.retries.Retries), "tenant", pool.tenant, "upstream", pool.upstream, "result", "sent")
+		m.Sample("velocity_retry_budget_retries_total", float64(pool.retries.Denied), "tenant", pool.tenant, "upstream", pool.upstream, "result", "denied")
+	}
+
+	m.Family("velocity_retry_budget_requests_total", "Requests counted against the retry budget", metrics.Counter)
+	for _, pool := range pools {
+		if pool.retries != nil {
+			m.Sample("velocity_retry_budget_requests_total", float64(pool.retries.Requests), "tenant", pool.tenant, "upstream", pool.upstream)
+		}
+	}
+
+	m.Family("velocity_panics_total", "Panics recovered while serving requests", metrics.Counter)
+	m.Sample("velocity_panics_total", float64(g.Recovery.Panics()))
+
+	if g.SlowRequests != nil {
+		counts := g.SlowRequests.Counts()
+		routes := make([]string, 0, len(counts))
+		for route := range counts {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+
+		m.Family("velocity_slow_requests_total", "Requests slower than the slow request threshold by route", metrics.Counter)
+		for _, route := range routes {
+			m.Sample("velocity_slow_requests_total", float64(counts[route]), "route", route)
+		}
+	}
+
+	if len(g.AccessLogSinks) > 0 {
+		m.Family("velocity_access_log_sink_events_total", "Access log events by sink and result: published, dropped on a full queue or failed to publish", metrics.Counter)
+		for _, sink := range g.AccessLogSinks {
+			stats := sink.Stats()
+			m.Sample("velocity_access_log_sink_events_total", float64(stats.Published), "sink", stats.Name, "type", stats.Type, "result", "published")
+			m.Sample("velocity_access_log_sink_events_total", float64(stats.Dropped), "sink", stats.Name, "type", stats.Type, "result", "dropped")
+			m.Sample("velocity_access_log_sink_events_total", float64(stats.Failed), "sink", stats.Name, "type", stats.Type, "result", "failed")
+		}
+
+		m.Family("velocity_access_log_sink_queued", "Access log events waiting to be published by sink", metrics.Gauge)
+		for _, sink := range g.AccessLogSinks {
+			stats := sink.Stats()
+			m.Sample("velocity_access_log_sink_queued", float64(stats.Queued), "sink", stats.Name, "type", stats.Type)
+		}
+	}
+
+	if g.IPBinding != nil {
+		bindingStats := g.IPBinding.Stats()
+		m.Family("velocity_ip_binding_requests_total", "Requests carrying a credential by IP binding result", metrics.Counter)
+		m.Sample("velocity_ip_binding_requests_total", float64(bindingStats.Allowed), "result", "allowed")
+		m.Sample("velocity_ip_binding_requests_total", float64(bindingStats.Flagged), "result", "flagged")
+		m.Sample("velocity_ip_binding_requests_total", float64(bindingStats.Blocked), "result", "blocked")
+		m.Sample("velocity_ip_binding_requests_total", float64(bindingStats.Anomalies), "result", "anomaly")
+	}
+
+	if g.ExtAuthz != nil {
+		authzStats := g.ExtAuthz.Stats()
+		m.Family("velocity_ext_authz_requests_total", "Requests checked with the external authorization service by result", metrics.Counter)
+		m.Sample("velocity_ext_authz_requests_total", float64(authzStats.Allowed), "result", "allowed")
+		m.Sample("velocity_ext_authz_requests_total", float64(authzStats.Denied), "result", "denied")
+		m.Sample("velocity_ext_authz_requests_total", float64(authzStats.Failed), "result", "failed")
+	}
+
+	if g.OIDC != nil {
+		oidcStats := g.OIDC.Stats()
+		m.Family("velocity_oidc_requests_total", "Requests of routes requiring a browser session by result", metrics.Counter)
+		m.Sample("velocity_oidc_requests_total", float64(oidcStats.Authenticated), "result", "authenticated")
+		m.Sample("velocity_oidc_requests_total", float64(oidcStats.Redirected), "result", "redirected")
+		m.Sample("velocity_oidc_requests_total", float64(oidcStats.Rejected), "result", "rejected")
+
+		m.Family("velocity_oidc_logins_total", "Browser sign-ins by result", metrics.Counter)
+		m.Sample("velocity_oidc_logins_total", float64(oidcStats.Logins), "result", "succeeded")
+		m.Sample("velocity_oidc_logins_total", float64(oidcStats.Failed), "result", "failed")
+	}
+
+	if g.AdminAuth != nil || len(g.BasicAuths) > 0 {
+		m.Family("velocity_basic_auth_requests_total", "Requests checked against an htpasswd file by scope and result", metrics.Counter)
+		for _, guard := range append([]*basicauth.Guard{g.AdminAuth}, g.BasicAuths...) {
+			if guard == nil {
+				continue
+			}
+
+			stats := guard.Stats()
+			m.Sample("velocity_basic_auth_requests_total", float64(stats.Allowed), "scope", guard.Scope(), "result", "allowed")
+			m.Sample("velocity_basic_auth_requests_total", float64(stats.Denied), "scope", guard.Scope(), "result", "denied")
+			m.Sample("velocity_basic_auth_requests_total", float64(stats.Throttled), "scope", guard.Scope(), "result", "throttled")
+		}
+	}
+
+	if g.Synthetic != nil {
+		probes := g.Synthetic.Stats()
+
+		m.Family("velocity_synthetic_probe_runs_total", "Synthetic probe runs by probe and result", metrics.Counter)
+		for _, probe := range probes {
+			m.Sample("velocity_synthetic_probe_runs_total", float64(probe.Successes), "probe", probe.Name, "route", probe.Route, "result", "success")
+			m.Sample("velocity_synthetic_probe_runs_total", float64(probe.Failures), "probe", probe.Name, "route", probe.Route, "result", "failure")
+		}
+
+		m.Family("velocity_synthetic_probe_up", "Whether the last run of the synthetic probe succeeded (1)", metrics.Gauge)
+		for _, probe := range probes {
+			m.Sample("velocity_synthetic_probe_up", boolValue(probe.Up), "probe", probe.Name, "route", probe.Route)
+		}
+
+		m.Family("velocity_synthetic_probe_latency_seconds", "Latency of the last run of the synthetic probe", metrics.Gauge)
+		for _, probe := range probes {
+			m.Sample("velocity_synthetic_probe_latency_seconds", probe.LastLatencySeconds, "probe", probe.Name, "route", probe.Route)
+		}
+	}
+
+	if plugins := g.Plugins.Stats(); len(plugins) > 0 {
+		m.Family("velocity_plugin_calls_total", "Calls to process plugins by plugin and result", metrics.Counter)
+		for _, plugin := range plugins {
+			m.Sample("velocity_plugin_calls_total", float64(plugin.Calls-plugin.Failures), "plugin", plugin.Name, "result", "success")
+			m.Sample("velocity_plugin_calls_total", float64(plugin.Failures), "plugin", plugin.Name, "result", "failure")
+		}
+
+		m.Family("velocity_plugin_restarts_total", "Restarts of plugin processes after they exited", metrics.Counter)
+		for _, plugin := range plugins {
+			m.Sample("velocity_plugin_restarts_total", float64(plugin.Restarts), "plugin", plugin.Name)
+		}
+	}
+
+	errorStats := errors.Stats()
+
+	m.Family("velocity_error_context_soft_limit_exceeded_total", "Errors whose context grew past the soft key limit", metrics.Counter)
+	m.Sample("velocity_error_context_soft_limit_exceeded_total", float64(errorStats.SoftLimitExceeded))
+
+	m.Family("velocity_error_context_dropped_total", "Error context entries dropped at the hard key limit", metrics.Counter)
+	m.Sample("velocity_error_context_dropped_total", float64(errorStats.DroppedEntries))
+
+	dial := g.Proxy.DialStats()
+	families := []struct {
+		name  string
+		stats dialer.FamilyStats
+	}{
+		{dialer.IPv4, dial.IPv4},
+		{dialer.IPv6, dial.IPv6},
+	}
+
+	m.Family("velocity_upstream_dials_total", "Upstream connection attempts by address family and outcome", metrics.Counter)
+	for _, family := range families {
+		m.Sample("velocity_upstream_dials_total", float64(family.stats.Successes), "family", family.name, "outcome", "success")
+		m.Sample("velocity_upstream_dials_total", float64(family.stats.Failures), "family", family.name, "outcome", "failure")
+		m.Sample("velocity_upstream_dials_total", float64(family.stats.Attempts-family.stats.Successes-family.stats.Failures),
+			"family", family.name, "outcome", "abandoned")
+	}
+
+	m.Family("velocity_upstream_dns_stale_fallbacks_total", "Failed upstream host name lookups answered with the last resolved addresses", metrics.Counter)
+	m.Sample("velocity_upstream_dns_stale_fallbacks_total", float64(dial.StaleFallbacks))
+
+	m.Family("velocity_upstream_dns_stale_hosts", "Upstream host names currently dialed with the addresses of their last successful lookup", metrics.Gauge)
+	m.Sample("velocity_upstream_dns_stale_hosts", float64(dial.StaleHosts))
+
+	g.writeConnectionMetrics(m)
+	g.writeReloadMetrics(m)
+	g.writeClusterMetrics(m)
+
+	if len(g.Contracts) > 0 {
+		m.Family("velocity_contract_responses_total", "Upstream responses by route and contract validation result", metrics.Counter)
+		for _, validator := range g.Contracts {
+			contractStats := validator.Stats()
+			m.Sample("velocity_contract_responses_total", float64(contractStats.Checked-contractStats.Violations),
+				"route", validator.Route(), "result", "valid")
+			m.Sample("velocity_contract_responses_total", float64(contractStats.Violations),
+				"route", validator.Route(), "result", "violation")
+			m.Sample("velocity_contract_responses_total", float64(contractStats.Skipped),
+				"route", validator.Route(), "result", "skipped")
+		}
+	}
+
+	if len(g.Verifiers) > 0 {
+		m.Family("velocity_checksum_responses_total", "Upstream response bodies by route and checksum verification result", metrics.Counter)
+		for _, verifier := range g.Verifiers {
+			checksumStats := verifier.Stats()
+			m.Sample("velocity_checksum_responses_total", float64(checksumStats.Verified),
+				"route", verifier.Route(), "result", "verified")
+			m.Sample("velocity_checksum_responses_total", float64(checksumStats.Mismatched),
+				"route", verifier.Route(), "result", "mismatch")
+		}
+	}
+
+	if len(g.Caches) > 0 {
+		m.Family("velocity_cache_requests_total", "Cacheable requests by route and cache result", metrics.Counter)
+		for _, c := range g.Caches {
+			cacheStats := c.Stats()
+			m.Sample("velocity_cache_requests_total", float64(cacheStats.Hits), "route", c.Route(), "result", "hit")
+			m.Sample("velocity_cache_requests_total", float64(cacheStats.Misses), "route", c.Route(), "result", "miss")
+			m.Sample("velocity_cache_requests_total", float64(cacheStats.Bypasses), "route", c.Route(), "result", "bypass")
+		}
+
+		m.Family("velocity_cache_entries", "Responses currently cached by route", metrics.Gauge)
+		for _, c := range g.Caches {
+			m.Sample("velocity_cache_entries", float64(c.Stats().Entries), "route", c.Route())
+		}
+
+		m.Family("velocity_cache_invalidations_total", "Cached negative responses removed by writes to their path by route", metrics.Counter)
+		for _, c := range g.Caches {
+			m.Sample("velocity_cache_invalidations_total", float64(c.Stats().Invalidations), "route", c.Route())
+		}
+	}
+
+	if len(g.Scripts) > 0 {
+		m.Family("velocity_script_responses_total", "Requests answered by a script rule by route", metrics.Counter)
+		for _, s := range g.Scripts {
+			m.Sample("velocity_script_responses_total", float64(s.Stats().Responded), "route", s.Route())
+		}
+
+		m.Family("velocity_script_errors_total", "Script rules skipped because an expression failed by route", metrics.Counter)
+		for _, s := range g.Scripts {
+			m.Sample("velocity_script_errors_total", float64(s.Stats().Errors), "route", s.Route())
+		}
+	}
+
+	if len(g.Breakers) > 0 {
+		m.Family("velocity_route_circuit_state", "State of the route's circuit breaker, 1 for the current state", metrics.Gauge)
+		for _, b := range g.Breakers {
+			state := b.Stats().State
+			for _, s := range []breaker.State{breaker.Closed, breaker.Open, breaker.HalfOpen} {
+				m.Sample("velocity_route_circuit_state", boolValue(state == s), "route", b.Route(), "state", s.String())
+			}
+		}
+
+		m.Family("velocity_route_circuit_opens_total", "Times the route's circuit breaker opened", metrics.Counter)
+		for _, b := range g.Breakers {
+			m.Sample("velocity_route_circuit_opens_total", float64(b.Stats().Opens), "route", b.Route())
+		}
+
+		m.Family("velocity_route_circuit_rejected_total", "Requests answered with the fallback while the route's circuit was open", metrics.Counter)
+		for _, b := range g.Breakers {
+			m.Sample("velocity_route_circuit_rejected_total", float64(b.Stats().Rejected), "route", b.Route())
+		}
+	}
+
+	if len(g.GRPCRetries) > 0 {
+		m.Family("velocity_grpc_retry_responses_total", "gRPC answers with a retried status by route and result", metrics.Counter)
+		for _, p := range g.GRPCRetries {
+			retryStats := p.Stats()
+			m.Sample("velocity_grpc_retry_responses_total", float64(retryStats.Retryable), "route", p.Route(), "result", "retryable")
+			m.Sample("velocity_grpc_retry_responses_total", float64(retryStats.Refused), "route", p.Route(), "result", "refused")
+			m.Sample("velocity_grpc_retry_responses_total", float64(retryStats.Failed), "route", p.Route(), "result", "failed")
+		}
+	}
+
+	if len(g.Dedups) > 0 {
+		m.Family("velocity_dedup_requests_total", "Deduplicated requests by route and result", metrics.Counter)
+		for _, d := range g.Dedups {
+			dedupStats := d.Stats()
+			m.Sample("velocity_dedup_requests_total", float64(dedupStats.Forwarded), "route", d.Route(), "result", "forwarded")
+			m.Sample("velocity_dedup_requests_total", float64(dedupStats.Replayed), "route", d.Route(), "result", "replayed")
+			m.Sample("velocity_dedup_requests_total", float64(dedupStats.Rejected), "route", d.Route(), "result", "rejected")
+		}
+	}
+
+	if len(g.ClientWrites) > 0 {
+		m.Family("velocity_client_write_stall_seconds_total", "Time response writes to clients spent blocked beyond the stall threshold by route", metrics.Counter)
+		for _, monitor := range g.ClientWrites {
+			m.Sample("velocity_client_write_stall_seconds_total", monitor.Stats().StallTime.Seconds(), "route", monitor.Route())
+		}
+
+		m.Family("velocity_slow_client_responses_total", "Responses with at least one stalled client write by route", metrics.Counter)
+		for _, monitor := range g.ClientWrites {
+			m.Sample("velocity_slow_client_responses_total", float64(monitor.Stats().SlowResponses), "route", monitor.Route())
+		}
+
+		m.Family("velocity_client_write_deadline_extensions_total", "Client write deadlines extended while enforcing a read rate floor by route", metrics.Counter)
+		for _, monitor := range g.ClientWrites {
+			m.Sample("velocity_client_write_deadline_extensions_total", float64(monitor.Stats().DeadlineExtensions), "route", monitor.Route())
+		}
+
+		m.Family("velocity_slow_client_aborts_total", "Responses aborted because the client read below the rate floor by route", metrics.Counter)
+		for _, monitor := range g.ClientWrites {
+			m.Sample("velocity_slow_client_aborts_total", float64(monitor.Stats().Aborts), "route", monitor.Route())
+		}
+	}
+
+	if len(g.Protocols) > 0 {
+		m.Family("velocity_route_requests_by_protocol_total", "Requests of a route by negotiated HTTP version and admission result", metrics.Counter)
+		for _, p := range g.Protocols {
+			for _, v := range p.Stats() {
+				m.Sample("velocity_route_requests_by_protocol_total", float64(v.Accepted),
+					"route", p.Route(), "protocol", v.Protocol, "result", "accepted")
+				m.Sample("velocity_route_requests_by_protocol_total", float64(v.Rejected),
+					"route", p.Route(), "protocol", v.Protocol, "result", "rejected")
+			}
+		}
+	}
+
+	if len(g.Upgrades) > 0 {
+		m.Family("velocity_upgrade_requests_total", "Protocol upgrade requests by route, protocol and result, stripped ones forwarded as plain requests", metrics.Counter)
+		for _, p := range g.Upgrades {
+			upgradeStats := p.Stats()
+			for _, protocol := range p.Allowed() {
+				m.Sample("velocity_upgrade_requests_total", float64(upgradeStats.Allowed[protocol]), "route", p.Route(), "protocol", protocol, "result", "allowed")
+			}
+			m.Sample("velocity_upgrade_requests_total", float64(upgradeStats.Stripped), "route", p.Route(), "protocol", "", "result", "stripped")
+		}
+	}
+
+	if len(g.Deprecations) > 0 {
+		m.Family("velocity_deprecated_route_requests_total", "Requests of deprecated routes by result, rejected ones answered 410 after the sunset", metrics.Counter)
+		m.Family("velocity_route_sunset_timestamp_seconds", "Sunset date of deprecated routes as a Unix timestamp", metrics.Gauge)
+		for _, p := range g.Deprecations {
+			deprecationStats := p.Stats()
+			m.Sample("velocity_deprecated_route_requests_total", float64(deprecationStats.Served), "route", p.Route(), "result", "served")
+			m.Sample("velocity_deprecated_route_requests_total", float64(deprecationStats.Warned), "route", p.Route(), "result", "warned")
+			m.Sample("velocity_deprecated_route_requests_total", float64(deprecationStats.Rejected), "route", p.Route(), "result", "rejected")
+			if sunset := p.Sunset(); !sunset.IsZero() {
+				m.Sample("velocity_route_sunset_timestamp_seconds", float64(sunset.Unix()), "route", p.Route())
+			}
+		}
+	}
+
+	if g.GSLB != nil {
+		report := g.GSLB.Report()
+		gslbStats := g.GSLB.Stats()
+		m.Family("velocity_gslb_weight", "Weight reported to external load balancers, 0 while unhealthy", metrics.Gauge)
+		m.Sample("velocity_gslb_weight", float64(report.Weight))
+		m.Family("velocity_gslb_pushes_total", "Capacity reports pushed to the collector by result", metrics.Counter)
+		m.Sample("velocity_gslb_pushes_total", float64(gslbStats.Pushed), "result", "success")
+		m.Sample("velocity_gslb_pushes_total", float64(gslbStats.Failed), "result", "failure")
+	}
+
+	if len(g.Taggers) > 0 {
+		m.Family("velocity_etag_responses_total", "Responses eligible for a generated ETag by route and result", metrics.Counter)
+		for _, t := range g.Taggers {
+			tagStats := t.Stats()
+			m.Sample("velocity_etag_responses_total", float64(tagStats.Tagged), "route", t.Route(), "result", "tagged")
+			m.Sample("velocity_etag_responses_total", float64(tagStats.NotModified), "route", t.Route(), "result", "not_modified")
+			m.Sample("velocity_etag_responses_total", float64(tagStats.Skipped), "route", t.Route(), "result", "skipped")
+		}
+	}
+
+	if len(g.Compressors) > 0 {
+		m.Family("velocity_compression_responses_total", "Responses to clients holding the route's dictionary by result", metrics.Counter)
+		m.Family("velocity_compression_bytes_total", "Body bytes of dictionary compressed responses before and after compression", metrics.Counter)
+		m.Family("velocity_compression_dictionary_fetches_total", "Downloads of the route's compression dictionary", metrics.Counter)
+		for _, c := range g.Compressors {
+			compressionStats := c.Stats()
+			m.Sample("velocity_compression_responses_total", float64(compressionStats.Compressed), "route", c.Route(), "result", "compressed")
+			m.Sample("velocity_compression_responses_total", float64(compressionStats.Skipped), "route", c.Route(), "result", "skipped")
+			m.Sample("velocity_compression_bytes_total", float64(compressionStats.BytesIn), "route", c.Route(), "body", "identity")
+			m.Sample("velocity_compression_bytes_total", float64(compressionStats.BytesOut), "route", c.Route(), "body", "compressed")
+			m.Sample("velocity_compression_dictionary_fetches_total", float64(compressionStats.DictionaryFetches), "route", c.Route())
+		}
+	}
+
+	if len(g.Origins) > 0 {
+		m.Family("velocity_origin_requests_total", "Requests of routes served from a bucket, directory or configured response by result", metrics.Counter)
+		for _, o := range g.Origins {
+			originStats := o.Stats()
+			m.Sample("velocity_origin_requests_total", float64(originStats.Served), "route", o.Route(), "result", "served")
+			m.Sample("velocity_origin_requests_total", float64(originStats.NotFound), "route", o.Route(), "result", "not_found")
+			m.Sample("velocity_origin_requests_total", float64(originStats.Failed), "route", o.Route(), "result", "failed")
+		}
+	}
+
+	if len(g.Canaries) > 0 {
+		m.Family("velocity_canary_requests_total", "Requests of canary routes by consumer segment and pool", metrics.Counter)
+		for _, split := range g.Canaries {
+			for _, seg := range split.Stats() {
+				m.Sample("velocity_canary_requests_total", float64(seg.Stable),
+					"route", split.Route(), "segment", seg.Segment, "pool", "stable")
+				m.Sample("velocity_canary_requests_total", float64(seg.Canary),
+					"route", split.Route(), "segment", seg.Segment, "pool", "canary")
+			}
+		}
+
+		m.Family("velocity_canary_weight_percent", "Configured canary share of a consumer segment", metrics.Gauge)
+		for _, split := range g.Canaries {
+			for _, seg := range split.Stats() {
+				m.Sample("velocity_canary_weight_percent", seg.Weight, "route", split.Route(), "segment", seg.Segment)
+			}
+		}
+	}
+
+	if g.Budget != nil {
+		mem := g.Budget.Stats()
+
+		m.Family("velocity_memory_buffered_bytes", "Bytes currently reserved for buffered bodies", metrics.Gauge)
+		m.Sample("velocity_memory_buffered_bytes", float64(mem.Used))
+
+		m.Family("velocity_memory_limit_bytes", "Memory budget for buffered bodies", metrics.Gauge)
+		m.Sample("velocity_memory_limit_bytes", float64(mem.Limit))
+
+		m.Family("velocity_memory_rejected_total", "Reservations rejected by the memory budget", metrics.Counter)
+		m.Sample("velocity_memory_rejected_total", float64(mem.Rejected))
+	}
+
+	if g.Shedder != nil {
+		qos := g.Shedder.Stats()
+
+		m.Family("velocity_qos_requests_total", "Requests by QoS class and admission decision", metrics.Counter)
+		for class := shedding.BestEffort; class <= shedding.Critical; class++ {
+			m.Sample("velocity_qos_requests_total", float64(qos[class].Admitted), "class", class.String(), "decision", "admitted")
+			m.Sample("velocity_qos_requests_total", float64(qos[class].Shed), "class", class.String(), "decision", "shed")
+		}
+
+		m.Family("velocity_qos_in_flight", "Requests in flight by QoS class", metrics.Gauge)
+		for class := shedding.BestEffort; class <= shedding.Critical; class++ {
+			m.Sample("velocity_qos_in_flight", float64(qos[class].InFlight), "class", class.String())
+		}
+	}
+}
+
+// writeClusterMetrics exports cluster membership and gossip traffic when
+// this gateway is a cluster member
+func (g *Gateway) writeClusterMetrics(m *metrics.Writer) {
+	node := cluster.Current()
+	if node == nil {
+		return
+	}
+
+	states := map[string]int{cluster.StateAlive: 0, cluster.StateSuspect: 0}
+	for _, member := range node.Members() {
+		states[member.State]++
+	}
+
+	m.Family("velocity_cluster_members", "Known cluster members, this one included, by state", metrics.Gauge)
+	m.Sample("velocity_cluster_members", float64(states[cluster.StateAlive]), "state", cluster.StateAlive)
+	m.Sample("velocity_cluster_members", float64(states[cluster.StateSuspect]), "state", cluster.StateSuspect)
+
+	m.Family("velocity_cluster_leader", "Whether this member is the cluster leader running singleton tasks", metrics.Gauge)
+	m.Sample("velocity_cluster_leader", boolValue(node.IsLeader()))
+
+	stats := node.Stats()
+	m.Family("velocity_cluster_messages_total", "Gossip messages sent, received and rejected", metrics.Counter)
+	m.Sample("velocity_cluster_messages_total", float64(stats.Sent), "direction", "sent")
+	m.Sample("velocity_cluster_messages_total", float64(stats.Received), "direction", "received")
+	m.Sample("velocity_cluster_messages_total", float64(stats.Rejected), "direction", "rejected")
+}
+
+// writeConnectionMetrics exports client connection statistics of every
+// tracked listener. TLS metrics are only reported for listeners that
+// terminate TLS.
+func (g *Gateway) writeConnectionMetrics(m *metrics.Writer) {
+	trackers := listener.Trackers()
+	if len(trackers) == 0 {
+		return
+	}
+
+	conns := make([]listener.Stats, len(trackers))
+	for i, tracker := range trackers {
+		conns[i] = tracker.Stats()
+	}
+
+	m.Family("velocity_connections_accepted_total", "Client connections accepted", metrics.Counter)
+	for _, c := range conns {
+		m.Sample("velocity_connections_accepted_total", float64(c.Accepted), "listener", c.Name)
+	}
+
+	m.Family("velocity_connections_open", "Client connections currently open", metrics.Gauge)
+	for _, c := range conns {
+		m.Sample("velocity_connections_open", float64(c.Open), "listener", c.Name)
+	}
+
+	m.Family("velocity_connections_limit", "Maximum concurrent client connections, 0 when unlimited", metrics.Gauge)
+	for _, c := range conns {
+		m.Sample("velocity_connections_limit", float64(c.Limit), "listener", c.Name)
+	}
+
+	m.Family("velocity_connections_oldest_age_seconds", "Age of the oldest open client connection", metrics.Gauge)
+	for _, c := range conns {
+		m.Sample("velocity_connections_oldest_age_seconds", c.OldestAge.Seconds(), "listener", c.Name)
+	}
+
+	m.Family("velocity_connections_accept_waits_total",
+		"Accepts delayed by the connection limit while new connections queue in the kernel", metrics.Counter)
+	for _, c := range conns {
+		m.Sample("velocity_connections_accept_waits_total", float64(c.Waited), "listener", c.Name)
+	}
+
+	m.Family("velocity_connections_accept_wait_seconds_total", "Time accepts spent waiting for a free connection slot", metrics.Counter)
+	for _, c := range conns {
+		m.Sample("velocity_connections_accept_wait_seconds_total", c.WaitTime.Seconds(), "listener", c.Name)
+	}
+
+	m.Family("velocity_connection_duration_seconds", "Lifetime of closed client connections", metrics.Histogram)
+	for _, c := range conns {
+		m.Histogram("velocity_connection_duration_seconds", c.Lifetimes, "listener", c.Name)
+	}
+
+	m.Family("velocity_connection_requests", "Requests served per closed client connection", metrics.Histogram)
+	for _, c := range conns {
+		m.Histogram("velocity_connection_requests", c.Requests, "listener", c.Name)
+	}
+
+	var tlsConns []listener.Stats
+	for _, c := range conns {
+		if c.TLS {
+			tlsConns = append(tlsConns, c)
+		}
+	}
+
+	if len(tlsConns) == 0 {
+		return
+	}
+
+	m.Family("velocity_tls_handshake_failures_total", "Client connections closed before completing the TLS handshake", metrics.Counter)
+	for _, c := range tlsConns {
+		m.Sample("velocity_tls_handshake_failures_total", float64(c.HandshakeFailures), "listener", c.Name)
+	}
+
+	m.Family("velocity_tls_handshake_duration_seconds", "Duration of completed client TLS handshakes", metrics.Histogram)
+	for _, c := range tlsConns {
+		m.Histogram("velocity_tls_handshake_duration_seconds", c.Handshakes, "listener", c.Name)
+	}
+
+	if checker := revocation.Current(); checker != nil {
+		revocationStats := checker.Stats()
+		m.Family("velocity_client_cert_revocation_checks_total", "Client certificates checked for revocation by status", metrics.Counter)
+		for _, status := range []string{revocation.StatusGood, revocation.StatusRevoked, revocation.StatusUnknown, revocation.StatusUnchecked} {
+			m.Sample("velocity_client_cert_revocation_checks_total", float64(revocationStats.Checks[status]), "status", status)
+		}
+
+		m.Family("velocity_client_cert_revocation_fail_open_total", "Client certificates of unknown revocation status accepted because checks fail open", metrics.Counter)
+		m.Sample("velocity_client_cert_revocation_fail_open_total", float64(revocationStats.FailedOpen))
+	}
+}
+
+// targetPool is the stats of one proxy's targets
+type targetPool struct {
+	// tenant owns the pool, empty for the gateway's own targets
+	tenant string
+
+	// upstream names the pool's upstream group, empty for the gateway's
+	// and tenants' targets
+	upstream string
+
+	// stats holds the per-target statistics
+	stats []proxy.TargetStats
+
+	// affinity holds the session affinity counters when enabled
+	affinity *proxy.AffinityStats
+
+	// retries holds the retry budget counters when enabled
+	retries *proxy.RetryBudgetStats
+}
+
+// targetPools returns the gateway's pool followed by the tenant pools and
+// the upstream groups in name order, so the exposition is stable across
+// scrapes
+func (g *Gateway) targetPools() []targetPool {
+	pools := []targetPool{newTargetPool("", "", g.Proxy)}
+
+	names := make([]string, 0, len(g.Tenants))
+	for name := range g.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pools = append(pools, newTargetPool(name, "", g.Tenants[name].Proxy))
+	}
+
+	for _, name := range g.upstreamNames() {
+		pools = append(pools, newTargetPool("", name, g.Upstreams[name]))
+	}
+
+	return pools
+}
+
+// newTargetPool snapshots the statistics of a pool's proxy
+func newTargetPool(tenant, upstream string, p *proxy.Proxy) targetPool {
+	pool := targetPool{tenant: tenant, upstream: upstream, stats: p.GetStats()}
+	if affinity, ok := p.AffinityStats(); ok {
+		pool.affinity = &affinity
+	}
+
+	if retries, ok := p.RetryBudgetStats(); ok {
+		pool.retries = &retries
+	}
+
+	return pool
+}
+
+// boolValue converts a boolean to a gauge value
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/metrics"
+	"velocity/internal/throttle"
+)
+
+// reloadResults are the final reload outcomes, exported even before they
+// first occur so alerts on them have a series to watch
+var reloadResults = []string{"applied", "rejected", "rolled_back"}
+
+// reloadHistory counts configuration reloads. It lives outside Gateway
+// because every successful reload replaces the gateway.
+type reloadHistory struct {
+	// attempts counts started reloads
+	attempts atomic.Int64
+
+	// durations is the distribution of the time to load, build and swap
+	// in a configuration, or to reject it
+	durations *metrics.Buckets
+
+	// mu guards results
+	mu sync.Mutex
+
+	// results counts reloads by final outcome
+	results map[string]int64
+
+	// last is when each outcome last occurred
+	last map[string]time.Time
+}
+
+// reloads is the process-wide reload history
+var reloads = reloadHistory{
+	durations: metrics.NewBuckets(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	results:   make(map[string]int64),
+	last:      make(map[string]time.Time),
+}
+
+// RecordReloadAttempt counts a reload and how long it took to load, build
+// and swap in the new configuration, or to reject it
+func RecordReloadAttempt(d time.Duration) {
+	reloads.attempts.Add(1)
+	reloads.durations.Observe(d.Seconds())
+}
+
+// RecordReloadResult counts the final outcome of a reload: "applied",
+// "rejected" or "rolled_back"
+func RecordReloadResult(result string) {
+	reloads.mu.Lock()
+	defer reloads.mu.Unlock()
+
+	reloads.results[result]++
+	reloads.last[result] = time.Now()
+}
+
+// writeReloadMetrics exports the reload history, the identity and age of
+// the running configuration and the admission throttle applied around
+// swaps
+func (g *Gateway) writeReloadMetrics(m *metrics.Writer) {
+	reloads.mu.Lock()
+	results := make(map[string]int64, len(reloads.results))
+	last := make(map[string]time.Time, len(reloads.last))
+	for result, count := range reloads.results {
+		results[result] = count
+		last[result] = reloads.last[result]
+	}
+	reloads.mu.Unlock()
+
+	m.Family("velocity_config_reload_attempts_total", "Configuration reloads started", metrics.Counter)
+	m.Sample("velocity_config_reload_attempts_total", float64(reloads.attempts.Load()))
+
+	m.Family("velocity_config_reloads_total", "Configuration reloads by final result", metrics.Counter)
+	for _, result := range reloadResults {
+		m.Sample("velocity_config_reloads_total", float64(results[result]), "result", result)
+	}
+
+	m.Family("velocity_config_reload_last_timestamp_seconds", "Unix time of the last reload with each result", metrics.Gauge)
+	for _, result := range reloadResults {
+		if at, ok := last[result]; ok {
+			m.Sample("velocity_config_reload_last_timestamp_seconds", float64(at.Unix()), "result", result)
+		}
+	}
+
+	m.Family("velocity_config_reload_duration_seconds", "Time to load, build and swap in or reject a configuration", metrics.Histogram)
+	m.Histogram("velocity_config_reload_duration_seconds", reloads.durations.Snapshot())
+
+	m.Family("velocity_config_info", "Running configuration, identified by the hash of its file", metrics.Gauge)
+	m.Sample("velocity_config_info", 1, "hash", g.Config.Hash)
+
+	m.Family("velocity_config_age_seconds", "Time since the running configuration was loaded", metrics.Gauge)
+	m.Sample("velocity_config_age_seconds", time.Since(g.Created).Seconds())
+
+	applying := throttle.Global().Stats()
+
+	m.Family("velocity_apply_throttle_active", "Whether request admission is throttled (1) while a configuration or discovery update is applied", metrics.Gauge)
+	m.Sample("velocity_apply_throttle_active", boolValue(applying.Active))
+
+	m.Family("velocity_apply_throttle_windows_total", "Admission throttle windows opened, by reason", metrics.Counter)
+	for _, reason := range throttle.Reasons {
+		m.Sample("velocity_apply_throttle_windows_total", float64(applying.Windows[reason]), "reason", reason)
+	}
+
+	m.Family("velocity_apply_throttle_seconds_total", "Time request admission was throttled", metrics.Counter)
+	m.Sample("velocity_apply_throttle_seconds_total", applying.Throttled.Seconds())
+
+	m.Family("velocity_apply_throttle_requests_total", "Requests held back by the admission throttle, by result", metrics.Counter)
+	m.Sample("velocity_apply_throttle_requests_total", float64(applying.Delayed), "result", "delayed")
+	m.Sample("velocity_apply_throttle_requests_total", float64(applying.Rejected), "result", "rejected")
+}
@@ -0,0 +1,204 @@
+package gateway
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocity/internal/origin"
+	"velocity/internal/proxy"
+)
+
+// RouteTable describes what the gateway exposes, for developer portals
+// and tests that introspect the running configuration
+type RouteTable struct {
+	// Generated is when the configuration was applied
+	Generated time.Time `json:"generated"`
+
+	// Routes are the effective routes in match order: highest priority,
+	// then longest prefix first
+	Routes []RouteDescription `json:"routes"`
+
+	// Fallback describes how requests matching no route are handled: the
+	// upstream group "default", "route:<name>" for a fallback route or
+	// "status:<code>" for a fixed response
+	Fallback string `json:"fallback"`
+
+	// Upstreams are the upstream groups routes forward to
+	Upstreams []UpstreamGroup `json:"upstreams"`
+}
+
+// RouteDescription is one effective route
+type RouteDescription struct {
+	// Name identifies the route, prefixed "<tenant>/" for tenant routes
+	Name string `json:"name"`
+
+	// PathPrefix is the matched path prefix
+	PathPrefix string `json:"path_prefix"`
+
+	// Priority orders the route before routes of lower priority
+	Priority int `json:"priority,omitempty"`
+
+	// Tenant owns the route, empty for gateway routes
+	Tenant string `json:"tenant,omitempty"`
+
+	// Type is proxy, static, or the bucket origin's type
+	Type string `json:"type"`
+
+	// Methods are the accepted methods, absent when every method is
+	// forwarded
+	Methods []string `json:"methods,omitempty"`
+
+	// Conditions are the method and header conditions a request must meet
+	// besides its path, e.g. "header X-Api-Version = 2"
+	Conditions []string `json:"conditions,omitempty"`
+
+	// TrailingSlash is the trailing slash policy
+	TrailingSlash string `json:"trailing_slash"`
+
+	// CaseInsensitive reports whether the prefix ignores case
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// Authentication is "jwt" when clients must present a token, "none"
+	// otherwise
+	Authentication string `json:"authentication"`
+
+	// AnonymousPaths are reachable without a token
+	AnonymousPaths []string `json:"anonymous_paths,omitempty"`
+
+	// Upstream names the upstream group, bucket or directory serving the
+	// route: "default", "tenant:<name>", "upstream:<name>",
+	// "<type>:<bucket>", "static:<root>" or "respond"
+	Upstream string `json:"upstream"`
+
+	// Canary names the upstream group receiving a share of the route's
+	// traffic, if any
+	Canary string `json:"canary,omitempty"`
+
+	// Policies lists the policies applied to every request, in order
+	Policies []Policy `json:"policies"`
+}
+
+// UpstreamGroup is a pool of targets
+type UpstreamGroup struct {
+	// Name is "default", "tenant:<name>", "upstream:<name>" or
+	// "canary:<route>"
+	Name string `json:"name"`
+
+	// Discovery reports whether targets are discovered at runtime
+	Discovery bool `json:"discovery"`
+
+	// Targets are the pool's current targets
+	Targets []UpstreamTarget `json:"targets"`
+}
+
+// UpstreamTarget is one target of an upstream group
+type UpstreamTarget struct {
+	// URL is the target's address
+	URL string `json:"url"`
+
+	// Available reports whether the target is neither ejected nor
+	// failing its health check
+	Available bool `json:"available"`
+}
+
+// RouteTable describes the gateway's effective routes and upstream groups
+func (g *Gateway) RouteTable() RouteTable {
+	table := RouteTable{Generated: g.Created, Fallback: "default", Routes: []RouteDescription{}}
+	switch {
+	case g.routes.FallbackRoute() != nil:
+		table.Fallback = "route:" + g.routes.FallbackRoute().Config.Name
+	case g.Config.Fallback.Status != 0:
+		table.Fallback = "status:" + strconv.Itoa(g.Config.Fallback.Status)
+	}
+
+	authentication := "none"
+	if g.Config.Auth.JWT.Enabled {
+		authentication = "jwt"
+	}
+
+	for _, route := range g.routes.Routes() {
+		rc := route.Config
+
+		d := RouteDescription{
+			Name:            rc.Name,
+			PathPrefix:      rc.PathPrefix,
+			Priority:        rc.Priority,
+			Tenant:          rc.Tenant,
+			Type:            origin.RouteProxy,
+			TrailingSlash:   rc.TrailingSlash,
+			CaseInsensitive: rc.CaseInsensitive,
+			Authentication:  authentication,
+			AnonymousPaths:  rc.Anonymous.Paths,
+			Upstream:        "default",
+			Conditions:      route.Conditions(),
+			Policies:        []Policy{},
+		}
+
+		if allow := route.Allow(); allow != "" {
+			d.Methods = strings.Split(allow, ", ")
+		}
+
+		switch {
+		case rc.Type == origin.RouteStatic:
+			d.Type, d.Upstream = origin.RouteStatic, "static:"+rc.Static.Root
+		case rc.Type == origin.RouteRespond:
+			d.Type, d.Upstream = origin.RouteRespond, "respond"
+		case rc.Origin.Type != "":
+			d.Type, d.Upstream = rc.Origin.Type, rc.Origin.Type+":"+rc.Origin.Bucket
+		case rc.Tenant != "":
+			d.Upstream = "tenant:" + rc.Tenant
+		case rc.Upstream != "":
+			d.Upstream = "upstream:" + rc.Upstream
+		}
+
+		if len(rc.Canary.Targets) > 0 {
+			d.Canary = "canary:" + rc.Name
+		}
+
+		if rc.RateLimit.Enabled {
+			d.Policies = append(d.Policies, Policy{"rate_limit (route)", describeRateLimit(rc.RateLimit)})
+		}
+
+		if rc.Anonymous.RateLimit.Enabled {
+			d.Policies = append(d.Policies, Policy{"rate_limit (anonymous)", describeRateLimit(rc.Anonymous.RateLimit)})
+		}
+
+		d.Policies = append(d.Policies, routePolicies(rc)...)
+		table.Routes = append(table.Routes, d)
+	}
+
+	table.Upstreams = append(table.Upstreams, describeGroup("default", g.Config.Discovery.Enabled, g.Proxy))
+
+	names := make([]string, 0, len(g.Tenants))
+	for name := range g.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		table.Upstreams = append(table.Upstreams, describeGroup("tenant:"+name, false, g.Tenants[name].Proxy))
+	}
+
+	for _, name := range g.upstreamNames() {
+		table.Upstreams = append(table.Upstreams, describeGroup("upstream:"+name, false, g.Upstreams[name]))
+	}
+
+	for i, split := range g.Canaries {
+		table.Upstreams = append(table.Upstreams, describeGroup("canary:"+split.Route(), false, g.canaryProxies[i]))
+	}
+
+	return table
+}
+
+// describeGroup lists the targets of a pool
+func describeGroup(name string, discovery bool, p *proxy.Proxy) UpstreamGroup {
+	group := UpstreamGroup{Name: name, Discovery: discovery, Targets: []UpstreamTarget{}}
+
+	for _, stat := range p.GetStats() {
+		group.Targets = append(group.Targets, UpstreamTarget{URL: stat.Target, Available: !stat.Ejected && !stat.Down})
+	}
+
+	return group
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"velocity/internal/config"
+	"velocity/internal/proxy"
+	"velocity/pkg/logger"
+)
+
+// poolName restricts tenant and upstream group names to what is safe in
+// route names, log attributes, metric labels and admin API paths
+var poolName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Tenant is an isolated namespace of routes sharing a target pool and a
+// rate limit budget
+type Tenant struct {
+	// Name identifies the tenant
+	Name string
+
+	// Config is the tenant definition
+	Config config.TenantConfig
+
+	// Proxy forwards the tenant's requests to its own targets, with its
+	// own stats and connection pools
+	Proxy *proxy.Proxy
+}
+
+// buildTenants creates a proxy per tenant. Tenant proxies inherit the
+// gateway-wide upstream settings but use only the tenant's targets and
+// never discovery. A tenant's own egress proxy replaces the gateway's.
+func (g *Gateway) buildTenants(log *logger.Logger) error {
+	g.Tenants = make(map[string]*Tenant, len(g.Config.Tenants))
+
+	for _, tc := range g.Config.Tenants {
+		if !poolName.MatchString(tc.Name) {
+			return fmt.Errorf("tenant %q: name must match %s", tc.Name, poolName)
+		}
+
+		if _, exists := g.Tenants[tc.Name]; exists {
+			return fmt.Errorf("duplicate tenant %s", tc.Name)
+		}
+
+		tenantCfg := *g.Config
+		tenantCfg.Targets = tc.Targets
+		tenantCfg.Discovery.Enabled = false
+		if tc.EgressProxy.URL != "" {
+			tenantCfg.EgressProxy = tc.EgressProxy
+		}
+		tenantCfg.ConnectionPool = connectionPool(g.Config.ConnectionPool, tc.ConnectionPool)
+
+		tenantProxy, err := proxy.New(&tenantCfg, log.With("tenant", tc.Name))
+		if err != nil {
+			return fmt.Errorf("tenant %s: failed to create proxy: %w", tc.Name, err)
+		}
+
+		g.Tenants[tc.Name] = &Tenant{Name: tc.Name, Config: tc, Proxy: tenantProxy}
+	}
+
+	return nil
+}
+
+// routeConfigs returns the gateway routes followed by every tenant's
+// routes. Tenant route names are prefixed with "<tenant>/". A tenant's
+// path prefixes may not equal, contain or lie under any other owner's,
+// and its priorities are capped at 0, so one tenant cannot capture
+// another's traffic or the gateway's.
+func routeConfigs(cfg *config.Config) ([]config.RouteConfig, error) {
+	routes := append([]config.RouteConfig(nil), cfg.Routes...)
+
+	type claim struct{ prefix, owner string }
+	claims := make([]claim, 0, len(routes))
+
+	for _, rc := range routes {
+		claims = append(claims, claim{rc.PathPrefix, "gateway"})
+	}
+
+	for _, tc := range cfg.Tenants {
+		owner := "tenant " + tc.Name
+
+		for i, rc := range tc.Routes {
+			if rc.Name == "" {
+				rc.Name = fmt.Sprintf("route-%d", i)
+			}
+
+			rc.Name = tc.Name + "/" + rc.Name
+			rc.Tenant = tc.Name
+
+			// Priorities only order a tenant's own routes, which never
+			// overlap another owner's
+			rc.Priority = min(rc.Priority, 0)
+
+			// A tenant may split its own prefix between routes with match
+			// conditions, but never claim any part of another owner's
+			for _, c := range claims {
+				if c.owner != owner && prefixesOverlap(rc.PathPrefix, c.prefix) {
+					return nil, fmt.Errorf("route %s: path_prefix %s overlaps %s of %s",
+						rc.Name, rc.PathPrefix, c.prefix, c.owner)
+				}
+			}
+			claims = append(claims, claim{rc.PathPrefix, owner})
+
+			routes = append(routes, rc)
+		}
+	}
+
+	return routes, nil
+}
+
+// prefixesOverlap reports whether a request path could match both path
+// prefixes, compared case-insensitively as routes may match either way
+func prefixesOverlap(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return prefixWithin(a, b) || prefixWithin(b, a)
+}
+
+// prefixWithin reports whether inner equals outer or lies below it on a
+// segment boundary, ignoring trailing slashes
+func prefixWithin(inner, outer string) bool {
+	outer = strings.TrimSuffix(outer, "/")
+	inner = strings.TrimSuffix(inner, "/")
+	return inner == outer || strings.HasPrefix(inner, outer+"/")
+}
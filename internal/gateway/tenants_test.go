@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"velocity/internal/config"
+)
+
+func TestRouteConfigsRejectsNestedTenantPrefixes(t *testing.T) {
+	tests := []struct {
+		name   string
+		global []config.RouteConfig
+		a, b   string
+	}{
+		{name: "under another tenant", a: "/a", b: "/a/x"},
+		{name: "containing another tenant", a: "/a/x", b: "/a"},
+		{name: "same prefix, other case", a: "/a", b: "/A/"},
+		{name: "under a gateway route", global: []config.RouteConfig{{Name: "api", PathPrefix: "/api"}}, a: "/other", b: "/api/v2"},
+		{name: "containing a gateway route", global: []config.RouteConfig{{Name: "api", PathPrefix: "/api/v2"}}, a: "/other", b: "/api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Routes: tt.global,
+				Tenants: []config.TenantConfig{
+					{Name: "alpha", Routes: []config.RouteConfig{{Name: "r", PathPrefix: tt.a}}},
+					{Name: "beta", Routes: []config.RouteConfig{{Name: "r", PathPrefix: tt.b}}},
+				},
+			}
+
+			_, err := routeConfigs(cfg)
+			if err == nil || !strings.Contains(err.Error(), "overlaps") {
+				t.Fatalf("routeConfigs() error = %v, want an overlap error", err)
+			}
+		})
+	}
+}
+
+func TestRouteConfigsAllowsOwnAndSiblingPrefixes(t *testing.T) {
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{{Name: "api", PathPrefix: "/api"}},
+		Tenants: []config.TenantConfig{
+			{Name: "alpha", Routes: []config.RouteConfig{
+				{Name: "all", PathPrefix: "/a"},
+				{Name: "reports", PathPrefix: "/a/reports"},
+			}},
+			{Name: "beta", Routes: []config.RouteConfig{{Name: "r", PathPrefix: "/ab"}}},
+		},
+	}
+
+	routes, err := routeConfigs(cfg)
+	if err != nil {
+		t.Fatalf("routeConfigs() error = %v", err)
+	}
+
+	if len(routes) != 4 {
+		t.Fatalf("got %d routes, want 4", len(routes))
+	}
+}
+
+func TestRouteConfigsCapsTenantPriority(t *testing.T) {
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{{Name: "api", PathPrefix: "/api"}},
+		Tenants: []config.TenantConfig{
+			{Name: "alpha", Routes: []config.RouteConfig{
+				{Name: "high", PathPrefix: "/a", Priority: 100},
+				{Name: "low", PathPrefix: "/a/old", Priority: -1},
+			}},
+		},
+	}
+
+	routes, err := routeConfigs(cfg)
+	if err != nil {
+		t.Fatalf("routeConfigs() error = %v", err)
+	}
+
+	want := map[string]int{"api": 0, "alpha/high": 0, "alpha/low": -1}
+	for _, rc := range routes {
+		if rc.Priority != want[rc.Name] {
+			t.Errorf("route %s: priority = %d, want %d", rc.Name, rc.Priority, want[rc.Name])
+		}
+	}
+}
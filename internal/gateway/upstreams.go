@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+
+	"velocity/internal/config"
+	"velocity/internal/proxy"
+	"velocity/pkg/logger"
+)
+
+// buildUpstreams creates a proxy per upstream group. Like tenant proxies,
+// group proxies inherit the gateway-wide upstream settings but use only
+// the group's targets and never discovery.
+func (g *Gateway) buildUpstreams(log *logger.Logger) error {
+	g.Upstreams = make(map[string]*proxy.Proxy, len(g.Config.Upstreams))
+
+	for _, uc := range g.Config.Upstreams {
+		if !poolName.MatchString(uc.Name) {
+			return fmt.Errorf("upstream %q: name must match %s", uc.Name, poolName)
+		}
+
+		if _, exists := g.Upstreams[uc.Name]; exists {
+			return fmt.Errorf("duplicate upstream %s", uc.Name)
+		}
+
+		if len(uc.Targets) == 0 {
+			return fmt.Errorf("upstream %s: at least one target is required", uc.Name)
+		}
+
+		groupCfg := *g.Config
+		groupCfg.Targets = uc.Targets
+		groupCfg.Discovery.Enabled = false
+		if uc.EgressProxy.URL != "" {
+			groupCfg.EgressProxy = uc.EgressProxy
+		}
+		groupCfg.ConnectionPool = connectionPool(g.Config.ConnectionPool, uc.ConnectionPool)
+
+		groupProxy, err := proxy.New(&groupCfg, log.With("upstream", uc.Name))
+		if err != nil {
+			return fmt.Errorf("upstream %s: failed to create proxy: %w", uc.Name, err)
+		}
+
+		g.Upstreams[uc.Name] = groupProxy
+	}
+
+	return nil
+}
+
+// connectionPool returns the gateway's connection pool limits with the
+// settings a tenant or upstream group overrides replaced
+func connectionPool(base, override config.ConnectionPoolConfig) config.ConnectionPoolConfig {
+	if override.MaxConnsPerTarget != 0 {
+		base.MaxConnsPerTarget = override.MaxConnsPerTarget
+	}
+
+	if override.MaxIdleConnsPerTarget != 0 {
+		base.MaxIdleConnsPerTarget = override.MaxIdleConnsPerTarget
+	}
+
+	if override.IdleTimeout != 0 {
+		base.IdleTimeout = override.IdleTimeout
+	}
+
+	return base
+}
+
+// routeUpstream returns the proxy of the upstream group a route names, or
+// nil when it names none
+func (g *Gateway) routeUpstream(rc config.RouteConfig) (*proxy.Proxy, error) {
+	if rc.Upstream == "" {
+		return nil, nil
+	}
+
+	if rc.Tenant != "" {
+		return nil, fmt.Errorf("upstream: tenant routes forward to the tenant's targets")
+	}
+
+	group, ok := g.Upstreams[rc.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("upstream: unknown upstream group %q", rc.Upstream)
+	}
+
+	return group, nil
+}
+
+// upstreamNames returns the names of the upstream groups in order
+func (g *Gateway) upstreamNames() []string {
+	names := make([]string, 0, len(g.Upstreams))
+	for name := range g.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
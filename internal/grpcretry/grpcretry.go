@@ -0,0 +1,296 @@
+// Package grpcretry classifies gRPC answers by their grpc-status for
+// retries and target health.
+//
+// gRPC calls fail with HTTP 200 responses whose grpc-status trailer holds
+// the outcome. A call the server rejects before sending any message, e.g.
+// because it is shedding load, gets a trailers-only response: the status
+// arrives in the response headers and nothing has been streamed, so the
+// call can be retried on another target. The server may ask for a delay
+// before the retry with grpc-retry-pushback-ms, or for no retry at all
+// with a negative value.
+//
+// Like the response contract, the route middleware attaches the Policy to
+// the context of gRPC requests and the proxy classifies the upstream
+// response:
+//
+//	policy, err := grpcretry.New(route, cfg.GRPCRetry)
+//	...
+//	handler = middleware.Chain(handler, policy.Middleware())
+//	...
+//	if p := grpcretry.FromContext(ctx); p != nil {
+//		if status := p.Check(resp); status != nil {
+//			// retry after status.Pushback
+//		}
+//	}
+package grpcretry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Defaults for unset configuration
+const defaultMaxPushback = time.Second
+
+// Headers and trailers of gRPC responses
+const (
+	HeaderStatus   = "Grpc-Status"
+	HeaderPushback = "Grpc-Retry-Pushback-Ms"
+)
+
+// codes maps the gRPC status names to their codes
+var codes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+// defaultStatuses are retried when none are configured
+var defaultStatuses = []string{"UNAVAILABLE", "RESOURCE_EXHAUSTED"}
+
+// Policy decides which gRPC answers of one route are retried
+//
+// Thread safety: All methods are safe for concurrent use.
+type Policy struct {
+	// route is the name of the route
+	route string
+
+	// statuses holds the names of the retried status codes by code
+	statuses map[int]string
+
+	// maxPushback is the longest pushback waited before a retry
+	maxPushback time.Duration
+
+	// retryable counts answers turned into retries, refused answers whose
+	// upstream asked not to be retried, and failed calls failing after
+	// messages were streamed
+	retryable, refused, failed atomic.Int64
+}
+
+// Stats holds a policy's counters
+type Stats struct {
+	// Retryable is the number of upstream answers retried, or returned
+	// when no attempt was left
+	Retryable int64
+
+	// Refused is the number of answers with a retried status whose
+	// upstream asked not to be retried
+	Refused int64
+
+	// Failed is the number of calls that failed with a retried status
+	// after response messages were streamed
+	Failed int64
+}
+
+// StatusError is a retryable gRPC answer. It holds the answer so it can
+// be passed to the client when no retry succeeds.
+type StatusError struct {
+	// Status is the gRPC status name
+	Status string
+
+	// Pushback is the delay the upstream asked for before a retry
+	Pushback time.Duration
+
+	// StatusCode is the HTTP status of the answer
+	StatusCode int
+
+	// Header holds the answer's headers, including grpc-status
+	Header http.Header
+}
+
+// Error implements the error interface
+func (e *StatusError) Error() string {
+	return "upstream answered gRPC status " + e.Status
+}
+
+// Write passes the answer to the client
+func (e *StatusError) Write(w http.ResponseWriter) {
+	for name, values := range e.Header {
+		w.Header()[name] = values
+	}
+
+	w.WriteHeader(e.StatusCode)
+}
+
+// New creates the policy of a route, or returns nil when gRPC retries are
+// disabled.
+//
+// Returns an error for an unknown status name, OK, or a negative maximum
+// pushback.
+func New(route string, cfg config.GRPCRetryConfig) (*Policy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.MaxPushback < 0 {
+		return nil, fmt.Errorf("grpc_retry: max_pushback must not be negative")
+	}
+
+	names := cfg.Statuses
+	if len(names) == 0 {
+		names = defaultStatuses
+	}
+
+	p := &Policy{route: route, statuses: make(map[int]string, len(names)), maxPushback: cfg.MaxPushback}
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		code, ok := codes[name]
+		if !ok {
+			return nil, fmt.Errorf("grpc_retry: unknown status %q", name)
+		}
+
+		if code == 0 {
+			return nil, fmt.Errorf("grpc_retry: OK cannot be retried")
+		}
+
+		p.statuses[code] = name
+	}
+
+	if p.maxPushback == 0 {
+		p.maxPushback = defaultMaxPushback
+	}
+
+	return p, nil
+}
+
+// Route returns the name of the route
+func (p *Policy) Route() string {
+	return p.route
+}
+
+// Stats returns the policy's counters
+func (p *Policy) Stats() Stats {
+	return Stats{
+		Retryable: p.retryable.Load(),
+		Refused:   p.refused.Load(),
+		Failed:    p.failed.Load(),
+	}
+}
+
+// Middleware returns a middleware attaching p to the context of gRPC
+// requests. Returns nil when p is nil.
+func (p *Policy) Middleware() middleware.Middleware {
+	if p == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsGRPC(r) {
+				r = r.WithContext(WithPolicy(r.Context(), p))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IsGRPC reports whether r is a gRPC call
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// policyKey is the context key for the policy
+type policyKey struct{}
+
+// WithPolicy returns a copy of ctx carrying p
+func WithPolicy(ctx context.Context, p *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// FromContext returns the request's policy, or nil if the request is not
+// a gRPC call of a route retrying on gRPC statuses
+func FromContext(ctx context.Context) *Policy {
+	p, _ := ctx.Value(policyKey{}).(*Policy)
+	return p
+}
+
+// Check classifies an upstream answer before anything is sent to the
+// client. It returns the answer as a StatusError when it is a
+// trailers-only answer with a retried status whose upstream did not ask
+// to skip retries, and nil otherwise.
+func (p *Policy) Check(resp *http.Response) *StatusError {
+	name, ok := p.status(resp.Header)
+	if !ok {
+		return nil
+	}
+
+	pushback, ok := p.pushback(resp.Header)
+	if !ok {
+		p.refused.Add(1)
+		return nil
+	}
+
+	p.retryable.Add(1)
+	return &StatusError{Status: name, Pushback: pushback, StatusCode: resp.StatusCode, Header: resp.Header.Clone()}
+}
+
+// Failed reports whether a call whose answer was streamed to the client
+// ended with a retried status in its trailers, recording it
+func (p *Policy) Failed(resp *http.Response) bool {
+	if _, ok := p.status(resp.Trailer); !ok {
+		return false
+	}
+
+	p.failed.Add(1)
+	return true
+}
+
+// status returns the name of the retried status h holds, if any
+func (p *Policy) status(h http.Header) (string, bool) {
+	value := h.Get(HeaderStatus)
+	if value == "" {
+		return "", false
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return "", false
+	}
+
+	name, ok := p.statuses[code]
+	return name, ok
+}
+
+// pushback returns the delay h asks for before a retry, reporting false
+// when the upstream asks not to be retried or for too long a delay
+func (p *Policy) pushback(h http.Header) (time.Duration, bool) {
+	value := h.Get(HeaderPushback)
+	if value == "" {
+		return 0, true
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+
+	delay := time.Duration(ms) * time.Millisecond
+	if ms > int64(p.maxPushback/time.Millisecond) {
+		return 0, false
+	}
+
+	return delay, true
+}
@@ -0,0 +1,345 @@
+// Package gslb reports the gateway's health and capacity to external DNS
+// and global server load balancers.
+//
+// A GSLB choosing between regions usually probes each instance with a
+// plain health check, which says "up" as long as the process answers,
+// even when every target behind it is ejected or the instance is shedding
+// load. The gateway knows better, so it reports a weight instead:
+//
+//	weight = max_weight * healthy target share * (1 - utilization)
+//
+// where the healthy target share counts targets in rotation, recovering
+// ones by their reduced weight, and utilization is the busier of request
+// concurrency and buffered memory. The weight never drops below
+// min_weight while the instance can serve, and is 0 with status 503 once
+// it cannot:
+//
+//	{"instance":"gw-eu-1","region":"eu-west-1","zone":"eu-west-1a",
+//	 "status":"degraded","weight":61,"max_weight":100,"targets":4,
+//	 "healthy_targets":3,"utilization":0.18,"config_hash":"9f2c...",
+//	 "time":"2026-01-01T00:00:00Z"}
+//
+// Balancers poll /capacity, or a collector receives the same report
+// pushed periodically.
+//
+// Example usage:
+//
+//	reporter, err := gslb.New(cfg.GSLB, cfg.Hash, g.capacity, log)
+//	mux.Handle("/capacity", reporter)
+//	go reporter.Run(ctx)
+package gslb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset configuration
+const (
+	defaultMaxWeight    = 100
+	defaultMinWeight    = 1
+	defaultPushInterval = 30 * time.Second
+	defaultPushTimeout  = 5 * time.Second
+)
+
+// Instance statuses
+const (
+	// StatusHealthy means every target is in rotation and capacity is left
+	StatusHealthy = "healthy"
+
+	// StatusDegraded means some targets are out of rotation or the
+	// instance is at capacity, but it still serves
+	StatusDegraded = "degraded"
+
+	// StatusUnhealthy means the instance should receive no traffic
+	StatusUnhealthy = "unhealthy"
+)
+
+// Capacity is the gateway's state a report is derived from
+type Capacity struct {
+	// Targets counts the targets of every pool
+	Targets int
+
+	// Healthy counts the targets in rotation
+	Healthy int
+
+	// HealthyWeight sums the weights of the targets in rotation, 1 for a
+	// healthy target and less while one recovers from an ejection
+	HealthyWeight float64
+
+	// Utilization is the share of the request or memory capacity in use,
+	// whichever is higher, 0 when neither is limited
+	Utilization float64
+}
+
+// Report is the JSON document served and pushed
+type Report struct {
+	// Instance names the reporting instance
+	Instance string `json:"instance"`
+
+	// Region and Zone locate the instance
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+
+	// Status is StatusHealthy, StatusDegraded or StatusUnhealthy
+	Status string `json:"status"`
+
+	// Weight is the share of traffic the instance asks for, from 0 to
+	// MaxWeight
+	Weight int `json:"weight"`
+
+	// MaxWeight is the weight of a fully healthy, idle instance
+	MaxWeight int `json:"max_weight"`
+
+	// Targets and HealthyTargets count the targets and those in rotation
+	Targets        int `json:"targets"`
+	HealthyTargets int `json:"healthy_targets"`
+
+	// Utilization is the share of capacity in use
+	Utilization float64 `json:"utilization"`
+
+	// ConfigHash identifies the running configuration
+	ConfigHash string `json:"config_hash"`
+
+	// Time is when the report was made
+	Time time.Time `json:"time"`
+}
+
+// Reporter derives capacity reports and pushes them to a collector
+//
+// Thread safety: All methods are safe for concurrent use.
+type Reporter struct {
+	// cfg holds the settings with defaults applied
+	cfg config.GSLBConfig
+
+	// configHash identifies the running configuration
+	configHash string
+
+	// source samples the gateway's state
+	source func() Capacity
+
+	// client posts pushed reports
+	client *http.Client
+
+	// secrets resolves the push token
+	secrets *secrets.Store
+
+	// failing reports whether the last push failed, so outages are
+	// logged once
+	failing atomic.Bool
+
+	// pushed and failed count pushed reports by outcome
+	pushed, failed atomic.Int64
+
+	// logger for push failures
+	logger *logger.Logger
+}
+
+// Stats counts pushed reports
+type Stats struct {
+	// Pushed counts reports the collector accepted
+	Pushed int64
+
+	// Failed counts reports that could not be delivered
+	Failed int64
+}
+
+// New creates a reporter sampling the gateway through source, or returns
+// nil when GSLB reporting is disabled
+//
+// Returns an error for weights or shares out of range, negative
+// durations and invalid push URLs.
+func New(cfg config.GSLBConfig, configHash string, source func() Capacity, log *logger.Logger) (*Reporter, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.MaxWeight == 0 {
+		cfg.MaxWeight = defaultMaxWeight
+	}
+
+	if cfg.MinWeight == 0 {
+		cfg.MinWeight = defaultMinWeight
+	}
+
+	if cfg.MaxWeight < 1 || cfg.MinWeight < 1 || cfg.MinWeight > cfg.MaxWeight {
+		return nil, errors.New("gslb: weights must satisfy 1 <= min_weight <= max_weight")
+	}
+
+	if cfg.MinHealthyShare < 0 || cfg.MinHealthyShare > 1 {
+		return nil, errors.New("gslb: min_healthy_share must be between 0 and 1")
+	}
+
+	if cfg.Push.Interval < 0 || cfg.Push.Timeout < 0 {
+		return nil, errors.New("gslb: push interval and timeout must not be negative")
+	}
+
+	if cfg.Push.Interval == 0 {
+		cfg.Push.Interval = defaultPushInterval
+	}
+
+	if cfg.Push.Timeout == 0 {
+		cfg.Push.Timeout = defaultPushTimeout
+	}
+
+	if cfg.Push.URL != "" {
+		u, err := url.Parse(cfg.Push.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("gslb: push url must be an http or https URL")
+		}
+	}
+
+	if cfg.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("gslb: instance not set and hostname unavailable: %w", err)
+		}
+		cfg.Instance = hostname
+	}
+
+	return &Reporter{
+		cfg:        cfg,
+		configHash: configHash,
+		source:     source,
+		client:     &http.Client{Timeout: cfg.Push.Timeout},
+		secrets:    secrets.NewStore(time.Minute),
+		logger:     log.Component("gslb"),
+	}, nil
+}
+
+// Report samples the gateway and derives its weight and status
+func (r *Reporter) Report() Report {
+	c := r.source()
+
+	report := Report{
+		Instance:       r.cfg.Instance,
+		Region:         r.cfg.Region,
+		Zone:           r.cfg.Zone,
+		MaxWeight:      r.cfg.MaxWeight,
+		Targets:        c.Targets,
+		HealthyTargets: c.Healthy,
+		Utilization:    math.Round(min(max(c.Utilization, 0), 1)*1000) / 1000,
+		ConfigHash:     r.configHash,
+		Time:           time.Now().UTC(),
+	}
+
+	share := 0.0
+	if c.Targets > 0 {
+		share = min(c.HealthyWeight/float64(c.Targets), 1)
+	}
+
+	if share == 0 || share < r.cfg.MinHealthyShare {
+		report.Status = StatusUnhealthy
+		return report
+	}
+
+	weight := int(math.Round(float64(r.cfg.MaxWeight) * share * (1 - report.Utilization)))
+	report.Weight = min(max(weight, r.cfg.MinWeight), r.cfg.MaxWeight)
+
+	report.Status = StatusHealthy
+	if c.Healthy < c.Targets || share < 1 || report.Utilization >= 1 {
+		report.Status = StatusDegraded
+	}
+
+	return report
+}
+
+// Stats returns the push counters
+func (r *Reporter) Stats() Stats {
+	return Stats{Pushed: r.pushed.Load(), Failed: r.failed.Load()}
+}
+
+// ServeHTTP answers with the current report, with status 503 while the
+// instance is unhealthy. The report is never cached, as balancers act on
+// it.
+func (r *Reporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Report()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if report.Status == StatusUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// Run pushes a report every interval until ctx is canceled. It returns at
+// once when no push URL is configured.
+func (r *Reporter) Run(ctx context.Context) {
+	if r.cfg.Push.URL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(r.cfg.Push.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.push(ctx); err != nil {
+			r.failed.Add(1)
+			if !r.failing.Swap(true) {
+				r.logger.Warn("Capacity report push failed", "error", err)
+			}
+		} else {
+			r.pushed.Add(1)
+			if r.failing.Swap(false) {
+				r.logger.Info("Capacity report push recovered")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// push posts the current report to the collector
+func (r *Reporter) push(ctx context.Context) error {
+	body, err := json.Marshal(r.Report())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.Push.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "velocity-gslb")
+
+	if r.cfg.Push.Token != "" {
+		token, err := r.secrets.Get(r.cfg.Push.Token)
+		if err != nil {
+			return fmt.Errorf("push token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("collector answered status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+// Package headers filters request and response headers per route.
+//
+// Internal headers such as X-Internal-Debug leak easily: clients can send
+// them to influence backends, and backends return them to clients. A route
+// can declare exactly which headers cross the gateway in each direction,
+// either by denying specific headers or by denying everything that is not
+// explicitly allowed.
+//
+// Patterns match header names case-insensitively; a trailing "*" matches
+// any name with that prefix, e.g. "X-Internal-*".
+//
+// Example usage:
+//
+//	filter, err := headers.Middleware(routeCfg.Headers)
+//	if err != nil {
+//		return err
+//	}
+//	handler = middleware.Chain(handler, filter)
+package headers
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// framingHeaders always pass, even under deny-by-default, because message
+// bodies cannot be interpreted without them
+var framingHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Date":              true,
+}
+
+// Middleware returns a middleware applying the route's header policy, or
+// nil when the policy does not filter anything.
+//
+// Request headers are filtered before the request continues down the
+// chain, so headers added later by the gateway itself (such as injected
+// upstream credentials) are unaffected. Headers set by earlier middleware,
+// such as JWT claim headers, are filtered like client headers and must be
+// allowed under deny-by-default.
+func Middleware(cfg config.HeaderPolicyConfig) (middleware.Middleware, error) {
+	request, err := compile(cfg.Request)
+	if err != nil {
+		return nil, fmt.Errorf("headers.request: %w", err)
+	}
+
+	response, err := compile(cfg.Response)
+	if err != nil {
+		return nil, fmt.Errorf("headers.response: %w", err)
+	}
+
+	if request == nil && response == nil {
+		return nil, nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if request != nil {
+				request.apply(r.Header, framingHeaders)
+			}
+
+			if response != nil {
+				w = &filteringWriter{ResponseWriter: w, filter: response}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// filter is a compiled header filter for one direction
+type filter struct {
+	// denyByDefault drops headers not matched by allow
+	denyByDefault bool
+
+	// allow and deny hold the compiled patterns
+	allow, deny patterns
+}
+
+// compile builds a filter, returning nil if it would never drop a header
+func compile(cfg config.HeaderFilterConfig) (*filter, error) {
+	f := &filter{}
+
+	switch cfg.Default {
+	case "", "allow":
+	case "deny":
+		f.denyByDefault = true
+	default:
+		return nil, fmt.Errorf("unknown default %q, expected allow or deny", cfg.Default)
+	}
+
+	if !f.denyByDefault && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+
+	f.allow = compilePatterns(cfg.Allow)
+	f.deny = compilePatterns(cfg.Deny)
+	return f, nil
+}
+
+// permits reports whether a header may pass. Deny always wins over allow.
+func (f *filter) permits(name string) bool {
+	if f.deny.match(name) {
+		return false
+	}
+
+	return !f.denyByDefault || f.allow.match(name)
+}
+
+// apply removes headers the filter does not permit. Names in keep are
+// retained regardless of the policy.
+func (f *filter) apply(header http.Header, keep map[string]bool) {
+	for name := range header {
+		if !keep[name] && !f.permits(name) {
+			delete(header, name)
+		}
+	}
+}
+
+// patterns is a compiled set of header name patterns
+type patterns struct {
+	// exact holds canonical header names
+	exact map[string]bool
+
+	// prefixes holds canonical prefixes of wildcard patterns
+	prefixes []string
+}
+
+// compilePatterns canonicalizes exact names and wildcard prefixes
+func compilePatterns(list []string) patterns {
+	p := patterns{exact: make(map[string]bool, len(list))}
+
+	for _, pattern := range list {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			p.prefixes = append(p.prefixes, strings.ToLower(prefix))
+			continue
+		}
+
+		p.exact[textproto.CanonicalMIMEHeaderKey(pattern)] = true
+	}
+
+	return p
+}
+
+// match reports whether name matches any pattern
+func (p patterns) match(name string) bool {
+	if p.exact[textproto.CanonicalMIMEHeaderKey(name)] {
+		return true
+	}
+
+	if len(p.prefixes) == 0 {
+		return false
+	}
+
+	lower := strings.ToLower(name)
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filteringWriter removes response headers just before they are sent
+type filteringWriter struct {
+	http.ResponseWriter
+
+	// filter is the response header policy
+	filter *filter
+
+	// filtered reports whether the headers were already filtered
+	filtered bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (fw *filteringWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		// Informational responses carry their own headers
+		fw.filter.apply(fw.ResponseWriter.Header(), framingHeaders)
+	} else {
+		fw.filterOnce()
+	}
+
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (fw *filteringWriter) Write(b []byte) (int, error) {
+	fw.filterOnce()
+	return fw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (fw *filteringWriter) Flush() {
+	fw.filterOnce()
+
+	if flusher, ok := fw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (fw *filteringWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// filterOnce applies the response policy before the headers are sent
+func (fw *filteringWriter) filterOnce() {
+	if fw.filtered {
+		return
+	}
+
+	fw.filtered = true
+	fw.filter.apply(fw.ResponseWriter.Header(), framingHeaders)
+}
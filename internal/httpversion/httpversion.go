@@ -0,0 +1,220 @@
+// Package httpversion restricts the HTTP versions clients may use on a
+// route and counts the versions they negotiated.
+//
+// APIs with streaming semantics, such as gRPC or long-lived server pushes,
+// break in confusing ways over HTTP/1.0, which has no chunked encoding, or
+// over HTTP/1.x in general, which has no trailers in practice. A route can
+// require a minimum version and deny individual versions; other requests
+// are answered 505 HTTP Version Not Supported before reaching upstreams:
+//
+//	protocols:
+//	  min_version: "2"
+//
+// Versions are written "1.0", "1.1", "2" or "3", optionally prefixed with
+// "HTTP/".
+//
+// Example usage:
+//
+//	policy, err := httpversion.New(rc.Name, rc.Protocols)
+//	handler = middleware.Chain(handler, policy.Middleware())
+package httpversion
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	gwerrors "velocity/pkg/errors"
+)
+
+// version identifies an HTTP version, ordered from oldest to newest
+type version int
+
+// Supported HTTP versions
+const (
+	http10 version = iota
+	http11
+	http2
+	http3
+
+	versionCount
+)
+
+// names are the canonical names of the versions, as reported in metrics
+var names = [versionCount]string{"HTTP/1.0", "HTTP/1.1", "HTTP/2", "HTTP/3"}
+
+// String returns the canonical name of the version
+func (v version) String() string {
+	return names[v]
+}
+
+// parseVersion parses a configured version
+func parseVersion(s string) (version, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "HTTP/") {
+	case "1.0":
+		return http10, nil
+	case "1.1":
+		return http11, nil
+	case "2", "2.0":
+		return http2, nil
+	case "3", "3.0":
+		return http3, nil
+	}
+
+	return 0, fmt.Errorf("protocols: unknown HTTP version %q, expected 1.0, 1.1, 2 or 3", s)
+}
+
+// requestVersion returns the version a request was received over.
+// Versions before HTTP/1.0 never reach handlers.
+func requestVersion(r *http.Request) version {
+	switch {
+	case r.ProtoMajor >= 3:
+		return http3
+	case r.ProtoMajor == 2:
+		return http2
+	case r.ProtoMinor == 0:
+		return http10
+	default:
+		return http11
+	}
+}
+
+// Name returns the canonical name of the HTTP version of a request, such
+// as "HTTP/2"
+func Name(r *http.Request) string {
+	return requestVersion(r).String()
+}
+
+// Policy enforces the allowed HTTP versions of one route and counts
+// requests by version
+//
+// Thread safety: All methods are safe for concurrent use.
+type Policy struct {
+	// route is the name of the route
+	route string
+
+	// allowed reports, per version, whether requests may use it
+	allowed [versionCount]bool
+
+	// restricted reports whether any version is denied
+	restricted bool
+
+	// accepted and rejected count requests per version
+	accepted, rejected [versionCount]atomic.Int64
+}
+
+// VersionStats counts the requests received over one HTTP version
+type VersionStats struct {
+	// Protocol is the canonical version name, such as "HTTP/1.1"
+	Protocol string
+
+	// Accepted counts requests passed on to the route
+	Accepted int64
+
+	// Rejected counts requests answered 505
+	Rejected int64
+}
+
+// New creates the policy of a route
+func New(route string, cfg config.ProtocolPolicyConfig) (*Policy, error) {
+	p := &Policy{route: route}
+
+	minimum := http10
+	if cfg.MinVersion != "" {
+		v, err := parseVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		minimum = v
+	}
+
+	for v := range versionCount {
+		p.allowed[v] = v >= minimum
+	}
+
+	for _, denied := range cfg.Deny {
+		v, err := parseVersion(denied)
+		if err != nil {
+			return nil, err
+		}
+
+		p.allowed[v] = false
+	}
+
+	for v := range versionCount {
+		if !p.allowed[v] {
+			p.restricted = true
+		}
+	}
+
+	if p.restricted && len(p.Allowed()) == 0 {
+		return nil, fmt.Errorf("protocols: every HTTP version is denied")
+	}
+
+	return p, nil
+}
+
+// Route returns the name of the route
+func (p *Policy) Route() string {
+	return p.route
+}
+
+// Allowed returns the names of the versions the route accepts
+func (p *Policy) Allowed() []string {
+	var allowed []string
+	for v := range versionCount {
+		if p.allowed[v] {
+			allowed = append(allowed, v.String())
+		}
+	}
+
+	return allowed
+}
+
+// Restricted reports whether the route denies any HTTP version
+func (p *Policy) Restricted() bool {
+	return p.restricted
+}
+
+// Stats returns the request counts of every version that was used
+func (p *Policy) Stats() []VersionStats {
+	var stats []VersionStats
+	for v := range versionCount {
+		accepted, rejected := p.accepted[v].Load(), p.rejected[v].Load()
+		if accepted == 0 && rejected == 0 {
+			continue
+		}
+
+		stats = append(stats, VersionStats{Protocol: v.String(), Accepted: accepted, Rejected: rejected})
+	}
+
+	return stats
+}
+
+// Middleware returns a middleware counting requests by version and
+// rejecting the denied ones
+func (p *Policy) Middleware() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v := requestVersion(r)
+
+			if !p.allowed[v] {
+				p.rejected[v].Add(1)
+
+				gwerrors.New(gwerrors.CodeProtocolNotAllowed,
+					fmt.Sprintf("%s is not supported on this route, use one of %s", v, strings.Join(p.Allowed(), ", "))).
+					WithRoute(p.route).
+					WithContext("protocol", v.String()).
+					WriteJSON(w)
+				return
+			}
+
+			p.accepted[v].Add(1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,434 @@
+// Package ipbinding restricts where consumer credentials may be used from.
+//
+// A leaked API key works from anywhere. Binding each key to the networks
+// its consumer actually calls from turns a stolen key used elsewhere into
+// a violation the gateway reports, or blocks with 403 in block mode.
+//
+// Keys without a binding can be profiled instead. During a learning period
+// after a key's first request, the networks it is used from (/24 for IPv4,
+// /48 for IPv6 by default) are remembered; afterwards a request from a
+// network not seen before is an anomaly. Anomalies are reported but never
+// blocked, and the new network is remembered so it is reported once.
+//
+// Reports are logged, counted and delivered as webhook events, at most once
+// per credential and network per notify interval:
+//
+//	{"event":"ip_binding.violation","time":"...",
+//	 "data":{"consumer":"partner-a","network":"203.0.113.0/24",
+//	         "client_ip":"203.0.113.9","blocked":true,"method":"GET","path":"/api/orders"}}
+//
+// Credentials never appear in reports: bound consumers are named by their
+// binding, unbound ones by a short SHA-256 fingerprint of the credential.
+//
+// Example usage:
+//
+//	guard, err := ipbinding.New(cfg.IPBinding, log)
+//	handler = middleware.Chain(handler, guard.Middleware())
+package ipbinding
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+	"velocity/internal/secrets"
+	"velocity/internal/webhook"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Binding modes
+const (
+	// ModeFlag reports violations and forwards the request
+	ModeFlag = "flag"
+
+	// ModeBlock reports violations and rejects the request
+	ModeBlock = "block"
+)
+
+// Webhook events
+const (
+	// EventViolation is a bound credential used from outside its networks
+	EventViolation = "ip_binding.violation"
+
+	// EventAnomaly is an unbound credential used from a new network
+	EventAnomaly = "ip_binding.anomaly"
+)
+
+// Defaults for unset limits
+const (
+	defaultConsumer       = "header.X-API-Key"
+	defaultNotifyInterval = time.Hour
+	defaultLearningPeriod = 24 * time.Hour
+	defaultIPv4Prefix     = 24
+	defaultIPv6Prefix     = 48
+	defaultMaxConsumers   = 10000
+	defaultMaxNetworks    = 32
+
+	// maxNotified bounds the remembered notifications before expired
+	// ones are purged
+	maxNotified = 10000
+)
+
+// Guard checks the networks credentials are used from
+//
+// Thread safety: All methods are safe for concurrent use.
+type Guard struct {
+	// consumer evaluates the credential of a request
+	consumer ratelimit.KeyFunc
+
+	// block rejects violating requests instead of only reporting them
+	block bool
+
+	// bindings holds the bound credentials by value
+	bindings map[string]*binding
+
+	// detect profiles unbound credentials
+	detect bool
+
+	// learning is how long a new credential's networks are learned
+	learning time.Duration
+
+	// ipv4Prefix and ipv6Prefix group addresses into networks
+	ipv4Prefix, ipv6Prefix int
+
+	// maxConsumers and maxNetworks bound the profiles
+	maxConsumers, maxNetworks int
+
+	// notifyInterval is the least time between two reports of the same
+	// credential and network
+	notifyInterval time.Duration
+
+	// mu guards profiles and notified
+	mu sync.Mutex
+
+	// profiles holds the learned networks of unbound credentials by
+	// fingerprint
+	profiles map[string]*profile
+
+	// notified holds when each credential and network was last reported
+	notified map[string]time.Time
+
+	// allowed, flagged, blocked and anomalies count checked requests by
+	// outcome
+	allowed, flagged, blocked, anomalies atomic.Int64
+
+	// notifier delivers reports to webhooks
+	notifier *webhook.Notifier
+
+	// logger receives reports
+	logger *logger.Logger
+}
+
+// binding is a compiled binding rule
+type binding struct {
+	// name identifies the consumer in reports
+	name string
+
+	// networks are the allowed client networks
+	networks []netip.Prefix
+}
+
+// profile is what was learned about an unbound credential
+type profile struct {
+	// since is when the credential was first seen
+	since time.Time
+
+	// networks are the networks it was used from
+	networks map[netip.Prefix]bool
+}
+
+// Stats is a snapshot of a guard's outcomes
+type Stats struct {
+	// Allowed counts requests of bound credentials from their networks
+	Allowed int64 `json:"allowed"`
+
+	// Flagged counts violations forwarded in flag mode
+	Flagged int64 `json:"flagged"`
+
+	// Blocked counts violations rejected in block mode
+	Blocked int64 `json:"blocked"`
+
+	// Anomalies counts unbound credentials used from a new network
+	Anomalies int64 `json:"anomalies"`
+}
+
+// New creates a guard, or returns nil when IP binding is disabled.
+//
+// Returns an error for an invalid consumer expression, mode or network, or
+// a binding key that cannot be resolved.
+func New(cfg config.IPBindingConfig, log *logger.Logger) (*Guard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	consumer := cfg.Consumer
+	if consumer == "" {
+		consumer = defaultConsumer
+	}
+
+	key, err := ratelimit.ParseKey(consumer)
+	if err != nil {
+		return nil, fmt.Errorf("ip_binding: %w", err)
+	}
+
+	g := &Guard{
+		consumer:       key,
+		bindings:       make(map[string]*binding, len(cfg.Bindings)),
+		detect:         cfg.Anomalies.Enabled,
+		learning:       orDefault(cfg.Anomalies.LearningPeriod, defaultLearningPeriod),
+		ipv4Prefix:     orDefault(cfg.Anomalies.IPv4Prefix, defaultIPv4Prefix),
+		ipv6Prefix:     orDefault(cfg.Anomalies.IPv6Prefix, defaultIPv6Prefix),
+		maxConsumers:   orDefault(cfg.Anomalies.MaxConsumers, defaultMaxConsumers),
+		maxNetworks:    orDefault(cfg.Anomalies.MaxNetworks, defaultMaxNetworks),
+		notifyInterval: orDefault(cfg.NotifyInterval, defaultNotifyInterval),
+		profiles:       make(map[string]*profile),
+		notified:       make(map[string]time.Time),
+		notifier:       webhook.New(cfg.Webhooks, log),
+		logger:         log.Component("ip_binding"),
+	}
+
+	switch cfg.Mode {
+	case "", ModeFlag:
+	case ModeBlock:
+		g.block = true
+	default:
+		return nil, fmt.Errorf("ip_binding: unknown mode %q, expected flag or block", cfg.Mode)
+	}
+
+	if g.ipv4Prefix > 32 || g.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("ip_binding: anomalies: prefix lengths must be at most 32 for IPv4 and 128 for IPv6")
+	}
+
+	store := secrets.NewStore(0)
+	for i, rule := range cfg.Bindings {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("binding-%d", i)
+		}
+
+		value, err := store.Get(rule.Key)
+		if err != nil {
+			return nil, fmt.Errorf("ip_binding: %s: %w", name, err)
+		}
+
+		if value == "" {
+			return nil, fmt.Errorf("ip_binding: %s: key is required", name)
+		}
+
+		if _, taken := g.bindings[value]; taken {
+			return nil, fmt.Errorf("ip_binding: %s: key is already bound by %s", name, g.bindings[value].name)
+		}
+
+		if len(rule.Networks) == 0 {
+			return nil, fmt.Errorf("ip_binding: %s: at least one network is required", name)
+		}
+
+		b := &binding{name: name}
+		for _, cidr := range rule.Networks {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, fmt.Errorf("ip_binding: %s: invalid network: %w", name, err)
+			}
+
+			b.networks = append(b.networks, prefix.Masked())
+		}
+
+		g.bindings[value] = b
+	}
+
+	return g, nil
+}
+
+// orDefault returns value, or fallback when value is not positive
+func orDefault[T int | time.Duration](value, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+
+	return value
+}
+
+// Stats returns the outcomes so far
+func (g *Guard) Stats() Stats {
+	return Stats{
+		Allowed:   g.allowed.Load(),
+		Flagged:   g.flagged.Load(),
+		Blocked:   g.blocked.Load(),
+		Anomalies: g.anomalies.Load(),
+	}
+}
+
+// Middleware returns a middleware checking the network of every request
+// carrying a credential. Returns nil when g is nil.
+func (g *Guard) Middleware() middleware.Middleware {
+	if g == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			credential := g.consumer(r)
+			if credential == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addr, err := netip.ParseAddr(ratelimit.ClientIP(r))
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			addr = addr.Unmap()
+
+			if b, bound := g.bindings[credential]; bound {
+				if b.allows(addr) {
+					g.allowed.Add(1)
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				if g.block {
+					g.blocked.Add(1)
+				} else {
+					g.flagged.Add(1)
+				}
+				g.report(EventViolation, b.name, addr, r)
+
+				if g.block {
+					gwerrors.New(gwerrors.CodeNetworkNotAllowed, "Credential is not allowed from this network").
+						WriteJSON(w)
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if g.detect {
+				fingerprint := fingerprint(credential)
+				if g.observe(fingerprint, g.network(addr)) {
+					g.anomalies.Add(1)
+					g.report(EventAnomaly, fingerprint, addr, r)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allows reports whether addr is in one of the binding's networks
+func (b *binding) allows(addr netip.Addr) bool {
+	for _, prefix := range b.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// network returns the network grouping addr
+func (g *Guard) network(addr netip.Addr) netip.Prefix {
+	bits := g.ipv6Prefix
+	if addr.Is4() {
+		bits = g.ipv4Prefix
+	}
+
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// observe records a request of an unbound credential from network and
+// reports whether it is an anomaly: a network first seen after the
+// learning period
+func (g *Guard) observe(fingerprint string, network netip.Prefix) bool {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.profiles[fingerprint]
+	if !ok {
+		if len(g.profiles) >= g.maxConsumers {
+			for forgotten := range g.profiles {
+				delete(g.profiles, forgotten)
+				break
+			}
+		}
+
+		p = &profile{since: now, networks: make(map[netip.Prefix]bool)}
+		g.profiles[fingerprint] = p
+	}
+
+	if p.networks[network] || len(p.networks) >= g.maxNetworks {
+		return false
+	}
+	p.networks[network] = true
+
+	return now.Sub(p.since) >= g.learning
+}
+
+// report logs and notifies a violation or anomaly, unless the same
+// credential and network was reported within the notify interval
+func (g *Guard) report(event, consumer string, addr netip.Addr, r *http.Request) {
+	network := g.network(addr)
+	key := consumer + "|" + network.String()
+	now := time.Now()
+
+	g.mu.Lock()
+	if last, ok := g.notified[key]; ok && now.Sub(last) < g.notifyInterval {
+		g.mu.Unlock()
+		return
+	}
+
+	if len(g.notified) >= maxNotified {
+		for k, last := range g.notified {
+			if now.Sub(last) >= g.notifyInterval {
+				delete(g.notified, k)
+			}
+		}
+
+		if len(g.notified) >= maxNotified {
+			clear(g.notified)
+		}
+	}
+	g.notified[key] = now
+	g.mu.Unlock()
+
+	blocked := event == EventViolation && g.block
+	g.logger.Warn("Credential used from an unexpected network",
+		"event", event,
+		"consumer", consumer,
+		"network", network.String(),
+		"client_ip", addr.String(),
+		"blocked", blocked,
+		"method", r.Method,
+		"path", r.URL.Path,
+	)
+
+	g.notifier.Notify(event, map[string]interface{}{
+		"consumer":  consumer,
+		"network":   network.String(),
+		"client_ip": addr.String(),
+		"blocked":   blocked,
+		"method":    r.Method,
+		"path":      r.URL.Path,
+	})
+}
+
+// fingerprint names an unbound credential in reports without revealing it
+func fingerprint(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
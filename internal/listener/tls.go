@@ -0,0 +1,94 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"velocity/internal/config"
+	"velocity/internal/revocation"
+	"velocity/pkg/logger"
+)
+
+// ServerTLS builds the TLS configuration of the proxy listener from the
+// server's certificate and optional client CA bundle, checking client
+// certificates for revocation when configured. Returns nil when no
+// certificate is configured, so the listener serves plain HTTP.
+func ServerTLS(cfg config.ServerTLSConfig, log *logger.Logger) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+
+		cas, err := parseCertificates(pem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CA bundle %s: %w", cfg.ClientCAFile, err)
+		}
+
+		if len(cas) == 0 {
+			return nil, fmt.Errorf("client CA bundle contains no certificates: %s", cfg.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			tlsConfig.ClientCAs.AddCert(ca)
+		}
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.ClientAuth == "optional" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		checker, err := revocation.New(cfg.Revocation, cas, log)
+		if err != nil {
+			return nil, err
+		}
+
+		if checker != nil {
+			tlsConfig.VerifyConnection = checker.VerifyConnection
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseCertificates returns the certificates of a PEM bundle, skipping
+// blocks of other types
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
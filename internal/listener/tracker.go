@@ -0,0 +1,349 @@
+// Package listener tracks and limits the client connections of the
+// gateway's listeners.
+package listener
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/metrics"
+)
+
+// Tracker observes the client connections of one listener: how many are
+// accepted and open, how long they live, how many requests each carries,
+// how long TLS handshakes take and how often connections wait for a free
+// slot under the connection limit. These explain load balancer and
+// keep-alive behavior in front of the gateway, e.g. an LB that opens a
+// connection per request or recycles connections too aggressively.
+//
+// Trackers register themselves by name so the metrics endpoint can report
+// them regardless of which gateway instance is serving after reloads.
+//
+// Example usage:
+//
+//	tracker := listener.NewTracker("proxy", cfg.Server.MaxConnections)
+//	server := &http.Server{Handler: h, ConnState: tracker.ConnState}
+//	server.Serve(tracker.Listener(ln))
+//
+// Thread safety: All methods are safe for concurrent use.
+type Tracker struct {
+	// name identifies the listener in metrics
+	name string
+
+	// limit caps open connections, 0 for unlimited
+	limit int
+
+	// slots holds one token per open connection when limited
+	slots chan struct{}
+
+	// tls reports whether connections are expected to handshake TLS
+	tls atomic.Bool
+
+	// accepted counts accepted connections
+	accepted atomic.Int64
+
+	// waited counts accepts that had to wait for a free slot
+	waited atomic.Int64
+
+	// waitNanos is the total time accepts spent waiting for a slot
+	waitNanos atomic.Int64
+
+	// handshakeFailures counts connections closed before completing TLS
+	handshakeFailures atomic.Int64
+
+	// handshakes is the distribution of TLS handshake durations
+	handshakes *metrics.Buckets
+
+	// lifetimes is the distribution of closed connection lifetimes
+	lifetimes *metrics.Buckets
+
+	// requests is the distribution of requests served per connection
+	requests *metrics.Buckets
+
+	// mu guards open
+	mu sync.Mutex
+
+	// open holds the currently open connections
+	open map[*trackedConn]struct{}
+}
+
+// Stats is a snapshot of a tracker
+type Stats struct {
+	// Name identifies the listener
+	Name string
+
+	// Limit is the connection limit, 0 for unlimited
+	Limit int
+
+	// Accepted counts accepted connections
+	Accepted int64
+
+	// Open is the number of currently open connections
+	Open int
+
+	// OldestAge is the age of the oldest open connection
+	OldestAge time.Duration
+
+	// Waited counts accepts delayed because the limit was reached; while
+	// they wait, new connections queue in the kernel accept queue
+	Waited int64
+
+	// WaitTime is the total time accepts spent waiting for a slot
+	WaitTime time.Duration
+
+	// TLS reports whether the listener terminates TLS
+	TLS bool
+
+	// HandshakeFailures counts connections closed before completing TLS
+	HandshakeFailures int64
+
+	// Handshakes is the distribution of TLS handshake seconds
+	Handshakes metrics.BucketsSnapshot
+
+	// Lifetimes is the distribution of connection lifetimes in seconds
+	Lifetimes metrics.BucketsSnapshot
+
+	// Requests is the distribution of requests per closed connection
+	Requests metrics.BucketsSnapshot
+}
+
+// registry holds every tracker by name
+var registry sync.Map
+
+// NewTracker creates and registers the tracker of a listener. A tracker
+// with the same name replaces the previous one in the registry.
+func NewTracker(name string, maxConnections int) *Tracker {
+	t := &Tracker{
+		name:       name,
+		limit:      max(maxConnections, 0),
+		handshakes: metrics.NewBuckets(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5),
+		lifetimes:  metrics.NewBuckets(0.1, 1, 5, 15, 60, 300, 900, 3600),
+		requests:   metrics.NewBuckets(1, 2, 5, 10, 50, 100, 1000),
+		open:       make(map[*trackedConn]struct{}),
+	}
+
+	if t.limit > 0 {
+		t.slots = make(chan struct{}, t.limit)
+	}
+
+	registry.Store(name, t)
+	return t
+}
+
+// Trackers returns the registered trackers ordered by name
+func Trackers() []*Tracker {
+	var trackers []*Tracker
+	registry.Range(func(_, value any) bool {
+		trackers = append(trackers, value.(*Tracker))
+		return true
+	})
+
+	sort.Slice(trackers, func(i, j int) bool { return trackers[i].name < trackers[j].name })
+	return trackers
+}
+
+// Listener wraps l so its connections are tracked and limited
+func (t *Tracker) Listener(l net.Listener) net.Listener {
+	return &trackingListener{Listener: l, tracker: t, done: make(chan struct{})}
+}
+
+// TLSConfig returns a copy of base that times each TLS handshake. Use it
+// with tls.NewListener over the tracked listener.
+func (t *Tracker) TLSConfig(base *tls.Config) *tls.Config {
+	t.tls.Store(true)
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		conn, ok := hello.Conn.(*trackedConn)
+		if !ok {
+			return nil, nil
+		}
+
+		// The client hello has arrived; the handshake completes once the
+		// connection is verified
+		start := time.Now()
+		perConn := base.Clone()
+		perConn.VerifyConnection = func(state tls.ConnectionState) error {
+			if base.VerifyConnection != nil {
+				if err := base.VerifyConnection(state); err != nil {
+					return err
+				}
+			}
+
+			if conn.handshaked.CompareAndSwap(false, true) {
+				t.handshakes.Observe(time.Since(start).Seconds())
+			}
+			return nil
+		}
+
+		return perConn, nil
+	}
+
+	return cfg
+}
+
+// ConnState is an http.Server ConnState hook counting the requests served
+// on each connection. Every transition to active counts as one request,
+// so concurrent HTTP/2 streams on a busy connection count once.
+func (t *Tracker) ConnState(conn net.Conn, state http.ConnState) {
+	if state != http.StateActive {
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if tracked, ok := conn.(*trackedConn); ok {
+		tracked.requests.Add(1)
+	}
+}
+
+// Stats returns the tracker's current statistics
+func (t *Tracker) Stats() Stats {
+	s := Stats{
+		Name:              t.name,
+		Limit:             t.limit,
+		Accepted:          t.accepted.Load(),
+		Waited:            t.waited.Load(),
+		WaitTime:          time.Duration(t.waitNanos.Load()),
+		TLS:               t.tls.Load(),
+		HandshakeFailures: t.handshakeFailures.Load(),
+		Handshakes:        t.handshakes.Snapshot(),
+		Lifetimes:         t.lifetimes.Snapshot(),
+		Requests:          t.requests.Snapshot(),
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	s.Open = len(t.open)
+	for conn := range t.open {
+		s.OldestAge = max(s.OldestAge, now.Sub(conn.opened))
+	}
+	t.mu.Unlock()
+
+	return s
+}
+
+// acquire takes a connection slot, waiting while the limit is reached.
+// Returns false if the listener closed while waiting.
+func (t *Tracker) acquire(done <-chan struct{}) bool {
+	if t.slots == nil {
+		return true
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	t.waited.Add(1)
+	start := time.Now()
+	defer func() { t.waitNanos.Add(int64(time.Since(start))) }()
+
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// release frees a connection slot
+func (t *Tracker) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// closed records the end of a connection
+func (t *Tracker) closed(conn *trackedConn) {
+	t.mu.Lock()
+	delete(t.open, conn)
+	t.mu.Unlock()
+
+	t.lifetimes.Observe(time.Since(conn.opened).Seconds())
+	t.requests.Observe(float64(conn.requests.Load()))
+
+	if t.tls.Load() && !conn.handshaked.Load() {
+		t.handshakeFailures.Add(1)
+	}
+
+	t.release()
+}
+
+// trackingListener tracks and limits accepted connections
+type trackingListener struct {
+	net.Listener
+
+	// tracker records the connections
+	tracker *Tracker
+
+	// done is closed when the listener closes, releasing a blocked Accept
+	done chan struct{}
+
+	// closeOnce guards closing done
+	closeOnce sync.Once
+}
+
+// Accept implements net.Listener
+func (l *trackingListener) Accept() (net.Conn, error) {
+	if !l.tracker.acquire(l.done) {
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.tracker.release()
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn, tracker: l.tracker, opened: time.Now()}
+
+	l.tracker.accepted.Add(1)
+	l.tracker.mu.Lock()
+	l.tracker.open[tracked] = struct{}{}
+	l.tracker.mu.Unlock()
+
+	return tracked, nil
+}
+
+// Close implements net.Listener
+func (l *trackingListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// trackedConn is an accepted connection under observation
+type trackedConn struct {
+	net.Conn
+
+	// tracker records the connection's end
+	tracker *Tracker
+
+	// opened is when the connection was accepted
+	opened time.Time
+
+	// requests counts requests served on the connection
+	requests atomic.Int64
+
+	// handshaked reports whether the TLS handshake completed
+	handshaked atomic.Bool
+
+	// once ensures the close is recorded exactly once
+	once sync.Once
+}
+
+// Close implements net.Conn
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.tracker.closed(c) })
+	return err
+}
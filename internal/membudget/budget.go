@@ -0,0 +1,224 @@
+// Package membudget bounds the memory the gateway spends on buffering.
+//
+// Request bodies buffered for retries or signing, cached responses and
+// body transformations all hold payloads in memory. Without a global
+// limit, a handful of large concurrent payloads can get the process
+// OOM-killed. Every component that buffers reserves bytes from a shared
+// Budget first and falls back to streaming (or rejects the request) when
+// the reservation fails.
+//
+// The budget travels in the request context so buffering sites deep in
+// the pipeline can reach it without extra plumbing:
+//
+//	handler := membudget.Middleware(budget)(proxy)
+//	...
+//	data, release, replay, ok, err := membudget.BufferBody(
+//		membudget.FromContext(r.Context()), r.Body, maxBody)
+package membudget
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"velocity/internal/middleware"
+	gwerrors "velocity/pkg/errors"
+)
+
+// ErrExceeded is returned when a payload cannot be buffered within the
+// budget. It translates to a RESOURCE_EXHAUSTED gateway error.
+var ErrExceeded error = exceededError{}
+
+// exceededError is the type of ErrExceeded
+type exceededError struct{}
+
+// Error implements the error interface
+func (exceededError) Error() string {
+	return "memory budget exceeded"
+}
+
+// ErrorCode implements errors.Coder
+func (exceededError) ErrorCode() gwerrors.ErrorCode {
+	return gwerrors.CodeResourceExhausted
+}
+
+// chunkSize is the reservation granularity when reading bodies
+const chunkSize = 32 << 10
+
+// Budget tracks bytes currently buffered across the gateway
+//
+// Thread safety: All methods are safe for concurrent use.
+type Budget struct {
+	// limit is the maximum number of bytes that may be reserved at once
+	limit int64
+
+	// used is the number of bytes currently reserved
+	used int64
+
+	// rejected counts reservations refused for lack of budget
+	rejected int64
+}
+
+// Stats is a snapshot of budget usage
+type Stats struct {
+	// Limit is the configured budget in bytes
+	Limit int64
+
+	// Used is the number of bytes currently reserved
+	Used int64
+
+	// Rejected is the number of refused reservations
+	Rejected int64
+}
+
+// New creates a budget of limit bytes. A non-positive limit returns nil,
+// which disables accounting: a nil Budget grants every reservation.
+func New(limit int64) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &Budget{limit: limit}
+}
+
+// Reserve claims n bytes. Returns false without reserving anything if the
+// budget would be exceeded.
+func (b *Budget) Reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	if atomic.AddInt64(&b.used, n) > b.limit {
+		atomic.AddInt64(&b.used, -n)
+		atomic.AddInt64(&b.rejected, 1)
+		return false
+	}
+
+	return true
+}
+
+// Release returns n previously reserved bytes
+func (b *Budget) Release(n int64) {
+	if b == nil {
+		return
+	}
+
+	atomic.AddInt64(&b.used, -n)
+}
+
+// Stats returns current usage
+func (b *Budget) Stats() Stats {
+	if b == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Limit:    b.limit,
+		Used:     atomic.LoadInt64(&b.used),
+		Rejected: atomic.LoadInt64(&b.rejected),
+	}
+}
+
+// budgetKey is the context key for the budget
+type budgetKey struct{}
+
+// WithBudget returns a copy of ctx carrying budget
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// FromContext returns the request's budget, or nil (unlimited) if none
+func FromContext(ctx context.Context) *Budget {
+	budget, _ := ctx.Value(budgetKey{}).(*Budget)
+	return budget
+}
+
+// Middleware attaches budget to every request context.
+// Returns nil when budget is nil.
+func Middleware(budget *Budget) middleware.Middleware {
+	if budget == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithBudget(r.Context(), budget)))
+		})
+	}
+}
+
+// BufferBody reads body into memory, reserving budget as it goes.
+//
+// Returns:
+//
+//	data: The complete body when ok is true
+//	release: Returns the reserved bytes; call when data is no longer needed
+//	replay: When ok is false, a reader yielding the bytes already consumed
+//	        followed by the unread remainder, for falling back to streaming
+//	ok: Whether the whole body fit within max and the budget
+//	err: Read error from body
+func BufferBody(budget *Budget, body io.ReadCloser, max int64) (data []byte, release func(), replay io.ReadCloser, ok bool, err error) {
+	var buf bytes.Buffer
+	var reserved int64
+
+	release = func() { budget.Release(reserved) }
+	chunk := make([]byte, chunkSize)
+
+	for {
+		n, readErr := body.Read(chunk)
+		if n > 0 {
+			if int64(buf.Len()+n) > max || !budget.Reserve(int64(n)) {
+				buf.Write(chunk[:n])
+				release()
+
+				replay = readCloser{
+					Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), body),
+					Closer: body,
+				}
+				return nil, func() {}, replay, false, nil
+			}
+
+			reserved += int64(n)
+			buf.Write(chunk[:n])
+		}
+
+		if readErr == io.EOF {
+			body.Close()
+			return buf.Bytes(), release, nil, true, nil
+		}
+
+		if readErr != nil {
+			release()
+			return nil, func() {}, nil, false, readErr
+		}
+	}
+}
+
+// NewBody returns a request body over data that calls release when closed.
+// The HTTP transport closes request bodies once sent, so the reservation
+// lives exactly as long as the payload is needed.
+func NewBody(data []byte, release func()) io.ReadCloser {
+	return &releasingBody{Reader: bytes.NewReader(data), release: release}
+}
+
+// releasingBody releases its reservation on the first Close
+type releasingBody struct {
+	*bytes.Reader
+	release func()
+	once    sync.Once
+}
+
+// Close implements io.Closer
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return nil
+}
+
+// readCloser combines a reader with the original body's Close
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
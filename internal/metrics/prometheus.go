@@ -0,0 +1,175 @@
+// Package metrics writes gateway statistics in the Prometheus text
+// exposition format.
+//
+// The gateway keeps its own counters in the components that own them
+// (proxy, dialer, shedder, memory budget); this package only renders
+// snapshots of them, so scraping never touches the request path and no
+// client library is needed. Buckets is the one collector provided here,
+// for components that record distributions.
+//
+// Example usage:
+//
+//	m := metrics.NewWriter(w)
+//	m.Family("velocity_target_requests_total", "Requests proxied to a target", metrics.Counter)
+//	m.Sample("velocity_target_requests_total", 42, "target", "http://backend1:3000")
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metric types
+const (
+	// Counter is a monotonically increasing value
+	Counter = "counter"
+
+	// Gauge is a value that can go up and down
+	Gauge = "gauge"
+
+	// Histogram is a distribution of observations in cumulative buckets
+	Histogram = "histogram"
+)
+
+// labelEscaper escapes label values per the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writer renders metric families and samples
+type Writer struct {
+	// w receives the exposition output
+	w io.Writer
+}
+
+// NewWriter creates a writer emitting to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Family writes the HELP and TYPE lines introducing a metric. All samples
+// of a metric must directly follow its family.
+func (m *Writer) Family(name, help, metricType string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Sample writes one sample. Labels are given as alternating names and
+// values.
+func (m *Writer) Sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+
+	if len(labels) > 0 {
+		b.WriteByte('{')
+
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+
+		b.WriteByte('}')
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+
+	io.WriteString(m.w, b.String())
+}
+
+// Buckets is a concurrent histogram with fixed upper bounds
+//
+// Thread safety: All methods are safe for concurrent use.
+type Buckets struct {
+	// bounds are the inclusive upper bounds in increasing order
+	bounds []float64
+
+	// counts holds per-bucket observation counts, the last for +Inf
+	counts []atomic.Int64
+
+	// sumBits holds the float64 bits of the sum of observations
+	sumBits atomic.Uint64
+}
+
+// BucketsSnapshot is a point-in-time copy of a histogram
+type BucketsSnapshot struct {
+	// Bounds are the bucket upper bounds
+	Bounds []float64
+
+	// Cumulative holds the number of observations at or below each bound
+	Cumulative []int64
+
+	// Count is the total number of observations
+	Count int64
+
+	// Sum is the sum of all observations
+	Sum float64
+}
+
+// NewBuckets creates a histogram with the given upper bounds, which must
+// be in increasing order
+func NewBuckets(bounds ...float64) *Buckets {
+	return &Buckets{
+		bounds: bounds,
+		counts: make([]atomic.Int64, len(bounds)+1),
+	}
+}
+
+// Observe records a value
+func (b *Buckets) Observe(v float64) {
+	i := sort.SearchFloat64s(b.bounds, v)
+	b.counts[i].Add(1)
+
+	for {
+		old := b.sumBits.Load()
+		if b.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the current bucket counts
+func (b *Buckets) Snapshot() BucketsSnapshot {
+	s := BucketsSnapshot{
+		Bounds:     b.bounds,
+		Cumulative: make([]int64, len(b.bounds)),
+		Sum:        math.Float64frombits(b.sumBits.Load()),
+	}
+
+	for i := range b.counts {
+		s.Count += b.counts[i].Load()
+		if i < len(b.bounds) {
+			s.Cumulative[i] = s.Count
+		}
+	}
+
+	return s
+}
+
+// Histogram writes the bucket, sum and count samples of a histogram. The
+// family must have been introduced with the Histogram type.
+func (m *Writer) Histogram(name string, s BucketsSnapshot, labels ...string) {
+	// Appending the le label must never write into the caller's array
+	labels = labels[:len(labels):len(labels)]
+
+	for i, bound := range s.Bounds {
+		m.Sample(name+"_bucket", float64(s.Cumulative[i]),
+			append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+
+	m.Sample(name+"_bucket", float64(s.Count), append(labels, "le", "+Inf")...)
+	m.Sample(name+"_sum", s.Sum, labels...)
+	m.Sample(name+"_count", float64(s.Count), labels...)
+}
@@ -0,0 +1,14 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// CompleteBody reports whether a response body of n bytes matches the
+// Content-Length announced in header, if any. Middlewares keeping a copy of
+// a response use it to drop bodies the upstream cut short.
+func CompleteBody(header http.Header, n int) bool {
+	length := header.Get("Content-Length")
+	return length == "" || length == strconv.Itoa(n)
+}
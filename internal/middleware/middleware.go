@@ -0,0 +1,32 @@
+// Package middleware provides the request pipeline building blocks used in
+// front of the proxy.
+//
+// A middleware wraps an http.Handler and returns a new handler, so features
+// such as authentication or header rewriting can be composed without the
+// proxy knowing about them.
+//
+// Example usage:
+//
+//	handler := middleware.Chain(proxy, authMiddleware, headerMiddleware)
+//	http.Handle("/", handler)
+package middleware
+
+import "net/http"
+
+// Middleware wraps a handler with additional request processing
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares to h. The first middleware is the outermost, so
+// it sees the request first and the response last.
+//
+// Nil middlewares are skipped, which lets callers build chains from
+// optional, config-driven features without extra branching.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			h = middlewares[i](h)
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Recovery turns panics in handlers and middleware into 500 responses
+//
+// Without recovery, net/http logs the panic to stderr and drops the
+// connection, so clients see a reset instead of an error and the panic
+// bypasses structured logging. Recovery logs the panic with its stack as a
+// critical GatewayError, counts it, and answers with a clean 500 if the
+// response has not started yet.
+//
+// Panics with http.ErrAbortHandler are passed through, since they are the
+// standard way to abort a response deliberately. Panics in goroutines
+// started by handlers cannot be recovered here.
+//
+// Thread safety: All methods are safe for concurrent use.
+type Recovery struct {
+	// panics counts recovered panics
+	panics atomic.Int64
+
+	// logger receives panic reports
+	logger *logger.Logger
+}
+
+// NewRecovery creates a recovery middleware provider
+func NewRecovery(log *logger.Logger) *Recovery {
+	return &Recovery{logger: log.Component("recovery")}
+}
+
+// Panics returns the number of panics recovered so far
+func (rc *Recovery) Panics() int64 {
+	return rc.panics.Load()
+}
+
+// Middleware returns the recovery middleware
+func (rc *Recovery) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tracker := &startTracker{ResponseWriter: w}
+
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				rc.panics.Add(1)
+
+				gatewayErr := errors.New(errors.CodeInternal, "Internal server error").
+					WithSeverity(errors.SeverityCritical).
+					WithContext("panic", fmt.Sprint(recovered)).
+					WithContext("method", r.Method).
+					WithContext("path", r.URL.Path).
+					WithContext("response_started", tracker.started).
+					WithStack()
+				gatewayErr.Log(rc.logger)
+
+				if tracker.started {
+					// The status line is already sent; aborting is the only
+					// way to signal the failure to the client
+					panic(http.ErrAbortHandler)
+				}
+
+				gatewayErr.WriteJSON(w)
+			}()
+
+			next.ServeHTTP(tracker, r)
+		})
+	}
+}
+
+// startTracker records whether a response has started
+type startTracker struct {
+	http.ResponseWriter
+
+	// started reports whether headers or body were written
+	started bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (t *startTracker) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		t.started = true
+	}
+
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (t *startTracker) Write(b []byte) (int, error) {
+	t.started = true
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (t *startTracker) Flush() {
+	t.started = true
+
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (t *startTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
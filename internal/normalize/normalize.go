@@ -0,0 +1,150 @@
+// Package normalize canonicalizes request targets and Host headers before
+// routing.
+//
+// Proxies are a common target for host-header confusion: a request can
+// name its target both in an absolute-form request URI
+// ("GET http://a.example/ HTTP/1.1") and in the Host header, and different
+// components may pick different ones. net/http already rejects requests
+// with several Host headers and gives the absolute-form authority
+// precedence as RFC 9112 requires. This package makes the remaining
+// behaviour explicit: absolute-form requests are either rewritten to
+// origin-form or rejected, Host values are canonicalized, and optionally
+// only known hosts are accepted.
+package normalize
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Middleware returns a middleware applying the normalization policy.
+//
+// Rejected requests receive 400 Bad Request (malformed or absolute-form
+// when rejecting) or 421 Misdirected Request (host not allowed).
+func Middleware(cfg config.NormalizationConfig) (middleware.Middleware, error) {
+	switch cfg.AbsoluteURI {
+	case "", "normalize", "reject":
+	default:
+		return nil, fmt.Errorf("request_normalization: unknown absolute_uri policy %q", cfg.AbsoluteURI)
+	}
+
+	// Entries without a port allow the name on any port, entries with one
+	// only that exact authority
+	names := make(map[string]bool, len(cfg.AllowedHosts))
+	authorities := make(map[string]bool, len(cfg.AllowedHosts))
+	for _, host := range cfg.AllowedHosts {
+		canonical := canonicalHost(host, "")
+		if name, port, err := net.SplitHostPort(canonical); err == nil {
+			authorities[net.JoinHostPort(name, port)] = true
+		} else {
+			names[hostname(canonical)] = true
+		}
+	}
+	restricted := len(cfg.AllowedHosts) > 0
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect && isAbsoluteForm(r) {
+				if cfg.AbsoluteURI == "reject" {
+					reject(w, http.StatusBadRequest, "absolute-form request URI not accepted")
+					return
+				}
+
+				// Rewrite to origin-form; r.Host already holds the
+				// authority from the request URI
+				r.RequestURI = r.URL.RequestURI()
+				r.URL.Scheme = ""
+				r.URL.Host = ""
+				r.URL.User = nil
+			}
+
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+
+			if r.Host == "" {
+				reject(w, http.StatusBadRequest, "missing host")
+				return
+			}
+
+			host := canonicalHost(r.Host, scheme)
+			if strings.ContainsAny(host, "/\\@ ") {
+				reject(w, http.StatusBadRequest, "invalid host")
+				return
+			}
+
+			if restricted && !names[hostname(host)] && !authorities[authority(host, scheme)] {
+				reject(w, http.StatusMisdirectedRequest, "unknown host")
+				return
+			}
+
+			r.Host = host
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// isAbsoluteForm reports whether the request line used an absolute URI
+func isAbsoluteForm(r *http.Request) bool {
+	return r.URL.IsAbs()
+}
+
+// canonicalHost lowercases a host, strips a trailing dot from the name
+// and drops the scheme's default port
+func canonicalHost(host, scheme string) string {
+	host = strings.ToLower(host)
+
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+
+		return name
+	}
+
+	return net.JoinHostPort(name, port)
+}
+
+// authority returns host with its port, the scheme's default port when
+// it has none, so port-qualified entries compare exactly
+func authority(host, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(hostname(host), port)
+}
+
+// hostname returns host without its port
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+
+	return strings.Trim(host, "[]")
+}
+
+// reject writes a JSON error response
+func reject(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	fmt.Fprintf(w, `{"error":"%s"}`, message)
+}
@@ -0,0 +1,55 @@
+package normalize
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"velocity/internal/config"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	mw, err := Middleware(config.NormalizationConfig{
+		AllowedHosts: []string{"api.example.com:8443", "www.example.com", "secure.example.com:443"},
+	})
+	if err != nil {
+		t.Fatalf("Middleware() error = %v", err)
+	}
+
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		host  string
+		https bool
+		want  int
+	}{
+		{host: "api.example.com:8443", want: http.StatusOK},
+		{host: "API.example.com.:8443", want: http.StatusOK},
+		{host: "api.example.com:9000", want: http.StatusMisdirectedRequest},
+		{host: "api.example.com", want: http.StatusMisdirectedRequest},
+		{host: "www.example.com", want: http.StatusOK},
+		{host: "www.example.com:9000", want: http.StatusOK},
+		{host: "secure.example.com", https: true, want: http.StatusOK},
+		{host: "secure.example.com:443", https: true, want: http.StatusOK},
+		{host: "secure.example.com", want: http.StatusMisdirectedRequest},
+		{host: "other.example.com", want: http.StatusMisdirectedRequest},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tt.host
+		if tt.https {
+			r.TLS = &tls.ConnectionState{}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("host %q (https %t): status %d, want %d", tt.host, tt.https, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Package origin serves routes from object storage buckets, local
+// directories and configured responses.
+//
+// Static assets and maintenance pages rarely justify a file server of
+// their own behind the gateway. A route with a bucket origin answers GET
+// and HEAD requests with objects fetched from an S3 or GCS bucket, signed
+// with AWS Signature Version 4 (GCS through its S3 compatible XML API and
+// HMAC keys). A static route serves files from a local directory instead.
+// Either way the object key or file path is the request path below the
+// route's prefix, so a route "/assets/" maps "/assets/app.js" to
+// "app.js".
+//
+// A respond route needs neither: it answers with a status, headers and
+// body from its configuration, for stub endpoints, robots.txt or
+// deprecation notices. Placeholders such as "{{ path }}" are evaluated
+// per request with the expression language of script rules.
+//
+// Validators, conditional and range headers are passed through, so
+// clients revalidate and resume as they would against a file server. A
+// missing object is answered with the configured not-found object, or a
+// plain 404.
+//
+// Example usage:
+//
+//	bucket, err := origin.New(rc, store, log)
+//	if bucket != nil {
+//		upstream = bucket
+//	}
+package origin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+	"velocity/internal/upstreamauth"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Origin types
+const (
+	// TypeS3 is an Amazon S3 bucket, or an S3 compatible store
+	TypeS3 = "s3"
+
+	// TypeGCS is a Google Cloud Storage bucket
+	TypeGCS = "gcs"
+)
+
+// defaultIndex is the object served for paths ending in a slash
+const defaultIndex = "index.html"
+
+// conditionalHeaders are the request headers passed to the bucket
+var conditionalHeaders = []string{
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Range",
+}
+
+// objectHeaders are the bucket response headers relayed to clients.
+// Service specific headers such as x-amz-* stay internal.
+var objectHeaders = []string{
+	"Accept-Ranges", "Cache-Control", "Content-Disposition", "Content-Encoding",
+	"Content-Language", "Content-Length", "Content-Range", "Content-Type",
+	"ETag", "Expires", "Last-Modified",
+}
+
+// Origin answers a route's requests in place of its targets
+type Origin interface {
+	http.Handler
+
+	// Route returns the name of the served route
+	Route() string
+
+	// Stats returns the origin's current statistics
+	Stats() Stats
+
+	// Close releases the origin's connections or files
+	Close()
+}
+
+// Bucket serves one route's requests from a bucket
+//
+// Thread safety: All methods are safe for concurrent use.
+type Bucket struct {
+	// route is the name of the served route
+	route string
+
+	// pathPrefix is the route's path prefix, removed to form keys
+	pathPrefix string
+
+	// cfg holds the origin settings with defaults applied
+	cfg config.OriginConfig
+
+	// base is the service endpoint
+	base *url.URL
+
+	// signer signs requests to the bucket
+	signer *upstreamauth.SigV4Signer
+
+	// transport holds the connections to the service
+	transport *http.Transport
+
+	// logger reports bucket failures
+	logger *logger.Logger
+
+	// served, notFound and failed count requests by outcome
+	served, notFound, failed atomic.Int64
+}
+
+// Stats is a snapshot of an origin
+type Stats struct {
+	// Served counts requests answered with an object or file, including
+	// 304 and 206 responses
+	Served int64
+
+	// NotFound counts requests for missing objects or files
+	NotFound int64
+
+	// Failed counts requests the origin could not answer
+	Failed int64
+}
+
+// New validates a route's origin and returns the bucket serving it, or nil
+// when the route is served by its targets
+func New(rc config.RouteConfig, store *secrets.Store, log *logger.Logger) (*Bucket, error) {
+	cfg := rc.Origin
+
+	var endpoint string
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case TypeS3:
+		if cfg.Region == "" {
+			return nil, errors.New("origin: s3 requires region")
+		}
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	case TypeGCS:
+		if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+			return nil, errors.New("origin: gcs requires an HMAC access_key_id and secret_access_key")
+		}
+		if cfg.Region == "" {
+			cfg.Region = "auto"
+		}
+		endpoint = "https://storage.googleapis.com"
+	default:
+		return nil, fmt.Errorf("origin: unknown type %q, expected %s or %s", cfg.Type, TypeS3, TypeGCS)
+	}
+
+	if cfg.Bucket == "" || strings.Contains(cfg.Bucket, "/") {
+		return nil, errors.New("origin: bucket must be a bucket name")
+	}
+
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("origin: invalid endpoint %q", endpoint)
+	}
+
+	if cfg.Index == "" {
+		cfg.Index = defaultIndex
+	}
+
+	provider, err := upstreamauth.NewAWSProvider(config.AWSSigV4Config{
+		Region:          cfg.Region,
+		Service:         "s3",
+		Profile:         cfg.Profile,
+		AccessKeyID:     cfg.AccessKeyID,
+		SecretAccessKey: cfg.SecretAccessKey,
+	}, store)
+	if err != nil {
+		return nil, fmt.Errorf("origin: %w", err)
+	}
+
+	return &Bucket{
+		route:      rc.Name,
+		pathPrefix: rc.PathPrefix,
+		cfg:        cfg,
+		base:       base,
+		signer:     upstreamauth.NewSigV4Signer(cfg.Region, "s3", provider),
+		transport:  http.DefaultTransport.(*http.Transport).Clone(),
+		logger:     log.Component("origin"),
+	}, nil
+}
+
+// Route returns the name of the served route
+func (b *Bucket) Route() string {
+	return b.route
+}
+
+// Stats returns the bucket's current statistics
+func (b *Bucket) Stats() Stats {
+	return Stats{
+		Served:   b.served.Load(),
+		NotFound: b.notFound.Load(),
+		Failed:   b.failed.Load(),
+	}
+}
+
+// Close releases idle connections to the bucket
+func (b *Bucket) Close() {
+	b.transport.CloseIdleConnections()
+}
+
+// ServeHTTP answers GET and HEAD requests with the object at the request
+// path
+func (b *Bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r, b.route) {
+		return
+	}
+
+	key, ok := b.key(r.URL.Path)
+	if !ok {
+		b.missing(w, r)
+		return
+	}
+
+	resp, err := b.fetch(r, key, true)
+	if err != nil {
+		b.fail(w, key, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified,
+		http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+		b.served.Add(1)
+		relay(w, resp, resp.StatusCode)
+	case http.StatusNotFound:
+		b.missing(w, r)
+	default:
+		b.fail(w, key, fmt.Errorf("bucket answered %s", resp.Status))
+	}
+}
+
+// key maps a request path to an object key. Paths with dot segments have
+// no key.
+func (b *Bucket) key(requestPath string) (string, bool) {
+	relative, ok := relativePath(requestPath, b.pathPrefix)
+	if !ok {
+		return "", false
+	}
+
+	if relative == "" || strings.HasSuffix(relative, "/") {
+		relative += b.cfg.Index
+	}
+
+	return b.cfg.KeyPrefix + relative, true
+}
+
+// relativePath returns the request path below the route's prefix, without
+// a leading slash. Paths with dot segments are rejected.
+func relativePath(requestPath, pathPrefix string) (string, bool) {
+	relative := requestPath
+	if len(relative) >= len(pathPrefix) {
+		relative = relative[len(pathPrefix):]
+	}
+	relative = strings.TrimPrefix(relative, "/")
+
+	for _, segment := range strings.Split(relative, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+
+	return relative, true
+}
+
+// fetch sends a signed request for an object, with the client's
+// conditional and range headers when conditional is set
+func (b *Bucket) fetch(r *http.Request, key string, conditional bool) (*http.Response, error) {
+	target := *b.base
+	target.Path = path.Join("/", b.base.Path, b.cfg.Bucket) + "/" + key
+	target.RawPath = upstreamauth.EscapePath(target.Path)
+	target.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, b.base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &target
+
+	if conditional {
+		for _, name := range conditionalHeaders {
+			if value := r.Header.Get(name); value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+
+	if err := b.signer.Sign(req); err != nil {
+		return nil, err
+	}
+
+	return b.transport.RoundTrip(req)
+}
+
+// missing answers a request for an object that does not exist, with the
+// not-found object when one is configured
+func (b *Bucket) missing(w http.ResponseWriter, r *http.Request) {
+	b.notFound.Add(1)
+
+	if b.cfg.NotFound != "" {
+		key := b.cfg.KeyPrefix + b.cfg.NotFound
+
+		resp, err := b.fetch(r, key, false)
+		if err == nil {
+			defer resp.Body.Close()
+
+			if resp.StatusCode == http.StatusOK {
+				relay(w, resp, http.StatusNotFound)
+				return
+			}
+
+			err = fmt.Errorf("bucket answered %s", resp.Status)
+		}
+
+		b.logger.Warn("Not-found object unavailable", "route", b.route, "key", key, "error", err)
+	}
+
+	gwerrors.New(gwerrors.CodeNotFound, "Not found").
+		WithRoute(b.route).
+		WriteJSON(w)
+}
+
+// fail answers a request the bucket could not serve
+func (b *Bucket) fail(w http.ResponseWriter, key string, err error) {
+	b.failed.Add(1)
+	b.logger.Warn("Origin request failed", "route", b.route, "bucket", b.cfg.Bucket, "key", key, "error", err)
+
+	gwerrors.Translate(err).
+		WithRoute(b.route).
+		WriteJSON(w)
+}
+
+// readOnly answers 405 to requests other than GET and HEAD and reports
+// whether the request may be served
+func readOnly(w http.ResponseWriter, r *http.Request, route string) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	gwerrors.New(gwerrors.CodeMethodNotAllowed, "Only GET and HEAD are served on this route").
+		WithRoute(route).
+		WriteJSON(w)
+	return false
+}
+
+// relay copies an object response to the client with status
+func relay(w http.ResponseWriter, resp *http.Response, status int) {
+	for _, name := range objectHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+
+	w.WriteHeader(status)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,263 @@
+package origin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/script"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// RouteRespond answers a route's requests with a configured response
+const RouteRespond = "respond"
+
+// defaultContentType is the Content-Type of configured responses
+const defaultContentType = "text/plain; charset=utf-8"
+
+// Response answers one route's requests with a configured response
+//
+// Thread safety: All methods are safe for concurrent use.
+type Response struct {
+	// route is the name of the served route
+	route string
+
+	// status is the response status
+	status int
+
+	// headers are the response headers, sorted by name
+	headers []responseHeader
+
+	// body is the response body
+	body template
+
+	// logger reports placeholders failing to evaluate
+	logger *logger.Logger
+
+	// served and failed count requests by outcome
+	served, failed atomic.Int64
+}
+
+// responseHeader is one configured response header
+type responseHeader struct {
+	// name is the canonical header name
+	name string
+
+	// value is the header value
+	value template
+}
+
+// template is a text with placeholders, evaluated for each request
+type template []templatePart
+
+// templatePart is literal text, or a placeholder when expr is set
+type templatePart struct {
+	// text is the literal text
+	text string
+
+	// expr is the placeholder's expression
+	expr *script.Expr
+}
+
+// NewResponse returns the response answering a respond route, or nil for
+// other route types
+//
+// Returns an error for statuses outside 200-599, bodies on responses that
+// cannot have one, unreadable body files and invalid placeholders.
+func NewResponse(rc config.RouteConfig, log *logger.Logger) (*Response, error) {
+	if rc.Type != RouteRespond {
+		return nil, nil
+	}
+
+	cfg := rc.Respond
+	if rc.Origin.Type != "" {
+		return nil, errors.New("respond: a respond route cannot also have an origin")
+	}
+
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusOK
+	}
+
+	if cfg.Status < 200 || cfg.Status > 599 {
+		return nil, fmt.Errorf("respond: invalid status %d", cfg.Status)
+	}
+
+	if cfg.BodyFile != "" {
+		if cfg.Body != "" {
+			return nil, errors.New("respond: body and body_file are mutually exclusive")
+		}
+
+		data, err := os.ReadFile(cfg.BodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("respond: %w", err)
+		}
+		cfg.Body = string(data)
+	}
+
+	if cfg.Body != "" && (cfg.Status == http.StatusNoContent || cfg.Status == http.StatusNotModified) {
+		return nil, fmt.Errorf("respond: status %d cannot have a body", cfg.Status)
+	}
+
+	body, err := compileTemplate(cfg.Body, cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("respond: body: %w", err)
+	}
+
+	values := make(map[string]string, len(cfg.Headers)+1)
+	if cfg.Body != "" {
+		values["Content-Type"] = defaultContentType
+		if cfg.ContentType != "" {
+			values["Content-Type"] = cfg.ContentType
+		}
+	}
+
+	for name, value := range cfg.Headers {
+		values[http.CanonicalHeaderKey(name)] = value
+	}
+
+	headers := make([]responseHeader, 0, len(values))
+	for name, value := range values {
+		if name == "Content-Length" {
+			return nil, errors.New("respond: Content-Length is set from the body")
+		}
+
+		compiled, err := compileTemplate(value, cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("respond: header %s: %w", name, err)
+		}
+
+		headers = append(headers, responseHeader{name: name, value: compiled})
+	}
+
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+
+	return &Response{
+		route:   rc.Name,
+		status:  cfg.Status,
+		headers: headers,
+		body:    body,
+		logger:  log.Component("origin"),
+	}, nil
+}
+
+// Route returns the name of the served route
+func (s *Response) Route() string {
+	return s.route
+}
+
+// Stats returns the response's current statistics
+func (s *Response) Stats() Stats {
+	return Stats{
+		Served: s.served.Load(),
+		Failed: s.failed.Load(),
+	}
+}
+
+// Close does nothing; a configured response holds no resources
+func (s *Response) Close() {}
+
+// ServeHTTP answers a request with the configured response, without the
+// body for HEAD requests
+func (s *Response) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := make([]string, len(s.headers))
+	for i, h := range s.headers {
+		value, err := h.value.render(r)
+		if err != nil {
+			s.fail(w, "header "+h.name, err)
+			return
+		}
+		values[i] = value
+	}
+
+	body, err := s.body.render(r)
+	if err != nil {
+		s.fail(w, "body", err)
+		return
+	}
+
+	s.served.Add(1)
+
+	for i, h := range s.headers {
+		w.Header().Set(h.name, values[i])
+	}
+
+	if body != "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	w.WriteHeader(s.status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body))
+	}
+}
+
+// fail answers a request whose placeholder failed to evaluate
+func (s *Response) fail(w http.ResponseWriter, part string, err error) {
+	s.failed.Add(1)
+	s.logger.Warn("Response placeholder failed", "route", s.route, "part", part, "error", err)
+
+	gwerrors.New(gwerrors.CodeInternal, "Response could not be rendered").
+		WithRoute(s.route).
+		WriteJSON(w)
+}
+
+// compileTemplate splits src into literal text and "{{ expression }}"
+// placeholders, or keeps it literal when placeholders are disabled
+func compileTemplate(src string, placeholders bool) (template, error) {
+	if !placeholders {
+		return template{{text: src}}, nil
+	}
+
+	var t template
+	for {
+		start := strings.Index(src, "{{")
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(src[start+2:], "}}")
+		if end < 0 {
+			return nil, errors.New("unclosed {{")
+		}
+
+		expr, err := script.Compile(src[start+2 : start+2+end])
+		if err != nil {
+			return nil, fmt.Errorf("placeholder %q: %w", src[start:start+2+end+2], err)
+		}
+
+		t = append(t, templatePart{text: src[:start]}, templatePart{expr: expr})
+		src = src[start+2+end+2:]
+	}
+
+	return append(t, templatePart{text: src}), nil
+}
+
+// render evaluates the placeholders of a template against a request
+func (t template) render(r *http.Request) (string, error) {
+	if len(t) == 1 && t[0].expr == nil {
+		return t[0].text, nil
+	}
+
+	var b strings.Builder
+	for _, part := range t {
+		if part.expr == nil {
+			b.WriteString(part.text)
+			continue
+		}
+
+		value, err := part.expr.Text(r)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", part.expr, err)
+		}
+		b.WriteString(value)
+	}
+
+	return b.String(), nil
+}
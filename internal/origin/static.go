@@ -0,0 +1,212 @@
+package origin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"velocity/internal/config"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+)
+
+// Route types
+const (
+	// RouteProxy forwards a route's requests to its targets
+	RouteProxy = "proxy"
+
+	// RouteStatic serves a route's requests from a local directory
+	RouteStatic = "static"
+)
+
+// Directory serves one route's requests from a local directory
+//
+// Thread safety: All methods are safe for concurrent use.
+type Directory struct {
+	// route is the name of the served route
+	route string
+
+	// pathPrefix is the route's path prefix, removed to form file paths
+	pathPrefix string
+
+	// cfg holds the static settings with defaults applied
+	cfg config.StaticConfig
+
+	// root confines file access to the served directory
+	root *os.Root
+
+	// logger reports file system failures
+	logger *logger.Logger
+
+	// served, notFound and failed count requests by outcome
+	served, notFound, failed atomic.Int64
+}
+
+// NewDirectory validates a route's type and returns the directory serving
+// it, or nil for proxy and respond routes
+func NewDirectory(rc config.RouteConfig, log *logger.Logger) (*Directory, error) {
+	switch rc.Type {
+	case "", RouteProxy, RouteRespond:
+		return nil, nil
+	case RouteStatic:
+	default:
+		return nil, fmt.Errorf("unknown route type %q, expected %s, %s or %s", rc.Type, RouteProxy, RouteStatic, RouteRespond)
+	}
+
+	cfg := rc.Static
+	if cfg.Root == "" {
+		return nil, errors.New("static: root is required")
+	}
+
+	if rc.Origin.Type != "" {
+		return nil, errors.New("static: a static route cannot also have an origin")
+	}
+
+	if cfg.Index == "" {
+		cfg.Index = defaultIndex
+	}
+
+	root, err := os.OpenRoot(cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("static: %w", err)
+	}
+
+	return &Directory{
+		route:      rc.Name,
+		pathPrefix: rc.PathPrefix,
+		cfg:        cfg,
+		root:       root,
+		logger:     log.Component("origin"),
+	}, nil
+}
+
+// Route returns the name of the served route
+func (d *Directory) Route() string {
+	return d.route
+}
+
+// Stats returns the directory's current statistics
+func (d *Directory) Stats() Stats {
+	return Stats{
+		Served:   d.served.Load(),
+		NotFound: d.notFound.Load(),
+		Failed:   d.failed.Load(),
+	}
+}
+
+// Close releases the served directory
+func (d *Directory) Close() {
+	d.root.Close()
+}
+
+// ServeHTTP answers GET and HEAD requests with the file at the request
+// path, or the index file of the directory there
+func (d *Directory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r, d.route) {
+		return
+	}
+
+	name, ok := relativePath(r.URL.Path, d.pathPrefix)
+	if ok && !hidden(name) {
+		if d.serve(w, r, name) {
+			return
+		}
+	}
+
+	if d.cfg.Fallback != "" && d.serve(w, r, d.cfg.Fallback) {
+		return
+	}
+
+	d.notFound.Add(1)
+	gwerrors.New(gwerrors.CodeNotFound, "Not found").
+		WithRoute(d.route).
+		WriteJSON(w)
+}
+
+// serve writes the file at name, relative to the root, and reports whether
+// it exists
+func (d *Directory) serve(w http.ResponseWriter, r *http.Request, name string) bool {
+	file, info, err := d.open(name)
+	if err != nil {
+		d.logMissing(name, err)
+		return false
+	}
+	defer file.Close()
+
+	d.served.Add(1)
+
+	// Validators derived from the file let clients revalidate without the
+	// body, also through caches that ignore Last-Modified
+	w.Header().Set("ETag", `W/"`+strconv.FormatInt(info.Size(), 16)+"-"+strconv.FormatInt(info.ModTime().UnixNano(), 16)+`"`)
+	if d.cfg.CacheControl != "" {
+		w.Header().Set("Cache-Control", d.cfg.CacheControl)
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return true
+}
+
+// open opens the regular file at name, or the index file when name is a
+// directory
+func (d *Directory) open(name string) (*os.File, fs.FileInfo, error) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+
+	for range 2 {
+		file, err := d.root.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+
+		if info.Mode().IsRegular() {
+			return file, info, nil
+		}
+
+		file.Close()
+		if !info.IsDir() {
+			break
+		}
+		name = path.Join(name, d.cfg.Index)
+	}
+
+	return nil, nil, fs.ErrNotExist
+}
+
+// logMissing records a file that could not be opened. Missing files are
+// expected; anything else, such as a permission problem or a symbolic link
+// leaving the root, is logged.
+func (d *Directory) logMissing(name string, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return
+	}
+
+	d.failed.Add(1)
+	d.logger.Warn("Static file unavailable", "route", d.route, "file", name, "error", err)
+}
+
+// hidden reports whether a path has a segment starting with a dot, such as
+// ".env" or ".git/config"
+func hidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,287 @@
+// Package plugins loads third-party middleware declared in configuration.
+//
+// Teams extend request handling with plugins instead of forking the
+// gateway. A plugin is either a Go shared object loaded into the gateway
+// process, which runs at full speed but must be built with the gateway's
+// exact Go version and can never be unloaded, or a separate process the
+// gateway talks to over its standard input and output, which can be
+// written in any language and cannot crash the gateway. See
+// velocity/pkg/plugin for writing process plugins.
+//
+// Global plugins run on every request, after authentication and before
+// routing; others run on the routes listing them.
+//
+// Example usage:
+//
+//	registry, err := plugins.Load(cfg.Plugins, log)
+//	defer registry.Close()
+//	handler = middleware.Chain(handler, registry.Global())
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/pkg/logger"
+)
+
+// Plugin types
+const (
+	// TypeGo loads a Go shared object into the gateway process
+	TypeGo = "go"
+
+	// TypeProcess runs the plugin as a separate process
+	TypeProcess = "process"
+)
+
+// Registry holds the loaded plugins
+//
+// Thread safety: All methods are safe for concurrent use.
+type Registry struct {
+	// plugins are the loaded plugins in configuration order
+	plugins []*loaded
+
+	// byName indexes plugins by name
+	byName map[string]*loaded
+}
+
+// loaded is one loaded plugin
+type loaded struct {
+	// cfg is the plugin's declaration
+	cfg config.PluginConfig
+
+	// middleware runs the plugin on a request
+	middleware middleware.Middleware
+
+	// process is the plugin process, nil for Go plugins
+	process *process
+}
+
+// Stats holds the call statistics of a process plugin
+type Stats struct {
+	// Name is the plugin name
+	Name string
+
+	// Calls is the number of requests sent to the plugin
+	Calls int64
+
+	// Failures is the number of calls that failed or timed out
+	Failures int64
+
+	// Restarts is the number of times the process was restarted
+	Restarts int64
+}
+
+// Load loads every declared plugin, or returns nil when none are. Process
+// plugins are started and initialized before Load returns.
+//
+// Returns an error for an invalid declaration or a plugin that cannot be
+// loaded or started. Plugins loaded before the failure are closed.
+func Load(cfgs []config.PluginConfig, log *logger.Logger) (*Registry, error) {
+	pluginLogger := log.Component("plugin")
+	return register(cfgs, func(cfg config.PluginConfig) (*loaded, error) {
+		return load(cfg, pluginLogger)
+	})
+}
+
+// Declare validates every declared plugin without loading or starting it,
+// or returns nil when none are. Declared plugins let requests through
+// untouched; Declare serves configuration validation, where running
+// third-party code is not wanted.
+//
+// Returns an error for an invalid declaration.
+func Declare(cfgs []config.PluginConfig) (*Registry, error) {
+	return register(cfgs, func(cfg config.PluginConfig) (*loaded, error) {
+		if err := check(cfg); err != nil {
+			return nil, err
+		}
+
+		return &loaded{cfg: cfg}, nil
+	})
+}
+
+// register builds the registry of the declared plugins with open, closing
+// the plugins opened before a failure
+func register(cfgs []config.PluginConfig, open func(config.PluginConfig) (*loaded, error)) (*Registry, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	r := &Registry{byName: make(map[string]*loaded, len(cfgs))}
+
+	for _, cfg := range cfgs {
+		if _, ok := r.byName[cfg.Name]; ok {
+			r.Close()
+			return nil, fmt.Errorf("plugins: duplicate plugin %q", cfg.Name)
+		}
+
+		p, err := open(cfg)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		r.plugins = append(r.plugins, p)
+		r.byName[cfg.Name] = p
+	}
+
+	return r, nil
+}
+
+// check validates a declaration
+func check(cfg config.PluginConfig) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("plugins: every plugin requires a name")
+	}
+
+	if cfg.Path == "" {
+		return fmt.Errorf("plugins: %s: path is required", cfg.Name)
+	}
+
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("plugins: %s: timeout must not be negative", cfg.Name)
+	}
+
+	switch cfg.Type {
+	case TypeGo:
+		if len(cfg.Args) > 0 || cfg.Timeout > 0 || cfg.FailOpen {
+			return fmt.Errorf("plugins: %s: args, timeout and fail_open apply to process plugins only", cfg.Name)
+		}
+
+	case TypeProcess:
+
+	default:
+		return fmt.Errorf("plugins: %s: unknown type %q, expected %s or %s", cfg.Name, cfg.Type, TypeGo, TypeProcess)
+	}
+
+	return nil
+}
+
+// load validates a declaration and loads the plugin
+func load(cfg config.PluginConfig, log *logger.Logger) (*loaded, error) {
+	if err := check(cfg); err != nil {
+		return nil, err
+	}
+
+	p := &loaded{cfg: cfg}
+
+	if cfg.Type == TypeGo {
+		mw, err := loadShared(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("plugins: %s: %w", cfg.Name, err)
+		}
+
+		p.middleware = mw
+		return p, nil
+	}
+
+	proc, err := startProcess(cfg, log.With("plugin", cfg.Name))
+	if err != nil {
+		return nil, fmt.Errorf("plugins: %s: %w", cfg.Name, err)
+	}
+
+	p.process = proc
+	p.middleware = proc.middleware()
+	return p, nil
+}
+
+// Global returns a middleware running the global plugins in order. Returns
+// nil when r is nil or no plugin is global.
+func (r *Registry) Global() middleware.Middleware {
+	if r == nil {
+		return nil
+	}
+
+	var global []middleware.Middleware
+	for _, p := range r.plugins {
+		if p.cfg.Global {
+			global = append(global, p.middleware)
+		}
+	}
+
+	return chain(global)
+}
+
+// Route returns a middleware running the named plugins in order, nil when
+// names is empty. Returns an error for an unknown or global plugin, which
+// already runs on every request.
+func (r *Registry) Route(names []string) (middleware.Middleware, error) {
+	var route []middleware.Middleware
+	for i, name := range names {
+		var p *loaded
+		if r != nil {
+			p = r.byName[name]
+		}
+
+		switch {
+		case p == nil:
+			return nil, fmt.Errorf("plugins: unknown plugin %q", name)
+		case p.cfg.Global:
+			return nil, fmt.Errorf("plugins: plugin %q is global and runs on every route", name)
+		case slices.Contains(names[:i], name):
+			return nil, fmt.Errorf("plugins: plugin %q listed twice", name)
+		}
+
+		route = append(route, p.middleware)
+	}
+
+	return chain(route), nil
+}
+
+// Names returns the names of the loaded plugins in configuration order
+func (r *Registry) Names() []string {
+	if r == nil {
+		return nil
+	}
+
+	names := make([]string, len(r.plugins))
+	for i, p := range r.plugins {
+		names[i] = p.cfg.Name
+	}
+
+	return names
+}
+
+// Stats returns the call statistics of the process plugins
+func (r *Registry) Stats() []Stats {
+	if r == nil {
+		return nil
+	}
+
+	var stats []Stats
+	for _, p := range r.plugins {
+		if p.process != nil {
+			stats = append(stats, p.process.stats())
+		}
+	}
+
+	return stats
+}
+
+// Close stops the plugin processes. Go plugins stay loaded, the runtime
+// cannot unload them. Close is safe to call on a nil registry.
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+
+	for _, p := range r.plugins {
+		if p.process != nil {
+			p.process.close()
+		}
+	}
+}
+
+// chain combines middlewares into one, the first outermost
+func chain(mws []middleware.Middleware) middleware.Middleware {
+	if len(mws) == 0 {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return middleware.Chain(next, mws...)
+	}
+}
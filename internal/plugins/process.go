@@ -0,0 +1,372 @@
+package plugins
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/router"
+	gwerrors "velocity/pkg/errors"
+	"velocity/pkg/logger"
+	"velocity/pkg/plugin"
+)
+
+// Process plugin timing
+const (
+	// defaultCallTimeout bounds each call when the plugin configures none
+	defaultCallTimeout = time.Second
+
+	// initTimeout bounds the start of a process, up to its Init reply
+	initTimeout = 10 * time.Second
+
+	// restartBackoff is the least time between two starts of a process
+	restartBackoff = time.Second
+
+	// maxTimeouts is the number of consecutive calls without an answer
+	// after which a process is considered hung and killed
+	maxTimeouts = 3
+)
+
+// errClosed is returned by calls to a plugin closed with its gateway
+var errClosed = errors.New("plugin closed")
+
+// errTimeout is returned by calls the process did not answer in time
+var errTimeout = errors.New("no answer")
+
+// process runs a plugin as a separate process and calls it over JSON-RPC
+// on its standard input and output.
+//
+// A process that exits, or leaves maxTimeouts calls in a row unanswered
+// and is killed, is restarted by the next call, at most once per
+// restartBackoff. The restart runs outside the lock and only one call
+// performs it; calls fail in between.
+type process struct {
+	// cfg is the plugin's declaration
+	cfg config.PluginConfig
+
+	// timeout bounds each call
+	timeout time.Duration
+
+	// mu guards client, cmd, started, starting and closed
+	mu sync.Mutex
+
+	// client calls the running process, nil while it is not running
+	client *rpc.Client
+
+	// cmd is the running process
+	cmd *exec.Cmd
+
+	// started is when the process was last started
+	started time.Time
+
+	// starting reports whether a call is starting the process
+	starting bool
+
+	// closed reports whether the plugin was closed
+	closed bool
+
+	// calls, failures and restarts count for Stats
+	calls, failures, restarts atomic.Int64
+
+	// timeouts counts consecutive calls left unanswered
+	timeouts atomic.Int64
+
+	// logger receives the process's standard error and lifecycle events
+	logger *logger.Logger
+}
+
+// startProcess starts and initializes a process plugin
+func startProcess(cfg config.PluginConfig, log *logger.Logger) (*process, error) {
+	p := &process{cfg: cfg, timeout: cfg.Timeout, logger: log}
+	if p.timeout == 0 {
+		p.timeout = defaultCallTimeout
+	}
+
+	p.started = time.Now()
+	cmd, client, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.install(cmd, client)
+	return p, nil
+}
+
+// start starts a process and sends it the plugin configuration, waiting
+// up to initTimeout for its reply. Does not touch the running process, so
+// it is called without mu held.
+func (p *process) start() (*exec.Cmd, *rpc.Client, error) {
+	cmd := exec.Command(p.cfg.Path, p.cfg.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	go p.copyLog(stderr)
+
+	client := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(pipe{Reader: stdout, WriteCloser: stdin}))
+	if err := p.wait(client.Go(plugin.MethodInit, p.cfg.Config, &struct{}{}, make(chan *rpc.Call, 1)), initTimeout, nil); err != nil {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, nil, fmt.Errorf("init: %w", err)
+	}
+
+	return cmd, client, nil
+}
+
+// install makes a started process the running one. Must be called with mu
+// held.
+func (p *process) install(cmd *exec.Cmd, client *rpc.Client) {
+	p.client, p.cmd = client, cmd
+	p.timeouts.Store(0)
+	go p.watch(cmd, client)
+
+	p.logger.Info("Plugin process started", "path", p.cfg.Path, "pid", cmd.Process.Pid)
+}
+
+// watch waits for the process to exit and marks it as not running
+func (p *process) watch(cmd *exec.Cmd, client *rpc.Client) {
+	err := cmd.Wait()
+	client.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client == client {
+		p.client, p.cmd = nil, nil
+	}
+
+	if !p.closed {
+		p.logger.Warn("Plugin process exited", "error", err)
+	}
+}
+
+// copyLog copies the process's standard error to the log, line by line
+func (p *process) copyLog(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		p.logger.Info(scanner.Text())
+	}
+}
+
+// conn returns the client of the running process, restarting it when it
+// exited and the restart backoff has passed. Calls arriving during a
+// restart fail instead of waiting for it.
+func (p *process) conn() (*rpc.Client, error) {
+	p.mu.Lock()
+
+	switch {
+	case p.closed:
+		p.mu.Unlock()
+		return nil, errClosed
+	case p.client != nil:
+		client := p.client
+		p.mu.Unlock()
+		return client, nil
+	case p.starting || time.Since(p.started) < restartBackoff:
+		p.mu.Unlock()
+		return nil, errors.New("plugin process restarting")
+	}
+
+	p.starting, p.started = true, time.Now()
+	p.mu.Unlock()
+
+	p.restarts.Add(1)
+	cmd, client, err := p.start()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.starting = false
+	if err != nil {
+		p.logger.Warn("Plugin process restart failed", "error", err)
+		return nil, err
+	}
+
+	// The plugin may have been closed while the process started
+	if p.closed {
+		client.Close()
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return nil, errClosed
+	}
+
+	p.install(cmd, client)
+	return client, nil
+}
+
+// hung kills the process behind client once it left maxTimeouts calls in
+// a row unanswered, so the next call starts a fresh one
+func (p *process) hung(client *rpc.Client) {
+	if p.timeouts.Add(1) < maxTimeouts {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != client {
+		return
+	}
+
+	p.logger.Warn("Plugin process not answering, killing it", "pid", p.cmd.Process.Pid, "timeouts", p.timeouts.Load())
+	client.Close()
+	p.cmd.Process.Kill()
+	p.client, p.cmd = nil, nil
+	p.timeouts.Store(0)
+}
+
+// call asks the plugin about a request
+func (p *process) call(r *http.Request) (*plugin.Response, error) {
+	p.calls.Add(1)
+
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &plugin.Request{
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	}
+
+	if route, ok := router.RouteFromContext(r.Context()); ok {
+		req.Route = route.Config.Name
+	}
+
+	// The request is encoded before Go returns, so the plugin never sees
+	// later changes to its headers
+	resp := &plugin.Response{}
+	if err := p.wait(client.Go(plugin.MethodHandle, req, resp, make(chan *rpc.Call, 1)), p.timeout, r.Context().Done()); err != nil {
+		if errors.Is(err, errTimeout) {
+			p.hung(client)
+		}
+		return nil, err
+	}
+
+	p.timeouts.Store(0)
+	return resp, nil
+}
+
+// wait waits for a call to complete within timeout or until canceled is
+// closed
+func (p *process) wait(call *rpc.Call, timeout time.Duration, canceled <-chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("%w within %s", errTimeout, timeout)
+	case <-canceled:
+		return errors.New("request canceled")
+	}
+}
+
+// middleware returns the middleware calling the plugin
+func (p *process) middleware() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, err := p.call(r)
+			if err != nil {
+				p.failures.Add(1)
+				p.logger.Debug("Plugin call failed", "method", r.Method, "path", r.URL.Path, "error", err)
+
+				if p.cfg.FailOpen {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				gwerrors.New(gwerrors.CodePluginFailed, "Plugin failed").
+					WithContext("plugin", p.cfg.Name).
+					WriteJSON(w)
+				return
+			}
+
+			if resp.Status != 0 {
+				for name, values := range resp.Header {
+					w.Header()[http.CanonicalHeaderKey(name)] = values
+				}
+
+				w.WriteHeader(resp.Status)
+				if r.Method != http.MethodHead {
+					w.Write(resp.Body)
+				}
+				return
+			}
+
+			for name, values := range resp.SetHeaders {
+				r.Header[http.CanonicalHeaderKey(name)] = values
+			}
+
+			for _, name := range resp.RemoveHeaders {
+				r.Header.Del(name)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// stats returns the plugin's call statistics
+func (p *process) stats() Stats {
+	return Stats{
+		Name:     p.cfg.Name,
+		Calls:    p.calls.Load(),
+		Failures: p.failures.Load(),
+		Restarts: p.restarts.Load(),
+	}
+}
+
+// close stops the process. Calls in flight fail.
+func (p *process) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.client != nil {
+		// Requests in flight fail either way, so the process is not given
+		// time to exit on its own
+		p.client.Close()
+		p.cmd.Process.Kill()
+		p.client, p.cmd = nil, nil
+	}
+}
+
+// pipe joins the process's standard output and input into one connection
+type pipe struct {
+	io.Reader
+	io.WriteCloser
+}
@@ -0,0 +1,48 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// SymbolMiddleware is the symbol a Go plugin exports
+const SymbolMiddleware = "Middleware"
+
+// sharedFactory is the type of a Go plugin's Middleware function. It uses
+// standard library types only, so plugins need not import the gateway.
+type sharedFactory = func(config map[string]string) (func(http.Handler) http.Handler, error)
+
+// loadShared opens a Go plugin and creates its middleware. Opening the
+// same shared object again, as on a configuration reload, returns the
+// already loaded plugin.
+func loadShared(cfg config.PluginConfig) (middleware.Middleware, error) {
+	so, err := plugin.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, err := so.Lookup(SymbolMiddleware)
+	if err != nil {
+		return nil, err
+	}
+
+	factory, ok := symbol.(sharedFactory)
+	if !ok {
+		return nil, fmt.Errorf("%s has type %T, expected func(map[string]string) (func(http.Handler) http.Handler, error)", SymbolMiddleware, symbol)
+	}
+
+	mw, err := factory(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if mw == nil {
+		return nil, fmt.Errorf("%s returned no middleware", SymbolMiddleware)
+	}
+
+	return mw, nil
+}
@@ -0,0 +1,303 @@
+// Package provenance signs upstream requests on behalf of the gateway.
+//
+// Backends behind the gateway usually trust its headers: the route it
+// matched, the claims it forwarded, the client address it saw. Anything
+// else inside the network that can reach a backend can send the same
+// headers. With request signing, the gateway attaches an HTTP Message
+// Signature (RFC 9421) to every upstream request, and a backend accepting
+// only correctly signed requests knows they transited the gateway.
+//
+// The signature base covers the method, authority, path and query, the
+// configured headers present on the request, and the signature
+// parameters:
+//
+//	"@method": POST
+//	"@authority": orders.internal:8080
+//	"@path": /api/orders
+//	"@query": ?dry_run=1
+//	"x-request-id": 4b1c...
+//	"@signature-params": ("@method" "@authority" "@path" "@query" "x-request-id");created=1700000000;keyid="velocity";alg="hmac-sha256"
+//
+// Configured headers a request does not carry are left out of its
+// component list, so verifiers must read the covered components from
+// Signature-Input rather than assume them. Requests are signed by the
+// upstream Transport, after retries picked a target and AWS SigV4 signing
+// ran, so the signature covers the request exactly as sent.
+//
+// Example usage:
+//
+//	signer, err := provenance.New(cfg.RequestSigning)
+//	transport := provenance.Transport(base, signer)
+package provenance
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+)
+
+// Signature algorithms
+const (
+	// AlgorithmHMAC signs with HMAC-SHA256 over a shared secret
+	AlgorithmHMAC = "hmac-sha256"
+
+	// AlgorithmEd25519 signs with an Ed25519 private key
+	AlgorithmEd25519 = "ed25519"
+)
+
+// Signature headers
+const (
+	// HeaderSignature carries the signature
+	HeaderSignature = "Signature"
+
+	// HeaderSignatureInput carries the covered components and parameters
+	HeaderSignatureInput = "Signature-Input"
+)
+
+// Label names the gateway's signature in the signature dictionaries
+const Label = "velocity"
+
+// minHMACKey is the shortest HMAC secret accepted, in bytes
+const minHMACKey = 32
+
+// derivedComponents are covered by every signature
+var derivedComponents = []string{"@method", "@authority", "@path", "@query"}
+
+// Signer signs upstream requests
+//
+// Thread safety: All methods are safe for concurrent use.
+type Signer struct {
+	// algorithm is the alg parameter
+	algorithm string
+
+	// keyID is the keyid parameter
+	keyID string
+
+	// headers are the lower case names of covered headers
+	headers []string
+
+	// validity sets the expires parameter, zero for none
+	validity time.Duration
+
+	// sign computes the signature of a signature base
+	sign func(base []byte) []byte
+
+	// publicKey is the base64 DER encoded public key, empty for HMAC
+	publicKey string
+
+	// now is the clock of the created parameter
+	now func() time.Time
+}
+
+// New creates a signer, or returns nil when request signing is disabled.
+//
+// Returns an error for an unknown algorithm or a key that cannot be
+// resolved or parsed.
+func New(cfg config.RequestSigningConfig) (*Signer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	s := &Signer{
+		algorithm: cfg.Algorithm,
+		keyID:     cfg.KeyID,
+		validity:  cfg.Validity,
+		now:       time.Now,
+	}
+
+	if s.algorithm == "" {
+		s.algorithm = AlgorithmHMAC
+	}
+
+	if s.keyID == "" {
+		s.keyID = Label
+	}
+
+	if strings.ContainsAny(s.keyID, "\"\\") {
+		return nil, fmt.Errorf("request_signing: key_id must not contain quotes or backslashes")
+	}
+
+	for _, name := range cfg.Headers {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || strings.HasPrefix(name, "@") {
+			return nil, fmt.Errorf("request_signing: invalid header %q", name)
+		}
+
+		s.headers = append(s.headers, name)
+	}
+
+	key, err := secrets.NewStore(0).Get(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("request_signing: %w", err)
+	}
+
+	switch s.algorithm {
+	case AlgorithmHMAC:
+		if len(key) < minHMACKey {
+			return nil, fmt.Errorf("request_signing: hmac-sha256 key must be at least %d bytes", minHMACKey)
+		}
+
+		secret := []byte(key)
+		s.sign = func(base []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(base)
+			return mac.Sum(nil)
+		}
+
+	case AlgorithmEd25519:
+		private, err := parseEd25519(key)
+		if err != nil {
+			return nil, fmt.Errorf("request_signing: %w", err)
+		}
+
+		public, err := x509.MarshalPKIXPublicKey(private.Public())
+		if err != nil {
+			return nil, fmt.Errorf("request_signing: %w", err)
+		}
+
+		s.publicKey = base64.StdEncoding.EncodeToString(public)
+		s.sign = func(base []byte) []byte { return ed25519.Sign(private, base) }
+
+	default:
+		return nil, fmt.Errorf("request_signing: unknown algorithm %q, expected hmac-sha256 or ed25519", s.algorithm)
+	}
+
+	return s, nil
+}
+
+// parseEd25519 parses a PKCS#8 PEM private key or a base64 encoded seed
+func parseEd25519(key string) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ed25519 key: %w", err)
+		}
+
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid ed25519 key: PEM block holds a %T", parsed)
+		}
+
+		return private, nil
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid ed25519 key: expected a PKCS#8 PEM block or a base64 encoded %d byte seed", ed25519.SeedSize)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Algorithm returns the signature algorithm
+func (s *Signer) Algorithm() string {
+	return s.algorithm
+}
+
+// KeyID returns the keyid parameter
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// PublicKey returns the base64 encoded DER (PKIX) public key backends
+// verify Ed25519 signatures with, empty for HMAC
+func (s *Signer) PublicKey() string {
+	return s.publicKey
+}
+
+// Sign replaces the request's Signature and Signature-Input headers with
+// the gateway's signature
+func (s *Signer) Sign(r *http.Request) {
+	components := append([]string(nil), derivedComponents...)
+	for _, name := range s.headers {
+		if _, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			components = append(components, name)
+		}
+	}
+
+	created := s.now().Unix()
+	params := `("` + strings.Join(components, `" "`) + `");created=` + strconv.FormatInt(created, 10)
+	if s.validity > 0 {
+		params += ";expires=" + strconv.FormatInt(created+int64(s.validity/time.Second), 10)
+	}
+	params += `;keyid="` + s.keyID + `";alg="` + s.algorithm + `"`
+
+	var base strings.Builder
+	for _, component := range components {
+		base.WriteString(`"` + component + `": ` + componentValue(r, component) + "\n")
+	}
+	base.WriteString(`"@signature-params": ` + params)
+
+	signature := s.sign([]byte(base.String()))
+
+	r.Header.Set(HeaderSignatureInput, Label+"="+params)
+	r.Header.Set(HeaderSignature, Label+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+}
+
+// componentValue returns the value of a covered component as it appears
+// in the signature base
+func componentValue(r *http.Request, component string) string {
+	switch component {
+	case "@method":
+		return r.Method
+
+	case "@authority":
+		host := r.Host
+		if host == "" {
+			host = r.URL.Host
+		}
+		return strings.ToLower(host)
+
+	case "@path":
+		if path := r.URL.EscapedPath(); path != "" {
+			return path
+		}
+		return "/"
+
+	case "@query":
+		return "?" + r.URL.RawQuery
+	}
+
+	// Field lines are trimmed and combined like a single field
+	var values []string
+	for _, value := range r.Header.Values(component) {
+		values = append(values, strings.TrimSpace(value))
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// Transport wraps base so that every request is signed immediately before
+// it is sent. Returns base unchanged when s is nil.
+func Transport(base http.RoundTripper, s *Signer) http.RoundTripper {
+	if s == nil {
+		return base
+	}
+
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// RoundTrippers must not modify the caller's request
+		r = r.Clone(r.Context())
+		s.Sign(r)
+
+		return base.RoundTrip(r)
+	})
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
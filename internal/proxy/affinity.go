@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	gwerrors "velocity/pkg/errors"
+)
+
+// Reasons a session loses its pinned target
+const (
+	// AffinityRemoved means the target left the pool, e.g. through
+	// discovery or a configuration change
+	AffinityRemoved = "removed"
+
+	// AffinityEjected means outlier detection ejected the target
+	AffinityEjected = "ejected"
+
+	// AffinityFailed means the request to the target failed in transit
+	AffinityFailed = "failed"
+)
+
+// Failover strategies for broken sessions
+const (
+	// FailoverRehash moves the session to another target
+	FailoverRehash = "rehash"
+
+	// FailoverReject answers with the configured status
+	FailoverReject = "reject"
+)
+
+// affinityReasons lists the break reasons in exposition order
+var affinityReasons = []string{AffinityRemoved, AffinityEjected, AffinityFailed}
+
+// affinity pins clients to targets with a cookie
+type affinity struct {
+	// cfg holds the cookie settings and failover strategy
+	cfg config.SessionAffinityConfig
+
+	// breaks counts broken sessions, indexed like affinityReasons
+	breaks [3]atomic.Int64
+}
+
+// AffinityStats is a snapshot of session affinity counters
+type AffinityStats struct {
+	// Failover is the configured strategy, rehash or reject
+	Failover string
+
+	// Breaks counts sessions whose pinned target was unusable, by reason
+	Breaks map[string]int64
+}
+
+// newAffinity validates the configuration and returns nil when session
+// affinity is disabled
+func newAffinity(cfg config.SessionAffinityConfig) (*affinity, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Cookie == "" {
+		return nil, fmt.Errorf("session_affinity: cookie must not be empty")
+	}
+
+	switch cfg.Failover {
+	case FailoverRehash:
+	case FailoverReject:
+		if cfg.RejectStatus < 400 || cfg.RejectStatus > 599 {
+			return nil, fmt.Errorf("session_affinity: reject_status must be a 4xx or 5xx status")
+		}
+	default:
+		return nil, fmt.Errorf("session_affinity: unknown failover %q, expected rehash or reject", cfg.Failover)
+	}
+
+	return &affinity{cfg: cfg}, nil
+}
+
+// affinityID derives the opaque cookie value identifying a target
+func affinityID(target *url.URL) string {
+	h := fnv.New64a()
+	h.Write([]byte(target.String()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// pinned resolves the client's affinity cookie. It returns the index of
+// the pinned target within available, or -1 with the reason the pinned
+// target is unusable. Both are empty when the client is not pinned.
+func (a *affinity) pinned(r *http.Request, all, available []*backend) (int, string) {
+	cookie, err := r.Cookie(a.cfg.Cookie)
+	if err != nil || cookie.Value == "" {
+		return -1, ""
+	}
+
+	for i, b := range available {
+		if b.affinityID == cookie.Value {
+			return i, ""
+		}
+	}
+
+	for _, b := range all {
+		if b.affinityID == cookie.Value {
+			return -1, AffinityEjected
+		}
+	}
+
+	return -1, AffinityRemoved
+}
+
+// broken counts a broken session. It returns false when the reject
+// strategy applies, after answering the client.
+func (a *affinity) broken(w http.ResponseWriter, r *http.Request, reason string) bool {
+	for i, known := range affinityReasons {
+		if known == reason {
+			a.breaks[i].Add(1)
+		}
+	}
+
+	if a.cfg.Failover != FailoverReject {
+		return true
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.cfg.Cookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	gwerrors.New(gwerrors.CodeAffinityLost, "Session target unavailable, please start a new session").
+		WithStatus(a.cfg.RejectStatus).
+		WithContext("reason", reason).
+		WriteJSON(w)
+	return false
+}
+
+// stick pins the client to b by adding the affinity cookie to resp,
+// unless the client is already pinned to it
+func (a *affinity) stick(resp *http.Response, b *backend) {
+	if cookie, err := resp.Request.Cookie(a.cfg.Cookie); err == nil && cookie.Value == b.affinityID {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     a.cfg.Cookie,
+		Value:    b.affinityID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   resp.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if a.cfg.TTL > 0 {
+		cookie.MaxAge = int(a.cfg.TTL.Seconds())
+	}
+
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// AffinityStats returns the session affinity counters, or false when
+// session affinity is disabled
+func (p *Proxy) AffinityStats() (AffinityStats, bool) {
+	if p.affinity == nil {
+		return AffinityStats{}, false
+	}
+
+	stats := AffinityStats{
+		Failover: p.affinity.cfg.Failover,
+		Breaks:   make(map[string]int64, len(affinityReasons)),
+	}
+
+	for i, reason := range affinityReasons {
+		stats.Breaks[reason] = p.affinity.breaks[i].Load()
+	}
+
+	return stats, true
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"velocity/internal/provenance"
+	"velocity/internal/upstreamauth"
+)
+
+// Upstream protocols selectable per target
+const (
+	// ProtocolAuto negotiates HTTP/2 via ALPN on https targets and uses
+	// HTTP/1.1 on http targets
+	ProtocolAuto = "auto"
+
+	// ProtocolHTTP1 always uses HTTP/1.1
+	ProtocolHTTP1 = "http/1.1"
+
+	// ProtocolH2 requires HTTP/2 over TLS
+	ProtocolH2 = "h2"
+
+	// ProtocolH2C uses HTTP/2 over cleartext with prior knowledge
+	ProtocolH2C = "h2c"
+)
+
+// protocols returns the transport protocols of a target, validating that
+// the protocol suits the target's scheme. An empty protocol means auto.
+func protocols(target *url.URL, protocol string) (*http.Protocols, error) {
+	var p http.Protocols
+	secure := target.Scheme == "https"
+
+	switch protocol {
+	case "", ProtocolAuto:
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+
+	case ProtocolHTTP1:
+		p.SetHTTP1(true)
+
+	case ProtocolH2:
+		if !secure {
+			return nil, fmt.Errorf("target %s: protocol h2 requires an https target, use h2c for cleartext", target)
+		}
+		p.SetHTTP2(true)
+
+	case ProtocolH2C:
+		if secure {
+			return nil, fmt.Errorf("target %s: protocol h2c requires an http target, use h2 with TLS", target)
+		}
+		p.SetUnencryptedHTTP2(true)
+
+	default:
+		return nil, fmt.Errorf("target %s: unknown protocol %q, expected http/1.1, h2, h2c or auto", target, protocol)
+	}
+
+	return &p, nil
+}
+
+// backend is a single upstream target with its own connection pool
+//
+// Giving every backend a dedicated transport lets a removed target's
+// connections be torn down once it has drained, without disturbing pooled
+// connections to the remaining targets. In sharded mode a backend has one
+// transport and one set of counters per shard.
+type backend struct {
+	// url is the target base URL
+	url *url.URL
+
+	// protocol is the configured upstream protocol
+	protocol string
+
+	// affinityID identifies the backend in session affinity cookies
+	affinityID string
+
+	// weight is the backend's share of traffic relative to the other
+	// backends of its priority, 1 unless discovery reports another
+	weight atomic.Int64
+
+	// priority ranks the backend for failover, lower first, 0 unless
+	// discovery reports another
+	priority atomic.Int64
+
+	// transports hold this backend's connection pools, one per shard
+	transports []*http.Transport
+
+	// roundTrippers wrap transports with request signing
+	roundTrippers []http.RoundTripper
+
+	// counters track request statistics, one set per shard
+	counters []shardCounters
+
+	// health is the passive health state used by outlier detection
+	health backendHealth
+
+	// latency averages response times for the p2c selector
+	latency latencyEWMA
+
+	// check is the target's active health check, nil without one
+	check *activeCheck
+
+	// phases break response latency out by phase and status class
+	phases *latencyBreakdown
+
+	// conns is the number of open connections across all shards
+	conns atomic.Int64
+}
+
+// newBackend creates a backend with shards connection pools cloned from
+// base, speaking protocol, whose requests are signed by signer when it is
+// not nil. A non-nil tlsConfig replaces base's for the target. The
+// protocol must have been validated by protocols.
+func newBackend(target *url.URL, protocol string, tlsConfig *tls.Config, base *http.Transport, shards int, signer *provenance.Signer) *backend {
+	if protocol == "" {
+		protocol = ProtocolAuto
+	}
+
+	b := &backend{
+		url:           target,
+		protocol:      protocol,
+		affinityID:    affinityID(target),
+		transports:    make([]*http.Transport, shards),
+		roundTrippers: make([]http.RoundTripper, shards),
+		counters:      make([]shardCounters, shards),
+		phases:        newLatencyBreakdown(),
+	}
+	b.weight.Store(1)
+
+	for i := range shards {
+		transport := base.Clone()
+		transport.Protocols, _ = protocols(target, protocol)
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig.Clone()
+		}
+		transport.DialContext = b.countConns(base.DialContext)
+
+		b.transports[i] = transport
+		// Provenance signing runs last, after SigV4 signed the request
+		b.roundTrippers[i] = upstreamauth.Transport(provenance.Transport(transport, signer))
+	}
+
+	return b
+}
+
+// inFlight returns the number of requests currently proxied to the
+// backend across all shards
+func (b *backend) inFlight() int64 {
+	var total int64
+	for i := range b.counters {
+		total += b.counters[i].inFlight.Load()
+	}
+
+	return total
+}
+
+// countConns wraps dial so the connections it opens are counted in b.conns
+// until they are closed
+func (b *backend) countConns(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		b.conns.Add(1)
+		return &countedConn{Conn: conn, open: &b.conns}, nil
+	}
+}
+
+// countedConn decrements its backend's connection count once closed
+type countedConn struct {
+	net.Conn
+
+	// open is the backend's connection count
+	open *atomic.Int64
+
+	// once makes repeated Close calls count once
+	once sync.Once
+}
+
+// Close implements net.Conn
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// closeIdleConnections closes the idle connections of every shard's pool
+func (b *backend) closeIdleConnections() {
+	for _, transport := range b.transports {
+		transport.CloseIdleConnections()
+	}
+}
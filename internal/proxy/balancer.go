@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+)
+
+// Load balancing algorithms
+const (
+	// AlgorithmRoundRobin rotates through the targets
+	AlgorithmRoundRobin = "round_robin"
+
+	// AlgorithmConsistentHash sends requests with the same key to the same
+	// target
+	AlgorithmConsistentHash = "consistent_hash"
+
+	// AlgorithmP2C picks the less loaded of two random targets
+	AlgorithmP2C = "p2c"
+)
+
+// selector is a load balancing algorithm. It chooses the target a request
+// is sent to first; retries continue with the following targets in pool
+// order. Session affinity takes precedence over every selector. Selectors
+// give targets traffic in proportion to their weight.
+type selector interface {
+	// pick returns the index within available of the first target to try.
+	// available is never empty and holds targets of a single priority.
+	pick(r *http.Request, current *pool, available []*backend, shard int) int
+
+	// observe is told the response latency of every attempt the target
+	// answered or failed, failures counting at least failurePenalty
+	observe(b *backend, latency time.Duration)
+}
+
+// newSelector validates the configuration and creates the selected
+// algorithm for a proxy with the given number of shards
+func newSelector(cfg config.LoadBalancingConfig, shards int) (selector, error) {
+	switch cfg.Algorithm {
+	case "", AlgorithmRoundRobin:
+		return newRoundRobin(shards), nil
+	case AlgorithmConsistentHash:
+		return newHashBalancer(cfg.ConsistentHash)
+	case AlgorithmP2C:
+		return p2c{}, nil
+	}
+
+	return nil, fmt.Errorf("load_balancing: unknown algorithm %q, expected %s, %s or %s",
+		cfg.Algorithm, AlgorithmRoundRobin, AlgorithmConsistentHash, AlgorithmP2C)
+}
+
+// roundRobin rotates through the available targets, with one rotation
+// per shard
+type roundRobin struct {
+	// cursors hold the round-robin position of each shard
+	cursors []cursor
+}
+
+// newRoundRobin creates a round-robin selector. Shards start apart so
+// their rotations do not move in lockstep.
+func newRoundRobin(shards int) *roundRobin {
+	rr := &roundRobin{cursors: make([]cursor, shards)}
+	for i := range rr.cursors {
+		rr.cursors[i].next.Store(int64(i))
+	}
+
+	return rr
+}
+
+// pick implements selector. Weighted targets take as many consecutive
+// turns of the rotation as their weight.
+func (rr *roundRobin) pick(_ *http.Request, _ *pool, available []*backend, shard int) int {
+	n := rr.cursors[shard].next.Add(1) - 1
+
+	total, weighted := totalWeight(available)
+	if !weighted {
+		return int(n % int64(len(available)))
+	}
+
+	position := n % total
+	for i, b := range available {
+		if position -= b.weight.Load(); position < 0 {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// observe implements selector
+func (rr *roundRobin) observe(*backend, time.Duration) {}
+
+// latencyDecay is the weight of a new sample in a backend's latency EWMA
+const latencyDecay = 0.2
+
+// failurePenalty is the least latency observed for a failed attempt, so a
+// target failing fast costs more than its healthy peers instead of less
+const failurePenalty = time.Second
+
+// p2c is the power of two choices: it samples two distinct targets at
+// random and picks the one with the lower load, the latency EWMA scaled by
+// the requests in flight plus one and divided by the target's weight, so
+// heavier targets win more comparisons. Comparing only two targets avoids the
+// herding of always picking the least loaded one, whose load every gateway
+// instance sees at the same time, while still steering traffic away from
+// slow, busy and failing targets.
+type p2c struct{}
+
+// pick implements selector
+func (p2c) pick(_ *http.Request, _ *pool, available []*backend, _ int) int {
+	if len(available) == 1 {
+		return 0
+	}
+
+	first := rand.IntN(len(available))
+	second := rand.IntN(len(available) - 1)
+	if second >= first {
+		second++
+	}
+
+	if available[second].weightedLoad() < available[first].weightedLoad() {
+		return second
+	}
+
+	return first
+}
+
+// observe implements selector
+func (p2c) observe(b *backend, latency time.Duration) {
+	b.latency.observe(latency)
+}
+
+// latencyEWMA is an exponentially weighted moving average of response
+// latencies in nanoseconds, zero before the first sample
+type latencyEWMA struct {
+	// nanos is the current average
+	nanos atomic.Int64
+}
+
+// observe adds a sample to the average
+func (e *latencyEWMA) observe(latency time.Duration) {
+	for {
+		old := e.nanos.Load()
+
+		next := int64(latency)
+		if old != 0 {
+			next = old + int64(latencyDecay*float64(int64(latency)-old))
+		}
+
+		if e.nanos.CompareAndSwap(old, max(next, 1)) {
+			return
+		}
+	}
+}
+
+// load returns the p2c cost of sending a request to the backend. Backends
+// without latency samples cost only their in-flight requests, so new
+// targets receive traffic right away.
+func (b *backend) load() float64 {
+	inFlight := float64(b.inFlight() + 1)
+
+	if latency := b.latency.nanos.Load(); latency > 0 {
+		return float64(latency) * inFlight
+	}
+
+	return inFlight
+}
+
+// weightedLoad returns the load per unit of weight
+func (b *backend) weightedLoad() float64 {
+	return b.load() / float64(max(b.weight.Load(), 1))
+}
+
+// totalWeight returns the summed weight of backends and whether any of
+// them is weighted other than 1
+func totalWeight(backends []*backend) (int64, bool) {
+	var total int64
+	weighted := false
+
+	for _, b := range backends {
+		weight := b.weight.Load()
+		total += weight
+		weighted = weighted || weight != 1
+	}
+
+	return total, weighted
+}
+
+// byPriority orders backends by ascending priority and returns them with
+// the number of backends of the lowest priority, which lead the result.
+// Backends of a single priority are returned as they are.
+func byPriority(backends []*backend) ([]*backend, int) {
+	lowest := backends[0].priority.Load()
+	uniform := true
+	for _, b := range backends[1:] {
+		priority := b.priority.Load()
+		uniform = uniform && priority == lowest
+		lowest = min(lowest, priority)
+	}
+
+	if uniform {
+		return backends, len(backends)
+	}
+
+	ordered := slices.Clone(backends)
+	slices.SortStableFunc(ordered, func(a, b *backend) int {
+		return cmp.Compare(a.priority.Load(), b.priority.Load())
+	})
+
+	tier := 0
+	for tier < len(ordered) && ordered[tier].priority.Load() == lowest {
+		tier++
+	}
+
+	return ordered, tier
+}
+
+// attemptIndex returns the index within backends of the target of an
+// attempt. Attempts rotate from first through the lowest priority tier,
+// the first tier backends, before moving on to the other priorities in
+// order. A first target outside the tier, as for a pinned session,
+// rotates through all backends.
+func attemptIndex(first, attempt, tier, total int) int {
+	switch {
+	case first >= tier:
+		return (first + attempt) % total
+	case attempt < tier:
+		return (first + attempt) % tier
+	}
+
+	return attempt
+}
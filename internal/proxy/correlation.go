@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"velocity/internal/router"
+)
+
+// Correlation headers sent to upstreams
+const (
+	// HeaderRoute names the matched route, absent for the fallback
+	HeaderRoute = "X-Velocity-Route"
+
+	// HeaderTarget is the target chosen for the attempt
+	HeaderTarget = "X-Velocity-Target"
+
+	// HeaderAttempt is the 1-based attempt number, above 1 on retries
+	HeaderAttempt = "X-Velocity-Attempt"
+)
+
+// correlationHeaders lists every header set by setCorrelation
+var correlationHeaders = []string{HeaderRoute, HeaderTarget, HeaderAttempt}
+
+// setCorrelation adds the correlation headers for one attempt to r,
+// replacing any values a client sent
+func (p *Proxy) setCorrelation(r *http.Request, b *backend, attempt int) {
+	if !p.correlation.Enabled {
+		return
+	}
+
+	r.Header.Del(HeaderRoute)
+	if route, ok := router.RouteFromContext(r.Context()); ok {
+		r.Header.Set(HeaderRoute, route.Config.Name)
+	}
+
+	r.Header.Set(HeaderTarget, b.url.String())
+	r.Header.Set(HeaderAttempt, strconv.Itoa(attempt))
+}
+
+// stripCorrelation removes correlation headers an upstream echoed back
+func (p *Proxy) stripCorrelation(resp *http.Response) {
+	if !p.correlation.Enabled || !p.correlation.StripFromResponses {
+		return
+	}
+
+	for _, name := range correlationHeaders {
+		resp.Header.Del(name)
+	}
+}
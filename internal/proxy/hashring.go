@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/ratelimit"
+)
+
+// defaultVirtualNodes is the number of ring points per target, enough to
+// keep the share of keys per target within a few percent of even
+const defaultVirtualNodes = 160
+
+// hashBalancer selects targets by hashing a request key onto a ring
+type hashBalancer struct {
+	// key derives the hash key of a request
+	key ratelimit.KeyFunc
+
+	// virtualNodes is the number of ring points per target
+	virtualNodes int
+}
+
+// newHashBalancer validates the configuration and creates a consistent
+// hashing selector
+func newHashBalancer(cfg config.ConsistentHashConfig) (*hashBalancer, error) {
+	key, err := ratelimit.ParseKey(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load_balancing: consistent_hash: %w", err)
+	}
+
+	if cfg.VirtualNodes < 0 {
+		return nil, fmt.Errorf("load_balancing: consistent_hash: virtual_nodes must not be negative")
+	}
+
+	virtualNodes := cfg.VirtualNodes
+	if virtualNodes == 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	return &hashBalancer{key: key, virtualNodes: virtualNodes}, nil
+}
+
+// pick implements selector. Requests fall back to the first target while
+// the pool has no ring, which cannot happen once the proxy is built.
+func (h *hashBalancer) pick(r *http.Request, current *pool, available []*backend, _ int) int {
+	if current.ring == nil {
+		return 0
+	}
+
+	return max(current.ring.lookup(h.key(r), available), 0)
+}
+
+// observe implements selector
+func (h *hashBalancer) observe(*backend, time.Duration) {}
+
+// ringPoint is one virtual node of a target
+type ringPoint struct {
+	// hash is the point's position on the ring
+	hash uint64
+
+	// backend is the target owning the point
+	backend *backend
+}
+
+// hashRing maps keys to backends.
+//
+// Every backend owns virtualNodes points placed by hashing its URL, so a
+// backend keeps its points when others join or leave, and only the keys
+// falling between its points and theirs move. Weighted backends own a
+// number of points proportional to their weight instead, keeping the
+// ring's size that of an unweighted one. A ring is immutable and
+// published with the pool it was built for.
+type hashRing struct {
+	// points are sorted by hash
+	points []ringPoint
+}
+
+// newHashRing builds the ring of backends
+func newHashRing(backends []*backend, virtualNodes int) *hashRing {
+	ring := &hashRing{points: make([]ringPoint, 0, len(backends)*virtualNodes)}
+	total, weighted := totalWeight(backends)
+
+	for _, b := range backends {
+		points := virtualNodes
+		if weighted {
+			share := float64(b.weight.Load()) * float64(len(backends)) / float64(total)
+			points = max(int(math.Round(share*float64(virtualNodes))), 1)
+		}
+
+		target := b.url.String()
+		for i := range points {
+			ring.points = append(ring.points, ringPoint{hash: hashKey(target + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+
+	slices.SortFunc(ring.points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	return ring
+}
+
+// hashKey returns the ring position of a key
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// FNV alone clusters similar keys such as "target#1" and "target#2";
+	// a final mix spreads them over the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// lookup returns the index within available of the backend owning key:
+// the first available backend clockwise from the key's position, so keys
+// of an ejected backend spread over the others and return once it is
+// readmitted. Returns -1 when no ring backend is available.
+func (ring *hashRing) lookup(key string, available []*backend) int {
+	if len(ring.points) == 0 {
+		return -1
+	}
+
+	start, _ := slices.BinarySearchFunc(ring.points, hashKey(key), func(p ringPoint, hash uint64) int {
+		return cmp.Compare(p.hash, hash)
+	})
+
+	for i := range ring.points {
+		point := ring.points[(start+i)%len(ring.points)]
+		if index := slices.Index(available, point.backend); index >= 0 {
+			return index
+		}
+	}
+
+	return -1
+}
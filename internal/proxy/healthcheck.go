@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+)
+
+// Active health check probe types
+const (
+	// HealthCheckHTTP requests a path and expects a 2xx or 3xx response
+	HealthCheckHTTP = "http"
+
+	// HealthCheckTCP only verifies that a connection can be established
+	HealthCheckTCP = "tcp"
+)
+
+// Health check defaults
+const (
+	defaultHealthCheckPath     = "/health"
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultUnhealthyThreshold  = 3
+	defaultHealthyThreshold    = 2
+)
+
+// activeCheck probes one backend on an interval
+//
+// A backend starts healthy and is taken out of rotation after
+// UnhealthyThreshold consecutive failed probes, then returned after
+// HealthyThreshold consecutive successful ones. Like ejection, a failing
+// check is ignored during selection when every backend is unavailable.
+type activeCheck struct {
+	// cfg holds the probe settings with defaults applied
+	cfg config.HealthCheckConfig
+
+	// down reports whether the backend is out of rotation
+	down atomic.Bool
+
+	// streak counts consecutive probes contradicting the current state.
+	// Only the check's goroutine touches it.
+	streak int
+}
+
+// newActiveCheck validates the configuration of a target's health check,
+// returning nil when the target has none
+func newActiveCheck(target string, cfg config.HealthCheckConfig) (*activeCheck, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case HealthCheckHTTP, HealthCheckTCP:
+	default:
+		return nil, fmt.Errorf("target %s: health_check: unknown type %q, expected %s or %s",
+			target, cfg.Type, HealthCheckHTTP, HealthCheckTCP)
+	}
+
+	if cfg.Interval < 0 || cfg.Timeout < 0 || cfg.UnhealthyThreshold < 0 || cfg.HealthyThreshold < 0 {
+		return nil, fmt.Errorf("target %s: health_check: interval, timeout and thresholds must not be negative", target)
+	}
+
+	if cfg.Path == "" {
+		cfg.Path = defaultHealthCheckPath
+	}
+
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return nil, fmt.Errorf("target %s: health_check: path must start with /", target)
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultHealthCheckInterval
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHealthCheckTimeout
+	}
+
+	if cfg.UnhealthyThreshold == 0 {
+		cfg.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	if cfg.HealthyThreshold == 0 {
+		cfg.HealthyThreshold = defaultHealthyThreshold
+	}
+
+	return &activeCheck{cfg: cfg}, nil
+}
+
+// runHealthCheck probes a backend immediately and then every interval
+// until the proxy is closed
+func (p *Proxy) runHealthCheck(b *backend) {
+	ticker := time.NewTicker(b.check.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.probe(b)
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe runs one health check of a backend and updates its state once a
+// threshold of consecutive results is reached
+func (p *Proxy) probe(b *backend) {
+	check := b.check
+
+	ctx, cancel := context.WithTimeout(context.Background(), check.cfg.Timeout)
+	defer cancel()
+
+	var err error
+	if check.cfg.Type == HealthCheckTCP {
+		err = probeTCP(ctx, b)
+	} else {
+		err = probeHTTP(ctx, b, check.cfg.Path)
+	}
+
+	down := check.down.Load()
+	if (err != nil) != down {
+		check.streak++
+	} else {
+		check.streak = 0
+	}
+
+	switch {
+	case !down && check.streak >= check.cfg.UnhealthyThreshold:
+		check.down.Store(true)
+		check.streak = 0
+		p.logger.Warn("Target failed health check", "target", b.url.String(), "type", check.cfg.Type, "error", err)
+	case down && check.streak >= check.cfg.HealthyThreshold:
+		check.down.Store(false)
+		check.streak = 0
+		p.logger.Info("Target passed health check", "target", b.url.String(), "type", check.cfg.Type)
+	}
+}
+
+// probeTCP opens and closes a connection to the backend's host, through
+// the egress proxy when one is configured
+func probeTCP(ctx context.Context, b *backend) error {
+	address := b.url.Host
+	if b.url.Port() == "" {
+		port := "80"
+		if b.url.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(b.url.Hostname(), port)
+	}
+
+	conn, err := b.transports[0].DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// probeHTTP requests path on the backend over its own connection pool
+func probeHTTP(ctx context.Context, b *backend, path string) error {
+	target := *b.url
+	target.Path = strings.TrimRight(target.Path, "/") + path
+	target.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "velocity-health-check")
+
+	resp, err := b.transports[0].RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// down reports whether the backend's active health check failed
+func (b *backend) down() bool {
+	return b.check != nil && b.check.down.Load()
+}
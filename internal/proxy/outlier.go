@@ -0,0 +1,425 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/cluster"
+	"velocity/internal/config"
+)
+
+// backendHealth is the passive health state of a backend, updated from the
+// outcome of proxied requests
+type backendHealth struct {
+	// consecutiveFailures counts transport errors and 5xx responses since
+	// the last success
+	consecutiveFailures atomic.Int64
+
+	// streakStart is when the current run of consecutive failures began as
+	// Unix nanoseconds, zero after a success
+	streakStart atomic.Int64
+
+	// latencySum and latencyCount accumulate time to response headers, in
+	// nanoseconds, for the current evaluation interval
+	latencySum   atomic.Int64
+	latencyCount atomic.Int64
+
+	// ejectedUntil is when the current ejection ends as Unix nanoseconds,
+	// zero when the backend is not ejected
+	ejectedUntil atomic.Int64
+
+	// readmittedAt is when the latest ejection ends as Unix nanoseconds,
+	// kept after the ejection expires to ramp the backend's share back up
+	readmittedAt atomic.Int64
+
+	// ejections is the total number of times the backend was ejected
+	ejections atomic.Int64
+}
+
+// ejected reports whether the backend is currently excluded from selection
+func (h *backendHealth) ejected(now time.Time) bool {
+	until := h.ejectedUntil.Load()
+	return until != 0 && now.UnixNano() < until
+}
+
+// minRecoveryWeight is the share of traffic a backend receives right after
+// its ejection ends when recovery is gradual
+const minRecoveryWeight = 0.1
+
+// weight returns the backend's share of traffic relative to a healthy
+// backend: 0 while ejected, ramping linearly from minRecoveryWeight to 1
+// over recovery once readmitted
+func (h *backendHealth) weight(now time.Time, recovery time.Duration) float64 {
+	if h.ejected(now) {
+		return 0
+	}
+
+	readmitted := h.readmittedAt.Load()
+	if recovery <= 0 || readmitted == 0 {
+		return 1
+	}
+
+	elapsed := now.UnixNano() - readmitted
+	if elapsed >= int64(recovery) {
+		return 1
+	}
+
+	return max(float64(elapsed)/float64(recovery), minRecoveryWeight)
+}
+
+// eject excludes the backend from selection until the given time
+func (h *backendHealth) eject(until time.Time) {
+	h.ejections.Add(1)
+	h.ejectedUntil.Store(until.UnixNano())
+	h.readmittedAt.Store(until.UnixNano())
+}
+
+// outlierDetector ejects backends that fail repeatedly or respond much
+// slower than the rest of the pool
+//
+// Ejected backends are skipped during selection until their ejection
+// expires, then readmitted gradually over RecoveryTime so a backend that
+// is still struggling is not flooded at once. If every backend is ejected,
+// selection falls back to the full pool rather than failing all traffic.
+type outlierDetector struct {
+	// cfg holds thresholds and ejection durations
+	cfg config.OutlierDetectionConfig
+
+	// mu serializes ejection decisions so MaxEjectionPercent holds
+	mu sync.Mutex
+
+	// paused suspends new ejections, e.g. during a maintenance window
+	paused atomic.Bool
+
+	// stop ends the evaluation loop
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// ErrOutlierDetectionDisabled is returned when controlling health checks
+// of a proxy without outlier detection
+var ErrOutlierDetectionDisabled = errors.New("outlier detection is disabled")
+
+// newOutlierDetector validates the configuration and creates a detector,
+// returning nil when outlier detection is disabled
+func newOutlierDetector(cfg config.OutlierDetectionConfig) (*outlierDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("outlier_detection: interval must be positive")
+	}
+
+	if cfg.ConsecutiveFailures < 0 || cfg.LatencyMultiplier < 0 || cfg.MinSamples < 0 || cfg.FailureWindow < 0 {
+		return nil, fmt.Errorf("outlier_detection: thresholds must not be negative")
+	}
+
+	if cfg.LatencyMultiplier > 0 && cfg.LatencyMultiplier <= 1 {
+		return nil, fmt.Errorf("outlier_detection: latency_multiplier must be greater than 1")
+	}
+
+	if cfg.MaxEjectionPercent < 0 || cfg.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("outlier_detection: max_ejection_percent must be between 0 and 100")
+	}
+
+	if cfg.BaseEjectionTime <= 0 || cfg.MaxEjectionTime < cfg.BaseEjectionTime {
+		return nil, fmt.Errorf("outlier_detection: invalid ejection times")
+	}
+
+	if cfg.RecoveryTime < 0 {
+		return nil, fmt.Errorf("outlier_detection: recovery_time must not be negative")
+	}
+
+	return &outlierDetector{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// close stops the evaluation loop
+func (o *outlierDetector) close() {
+	o.stopOnce.Do(func() { close(o.stop) })
+}
+
+// PauseHealthChecks stops outlier detection from ejecting backends until
+// ResumeHealthChecks is called. Outcomes are still recorded and existing
+// ejections expire as usual, so backends restarted during a maintenance
+// window are not ejected for the errors they cause while down.
+func (p *Proxy) PauseHealthChecks() error {
+	if p.outliers == nil {
+		return ErrOutlierDetectionDisabled
+	}
+
+	if !p.outliers.paused.Swap(true) {
+		p.logger.Info("Health checks paused")
+	}
+	return nil
+}
+
+// ResumeHealthChecks lets outlier detection eject backends again
+func (p *Proxy) ResumeHealthChecks() error {
+	if p.outliers == nil {
+		return ErrOutlierDetectionDisabled
+	}
+
+	if p.outliers.paused.Swap(false) {
+		p.logger.Info("Health checks resumed")
+	}
+	return nil
+}
+
+// HealthChecksPaused reports whether ejections are currently suspended
+func (p *Proxy) HealthChecksPaused() bool {
+	return p.outliers != nil && p.outliers.paused.Load()
+}
+
+// CheckHealth runs an outlier detection cycle immediately instead of
+// waiting for the next interval: expired ejections are restored, latency
+// since the last cycle is evaluated and ejections shared by cluster
+// members are adopted.
+func (p *Proxy) CheckHealth() error {
+	if p.outliers == nil {
+		return ErrOutlierDetectionDisabled
+	}
+
+	p.restoreExpired()
+	p.evaluateLatency()
+	p.adoptClusterEjections()
+	return nil
+}
+
+// available returns the backends neither ejected nor failing their active
+// health check, or all backends if every one of them is. Backends
+// recovering from an ejection are included with a probability of their
+// weight, so their share of traffic ramps up; they are always included
+// when no fully healthy backend is.
+func (p *Proxy) available(backends []*backend) []*backend {
+	if p.outliers == nil && !p.checked {
+		return backends
+	}
+
+	now := time.Now()
+	healthy := make([]*backend, 0, len(backends))
+	var recovering []*backend
+	full := 0
+
+	for _, b := range backends {
+		weight := b.health.weight(now, p.recoveryTime())
+		switch {
+		case weight == 0 || b.down():
+			continue
+		case weight == 1:
+			full++
+		case rand.Float64() >= weight:
+			recovering = append(recovering, b)
+			continue
+		}
+
+		healthy = append(healthy, b)
+	}
+
+	if full == 0 {
+		healthy = append(healthy, recovering...)
+	}
+
+	if len(healthy) == 0 {
+		return backends
+	}
+
+	return healthy
+}
+
+// recordOutcome feeds the result of a proxied request into outlier
+// detection
+func (p *Proxy) recordOutcome(b *backend, latency time.Duration, failed bool) {
+	if p.outliers == nil {
+		return
+	}
+
+	if !failed {
+		b.health.consecutiveFailures.Store(0)
+		b.health.streakStart.Store(0)
+		b.health.latencySum.Add(int64(latency))
+		b.health.latencyCount.Add(1)
+		return
+	}
+
+	threshold := int64(p.outliers.cfg.ConsecutiveFailures)
+	if threshold == 0 {
+		return
+	}
+
+	// A run of failures older than the window starts over with this one
+	if window := p.outliers.cfg.FailureWindow; window > 0 {
+		now := time.Now().UnixNano()
+		start := b.health.streakStart.Load()
+		if start == 0 || now-start > int64(window) {
+			b.health.streakStart.Store(now)
+			b.health.consecutiveFailures.Store(0)
+		}
+	}
+
+	if b.health.consecutiveFailures.Add(1) >= threshold {
+		b.health.consecutiveFailures.Store(0)
+		b.health.streakStart.Store(0)
+		p.eject(b, fmt.Sprintf("%d consecutive failures", threshold))
+	}
+}
+
+// runOutlierDetection evaluates latency and expires ejections every
+// interval until the proxy is closed
+func (p *Proxy) runOutlierDetection() {
+	ticker := time.NewTicker(p.outliers.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.outliers.stop:
+			return
+		case <-ticker.C:
+			p.restoreExpired()
+			p.evaluateLatency()
+			p.adoptClusterEjections()
+		}
+	}
+}
+
+// restoreExpired returns backends whose ejection has ended to selection
+func (p *Proxy) restoreExpired() {
+	now := time.Now().UnixNano()
+
+	for _, b := range p.snapshot() {
+		until := b.health.ejectedUntil.Load()
+		if until != 0 && now >= until && b.health.ejectedUntil.CompareAndSwap(until, 0) {
+			p.logger.LogTargetRestored(b.url.String())
+		}
+	}
+}
+
+// evaluateLatency ejects backends whose mean latency over the last
+// interval exceeds the configured multiple of the pool median.
+//
+// Only backends with at least MinSamples requests in the interval take
+// part. The lower median is used so that with two backends the faster one
+// is the reference.
+func (p *Proxy) evaluateLatency() {
+	type sample struct {
+		backend *backend
+		mean    time.Duration
+	}
+
+	var samples []sample
+	for _, b := range p.snapshot() {
+		sum := b.health.latencySum.Swap(0)
+		count := b.health.latencyCount.Swap(0)
+
+		if count > 0 && count >= int64(p.outliers.cfg.MinSamples) {
+			samples = append(samples, sample{backend: b, mean: time.Duration(sum / count)})
+		}
+	}
+
+	if p.outliers.cfg.LatencyMultiplier == 0 || len(samples) < 2 {
+		return
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].mean < samples[j].mean })
+	median := samples[(len(samples)-1)/2].mean
+	limit := time.Duration(float64(median) * p.outliers.cfg.LatencyMultiplier)
+
+	for _, s := range samples {
+		if s.mean > limit {
+			p.eject(s.backend, fmt.Sprintf("latency %s exceeds %s (pool median %s)", s.mean, limit, median))
+		}
+	}
+}
+
+// eject removes a backend from selection for a duration growing with the
+// number of times it has been ejected, unless that would exceed
+// MaxEjectionPercent of the pool or health checks are paused
+func (p *Proxy) eject(b *backend, reason string) {
+	o := p.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.paused.Load() {
+		return
+	}
+
+	now := time.Now()
+	if b.health.ejected(now) {
+		return
+	}
+
+	if !p.ejectable(now) {
+		return
+	}
+
+	count := b.health.ejections.Load() + 1
+	duration := time.Duration(count) * o.cfg.BaseEjectionTime
+	if duration > o.cfg.MaxEjectionTime {
+		duration = o.cfg.MaxEjectionTime
+	}
+
+	b.health.eject(now.Add(duration))
+	p.logger.LogTargetEjected(b.url.String(), reason, duration)
+	cluster.Current().ReportEjection(b.url.String(), now.Add(duration))
+}
+
+// ejectable reports whether one more backend may be ejected without
+// exceeding MaxEjectionPercent. Must be called with p.outliers.mu held.
+func (p *Proxy) ejectable(now time.Time) bool {
+	backends := p.snapshot()
+	ejected := 0
+	for _, other := range backends {
+		if other.health.ejected(now) {
+			ejected++
+		}
+	}
+
+	return (ejected+1)*100 <= p.outliers.cfg.MaxEjectionPercent*len(backends)
+}
+
+// adoptClusterEjections ejects the backends other cluster members ejected,
+// until their ejection ends there, within the same MaxEjectionPercent
+// limit and pause as local ejections
+func (p *Proxy) adoptClusterEjections() {
+	remote := cluster.Current().Ejections()
+	if len(remote) == 0 {
+		return
+	}
+
+	o := p.outliers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.paused.Load() {
+		return
+	}
+
+	now := time.Now()
+	for _, b := range p.snapshot() {
+		until, ok := remote[b.url.String()]
+		if !ok || b.health.ejected(now) || !p.ejectable(now) {
+			continue
+		}
+
+		b.health.eject(until)
+		p.logger.LogTargetEjected(b.url.String(), "ejected by a cluster member", until.Sub(now))
+	}
+}
+
+// recoveryTime returns how long readmitted backends take to ramp up to a
+// full share of traffic, zero without outlier detection
+func (p *Proxy) recoveryTime() time.Duration {
+	if p.outliers == nil {
+		return 0
+	}
+
+	return p.outliers.cfg.RecoveryTime
+}
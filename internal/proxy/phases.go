@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"time"
+
+	"velocity/internal/metrics"
+)
+
+// Upstream latency phases, in the order a request goes through them
+const (
+	// PhaseDial is establishing a new TCP connection, TLS excluded
+	PhaseDial = "dial"
+
+	// PhaseTLS is the TLS handshake of a new connection
+	PhaseTLS = "tls"
+
+	// PhaseTTFB is the time from the connection being ready until the
+	// first response byte: sending the request and the upstream's
+	// processing
+	PhaseTTFB = "ttfb"
+
+	// PhaseBody is the time from the first response byte until the
+	// response was relayed to the client
+	PhaseBody = "body"
+)
+
+// Phases lists the latency phases in order
+var Phases = [...]string{PhaseDial, PhaseTLS, PhaseTTFB, PhaseBody}
+
+// ClassError is the status class of attempts that produced no response
+const ClassError = "error"
+
+// StatusClasses lists the status classes latencies are broken out by
+var StatusClasses = [...]string{"2xx", "3xx", "4xx", "5xx", ClassError}
+
+// phaseBounds are the histogram bounds of phase latencies in seconds
+var phaseBounds = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// phaseTimings are the phase durations of one attempt. Phases the attempt
+// did not go through are zero.
+type phaseTimings struct {
+	dial, tls, ttfb, body time.Duration
+}
+
+// latencyBreakdown holds a backend's phase latency histograms by phase and
+// status class
+//
+// Thread safety: All methods are safe for concurrent use.
+type latencyBreakdown struct {
+	// buckets are indexed by position in Phases, then StatusClasses
+	buckets [len(Phases)][len(StatusClasses)]*metrics.Buckets
+}
+
+// newLatencyBreakdown creates empty histograms for every phase and class
+func newLatencyBreakdown() *latencyBreakdown {
+	l := &latencyBreakdown{}
+	for phase := range l.buckets {
+		for class := range l.buckets[phase] {
+			l.buckets[phase][class] = metrics.NewBuckets(phaseBounds...)
+		}
+	}
+
+	return l
+}
+
+// observe records the phases of an attempt answered with status, 0 when it
+// produced no response
+func (l *latencyBreakdown) observe(status int, t phaseTimings) {
+	class := statusClass(status)
+
+	for phase, d := range [...]time.Duration{t.dial, t.tls, t.ttfb, t.body} {
+		if d > 0 {
+			l.buckets[phase][class].Observe(d.Seconds())
+		}
+	}
+}
+
+// snapshot returns the histograms holding observations
+func (l *latencyBreakdown) snapshot() []PhaseStats {
+	var stats []PhaseStats
+
+	for phase := range l.buckets {
+		for class := range l.buckets[phase] {
+			if s := l.buckets[phase][class].Snapshot(); s.Count > 0 {
+				stats = append(stats, PhaseStats{Phase: Phases[phase], Class: StatusClasses[class], Latency: s})
+			}
+		}
+	}
+
+	return stats
+}
+
+// statusClass returns the index in StatusClasses of a response status
+func statusClass(status int) int {
+	if status < 200 || status >= 600 {
+		return len(StatusClasses) - 1
+	}
+
+	return status/100 - 2
+}
+
+// PhaseStats is the latency distribution of one phase of the requests to
+// a target that ended in one status class
+type PhaseStats struct {
+	// Phase is one of Phases
+	Phase string
+
+	// Class is one of StatusClasses
+	Class string
+
+	// Latency is the distribution in seconds
+	Latency metrics.BucketsSnapshot
+}
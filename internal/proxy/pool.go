@@ -0,0 +1,36 @@
+package proxy
+
+// pool is an immutable snapshot of the backends eligible for selection.
+//
+// The proxy publishes pools through an atomic pointer: request handlers
+// load the current pool without locking and keep using it for the whole
+// request, while target updates build a new pool next to it and swap it
+// in. A pool and its backends slice are never modified after publication.
+type pool struct {
+	// backends lists the backends in selection order
+	backends []*backend
+
+	// byURL indexes backends by target URL so updates can carry existing
+	// backends, with their stats and connections, over to the next pool
+	byURL map[string]*backend
+
+	// ring places the backends on a hash ring, nil unless consistent
+	// hashing is enabled
+	ring *hashRing
+}
+
+// newPool creates a pool of backends, which the pool takes ownership of,
+// with a hash ring when sel hashes consistently
+func newPool(backends []*backend, sel selector) *pool {
+	byURL := make(map[string]*backend, len(backends))
+	for _, b := range backends {
+		byURL[b.url.String()] = b
+	}
+
+	current := &pool{backends: backends, byURL: byURL}
+	if hasher, ok := sel.(*hashBalancer); ok {
+		current.ring = newHashRing(backends, hasher.virtualNodes)
+	}
+
+	return current
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+
+	"velocity/internal/config"
+	"velocity/internal/discovery"
+	"velocity/pkg/logger"
+)
+
+// BenchmarkSnapshot loads the pool from parallel request handlers while
+// discovery keeps replacing half of the targets
+func BenchmarkSnapshot(b *testing.B) {
+	cfg := config.DefaultConfig()
+	cfg.Targets = []config.TargetConfig{{URL: "http://127.0.0.1:9001", Enabled: true}}
+
+	p, err := New(cfg, logger.New(logger.LoggerConfig{Level: "error", Output: io.Discard}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+
+	sets := make([][]discovery.Target, 2)
+	for i := range 16 {
+		target, _ := url.Parse(fmt.Sprintf("http://10.0.%d.%d:8080", i%2, i))
+		sets[i%2] = append(sets[i%2], discovery.Target{URL: target, Weight: 1})
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				p.UpdateTargets(sets[i%2])
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if len(p.snapshot()) == 0 {
+				b.Error("empty snapshot")
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-stopped
+}
@@ -9,6 +9,8 @@
 // Key features:
 //   - Round-robin load balancing across multiple targets
 //   - Automatic failover when backends are unavailable
+//   - Dynamic targets with graceful draining of removed backends
+//   - Outlier detection ejecting failing or slow targets
 //   - Request logging and error handling
 //   - HTTP header forwarding for proper proxy behavior
 //
@@ -20,7 +22,7 @@
 //			{URL: "http://backend2:3000", Enabled: true},
 //		},
 //	}
-//	proxy, err := proxy.New(cfg)
+//	proxy, err := proxy.New(cfg, log)
 //	if err != nil {
 //		log.Fatal(err)
 //	}
@@ -28,40 +30,126 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"velocity/internal/accesslog"
+	"velocity/internal/bodybuf"
+	"velocity/internal/checksum"
 	"velocity/internal/config"
+	"velocity/internal/contract"
+	"velocity/internal/deadline"
+	"velocity/internal/debug"
+	"velocity/internal/dialer"
+	"velocity/internal/discovery"
+	"velocity/internal/grpcretry"
+	"velocity/internal/provenance"
+	"velocity/internal/router"
+	"velocity/internal/spiffe"
+	gwerrors "velocity/pkg/errors"
 	"velocity/pkg/logger"
 )
 
 // Proxy handles reverse proxying to backend targets with load balancing
 //
-// The proxy mantains a list of backend target URLs and distributes requests
+// The proxy mantains a list of backend targets and distributes requests
 // among them using round-robin scheduling. It automatically retries failed
 // requests on other available targets.
 //
 // Thread safety: All methods are safe for concurrent use by multiple goroutines
-// The atomic counter ensures race-free round-robin distribution.
+// The atomic counter ensures race-free round-robin distribution. The backend
+// list is an immutable pool swapped atomically on updates, so request
+// handlers read it without locks and keep using the pool they loaded even
+// while targets are updated.
 type Proxy struct {
-	// targets contains parsed URLs of all enabled backend services
-	targets []*url.URL
+	// pool holds the backends currently eligible for selection
+	pool atomic.Pointer[pool]
 
-	// current is an atomic counter used for round-robin target selection
-	current int64
+	// updateMu serializes target updates so concurrent updates never
+	// build on the same pool and lose each other's changes. Readers never
+	// take it.
+	updateMu sync.Mutex
 
-	// stats tracks request statistics per target
-	stats []TargetStats
+	// static contains the enabled targets from configuration, which are
+	// kept regardless of discovery updates
+	static []*url.URL
+
+	// staticProtocols maps static target URLs to their configured protocol
+	staticProtocols map[string]string
+
+	// staticTLS maps static target URLs to their own TLS configuration
+	staticTLS map[string]*tls.Config
+
+	// discoveryProtocol is the protocol of discovered targets
+	discoveryProtocol string
+
+	// shards is the number of worker groups the proxy's state is split
+	// into, 1 unless sharded workers are enabled
+	shards int
 
 	// logger for structured logging
 	logger *logger.Logger
+
+	// transport is the template cloned into every backend's connection pool
+	transport *http.Transport
+
+	// dialer establishes upstream connections and counts dials per
+	// address family
+	dialer *dialer.Dialer
+
+	// maxRetryBody is the largest request body buffered for retries
+	maxRetryBody int64
+
+	// maxResponseHeaders is the largest number of header fields accepted
+	// in an upstream response, zero for no limit
+	maxResponseHeaders int
+
+	// drainTimeout bounds how long removed backends wait for in-flight
+	// requests before their connections are closed
+	drainTimeout time.Duration
+
+	// svids supplies workload identity for upstream mTLS, nil when disabled
+	svids *spiffe.X509Source
+
+	// outliers ejects failing or slow backends, nil when disabled
+	outliers *outlierDetector
+
+	// correlation controls the X-Velocity-* headers sent upstream
+	correlation config.CorrelationHeadersConfig
+
+	// signer signs upstream requests, nil when request signing is disabled
+	signer *provenance.Signer
+
+	// affinity pins clients to targets, nil when disabled
+	affinity *affinity
+
+	// retries caps retries to a share of requests, nil when disabled
+	retries *retryBudget
+
+	// selector is the load balancing algorithm
+	selector selector
+
+	// checked reports whether any backend has an active health check
+	checked bool
+
+	// stop ends the active health checks
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // TargetStats holds request statistics for a single target
 type TargetStats struct {
+	// Target is the backend URL
+	Target string
+
 	// Requests is the total number of requests sent to this target
 	Requests int64
 
@@ -70,6 +158,47 @@ type TargetStats struct {
 
 	// Failures is the number of failed requests
 	Failures int64
+
+	// InFlight is the number of requests currently being proxied
+	InFlight int64
+
+	// Connections is the number of open connections to the target
+	Connections int64
+
+	// Ejected reports whether outlier detection currently excludes the
+	// target from selection
+	Ejected bool
+
+	// Ejections is the number of times the target was ejected
+	Ejections int64
+
+	// Weight is the target's share of traffic relative to a healthy
+	// target: 0 while ejected, below 1 while recovering from an ejection
+	Weight float64
+
+	// BalancerWeight is the target's share of traffic relative to the
+	// other targets of its priority, as reported by discovery, 1 for
+	// static targets
+	BalancerWeight int64
+
+	// Priority ranks the target for failover, lower first, as reported by
+	// discovery, 0 for static targets
+	Priority int64
+
+	// Protocol is the configured upstream protocol
+	Protocol string
+
+	// HealthCheck is the type of the target's active health check, empty
+	// without one
+	HealthCheck string
+
+	// Down reports whether the active health check currently takes the
+	// target out of rotation
+	Down bool
+
+	// Phases are the latency distributions by phase and status class that
+	// hold observations
+	Phases []PhaseStats
 }
 
 // New creates a new proxy instance configured with the given targets.
@@ -77,7 +206,8 @@ type TargetStats struct {
 // This constructor:
 //  1. Validates and parses all enabled target URLs
 //  2. Filters out disabled targets
-//  3. Returns an error if no enabled targets are found
+//  3. Returns an error if no enabled targets are found and discovery
+//     is disabled
 //
 // URL validation ensures that each target has a valid scheme (http/https)
 // and can be parsed correctly. Invalid URLs cause initialization to fail
@@ -86,6 +216,7 @@ type TargetStats struct {
 // Parameters:
 //
 //	cfg: Configuration containing target definitions
+//	log: Logger for proxy events
 //
 // Returns:
 //
@@ -94,12 +225,15 @@ type TargetStats struct {
 //
 // Example:
 //
-//	proxy, err := New(cfg)
+//	proxy, err := New(cfg, log)
 //	if err != nil {
 //	    return fmt.Errorf("proxy setup failed: %w", err)
 //	}
-func New(cfg *config.Config) (*Proxy, error) {
+func New(cfg *config.Config, log *logger.Logger) (*Proxy, error) {
 	var targets []*url.URL
+	staticProtocols := make(map[string]string)
+	staticTLS := make(map[string]*tls.Config)
+	checks := make(map[string]*activeCheck)
 
 	for _, target := range cfg.Targets {
 		if !target.Enabled {
@@ -111,95 +245,691 @@ func New(cfg *config.Config) (*Proxy, error) {
 			return nil, fmt.Errorf("invalid target URL %s: %w", target.URL, err)
 		}
 
+		if _, err := protocols(u, target.Protocol); err != nil {
+			return nil, err
+		}
+
+		check, err := newActiveCheck(target.URL, target.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig, err := targetTLS(u, target.TLS)
+		if err != nil {
+			return nil, err
+		}
+
+		if target.TLS.InsecureSkipVerify && !cfg.Offline {
+			log.Component("proxy").Warn("Certificate verification disabled for target", "target", target.URL)
+		}
+
 		targets = append(targets, u)
+		staticProtocols[u.String()] = target.Protocol
+		if tlsConfig != nil {
+			staticTLS[u.String()] = tlsConfig
+		}
+		if check != nil {
+			checks[u.String()] = check
+		}
+	}
+
+	switch cfg.Discovery.Protocol {
+	case "", ProtocolAuto, ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+	default:
+		return nil, fmt.Errorf("discovery: unknown protocol %q, expected http/1.1, h2, h2c or auto", cfg.Discovery.Protocol)
 	}
 
-	if len(targets) == 0 {
+	if len(targets) == 0 && !cfg.Discovery.Enabled {
 		return nil, fmt.Errorf("no enabled targets configured")
 	}
 
-	stats := make([]TargetStats, len(targets))
-	proxyLogger := logger.New(logger.LoggerConfig{
-		Level: cfg.Logging.Level,
-		Format: cfg.Logging.Format,
-	})
+	if cfg.Memory.MaxResponseHeaderBytes < 0 || cfg.Memory.MaxResponseHeaders < 0 {
+		return nil, fmt.Errorf("memory: max_response_header_bytes and max_response_headers must not be negative")
+	}
+
+	if pool := cfg.ConnectionPool; pool.MaxConnsPerTarget < 0 || pool.MaxIdleConnsPerTarget < 0 || pool.IdleTimeout < 0 {
+		return nil, fmt.Errorf("connection_pool: max_conns_per_target, max_idle_conns_per_target and idle_timeout must not be negative")
+	}
+
+	proxyLogger := log.Component("proxy")
+
+	outliers, err := newOutlierDetector(cfg.OutlierDetection)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := newAffinity(cfg.SessionAffinity)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := newRetryBudget(cfg.RetryBudget)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := shardCount(cfg.Experimental.ShardedWorkers)
+	if err != nil {
+		return nil, err
+	}
+
+	balancer, err := newSelector(cfg.LoadBalancing, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, upstreamDialer, svids, err := newTransport(cfg, proxyLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := provenance.New(cfg.RequestSigning)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		static:             targets,
+		staticProtocols:    staticProtocols,
+		staticTLS:          staticTLS,
+		discoveryProtocol:  cfg.Discovery.Protocol,
+		logger:             proxyLogger,
+		transport:          transport,
+		dialer:             upstreamDialer,
+		maxRetryBody:       cfg.Memory.MaxRetryBodyBytes,
+		maxResponseHeaders: cfg.Memory.MaxResponseHeaders,
+		drainTimeout:       cfg.Discovery.DrainTimeout,
+		svids:              svids,
+		outliers:           outliers,
+		correlation:        cfg.CorrelationHeaders,
+		signer:             signer,
+		affinity:           sessions,
+		retries:            budget,
+		selector:           balancer,
+		shards:             shards,
+		checked:            len(checks) > 0,
+		stop:               make(chan struct{}),
+	}
+
+	backends := make([]*backend, 0, len(targets))
+	for _, target := range targets {
+		b := newBackend(target, staticProtocols[target.String()], staticTLS[target.String()], transport, shards, signer)
+		b.check = checks[target.String()]
+		backends = append(backends, b)
+	}
+	p.pool.Store(newPool(backends, p.selector))
+
+	if outliers != nil {
+		go p.runOutlierDetection()
+	}
+
+	// An offline proxy is only built to validate its configuration
+	for _, b := range backends {
+		if b.check != nil && !cfg.Offline {
+			go p.runHealthCheck(b)
+		}
+	}
+
+	return p, nil
+}
+
+// Changes returns how many targets UpdateTargets would add or remove for
+// the given discovered targets
+func (p *Proxy) Changes(discovered []discovery.Target) int {
+	desired := make(map[string]bool, len(p.static)+len(discovered))
+	for _, target := range p.static {
+		desired[target.String()] = true
+	}
+	for _, target := range discovered {
+		desired[target.URL.String()] = true
+	}
+
+	current := p.pool.Load().byURL
+	changes := 0
+	for key := range desired {
+		if _, ok := current[key]; !ok {
+			changes++
+		}
+	}
+	for key := range current {
+		if !desired[key] {
+			changes++
+		}
+	}
+
+	return changes
+}
+
+// UpdateTargets replaces the discovered targets.
+//
+// The new target set is the static configuration plus discovered. Backends
+// present in both the old and new sets are kept, including their stats and
+// connection pools. Removed backends stop receiving new requests
+// immediately, but in-flight requests complete on them; their connection
+// pools are closed once drained or after the drain timeout.
+//
+// The update builds a new pool and publishes it in a single atomic swap;
+// requests in progress finish on the pool they started with. Kept
+// backends take the weight and priority of their new discovery entry;
+// static targets keep weight 1 and priority 0.
+func (p *Proxy) UpdateTargets(discovered []discovery.Target) {
+	desired := make([]discovery.Target, 0, len(p.static)+len(discovered))
+	for _, target := range p.static {
+		desired = append(desired, discovery.Target{URL: target, Weight: 1})
+	}
+	desired = append(desired, discovered...)
+
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	current := p.pool.Load()
+	existing := make(map[string]*backend, len(current.byURL))
+	for key, b := range current.byURL {
+		existing[key] = b
+	}
+
+	seen := make(map[string]bool, len(desired))
+	next := make([]*backend, 0, len(desired))
+
+	for _, target := range desired {
+		key := target.URL.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if b, ok := existing[key]; ok {
+			b.weight.Store(int64(max(target.Weight, 1)))
+			b.priority.Store(int64(target.Priority))
+			next = append(next, b)
+			delete(existing, key)
+			continue
+		}
+
+		protocol, static := p.staticProtocols[key]
+		if !static {
+			protocol = p.discoveryProtocol
+			if _, err := protocols(target.URL, protocol); err != nil {
+				p.logger.Warn("Discovered target skipped", "target", key, "error", err)
+				continue
+			}
+		}
+
+		b := newBackend(target.URL, protocol, p.staticTLS[key], p.transport, p.shards, p.signer)
+		b.weight.Store(int64(max(target.Weight, 1)))
+		b.priority.Store(int64(target.Priority))
+		next = append(next, b)
+		p.logger.LogTargetAdded(key)
+	}
+
+	p.pool.Store(newPool(next, p.selector))
 
-	return &Proxy{
-		targets: targets,
-		stats:   stats,
-		logger: proxyLogger,
-	}, nil
+	for _, b := range existing {
+		go p.drain(b)
+	}
+}
+
+// drain waits for a removed backend's in-flight requests to finish, then
+// closes its connection pool
+func (p *Proxy) drain(b *backend) {
+	p.logger.LogTargetDraining(b.url.String(), b.inFlight())
+
+	deadline := time.Now().Add(p.drainTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for b.inFlight() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+
+	remaining := b.inFlight()
+	b.closeIdleConnections()
+	p.logger.LogTargetDrained(b.url.String(), remaining)
+}
+
+// snapshot returns the current backend list without locking. The
+// returned slice must not be modified.
+func (p *Proxy) snapshot() []*backend {
+	return p.pool.Load().backends
+}
+
+// Close releases background resources such as the SPIFFE watcher and idle
+// upstream connections
+func (p *Proxy) Close() {
+	if p.outliers != nil {
+		p.outliers.close()
+	}
+
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	if p.svids != nil {
+		p.svids.Close()
+	}
+
+	for _, b := range p.snapshot() {
+		b.closeIdleConnections()
+	}
 }
 
 // ServeHTTP implements http.Handler and proxies to targets using round-robin
 // with retry
+//
+// Request bodies are buffered, within the memory budget, so they can be
+// replayed on retries. The buffer is shared with request signing and any
+// other inspection on the route, and capped by the route's body inspection
+// limit or the proxy's retry body limit. Bodies too large to buffer are
+// streamed to a single target without retries. Backends ejected by
+// outlier detection or failing their active health check are skipped.
+//
+// With session affinity, a pinned client is sent to its target first. If
+// that target is gone, ejected or fails, the failover strategy either
+// moves the session to the next target or rejects the request.
+//
+// Discovered targets with a priority are load balanced only while no
+// target of a lower priority is available. Retries try the rest of the
+// selected target's priority before moving on to the next one.
+//
+// Upstream failures are translated into GatewayErrors, which decide both
+// the status returned to the client and whether another target is tried:
+// requests that never reached an upstream are always retried, others only
+// when the method is idempotent.
+//
+// On routes retrying gRPC calls, trailers-only answers with a retried
+// grpc-status are retried after the pushback their upstream asked for,
+// and the last of them is passed to the client unchanged.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if len(p.targets) == 0 {
-		http.Error(w, "No targets available", http.StatusBadGateway)
+	current := p.pool.Load()
+	all := current.backends
+	backends := p.available(all)
+	if len(backends) == 0 {
+		gwerrors.New(gwerrors.CodeUpstreamUnavailable, "No targets available").
+			WithStatus(http.StatusBadGateway).
+			WriteJSON(w)
 		return
 	}
 
-	startIndex := atomic.AddInt64(&p.current, 1) - 1
-	for attempt := 0; attempt < len(p.targets); attempt++ {
-		targetIndex := (startIndex + int64(attempt)) % int64(len(p.targets))
-		target := p.targets[targetIndex]
+	// Only the lowest priority with available targets is load balanced;
+	// the others are kept for retries
+	backends, tier := byPriority(backends)
+
+	pinned := -1
+	if p.affinity != nil {
+		var reason string
+		if pinned, reason = p.affinity.pinned(r, all, backends); reason != "" && !p.affinity.broken(w, r, reason) {
+			return
+		}
+	}
+
+	// Pinned sessions take precedence over the load balancing algorithm
+	shard := p.shardOf(r)
+	first := pinned
+	if first < 0 {
+		first = p.selector.pick(r, current, backends[:tier], shard)
+	}
+
+	if echo := debug.FromContext(r.Context()); echo != nil {
+		p.echo(w, r, echo, backends[first])
+		return
+	}
+
+	if p.retries != nil {
+		p.retries.request()
+	}
+
+	r, release := bodybuf.Attach(r, p.maxRetryBody)
+	defer release()
+
+	attempts := len(backends)
+	body, ok, err := bodybuf.Read(r, p.maxRetryBody)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		attempts = 1
+	}
+
+	var lastErr *gwerrors.GatewayError
+	for attempt := 0; attempt < attempts; attempt++ {
+		b := backends[attemptIndex(first, attempt, tier, len(backends))]
+
+		// Rewind the buffered body for this attempt
+		if body != nil {
+			bodybuf.Read(r, p.maxRetryBody)
+		}
+
+		p.logger.LogProxy(r.Method, r.URL.Path, b.url.Host, attempt+1, len(backends))
 
-		p.logger.LogProxy(r.Method, r.URL.Path, target.Host, attempt+1, len(p.targets))
+		p.setCorrelation(r, b, attempt+1)
+		lastErr = p.tryTarget(w, r, b, shard)
+		if lastErr == nil {
+			return
+		}
+
+		lastErr.WithTarget(b.url.Host).WithAttempt(attempt + 1)
+		if !shouldRetry(lastErr, r) {
+			break
+		}
 
-		if p.tryTarget(w, r, target, int(targetIndex), attempt == len(p.targets)-1) {
+		if pinned >= 0 && attempt == 0 && attempts > 1 && !p.affinity.broken(w, r, AffinityFailed) {
 			return
 		}
+
+		if attempt == attempts-1 {
+			p.logger.LogAllTargetsFailed(r.Method, r.URL.Path)
+			break
+		}
+
+		// Fail fast rather than add load to a fleet already failing more
+		// requests than the budget absorbs
+		if p.retries != nil && !p.retries.allow() {
+			lastErr = gwerrors.Wrap(lastErr, gwerrors.CodeUpstreamUnavailable, "Upstream unavailable, retry budget exhausted").
+				WithTarget(b.url.Host).
+				WithAttempt(attempt + 1)
+			break
+		}
+
+		if !pushback(r, lastErr) {
+			break
+		}
+	}
+
+	if route, ok := router.RouteFromContext(r.Context()); ok {
+		lastErr.WithRoute(route.Config.Name)
 	}
 
-	p.logger.LogAllTargetsFailed(r.Method, r.URL.Path)
+	lastErr.Log(p.logger)
+
+	// gRPC clients get the upstream's own answer, not a gateway error
+	var status *grpcretry.StatusError
+	if errors.As(lastErr, &status) {
+		status.Write(w)
+		return
+	}
+
+	lastErr.WriteJSON(w)
+}
+
+// pushback waits for the delay a gRPC upstream asked for before the next
+// attempt, reporting false when the request ended meanwhile
+func pushback(r *http.Request, err *gwerrors.GatewayError) bool {
+	var status *grpcretry.StatusError
+	if !errors.As(err, &status) || status.Pushback <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(status.Pushback)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
 }
 
-// tryTarget attempts to proxy to a specific target, returns true if successful
-func (p *Proxy) tryTarget(w http.ResponseWriter, r *http.Request,
-	target *url.URL, targetIndex int, isLastAttempt bool) bool {
-	atomic.AddInt64(&p.stats[targetIndex].Requests, 1)
+// echo answers a debug echo request with the request that would be sent
+// to b, the target the load balancer or session affinity chose, without
+// contacting it or touching its statistics
+func (p *Proxy) echo(w http.ResponseWriter, r *http.Request, echo *debug.Echo, b *backend) {
+	outgoing := r.Clone(r.Context())
+	outgoing.Header.Set("X-Forwarded-Host", r.Host)
+	outgoing.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	p.setCorrelation(outgoing, b, 1)
+	deadline.Apply(outgoing)
+	httputil.NewSingleHostReverseProxy(b.url).Director(outgoing)
+
+	var route string
+	if matched, ok := router.RouteFromContext(r.Context()); ok {
+		route = matched.Config.Name
+	}
+
+	echo.Write(w, outgoing, route, b.url)
+}
+
+// checkHeaderCount fails a response carrying more header fields than
+// allowed. The size of the header section is limited by the transport.
+func (p *Proxy) checkHeaderCount(resp *http.Response) error {
+	if p.maxResponseHeaders <= 0 {
+		return nil
+	}
+
+	fields := 0
+	for _, values := range resp.Header {
+		fields += len(values)
+	}
+
+	if fields <= p.maxResponseHeaders {
+		return nil
+	}
+
+	return gwerrors.New(gwerrors.CodeUpstreamHeadersTooLarge, "Upstream response headers too large").
+		WithContext("header_fields", fields).
+		WithContext("max_header_fields", p.maxResponseHeaders)
+}
+
+// shouldRetry reports whether a failed attempt may be repeated on another
+// target
+func shouldRetry(err *gwerrors.GatewayError, r *http.Request) bool {
+	switch err.Code {
+	case gwerrors.CodeClientCanceled, gwerrors.CodeResourceExhausted, gwerrors.CodeUpstreamContract:
+		return false
+	}
+
+	return err.Retryable || isIdempotent(r)
+}
+
+// isIdempotent reports whether repeating the request is safe even if an
+// upstream already processed it
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// tryTarget attempts to proxy to a specific target. It returns nil on
+// success; on failure nothing has been written to w and the translated
+// error is returned for the caller to retry or report.
+func (p *Proxy) tryTarget(w http.ResponseWriter, r *http.Request, b *backend, shard int) *gwerrors.GatewayError {
+	target := b.url
+	counters := &b.counters[shard]
+
+	counters.requests.Add(1)
+	counters.inFlight.Add(1)
+	defer counters.inFlight.Add(-1)
+
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = b.roundTrippers[shard]
+
+	start := time.Now()
+	var latency time.Duration
+	var serverError bool
+	var status int
+
+	// Connection, TLS and first byte timings for the phase latencies and
+	// the access log
+	var getConn, gotConn, tlsStart, tlsDone, firstByte time.Time
+	var reused bool
+
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { getConn = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn = time.Now()
+			reused = info.Reused
+		},
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}))
+
+	grpcPolicy := grpcretry.FromContext(r.Context())
+	var upstream *http.Response
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		latency = time.Since(start)
+		if err := p.checkHeaderCount(resp); err != nil {
+			return err
+		}
+
+		if grpcPolicy != nil {
+			if status := grpcPolicy.Check(resp); status != nil {
+				err := gwerrors.Wrap(status, gwerrors.CodeUpstreamGRPCStatus, "Upstream answered a retryable gRPC status").
+					WithContext("grpc_status", status.Status)
+				// The upstream asked for the call to be retried
+				err.Retryable = true
+				return err
+			}
+			upstream = resp
+		}
+
+		status = resp.StatusCode
+		serverError = resp.StatusCode >= http.StatusInternalServerError
+		p.stripCorrelation(resp)
+
+		if p.affinity != nil {
+			p.affinity.stick(resp, b)
+		}
+
+		// Verify before the contract check buffers the body, so a
+		// mismatch found there is answered with a 502
+		if verifier := checksum.FromContext(r.Context()); verifier != nil {
+			verifier.Wrap(resp)
+		}
+
+		if validator := contract.FromContext(r.Context()); validator != nil {
+			return validator.Check(resp)
+		}
 
-	var failed bool
+		return nil
+	}
+
+	var gatewayErr *gwerrors.GatewayError
 	proxy.ErrorHandler = func(ew http.ResponseWriter, er *http.Request,
 		err error) {
 		p.logger.LogProxyFailure(target.Host, err)
-		failed = true
-
-		atomic.AddInt64(&p.stats[targetIndex].Failures, 1)
-
-		if isLastAttempt {
-			ew.Header().Set("Content-Type", "application/json")
-			ew.WriteHeader(http.StatusBadGateway)
+		gatewayErr = gwerrors.Translate(err)
 
-			fmt.Fprintf(ew, `{"error":"All targets unavailable","last_target":"%s","message":"%s"}`, target.Host, err.Error())
+		// A client going away says nothing about the target's health
+		if gatewayErr.Code != gwerrors.CodeClientCanceled {
+			counters.failures.Add(1)
 		}
 	}
 
 	r.Header.Set("X-Forwarded-Host", r.Host)
 	r.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	deadline.Apply(r)
 
 	proxy.ServeHTTP(w, r)
+	done := time.Now()
+
+	// gRPC failures arrive in the trailers of 200 responses
+	if upstream != nil && grpcPolicy.Failed(upstream) {
+		serverError = true
+	}
+
+	var timings phaseTimings
+	if !reused && !getConn.IsZero() && !gotConn.IsZero() {
+		if !tlsStart.IsZero() && !tlsDone.IsZero() {
+			timings.tls = tlsDone.Sub(tlsStart)
+		}
+		timings.dial = gotConn.Sub(getConn) - timings.tls
+	}
+
+	if !gotConn.IsZero() && !firstByte.IsZero() {
+		timings.ttfb = firstByte.Sub(gotConn)
+	}
+
+	if !firstByte.IsZero() && status != 0 {
+		timings.body = done.Sub(firstByte)
+	}
+
+	b.phases.observe(status, timings)
+
+	failed := gatewayErr != nil
+	if !failed || gatewayErr.Code != gwerrors.CodeClientCanceled {
+		p.recordOutcome(b, latency, failed || serverError)
+
+		if failed || serverError {
+			p.selector.observe(b, max(latency, failurePenalty))
+		} else {
+			p.selector.observe(b, latency)
+		}
+	}
+
+	if entry := accesslog.FromContext(r.Context()); entry != nil {
+		entry.Target = target.String()
+		entry.Attempts++
+		entry.ConnReused = reused
+		entry.Connect, entry.TTFB = timings.dial+timings.tls, 0
+		entry.TLS, entry.Body = timings.tls, timings.body
+
+		if !firstByte.IsZero() {
+			entry.TTFB = firstByte.Sub(start)
+		}
+	}
 
 	if !failed {
 		p.logger.LogProxySuccess(target.Host)
-		atomic.AddInt64(&p.stats[targetIndex].Successes, 1)
+		counters.successes.Add(1)
 	}
 
-	return !failed
+	return gatewayErr
 }
 
 // GetStats returns current statistics for all targets
 func (p *Proxy) GetStats() []TargetStats {
-	stats := make([]TargetStats, len(p.stats))
+	backends := p.snapshot()
+	stats := make([]TargetStats, len(backends))
+	now := time.Now()
 
-	for i := range p.stats {
+	for i, b := range backends {
 		stats[i] = TargetStats{
-			Requests:  atomic.LoadInt64(&p.stats[i].Requests),
-			Successes: atomic.LoadInt64(&p.stats[i].Successes),
-			Failures:  atomic.LoadInt64(&p.stats[i].Failures),
+			Target:         b.url.String(),
+			Ejected:        b.health.ejected(now),
+			Ejections:      b.health.ejections.Load(),
+			Weight:         b.health.weight(now, p.recoveryTime()),
+			BalancerWeight: b.weight.Load(),
+			Priority:       b.priority.Load(),
+			Down:           b.down(),
+			Protocol:       b.protocol,
+			Phases:         b.phases.snapshot(),
+			Connections:    b.conns.Load(),
+		}
+
+		if b.check != nil {
+			stats[i].HealthCheck = b.check.cfg.Type
+		}
+
+		if stats[i].Down {
+			stats[i].Weight = 0
+		}
+
+		// Shards count independently, the target's figures are their sum
+		for j := range b.counters {
+			counters := &b.counters[j]
+			stats[i].Requests += counters.requests.Load()
+			stats[i].Successes += counters.successes.Load()
+			stats[i].Failures += counters.failures.Load()
+			stats[i].InFlight += counters.inFlight.Load()
 		}
 	}
 
 	return stats
 }
+
+// Signer returns the signer of upstream requests, nil when request
+// signing is disabled
+func (p *Proxy) Signer() *provenance.Signer {
+	return p.signer
+}
+
+// DialStats returns upstream connection statistics by address family
+func (p *Proxy) DialStats() dialer.Stats {
+	return p.dialer.Stats()
+}
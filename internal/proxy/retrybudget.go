@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+)
+
+// retryBudgetSlots is the number of slots the budget window is split into.
+// Counts age out one slot at a time.
+const retryBudgetSlots = 10
+
+// retryBudget caps retries to a share of the requests received over a
+// sliding window
+//
+// Thread safety: All methods are safe for concurrent use.
+type retryBudget struct {
+	// ratio is the share of requests that may be retried
+	ratio float64
+
+	// minRetries are allowed per window regardless of ratio
+	minRetries int64
+
+	// slot is the duration of one slot
+	slot time.Duration
+
+	// mu guards slots and the totals
+	mu sync.Mutex
+
+	// slots count requests and retries, indexed by slot number modulo
+	// retryBudgetSlots
+	slots [retryBudgetSlots]budgetSlot
+
+	// requests, retries and denied are totals since start
+	requests, retries, denied int64
+}
+
+// budgetSlot holds the counts of one slot of the window
+type budgetSlot struct {
+	// number identifies the slot's period since the Unix epoch
+	number int64
+
+	requests, retries int64
+}
+
+// RetryBudgetStats is a snapshot of a pool's retry budget
+type RetryBudgetStats struct {
+	// Ratio is the configured share of requests that may be retried
+	Ratio float64
+
+	// Requests counts requests received
+	Requests int64
+
+	// Retries counts retries sent within the budget
+	Retries int64
+
+	// Denied counts retries refused because the budget was spent
+	Denied int64
+}
+
+// newRetryBudget validates the configuration and returns nil when the
+// retry budget is disabled
+func newRetryBudget(cfg config.RetryBudgetConfig) (*retryBudget, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Ratio < 0 || cfg.Window <= 0 || cfg.MinRetries < 0 {
+		return nil, fmt.Errorf("retry_budget: ratio and min_retries must not be negative, window must be positive")
+	}
+
+	return &retryBudget{
+		ratio:      cfg.Ratio,
+		minRetries: int64(cfg.MinRetries),
+		slot:       max(cfg.Window/retryBudgetSlots, 1),
+	}, nil
+}
+
+// request records a request received by the pool
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.current(time.Now()).requests++
+	b.requests++
+}
+
+// allow reports whether a retry fits the budget, recording it if it does
+func (b *retryBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	oldest := b.number(now) - retryBudgetSlots + 1
+
+	var requests, retries int64
+	for _, slot := range b.slots {
+		if slot.number >= oldest {
+			requests += slot.requests
+			retries += slot.retries
+		}
+	}
+
+	if retries >= b.minRetries && float64(retries+1) > b.ratio*float64(requests) {
+		b.denied++
+		return false
+	}
+
+	b.current(now).retries++
+	b.retries++
+	return true
+}
+
+// current returns the slot of now, clearing it when it last held an
+// earlier period
+func (b *retryBudget) current(now time.Time) *budgetSlot {
+	number := b.number(now)
+
+	slot := &b.slots[number%retryBudgetSlots]
+	if slot.number != number {
+		*slot = budgetSlot{number: number}
+	}
+
+	return slot
+}
+
+// number returns the period since the Unix epoch now falls in
+func (b *retryBudget) number(now time.Time) int64 {
+	return now.UnixNano() / int64(b.slot)
+}
+
+// RetryBudgetStats returns the retry budget's counters, or false when the
+// pool has no budget
+func (p *Proxy) RetryBudgetStats() (RetryBudgetStats, bool) {
+	if p.retries == nil {
+		return RetryBudgetStats{}, false
+	}
+
+	p.retries.mu.Lock()
+	defer p.retries.mu.Unlock()
+
+	return RetryBudgetStats{
+		Ratio:    p.retries.ratio,
+		Requests: p.retries.requests,
+		Retries:  p.retries.retries,
+		Denied:   p.retries.denied,
+	}, true
+}
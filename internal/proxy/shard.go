@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+
+	"velocity/internal/config"
+)
+
+// cacheLine is the size padded to so per-shard state of different shards
+// never shares a cache line
+const cacheLine = 64
+
+// shardCounters are one shard's share of a backend's statistics. Shards
+// count independently and GetStats merges them.
+type shardCounters struct {
+	// requests, successes and failures count attempts by outcome
+	requests, successes, failures atomic.Int64
+
+	// inFlight is the number of attempts in progress
+	inFlight atomic.Int64
+
+	_ [cacheLine - 32]byte
+}
+
+// cursor is one shard's round-robin position
+type cursor struct {
+	// next is the index the next request starts at
+	next atomic.Int64
+
+	_ [cacheLine - 8]byte
+}
+
+// connectionSeq numbers accepted client connections for shard assignment
+var connectionSeq atomic.Uint64
+
+// shardKey is the context key for the shard key of a client connection
+type shardKey struct{}
+
+// ConnContext is an http.Server ConnContext hook giving every client
+// connection its own shard key, so in sharded mode all requests of a
+// connection are handled by the same worker group
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return WithShardKey(ctx, connectionSeq.Add(1))
+}
+
+// WithShardKey returns a copy of ctx whose requests are assigned to the
+// shard key selects
+func WithShardKey(ctx context.Context, key uint64) context.Context {
+	return context.WithValue(ctx, shardKey{}, key)
+}
+
+// shardCount returns the number of shards configured, 1 when sharding is
+// disabled
+func shardCount(cfg config.ShardedWorkersConfig) (int, error) {
+	if !cfg.Enabled {
+		return 1, nil
+	}
+
+	if cfg.Shards < 0 {
+		return 0, fmt.Errorf("experimental: sharded_workers: shards must not be negative")
+	}
+
+	if cfg.Shards == 0 {
+		return runtime.GOMAXPROCS(0), nil
+	}
+
+	return cfg.Shards, nil
+}
+
+// shardOf returns the shard handling a request: the shard of its client
+// connection, or a random one for requests without a shard key
+func (p *Proxy) shardOf(r *http.Request) int {
+	if p.shards == 1 {
+		return 0
+	}
+
+	if key, ok := r.Context().Value(shardKey{}).(uint64); ok {
+		return int(key % uint64(p.shards))
+	}
+
+	return rand.IntN(p.shards)
+}
+
+// Shards returns the number of worker groups the proxy's state is split
+// into, 1 unless sharded workers are enabled
+func (p *Proxy) Shards() int {
+	return p.shards
+}
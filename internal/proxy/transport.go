@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"velocity/internal/config"
+	"velocity/internal/dialer"
+	"velocity/internal/egress"
+	"velocity/internal/spiffe"
+	"velocity/pkg/logger"
+)
+
+// newTransport builds the shared upstream transport.
+//
+// The transport is cloned from http.DefaultTransport so connection pooling
+// and timeouts keep their standard behaviour, and dials through the Happy
+// Eyeballs dialer. When an egress proxy is configured, connections are
+// tunneled through it instead of the proxy taken from the environment.
+// Upstream response headers are read up to the memory configuration's
+// header size limit, and connections per target are limited by the
+// connection pool configuration. When SPIFFE is enabled, the transport presents the
+// gateway's SVID and verifies upstream SVIDs; the returned source must be
+// closed when the proxy shuts down. An offline transport does not contact
+// the workload API and has no SVID.
+func newTransport(cfg *config.Config, log *logger.Logger) (*http.Transport, *dialer.Dialer, *spiffe.X509Source, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = cfg.Memory.MaxResponseHeaderBytes
+	transport.MaxConnsPerHost = cfg.ConnectionPool.MaxConnsPerTarget
+	transport.MaxIdleConnsPerHost = cfg.ConnectionPool.MaxIdleConnsPerTarget
+	if cfg.ConnectionPool.IdleTimeout > 0 {
+		transport.IdleConnTimeout = cfg.ConnectionPool.IdleTimeout
+	}
+
+	upstreamDialer, err := dialer.New(cfg.UpstreamDial)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	transport.DialContext = upstreamDialer.DialContext
+
+	egressDialer, err := egress.New(cfg.EgressProxy, upstreamDialer.DialContext)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if egressDialer != nil {
+		transport.DialContext = egressDialer.DialContext
+		transport.Proxy = nil
+		log.Info("Upstream connections use egress proxy", "proxy", egressDialer.Proxy())
+	}
+
+	if !cfg.UpstreamTLS.SPIFFE.Enabled || cfg.Offline {
+		return transport, upstreamDialer, nil, nil
+	}
+
+	source, err := spiffe.NewX509Source(context.Background(), cfg.UpstreamTLS.SPIFFE, log.Component("spiffe"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("SPIFFE workload identity unavailable: %w", err)
+	}
+
+	transport.TLSClientConfig = source.ClientTLSConfig()
+	return transport, upstreamDialer, source, nil
+}
+
+// targetTLS returns the TLS configuration of an https target, or nil when
+// the target uses the shared transport's. The client certificate and CA
+// bundle are read here.
+func targetTLS(target *url.URL, cfg config.TargetTLSConfig) (*tls.Config, error) {
+	if cfg == (config.TargetTLSConfig{}) {
+		return nil, nil
+	}
+
+	if target.Scheme != "https" {
+		return nil, fmt.Errorf("target %s: tls requires an https target", target)
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("target %s: tls: cert_file and key_file must be set together", target)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: tls: failed to load client certificate: %w", target, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: tls: failed to read CA bundle: %w", target, err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("target %s: tls: no certificates found in %s", target, cfg.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	return tlsConfig, nil
+}
+
+// DialContext connects to a target address the way upstream requests do,
+// through the egress proxy when one is configured
+func (p *Proxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return p.transport.DialContext(ctx, network, address)
+}
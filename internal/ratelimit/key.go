@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"velocity/internal/auth"
+	"velocity/internal/router"
+)
+
+// KeyFunc derives the limiter key for a request
+type KeyFunc func(r *http.Request) string
+
+// ParseKey compiles a key expression.
+//
+// An expression is one or more terms joined by "+". Each term evaluates to
+// a string and the results are quoted and concatenated with "|", so no
+// value can pass for two:
+//
+//	client_ip        remote address of the client
+//	route            name of the matched route ("default" if none)
+//	method, host, path
+//	header.NAME      value of request header NAME
+//	query.NAME       value of query parameter NAME
+//	cookie.NAME      value of cookie NAME
+//	claim.NAME       validated JWT claim (dot notation for nesting)
+//	'literal'        a fixed string
+//
+// Example: "claim.tenant_id + route" gives each tenant its own bucket per
+// route. Missing values evaluate to the empty string.
+func ParseKey(expr string) (KeyFunc, error) {
+	if strings.TrimSpace(expr) == "" {
+		expr = "client_ip"
+	}
+
+	var terms []KeyFunc
+	for _, raw := range strings.Split(expr, "+") {
+		term, err := parseTerm(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit key %q: %w", expr, err)
+		}
+
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return func(r *http.Request) string {
+		parts := make([]string, len(terms))
+		for i, term := range terms {
+			parts[i] = strconv.Quote(term(r))
+		}
+
+		return strings.Join(parts, "|")
+	}, nil
+}
+
+// KeyHeaders returns the names of the request headers a key expression
+// reads, so callers can treat them as client credentials
+func KeyHeaders(expr string) []string {
+	var names []string
+	for _, raw := range strings.Split(expr, "+") {
+		if source, name, ok := strings.Cut(strings.TrimSpace(raw), "."); ok && source == "header" && name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// parseTerm compiles a single key term
+func parseTerm(term string) (KeyFunc, error) {
+	if len(term) >= 2 && term[0] == '\'' && term[len(term)-1] == '\'' {
+		literal := term[1 : len(term)-1]
+		return func(*http.Request) string { return literal }, nil
+	}
+
+	switch term {
+	case "client_ip":
+		return ClientIP, nil
+
+	case "route":
+		return func(r *http.Request) string {
+			if route, ok := router.RouteFromContext(r.Context()); ok {
+				return route.Config.Name
+			}
+
+			return "default"
+		}, nil
+
+	case "method":
+		return func(r *http.Request) string { return r.Method }, nil
+
+	case "host":
+		return func(r *http.Request) string { return r.Host }, nil
+
+	case "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	}
+
+	source, name, ok := strings.Cut(term, ".")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("unknown term %q", term)
+	}
+
+	switch source {
+	case "header":
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+
+	case "query":
+		return func(r *http.Request) string { return r.URL.Query().Get(name) }, nil
+
+	case "cookie":
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+
+			return ""
+		}, nil
+
+	case "claim":
+		return func(r *http.Request) string {
+			if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+				value, _ := claims.String(name)
+				return value
+			}
+
+			return ""
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown term %q", term)
+}
+
+// ClientIP returns the host part of the request's remote address
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
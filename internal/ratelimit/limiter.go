@@ -0,0 +1,220 @@
+// Package ratelimit provides keyed rate limiting.
+//
+// Each distinct key (client IP, tenant, API key, or any combination
+// expressed with ParseKey) gets its own bucket. Buckets refill continuously
+// at the configured rate up to the burst size; idle buckets are discarded
+// periodically so memory stays proportional to the active key set.
+//
+// Two algorithms implement the Limiter interface: TokenBucket allows bursts
+// up to the bucket size, SpikeArrest spaces requests evenly.
+//
+// Example usage:
+//
+//	limiter := ratelimit.NewTokenBucket(10, 20)
+//	if ok, retryAfter := limiter.Allow("tenant-a"); !ok {
+//		// reject, ask the client to retry after retryAfter
+//	}
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are discarded
+const sweepInterval = time.Minute
+
+// Limiter decides whether a request identified by key may proceed
+type Limiter interface {
+	// Allow consumes capacity for key. When rejected, the returned
+	// duration is how long until the key has capacity again.
+	Allow(key string) (bool, time.Duration)
+
+	// Remaining returns how many requests key could make right now
+	Remaining(key string) int
+
+	// Limit returns the maximum number of requests allowed at once
+	Limit() int
+
+	// Consume charges key with n requests admitted elsewhere, such as by
+	// other cluster members
+	Consume(key string, n float64)
+
+	// Inspect returns the state of key without consuming capacity
+	Inspect(key string) Snapshot
+}
+
+// Snapshot is the state of one key in a limiter
+type Snapshot struct {
+	// Tokens is the capacity available to the key right now, fractional
+	// for token buckets between two refills
+	Tokens float64
+
+	// RetryAfter is how long until the key may make its next request,
+	// zero when it may make one now
+	RetryAfter time.Duration
+
+	// Reset is how long until the key is back to full capacity
+	Reset time.Duration
+
+	// Tracked reports whether the limiter holds state for the key. Keys
+	// without state, never seen or idle long enough to be discarded, have
+	// full capacity.
+	Tracked bool
+}
+
+// TokenBucket is a set of token buckets keyed by string
+//
+// Thread safety: All methods are safe for concurrent use.
+type TokenBucket struct {
+	// rate is the refill rate in tokens per second
+	rate float64
+
+	// burst is the bucket capacity
+	burst float64
+
+	// mu guards buckets and lastSweep
+	mu sync.Mutex
+
+	// buckets holds the state of every active key
+	buckets map[string]*bucket
+
+	// lastSweep is when idle buckets were last discarded
+	lastSweep time.Time
+
+	// now is the clock, replaceable for deterministic behaviour
+	now func() time.Time
+}
+
+// bucket is the state of a single key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a limiter allowing rate requests per second with
+// bursts of up to burst requests. A burst below one is raised to one.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from key's bucket.
+//
+// Returns:
+//
+//	bool: Whether the request is allowed
+//	time.Duration: When a token becomes available if rejected
+func (l *TokenBucket) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Remaining returns the whole tokens currently available for key
+func (l *TokenBucket) Remaining(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return int(l.burst)
+	}
+
+	tokens := math.Min(l.burst, b.tokens+l.now().Sub(b.last).Seconds()*l.rate)
+	return int(tokens)
+}
+
+// Limit returns the bucket capacity
+func (l *TokenBucket) Limit() int {
+	return int(l.burst)
+}
+
+// Consume takes n tokens from key's bucket. The bucket does not go below
+// empty, so consumption beyond the burst is forgiven.
+func (l *TokenBucket) Consume(key string, n float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Max(0, math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)-n)
+	b.last = now
+}
+
+// Inspect implements Limiter
+func (l *TokenBucket) Inspect(key string) Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return Snapshot{Tokens: l.burst}
+	}
+
+	tokens := math.Min(l.burst, b.tokens+l.now().Sub(b.last).Seconds()*l.rate)
+	snapshot := Snapshot{
+		Tokens:  tokens,
+		Reset:   time.Duration((l.burst - tokens) / l.rate * float64(time.Second)),
+		Tracked: true,
+	}
+
+	if tokens < 1 {
+		snapshot.RetryAfter = time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+
+	return snapshot
+}
+
+// sweep discards buckets that have been idle long enough to be full again.
+// Must be called with l.mu held.
+func (l *TokenBucket) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+
+	"velocity/internal/cluster"
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Middleware returns a middleware enforcing the rate limit policy.
+//
+// Rejected requests receive 429 Too Many Requests with a Retry-After
+// header derived from the limiter's refill state and capped by the route's
+// max_retry_after. Allowed requests carry X-RateLimit-Limit and
+// X-RateLimit-Remaining so clients can pace themselves.
+//
+// In a cluster, scope names the policy across members, e.g. "global" or
+// "route:orders", so each member's limiter also counts the requests the
+// others admitted for the same scope and key.
+//
+// Returns nil when the policy is disabled. Use NewPolicy to also inspect
+// the state of the limiter.
+func Middleware(cfg config.RateLimitConfig, scope string) (middleware.Middleware, error) {
+	policy, err := NewPolicy(cfg, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.Middleware(), nil
+}
+
+// newLimiter creates the limiter for the configured mode.
+// The rate is taken from requests/window when a window is set, otherwise
+// from requests_per_second.
+func newLimiter(cfg config.RateLimitConfig) (Limiter, error) {
+	rate := cfg.RequestsPerSecond
+	if cfg.Window > 0 {
+		rate = float64(cfg.Requests) / cfg.Window.Seconds()
+	}
+
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate_limit: rate must be positive")
+	}
+
+	switch cfg.Mode {
+	case "", "token_bucket":
+		return NewTokenBucket(rate, cfg.Burst), nil
+
+	case "spike_arrest":
+		return NewSpikeArrest(rate), nil
+
+	default:
+		return nil, fmt.Errorf("rate_limit: unknown mode %q", cfg.Mode)
+	}
+}
+
+// clustered shares a limiter's consumption with the other cluster members
+type clustered struct {
+	Limiter
+
+	// node exchanges consumption with the other members
+	node *cluster.Node
+
+	// scope names the policy across members
+	scope string
+}
+
+// Allow implements Limiter. Requests admitted by other members since the
+// last call are charged before deciding, and an admitted request is
+// reported to them.
+func (c *clustered) Allow(key string) (bool, time.Duration) {
+	if remote := c.node.TakeRemote(c.scope, key); remote > 0 {
+		c.Limiter.Consume(key, remote)
+	}
+
+	allowed, retryAfter := c.Limiter.Allow(key)
+	if allowed {
+		c.node.Consumed(c.scope, key, 1)
+	}
+
+	return allowed, retryAfter
+}
@@ -0,0 +1,274 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velocity/internal/cluster"
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/retryafter"
+)
+
+// rejectionHistory is how many rejections a policy remembers, across keys
+const rejectionHistory = 256
+
+// maxKeyRejections is how many rejections State lists for one key
+const maxKeyRejections = 20
+
+// Policy enforces one rate limit configuration and remembers its recent
+// rejections, so an operator can tell a client why it is being limited
+// without searching the logs.
+//
+// Thread safety: All methods are safe for concurrent use.
+type Policy struct {
+	// scope names the policy, e.g. "global" or "route:orders"
+	scope string
+
+	// cfg is the policy's configuration
+	cfg config.RateLimitConfig
+
+	// limiter holds the per-key state
+	limiter Limiter
+
+	// keyFunc derives the key of a request
+	keyFunc KeyFunc
+
+	// mu guards rejections and next
+	mu sync.Mutex
+
+	// rejections is a ring of the most recent rejections
+	rejections []Rejection
+
+	// next is the ring position of the next rejection
+	next int
+}
+
+// Rejection is one request rejected by a policy
+type Rejection struct {
+	// Key is the limiter key of the request
+	Key string `json:"key"`
+
+	// Time is when the request was rejected
+	Time time.Time `json:"time"`
+
+	// RetryAfterSeconds is how long the client was told to wait
+	RetryAfterSeconds float64 `json:"retry_after_seconds"`
+}
+
+// State is the limiter state of one key in a policy
+type State struct {
+	// Scope names the policy
+	Scope string `json:"scope"`
+
+	// KeyExpression is the expression deriving keys from requests
+	KeyExpression string `json:"key_expression"`
+
+	// Mode is the limiting algorithm, token_bucket or spike_arrest
+	Mode string `json:"mode"`
+
+	// Key is the inspected key
+	Key string `json:"key"`
+
+	// Limit is the maximum number of requests allowed at once
+	Limit int `json:"limit"`
+
+	// Remaining is how many requests the key could make right now
+	Remaining int `json:"remaining"`
+
+	// Tokens is the capacity available to the key, fractional between
+	// two refills
+	Tokens float64 `json:"tokens"`
+
+	// RetryAfterSeconds is how long until the key may make its next
+	// request, zero when it may make one now
+	RetryAfterSeconds float64 `json:"retry_after_seconds"`
+
+	// ResetAt is when the key is back to full capacity
+	ResetAt time.Time `json:"reset_at"`
+
+	// Tracked reports whether the limiter holds state for the key. Keys
+	// it holds none for have not sent requests recently.
+	Tracked bool `json:"tracked"`
+
+	// Rejections are the key's most recent rejections, newest first
+	Rejections []Rejection `json:"rejections"`
+}
+
+// Summary describes a policy and its most recent rejections
+type Summary struct {
+	// Scope names the policy
+	Scope string `json:"scope"`
+
+	// KeyExpression is the expression deriving keys from requests
+	KeyExpression string `json:"key_expression"`
+
+	// Mode is the limiting algorithm, token_bucket or spike_arrest
+	Mode string `json:"mode"`
+
+	// Limit is the maximum number of requests allowed at once
+	Limit int `json:"limit"`
+
+	// Rejections are the most recent rejections across keys, newest first
+	Rejections []Rejection `json:"rejections"`
+}
+
+// NewPolicy creates the policy for a rate limit configuration, or returns
+// nil when it is disabled. scope names the policy in a cluster and in
+// State; see Middleware.
+//
+// Returns an error for an invalid rate, mode or key expression.
+func NewPolicy(cfg config.RateLimitConfig, scope string) (*Policy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	limiter, err := newLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if node := cluster.Current(); node != nil {
+		limiter = &clustered{Limiter: limiter, node: node, scope: scope}
+	}
+
+	keyFunc, err := ParseKey(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Policy{
+		scope:      scope,
+		cfg:        cfg,
+		limiter:    limiter,
+		keyFunc:    keyFunc,
+		rejections: make([]Rejection, 0, rejectionHistory),
+	}, nil
+}
+
+// Scope returns the name of the policy
+func (p *Policy) Scope() string {
+	return p.scope
+}
+
+// Middleware returns the middleware enforcing the policy, described on
+// the package-level Middleware. Returns nil when p is nil.
+func (p *Policy) Middleware() middleware.Middleware {
+	if p == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := p.keyFunc(r)
+			allowed, retryAfter := p.limiter.Allow(key)
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(p.limiter.Limit()))
+
+			if !allowed {
+				p.reject(key, retryAfter)
+
+				seconds := retryafter.Set(w, r, retryAfter)
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				fmt.Fprintf(w, `{"error":"Rate limit exceeded","retry_after":%d}`, seconds)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(p.limiter.Remaining(key)))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reject remembers a rejection, replacing the oldest once the history is
+// full
+func (p *Policy) reject(key string, retryAfter time.Duration) {
+	rejection := Rejection{Key: key, Time: time.Now(), RetryAfterSeconds: retryAfter.Seconds()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.rejections) < rejectionHistory {
+		p.rejections = append(p.rejections, rejection)
+	} else {
+		p.rejections[p.next] = rejection
+	}
+
+	p.next = (p.next + 1) % rejectionHistory
+}
+
+// recent returns up to limit remembered rejections, newest first: those
+// of key, or those of every key when all is set
+func (p *Policy) recent(key string, all bool, limit int) []Rejection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rejections := []Rejection{}
+	for i := 1; i <= len(p.rejections) && len(rejections) < limit; i++ {
+		rejection := p.rejections[(p.next-i+rejectionHistory)%rejectionHistory]
+		if all || rejection.Key == key {
+			rejections = append(rejections, rejection)
+		}
+	}
+
+	return rejections
+}
+
+// State returns the state of key without consuming capacity. In a
+// cluster, requests other members admitted since the key's last request
+// here are not yet counted.
+func (p *Policy) State(key string) State {
+	snapshot := p.limiter.Inspect(key)
+	now := time.Now()
+
+	return State{
+		Scope:             p.scope,
+		KeyExpression:     p.keyExpression(),
+		Mode:              p.mode(),
+		Key:               key,
+		Limit:             p.limiter.Limit(),
+		Remaining:         int(snapshot.Tokens),
+		Tokens:            snapshot.Tokens,
+		RetryAfterSeconds: snapshot.RetryAfter.Seconds(),
+		ResetAt:           now.Add(snapshot.Reset),
+		Tracked:           snapshot.Tracked,
+		Rejections:        p.recent(key, false, maxKeyRejections),
+	}
+}
+
+// Summary describes the policy with up to limit of its most recent
+// rejections
+func (p *Policy) Summary(limit int) Summary {
+	return Summary{
+		Scope:         p.scope,
+		KeyExpression: p.keyExpression(),
+		Mode:          p.mode(),
+		Limit:         p.limiter.Limit(),
+		Rejections:    p.recent("", true, limit),
+	}
+}
+
+// keyExpression returns the key expression with its default applied
+func (p *Policy) keyExpression() string {
+	if strings.TrimSpace(p.cfg.Key) == "" {
+		return "client_ip"
+	}
+
+	return p.cfg.Key
+}
+
+// mode returns the limiting algorithm with its default applied
+func (p *Policy) mode() string {
+	if p.cfg.Mode == "" {
+		return "token_bucket"
+	}
+
+	return p.cfg.Mode
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SpikeArrest smooths traffic by spacing requests evenly.
+//
+// Instead of allowing a full burst at the start of a window, each key may
+// make one request per interval (1/rate). A limit of 100 per minute is
+// therefore enforced as one request every 600ms, which protects backends
+// that cannot absorb bursts.
+//
+// Thread safety: All methods are safe for concurrent use.
+type SpikeArrest struct {
+	// interval is the minimum spacing between requests of the same key
+	interval time.Duration
+
+	// mu guards next and lastSweep
+	mu sync.Mutex
+
+	// next holds the earliest time each key may make its next request
+	next map[string]time.Time
+
+	// lastSweep is when expired keys were last discarded
+	lastSweep time.Time
+
+	// now is the clock, replaceable for deterministic behaviour
+	now func() time.Time
+}
+
+// NewSpikeArrest creates a limiter allowing one request every 1/rate
+// seconds per key
+func NewSpikeArrest(rate float64) *SpikeArrest {
+	return &SpikeArrest{
+		interval:  time.Duration(float64(time.Second) / rate),
+		next:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow implements Limiter
+func (s *SpikeArrest) Allow(key string) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if next, ok := s.next[key]; ok && now.Before(next) {
+		return false, next.Sub(now)
+	}
+
+	s.next[key] = now.Add(s.interval)
+	return true, 0
+}
+
+// Remaining implements Limiter. It is 1 when key may send now, else 0.
+func (s *SpikeArrest) Remaining(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next, ok := s.next[key]; ok && s.now().Before(next) {
+		return 0
+	}
+
+	return 1
+}
+
+// Limit implements Limiter. Spike arrest never allows more than one
+// request at a time.
+func (s *SpikeArrest) Limit() int {
+	return 1
+}
+
+// Consume implements Limiter. Each consumed request pushes key's next
+// slot back by one interval.
+func (s *SpikeArrest) Consume(key string, n float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.now()
+	if scheduled, ok := s.next[key]; ok && scheduled.After(next) {
+		next = scheduled
+	}
+
+	s.next[key] = next.Add(time.Duration(n * float64(s.interval)))
+}
+
+// Inspect implements Limiter. A key waiting for its next slot has no
+// capacity until then, which is also when it is back to full capacity.
+func (s *SpikeArrest) Inspect(key string) Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, ok := s.next[key]
+	if !ok {
+		return Snapshot{Tokens: 1}
+	}
+
+	wait := next.Sub(s.now())
+	if wait <= 0 {
+		return Snapshot{Tokens: 1, Tracked: true}
+	}
+
+	return Snapshot{RetryAfter: wait, Reset: wait, Tracked: true}
+}
+
+// sweep discards keys whose spacing interval has passed.
+// Must be called with s.mu held.
+func (s *SpikeArrest) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+
+	s.lastSweep = now
+	for key, next := range s.next {
+		if now.After(next) {
+			delete(s.next, key)
+		}
+	}
+}
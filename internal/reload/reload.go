@@ -0,0 +1,313 @@
+// Package reload applies configuration changes at runtime with automatic
+// rollback.
+//
+// A reload builds a complete new Gateway from the configuration file,
+// swaps it in atomically, under the admission throttle when configured,
+// and then keeps the previous, known-good gateway
+// on standby for a probation period. If the new configuration turns out to
+// be broken in ways validation cannot catch — every target unreachable,
+// TLS handshakes failing, a spike in upstream errors — the previous
+// gateway is swapped back in and the failure is reported through the
+// admin API and webhooks.
+//
+// Example usage:
+//
+//	reloader := reload.New("config.yaml", gw, cfg.Reload, notifier, log)
+//	http.ListenAndServe(addr, reloader)
+//	...
+//	reloader.Reload(ctx) // on SIGHUP or admin request
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/gateway"
+	"velocity/internal/throttle"
+	"velocity/internal/webhook"
+	"velocity/pkg/logger"
+)
+
+// ErrInProbation is returned when a reload is requested while the previous
+// reload is still being evaluated
+var ErrInProbation = errors.New("previous reload is still in probation")
+
+// Result describes the outcome of the most recent reload
+type Result string
+
+const (
+	// ResultNone means no reload has been attempted
+	ResultNone Result = "none"
+
+	// ResultRejected means the configuration failed to load or validate
+	ResultRejected Result = "rejected"
+
+	// ResultProbation means the configuration is live but under evaluation
+	ResultProbation Result = "probation"
+
+	// ResultApplied means the configuration passed probation
+	ResultApplied Result = "applied"
+
+	// ResultRolledBack means the configuration was reverted
+	ResultRolledBack Result = "rolled_back"
+)
+
+// Status is the state of the reload subsystem
+type Status struct {
+	// Result is the outcome of the last reload
+	Result Result `json:"result"`
+
+	// LastAttempt is when the last reload started
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+
+	// Error describes why the last reload was rejected or rolled back
+	Error string `json:"error,omitempty"`
+}
+
+// Reloader serves the current gateway and replaces it on reload
+//
+// Thread safety: ServeHTTP and Current are safe for concurrent use and
+// lock-free. Reloads are serialized.
+type Reloader struct {
+	// path is the configuration file
+	path string
+
+	// cfg controls probation and rollback thresholds
+	cfg config.ReloadConfig
+
+	// current is the gateway serving traffic
+	current atomic.Pointer[gateway.Gateway]
+
+	// mu serializes reloads and guards previous and status
+	mu sync.Mutex
+
+	// previous is the known-good gateway kept during probation
+	previous *gateway.Gateway
+
+	// status is the outcome of the last reload
+	status Status
+
+	// notifier delivers reload events
+	notifier *webhook.Notifier
+
+	// logger for reload events
+	logger *logger.Logger
+}
+
+// New creates a reloader serving initial
+func New(path string, initial *gateway.Gateway, cfg config.ReloadConfig,
+	notifier *webhook.Notifier, log *logger.Logger) *Reloader {
+	r := &Reloader{
+		path:     path,
+		cfg:      cfg,
+		status:   Status{Result: ResultNone},
+		notifier: notifier,
+		logger:   log.Component("reload"),
+	}
+
+	r.current.Store(initial)
+	return r
+}
+
+// Current returns the gateway currently serving traffic
+func (r *Reloader) Current() *gateway.Gateway {
+	return r.current.Load()
+}
+
+// ServeHTTP implements http.Handler by delegating to the current gateway
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.current.Load().ServeHTTP(w, req)
+}
+
+// Endpoints returns a handler serving the current gateway's built-in
+// endpoints, for the priority lane listener
+func (r *Reloader) Endpoints() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().Endpoints().ServeHTTP(w, req)
+	})
+}
+
+// Status returns the outcome of the last reload
+func (r *Reloader) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
+// Reload loads the configuration file, builds a new gateway and swaps it
+// in.
+//
+// This method:
+//  1. Loads and validates the configuration by building a gateway
+//  2. Swaps the new gateway in, keeping the previous one on standby
+//  3. Rolls back immediately if no target of the new gateway is reachable
+//  4. Evaluates upstream errors during the probation period in the
+//     background and rolls back if they exceed the configured ratio
+//
+// Returns an error if the configuration was rejected or rolled back
+// immediately. Rollbacks after probation are reported via Status and
+// webhooks.
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.previous != nil {
+		return ErrInProbation
+	}
+
+	start := time.Now()
+	r.status = Status{LastAttempt: start}
+	defer func() { gateway.RecordReloadAttempt(time.Since(start)) }()
+
+	cfg, err := config.LoadFromFile(r.path)
+	if err != nil {
+		return r.reject(err)
+	}
+
+	for _, note := range cfg.Migrations {
+		r.logger.Warn("Configuration migrated", "migration", note)
+	}
+
+	next, err := gateway.New(cfg, r.logger)
+	if err != nil {
+		return r.reject(err)
+	}
+
+	// A health check pause set through the admin API outlives the reload,
+	// otherwise a config change during maintenance would silently end it
+	if r.current.Load().HealthChecksPaused() {
+		next.PauseHealthChecks()
+	}
+
+	throttle.Global().Open(throttle.ReasonReload, cfg.Reload.Throttle)
+	previous := r.current.Swap(next)
+	next.Activate()
+	r.logger.Info("Configuration reloaded, entering probation", "probation", r.cfg.Probation)
+
+	if r.cfg.CheckTargets {
+		if err := checkTargets(ctx, next); err != nil {
+			r.rollback(previous, next, err)
+			return err
+		}
+	}
+
+	r.previous = previous
+	r.status.Result = ResultProbation
+
+	go r.probation(next)
+	return nil
+}
+
+// probation evaluates the new gateway's upstream error ratio once the
+// probation period has passed
+func (r *Reloader) probation(next *gateway.Gateway) {
+	time.Sleep(r.cfg.Probation)
+
+	var requests, failures int64
+	for _, stat := range next.Proxy.GetStats() {
+		requests += stat.Requests
+		failures += stat.Failures
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.previous
+	r.previous = nil
+
+	if requests >= int64(r.cfg.MinRequests) &&
+		float64(failures)/float64(requests) >= r.cfg.MaxErrorRatio {
+		r.rollback(previous, next, fmt.Errorf("upstream error ratio %d/%d exceeded %.2f during probation",
+			failures, requests, r.cfg.MaxErrorRatio))
+		return
+	}
+
+	previous.Close()
+	r.status.Result = ResultApplied
+	gateway.RecordReloadResult(string(ResultApplied))
+	r.logger.Info("Configuration reload applied", "requests", requests, "failures", failures)
+	r.notifier.Notify("config.applied", map[string]interface{}{
+		"requests": requests,
+		"failures": failures,
+	})
+}
+
+// reject records a configuration that failed to load or validate.
+// Must be called with r.mu held.
+func (r *Reloader) reject(err error) error {
+	r.status.Result = ResultRejected
+	r.status.Error = err.Error()
+	gateway.RecordReloadResult(string(ResultRejected))
+
+	r.logger.Error("Configuration reload rejected", "error", err)
+	r.notifier.Notify("config.rejected", map[string]interface{}{"error": err.Error()})
+
+	return fmt.Errorf("configuration rejected: %w", err)
+}
+
+// rollback restores the previous gateway and discards the failed one.
+// Must be called with r.mu held.
+func (r *Reloader) rollback(previous, failed *gateway.Gateway, reason error) {
+	throttle.Global().Open(throttle.ReasonReload, previous.Config.Reload.Throttle)
+	r.current.Store(previous)
+	previous.Activate()
+	failed.Close()
+
+	r.status.Result = ResultRolledBack
+	r.status.Error = reason.Error()
+	gateway.RecordReloadResult(string(ResultRolledBack))
+
+	r.logger.Error("Configuration rolled back", "reason", reason)
+	r.notifier.Notify("config.rolled_back", map[string]interface{}{"reason": reason.Error()})
+}
+
+// checkTargets verifies that at least one target of the gateway accepts TCP
+// connections, dialed as upstream requests are
+func checkTargets(ctx context.Context, g *gateway.Gateway) error {
+	stats := g.Proxy.GetStats()
+	if len(stats) == 0 {
+		return nil
+	}
+
+	var lastErr error
+
+	for _, stat := range stats {
+		u, err := url.Parse(stat.Target)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		conn, err := g.Proxy.DialContext(dialCtx, "tcp", host)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn.Close()
+		return nil
+	}
+
+	return fmt.Errorf("all targets unreachable: %w", lastErr)
+}
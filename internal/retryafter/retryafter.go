@@ -0,0 +1,70 @@
+// Package retryafter sets the Retry-After header of overload rejections.
+//
+// Components that turn requests away under load (load shedding, rate
+// limits) estimate how long a client should back off from their current
+// state: queue depth, utilization, limiter refill. This package rounds the
+// estimate to whole seconds and clamps it between one second and the
+// maximum configured for the request's route, so a pathological estimate
+// never tells clients to go away for an hour.
+//
+// The route's maximum travels in the request context:
+//
+//	handler = middleware.Chain(handler, retryafter.Middleware(rc.MaxRetryAfter))
+//	...
+//	seconds := retryafter.Set(w, r, estimate)
+package retryafter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"velocity/internal/middleware"
+)
+
+// DefaultMax caps Retry-After on routes without max_retry_after
+const DefaultMax = time.Minute
+
+// maxKey is the context key for the route's maximum
+type maxKey struct{}
+
+// WithMax returns a copy of ctx capping Retry-After at limit
+func WithMax(ctx context.Context, limit time.Duration) context.Context {
+	return context.WithValue(ctx, maxKey{}, limit)
+}
+
+// MaxFromContext returns the Retry-After cap of a request
+func MaxFromContext(ctx context.Context) time.Duration {
+	if limit, ok := ctx.Value(maxKey{}).(time.Duration); ok {
+		return limit
+	}
+
+	return DefaultMax
+}
+
+// Middleware returns a middleware applying limit to every request, or nil
+// when limit is not positive and the default applies
+func Middleware(limit time.Duration) middleware.Middleware {
+	if limit <= 0 {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithMax(r.Context(), limit)))
+		})
+	}
+}
+
+// Set writes the Retry-After header for an estimated backoff and returns
+// the advertised number of seconds. The estimate is rounded up and
+// clamped to at least one second and at most the request's maximum.
+func Set(w http.ResponseWriter, r *http.Request, estimate time.Duration) int {
+	limit := int(math.Ceil(MaxFromContext(r.Context()).Seconds()))
+	seconds := max(min(int(math.Ceil(estimate.Seconds())), limit), 1)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
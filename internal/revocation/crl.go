@@ -0,0 +1,240 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/pkg/logger"
+)
+
+// crl is the revocation list of one issuer
+type crl struct {
+	// list is the parsed revocation list
+	list *x509.RevocationList
+
+	// revoked holds the decimal serial numbers of revoked certificates
+	revoked map[string]bool
+
+	// verified reports whether the list's signature was checked against
+	// the issuer of a verified chain
+	verified atomic.Bool
+}
+
+// crlSet holds the configured CRLs by issuer and reloads them when their
+// files change
+//
+// Thread safety: All methods are safe for concurrent use.
+type crlSet struct {
+	// files are the CRL file paths
+	files []string
+
+	// cas are the trusted client CAs, against which lists they issued are
+	// verified when loaded
+	cas []*x509.Certificate
+
+	// interval is the least time between two checks for changed files
+	interval time.Duration
+
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// lists holds the newest CRL of each issuer by raw issuer name
+	lists map[string]*crl
+
+	// modTimes holds the modification time of each file when last loaded
+	modTimes map[string]time.Time
+
+	// checked is when the files were last checked for changes
+	checked time.Time
+
+	// logger for reload failures
+	logger *logger.Logger
+}
+
+// loadCRLs reads the CRL files, failing when one cannot be read or parsed
+// or a list issued by one of cas is not signed by it
+func loadCRLs(files []string, cas []*x509.Certificate, interval time.Duration, log *logger.Logger) (*crlSet, error) {
+	s := &crlSet{files: files, cas: cas, interval: interval, logger: log}
+
+	lists, modTimes, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lists, s.modTimes, s.checked = lists, modTimes, time.Now()
+	return s, nil
+}
+
+// check returns the status of cert in its issuer's CRL, or an empty status
+// when no CRL covers the issuer
+func (s *crlSet) check(cert, issuer *x509.Certificate) (string, error) {
+	s.refresh()
+
+	s.mu.Lock()
+	list := s.lists[string(issuer.RawSubject)]
+	s.mu.Unlock()
+
+	if list == nil {
+		return "", nil
+	}
+
+	// Lists of intermediate CAs can only be verified once a client
+	// presents the intermediate
+	if !list.verified.Load() {
+		if err := list.list.CheckSignatureFrom(issuer); err != nil {
+			return StatusUnknown, fmt.Errorf("CRL of %s has an invalid signature: %w", issuer.Subject, err)
+		}
+		list.verified.Store(true)
+	}
+
+	if next := list.list.NextUpdate; !next.IsZero() && time.Now().After(next) {
+		return StatusUnknown, fmt.Errorf("CRL of %s expired at %s", issuer.Subject, next.UTC().Format(time.RFC3339))
+	}
+
+	if list.revoked[cert.SerialNumber.String()] {
+		return StatusRevoked, nil
+	}
+
+	return StatusGood, nil
+}
+
+// refresh reloads the CRL files when one changed, at most once per
+// interval. Failed reloads keep the previous lists.
+func (s *crlSet) refresh() {
+	s.mu.Lock()
+	if time.Since(s.checked) < s.interval {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+
+	changed := false
+	for _, file := range s.files {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(s.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	lists, modTimes, err := s.load()
+	if err != nil {
+		s.logger.Warn("CRL reload failed, keeping the previous lists", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.lists, s.modTimes = lists, modTimes
+	s.mu.Unlock()
+
+	s.logger.Info("CRLs reloaded", "issuers", len(lists))
+}
+
+// load reads every CRL file, keeping the newest list of each issuer
+func (s *crlSet) load() (map[string]*crl, map[string]time.Time, error) {
+	lists := make(map[string]*crl)
+	modTimes := make(map[string]time.Time, len(s.files))
+
+	for _, file := range s.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CRL: %w", err)
+		}
+		modTimes[file] = info.ModTime()
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CRL: %w", err)
+		}
+
+		parsed, err := parseCRLs(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CRL %s: %w", file, err)
+		}
+
+		for _, list := range parsed {
+			verified, err := s.verify(list)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid CRL %s: %w", file, err)
+			}
+
+			key := string(list.RawIssuer)
+			if existing, ok := lists[key]; ok && !list.ThisUpdate.After(existing.list.ThisUpdate) {
+				continue
+			}
+
+			revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+			for _, entry := range list.RevokedCertificateEntries {
+				revoked[entry.SerialNumber.String()] = true
+			}
+
+			lists[key] = &crl{list: list, revoked: revoked}
+			lists[key].verified.Store(verified)
+		}
+	}
+
+	return lists, modTimes, nil
+}
+
+// verify checks the signature of a list issued by one of the trusted CAs,
+// reporting whether it was checked. Lists of other issuers are checked
+// when first used.
+func (s *crlSet) verify(list *x509.RevocationList) (bool, error) {
+	for _, ca := range s.cas {
+		if bytes.Equal(ca.RawSubject, list.RawIssuer) {
+			if err := list.CheckSignatureFrom(ca); err != nil {
+				return false, fmt.Errorf("not signed by %s: %w", ca.Subject, err)
+			}
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parseCRLs parses a PEM file of X509 CRL blocks or a single DER CRL
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{list}, nil
+	}
+
+	var lists []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("no X509 CRL block found")
+	}
+
+	return lists, nil
+}
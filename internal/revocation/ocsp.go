@@ -0,0 +1,330 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OCSP answer caching
+const (
+	// maxOCSPCacheTTL bounds how long an answer is trusted, whatever its
+	// next update
+	maxOCSPCacheTTL = time.Hour
+
+	// failureCacheTTL is how long a failed query is remembered, so an
+	// unreachable responder does not delay every handshake
+	failureCacheTTL = 30 * time.Second
+
+	// maxOCSPResponse bounds the responses read from responders
+	maxOCSPResponse = 64 << 10
+
+	// ocspClockSkew tolerates responders whose clocks run ahead
+	ocspClockSkew = 5 * time.Minute
+)
+
+// OCSP (RFC 6960) object identifiers
+var (
+	oidSHA1             = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSignatureMethods = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// certID identifies a certificate to a responder
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+// ocspRequest is an OCSPRequest asking for a single certificate
+type ocspRequest struct {
+	TBSRequest struct {
+		Version     int `asn1:"explicit,tag:0,default:0,optional"`
+		RequestList []struct {
+			Cert certID
+		}
+	}
+}
+
+// ocspResponse is an OCSPResponse
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+// basicResponse is a BasicOCSPResponse
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+// responseData is the signed part of a basic response
+type responseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []singleResponse
+}
+
+// singleResponse is the status of one certificate
+type singleResponse struct {
+	CertID     certID
+	Good       asn1.Flag   `asn1:"tag:0,optional"`
+	Revoked    revokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag   `asn1:"tag:2,optional"`
+	ThisUpdate time.Time   `asn1:"generalized"`
+	NextUpdate time.Time   `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+// revokedInfo tells when a certificate was revoked
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspAnswer is a cached status
+type ocspAnswer struct {
+	// status is StatusGood, StatusRevoked or StatusUnknown
+	status string
+
+	// err explains an unknown status
+	err error
+
+	// expires is when the answer must be fetched again
+	expires time.Time
+}
+
+// ocspClient queries OCSP responders and caches their answers
+//
+// Thread safety: All methods are safe for concurrent use.
+type ocspClient struct {
+	// client sends the queries
+	client *http.Client
+
+	// mu guards cache
+	mu sync.Mutex
+
+	// cache holds answers by issuer key hash and serial number
+	cache map[string]ocspAnswer
+}
+
+// newOCSPClient creates a client whose queries time out after timeout
+func newOCSPClient(timeout time.Duration) *ocspClient {
+	return &ocspClient{
+		client: &http.Client{Timeout: timeout},
+		cache:  make(map[string]ocspAnswer),
+	}
+}
+
+// check returns the status of cert from the cache or its responder
+func (o *ocspClient) check(cert, issuer *x509.Certificate) (string, error) {
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return StatusUnknown, err
+	}
+
+	key := string(id.IssuerKeyHash) + cert.SerialNumber.String()
+	now := time.Now()
+
+	o.mu.Lock()
+	answer, ok := o.cache[key]
+	o.mu.Unlock()
+
+	if ok && now.Before(answer.expires) {
+		return answer.status, answer.err
+	}
+
+	answer = o.query(cert.OCSPServer[0], id, issuer, now)
+
+	o.mu.Lock()
+	for k, a := range o.cache {
+		if now.After(a.expires) {
+			delete(o.cache, k)
+		}
+	}
+	o.cache[key] = answer
+	o.mu.Unlock()
+
+	return answer.status, answer.err
+}
+
+// query asks a responder for the status of a certificate
+func (o *ocspClient) query(server string, id certID, issuer *x509.Certificate, now time.Time) ocspAnswer {
+	failed := func(err error) ocspAnswer {
+		return ocspAnswer{status: StatusUnknown, err: fmt.Errorf("OCSP responder %s: %w", server, err), expires: now.Add(failureCacheTTL)}
+	}
+
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ Cert certID }{id})
+
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return failed(err)
+	}
+
+	resp, err := o.client.Post(server, "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return failed(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return failed(fmt.Errorf("status %d", resp.StatusCode))
+	}
+
+	der, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return failed(err)
+	}
+
+	single, err := parseResponse(der, id, issuer, now)
+	if err != nil {
+		return failed(err)
+	}
+
+	expires := now.Add(maxOCSPCacheTTL)
+	if !single.NextUpdate.IsZero() && single.NextUpdate.Before(expires) {
+		expires = single.NextUpdate
+	}
+
+	switch {
+	case bool(single.Good):
+		return ocspAnswer{status: StatusGood, expires: expires}
+	case !single.Revoked.RevocationTime.IsZero():
+		return ocspAnswer{status: StatusRevoked, expires: expires}
+	default:
+		return ocspAnswer{status: StatusUnknown, err: fmt.Errorf("OCSP responder %s does not know the certificate", server), expires: expires}
+	}
+}
+
+// parseResponse verifies a responder's answer and returns the status of
+// the certificate identified by id
+func parseResponse(der []byte, id certID, issuer *x509.Certificate, now time.Time) (*singleResponse, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("request failed with response status %d", resp.Status)
+	}
+
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errors.New("unsupported response type")
+	}
+
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	algorithm, ok := oidSignatureMethods[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %s", basic.SignatureAlgorithm.Algorithm)
+	}
+
+	signer, err := responderCert(basic.Certificates, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("invalid response signature: %w", err)
+	}
+
+	for i := range basic.TBSResponseData.Responses {
+		single := &basic.TBSResponseData.Responses[i]
+		if single.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 || !bytes.Equal(single.CertID.IssuerKeyHash, id.IssuerKeyHash) {
+			continue
+		}
+
+		if single.ThisUpdate.After(now.Add(ocspClockSkew)) {
+			return nil, errors.New("response is not valid yet")
+		}
+
+		if !single.NextUpdate.IsZero() && single.NextUpdate.Before(now) {
+			return nil, errors.New("response is out of date")
+		}
+
+		return single, nil
+	}
+
+	return nil, errors.New("response does not cover the certificate")
+}
+
+// responderCert returns the certificate signing a response: the issuer
+// itself, or a responder certificate the issuer delegated OCSP signing to
+func responderCert(raw []asn1.RawValue, issuer *x509.Certificate) (*x509.Certificate, error) {
+	if len(raw) == 0 {
+		return issuer, nil
+	}
+
+	responder, err := x509.ParseCertificate(raw[0].FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid responder certificate: %w", err)
+	}
+
+	if bytes.Equal(responder.Raw, issuer.Raw) {
+		return issuer, nil
+	}
+
+	if err := responder.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("responder certificate not issued by %s: %w", issuer.Subject, err)
+	}
+
+	for _, usage := range responder.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return responder, nil
+		}
+	}
+
+	return nil, errors.New("responder certificate is not authorized to sign OCSP responses")
+}
+
+// newCertID identifies cert by SHA-1 hashes of its issuer's name and key
+func newCertID(cert, issuer *x509.Certificate) (certID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, fmt.Errorf("invalid issuer public key: %w", err)
+	}
+
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
@@ -0,0 +1,217 @@
+// Package revocation rejects revoked client certificates during the TLS
+// handshake.
+//
+// A verified chain proves a client certificate was issued by a trusted
+// CA, not that the CA still stands behind it. Every certificate of the
+// chain below the root is looked up in the configured CRLs of its issuer
+// and, when no CRL covers the issuer, with the OCSP responder named in the
+// certificate. Certificates covered by neither source are accepted.
+//
+// A certificate whose status cannot be determined, because its CRL is
+// past its next update or its OCSP responder fails or answers "unknown",
+// fails the handshake unless the checker fails open.
+//
+// Example usage:
+//
+//	checker, err := revocation.New(cfg.Revocation, cas, log)
+//	tlsConfig.VerifyConnection = checker.VerifyConnection
+package revocation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// Defaults for unset configuration
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	defaultOCSPTimeout     = 2 * time.Second
+)
+
+// Certificate statuses
+const (
+	// StatusGood means the issuer vouches for the certificate
+	StatusGood = "good"
+
+	// StatusRevoked means the issuer revoked the certificate
+	StatusRevoked = "revoked"
+
+	// StatusUnknown means the status could not be determined
+	StatusUnknown = "unknown"
+
+	// StatusUnchecked means no CRL or OCSP responder covers the
+	// certificate
+	StatusUnchecked = "unchecked"
+)
+
+// ErrRevoked is returned for handshakes presenting a revoked certificate
+var ErrRevoked = errors.New("client certificate revoked")
+
+// current is the checker of the proxy listener, nil when disabled
+var current atomic.Pointer[Checker]
+
+// Current returns the checker of the proxy listener, or nil when
+// revocation checking is disabled
+func Current() *Checker {
+	return current.Load()
+}
+
+// Checker looks up the revocation status of client certificates
+//
+// Thread safety: All methods are safe for concurrent use.
+type Checker struct {
+	// crls holds the revocation lists, nil when none are configured
+	crls *crlSet
+
+	// ocsp queries responders, nil when OCSP is disabled
+	ocsp *ocspClient
+
+	// failOpen accepts certificates of unknown status
+	failOpen bool
+
+	// counts holds the checked certificates by status, in the order of
+	// statuses
+	counts [4]atomic.Int64
+
+	// failedOpen counts certificates of unknown status accepted anyway
+	failedOpen atomic.Int64
+
+	// logger for revoked certificates and unavailable sources
+	logger *logger.Logger
+}
+
+// statuses orders the counted statuses
+var statuses = [4]string{StatusGood, StatusRevoked, StatusUnknown, StatusUnchecked}
+
+// Stats holds the checker's counters
+type Stats struct {
+	// Checks counts checked certificates by status
+	Checks map[string]int64
+
+	// FailedOpen counts certificates of unknown status that were accepted
+	FailedOpen int64
+}
+
+// New creates a checker for certificates issued by cas, or returns nil
+// when neither CRLs nor OCSP are configured. The checker becomes the one
+// reported by Current.
+//
+// Returns an error for unreadable or invalid CRL files, CRLs not signed by
+// one of cas and negative durations.
+func New(cfg config.ClientRevocationConfig, cas []*x509.Certificate, log *logger.Logger) (*Checker, error) {
+	if len(cfg.CRLFiles) == 0 && !cfg.OCSP {
+		return nil, nil
+	}
+
+	if cfg.RefreshInterval < 0 || cfg.OCSPTimeout < 0 {
+		return nil, fmt.Errorf("revocation: refresh_interval and ocsp_timeout must not be negative")
+	}
+
+	c := &Checker{
+		failOpen: cfg.FailOpen,
+		logger:   log.Component("revocation"),
+	}
+
+	if len(cfg.CRLFiles) > 0 {
+		interval := cfg.RefreshInterval
+		if interval == 0 {
+			interval = defaultRefreshInterval
+		}
+
+		crls, err := loadCRLs(cfg.CRLFiles, cas, interval, c.logger)
+		if err != nil {
+			return nil, fmt.Errorf("revocation: %w", err)
+		}
+		c.crls = crls
+	}
+
+	if cfg.OCSP {
+		timeout := cfg.OCSPTimeout
+		if timeout == 0 {
+			timeout = defaultOCSPTimeout
+		}
+		c.ocsp = newOCSPClient(timeout)
+	}
+
+	current.Store(c)
+	return c, nil
+}
+
+// Stats returns the checker's counters
+func (c *Checker) Stats() Stats {
+	stats := Stats{Checks: make(map[string]int64, len(statuses)), FailedOpen: c.failedOpen.Load()}
+	for i, status := range statuses {
+		stats.Checks[status] = c.counts[i].Load()
+	}
+
+	return stats
+}
+
+// VerifyConnection is a tls.Config VerifyConnection hook failing
+// handshakes whose client chain contains a revoked certificate.
+// Connections without a client certificate pass.
+func (c *Checker) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	chain := state.VerifiedChains[0]
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		status, err := c.check(cert, issuer)
+		c.count(status)
+
+		switch status {
+		case StatusRevoked:
+			c.logger.Warn("Revoked client certificate rejected",
+				"subject", cert.Subject.String(), "serial", cert.SerialNumber.Text(16))
+			return ErrRevoked
+
+		case StatusUnknown:
+			if c.failOpen {
+				c.failedOpen.Add(1)
+				c.logger.Warn("Client certificate status unknown, accepting it", "subject", cert.Subject.String(), "error", err)
+				continue
+			}
+
+			c.logger.Warn("Client certificate status unknown, rejecting it", "subject", cert.Subject.String(), "error", err)
+			return fmt.Errorf("client certificate revocation status unknown: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// check returns the status of a certificate, with the reason of an
+// unknown status
+func (c *Checker) check(cert, issuer *x509.Certificate) (string, error) {
+	if c.crls != nil {
+		// A CRL of the issuer settles the status without asking OCSP
+		if status, err := c.crls.check(cert, issuer); status != "" {
+			return status, err
+		}
+	}
+
+	if c.ocsp != nil && len(cert.OCSPServer) > 0 {
+		return c.ocsp.check(cert, issuer)
+	}
+
+	return StatusUnchecked, nil
+}
+
+// count records the status of a checked certificate
+func (c *Checker) count(status string) {
+	for i, s := range statuses {
+		if s == status {
+			c.counts[i].Add(1)
+		}
+	}
+}
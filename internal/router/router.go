@@ -0,0 +1,539 @@
+// Package router matches incoming requests to configured routes.
+//
+// Each route owns its own handler chain, so per-route policies (credential
+// injection, header rules, limits) are composed once at startup rather than
+// evaluated through conditionals on every request. Routes are evaluated by
+// descending priority, then longest prefix first. Requests that match no
+// route are passed to a fallback handler, or to a designated fallback
+// route.
+//
+// Each route also decides how paths are matched: whether "/foo" and
+// "/foo/" are equivalent (strict, redirect or rewrite) and whether the
+// prefix is compared case-insensitively. Backends disagree on both, so the
+// behaviour is configured per route rather than guessed.
+//
+// Routes may further match on request methods and header values, so one
+// prefix can be split between backends, e.g. by an X-Api-Version header.
+// A request failing a route's conditions is matched against the remaining
+// routes.
+//
+// Example usage:
+//
+//	r, err := router.New(cfg.Routes, proxyHandler, func(rc config.RouteConfig) (http.Handler, error) {
+//		return middleware.Chain(proxyHandler, routeMiddlewares(rc)...), nil
+//	})
+//	http.Handle("/", r)
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"velocity/internal/accesslog"
+	"velocity/internal/config"
+	gwerrors "velocity/pkg/errors"
+)
+
+// Route is a compiled route ready to serve requests
+type Route struct {
+	// Config is the route definition this route was built from
+	Config config.RouteConfig
+
+	// Handler serves requests matching the route
+	Handler http.Handler
+
+	// anonymous are the path prefixes open to unauthenticated clients
+	anonymous []string
+
+	// methods are the accepted request methods, nil when every method is
+	// forwarded
+	methods map[string]bool
+
+	// allow is the Allow header of 405 and automatic OPTIONS responses
+	allow string
+
+	// matchMethods are the methods the route matches, nil when it matches
+	// every method
+	matchMethods map[string]bool
+
+	// matchHeaders are the header conditions the route matches
+	matchHeaders []headerMatcher
+}
+
+// headerMatcher is a compiled header condition
+type headerMatcher struct {
+	// name is the canonical header name
+	name string
+
+	// value is the exact value required, when pattern is nil
+	value string
+
+	// pattern is the regular expression the value must match
+	pattern *regexp.Regexp
+
+	// present only requires the header to be sent
+	present bool
+}
+
+// Router dispatches requests to routes by priority and longest matching
+// path prefix
+type Router struct {
+	// routes are sorted by descending priority, then descending prefix
+	// length, routes with match conditions first among equal prefixes
+	routes []*Route
+
+	// fallback serves requests that match no route
+	fallback http.Handler
+
+	// fallbackRoute serves requests that match no route in place of
+	// fallback, nil when unset
+	fallbackRoute *Route
+}
+
+// Trailing slash policies
+const (
+	// TrailingSlashStrict treats "/foo" and "/foo/" as different paths
+	TrailingSlashStrict = "strict"
+
+	// TrailingSlashRedirect redirects to the canonical form
+	TrailingSlashRedirect = "redirect"
+
+	// TrailingSlashRewrite forwards the canonical form
+	TrailingSlashRewrite = "rewrite"
+)
+
+// BuildFunc creates the handler chain for a route
+type BuildFunc func(config.RouteConfig) (http.Handler, error)
+
+// routeKey is the context key for the matched route
+type routeKey struct{}
+
+// New compiles the route table.
+//
+// Parameters:
+//
+//	routes: Route definitions from configuration
+//	fallback: Handler for requests matching no route
+//	build: Creates each route's handler chain
+//
+// Returns:
+//
+//	*Router: Router ready for use as an http.Handler
+//	error: Invalid or duplicate route definitions, or build failures
+func New(routes []config.RouteConfig, fallback http.Handler, build BuildFunc) (*Router, error) {
+	r := &Router{fallback: fallback}
+	seen := make(map[string]bool, len(routes))
+
+	for i, rc := range routes {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("route-%d", i)
+		}
+
+		if !strings.HasPrefix(rc.PathPrefix, "/") {
+			return nil, fmt.Errorf("route %s: path_prefix must start with /", rc.Name)
+		}
+
+		switch rc.TrailingSlash {
+		case "":
+			rc.TrailingSlash = TrailingSlashStrict
+		case TrailingSlashStrict, TrailingSlashRedirect, TrailingSlashRewrite:
+		default:
+			return nil, fmt.Errorf("route %s: unknown trailing_slash policy %q", rc.Name, rc.TrailingSlash)
+		}
+
+		for _, path := range rc.Anonymous.Paths {
+			if !matchPrefix(path, rc.PathPrefix) &&
+				!(rc.CaseInsensitive && matchPrefix(strings.ToLower(path), strings.ToLower(rc.PathPrefix))) {
+				return nil, fmt.Errorf("route %s: anonymous path %q is outside path_prefix %s", rc.Name, path, rc.PathPrefix)
+			}
+		}
+
+		if seen[rc.Name] {
+			return nil, fmt.Errorf("duplicate route name %s", rc.Name)
+		}
+		seen[rc.Name] = true
+
+		methods, allow, err := compileMethods(rc.Methods)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+
+		matchMethods, _, err := compileMethods(rc.Match.Methods)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: match: %w", rc.Name, err)
+		}
+
+		matchHeaders, err := compileHeaders(rc.Match.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: match: %w", rc.Name, err)
+		}
+
+		handler, err := build(rc)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+
+		r.routes = append(r.routes, &Route{Config: rc, Handler: handler, anonymous: rc.Anonymous.Paths,
+			methods: methods, allow: allow, matchMethods: matchMethods, matchHeaders: matchHeaders})
+	}
+
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		a, b := r.routes[i], r.routes[j]
+		if a.Config.Priority != b.Config.Priority {
+			return a.Config.Priority > b.Config.Priority
+		}
+
+		if len(a.Config.PathPrefix) != len(b.Config.PathPrefix) {
+			return len(a.Config.PathPrefix) > len(b.Config.PathPrefix)
+		}
+
+		return a.conditional() && !b.conditional()
+	})
+
+	return r, nil
+}
+
+// Routes returns the compiled routes in match order
+func (r *Router) Routes() []*Route {
+	return r.routes
+}
+
+// SetFallbackRoute makes the named route serve requests that match no
+// route, instead of the fallback handler
+func (r *Router) SetFallbackRoute(name string) error {
+	for _, route := range r.routes {
+		if route.Config.Name == name {
+			r.fallbackRoute = route
+			return nil
+		}
+	}
+
+	return fmt.Errorf("fallback: unknown route %q", name)
+}
+
+// FallbackRoute returns the route serving requests that match no route,
+// nil when they go to the fallback handler
+func (r *Router) FallbackRoute() *Route {
+	return r.fallbackRoute
+}
+
+// Match returns the route for the request path, method and headers, or
+// nil if none matches
+func (r *Router) Match(req *http.Request) *Route {
+	for _, route := range r.routes {
+		if route.matches(req.URL.Path) && route.meets(req) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// conditional reports whether the route has match conditions
+func (route *Route) conditional() bool {
+	return route.matchMethods != nil || len(route.matchHeaders) > 0
+}
+
+// meets reports whether the request satisfies the route's match conditions
+func (route *Route) meets(req *http.Request) bool {
+	if route.matchMethods != nil && !route.matchMethods[req.Method] {
+		return false
+	}
+
+	for _, m := range route.matchHeaders {
+		if !m.matches(req.Header.Values(m.name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches reports whether any of a header's values satisfies the condition
+func (m headerMatcher) matches(values []string) bool {
+	if m.present {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		if m.pattern != nil && m.pattern.MatchString(value) || m.pattern == nil && value == m.value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conditions describes the route's match conditions, e.g.
+// "method GET, HEAD" or "header X-Api-Version = 2"
+func (route *Route) Conditions() []string {
+	var conditions []string
+
+	if route.matchMethods != nil {
+		var names []string
+		seen := make(map[string]bool, len(route.matchMethods))
+		add := func(method string) {
+			if !seen[method] {
+				seen[method] = true
+				names = append(names, method)
+			}
+		}
+
+		for _, method := range route.Config.Match.Methods {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			add(method)
+			if method == http.MethodGet {
+				add(http.MethodHead)
+			}
+		}
+
+		conditions = append(conditions, "method "+strings.Join(names, ", "))
+	}
+
+	for _, m := range route.matchHeaders {
+		switch {
+		case m.present:
+			conditions = append(conditions, "header "+m.name+" present")
+		case m.pattern != nil:
+			conditions = append(conditions, "header "+m.name+" ~ "+m.pattern.String())
+		default:
+			conditions = append(conditions, "header "+m.name+" = "+m.value)
+		}
+	}
+
+	return conditions
+}
+
+// matches reports whether path belongs to the route under its matching
+// options
+func (route *Route) matches(path string) bool {
+	prefix := route.Config.PathPrefix
+	if route.Config.CaseInsensitive && len(path) >= len(prefix) &&
+		strings.EqualFold(path[:len(prefix)], prefix) {
+		path = prefix + path[len(prefix):]
+	}
+
+	if matchPrefix(path, prefix) {
+		return true
+	}
+
+	// Outside strict mode the route root without its trailing slash
+	// belongs to the route and is canonicalized on dispatch
+	return route.Config.TrailingSlash != TrailingSlashStrict &&
+		len(prefix) > 1 && strings.HasSuffix(prefix, "/") &&
+		len(path) == len(prefix)-1 &&
+		(path == prefix[:len(prefix)-1] ||
+			route.Config.CaseInsensitive && strings.EqualFold(path, prefix[:len(prefix)-1]))
+}
+
+// Anonymous reports whether path lies under one of the route's anonymous
+// paths, which unauthenticated clients may reach
+func (route *Route) Anonymous(path string) bool {
+	for _, prefix := range route.anonymous {
+		if matchPrefix(path, prefix) ||
+			route.Config.CaseInsensitive && matchPrefix(strings.ToLower(path), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Serving returns the route serving the request: the matching route, else
+// the fallback route, nil when it goes to the fallback handler
+func (r *Router) Serving(req *http.Request) *Route {
+	if route := r.Match(req); route != nil {
+		return route
+	}
+
+	return r.fallbackRoute
+}
+
+// Anonymous reports whether the request goes to an anonymous path of its
+// route, or is an OPTIONS request the router answers itself
+func (r *Router) Anonymous(req *http.Request) bool {
+	route := r.Serving(req)
+	return route != nil && (route.Anonymous(req.URL.Path) ||
+		req.Method == http.MethodOptions && !route.Allows(req.Method))
+}
+
+// Allows reports whether the route forwards requests with method
+func (route *Route) Allows(method string) bool {
+	return route.methods == nil || route.methods[method]
+}
+
+// Allow returns the Allow header of responses the router answers for the
+// route, empty when every method is forwarded
+func (route *Route) Allow() string {
+	return route.allow
+}
+
+// compileMethods validates a route's methods and returns them as a set
+// with the matching Allow header. GET implies HEAD, and the header always
+// lists OPTIONS since the router answers it when the route does not
+// forward it.
+func compileMethods(configured []string) (map[string]bool, string, error) {
+	if len(configured) == 0 {
+		return nil, "", nil
+	}
+
+	methods := make(map[string]bool, len(configured)+2)
+	var allow []string
+
+	add := func(method string) {
+		if !methods[method] {
+			methods[method] = true
+			allow = append(allow, method)
+		}
+	}
+
+	for _, method := range configured {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.ContainsFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) {
+			return nil, "", fmt.Errorf("invalid method %q", method)
+		}
+
+		add(method)
+		if method == http.MethodGet {
+			add(http.MethodHead)
+		}
+	}
+
+	header := strings.Join(allow, ", ")
+	if !methods[http.MethodOptions] {
+		header += ", " + http.MethodOptions
+	}
+
+	return methods, header, nil
+}
+
+// compileHeaders validates a route's header conditions and compiles their
+// regular expressions
+func compileHeaders(configured []config.HeaderMatchConfig) ([]headerMatcher, error) {
+	matchers := make([]headerMatcher, 0, len(configured))
+
+	for _, hc := range configured {
+		if strings.TrimSpace(hc.Name) == "" {
+			return nil, fmt.Errorf("header condition without a name")
+		}
+
+		m := headerMatcher{name: http.CanonicalHeaderKey(strings.TrimSpace(hc.Name)), value: hc.Value}
+
+		switch {
+		case hc.Value != "" && hc.Regex != "":
+			return nil, fmt.Errorf("header %s: value and regex are mutually exclusive", m.name)
+		case hc.Regex != "":
+			pattern, err := regexp.Compile(hc.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: invalid regex: %w", m.name, err)
+			}
+			m.pattern = pattern
+		case hc.Value == "":
+			m.present = true
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+// CanonicalPath returns the path in the route's trailing slash form
+func (route *Route) CanonicalPath(path string) string {
+	prefix := route.Config.PathPrefix
+	if strings.HasSuffix(prefix, "/") {
+		if len(path) == len(prefix)-1 {
+			return path + "/"
+		}
+
+		return path
+	}
+
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		return strings.TrimRight(path, "/")
+	}
+
+	return path
+}
+
+// ServeHTTP dispatches the request to the matching route's handler
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route := r.Match(req)
+	if route == nil && r.fallbackRoute == nil {
+		r.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	// The path of a request falling back lies outside the route's prefix
+	// and is forwarded as received
+	if route == nil {
+		route = r.fallbackRoute
+	} else if route.Config.TrailingSlash != TrailingSlashStrict {
+		if canonical := route.CanonicalPath(req.URL.Path); canonical != req.URL.Path {
+			if route.Config.TrailingSlash == TrailingSlashRedirect {
+				target := canonical
+				if req.URL.RawQuery != "" {
+					target += "?" + req.URL.RawQuery
+				}
+
+				http.Redirect(w, req, target, http.StatusPermanentRedirect)
+				return
+			}
+
+			if req.URL.RawPath != "" {
+				if strings.HasSuffix(canonical, "/") {
+					req.URL.RawPath += "/"
+				} else {
+					req.URL.RawPath = strings.TrimRight(req.URL.RawPath, "/")
+				}
+			}
+			req.URL.Path = canonical
+		}
+	}
+
+	if entry := accesslog.FromContext(req.Context()); entry != nil {
+		entry.Route = route.Config.Name
+	}
+
+	if !route.Allows(req.Method) {
+		w.Header().Set("Allow", route.allow)
+
+		if req.Method == http.MethodOptions {
+			if req.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", route.allow)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		gwerrors.New(gwerrors.CodeMethodNotAllowed, req.Method+" is not allowed on this route").
+			WithRoute(route.Config.Name).
+			WriteJSON(w)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), routeKey{}, route)
+	route.Handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// RouteFromContext returns the route matched for the request, if any
+func RouteFromContext(ctx context.Context) (*Route, bool) {
+	route, ok := ctx.Value(routeKey{}).(*Route)
+	return route, ok
+}
+
+// matchPrefix reports whether path starts with prefix on a segment boundary
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) ||
+		strings.HasSuffix(prefix, "/") ||
+		path[len(prefix)] == '/'
+}
@@ -0,0 +1,706 @@
+// Package schema validates JSON documents against JSON Schema.
+//
+// It implements the structural subset of JSON Schema (draft 2020-12 and
+// earlier drafts) that API contracts rely on:
+//
+//	type, enum, const
+//	properties, required, additionalProperties
+//	items, minItems, maxItems
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum
+//	minLength, maxLength, pattern
+//	allOf, anyOf, oneOf, not
+//	$ref to local definitions ("#/$defs/Name", "#/definitions/Name")
+//
+// Unknown keywords, including format, are ignored as the specification
+// requires, so a schema written for a full validator still loads.
+//
+// Example usage:
+//
+//	s, err := schema.Load("schemas/order.json")
+//	if err != nil {
+//		return err
+//	}
+//	for _, v := range s.Validate(document) {
+//		log.Warn("Contract violation", "path", v.Path, "error", v.Message)
+//	}
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxViolations bounds the violations reported for one document so a
+// badly broken response cannot produce unbounded output
+const maxViolations = 20
+
+// Schema is a compiled JSON Schema
+//
+// Thread safety: A compiled Schema is immutable and safe for concurrent use.
+type Schema struct {
+	// root is the compiled top-level schema
+	root *node
+}
+
+// Violation is a single contract violation
+type Violation struct {
+	// Path locates the offending value as a JSON pointer, "" for the root
+	Path string `json:"path"`
+
+	// Message describes the violation
+	Message string `json:"message"`
+}
+
+// String formats the violation for logs
+func (v Violation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "/"
+	}
+
+	return path + ": " + v.Message
+}
+
+// node is a compiled schema or subschema
+type node struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+
+	// ref is the resolved target of $ref, set after compilation
+	ref *node
+
+	// refName is the unresolved $ref
+	refName string
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties           map[string]*node
+	required             []string
+	additionalProperties *node
+
+	items              *node
+	minItems, maxItems *int
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+}
+
+// Load reads and compiles the schema file at path
+func Load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	s, err := Compile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Compile parses a JSON Schema document
+func Compile(data []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid schema JSON: %w", err)
+	}
+
+	c := &compiler{document: raw, defs: make(map[string]*node)}
+
+	root, err := c.compile(raw, "#")
+	if err != nil {
+		return nil, err
+	}
+
+	// The root is a $ref target like any other
+	c.defs["#"] = root
+
+	if err := c.resolve(); err != nil {
+		return nil, err
+	}
+
+	if err := checkCycles(root); err != nil {
+		return nil, err
+	}
+
+	return &Schema{root: root}, nil
+}
+
+// Validate checks a decoded JSON document, as produced by encoding/json
+// with UseNumber or plain float64 numbers. Returns nil when it conforms.
+func (s *Schema) Validate(document interface{}) []Violation {
+	v := &validator{}
+	v.validate(s.root, document, "")
+	return v.violations
+}
+
+// compiler builds nodes and collects $ref targets
+type compiler struct {
+	// document is the raw schema, used to look up $ref targets
+	document interface{}
+
+	// defs caches compiled $ref targets by reference
+	defs map[string]*node
+
+	// refs are nodes whose $ref still needs resolving
+	refs []*node
+}
+
+// compile builds the node for a raw schema value
+func (c *compiler) compile(raw interface{}, at string) (*node, error) {
+	if b, ok := raw.(bool); ok {
+		return &node{always: &b}, nil
+	}
+
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or boolean", at)
+	}
+
+	n := &node{}
+	var err error
+
+	if ref, ok := obj["$ref"].(string); ok {
+		n.refName = ref
+		c.refs = append(c.refs, n)
+	}
+
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: must be a string or array of strings", at)
+			}
+			n.types = append(n.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s/type: must be a string or array of strings", at)
+	}
+
+	if enum, ok := obj["enum"].([]interface{}); ok {
+		n.enum = enum
+	}
+
+	if constant, ok := obj["const"]; ok {
+		n.constant = &constant
+	}
+
+	if props, ok := obj["properties"].(map[string]interface{}); ok {
+		n.properties = make(map[string]*node, len(props))
+		for name, sub := range props {
+			if n.properties[name], err = c.compile(sub, at+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if required, ok := obj["required"].([]interface{}); ok {
+		for _, item := range required {
+			if name, ok := item.(string); ok {
+				n.required = append(n.required, name)
+			}
+		}
+	}
+
+	if sub, ok := obj["additionalProperties"]; ok {
+		if n.additionalProperties, err = c.compile(sub, at+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+
+	if sub, ok := obj["items"]; ok {
+		if n.items, err = c.compile(sub, at+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	n.minItems = intKeyword(obj, "minItems")
+	n.maxItems = intKeyword(obj, "maxItems")
+	n.minLength = intKeyword(obj, "minLength")
+	n.maxLength = intKeyword(obj, "maxLength")
+	n.minimum = numberKeyword(obj, "minimum")
+	n.maximum = numberKeyword(obj, "maximum")
+	n.exclusiveMinimum = numberKeyword(obj, "exclusiveMinimum")
+	n.exclusiveMaximum = numberKeyword(obj, "exclusiveMaximum")
+
+	if pattern, ok := obj["pattern"].(string); ok {
+		if n.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %w", at, err)
+		}
+	}
+
+	for keyword, target := range map[string]*[]*node{"allOf": &n.allOf, "anyOf": &n.anyOf, "oneOf": &n.oneOf} {
+		list, ok := obj[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for i, sub := range list {
+			compiled, err := c.compile(sub, fmt.Sprintf("%s/%s/%d", at, keyword, i))
+			if err != nil {
+				return nil, err
+			}
+			*target = append(*target, compiled)
+		}
+	}
+
+	if sub, ok := obj["not"]; ok {
+		if n.not, err = c.compile(sub, at+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// resolve links every $ref to its compiled target. Targets are compiled
+// once and shared, so recursive schemas terminate.
+func (c *compiler) resolve() error {
+	for i := 0; i < len(c.refs); i++ {
+		n := c.refs[i]
+
+		if target, ok := c.defs[n.refName]; ok {
+			n.ref = target
+			continue
+		}
+
+		raw, err := c.lookup(n.refName)
+		if err != nil {
+			return err
+		}
+
+		// Register before compiling so self references resolve to it
+		target := &node{}
+		c.defs[n.refName] = target
+
+		compiled, err := c.compile(raw, n.refName)
+		if err != nil {
+			return err
+		}
+
+		*target = *compiled
+		n.ref = target
+
+		// A target that is itself a $ref is resolved through the
+		// registered node, not the discarded copy
+		for j := i + 1; j < len(c.refs); j++ {
+			if c.refs[j] == compiled {
+				c.refs[j] = target
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkCycles rejects schemas whose $ref chains lead back to where they
+// started without descending into the value, such as {"$ref": "#"}.
+// Validating any document against them would never terminate. Cycles
+// through properties or items are fine: each step moves into the value.
+func checkCycles(root *node) error {
+	// state is 1 while a node is on the walk, 2 once it is cleared
+	state := make(map[*node]int)
+	seen := make(map[*node]bool)
+	pending := []*node{root}
+
+	// walk follows the edges that apply the schema to the same value
+	var walk func(n *node, refs []string) error
+	walk = func(n *node, refs []string) error {
+		switch state[n] {
+		case 1:
+			return fmt.Errorf("$ref cycle %s applies the schema to the same value forever", strings.Join(refs, " -> "))
+		case 2:
+			return nil
+		}
+		state[n] = 1
+
+		if n.ref != nil {
+			if err := walk(n.ref, append(refs, n.refName)); err != nil {
+				return err
+			}
+		}
+
+		for _, sub := range slices.Concat(n.allOf, n.anyOf, n.oneOf, []*node{n.not}) {
+			if sub != nil {
+				if err := walk(sub, refs); err != nil {
+					return err
+				}
+			}
+		}
+
+		state[n] = 2
+		return nil
+	}
+
+	for len(pending) > 0 {
+		n := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+
+		if err := walk(n, nil); err != nil {
+			return err
+		}
+
+		children := slices.Concat(n.allOf, n.anyOf, n.oneOf, []*node{n.not, n.ref, n.items, n.additionalProperties})
+		for _, sub := range n.properties {
+			children = append(children, sub)
+		}
+
+		for _, sub := range children {
+			if sub != nil {
+				pending = append(pending, sub)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookup finds the raw schema a local JSON pointer reference points to
+func (c *compiler) lookup(ref string) (interface{}, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("$ref %q: only local references are supported", ref)
+	}
+
+	current := c.document
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if token == "" {
+			continue
+		}
+
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$ref %q: not found", ref)
+		}
+
+		if current, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("$ref %q: not found", ref)
+		}
+	}
+
+	return current, nil
+}
+
+// intKeyword reads a non-negative integer keyword
+func intKeyword(obj map[string]interface{}, key string) *int {
+	f, ok := obj[key].(float64)
+	if !ok {
+		return nil
+	}
+
+	i := int(f)
+	return &i
+}
+
+// numberKeyword reads a numeric keyword. Draft 4 boolean exclusive
+// bounds are not numbers and are ignored.
+func numberKeyword(obj map[string]interface{}, key string) *float64 {
+	f, ok := obj[key].(float64)
+	if !ok {
+		return nil
+	}
+
+	return &f
+}
+
+// validator accumulates violations for one document
+type validator struct {
+	violations []Violation
+}
+
+// report records a violation unless the limit was reached
+func (v *validator) report(path, format string, args ...interface{}) {
+	if len(v.violations) < maxViolations {
+		v.violations = append(v.violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// matches reports whether value conforms to n without recording anything
+func matches(n *node, value interface{}) bool {
+	probe := &validator{}
+	probe.validate(n, value, "")
+	return len(probe.violations) == 0
+}
+
+// validate checks value against n
+func (v *validator) validate(n *node, value interface{}, path string) {
+	if n.always != nil {
+		if !*n.always {
+			v.report(path, "no value is allowed here")
+		}
+		return
+	}
+
+	if n.ref != nil {
+		v.validate(n.ref, value, path)
+	}
+
+	if len(n.types) > 0 && !hasType(n.types, value) {
+		v.report(path, "expected %s, got %s", strings.Join(n.types, " or "), typeOf(value))
+		return
+	}
+
+	if n.enum != nil && !containsValue(n.enum, value) {
+		v.report(path, "value is not one of the allowed values")
+	}
+
+	if n.constant != nil && !equal(*n.constant, value) {
+		v.report(path, "value does not match the required constant")
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(n, val, path)
+	case []interface{}:
+		v.validateArray(n, val, path)
+	case string:
+		v.validateString(n, val, path)
+	case float64:
+		v.validateNumber(n, val, path)
+	case json.Number:
+		if f, err := val.Float64(); err == nil {
+			v.validateNumber(n, f, path)
+		}
+	}
+
+	for _, sub := range n.allOf {
+		v.validate(sub, value, path)
+	}
+
+	if len(n.anyOf) > 0 {
+		matched := false
+		for _, sub := range n.anyOf {
+			if matches(sub, value) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			v.report(path, "value does not match any of the anyOf schemas")
+		}
+	}
+
+	if len(n.oneOf) > 0 {
+		count := 0
+		for _, sub := range n.oneOf {
+			if matches(sub, value) {
+				count++
+			}
+		}
+
+		if count != 1 {
+			v.report(path, "value matches %d of the oneOf schemas, expected exactly 1", count)
+		}
+	}
+
+	if n.not != nil && matches(n.not, value) {
+		v.report(path, "value matches a schema it must not match")
+	}
+}
+
+// validateObject applies the object keywords
+func (v *validator) validateObject(n *node, obj map[string]interface{}, path string) {
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			v.report(path, "missing required property %q", name)
+		}
+	}
+
+	// Sorted so reports are stable across runs
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := path + "/" + escapePointer(name)
+
+		if sub, ok := n.properties[name]; ok {
+			v.validate(sub, obj[name], childPath)
+		} else if n.additionalProperties != nil {
+			v.validate(n.additionalProperties, obj[name], childPath)
+		}
+	}
+}
+
+// validateArray applies the array keywords
+func (v *validator) validateArray(n *node, arr []interface{}, path string) {
+	if n.minItems != nil && len(arr) < *n.minItems {
+		v.report(path, "expected at least %d items, got %d", *n.minItems, len(arr))
+	}
+
+	if n.maxItems != nil && len(arr) > *n.maxItems {
+		v.report(path, "expected at most %d items, got %d", *n.maxItems, len(arr))
+	}
+
+	if n.items != nil {
+		for i, item := range arr {
+			v.validate(n.items, item, fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+}
+
+// validateString applies the string keywords
+func (v *validator) validateString(n *node, s string, path string) {
+	length := utf8.RuneCountInString(s)
+
+	if n.minLength != nil && length < *n.minLength {
+		v.report(path, "expected at least %d characters, got %d", *n.minLength, length)
+	}
+
+	if n.maxLength != nil && length > *n.maxLength {
+		v.report(path, "expected at most %d characters, got %d", *n.maxLength, length)
+	}
+
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		v.report(path, "value does not match pattern %s", n.pattern)
+	}
+}
+
+// validateNumber applies the numeric keywords
+func (v *validator) validateNumber(n *node, f float64, path string) {
+	if n.minimum != nil && f < *n.minimum {
+		v.report(path, "expected minimum %v, got %v", *n.minimum, f)
+	}
+
+	if n.maximum != nil && f > *n.maximum {
+		v.report(path, "expected maximum %v, got %v", *n.maximum, f)
+	}
+
+	if n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum {
+		v.report(path, "expected greater than %v, got %v", *n.exclusiveMinimum, f)
+	}
+
+	if n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum {
+		v.report(path, "expected less than %v, got %v", *n.exclusiveMaximum, f)
+	}
+}
+
+// hasType reports whether value is one of the JSON Schema types
+func hasType(types []string, value interface{}) bool {
+	actual := typeOf(value)
+
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// typeOf returns the JSON Schema type of a decoded value
+func typeOf(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// containsValue reports whether list holds a value equal to value
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if equal(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// equal compares decoded JSON values structurally
+func equal(a, b interface{}) bool {
+	if n, ok := b.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			b = f
+		}
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+
+		for key, item := range av {
+			if other, ok := bv[key]; !ok || !equal(item, other) {
+				return false
+			}
+		}
+
+		return true
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+
+		return true
+
+	default:
+		return a == b
+	}
+}
+
+// escapePointer escapes a property name for use in a JSON pointer
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,55 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileRejectsRefCycles(t *testing.T) {
+	tests := map[string]string{
+		"root":          `{"$ref": "#"}`,
+		"self":          `{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		"mutual":        `{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		"through allOf": `{"$defs": {"a": {"allOf": [{"$ref": "#/$defs/a"}]}}, "properties": {"x": {"$ref": "#/$defs/a"}}}`,
+		"through not":   `{"not": {"$ref": "#"}}`,
+	}
+
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Compile([]byte(doc))
+			if err == nil || !strings.Contains(err.Error(), "cycle") {
+				t.Fatalf("Compile() error = %v, want a $ref cycle error", err)
+			}
+		})
+	}
+}
+
+func TestCompileAllowsRecursionIntoValues(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"$defs": {
+			"tree": {
+				"type": "object",
+				"properties": {"children": {"type": "array", "items": {"$ref": "#/$defs/tree"}}},
+				"additionalProperties": false
+			}
+		},
+		"$ref": "#/$defs/tree"
+	}`))
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	valid := map[string]interface{}{"children": []interface{}{
+		map[string]interface{}{"children": []interface{}{}},
+	}}
+	if violations := s.Validate(valid); len(violations) != 0 {
+		t.Fatalf("Validate() = %v, want no violations", violations)
+	}
+
+	invalid := map[string]interface{}{"children": []interface{}{
+		map[string]interface{}{"name": "leaf"},
+	}}
+	if violations := s.Validate(invalid); len(violations) == 0 {
+		t.Fatal("Validate() reported no violations for an unexpected property")
+	}
+}
@@ -0,0 +1,164 @@
+package script
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"velocity/internal/auth"
+	"velocity/internal/ratelimit"
+	"velocity/internal/router"
+)
+
+// variables are the request attributes expressions can read
+var variables = map[string]evalFunc{
+	"method": func(r *http.Request) (any, error) { return r.Method, nil },
+	"path":   func(r *http.Request) (any, error) { return r.URL.Path, nil },
+	"host":   func(r *http.Request) (any, error) { return r.Host, nil },
+
+	"query_string": func(r *http.Request) (any, error) { return r.URL.RawQuery, nil },
+	"client_ip":    func(r *http.Request) (any, error) { return ratelimit.ClientIP(r), nil },
+
+	"route": func(r *http.Request) (any, error) {
+		if route, ok := router.RouteFromContext(r.Context()); ok {
+			return route.Config.Name, nil
+		}
+
+		return "", nil
+	},
+
+	"header": func(r *http.Request) (any, error) {
+		return lookup(func(name string) (string, bool) {
+			values, ok := r.Header[http.CanonicalHeaderKey(name)]
+			if !ok || len(values) == 0 {
+				return "", false
+			}
+
+			return values[0], true
+		}), nil
+	},
+
+	"query": func(r *http.Request) (any, error) {
+		query := r.URL.Query()
+		return lookup(func(name string) (string, bool) {
+			return query.Get(name), query.Has(name)
+		}), nil
+	},
+
+	"cookie": func(r *http.Request) (any, error) {
+		return lookup(func(name string) (string, bool) {
+			c, err := r.Cookie(name)
+			if err != nil {
+				return "", false
+			}
+
+			return c.Value, true
+		}), nil
+	},
+
+	"claim": func(r *http.Request) (any, error) {
+		claims, _ := auth.ClaimsFromContext(r.Context())
+		return lookup(func(name string) (string, bool) {
+			if claims == nil {
+				return "", false
+			}
+
+			return claims.String(name)
+		}), nil
+	},
+}
+
+// function is a built-in function of the expression language
+type function struct {
+	// arity is the number of arguments
+	arity int
+
+	// call applies the function to its evaluated arguments
+	call func(args []any) (any, error)
+}
+
+// functions are the built-in functions
+var functions = map[string]function{
+	"lower": stringFunc(func(s []string) (any, error) { return strings.ToLower(s[0]), nil }, 1),
+	"upper": stringFunc(func(s []string) (any, error) { return strings.ToUpper(s[0]), nil }, 1),
+	"trim":  stringFunc(func(s []string) (any, error) { return strings.TrimSpace(s[0]), nil }, 1),
+
+	"starts_with": stringFunc(func(s []string) (any, error) { return strings.HasPrefix(s[0], s[1]), nil }, 2),
+	"ends_with":   stringFunc(func(s []string) (any, error) { return strings.HasSuffix(s[0], s[1]), nil }, 2),
+	"replace":     stringFunc(func(s []string) (any, error) { return strings.ReplaceAll(s[0], s[1], s[2]), nil }, 3),
+
+	"trim_prefix": stringFunc(func(s []string) (any, error) { return strings.TrimPrefix(s[0], s[1]), nil }, 2),
+	"trim_suffix": stringFunc(func(s []string) (any, error) { return strings.TrimSuffix(s[0], s[1]), nil }, 2),
+
+	"split": stringFunc(func(s []string) (any, error) {
+		parts := strings.Split(s[0], s[1])
+		list := make([]any, len(parts))
+		for i, part := range parts {
+			list[i] = part
+		}
+		return list, nil
+	}, 2),
+
+	"cidr": stringFunc(func(s []string) (any, error) {
+		prefix, err := netip.ParsePrefix(s[1])
+		if err != nil {
+			return nil, err
+		}
+
+		addr, err := netip.ParseAddr(s[0])
+		if err != nil {
+			return false, nil
+		}
+
+		return prefix.Contains(addr.Unmap()), nil
+	}, 2),
+
+	"number": stringFunc(func(s []string) (any, error) {
+		n, err := strconv.ParseFloat(strings.TrimSpace(s[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", s[0])
+		}
+		return n, nil
+	}, 1),
+
+	"len": {arity: 1, call: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []any:
+			return float64(len(v)), nil
+		}
+
+		return nil, fmt.Errorf("expects a string or list, got %s", typeName(args[0]))
+	}},
+
+	"string": {arity: 1, call: func(args []any) (any, error) {
+		return toString(args[0])
+	}},
+
+	"default": {arity: 2, call: func(args []any) (any, error) {
+		if args[0] == "" {
+			return args[1], nil
+		}
+
+		return args[0], nil
+	}},
+}
+
+// stringFunc returns a function taking arity string arguments
+func stringFunc(fn func(s []string) (any, error), arity int) function {
+	return function{arity: arity, call: func(args []any) (any, error) {
+		s := make([]string, len(args))
+		for i, arg := range args {
+			v, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %d must be a string, got %s", i+1, typeName(arg))
+			}
+			s[i] = v
+		}
+
+		return fn(s)
+	}}
+}
@@ -0,0 +1,642 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled expression
+//
+// Thread safety: An Expr may be evaluated concurrently.
+type Expr struct {
+	// src is the expression's source
+	src string
+
+	// eval evaluates the expression against a request
+	eval evalFunc
+}
+
+// evalFunc evaluates a compiled node against a request
+type evalFunc func(r *http.Request) (any, error)
+
+// lookup is a map-like value such as the request headers. It reports
+// whether the key exists.
+type lookup func(key string) (string, bool)
+
+// precedence gives the binding strength of each binary operator
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4, "in": 4, "matches": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// Compile parses an expression. Unknown variables and functions, calls
+// with the wrong number of arguments and invalid regular expressions are
+// reported here; type errors are reported when the expression is
+// evaluated.
+func Compile(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	eval, err := p.parseExpr(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+
+	return &Expr{src: src, eval: eval}, nil
+}
+
+// String returns the expression's source
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression against r. The result is a string, a
+// number (float64), a bool or a list ([]any).
+func (e *Expr) Eval(r *http.Request) (any, error) {
+	return e.eval(r)
+}
+
+// Bool evaluates an expression that must yield a bool
+func (e *Expr) Bool(r *http.Request) (bool, error) {
+	v, err := e.eval(r)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool, got %s", typeName(v))
+	}
+
+	return b, nil
+}
+
+// Text evaluates an expression yielding a string, a number or a bool and
+// returns it as a string
+func (e *Expr) Text(r *http.Request) (string, error) {
+	v, err := e.eval(r)
+	if err != nil {
+		return "", err
+	}
+
+	return toString(v)
+}
+
+// parser compiles a token stream by precedence climbing
+type parser struct {
+	// tokens is the lexed expression, ending with tokenEOF
+	tokens []token
+
+	// pos is the index of the next token
+	pos int
+}
+
+// peek returns the next token without consuming it
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the next token
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// accept consumes the next token if it is the operator op
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+// expect consumes the operator op or fails
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected '%s', got %s at %d", op, t, t.pos)
+	}
+
+	return nil
+}
+
+// binaryOperator returns the binary operator at the next token, if any
+func (p *parser) binaryOperator() (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator && t.kind != tokenIdent {
+		return "", false
+	}
+
+	_, ok := precedence[t.text]
+	return t.text, ok
+}
+
+// parseExpr parses binary operations binding at least as strongly as
+// minPrec
+func (p *parser) parseExpr(minPrec int) (evalFunc, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.binaryOperator()
+		if !ok || precedence[op] < minPrec {
+			return left, nil
+		}
+		p.next()
+
+		if op == "matches" {
+			left, err = p.parseMatches(left)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		right, err := p.parseExpr(precedence[op] + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = binary(op, left, right)
+	}
+}
+
+// parseMatches compiles "left matches 'regexp'". The pattern must be a
+// string literal so it is compiled once.
+func (p *parser) parseMatches(left evalFunc) (evalFunc, error) {
+	t := p.next()
+	if t.kind != tokenString {
+		return nil, fmt.Errorf("matches requires a string literal pattern at %d", t.pos)
+	}
+
+	re, err := regexp.Compile(t.text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern at %d: %w", t.pos, err)
+	}
+
+	return func(r *http.Request) (any, error) {
+		v, err := left(r)
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches expects a string, got %s", typeName(v))
+		}
+
+		return re.MatchString(s), nil
+	}, nil
+}
+
+// parseUnary parses a negation or a postfix expression
+func (p *parser) parseUnary() (evalFunc, error) {
+	switch {
+	case p.accept("!"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(r *http.Request) (any, error) {
+			b, err := evalBool(operand, r, "!")
+			return !b, err
+		}, nil
+
+	case p.accept("-"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(r *http.Request) (any, error) {
+			v, err := operand(r)
+			if err != nil {
+				return nil, err
+			}
+
+			n, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("- expects a number, got %s", typeName(v))
+			}
+
+			return -n, nil
+		}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a primary expression followed by index operations
+func (p *parser) parsePostfix() (evalFunc, error) {
+	operand, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("[") {
+		index, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+
+		operand = indexOf(operand, index)
+	}
+
+	return operand, nil
+}
+
+// parsePrimary parses a literal, variable, call, list or parenthesized
+// expression
+func (p *parser) parsePrimary() (evalFunc, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at %d", t.text, t.pos)
+		}
+		return constant(n), nil
+
+	case tokenString:
+		return constant(t.text), nil
+
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		}
+
+		if p.accept("(") {
+			return p.parseCall(t)
+		}
+
+		variable, ok := variables[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s at %d", t.text, t.pos)
+		}
+		return variable, nil
+
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parseExpr(1)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+
+		case "[":
+			return p.parseList()
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+// parseCall parses the arguments of a call to the function named by name,
+// whose opening parenthesis was consumed
+func (p *parser) parseCall(name token) (evalFunc, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at %d", name.text, name.pos)
+	}
+
+	args, err := p.parseArgs(")")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d at %d", name.text, fn.arity, len(args), name.pos)
+	}
+
+	return func(r *http.Request) (any, error) {
+		values := make([]any, len(args))
+		for i, arg := range args {
+			v, err := arg(r)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+
+		v, err := fn.call(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name.text, err)
+		}
+
+		return v, nil
+	}, nil
+}
+
+// parseList parses a list literal whose opening bracket was consumed
+func (p *parser) parseList() (evalFunc, error) {
+	items, err := p.parseArgs("]")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(r *http.Request) (any, error) {
+		list := make([]any, len(items))
+		for i, item := range items {
+			v, err := item(r)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+
+		return list, nil
+	}, nil
+}
+
+// parseArgs parses comma separated expressions up to the closing operator
+func (p *parser) parseArgs(closing string) ([]evalFunc, error) {
+	var args []evalFunc
+	if p.accept(closing) {
+		return args, nil
+	}
+
+	for {
+		arg, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.accept(closing) {
+			return args, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// constant returns a node evaluating to v
+func constant(v any) evalFunc {
+	return func(*http.Request) (any, error) { return v, nil }
+}
+
+// binary returns the node applying a binary operator
+func binary(op string, left, right evalFunc) evalFunc {
+	switch op {
+	case "&&", "||":
+		// Short-circuit: the right operand is evaluated only when needed
+		return func(r *http.Request) (any, error) {
+			l, err := evalBool(left, r, op)
+			if err != nil || l == (op == "||") {
+				return l, err
+			}
+
+			return evalBool(right, r, op)
+		}
+	}
+
+	return func(r *http.Request) (any, error) {
+		l, err := left(r)
+		if err != nil {
+			return nil, err
+		}
+
+		rv, err := right(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return applyBinary(op, l, rv)
+	}
+}
+
+// applyBinary applies a non short-circuit binary operator to two values
+func applyBinary(op string, l, r any) (any, error) {
+	switch op {
+	case "==":
+		return equal(l, r), nil
+
+	case "!=":
+		return !equal(l, r), nil
+
+	case "in":
+		return contains(l, r)
+	}
+
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects two strings, got string and %s", op, typeName(r))
+		}
+
+		switch op {
+		case "+":
+			return ls + rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+
+		return nil, fmt.Errorf("%s does not apply to strings", op)
+	}
+
+	ln, lok := l.(float64)
+	rn, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s expects two numbers or two strings, got %s and %s", op, typeName(l), typeName(r))
+	}
+
+	switch op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/", "%":
+		if rn == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if op == "%" {
+			return math.Mod(ln, rn), nil
+		}
+		return ln / rn, nil
+	case "<":
+		return ln < rn, nil
+	case "<=":
+		return ln <= rn, nil
+	case ">":
+		return ln > rn, nil
+	default:
+		return ln >= rn, nil
+	}
+}
+
+// evalBool evaluates an operand that must yield a bool
+func evalBool(operand evalFunc, r *http.Request, op string) (bool, error) {
+	v, err := operand(r)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s expects bool, got %s", op, typeName(v))
+	}
+
+	return b, nil
+}
+
+// indexOf returns the node indexing a list by number or a lookup by key.
+// Missing keys yield the empty string.
+func indexOf(operand, index evalFunc) evalFunc {
+	return func(r *http.Request) (any, error) {
+		v, err := operand(r)
+		if err != nil {
+			return nil, err
+		}
+
+		i, err := index(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch container := v.(type) {
+		case lookup:
+			key, ok := i.(string)
+			if !ok {
+				return nil, fmt.Errorf("map index must be a string, got %s", typeName(i))
+			}
+
+			value, _ := container(key)
+			return value, nil
+
+		case []any:
+			n, ok := i.(float64)
+			if !ok || n != math.Trunc(n) {
+				return nil, fmt.Errorf("list index must be an integer, got %s", typeName(i))
+			}
+
+			if n < 0 || int(n) >= len(container) {
+				return nil, fmt.Errorf("list index %d out of range", int(n))
+			}
+
+			return container[int(n)], nil
+		}
+
+		return nil, fmt.Errorf("cannot index %s", typeName(v))
+	}
+}
+
+// equal reports whether two values are equal. Values of different types
+// are never equal.
+func equal(a, b any) bool {
+	switch av := a.(type) {
+	case []any:
+		bv, ok := b.([]any)
+		return ok && slices.EqualFunc(av, bv, equal)
+	case lookup:
+		return false
+	}
+
+	switch b.(type) {
+	case []any, lookup:
+		return false
+	}
+
+	return a == b
+}
+
+// contains implements "in": membership in a list, a substring of a
+// string or a key of a map
+func contains(item, container any) (any, error) {
+	switch c := container.(type) {
+	case []any:
+		return slices.ContainsFunc(c, func(v any) bool { return equal(item, v) }), nil
+
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("in a string expects a string, got %s", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+
+	case lookup:
+		key, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("in a map expects a string key, got %s", typeName(item))
+		}
+		_, found := c(key)
+		return found, nil
+	}
+
+	return nil, fmt.Errorf("in expects a list, string or map, got %s", typeName(container))
+}
+
+// toString formats a string, number or bool
+func toString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	return "", fmt.Errorf("cannot convert %s to string", typeName(v))
+}
+
+// typeName names the type of a value in error messages
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case lookup:
+		return "map"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
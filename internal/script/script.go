@@ -0,0 +1,292 @@
+// Package script runs inline rules on a route's requests.
+//
+// A one-off routing tweak or header fix should not need a plugin or a
+// gateway release. Script rules, written in the route's configuration,
+// test a condition on the request and then add, replace or remove
+// headers, rewrite the path or answer the request directly.
+//
+// Conditions and values are expressions in a small language, checked when
+// the configuration loads and evaluated without side effects:
+//
+//	Literals   "text" 'text' 42 1.5 true false ["GET", "HEAD"]
+//	Variables  method path host query_string client_ip route
+//	Maps       header["X-Env"] query["page"] cookie["session"] claim["org.id"]
+//	Operators  || && == != < <= > >= in matches + - * / % ! and parentheses
+//	Functions  lower upper trim trim_prefix trim_suffix starts_with
+//	           ends_with replace split cidr len number string default
+//
+// Missing map keys read as the empty string; "key in header" tests
+// whether one is present. "in" also tests list membership and substrings.
+// "matches" takes a regular expression literal. Values of different types
+// are never equal, and other operators on mismatched types are errors.
+//
+// A rule whose expression fails to evaluate, e.g. number("abc"), is
+// skipped; the failure is logged and counted.
+//
+// Example usage:
+//
+//	s, err := script.New(rc.Name, rc.Script, log)
+//	handler = middleware.Chain(handler, s.Middleware())
+package script
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/pkg/logger"
+)
+
+// Script runs the rules of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Script struct {
+	// route is the name of the route
+	route string
+
+	// rules are the compiled rules in order
+	rules []*rule
+
+	// responded counts requests answered by a rule, errors rules skipped
+	// because an expression failed
+	responded, errors atomic.Int64
+
+	// logger for evaluation failures
+	logger *logger.Logger
+}
+
+// rule is one compiled rule
+type rule struct {
+	// index is the rule's position, for log messages
+	index int
+
+	// when is the condition, nil for every request
+	when *Expr
+
+	// remove lists the headers to delete
+	remove []string
+
+	// set holds the headers to replace, sorted by name
+	set []header
+
+	// path rewrites the path, nil to keep it
+	path *Expr
+
+	// status answers the request when not zero
+	status int
+
+	// body gives the response body, nil for none
+	body *Expr
+
+	// contentType is the Content-Type of the response body
+	contentType string
+}
+
+// header is a header set by a rule
+type header struct {
+	// name is the canonical header name
+	name string
+
+	// value gives the header value
+	value *Expr
+}
+
+// Stats holds a script's counters
+type Stats struct {
+	// Responded is the number of requests answered by a rule
+	Responded int64
+
+	// Errors is the number of rules skipped because an expression failed
+	Errors int64
+}
+
+// New compiles the rules of a route, or returns nil when there are none.
+//
+// Returns an error for an expression that does not compile, a rule doing
+// nothing or an invalid status.
+func New(route string, rules []config.ScriptRuleConfig, log *logger.Logger) (*Script, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	s := &Script{route: route, logger: log.Component("script").With("route", route)}
+
+	for i, rc := range rules {
+		r, err := compileRule(i, rc)
+		if err != nil {
+			return nil, fmt.Errorf("script[%d]: %w", i, err)
+		}
+
+		s.rules = append(s.rules, r)
+	}
+
+	return s, nil
+}
+
+// compileRule compiles one rule
+func compileRule(index int, rc config.ScriptRuleConfig) (*rule, error) {
+	r := &rule{index: index, remove: rc.RemoveHeaders, status: rc.Respond.Status, contentType: rc.Respond.ContentType}
+
+	if len(rc.RemoveHeaders) == 0 && len(rc.SetHeaders) == 0 && rc.SetPath == "" && rc.Respond.Status == 0 {
+		return nil, fmt.Errorf("rule has no action, expected remove_headers, set_headers, set_path or respond")
+	}
+
+	if r.status != 0 && (r.status < 200 || r.status > 599) {
+		return nil, fmt.Errorf("respond: invalid status %d", r.status)
+	}
+
+	if r.status != 0 && (len(rc.RemoveHeaders) > 0 || len(rc.SetHeaders) > 0 || rc.SetPath != "") {
+		return nil, fmt.Errorf("respond answers the request, it cannot be combined with remove_headers, set_headers or set_path")
+	}
+
+	if r.status == 0 && (rc.Respond.Body != "" || rc.Respond.ContentType != "") {
+		return nil, fmt.Errorf("respond: body requires status")
+	}
+
+	if r.contentType == "" {
+		r.contentType = "text/plain; charset=utf-8"
+	}
+
+	var err error
+	if r.when, err = compileOptional(rc.When); err != nil {
+		return nil, fmt.Errorf("when: %w", err)
+	}
+
+	if r.path, err = compileOptional(rc.SetPath); err != nil {
+		return nil, fmt.Errorf("set_path: %w", err)
+	}
+
+	if r.body, err = compileOptional(rc.Respond.Body); err != nil {
+		return nil, fmt.Errorf("respond.body: %w", err)
+	}
+
+	for name, src := range rc.SetHeaders {
+		value, err := Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("set_headers.%s: %w", name, err)
+		}
+
+		r.set = append(r.set, header{name: http.CanonicalHeaderKey(name), value: value})
+	}
+
+	sort.Slice(r.set, func(i, j int) bool { return r.set[i].name < r.set[j].name })
+	return r, nil
+}
+
+// compileOptional compiles an expression, or returns nil for an empty one
+func compileOptional(src string) (*Expr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+
+	return Compile(src)
+}
+
+// Route returns the name of the route
+func (s *Script) Route() string {
+	return s.route
+}
+
+// Stats returns the script's counters
+func (s *Script) Stats() Stats {
+	return Stats{Responded: s.responded.Load(), Errors: s.errors.Load()}
+}
+
+// Middleware returns a middleware running the rules on every request.
+// Returns nil when s is nil.
+func (s *Script) Middleware() middleware.Middleware {
+	if s == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range s.rules {
+				answered, err := rule.apply(w, r)
+				if err != nil {
+					s.errors.Add(1)
+					s.logger.Warn("Script rule failed", "rule", rule.index, "method", r.Method, "path", r.URL.Path, "error", err)
+					continue
+				}
+
+				if answered {
+					s.responded.Add(1)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apply runs the rule on a request, reporting whether it answered it.
+// Nothing is changed when an expression fails.
+func (r *rule) apply(w http.ResponseWriter, req *http.Request) (bool, error) {
+	if r.when != nil {
+		matched, err := r.when.Bool(req)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+
+	if r.status != 0 {
+		var body string
+		if r.body != nil {
+			var err error
+			if body, err = r.body.Text(req); err != nil {
+				return false, err
+			}
+		}
+
+		if body != "" {
+			w.Header().Set("Content-Type", r.contentType)
+		}
+		w.WriteHeader(r.status)
+		if req.Method != http.MethodHead {
+			w.Write([]byte(body))
+		}
+		return true, nil
+	}
+
+	// Every value is computed from the request as it came in, before
+	// anything is changed
+	values := make([]string, len(r.set))
+	for i, h := range r.set {
+		value, err := h.value.Text(req)
+		if err != nil {
+			return false, fmt.Errorf("set_headers.%s: %w", h.name, err)
+		}
+		values[i] = value
+	}
+
+	var path string
+	if r.path != nil {
+		var err error
+		if path, err = r.path.Text(req); err != nil {
+			return false, fmt.Errorf("set_path: %w", err)
+		}
+
+		if !strings.HasPrefix(path, "/") {
+			return false, fmt.Errorf("set_path: %q does not start with /", path)
+		}
+	}
+
+	for _, name := range r.remove {
+		req.Header.Del(name)
+	}
+
+	for i, h := range r.set {
+		req.Header.Set(h.name, values[i])
+	}
+
+	if path != "" {
+		req.URL.Path, req.URL.RawPath = path, ""
+	}
+
+	return false, nil
+}
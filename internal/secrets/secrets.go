@@ -0,0 +1,109 @@
+// Package secrets resolves secret references used in configuration.
+//
+// Configuration values that hold credentials can either be literals or
+// references into the secret store:
+//
+//	env:NAME           value of environment variable NAME
+//	file:/run/secret   contents of a file (trailing newline trimmed)
+//
+// File backed secrets are re-read after the store's refresh interval, so
+// rotating a mounted secret takes effect without restarting the gateway.
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store resolves and caches secret references
+type Store struct {
+	// refresh is how long a resolved value is cached
+	refresh time.Duration
+
+	// mu guards cache
+	mu sync.Mutex
+
+	// cache maps references to their last resolved value
+	cache map[string]cachedSecret
+}
+
+// cachedSecret is a resolved value and its resolution time
+type cachedSecret struct {
+	value    string
+	resolved time.Time
+}
+
+// NewStore creates a store that caches resolved values for refresh.
+// A zero refresh resolves the reference on every call.
+func NewStore(refresh time.Duration) *Store {
+	return &Store{
+		refresh: refresh,
+		cache:   make(map[string]cachedSecret),
+	}
+}
+
+// IsReference reports whether value refers to the secret store rather than
+// being a literal
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "file:")
+}
+
+// Get resolves value. Literals are returned unchanged.
+//
+// Returns an error if the referenced environment variable is unset or the
+// file cannot be read.
+func (s *Store) Get(value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.cache[value]; ok && time.Since(cached.resolved) < s.refresh {
+		return cached.value, nil
+	}
+
+	resolved, err := resolve(value)
+	if err != nil {
+		// Keep serving the last good value if a rotation is in progress
+		if cached, ok := s.cache[value]; ok {
+			return cached.value, nil
+		}
+
+		return "", err
+	}
+
+	s.cache[value] = cachedSecret{value: resolved, resolved: time.Now()}
+	return resolved, nil
+}
+
+// resolve reads a reference from its backing source
+func resolve(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+
+		return value, nil
+
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return ref, nil
+}
@@ -0,0 +1,176 @@
+// Package selfsigned generates self-signed TLS certificates for local
+// development.
+//
+// Testing HTTPS locally otherwise takes a round of openssl commands. A
+// generated certificate is cached on disk and reused for as long as it
+// covers the requested hosts and is not about to expire, so clients that
+// were told to trust it keep working across restarts:
+//
+//	certFile, keyFile, created, err := selfsigned.LoadOrCreate(selfsigned.DefaultDir(), []string{"localhost"})
+//
+// Self-signed certificates are not trusted by any client by default and
+// must never be used in production.
+package selfsigned
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Validity of generated certificates
+const (
+	// Lifetime is how long a generated certificate is valid
+	Lifetime = 365 * 24 * time.Hour
+
+	// renewBefore is how close to expiry a cached certificate is replaced
+	renewBefore = 7 * 24 * time.Hour
+)
+
+// File names of a cached certificate and its key
+const (
+	CertFileName = "cert.pem"
+	KeyFileName  = "key.pem"
+)
+
+// DefaultDir returns the directory certificates are cached in: velocity/tls
+// under the user's cache directory, or the system temporary directory when
+// there is none
+func DefaultDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+
+	return filepath.Join(base, "velocity", "tls")
+}
+
+// Generate creates a self-signed certificate for hosts, which may be DNS
+// names or IP addresses, valid for lifetime. Returns the PEM encoded
+// certificate and private key.
+func Generate(hosts []string, lifetime time.Duration) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("self-signed certificate: at least one host is required")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("self-signed certificate: generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("self-signed certificate: generating serial number: %w", err)
+	}
+
+	// Backdated an hour so clients with a skewed clock accept it
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"Velocity development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("self-signed certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("self-signed certificate: encoding key: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// LoadOrCreate returns the certificate and key files cached in dir,
+// generating them first unless the cached certificate covers every host
+// and stays valid for at least another week. Returns whether a new
+// certificate was generated.
+func LoadOrCreate(dir string, hosts []string) (certFile, keyFile string, created bool, err error) {
+	certFile = filepath.Join(dir, CertFileName)
+	keyFile = filepath.Join(dir, KeyFileName)
+
+	if usable(certFile, keyFile, hosts) {
+		return certFile, keyFile, false, nil
+	}
+
+	certPEM, keyPEM, err := Generate(hosts, Lifetime)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", false, fmt.Errorf("self-signed certificate: %w", err)
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return "", "", false, fmt.Errorf("self-signed certificate: %w", err)
+	}
+
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return "", "", false, fmt.Errorf("self-signed certificate: %w", err)
+	}
+
+	return certFile, keyFile, true, nil
+}
+
+// usable reports whether a cached certificate exists with its key, covers
+// hosts and is far enough from expiry
+func usable(certFile, keyFile string, hosts []string) bool {
+	if _, err := os.Stat(keyFile); err != nil {
+		return false
+	}
+
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				return false
+			}
+		} else if !slices.Contains(cert.DNSNames, host) {
+			return false
+		}
+	}
+
+	return true
+}
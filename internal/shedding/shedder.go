@@ -0,0 +1,324 @@
+// Package shedding provides priority-aware load shedding.
+//
+// The shedder caps the number of requests in flight across the gateway.
+// Each request belongs to a QoS class, and each class may only be admitted
+// while utilization is below its threshold: best-effort traffic is shed
+// first as load rises, normal traffic next, and critical traffic only when
+// the gateway is completely full.
+//
+// Example usage:
+//
+//	shedder, err := shedding.New(cfg.LoadShedding)
+//	handler := middleware.Chain(proxy, shedder.Middleware(shedding.Critical))
+package shedding
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+	"velocity/internal/retryafter"
+)
+
+// Class is a QoS priority class
+type Class int
+
+const (
+	// BestEffort traffic is shed first
+	BestEffort Class = iota
+
+	// Normal is the default class
+	Normal
+
+	// Critical traffic is shed last
+	Critical
+
+	numClasses
+)
+
+// String returns the configuration name of the class
+func (c Class) String() string {
+	switch c {
+	case BestEffort:
+		return "best_effort"
+
+	case Critical:
+		return "critical"
+
+	default:
+		return "normal"
+	}
+}
+
+// ParseClass converts a configuration name into a Class
+func ParseClass(name string) (Class, error) {
+	switch name {
+	case "best_effort":
+		return BestEffort, nil
+
+	case "", "normal":
+		return Normal, nil
+
+	case "critical":
+		return Critical, nil
+	}
+
+	return Normal, fmt.Errorf("unknown QoS class %q", name)
+}
+
+// ClassStats holds counters for a single QoS class
+type ClassStats struct {
+	// Admitted is the number of requests let through
+	Admitted int64
+
+	// Shed is the number of requests rejected under load
+	Shed int64
+
+	// InFlight is the number of requests currently being served
+	InFlight int64
+}
+
+// Shedder admits requests based on utilization and QoS class
+//
+// Thread safety: All methods are safe for concurrent use. Admission is a
+// single atomic increment on the hot path.
+type Shedder struct {
+	// capacity is the maximum number of requests in flight
+	capacity int64
+
+	// limits holds the in-flight ceiling for each class
+	limits [numClasses]int64
+
+	// inFlight is the total number of requests being served
+	inFlight int64
+
+	// stats holds per-class counters
+	stats [numClasses]ClassStats
+
+	// latency is the moving average duration of admitted requests in
+	// nanoseconds, used to estimate when slots free up
+	latency int64
+
+	// shedSecond is the Unix second shedRecent counts for
+	shedSecond int64
+
+	// shedRecent counts requests shed during shedSecond; clients shed
+	// moments ago are about to compete for slots again
+	shedRecent int64
+
+	// defaultClass applies when neither consumer nor route assign one
+	defaultClass Class
+
+	// consumerKey extracts the consumer identity, nil if unused
+	consumerKey ratelimit.KeyFunc
+
+	// consumers maps consumer identities to classes
+	consumers map[string]Class
+}
+
+// New creates a shedder from configuration. Returns nil when load shedding
+// is disabled; a nil shedder's Middleware is a no-op.
+func New(cfg config.LoadSheddingConfig) (*Shedder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("load_shedding: max_in_flight must be positive")
+	}
+
+	defaultClass, err := ParseClass(cfg.DefaultClass)
+	if err != nil {
+		return nil, fmt.Errorf("load_shedding: %w", err)
+	}
+
+	s := &Shedder{
+		capacity:     int64(cfg.MaxInFlight),
+		defaultClass: defaultClass,
+		consumers:    make(map[string]Class, len(cfg.Consumers)),
+	}
+
+	thresholds := [numClasses]float64{
+		BestEffort: cfg.Thresholds.BestEffort,
+		Normal:     cfg.Thresholds.Normal,
+		Critical:   1,
+	}
+	for class, threshold := range thresholds {
+		if threshold <= 0 || threshold > 1 {
+			return nil, fmt.Errorf("load_shedding: threshold for %s must be in (0, 1]", Class(class))
+		}
+
+		// Every class may have at least one request in flight
+		s.limits[class] = max(1, int64(threshold*float64(cfg.MaxInFlight)))
+	}
+
+	if len(cfg.Consumers) > 0 {
+		if s.consumerKey, err = ratelimit.ParseKey(cfg.ConsumerKey); err != nil {
+			return nil, fmt.Errorf("load_shedding: %w", err)
+		}
+
+		for consumer, name := range cfg.Consumers {
+			class, err := ParseClass(name)
+			if err != nil {
+				return nil, fmt.Errorf("load_shedding: consumer %s: %w", consumer, err)
+			}
+
+			s.consumers[consumer] = class
+		}
+	}
+
+	return s, nil
+}
+
+// Acquire tries to admit a request of the given class. Every successful
+// Acquire must be paired with a Release of the same class.
+func (s *Shedder) Acquire(class Class) bool {
+	if atomic.AddInt64(&s.inFlight, 1) > s.limits[class] {
+		atomic.AddInt64(&s.inFlight, -1)
+		atomic.AddInt64(&s.stats[class].Shed, 1)
+		s.countShed()
+		return false
+	}
+
+	atomic.AddInt64(&s.stats[class].Admitted, 1)
+	atomic.AddInt64(&s.stats[class].InFlight, 1)
+	return true
+}
+
+// Release marks a request of the given class as finished
+func (s *Shedder) Release(class Class) {
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddInt64(&s.stats[class].InFlight, -1)
+}
+
+// RetryAfter estimates how long a shed request of the given class should
+// wait before retrying.
+//
+// The backlog is the requests in flight plus those shed during the last
+// second, which are likely to retry. The class's slots work through it in
+// rounds of the average request duration, so the estimate grows with
+// both the depth of the overload and the slowness of the upstreams.
+func (s *Shedder) RetryAfter(class Class) time.Duration {
+	latency := time.Duration(atomic.LoadInt64(&s.latency))
+	if latency <= 0 {
+		latency = time.Second
+	}
+
+	slots := max(s.limits[class], 1)
+	backlog := atomic.LoadInt64(&s.inFlight) + s.recentSheds()
+	rounds := max((backlog+slots-1)/slots, 1)
+
+	return time.Duration(rounds) * latency
+}
+
+// observe folds the duration of an admitted request into the moving
+// average with a weight of 1/8
+func (s *Shedder) observe(d time.Duration) {
+	for {
+		current := atomic.LoadInt64(&s.latency)
+		next := int64(d)
+		if current != 0 {
+			next = current + (int64(d)-current)/8
+		}
+
+		if atomic.CompareAndSwapInt64(&s.latency, current, next) {
+			return
+		}
+	}
+}
+
+// countShed records a shed request in the current one-second window
+func (s *Shedder) countShed() {
+	now := time.Now().Unix()
+	if second := atomic.LoadInt64(&s.shedSecond); second != now &&
+		atomic.CompareAndSwapInt64(&s.shedSecond, second, now) {
+		atomic.StoreInt64(&s.shedRecent, 0)
+	}
+
+	atomic.AddInt64(&s.shedRecent, 1)
+}
+
+// recentSheds returns the requests shed in the current or previous second
+func (s *Shedder) recentSheds() int64 {
+	if atomic.LoadInt64(&s.shedSecond) < time.Now().Unix()-1 {
+		return 0
+	}
+
+	return atomic.LoadInt64(&s.shedRecent)
+}
+
+// Classify determines the class of a request. A consumer assignment wins
+// over the route's class, which wins over the default.
+func (s *Shedder) Classify(r *http.Request, routeClass *Class) Class {
+	if s.consumerKey != nil {
+		if class, ok := s.consumers[s.consumerKey(r)]; ok {
+			return class
+		}
+	}
+
+	if routeClass != nil {
+		return *routeClass
+	}
+
+	return s.defaultClass
+}
+
+// Middleware returns a middleware admitting requests through the shedder.
+// routeClass is the class configured on the route, nil for none.
+//
+// Shed requests receive 503 Service Unavailable with a Retry-After
+// estimated from the current backlog, capped by the route's
+// max_retry_after.
+func (s *Shedder) Middleware(routeClass *Class) middleware.Middleware {
+	if s == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			class := s.Classify(r, routeClass)
+			if !s.Acquire(class) {
+				seconds := retryafter.Set(w, r, s.RetryAfter(class))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				fmt.Fprintf(w, `{"error":"Gateway overloaded","qos_class":"%s","retry_after":%d}`, class, seconds)
+				return
+			}
+			defer s.Release(class)
+
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			s.observe(time.Since(start))
+		})
+	}
+}
+
+// Utilization returns the share of the concurrency capacity in use, 0 for
+// a nil shedder
+func (s *Shedder) Utilization() float64 {
+	if s == nil {
+		return 0
+	}
+
+	return float64(atomic.LoadInt64(&s.inFlight)) / float64(s.capacity)
+}
+
+// Stats returns a snapshot of the per-class counters, indexed by Class
+func (s *Shedder) Stats() map[Class]ClassStats {
+	stats := make(map[Class]ClassStats, numClasses)
+
+	for class := Class(0); class < numClasses; class++ {
+		stats[class] = ClassStats{
+			Admitted: atomic.LoadInt64(&s.stats[class].Admitted),
+			Shed:     atomic.LoadInt64(&s.stats[class].Shed),
+			InFlight: atomic.LoadInt64(&s.stats[class].InFlight),
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,269 @@
+// Package slowlog reports requests slower than a latency threshold.
+//
+// The access log records every request; finding the slow ones in it means
+// filtering millions of lines. The slow request log writes a warning only
+// for requests over the threshold, with the phase timings that tell where
+// the time went: connecting to the upstream, waiting for its first byte,
+// relaying the body, or inside the gateway itself, in retries, queues and
+// rate limiters. Slow requests are also counted per route.
+//
+// Requests carrying a W3C traceparent header are logged with their trace
+// ID and, with a trace URL template configured, a link to the trace.
+// With stack capture enabled, the stack of the goroutine serving a request
+// is captured the moment the request crosses the threshold, showing where
+// it is stuck while it still is. Captures are limited to one per second.
+//
+// Example usage:
+//
+//	slow := slowlog.New(cfg.Logging.SlowRequests, log)
+//	handler = middleware.Chain(handler, slow.Middleware())
+package slowlog
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/accesslog"
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/pkg/logger"
+)
+
+// Stack capture limits
+const (
+	// captureInterval is the least time between two stack captures
+	captureInterval = time.Second
+
+	// maxDumpBytes bounds the goroutine dump searched for a request's stack
+	maxDumpBytes = 8 << 20
+)
+
+// traceparent matches a W3C traceparent header, capturing the trace ID
+var traceparent = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// Recorder logs and counts slow requests
+//
+// Thread safety: All methods are safe for concurrent use.
+type Recorder struct {
+	// threshold is the latency above which a request is slow
+	threshold time.Duration
+
+	// traceURL links to a trace, with {trace_id} replaced
+	traceURL string
+
+	// captureStacks captures the serving goroutine's stack of slow
+	// requests
+	captureStacks bool
+
+	// lastCapture is when the last stack was captured, in Unix nanoseconds
+	lastCapture atomic.Int64
+
+	// mu guards counts
+	mu sync.Mutex
+
+	// counts holds the slow requests by route, "" for the fallback
+	counts map[string]int64
+
+	// logger receives slow request reports
+	logger *logger.Logger
+}
+
+// New creates a recorder, or returns nil when no threshold is configured
+func New(cfg config.SlowRequestConfig, log *logger.Logger) *Recorder {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+
+	return &Recorder{
+		threshold:     cfg.Threshold,
+		traceURL:      cfg.TraceURL,
+		captureStacks: cfg.CaptureStacks,
+		counts:        make(map[string]int64),
+		logger:        log.Component("slow"),
+	}
+}
+
+// Counts returns the number of slow requests by route name, "" for
+// requests matching no route
+func (s *Recorder) Counts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int64, len(s.counts))
+	for route, count := range s.counts {
+		counts[route] = count
+	}
+
+	return counts
+}
+
+// Middleware returns a middleware reporting requests slower than the
+// threshold. Returns nil when s is nil.
+func (s *Recorder) Middleware() middleware.Middleware {
+	if s == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			// Upstream timings are shared with the access log when it is on
+			entry := accesslog.FromContext(r.Context())
+			if entry == nil {
+				entry = &accesslog.Entry{}
+				r = r.WithContext(accesslog.WithEntry(r.Context(), entry))
+			}
+
+			var stack atomic.Pointer[string]
+			if s.captureStacks {
+				id := goroutineID()
+				timer := time.AfterFunc(s.threshold, func() {
+					if captured, ok := s.capture(id); ok {
+						stack.Store(&captured)
+					}
+				})
+				defer timer.Stop()
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			duration := time.Since(start)
+			if duration < s.threshold {
+				return
+			}
+
+			s.mu.Lock()
+			s.counts[entry.Route]++
+			s.mu.Unlock()
+
+			upstream := entry.TTFB + entry.Body
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"route", entry.Route,
+				"status", recorder.status,
+				"duration", duration,
+				"threshold", s.threshold,
+				"target", entry.Target,
+				"attempts", entry.Attempts,
+				"upstream_connect", entry.Connect,
+				"upstream_tls", entry.TLS,
+				"upstream_ttfb", entry.TTFB,
+				"upstream_body", entry.Body,
+				"gateway", max(duration-upstream, 0),
+				"conn_reused", entry.ConnReused,
+			}
+
+			if match := traceparent.FindStringSubmatch(r.Header.Get("Traceparent")); match != nil {
+				attrs = append(attrs, "trace_id", match[1])
+				if s.traceURL != "" {
+					attrs = append(attrs, "trace", strings.ReplaceAll(s.traceURL, "{trace_id}", match[1]))
+				}
+			}
+
+			if captured := stack.Load(); captured != nil {
+				attrs = append(attrs, "stack", *captured)
+			}
+
+			s.logger.Warn("Slow request", attrs...)
+		})
+	}
+}
+
+// capture returns the stack of goroutine id, unless another stack was
+// captured less than captureInterval ago
+func (s *Recorder) capture(id string) (string, bool) {
+	now := time.Now().UnixNano()
+	last := s.lastCapture.Load()
+	if now-last < int64(captureInterval) || !s.lastCapture.CompareAndSwap(last, now) {
+		return "", false
+	}
+
+	// Only a dump of all goroutines includes the one serving the request
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxDumpBytes {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	header := []byte("goroutine " + id + " [")
+	for _, block := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(block, header) {
+			return string(block), true
+		}
+	}
+
+	return "", false
+}
+
+// goroutineID returns the ID of the calling goroutine, as it appears in
+// stack dumps
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	// "goroutine 123 [running]:..."
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return ""
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return ""
+	}
+
+	return fields[1]
+}
+
+// statusRecorder captures the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+
+	// status is the response status code
+	status int
+
+	// wroteHeader reports whether the status was already sent
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *statusRecorder) WriteHeader(status int) {
+	// Informational responses precede the final status
+	if !r.wroteHeader && status >= http.StatusOK {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,294 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/pkg/logger"
+)
+
+// X509Source keeps the gateway's current SVID and trust bundle in memory,
+// updating both whenever the Workload API pushes a rotation.
+//
+// Thread safety: All methods are safe for concurrent use. TLS handshakes
+// read the latest SVID at handshake time, so rotations take effect on new
+// upstream connections without rebuilding the transport.
+type X509Source struct {
+	// client is the Workload API client
+	client *workloadClient
+
+	// trustDomain restricts accepted upstream SVIDs
+	trustDomain string
+
+	// allowed is the set of accepted upstream SPIFFE IDs (empty = any)
+	allowed map[string]struct{}
+
+	// mu guards svid
+	mu sync.RWMutex
+
+	// svid is the most recently received identity
+	svid *SVID
+
+	// cancel stops the watch loop
+	cancel context.CancelFunc
+
+	// done is closed when the watch loop exits
+	done chan struct{}
+
+	// logger for rotation and reconnect events
+	logger *logger.Logger
+}
+
+// NewX509Source connects to the Workload API and blocks until the first SVID
+// has been received or cfg.FetchTimeout elapses.
+//
+// The returned source keeps watching the Workload API in the background and
+// reconnects with exponential backoff if the stream breaks. Call Close to
+// stop it.
+//
+// Parameters:
+//
+//	ctx: Context bounding the initial fetch
+//	cfg: SPIFFE configuration
+//	log: Logger for rotation events
+//
+// Returns:
+//
+//	*X509Source: Source holding a valid SVID
+//	error: Socket configuration error or initial fetch failure
+func NewX509Source(ctx context.Context, cfg config.SPIFFEConfig, log *logger.Logger) (*X509Source, error) {
+	client, err := newWorkloadClient(cfg.WorkloadAPISocket)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]struct{}, len(cfg.AllowedIDs))
+	for _, id := range cfg.AllowedIDs {
+		if _, err := parseID(id); err != nil {
+			return nil, fmt.Errorf("invalid allowed SPIFFE ID: %w", err)
+		}
+
+		allowed[id] = struct{}{}
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	s := &X509Source{
+		client:      client,
+		trustDomain: cfg.TrustDomain,
+		allowed:     allowed,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		logger:      log,
+	}
+
+	ready := make(chan struct{})
+	go s.watch(watchCtx, ready)
+
+	timeout := cfg.FetchTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	select {
+	case <-ready:
+		return s, nil
+
+	case <-time.After(timeout):
+		s.Close()
+		return nil, fmt.Errorf("timed out waiting for SVID from %s", client.socket)
+
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// watch runs the Workload API stream until ctx is canceled
+func (s *X509Source) watch(ctx context.Context, ready chan struct{}) {
+	defer close(s.done)
+
+	var once sync.Once
+	backoff := time.Second
+
+	for {
+		err := s.client.watchX509(ctx, func(svids []SVID) {
+			s.update(svids[0])
+			backoff = time.Second
+			once.Do(func() { close(ready) })
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Warn("SPIFFE workload API stream failed",
+			"socket", s.client.socket,
+			"error", err,
+			"retry_in", backoff,
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// update installs a newly received SVID
+func (s *X509Source) update(svid SVID) {
+	s.mu.Lock()
+	s.svid = &svid
+	s.mu.Unlock()
+
+	s.logger.Info("SPIFFE SVID updated",
+		"spiffe_id", svid.ID,
+		"expires", svid.Certificates[0].NotAfter,
+	)
+}
+
+// SVID returns the current identity
+func (s *X509Source) SVID() *SVID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.svid
+}
+
+// Close stops watching the Workload API
+func (s *X509Source) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// ClientTLSConfig returns a TLS configuration for upstream connections that
+// presents the current SVID and authenticates the server by SPIFFE ID.
+//
+// Standard hostname verification is replaced by SPIFFE verification: the
+// server chain must verify against the trust bundle, and its URI SAN must be
+// a SPIFFE ID in the configured trust domain and allow-list.
+func (s *X509Source) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			svid := s.SVID()
+			if svid == nil {
+				return nil, errors.New("no SVID available")
+			}
+
+			cert := &tls.Certificate{
+				PrivateKey: svid.PrivateKey,
+				Leaf:       svid.Certificates[0],
+			}
+			for _, c := range svid.Certificates {
+				cert.Certificate = append(cert.Certificate, c.Raw)
+			}
+
+			return cert, nil
+		},
+
+		// Hostname verification does not apply to SVIDs; the chain and
+		// SPIFFE ID are checked in VerifyPeerCertificate instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return s.verifyPeer(rawCerts)
+		},
+	}
+}
+
+// verifyPeer validates an upstream server certificate chain
+func (s *X509Source) verifyPeer(rawCerts [][]byte) error {
+	svid := s.SVID()
+	if svid == nil {
+		return errors.New("no trust bundle available")
+	}
+
+	if len(rawCerts) == 0 {
+		return errors.New("upstream presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid upstream certificate: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	roots := x509.NewCertPool()
+	for _, c := range svid.Bundle {
+		roots.AddCert(c)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("upstream SVID verification failed: %w", err)
+	}
+
+	if len(certs[0].URIs) != 1 {
+		return errors.New("upstream certificate must contain exactly one URI SAN")
+	}
+
+	peerID := certs[0].URIs[0]
+	if peerID.Scheme != "spiffe" {
+		return fmt.Errorf("upstream URI SAN %s is not a SPIFFE ID", peerID)
+	}
+
+	trustDomain := s.trustDomain
+	if trustDomain == "" {
+		own, err := parseID(svid.ID)
+		if err != nil {
+			return err
+		}
+
+		trustDomain = own.Host
+	}
+
+	if peerID.Host != trustDomain {
+		return fmt.Errorf("upstream SPIFFE ID %s is not in trust domain %s", peerID, trustDomain)
+	}
+
+	if len(s.allowed) > 0 {
+		if _, ok := s.allowed[peerID.String()]; !ok {
+			return fmt.Errorf("upstream SPIFFE ID %s is not allowed", peerID)
+		}
+	}
+
+	return nil
+}
+
+// parseID validates a SPIFFE ID of the form spiffe://trust-domain/path
+func parseID(id string) (*url.URL, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q: %w", id, err)
+	}
+
+	if u.Scheme != "spiffe" || u.Host == "" {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,345 @@
+// Package spiffe provides SPIFFE workload identity for upstream mTLS.
+//
+// This package talks to the SPIFFE Workload API (as served by a SPIRE agent)
+// over its local Unix socket, receives X.509 SVIDs and trust bundles, and
+// keeps them up to date as the agent rotates them. The gateway uses the SVID
+// as its client certificate towards upstreams and validates upstream server
+// certificates against the trust bundle and an allow-list of SPIFFE IDs.
+//
+// The Workload API is a gRPC service. To avoid pulling the full gRPC stack
+// into the gateway, the single streaming call needed (FetchX509SVID) is
+// implemented directly on top of net/http's HTTP/2 support with a minimal
+// protobuf decoder for the response message.
+//
+// Example usage:
+//
+//	source, err := spiffe.NewX509Source(ctx, cfg.UpstreamTLS.SPIFFE, log)
+//	if err != nil {
+//		return err
+//	}
+//	defer source.Close()
+//	transport.TLSClientConfig = source.ClientTLSConfig()
+package spiffe
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// endpointEnv is the standard environment variable pointing at the
+	// Workload API socket
+	endpointEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+	// fetchX509SVIDPath is the gRPC method path of the streaming SVID call
+	fetchX509SVIDPath = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+	// maxMessageSize bounds a single Workload API response message
+	maxMessageSize = 4 << 20
+)
+
+// SVID is an X.509 SPIFFE Verifiable Identity Document
+type SVID struct {
+	// ID is the SPIFFE ID of the workload, e.g. spiffe://example.org/gateway
+	ID string
+
+	// Certificates is the leaf certificate followed by any intermediates
+	Certificates []*x509.Certificate
+
+	// PrivateKey is the key matching the leaf certificate
+	PrivateKey crypto.Signer
+
+	// Bundle contains the trust bundle roots for the SVID's trust domain
+	Bundle []*x509.Certificate
+}
+
+// workloadClient is a minimal client for the SPIFFE Workload API
+type workloadClient struct {
+	// socket is the filesystem path of the Workload API Unix socket
+	socket string
+
+	// http is an h2c client dialing the Unix socket
+	http *http.Client
+}
+
+// newWorkloadClient creates a Workload API client for the given endpoint.
+// The endpoint uses the "unix://" scheme; an empty endpoint falls back to
+// the SPIFFE_ENDPOINT_SOCKET environment variable.
+func newWorkloadClient(endpoint string) (*workloadClient, error) {
+	if endpoint == "" {
+		endpoint = os.Getenv(endpointEnv)
+	}
+
+	if endpoint == "" {
+		return nil, fmt.Errorf("workload API socket not configured and %s is not set", endpointEnv)
+	}
+
+	socket, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	transport := &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &workloadClient{
+		socket: socket,
+		http:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// parseEndpoint converts a Workload API endpoint URL into a socket path
+func parseEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid workload API endpoint %q: %w", endpoint, err)
+	}
+
+	if u.Scheme != "unix" {
+		return "", fmt.Errorf("unsupported workload API endpoint scheme %q", u.Scheme)
+	}
+
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("workload API endpoint %q has no socket path", endpoint)
+	}
+
+	return path, nil
+}
+
+// watchX509 opens the FetchX509SVID stream and invokes onUpdate for every
+// response received. It returns when the stream ends or ctx is canceled.
+func (c *workloadClient) watchX509(ctx context.Context, onUpdate func([]SVID)) error {
+	// An empty X509SVIDRequest framed as an uncompressed gRPC message
+	body := strings.NewReader("\x00\x00\x00\x00\x00")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"http://localhost"+fetchX509SVIDPath, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("workload API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("workload API returned HTTP %d", resp.StatusCode)
+	}
+
+	if status := resp.Header.Get("Grpc-Status"); status != "" && status != "0" {
+		return fmt.Errorf("workload API error: status %s: %s", status, resp.Header.Get("Grpc-Message"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		msg, err := readGRPCMessage(reader)
+		if err == io.EOF {
+			if status := resp.Trailer.Get("Grpc-Status"); status != "" && status != "0" {
+				return fmt.Errorf("workload API error: status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+			}
+
+			return errors.New("workload API stream closed")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		svids, err := decodeX509SVIDResponse(msg)
+		if err != nil {
+			return err
+		}
+
+		onUpdate(svids)
+	}
+}
+
+// readGRPCMessage reads a single length-prefixed gRPC message
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated gRPC message header: %w", err)
+		}
+
+		return nil, err
+	}
+
+	if header[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("gRPC message too large: %d bytes", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("truncated gRPC message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// decodeX509SVIDResponse decodes an X509SVIDResponse message.
+//
+//	message X509SVIDResponse { repeated X509SVID svids = 1; ... }
+//	message X509SVID {
+//	    string spiffe_id = 1; bytes x509_svid = 2;
+//	    bytes x509_svid_key = 3; bytes bundle = 4;
+//	}
+func decodeX509SVIDResponse(msg []byte) ([]SVID, error) {
+	var svids []SVID
+
+	err := walkFields(msg, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+
+		svid, err := decodeX509SVID(value)
+		if err != nil {
+			return err
+		}
+
+		svids = append(svids, svid)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid X509SVIDResponse: %w", err)
+	}
+
+	if len(svids) == 0 {
+		return nil, errors.New("workload API returned no SVIDs")
+	}
+
+	return svids, nil
+}
+
+// decodeX509SVID decodes and parses a single X509SVID message
+func decodeX509SVID(msg []byte) (SVID, error) {
+	var svid SVID
+	var keyDER []byte
+
+	err := walkFields(msg, func(field int, value []byte) error {
+		var err error
+
+		switch field {
+		case 1:
+			svid.ID = string(value)
+
+		case 2:
+			svid.Certificates, err = x509.ParseCertificates(value)
+
+		case 3:
+			keyDER = value
+
+		case 4:
+			svid.Bundle, err = x509.ParseCertificates(value)
+		}
+
+		return err
+	})
+	if err != nil {
+		return SVID{}, err
+	}
+
+	if len(svid.Certificates) == 0 {
+		return SVID{}, fmt.Errorf("SVID %s has no certificates", svid.ID)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return SVID{}, fmt.Errorf("SVID %s has invalid private key: %w", svid.ID, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return SVID{}, fmt.Errorf("SVID %s private key is not a signer", svid.ID)
+	}
+
+	svid.PrivateKey = signer
+	return svid, nil
+}
+
+// walkFields iterates over the length-delimited fields of a protobuf
+// message. Varint and fixed-size fields are skipped.
+func walkFields(msg []byte, fn func(field int, value []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		msg = msg[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			msg = msg[n:]
+
+		case 1:
+			if len(msg) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			msg = msg[8:]
+
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return errors.New("truncated length-delimited field")
+			}
+
+			value := msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+
+			if err := fn(field, value); err != nil {
+				return err
+			}
+
+		case 5:
+			if len(msg) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			msg = msg[4:]
+
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+	}
+
+	return nil
+}
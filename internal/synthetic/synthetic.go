@@ -0,0 +1,388 @@
+// Package synthetic verifies routes end to end with probe requests.
+//
+// Active health checks ask each target whether it is up, which says
+// nothing about the configuration in front of it: a route whose prefix
+// was mistyped, whose rewrite points at a path the backend does not
+// serve, or whose authentication rejects every caller passes them all.
+// A synthetic probe sends a configured request through the gateway's own
+// handler, middleware, routing and proxy included, exactly as a client
+// would, and checks which route it matched and the status it received.
+//
+// Probes run in process; they never open a connection to the gateway's
+// listener. Each carries an X-Velocity-Synthetic header naming the probe,
+// so backends and the access log can tell them apart from real traffic.
+//
+// Example usage:
+//
+//	prober, err := synthetic.New(cfg.Synthetic, routes, handler, log)
+//	go prober.Run(ctx)
+package synthetic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velocity/internal/accesslog"
+	"velocity/internal/config"
+	"velocity/internal/router"
+	"velocity/internal/secrets"
+	"velocity/pkg/logger"
+)
+
+// HeaderSynthetic names the probe that sent a request
+const HeaderSynthetic = "X-Velocity-Synthetic"
+
+// Probe request defaults
+const (
+	// remoteAddr is the client address of probe requests
+	remoteAddr = "127.0.0.1:0"
+
+	// defaultHost is the Host header of probes configuring none
+	defaultHost = "localhost"
+)
+
+// Prober runs synthetic probes
+//
+// Thread safety: All methods are safe for concurrent use.
+type Prober struct {
+	// probes are the configured probes
+	probes []*probe
+
+	// handler serves probe requests, the gateway's full pipeline
+	handler http.Handler
+
+	// logger for probe failures and recoveries
+	logger *logger.Logger
+}
+
+// probe is one configured probe and its results
+type probe struct {
+	// cfg holds the probe settings with defaults applied
+	cfg config.SyntheticProbeConfig
+
+	// header holds the headers sent with every request
+	header http.Header
+
+	// interval is the time between runs
+	interval time.Duration
+
+	// timeout bounds each request
+	timeout time.Duration
+
+	// mu guards stats
+	mu sync.Mutex
+
+	// stats are the results so far
+	stats Stats
+}
+
+// Stats holds the results of one probe
+type Stats struct {
+	// Name is the probe name
+	Name string `json:"name"`
+
+	// Route is the route the probe must match
+	Route string `json:"route"`
+
+	// Runs is the number of completed runs
+	Runs int64 `json:"runs"`
+
+	// Successes is the number of successful runs
+	Successes int64 `json:"successes"`
+
+	// Failures is the number of failed runs
+	Failures int64 `json:"failures"`
+
+	// Up reports whether the last run succeeded
+	Up bool `json:"up"`
+
+	// LastRun is when the last run completed, zero before the first
+	LastRun time.Time `json:"last_run"`
+
+	// LastStatus is the response status of the last run
+	LastStatus int `json:"last_status"`
+
+	// LastRoute is the route the last run matched, empty for none
+	LastRoute string `json:"last_route"`
+
+	// LastLatencySeconds is the duration of the last run
+	LastLatencySeconds float64 `json:"last_latency_seconds"`
+
+	// LastError explains why the last run failed, empty on success
+	LastError string `json:"last_error,omitempty"`
+}
+
+// New creates a prober sending requests to handler, or returns nil when
+// synthetic probes are disabled. Probe routes are looked up in routes.
+//
+// Returns an error for a probe without a name or naming an unknown route,
+// an invalid path or status, or a header value that cannot be resolved.
+func New(cfg config.SyntheticConfig, routes *router.Router, handler http.Handler, log *logger.Logger) (*Prober, error) {
+	if !cfg.Enabled || len(cfg.Probes) == 0 {
+		return nil, nil
+	}
+
+	if cfg.Interval < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("synthetic: interval and timeout must not be negative")
+	}
+
+	byName := make(map[string]*router.Route)
+	for _, route := range routes.Routes() {
+		byName[route.Config.Name] = route
+	}
+
+	store := secrets.NewStore(0)
+	seen := make(map[string]bool)
+	p := &Prober{handler: handler, logger: log.Component("synthetic")}
+
+	for _, pc := range cfg.Probes {
+		if pc.Name == "" {
+			return nil, fmt.Errorf("synthetic: every probe requires a name")
+		}
+
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("synthetic: duplicate probe %q", pc.Name)
+		}
+		seen[pc.Name] = true
+
+		route, ok := byName[pc.Route]
+		if !ok {
+			return nil, fmt.Errorf("synthetic: probe %q: unknown route %q", pc.Name, pc.Route)
+		}
+
+		if pc.Method == "" {
+			pc.Method = http.MethodGet
+		}
+		pc.Method = strings.ToUpper(pc.Method)
+
+		if pc.Host == "" {
+			pc.Host = defaultHost
+		}
+
+		if pc.Path == "" {
+			pc.Path = route.Config.PathPrefix
+		}
+
+		if !strings.HasPrefix(pc.Path, "/") {
+			return nil, fmt.Errorf("synthetic: probe %q: path must start with /", pc.Name)
+		}
+
+		for _, status := range pc.ExpectStatus {
+			if status < 100 || status > 599 {
+				return nil, fmt.Errorf("synthetic: probe %q: invalid status %d", pc.Name, status)
+			}
+		}
+
+		if pc.Interval < 0 {
+			return nil, fmt.Errorf("synthetic: probe %q: interval must not be negative", pc.Name)
+		}
+
+		header := make(http.Header)
+		for _, h := range pc.Headers {
+			value, err := store.Get(h.Value)
+			if err != nil {
+				return nil, fmt.Errorf("synthetic: probe %q: header %s: %w", pc.Name, h.Name, err)
+			}
+
+			header.Add(h.Name, value)
+		}
+		header.Set(HeaderSynthetic, pc.Name)
+
+		interval := pc.Interval
+		if interval == 0 {
+			interval = cfg.Interval
+		}
+
+		p.probes = append(p.probes, &probe{
+			cfg:      pc,
+			header:   header,
+			interval: max(interval, time.Second),
+			timeout:  max(cfg.Timeout, time.Second),
+			stats:    Stats{Name: pc.Name, Route: pc.Route},
+		})
+	}
+
+	return p, nil
+}
+
+// Stats returns the results of every probe, in configuration order
+func (p *Prober) Stats() []Stats {
+	stats := make([]Stats, len(p.probes))
+	for i, pr := range p.probes {
+		pr.mu.Lock()
+		stats[i] = pr.stats
+		pr.mu.Unlock()
+	}
+
+	return stats
+}
+
+// Run runs every probe at its interval, the first time immediately, until
+// ctx is canceled
+func (p *Prober) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, pr := range p.probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.loop(ctx, pr)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// loop runs one probe until ctx is canceled
+func (p *Prober) loop(ctx context.Context, pr *probe) {
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+
+	for {
+		p.run(ctx, pr)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run sends the probe request once and records the result
+func (p *Prober) run(ctx context.Context, pr *probe) {
+	ctx, cancel := context.WithTimeout(ctx, pr.timeout)
+	defer cancel()
+
+	entry := &accesslog.Entry{}
+	req, err := http.NewRequestWithContext(accesslog.WithEntry(ctx, entry), pr.cfg.Method, pr.cfg.Path, strings.NewReader(pr.cfg.Body))
+	if err != nil {
+		p.record(pr, 0, "", 0, err)
+		return
+	}
+
+	req.Header = pr.header.Clone()
+	req.RemoteAddr = remoteAddr
+	req.RequestURI = pr.cfg.Path
+	req.Host = pr.cfg.Host
+
+	start := time.Now()
+	w := &discardWriter{header: make(http.Header)}
+	p.handler.ServeHTTP(w, req)
+	latency := time.Since(start)
+
+	// Shutdown is not a failure of the route
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("timed out after %s", pr.timeout)
+	case entry.Route != pr.cfg.Route:
+		matched := strconv.Quote(entry.Route)
+		if entry.Route == "" {
+			matched = "no route"
+		}
+		err = fmt.Errorf("matched %s instead of %q", matched, pr.cfg.Route)
+	case !expected(pr.cfg.ExpectStatus, status):
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+
+	p.record(pr, status, entry.Route, latency, err)
+}
+
+// record stores the result of a run, logging failures and recoveries
+func (p *Prober) record(pr *probe, status int, route string, latency time.Duration, err error) {
+	pr.mu.Lock()
+	wasUp, first := pr.stats.Up, pr.stats.Runs == 0
+
+	pr.stats.Runs++
+	pr.stats.LastRun = time.Now()
+	pr.stats.LastStatus = status
+	pr.stats.LastRoute = route
+	pr.stats.LastLatencySeconds = latency.Seconds()
+	pr.stats.Up = err == nil
+	pr.stats.LastError = ""
+	if err != nil {
+		pr.stats.Failures++
+		pr.stats.LastError = err.Error()
+	} else {
+		pr.stats.Successes++
+	}
+	pr.mu.Unlock()
+
+	attrs := []any{
+		"probe", pr.cfg.Name,
+		"route", pr.cfg.Route,
+		"method", pr.cfg.Method,
+		"path", pr.cfg.Path,
+		"status", status,
+		"latency", latency,
+	}
+
+	switch {
+	case err != nil && (wasUp || first):
+		p.logger.Warn("Synthetic probe failed", append(attrs, "error", err)...)
+	case err != nil:
+		p.logger.Debug("Synthetic probe still failing", append(attrs, "error", err)...)
+	case !wasUp && !first:
+		p.logger.Info("Synthetic probe recovered", attrs...)
+	}
+}
+
+// expected reports whether status counts as success: one of expect, or
+// any 2xx when expect is empty
+func expected(expect []int, status int) bool {
+	if len(expect) == 0 {
+		return status >= 200 && status < 300
+	}
+
+	return slices.Contains(expect, status)
+}
+
+// discardWriter records the status of a probe response and discards its
+// body
+type discardWriter struct {
+	// header holds the response headers
+	header http.Header
+
+	// status is the final response status, zero until written
+	status int
+}
+
+// Header implements http.ResponseWriter
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *discardWriter) WriteHeader(status int) {
+	// Informational responses precede the final status
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+// Write implements http.ResponseWriter
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+// Flush implements http.Flusher so streamed responses are not buffered
+func (w *discardWriter) Flush() {}
@@ -0,0 +1,249 @@
+// Package throttle limits request admission while configuration is
+// applied.
+//
+// Swapping in new routing tables, connection pools or TLS material leaves
+// the gateway briefly cold: pools are empty and the first requests pay for
+// new connections and handshakes. A burst arriving at that moment queues
+// behind them and shows up as a tail latency spike. Opening the throttle
+// around a swap admits only a bounded number of requests at a time for a
+// short window; the rest wait briefly for a slot and are answered 503 with
+// Retry-After if none frees up.
+//
+// Windows are opened by configuration reloads and by discovery updates
+// adding or removing many targets. The window state and admission count
+// are process-wide, so a request served by the previous gateway during a
+// reload counts against the same limit as one served by the new gateway.
+//
+// Example usage:
+//
+//	throttle.Global().Open(throttle.ReasonReload, cfg.Reload.Throttle)
+//	admission, err := throttle.Global().Middleware(cfg.Reload.Throttle)
+//	handler = middleware.Chain(handler, admission)
+package throttle
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/retryafter"
+)
+
+// Reasons for opening the throttle
+const (
+	// ReasonReload is a configuration reload or rollback
+	ReasonReload = "reload"
+
+	// ReasonDiscovery is a discovery update changing many targets
+	ReasonDiscovery = "discovery"
+)
+
+// Reasons lists the reasons the throttle is opened for
+var Reasons = []string{ReasonReload, ReasonDiscovery}
+
+// global is the process-wide throttle
+var global = &Throttle{released: make(chan struct{}), windows: make(map[string]int64)}
+
+// Global returns the process-wide throttle
+func Global() *Throttle {
+	return global
+}
+
+// Throttle tracks admission windows and the requests admitted during them
+//
+// Thread safety: All methods are safe for concurrent use.
+type Throttle struct {
+	// until is when the current window ends as Unix nanoseconds
+	until atomic.Int64
+
+	// inFlight counts requests admitted during windows and not yet done
+	inFlight atomic.Int64
+
+	// delayed counts requests that waited for admission
+	delayed atomic.Int64
+
+	// rejected counts requests that found no slot within MaxWait
+	rejected atomic.Int64
+
+	// mu guards released, windows, throttled and opened
+	mu sync.Mutex
+
+	// released is closed and replaced whenever a slot frees up
+	released chan struct{}
+
+	// windows counts opened windows by reason
+	windows map[string]int64
+
+	// throttled is the total time windows were open, excluding the
+	// current window
+	throttled time.Duration
+
+	// opened is when the current run of overlapping windows started
+	opened time.Time
+}
+
+// Stats is a snapshot of the throttle
+type Stats struct {
+	// Active reports whether a window is open
+	Active bool
+
+	// Windows counts opened windows by reason
+	Windows map[string]int64
+
+	// Throttled is the total time windows were open
+	Throttled time.Duration
+
+	// Delayed counts requests that waited for admission
+	Delayed int64
+
+	// Rejected counts requests answered 503 for lack of a slot
+	Rejected int64
+}
+
+// Open starts a window of cfg.Window, or extends the current one. Does
+// nothing when the throttle is disabled.
+func (t *Throttle) Open(reason string, cfg config.ApplyThrottleConfig) {
+	if !cfg.Enabled || cfg.Window <= 0 {
+		return
+	}
+
+	now := time.Now()
+	until := now.Add(cfg.Window).UnixNano()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.windows[reason]++
+
+	current := t.until.Load()
+	if current <= now.UnixNano() {
+		// The previous window is over, account for it and start a new run
+		if !t.opened.IsZero() {
+			t.throttled += time.Unix(0, current).Sub(t.opened)
+		}
+		t.opened = now
+	}
+
+	if until > current {
+		t.until.Store(until)
+	}
+}
+
+// Active reports whether a window is open
+func (t *Throttle) Active() bool {
+	return time.Now().UnixNano() < t.until.Load()
+}
+
+// Middleware validates the configuration and returns a middleware limiting
+// concurrent requests to cfg.MaxInFlight while a window is open. Outside
+// windows requests pass untouched. Returns nil when the throttle is
+// disabled.
+func (t *Throttle) Middleware(cfg config.ApplyThrottleConfig) (middleware.Middleware, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Window <= 0 || cfg.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("reload: throttle: window and max_in_flight must be positive")
+	}
+
+	if cfg.MaxWait < 0 || cfg.MinDiscoveryChanges < 0 {
+		return nil, fmt.Errorf("reload: throttle: max_wait and min_discovery_changes must not be negative")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !t.Active() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !t.acquire(r, cfg) {
+				t.rejected.Add(1)
+				seconds := retryafter.Set(w, r, time.Duration(t.until.Load()-time.Now().UnixNano()))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				fmt.Fprintf(w, `{"error":"Gateway applying configuration","retry_after":%d}`, seconds)
+				return
+			}
+			defer t.release()
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// acquire admits a request, waiting up to cfg.MaxWait for a slot
+func (t *Throttle) acquire(r *http.Request, cfg config.ApplyThrottleConfig) bool {
+	var timeout <-chan time.Time
+
+	for {
+		// Taken before trying, so a slot freed in between is not missed
+		t.mu.Lock()
+		released := t.released
+		t.mu.Unlock()
+
+		if t.inFlight.Add(1) <= int64(cfg.MaxInFlight) {
+			return true
+		}
+		t.inFlight.Add(-1)
+
+		if timeout == nil {
+			t.delayed.Add(1)
+			timer := time.NewTimer(cfg.MaxWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// release frees a slot and wakes the requests waiting for one
+func (t *Throttle) release() {
+	t.inFlight.Add(-1)
+
+	t.mu.Lock()
+	close(t.released)
+	t.released = make(chan struct{})
+	t.mu.Unlock()
+}
+
+// Stats returns a snapshot of the throttle
+func (t *Throttle) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := Stats{
+		Active:    t.Active(),
+		Windows:   make(map[string]int64, len(t.windows)),
+		Throttled: t.throttled,
+		Delayed:   t.delayed.Load(),
+		Rejected:  t.rejected.Load(),
+	}
+
+	for reason, count := range t.windows {
+		stats.Windows[reason] = count
+	}
+
+	if !t.opened.IsZero() {
+		end := time.Unix(0, t.until.Load())
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+		stats.Throttled += end.Sub(t.opened)
+	}
+
+	return stats
+}
@@ -0,0 +1,195 @@
+// Package upgrade limits protocol upgrades to the routes allowing them.
+//
+// The reverse proxy passes a request's Upgrade header on and, once the
+// upstream answers 101 Switching Protocols, turns the client connection
+// into a raw tunnel to the upstream. Any backend reachable through the
+// gateway could take over client connections that way. Routes therefore
+// list the protocols they accept:
+//
+//	upgrades: ["websocket"]
+//
+// Requests asking for other protocols, on any route and on requests
+// matching no route, have their Upgrade header, the "upgrade" token of
+// their Connection header and HTTP2-Settings removed, so upstreams see a
+// plain request and answer it as such.
+//
+// Example usage:
+//
+//	policy, err := upgrade.New(rc.Name, rc.Upgrades)
+//	handler = middleware.Chain(handler, policy.Middleware())
+package upgrade
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"velocity/internal/middleware"
+)
+
+// Policy enforces the upgrade allowlist of one route
+//
+// Thread safety: All methods are safe for concurrent use.
+type Policy struct {
+	// route is the name of the route, empty for unmatched requests
+	route string
+
+	// allowed holds the lowercase protocol names the route accepts
+	allowed []string
+
+	// allowedCount counts upgrade requests passed on per allowed protocol
+	allowedCount []atomic.Int64
+
+	// stripped counts upgrade requests forwarded without their upgrade
+	stripped atomic.Int64
+}
+
+// Stats counts a route's upgrade requests
+type Stats struct {
+	// Allowed counts upgrade requests passed on, by protocol
+	Allowed map[string]int64
+
+	// Stripped counts upgrade requests forwarded as plain requests
+	Stripped int64
+}
+
+// New creates the upgrade policy of a route. Protocols are HTTP tokens
+// such as "websocket", matched case-insensitively and regardless of a
+// version suffix like "/13".
+func New(route string, protocols []string) (*Policy, error) {
+	p := &Policy{route: route}
+
+	for _, protocol := range protocols {
+		name := strings.ToLower(strings.TrimSpace(protocol))
+		if !isToken(name) {
+			return nil, fmt.Errorf("upgrades: invalid protocol %q", protocol)
+		}
+
+		if !slices.Contains(p.allowed, name) {
+			p.allowed = append(p.allowed, name)
+		}
+	}
+
+	p.allowedCount = make([]atomic.Int64, len(p.allowed))
+	return p, nil
+}
+
+// Route returns the name of the route
+func (p *Policy) Route() string {
+	return p.route
+}
+
+// Allowed returns the protocols the route accepts
+func (p *Policy) Allowed() []string {
+	return p.allowed
+}
+
+// Stats returns the policy's counters
+func (p *Policy) Stats() Stats {
+	stats := Stats{Allowed: make(map[string]int64, len(p.allowed)), Stripped: p.stripped.Load()}
+	for i, protocol := range p.allowed {
+		stats.Allowed[protocol] = p.allowedCount[i].Load()
+	}
+
+	return stats
+}
+
+// Middleware returns a middleware removing the upgrade headers of
+// requests for protocols the route does not allow
+func (p *Policy) Middleware() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") == "" && !hasToken(r.Header, "Connection", "upgrade") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if i := p.match(r.Header.Values("Upgrade")); i >= 0 && hasToken(r.Header, "Connection", "upgrade") {
+				p.allowedCount[i].Add(1)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p.stripped.Add(1)
+
+			r = r.Clone(r.Context())
+			strip(r.Header)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// match returns the index of the allowed protocol requested by the
+// Upgrade header values, or -1. A request offering several protocols is
+// allowed only if every one of them is.
+func (p *Policy) match(values []string) int {
+	found := -1
+	for _, value := range values {
+		for offer := range strings.SplitSeq(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(offer), "/")
+			if name == "" {
+				continue
+			}
+
+			i := slices.Index(p.allowed, strings.ToLower(name))
+			if i < 0 {
+				return -1
+			}
+
+			found = i
+		}
+	}
+
+	return found
+}
+
+// strip removes the headers asking for an upgrade
+func strip(header http.Header) {
+	header.Del("Upgrade")
+	header.Del("HTTP2-Settings")
+
+	var kept []string
+	for _, value := range header.Values("Connection") {
+		for option := range strings.SplitSeq(value, ",") {
+			option = strings.TrimSpace(option)
+			if option != "" && !strings.EqualFold(option, "upgrade") && !strings.EqualFold(option, "HTTP2-Settings") {
+				kept = append(kept, option)
+			}
+		}
+	}
+
+	header.Del("Connection")
+	if len(kept) > 0 {
+		header.Set("Connection", strings.Join(kept, ", "))
+	}
+}
+
+// hasToken reports whether a comma-separated header lists token
+func hasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for option := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isToken reports whether s is a non-empty HTTP token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+
+	return true
+}
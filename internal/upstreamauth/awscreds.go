@@ -0,0 +1,294 @@
+package upstreamauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/secrets"
+)
+
+// AWSCredentials is a set of AWS access credentials
+type AWSCredentials struct {
+	// AccessKeyID and SecretAccessKey identify and authenticate the caller
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken is set for temporary credentials
+	SessionToken string
+
+	// Expires is when temporary credentials stop being valid, zero if never
+	Expires time.Time
+}
+
+// AWSCredentialsProvider supplies AWS credentials
+type AWSCredentialsProvider interface {
+	// Retrieve returns valid credentials or an error
+	Retrieve(ctx context.Context) (AWSCredentials, error)
+}
+
+// staticProvider returns fixed credentials
+type staticProvider struct {
+	creds AWSCredentials
+}
+
+// Retrieve implements AWSCredentialsProvider
+func (p staticProvider) Retrieve(context.Context) (AWSCredentials, error) {
+	return p.creds, nil
+}
+
+// envProvider reads the standard AWS_* environment variables
+type envProvider struct{}
+
+// Retrieve implements AWSCredentialsProvider
+func (envProvider) Retrieve(context.Context) (AWSCredentials, error) {
+	id := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return AWSCredentials{}, errors.New("AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY not set")
+	}
+
+	return AWSCredentials{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+// profileProvider reads a profile from the shared credentials file
+type profileProvider struct {
+	// profile is the section name, "default" if empty
+	profile string
+}
+
+// Retrieve implements AWSCredentialsProvider
+func (p profileProvider) Retrieve(context.Context) (AWSCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return AWSCredentials{}, err
+		}
+
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := p.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	defer file.Close()
+
+	var creds AWSCredentials
+	inProfile := false
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !inProfile || !ok {
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return AWSCredentials{}, err
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return AWSCredentials{}, fmt.Errorf("profile %s not found in %s", profile, path)
+	}
+
+	return creds, nil
+}
+
+// imdsProvider fetches instance role credentials from EC2 IMDSv2
+type imdsProvider struct {
+	// endpoint is the metadata service base URL
+	endpoint string
+
+	// client is used for metadata requests
+	client *http.Client
+}
+
+// Retrieve implements AWSCredentialsProvider
+func (p imdsProvider) Retrieve(ctx context.Context) (AWSCredentials, error) {
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, p.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+
+	token, err := p.fetch(tokenReq)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("IMDS token: %w", err)
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+
+		return p.fetch(req)
+	}
+
+	roles, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("IMDS role: %w", err)
+	}
+
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return AWSCredentials{}, errors.New("IMDS: no instance role attached")
+	}
+
+	body, err := get("/latest/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("IMDS credentials: %w", err)
+	}
+
+	var doc struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return AWSCredentials{}, fmt.Errorf("IMDS credentials: %w", err)
+	}
+
+	return AWSCredentials{
+		AccessKeyID:     doc.AccessKeyID,
+		SecretAccessKey: doc.SecretAccessKey,
+		SessionToken:    doc.Token,
+		Expires:         doc.Expiration,
+	}, nil
+}
+
+// fetch performs a metadata request and returns the body
+func (p imdsProvider) fetch(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	return string(body), nil
+}
+
+// chainProvider tries providers in order and caches the first success
+// until shortly before the credentials expire
+type chainProvider struct {
+	providers []AWSCredentialsProvider
+
+	mu     sync.Mutex
+	cached *AWSCredentials
+}
+
+// newDefaultAWSProvider returns the standard chain: environment, shared
+// credentials profile, then EC2 instance metadata
+func newDefaultAWSProvider(profile string) *chainProvider {
+	return &chainProvider{
+		providers: []AWSCredentialsProvider{
+			envProvider{},
+			profileProvider{profile: profile},
+			imdsProvider{
+				endpoint: "http://169.254.169.254",
+				client:   &http.Client{Timeout: 2 * time.Second},
+			},
+		},
+	}
+}
+
+// NewAWSProvider returns static credentials when cfg sets an access key,
+// resolving secret references through store, and the default chain
+// otherwise
+func NewAWSProvider(cfg config.AWSSigV4Config, store *secrets.Store) (AWSCredentialsProvider, error) {
+	if cfg.AccessKeyID == "" {
+		return newDefaultAWSProvider(cfg.Profile), nil
+	}
+
+	id, err := store.Get(cfg.AccessKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := store.Get(cfg.SecretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return staticProvider{creds: AWSCredentials{AccessKeyID: id, SecretAccessKey: secret}}, nil
+}
+
+// Retrieve implements AWSCredentialsProvider
+func (c *chainProvider) Retrieve(ctx context.Context) (AWSCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil && (c.cached.Expires.IsZero() || time.Until(c.cached.Expires) > 5*time.Minute) {
+		return *c.cached, nil
+	}
+
+	var errs []error
+	for _, provider := range c.providers {
+		creds, err := provider.Retrieve(ctx)
+		if err == nil {
+			c.cached = &creds
+			return creds, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return AWSCredentials{}, fmt.Errorf("no AWS credentials found: %w", errors.Join(errs...))
+}
@@ -0,0 +1,296 @@
+package upstreamauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/secrets"
+)
+
+// fetchTimeout bounds a token request. Fetches are detached from the
+// requests waiting on them, so one caller giving up does not fail the
+// others.
+const fetchTimeout = 10 * time.Second
+
+// oauth2Token is a cached access token
+type oauth2Token struct {
+	value   string
+	expires time.Time
+
+	// credential identifies the client credentials the token was issued
+	// for
+	credential string
+}
+
+// oauth2Credentials are client credentials with secrets resolved
+type oauth2Credentials struct {
+	clientID, clientSecret string
+}
+
+// key identifies the credentials, so a token is never used after they
+// rotate
+func (c oauth2Credentials) key() string {
+	sum := sha256.Sum256([]byte(c.clientID + "\x00" + c.clientSecret))
+	return hex.EncodeToString(sum[:])
+}
+
+// oauth2Fetch is a token request in progress, shared by every caller that
+// needs it
+type oauth2Fetch struct {
+	// done is closed once token or err is set
+	done chan struct{}
+
+	token *oauth2Token
+	err   error
+}
+
+// OAuth2TokenSource fetches and caches client-credentials access tokens.
+//
+// A token is reused until it enters the refresh window before expiry. From
+// then on, requests keep using the still valid token while a single
+// background refresh runs, so upstream calls never wait on the token
+// endpoint unless the token has actually expired.
+//
+// Client credentials are resolved through the secret store on every use,
+// and a cached token is only used with the credentials it was issued for,
+// so rotating the client secret fetches a new token. Concurrent callers
+// share one token request per credential, which runs without holding the
+// lock and is bounded by fetchTimeout.
+type OAuth2TokenSource struct {
+	// cfg is the client configuration, with secret references unresolved
+	cfg config.OAuth2ClientConfig
+
+	// store resolves the client credentials
+	store *secrets.Store
+
+	// client performs token endpoint requests
+	client *http.Client
+
+	// mu guards token and fetches
+	mu sync.Mutex
+
+	// token is the current token, nil before the first fetch
+	token *oauth2Token
+
+	// fetches are the token requests in progress, by credential
+	fetches map[string]*oauth2Fetch
+
+	// now is the clock used for expiry decisions
+	now func() time.Time
+}
+
+// NewOAuth2TokenSource creates a token source. Client credentials are
+// resolved through the secret store.
+func NewOAuth2TokenSource(cfg config.OAuth2ClientConfig, store *secrets.Store) (*OAuth2TokenSource, error) {
+	if cfg.TokenURL == "" || cfg.ClientID == "" {
+		return nil, errors.New("oauth2 requires token_url and client_id")
+	}
+
+	if _, err := url.ParseRequestURI(cfg.TokenURL); err != nil {
+		return nil, fmt.Errorf("invalid oauth2 token_url: %w", err)
+	}
+
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = time.Minute
+	}
+
+	s := &OAuth2TokenSource{
+		cfg:     cfg,
+		store:   store,
+		client:  &http.Client{Timeout: fetchTimeout},
+		fetches: make(map[string]*oauth2Fetch),
+		now:     time.Now,
+	}
+
+	if _, err := s.credentials(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// credentials resolves the client credentials
+func (s *OAuth2TokenSource) credentials() (oauth2Credentials, error) {
+	clientID, err := s.store.Get(s.cfg.ClientID)
+	if err != nil {
+		return oauth2Credentials{}, err
+	}
+
+	clientSecret, err := s.store.Get(s.cfg.ClientSecret)
+	if err != nil {
+		return oauth2Credentials{}, err
+	}
+
+	return oauth2Credentials{clientID: clientID, clientSecret: clientSecret}, nil
+}
+
+// Token returns a valid access token, fetching one if necessary. Waiting
+// for the fetch ends when ctx is done; the fetch itself continues for the
+// other callers.
+func (s *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	creds, err := s.credentials()
+	if err != nil {
+		return "", err
+	}
+	key := creds.key()
+
+	s.mu.Lock()
+	now := s.now()
+	if t := s.token; t != nil && t.credential == key && now.Before(t.expires) {
+		if now.After(t.expires.Add(-s.cfg.RefreshBefore)) {
+			s.start(key, creds)
+		}
+		s.mu.Unlock()
+
+		return t.value, nil
+	}
+
+	fetch := s.start(key, creds)
+	s.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+		if fetch.err != nil {
+			return "", fetch.err
+		}
+		return fetch.token.value, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// start returns the token request in progress for a credential, starting
+// one if there is none. Must be called with mu held.
+func (s *OAuth2TokenSource) start(key string, creds oauth2Credentials) *oauth2Fetch {
+	if fetch, ok := s.fetches[key]; ok {
+		return fetch
+	}
+
+	fetch := &oauth2Fetch{done: make(chan struct{})}
+	s.fetches[key] = fetch
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+
+		fetch.token, fetch.err = s.fetch(ctx, creds)
+		if fetch.token != nil {
+			fetch.token.credential = key
+		}
+
+		s.mu.Lock()
+		delete(s.fetches, key)
+		if fetch.err == nil {
+			s.token = fetch.token
+		}
+		s.mu.Unlock()
+
+		close(fetch.done)
+	}()
+
+	return fetch
+}
+
+// fetch requests a new token from the token endpoint
+func (s *OAuth2TokenSource) fetch(ctx context.Context, creds oauth2Credentials) (*oauth2Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	}
+
+	if s.cfg.Audience != "" {
+		form.Set("audience", s.cfg.Audience)
+	}
+
+	if s.cfg.AuthStyle == "body" {
+		form.Set("client_id", creds.clientID)
+		form.Set("client_secret", creds.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.cfg.AuthStyle != "body" {
+		req.SetBasicAuth(url.QueryEscape(creds.clientID), url.QueryEscape(creds.clientSecret))
+	}
+
+	requested := s.now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth2 token endpoint returned HTTP %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("oauth2 token response: %w", err)
+	}
+
+	if payload.AccessToken == "" {
+		return nil, errors.New("oauth2 token response has no access_token")
+	}
+
+	if payload.TokenType != "" && !strings.EqualFold(payload.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported oauth2 token type %q", payload.TokenType)
+	}
+
+	lifetime := time.Duration(payload.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+
+	return &oauth2Token{value: payload.AccessToken, expires: requested.Add(lifetime)}, nil
+}
+
+// oauth2Middleware attaches a client-credentials access token to requests
+func oauth2Middleware(cfg config.OAuth2ClientConfig, store *secrets.Store) (middleware.Middleware, error) {
+	source, err := NewOAuth2TokenSource(cfg, store)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_auth: %w", err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := source.Token(r.Context())
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprintf(w, `{"error":"Upstream token unavailable"}`)
+				return
+			}
+
+			r.Header.Set("Authorization", "Bearer "+token)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,272 @@
+package upstreamauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"velocity/internal/bodybuf"
+	"velocity/internal/membudget"
+)
+
+const (
+	// sigV4Algorithm is the signing algorithm identifier
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+	// amzDateFormat is the ISO 8601 basic format used by SigV4
+	amzDateFormat = "20060102T150405Z"
+
+	// MaxSignedBody is the largest payload buffered for hashing when the
+	// route sets no body inspection limit
+	MaxSignedBody = 64 << 20
+)
+
+// RequestSigner signs an outgoing upstream request in place
+type RequestSigner interface {
+	Sign(r *http.Request) error
+}
+
+// signerKey is the context key for the route's request signer
+type signerKey struct{}
+
+// WithSigner returns a copy of ctx carrying signer
+func WithSigner(ctx context.Context, signer RequestSigner) context.Context {
+	return context.WithValue(ctx, signerKey{}, signer)
+}
+
+// Transport wraps base so that requests carrying a RequestSigner in their
+// context are signed immediately before they are sent.
+//
+// Signing has to happen at the transport level because the reverse proxy
+// rewrites the URL and host after the middleware chain has run, and the
+// signature covers both.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		signer, ok := r.Context().Value(signerKey{}).(RequestSigner)
+		if !ok {
+			return base.RoundTrip(r)
+		}
+
+		// RoundTrippers must not modify the caller's request
+		r = r.Clone(r.Context())
+		if err := signer.Sign(r); err != nil {
+			return nil, fmt.Errorf("request signing failed: %w", err)
+		}
+
+		return base.RoundTrip(r)
+	})
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// SigV4Signer signs requests with AWS Signature Version 4
+type SigV4Signer struct {
+	// region and service form the credential scope
+	region  string
+	service string
+
+	// credentials supplies the signing keys
+	credentials AWSCredentialsProvider
+
+	// now is the clock used for request timestamps
+	now func() time.Time
+}
+
+// NewSigV4Signer creates a signer for the given region and service
+func NewSigV4Signer(region, service string, credentials AWSCredentialsProvider) *SigV4Signer {
+	return &SigV4Signer{
+		region:      region,
+		service:     service,
+		credentials: credentials,
+		now:         time.Now,
+	}
+}
+
+// Sign adds X-Amz-Date, X-Amz-Content-Sha256, the optional security token
+// and the Authorization header to r.
+//
+// The payload hash is computed over the request's shared body buffer,
+// within the route's body inspection limit and the memory budget. The Host
+// header is set to the upstream host since AWS validates it as part of the
+// signature.
+func (s *SigV4Signer) Sign(r *http.Request) error {
+	creds, err := s.credentials.Retrieve(r.Context())
+	if err != nil {
+		return err
+	}
+
+	payload, ok, err := bodybuf.Read(r, MaxSignedBody)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	if !ok {
+		return membudget.ErrExceeded
+	}
+
+	payloadHash := sha256Hex(payload)
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+
+	// The path is sent encoded the way it is signed, whatever encoding
+	// the client chose
+	r.Host = r.URL.Host
+	r.URL.RawPath = EscapePath(r.URL.Path)
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := s.canonicalHeaders(r)
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s.canonicalURI(r),
+		canonicalQuery(r),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.region, s.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+
+	return nil
+}
+
+// canonicalURI returns the encoded path. Every service except S3 expects
+// path segments to be encoded twice.
+func (s *SigV4Signer) canonicalURI(r *http.Request) string {
+	path := EscapePath(r.URL.Path)
+	if path == "" {
+		return "/"
+	}
+
+	if s.service == "s3" {
+		return path
+	}
+
+	return EscapePath(path)
+}
+
+// canonicalQuery returns the sorted, encoded query string
+func canonicalQuery(r *http.Request) string {
+	query := r.URL.Query()
+	pairs := make([]string, 0, len(query))
+
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// canonicalHeaders returns the signed header list and canonical header
+// block. Host, Content-Type and all X-Amz-* headers are signed.
+func (s *SigV4Signer) canonicalHeaders(r *http.Request) (string, string) {
+	headers := map[string]string{"host": r.Host}
+
+	for name, values := range r.Header {
+		lower := strings.ToLower(name)
+		if lower != "content-type" && !strings.HasPrefix(lower, "x-amz-") {
+			continue
+		}
+
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+
+		headers[lower] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var block strings.Builder
+	for _, name := range names {
+		block.WriteString(name)
+		block.WriteByte(':')
+		block.WriteString(headers[name])
+		block.WriteByte('\n')
+	}
+
+	return strings.Join(names, ";"), block.String()
+}
+
+// EscapePath percent-encodes each segment of a path the way SigV4 expects
+// S3 object keys, which is stricter than url.URL's own encoding. Set it as
+// the URL's RawPath so the request line and the signature agree.
+func EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// awsEscape percent-encodes everything except unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+// sha256Hex returns the hex encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 computes HMAC-SHA256(key, data)
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
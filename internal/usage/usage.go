@@ -0,0 +1,265 @@
+// Package usage accumulates billable request units per consumer.
+//
+// A route annotated with a cost charges every successful request a number
+// of units to the consumer identified by the route's consumer key, so API
+// monetization can be computed from gateway data alone:
+//
+//	cost:
+//	  units: 1
+//	  methods:
+//	    POST: 5
+//	  consumer: "claim.sub"
+//
+// Totals are kept per consumer and route in a process-wide ledger that
+// outlives configuration reloads. Billing systems read them from the admin
+// API, and can take and reset them in one step at the end of a period so
+// no request is counted twice or lost in between. Each gateway instance
+// keeps its own ledger; a cluster's usage is the sum over its members.
+//
+// Example usage:
+//
+//	meter, err := usage.Middleware(rc.Name, rc.Cost, usage.Global())
+//	handler = middleware.Chain(handler, meter)
+package usage
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+	"velocity/internal/ratelimit"
+)
+
+// Overflow is the consumer charged once the ledger tracks MaxConsumers
+// consumers, so totals stay complete when consumer keys are unbounded
+const Overflow = "_overflow"
+
+// MaxConsumers bounds the number of consumer and route pairs a ledger
+// tracks between resets
+const MaxConsumers = 100000
+
+// global is the process-wide ledger
+var global = NewLedger()
+
+// Global returns the process-wide ledger
+func Global() *Ledger {
+	return global
+}
+
+// key identifies a ledger line
+type key struct {
+	// consumer is the charged consumer
+	consumer string
+
+	// route is the route the requests went to
+	route string
+}
+
+// totals are the charges of one ledger line
+type totals struct {
+	// requests counts charged requests
+	requests int64
+
+	// units is the sum of charged units
+	units float64
+}
+
+// Ledger holds usage totals
+//
+// Thread safety: All methods are safe for concurrent use.
+type Ledger struct {
+	// mu guards lines and since
+	mu sync.Mutex
+
+	// lines holds the totals by consumer and route
+	lines map[key]*totals
+
+	// since is when the ledger was created or last reset
+	since time.Time
+}
+
+// Line is the usage of one consumer on one route
+type Line struct {
+	// Consumer is the charged consumer
+	Consumer string `json:"consumer"`
+
+	// Route is the route the requests went to
+	Route string `json:"route"`
+
+	// Requests is the number of charged requests
+	Requests int64 `json:"requests"`
+
+	// Units is the sum of charged units
+	Units float64 `json:"units"`
+}
+
+// Report is a snapshot of a ledger
+type Report struct {
+	// Since is when accumulation started
+	Since time.Time `json:"since"`
+
+	// Until is when the snapshot was taken
+	Until time.Time `json:"until"`
+
+	// Lines are ordered by consumer and route
+	Lines []Line `json:"lines"`
+}
+
+// NewLedger creates an empty ledger
+func NewLedger() *Ledger {
+	return &Ledger{lines: make(map[key]*totals), since: time.Now()}
+}
+
+// Charge adds one request of units to a consumer's usage of a route
+func (l *Ledger) Charge(consumer, route string, units float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := key{consumer: consumer, route: route}
+	line, ok := l.lines[k]
+	if !ok {
+		if len(l.lines) >= MaxConsumers {
+			k.consumer = Overflow
+			line = l.lines[k]
+		}
+
+		if line == nil {
+			line = &totals{}
+			l.lines[k] = line
+		}
+	}
+
+	line.requests++
+	line.units += units
+}
+
+// Report returns the ledger's totals, limited to consumer unless it is
+// empty
+func (l *Ledger) Report(consumer string) Report {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.report(consumer)
+}
+
+// Reset returns the ledger's totals and starts a new period
+func (l *Ledger) Reset() Report {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := l.report("")
+	l.lines = make(map[key]*totals)
+	l.since = report.Until
+	return report
+}
+
+// report builds a report. Must be called with l.mu held.
+func (l *Ledger) report(consumer string) Report {
+	report := Report{Since: l.since, Until: time.Now(), Lines: []Line{}}
+
+	for k, line := range l.lines {
+		if consumer != "" && k.consumer != consumer {
+			continue
+		}
+
+		report.Lines = append(report.Lines, Line{
+			Consumer: k.consumer,
+			Route:    k.route,
+			Requests: line.requests,
+			Units:    line.units,
+		})
+	}
+
+	sort.Slice(report.Lines, func(i, j int) bool {
+		a, b := report.Lines[i], report.Lines[j]
+		if a.Consumer != b.Consumer {
+			return a.Consumer < b.Consumer
+		}
+
+		return a.Route < b.Route
+	})
+
+	return report
+}
+
+// Middleware returns a middleware charging the route's successful
+// requests to ledger. Returns nil when the route has no cost.
+func Middleware(route string, cfg config.CostConfig, ledger *Ledger) (middleware.Middleware, error) {
+	if cfg.Units == 0 && len(cfg.Methods) == 0 {
+		return nil, nil
+	}
+
+	if cfg.Units < 0 {
+		return nil, fmt.Errorf("cost: units must not be negative")
+	}
+
+	methods := make(map[string]float64, len(cfg.Methods))
+	for method, units := range cfg.Methods {
+		if units < 0 {
+			return nil, fmt.Errorf("cost: units of %s must not be negative", method)
+		}
+
+		methods[strings.ToUpper(method)] = units
+	}
+
+	consumerKey, err := ratelimit.ParseKey(cfg.Consumer)
+	if err != nil {
+		return nil, fmt.Errorf("cost: %w", err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status >= http.StatusBadRequest && !cfg.ChargeFailures {
+				return
+			}
+
+			units, ok := methods[r.Method]
+			if !ok {
+				units = cfg.Units
+			}
+
+			ledger.Charge(consumerKey(r), route, units)
+		})
+	}, nil
+}
+
+// statusRecorder captures the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+
+	// status is the response status code
+	status int
+
+	// wroteHeader reports whether the final status was sent
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader && status >= http.StatusOK {
+		s.status = status
+		s.wroteHeader = true
+	}
+
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher so streamed responses stay streamed
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
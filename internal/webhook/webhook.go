@@ -0,0 +1,91 @@
+// Package webhook delivers gateway events to external HTTP endpoints.
+//
+// Events are posted as JSON in the background so that a slow or failing
+// receiver never blocks the operation that raised the event.
+//
+// Example payload:
+//
+//	{"event":"config.rolled_back","time":"2024-01-01T00:00:00Z",
+//	 "data":{"reason":"all targets unreachable"}}
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"velocity/pkg/logger"
+)
+
+// Notifier posts events to a fixed set of URLs
+type Notifier struct {
+	// urls receive every event
+	urls []string
+
+	// client delivers events
+	client *http.Client
+
+	// logger for delivery failures
+	logger *logger.Logger
+}
+
+// Event is the JSON body delivered to receivers
+type Event struct {
+	// Event is the event type, e.g. "config.reload_failed"
+	Event string `json:"event"`
+
+	// Time is when the event occurred
+	Time time.Time `json:"time"`
+
+	// Data holds event specific details
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// New creates a notifier. A notifier without URLs drops every event.
+func New(urls []string, log *logger.Logger) *Notifier {
+	return &Notifier{
+		urls:   urls,
+		client: &http.Client{Timeout: 5 * time.Second},
+		logger: log.Component("webhook"),
+	}
+}
+
+// Notify delivers an event to every receiver asynchronously
+func (n *Notifier) Notify(event string, data map[string]interface{}) {
+	if n == nil || len(n.urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(Event{Event: event, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		n.logger.Warn("Webhook event encoding failed", "event", event, "error", err)
+		return
+	}
+
+	for _, url := range n.urls {
+		go n.deliver(url, event, body)
+	}
+}
+
+// deliver posts a single event
+func (n *Notifier) deliver(url, event string, body []byte) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		n.logger.Warn("Webhook delivery failed", "url", url, "event", event, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		n.logger.Warn("Webhook delivery failed", "url", url, "event", event, "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		n.logger.Warn("Webhook rejected", "url", url, "event", event, "status", resp.StatusCode)
+	}
+}
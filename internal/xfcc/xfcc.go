@@ -0,0 +1,205 @@
+// Package xfcc builds the X-Forwarded-Client-Cert header describing the
+// client certificate of a request to upstreams.
+//
+// The header follows the Envoy conventions backends already parse: one
+// element per hop separated by commas, each a list of Key=value pairs
+// separated by semicolons, with values quoted when they contain one of
+// the separators:
+//
+//	X-Forwarded-Client-Cert: Hash=4f2a...;Subject="CN=billing,O=Example";URI=spiffe://example.org/billing
+//
+// Besides the Envoy keys Hash, Cert, Subject, URI and DNS, the Validity
+// detail adds NotBefore and NotAfter in RFC 3339 format.
+//
+// The header is trustworthy only if the gateway controls it, so it is
+// removed from every request that does not come from a trusted proxy,
+// whether or not client certificates are enabled.
+//
+// Upstreams that do not parse XFCC can receive the subject and SHA-256
+// fingerprint of the verified certificate in plain headers instead. These
+// always describe the gateway's own client and are removed from every
+// request first.
+package xfcc
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"velocity/internal/config"
+	"velocity/internal/middleware"
+)
+
+// Header is the name of the forwarded client certificate header
+const Header = "X-Forwarded-Client-Cert"
+
+// Certificate details that can be forwarded
+const (
+	DetailHash     = "Hash"
+	DetailCert     = "Cert"
+	DetailSubject  = "Subject"
+	DetailURI      = "URI"
+	DetailDNS      = "DNS"
+	DetailValidity = "Validity"
+)
+
+// defaultDetails are forwarded unless configured otherwise. The PEM
+// certificate is left out as it makes the header several kilobytes long.
+var defaultDetails = []string{DetailHash, DetailSubject, DetailURI, DetailDNS, DetailValidity}
+
+// Middleware returns a middleware removing the header from untrusted
+// requests and describing the verified client certificate, if any, in it.
+// The header is only built when client certificates are enabled.
+func Middleware(cfg config.ServerTLSConfig) (middleware.Middleware, error) {
+	switch cfg.ClientAuth {
+	case "", "require", "optional":
+	default:
+		return nil, fmt.Errorf("tls: unknown client_auth %q, expected require or optional", cfg.ClientAuth)
+	}
+
+	details := cfg.ForwardClientCert.Details
+	if len(details) == 0 {
+		details = defaultDetails
+	}
+
+	for _, detail := range details {
+		switch detail {
+		case DetailHash, DetailCert, DetailSubject, DetailURI, DetailDNS, DetailValidity:
+		default:
+			return nil, fmt.Errorf("tls: unknown forward_client_cert detail %q", detail)
+		}
+	}
+
+	trusted := make([]netip.Prefix, 0, len(cfg.ForwardClientCert.TrustedProxies))
+	for _, cidr := range cfg.ForwardClientCert.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("tls: invalid forward_client_cert trusted proxy: %w", err)
+		}
+
+		trusted = append(trusted, prefix.Masked())
+	}
+
+	describeCerts := cfg.ClientCAFile != ""
+	subjectHeader, fingerprintHeader := cfg.ForwardClientCert.SubjectHeader, cfg.ForwardClientCert.FingerprintHeader
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !fromTrustedProxy(r, trusted) {
+				r.Header.Del(Header)
+			}
+
+			if subjectHeader != "" {
+				r.Header.Del(subjectHeader)
+			}
+
+			if fingerprintHeader != "" {
+				r.Header.Del(fingerprintHeader)
+			}
+
+			if describeCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				cert := r.TLS.VerifiedChains[0][0]
+				element := Describe(cert, details)
+
+				if forwarded := r.Header.Get(Header); forwarded != "" {
+					element = forwarded + "," + element
+				}
+				r.Header.Set(Header, element)
+
+				if subjectHeader != "" {
+					r.Header.Set(subjectHeader, cert.Subject.String())
+				}
+
+				if fingerprintHeader != "" {
+					sum := sha256.Sum256(cert.Raw)
+					r.Header.Set(fingerprintHeader, hex.EncodeToString(sum[:]))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// fromTrustedProxy reports whether the request's remote address is within
+// one of the trusted prefixes
+func fromTrustedProxy(r *http.Request, trusted []netip.Prefix) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Describe returns the XFCC element of a certificate with the given
+// details, in the order the details are listed
+func Describe(cert *x509.Certificate, details []string) string {
+	var pairs []string
+
+	for _, detail := range details {
+		switch detail {
+		case DetailHash:
+			sum := sha256.Sum256(cert.Raw)
+			pairs = append(pairs, "Hash="+hex.EncodeToString(sum[:]))
+		case DetailCert:
+			encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			pairs = append(pairs, "Cert="+quote(url.QueryEscape(string(encoded))))
+		case DetailSubject:
+			// Envoy always quotes the subject, whose RDNs contain commas
+			pairs = append(pairs, `Subject="`+escape(cert.Subject.String())+`"`)
+		case DetailURI:
+			for _, uri := range cert.URIs {
+				pairs = append(pairs, "URI="+quote(uri.String()))
+			}
+		case DetailDNS:
+			for _, name := range cert.DNSNames {
+				pairs = append(pairs, "DNS="+quote(name))
+			}
+		case DetailValidity:
+			pairs = append(pairs,
+				"NotBefore="+cert.NotBefore.UTC().Format(time.RFC3339),
+				"NotAfter="+cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// quote returns value, double-quoted when it contains a separator
+func quote(value string) string {
+	if strings.ContainsAny(value, `,;="`) {
+		return `"` + escape(value) + `"`
+	}
+
+	return value
+}
+
+// escape escapes the double quotes of a quoted value
+func escape(value string) string {
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -0,0 +1,308 @@
+// Package errors provides structured errors for Velocity Gateway.
+//
+// A GatewayError carries everything needed to handle a failure
+// consistently: a stable machine-readable code, the HTTP status returned to
+// clients, a severity for logging and alerting, the underlying cause and
+// free-form context. Handlers create a GatewayError where the failure is
+// detected and leave logging and the client response to Log and WriteJSON,
+// so every failure is reported the same way.
+//
+// Creating an error is cheap: the most common details (target, route and
+// attempt) have typed fields, and the context map is only allocated once
+// other context is added, so errors can be created on the hot path without
+// allocating beyond the error itself.
+//
+// Context growth is bounded. Past the soft key limit additions still
+// succeed but are counted, so unexpected growth shows up in stats; past
+// the hard limit they are dropped. String values longer than the value
+// limit are truncated. Limits are process-wide and set with SetLimits.
+//
+// Example usage:
+//
+//	err := errors.New(errors.CodeInternal, "internal server error").
+//		WithSeverity(errors.SeverityCritical).
+//		WithContext("path", r.URL.Path)
+//	err.Log(log)
+//	err.WriteJSON(w)
+package errors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"velocity/pkg/logger"
+)
+
+// ErrorCode is a stable, machine-readable identifier of a failure class
+type ErrorCode string
+
+const (
+	// CodeInternal is an unexpected failure inside the gateway
+	CodeInternal ErrorCode = "INTERNAL_ERROR"
+)
+
+// Severity ranks errors for logging and alerting
+type Severity int
+
+const (
+	// SeverityLow is an expected failure caused by the client
+	SeverityLow Severity = iota
+
+	// SeverityMedium is a failure of a single request
+	SeverityMedium
+
+	// SeverityHigh is a failure likely to affect many requests
+	SeverityHigh
+
+	// SeverityCritical is a bug or a failure requiring immediate attention
+	SeverityCritical
+)
+
+// String returns the lowercase name of the severity
+func (s Severity) String() string {
+	switch s {
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// GatewayError is a structured gateway failure
+type GatewayError struct {
+	// Code identifies the failure class
+	Code ErrorCode
+
+	// Message is the client-safe description of the failure
+	Message string
+
+	// StatusCode is the HTTP status returned to clients
+	StatusCode int
+
+	// Severity ranks the error for logging and alerting
+	Severity Severity
+
+	// Cause is the underlying error, if any
+	Cause error
+
+	// Retryable reports whether the request certainly never reached the
+	// upstream, so it can be retried elsewhere regardless of its method
+	Retryable bool
+
+	// Target is the upstream involved in the failure, if any
+	Target string
+
+	// Route is the name of the matched route, if any
+	Route string
+
+	// Attempt is the upstream attempt number, zero when not applicable
+	Attempt int
+
+	// Context holds additional details for logs. It is nil until the first
+	// WithContext call with a key that has no typed field.
+	Context map[string]interface{}
+
+	// DroppedContext counts context entries dropped at the hard limit
+	DroppedContext int
+
+	// Stack is the goroutine stack captured by WithStack
+	Stack []byte
+
+	// Timestamp is when the error was created
+	Timestamp time.Time
+}
+
+// codeDefaults are the HTTP status and severity of an error code
+type codeDefaults struct {
+	status   int
+	severity Severity
+}
+
+// defaults maps codes to their HTTP status and severity
+var defaults = map[ErrorCode]codeDefaults{
+	CodeInternal: {http.StatusInternalServerError, SeverityHigh},
+}
+
+// New creates an error with the status and severity registered for code
+func New(code ErrorCode, message string) *GatewayError {
+	e := &GatewayError{
+		Code:       code,
+		Message:    message,
+		StatusCode: http.StatusInternalServerError,
+		Severity:   SeverityMedium,
+		Timestamp:  time.Now(),
+	}
+
+	if d, ok := defaults[code]; ok {
+		e.StatusCode = d.status
+		e.Severity = d.severity
+	}
+
+	return e
+}
+
+// Wrap creates an error with cause as the underlying error
+func Wrap(cause error, code ErrorCode, message string) *GatewayError {
+	e := New(code, message)
+	e.Cause = cause
+	return e
+}
+
+// Error implements the error interface
+func (e *GatewayError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Cause)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the underlying cause for errors.Is and errors.As
+func (e *GatewayError) Unwrap() error {
+	return e.Cause
+}
+
+// WithContext adds a detail to the error and returns it.
+//
+// The keys "target", "route" and "attempt" with string, string and int
+// values are stored in their typed fields. Other keys go to the Context
+// map, subject to the configured limits.
+func (e *GatewayError) WithContext(key string, value interface{}) *GatewayError {
+	switch key {
+	case "target":
+		if v, ok := value.(string); ok {
+			return e.WithTarget(v)
+		}
+	case "route":
+		if v, ok := value.(string); ok {
+			return e.WithRoute(v)
+		}
+	case "attempt":
+		if v, ok := value.(int); ok {
+			return e.WithAttempt(v)
+		}
+	}
+
+	limits := currentLimits()
+
+	if _, exists := e.Context[key]; !exists {
+		if limits.HardKeys > 0 && len(e.Context) >= limits.HardKeys {
+			e.DroppedContext++
+			droppedEntries.Add(1)
+			return e
+		}
+
+		if limits.SoftKeys > 0 && len(e.Context) == limits.SoftKeys {
+			softLimitExceeded.Add(1)
+		}
+	}
+
+	if e.Context == nil {
+		e.Context = make(map[string]interface{}, 4)
+	}
+
+	e.Context[key] = truncate(value, limits.MaxValueBytes)
+	return e
+}
+
+// WithTarget records the upstream involved and returns the error
+func (e *GatewayError) WithTarget(target string) *GatewayError {
+	e.Target = target
+	return e
+}
+
+// WithRoute records the matched route and returns the error
+func (e *GatewayError) WithRoute(route string) *GatewayError {
+	e.Route = route
+	return e
+}
+
+// WithAttempt records the upstream attempt number and returns the error
+func (e *GatewayError) WithAttempt(attempt int) *GatewayError {
+	e.Attempt = attempt
+	return e
+}
+
+// WithSeverity overrides the error's severity and returns it
+func (e *GatewayError) WithSeverity(severity Severity) *GatewayError {
+	e.Severity = severity
+	return e
+}
+
+// WithStatus overrides the HTTP status and returns the error
+func (e *GatewayError) WithStatus(status int) *GatewayError {
+	e.StatusCode = status
+	return e
+}
+
+// WithStack captures the current goroutine's stack and returns the error.
+// Called from a deferred recover, the stack includes the panicking frames.
+func (e *GatewayError) WithStack() *GatewayError {
+	e.Stack = debug.Stack()
+	return e
+}
+
+// Log writes the error to log. High and critical errors are logged at error
+// level, medium at warn and low at info.
+func (e *GatewayError) Log(log *logger.Logger) {
+	attrs := make([]interface{}, 0, 16+2*len(e.Context))
+	attrs = append(attrs, "code", e.Code, "severity", e.Severity.String(), "status", e.StatusCode)
+
+	if e.Cause != nil {
+		attrs = append(attrs, "cause", e.Cause.Error())
+	}
+
+	if e.Target != "" {
+		attrs = append(attrs, "target", e.Target)
+	}
+
+	if e.Route != "" {
+		attrs = append(attrs, "route", e.Route)
+	}
+
+	if e.Attempt > 0 {
+		attrs = append(attrs, "attempt", e.Attempt)
+	}
+
+	for key, value := range e.Context {
+		attrs = append(attrs, key, value)
+	}
+
+	if e.DroppedContext > 0 {
+		attrs = append(attrs, "dropped_context", e.DroppedContext)
+	}
+
+	if e.Stack != nil {
+		attrs = append(attrs, "stack", string(e.Stack))
+	}
+
+	switch {
+	case e.Severity >= SeverityHigh:
+		log.Error(e.Message, attrs...)
+	case e.Severity == SeverityMedium:
+		log.Warn(e.Message, attrs...)
+	default:
+		log.Info(e.Message, attrs...)
+	}
+}
+
+// WriteJSON writes the error as the client response. Only the code and
+// message are exposed; cause, context and stack stay in the logs.
+func (e *GatewayError) WriteJSON(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.StatusCode)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": e.Message,
+		"code":  string(e.Code),
+	})
+}
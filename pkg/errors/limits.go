@@ -0,0 +1,107 @@
+package errors
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Limits bounds the growth of GatewayError context
+type Limits struct {
+	// SoftKeys is the number of context keys after which additions are
+	// counted as soft limit violations. Zero disables the soft limit.
+	SoftKeys int
+
+	// HardKeys is the maximum number of context keys; further keys are
+	// dropped. Zero disables the hard limit.
+	HardKeys int
+
+	// MaxValueBytes truncates longer string and byte slice values. Zero
+	// disables truncation.
+	MaxValueBytes int
+}
+
+// LimitStats counts context limit violations since process start
+type LimitStats struct {
+	// SoftLimitExceeded is the number of errors whose context grew past
+	// the soft limit
+	SoftLimitExceeded int64
+
+	// DroppedEntries is the number of context entries dropped at the hard
+	// limit
+	DroppedEntries int64
+}
+
+// DefaultLimits are the limits in effect until SetLimits is called
+var DefaultLimits = Limits{SoftKeys: 16, HardKeys: 32, MaxValueBytes: 1024}
+
+// truncatedSuffix marks truncated context values
+const truncatedSuffix = "...(truncated)"
+
+var (
+	// limits holds the current process-wide limits
+	limits atomic.Pointer[Limits]
+
+	// softLimitExceeded and droppedEntries back LimitStats
+	softLimitExceeded atomic.Int64
+	droppedEntries    atomic.Int64
+)
+
+func init() {
+	defaults := DefaultLimits
+	limits.Store(&defaults)
+}
+
+// SetLimits replaces the process-wide context limits. Errors created
+// before the call keep the context they already have.
+func SetLimits(l Limits) {
+	limits.Store(&l)
+}
+
+// CurrentLimits returns the process-wide context limits
+func CurrentLimits() Limits {
+	return *currentLimits()
+}
+
+// Stats returns context limit violation counters
+func Stats() LimitStats {
+	return LimitStats{
+		SoftLimitExceeded: softLimitExceeded.Load(),
+		DroppedEntries:    droppedEntries.Load(),
+	}
+}
+
+// currentLimits returns the limits without copying them
+func currentLimits() *Limits {
+	return limits.Load()
+}
+
+// truncate shortens string and byte slice values longer than max bytes,
+// cutting on a rune boundary. Other values are returned unchanged.
+func truncate(value interface{}, max int) interface{} {
+	if max <= 0 {
+		return value
+	}
+
+	switch v := value.(type) {
+	case string:
+		if len(v) > max {
+			return truncateString(v, max)
+		}
+	case []byte:
+		if len(v) > max {
+			return truncateString(string(v[:max+1]), max)
+		}
+	}
+
+	return value
+}
+
+// truncateString cuts s, which is longer than max bytes, to at most max
+// bytes without splitting a multi-byte rune
+func truncateString(s string, max int) string {
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+
+	return s[:max] + truncatedSuffix
+}
@@ -0,0 +1,282 @@
+package errors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// Upstream and client error codes
+const (
+	// CodeUpstreamTimeout means the upstream did not connect or respond in
+	// time
+	CodeUpstreamTimeout ErrorCode = "UPSTREAM_TIMEOUT"
+
+	// CodeUpstreamRefused means the upstream actively refused the
+	// connection
+	CodeUpstreamRefused ErrorCode = "UPSTREAM_REFUSED"
+
+	// CodeUpstreamDNS means the upstream host name could not be resolved
+	CodeUpstreamDNS ErrorCode = "UPSTREAM_DNS_FAILURE"
+
+	// CodeUpstreamTLS means the TLS handshake with the upstream failed
+	CodeUpstreamTLS ErrorCode = "UPSTREAM_TLS_FAILURE"
+
+	// CodeUpstreamReset means the upstream closed the connection mid
+	// exchange
+	CodeUpstreamReset ErrorCode = "UPSTREAM_CONNECTION_RESET"
+
+	// CodeUpstreamUnavailable is any other failure to reach the upstream
+	CodeUpstreamUnavailable ErrorCode = "UPSTREAM_UNAVAILABLE"
+
+	// CodeUpstreamContract means the upstream response violated the
+	// route's response contract
+	CodeUpstreamContract ErrorCode = "UPSTREAM_CONTRACT_VIOLATION"
+
+	// CodeUpstreamHeadersTooLarge means the upstream response headers
+	// exceeded the configured size or field count
+	CodeUpstreamHeadersTooLarge ErrorCode = "UPSTREAM_HEADERS_TOO_LARGE"
+
+	// CodeUpstreamGRPCStatus means a gRPC upstream answered with a status
+	// the route retries on
+	CodeUpstreamGRPCStatus ErrorCode = "UPSTREAM_GRPC_STATUS"
+
+	// CodeUpstreamChecksum means the upstream response body did not match
+	// the digest sent with it
+	CodeUpstreamChecksum ErrorCode = "UPSTREAM_CHECKSUM_MISMATCH"
+
+	// CodeClientCanceled means the client went away before the response
+	CodeClientCanceled ErrorCode = "CLIENT_CANCELED"
+
+	// CodeResourceExhausted means a gateway resource limit was reached
+	CodeResourceExhausted ErrorCode = "RESOURCE_EXHAUSTED"
+
+	// CodeAffinityLost means the client's pinned target is gone and the
+	// session cannot continue elsewhere
+	CodeAffinityLost ErrorCode = "SESSION_AFFINITY_LOST"
+
+	// CodeDuplicateRequest means an identical request was just handled and
+	// its response cannot be replayed
+	CodeDuplicateRequest ErrorCode = "DUPLICATE_REQUEST"
+
+	// CodeProtocolNotAllowed means the route does not accept the HTTP
+	// version the request was sent over
+	CodeProtocolNotAllowed ErrorCode = "HTTP_VERSION_NOT_SUPPORTED"
+
+	// CodeNotFound means the route's origin holds nothing at the path
+	CodeNotFound ErrorCode = "NOT_FOUND"
+
+	// CodeMethodNotAllowed means the route's origin does not accept the
+	// request method
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+
+	// CodeNoRoute means no route matches the request and the gateway is
+	// configured to answer such requests itself
+	CodeNoRoute ErrorCode = "NO_ROUTE"
+
+	// CodeNetworkNotAllowed means the request's credential is bound to
+	// networks the client is not in
+	CodeNetworkNotAllowed ErrorCode = "CREDENTIAL_NETWORK_NOT_ALLOWED"
+
+	// CodePluginFailed means a plugin on the request's path failed or did
+	// not answer in time
+	CodePluginFailed ErrorCode = "PLUGIN_FAILED"
+
+	// CodeCircuitOpen means the route's circuit breaker is open and the
+	// request was not forwarded
+	CodeCircuitOpen ErrorCode = "CIRCUIT_OPEN"
+
+	// CodeAuthzUnavailable means the external authorization service failed
+	// or did not answer in time and the request was not allowed
+	CodeAuthzUnavailable ErrorCode = "AUTHZ_UNAVAILABLE"
+
+	// CodeIdentityProviderUnavailable means the OpenID Connect provider
+	// failed or did not answer in time, so nobody could sign in
+	CodeIdentityProviderUnavailable ErrorCode = "IDENTITY_PROVIDER_UNAVAILABLE"
+
+	// CodeRouteSunset means the route was retired on its sunset date
+	CodeRouteSunset ErrorCode = "ROUTE_SUNSET"
+)
+
+// StatusClientClosedRequest is the non-standard status recorded when the
+// client closes the connection before the response is sent
+const StatusClientClosedRequest = 499
+
+func init() {
+	defaults[CodeUpstreamTimeout] = codeDefaults{http.StatusGatewayTimeout, SeverityMedium}
+	defaults[CodeUpstreamRefused] = codeDefaults{http.StatusBadGateway, SeverityMedium}
+	defaults[CodeUpstreamDNS] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeUpstreamTLS] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeUpstreamReset] = codeDefaults{http.StatusBadGateway, SeverityMedium}
+	defaults[CodeUpstreamUnavailable] = codeDefaults{http.StatusBadGateway, SeverityMedium}
+	defaults[CodeUpstreamContract] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeUpstreamChecksum] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeUpstreamHeadersTooLarge] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeUpstreamGRPCStatus] = codeDefaults{http.StatusBadGateway, SeverityMedium}
+	defaults[CodeClientCanceled] = codeDefaults{StatusClientClosedRequest, SeverityLow}
+	defaults[CodeResourceExhausted] = codeDefaults{http.StatusServiceUnavailable, SeverityHigh}
+	defaults[CodeAffinityLost] = codeDefaults{http.StatusUnauthorized, SeverityMedium}
+	defaults[CodeDuplicateRequest] = codeDefaults{http.StatusConflict, SeverityLow}
+	defaults[CodeProtocolNotAllowed] = codeDefaults{http.StatusHTTPVersionNotSupported, SeverityLow}
+	defaults[CodeNotFound] = codeDefaults{http.StatusNotFound, SeverityLow}
+	defaults[CodeMethodNotAllowed] = codeDefaults{http.StatusMethodNotAllowed, SeverityLow}
+	defaults[CodeNetworkNotAllowed] = codeDefaults{http.StatusForbidden, SeverityMedium}
+	defaults[CodeNoRoute] = codeDefaults{http.StatusNotFound, SeverityLow}
+	defaults[CodePluginFailed] = codeDefaults{http.StatusBadGateway, SeverityHigh}
+	defaults[CodeCircuitOpen] = codeDefaults{http.StatusServiceUnavailable, SeverityMedium}
+	defaults[CodeAuthzUnavailable] = codeDefaults{http.StatusServiceUnavailable, SeverityHigh}
+	defaults[CodeIdentityProviderUnavailable] = codeDefaults{http.StatusServiceUnavailable, SeverityHigh}
+	defaults[CodeRouteSunset] = codeDefaults{http.StatusGone, SeverityLow}
+}
+
+// Coder is implemented by errors that know their gateway error code, so
+// packages can map their own sentinel errors without Translate knowing
+// about them
+type Coder interface {
+	ErrorCode() ErrorCode
+}
+
+// Translate converts an error from the upstream path into a GatewayError.
+//
+// It is the single place where net, url, TLS and context errors are
+// classified, so status codes and retry decisions are consistent across
+// handlers:
+//
+//	context.Canceled          CLIENT_CANCELED            499
+//	timeouts                  UPSTREAM_TIMEOUT           504
+//	DNS failures              UPSTREAM_DNS_FAILURE       502  retryable
+//	connection refused        UPSTREAM_REFUSED           502  retryable
+//	TLS handshake failures    UPSTREAM_TLS_FAILURE       502  retryable
+//	resets and unexpected EOF UPSTREAM_CONNECTION_RESET  502
+//	anything else             UPSTREAM_UNAVAILABLE       502
+//
+// Retryable is set only when the request certainly never reached the
+// upstream, which includes connect timeouts. Errors already translated are
+// returned unchanged and errors implementing Coder keep their own code.
+func Translate(err error) *GatewayError {
+	if err == nil {
+		return nil
+	}
+
+	var gatewayErr *GatewayError
+	if stderrors.As(err, &gatewayErr) {
+		return gatewayErr
+	}
+
+	var coder Coder
+	if stderrors.As(err, &coder) {
+		return Wrap(err, coder.ErrorCode(), messages[coder.ErrorCode()])
+	}
+
+	dial := isDial(err)
+
+	switch {
+	case stderrors.Is(err, context.Canceled):
+		return translated(err, CodeClientCanceled, false)
+
+	case stderrors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return translated(err, CodeUpstreamTimeout, dial)
+
+	case isDNS(err):
+		return translated(err, CodeUpstreamDNS, true)
+
+	case stderrors.Is(err, syscall.ECONNREFUSED):
+		return translated(err, CodeUpstreamRefused, true)
+
+	case isTLS(err):
+		return translated(err, CodeUpstreamTLS, true)
+
+	case isHeaderLimit(err):
+		return translated(err, CodeUpstreamHeadersTooLarge, false)
+
+	case stderrors.Is(err, syscall.ECONNRESET) || stderrors.Is(err, syscall.EPIPE) ||
+		stderrors.Is(err, io.EOF) || stderrors.Is(err, io.ErrUnexpectedEOF):
+		return translated(err, CodeUpstreamReset, dial)
+
+	default:
+		return translated(err, CodeUpstreamUnavailable, dial)
+	}
+}
+
+// messages are the client-facing messages of translated errors
+var messages = map[ErrorCode]string{
+	CodeUpstreamTimeout:     "Upstream timed out",
+	CodeUpstreamRefused:     "Upstream refused the connection",
+	CodeUpstreamDNS:         "Upstream host could not be resolved",
+	CodeUpstreamTLS:         "Upstream TLS handshake failed",
+	CodeUpstreamReset:       "Upstream closed the connection",
+	CodeUpstreamUnavailable: "Upstream unavailable",
+	CodeClientCanceled:      "Client closed request",
+	CodeResourceExhausted:   "Gateway resources exhausted",
+
+	CodeUpstreamHeadersTooLarge: "Upstream response headers too large",
+}
+
+// translated wraps err with code and its registered message
+func translated(err error, code ErrorCode, retryable bool) *GatewayError {
+	e := Wrap(err, code, messages[code])
+	e.Retryable = retryable
+	return e
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return stderrors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isDial reports whether err happened while connecting, before any part of
+// the request was sent
+func isDial(err error) bool {
+	var opErr *net.OpError
+	return stderrors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isDNS reports whether err is a name resolution failure
+func isDNS(err error) bool {
+	var dnsErr *net.DNSError
+	return stderrors.As(err, &dnsErr)
+}
+
+// headerLimitMessages identify the transport errors for response headers
+// over the size limit, which net/http reports without a distinct type:
+// HTTP/1 and HTTP/2 respectively
+var headerLimitMessages = []string{
+	"server response headers exceeded",
+	"response header list larger than advertised limit",
+}
+
+// isHeaderLimit reports whether err is an upstream response whose headers
+// exceeded the transport's size limit
+func isHeaderLimit(err error) bool {
+	msg := err.Error()
+	for _, m := range headerLimitMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTLS reports whether err is a TLS handshake or certificate failure
+func isTLS(err error) bool {
+	var (
+		verifyErr   *tls.CertificateVerificationError
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+		unknownAuth x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		certInvalid x509.CertificateInvalidError
+	)
+
+	return stderrors.As(err, &verifyErr) || stderrors.As(err, &recordErr) ||
+		stderrors.As(err, &alertErr) || stderrors.As(err, &unknownAuth) ||
+		stderrors.As(err, &hostnameErr) || stderrors.As(err, &certInvalid)
+}
@@ -0,0 +1,219 @@
+// Package gateway embeds Velocity in other Go programs.
+//
+// It is the public face of the proxy, routing and middleware engine that
+// the velocity binary runs: a Gateway is built from the same configuration
+// the binary reads, and either mounted as an http.Handler in the host
+// program's own server or started on the configured listener.
+//
+// Example usage:
+//
+//	cfg, err := gateway.LoadConfig("config.yaml")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	gw, err := gateway.New(cfg)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer gw.Close()
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/api/", gw.Handler())
+//
+// or, to serve on cfg.Server's address until ctx is cancelled:
+//
+//	err = gw.Start(ctx)
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"velocity/internal/cluster"
+	"velocity/internal/config"
+	internal "velocity/internal/gateway"
+	"velocity/internal/listener"
+	"velocity/internal/proxy"
+	"velocity/pkg/logger"
+)
+
+// Config is the complete gateway configuration, as read from config.yaml
+type Config = config.Config
+
+// ServerConfig configures the listener used by Start
+type ServerConfig = config.ServerConfig
+
+// TargetConfig configures one upstream target
+type TargetConfig = config.TargetConfig
+
+// RouteConfig configures one route
+type RouteConfig = config.RouteConfig
+
+// DefaultConfig returns the configuration used when no file is given
+func DefaultConfig() *Config {
+	return config.DefaultConfig()
+}
+
+// LoadConfig reads, migrates and validates a YAML configuration file
+func LoadConfig(path string) (*Config, error) {
+	return config.LoadFromFile(path)
+}
+
+// shutdownTimeout bounds how long Start waits for in-flight requests once
+// its context is cancelled
+const shutdownTimeout = 30 * time.Second
+
+// Option customizes a Gateway
+type Option func(*options)
+
+// options holds the settings applied by Options
+type options struct {
+	// log receives the gateway's logs
+	log *logger.Logger
+}
+
+// WithLogger sends the gateway's logs to log instead of a logger built
+// from the configuration's logging section
+func WithLogger(log *logger.Logger) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
+
+// Gateway is an embedded Velocity gateway
+//
+// Thread safety: All methods are safe for concurrent use.
+type Gateway struct {
+	// cfg is the configuration the gateway was built from
+	cfg *Config
+
+	// log receives the gateway's logs
+	log *logger.Logger
+
+	// engine is the assembled request pipeline
+	engine *internal.Gateway
+}
+
+// New builds a gateway from cfg. Zero durations in cfg are set to their
+// defaults, the configuration is validated and every component it enables
+// is created; the returned Gateway serves requests right away through
+// Handler.
+//
+// Clustering is process-wide: the first gateway built with it enabled joins
+// the cluster, and later gateways in the same process share that node.
+func New(cfg *Config, opts ...Option) (*Gateway, error) {
+	if cfg == nil {
+		return nil, errors.New("gateway: configuration is required")
+	}
+
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.log == nil {
+		o.log = logger.New(logger.LoggerConfig{
+			Level:  cfg.Logging.Level,
+			Format: cfg.Logging.Format,
+		})
+	}
+
+	// Durations left at zero fall back to their defaults, as in a file
+	config.ApplyDurationDefaults(cfg)
+
+	var joined *cluster.Node
+	if cluster.Current() == nil {
+		var err error
+		if joined, err = cluster.Start(cfg.Cluster, o.log); err != nil {
+			return nil, fmt.Errorf("gateway: failed to join cluster: %w", err)
+		}
+	}
+
+	engine, err := internal.New(cfg, o.log)
+	if err != nil {
+		// A gateway that failed to build leaves the cluster it joined
+		joined.Close()
+		return nil, err
+	}
+
+	// An embedded gateway serves as soon as it is built
+	engine.Activate()
+
+	return &Gateway{cfg: cfg, log: o.log, engine: engine}, nil
+}
+
+// Handler returns the gateway's request pipeline: routing, middleware,
+// proxying and the built-in endpoints such as /health and /metrics
+func (g *Gateway) Handler() http.Handler {
+	return g.engine
+}
+
+// Start serves the gateway on the address, TLS settings and timeouts of
+// cfg.Server until ctx is cancelled, then stops accepting connections and
+// waits for in-flight requests to finish. Returns nil after a clean
+// shutdown. Start does not close the gateway.
+func (g *Gateway) Start(ctx context.Context) error {
+	addr := net.JoinHostPort(g.cfg.Server.Host, strconv.Itoa(g.cfg.Server.Port))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("gateway: failed to listen on %s: %w", addr, err)
+	}
+
+	tracker := listener.NewTracker("proxy", g.cfg.Server.MaxConnections)
+	ln = tracker.Listener(ln)
+
+	tlsConfig, err := listener.ServerTLS(g.cfg.Server.TLS, g.log)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("gateway: %w", err)
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tracker.TLSConfig(tlsConfig))
+	}
+
+	server := &http.Server{
+		Handler:      g.engine,
+		ReadTimeout:  g.cfg.Server.ReadTimeout,
+		WriteTimeout: g.cfg.Server.WriteTimeout,
+		ConnState:    tracker.ConnState,
+		ConnContext:  proxy.ConnContext,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	g.log.Info("Gateway started", "address", addr, "tls", tlsConfig != nil)
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("gateway: shutdown: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the gateway's background work: health checks, discovery
+// watchers and idle upstream connections. Requests must no longer be sent
+// to its handler.
+func (g *Gateway) Close() {
+	g.engine.Close()
+}
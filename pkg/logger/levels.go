@@ -0,0 +1,225 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levels holds the minimum log level, globally and per component, and
+// allows changing them at runtime.
+//
+// A component without its own level inherits the global one. Changes can
+// revert automatically after a delay, so raising verbosity to debug a
+// production issue cannot be forgotten.
+//
+// Thread safety: All methods are safe for concurrent use.
+type Levels struct {
+	// mu guards all fields
+	mu sync.RWMutex
+
+	// global applies to components without their own level
+	global slog.Level
+
+	// components holds per-component overrides
+	components map[string]slog.Level
+
+	// reverts holds pending automatic reverts by component, with "" for
+	// the global level
+	reverts map[string]*pendingRevert
+}
+
+// pendingRevert restores a level once its timer fires
+type pendingRevert struct {
+	// timer fires the revert
+	timer *time.Timer
+
+	// level is the level to restore, nil to remove a component override
+	level *slog.Level
+}
+
+// LevelsSnapshot is the current level configuration
+type LevelsSnapshot struct {
+	// Global is the level of components without their own level
+	Global string `json:"global"`
+
+	// Components holds per-component overrides
+	Components map[string]string `json:"components"`
+
+	// Reverting lists the levels ("" for global) that revert automatically
+	Reverting []string `json:"reverting,omitempty"`
+}
+
+// newLevels creates a level registry with the given global level
+func newLevels(global slog.Level) *Levels {
+	return &Levels{
+		global:     global,
+		components: make(map[string]slog.Level),
+		reverts:    make(map[string]*pendingRevert),
+	}
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a level
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Enabled reports whether a record at level is logged for component
+func (lv *Levels) Enabled(component string, level slog.Level) bool {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+
+	if min, ok := lv.components[component]; ok {
+		return level >= min
+	}
+
+	return level >= lv.global
+}
+
+// SetGlobal changes the global level. With revertAfter > 0 the previous
+// level is restored once the delay has passed.
+func (lv *Levels) SetGlobal(level slog.Level, revertAfter time.Duration) {
+	lv.set("", &level, revertAfter)
+}
+
+// SetComponent changes the level of one component. With revertAfter > 0
+// the previous level is restored once the delay has passed.
+func (lv *Levels) SetComponent(component string, level slog.Level, revertAfter time.Duration) {
+	lv.set(component, &level, revertAfter)
+}
+
+// ResetComponent removes a component's override so it inherits the global
+// level again
+func (lv *Levels) ResetComponent(component string) {
+	lv.set(component, nil, 0)
+}
+
+// Snapshot returns the current levels
+func (lv *Levels) Snapshot() LevelsSnapshot {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+
+	snapshot := LevelsSnapshot{
+		Global:     levelName(lv.global),
+		Components: make(map[string]string, len(lv.components)),
+	}
+
+	for component, level := range lv.components {
+		snapshot.Components[component] = levelName(level)
+	}
+
+	for key := range lv.reverts {
+		snapshot.Reverting = append(snapshot.Reverting, key)
+	}
+
+	return snapshot
+}
+
+// set applies a level change for key ("" for global) and schedules its
+// revert. A change replaces any pending revert of the same key, but the
+// revert still restores the level from before the first change.
+func (lv *Levels) set(key string, level *slog.Level, revertAfter time.Duration) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	previous := lv.current(key)
+	if pending, ok := lv.reverts[key]; ok {
+		pending.timer.Stop()
+		previous = pending.level
+		delete(lv.reverts, key)
+	}
+
+	lv.apply(key, level)
+
+	if revertAfter <= 0 {
+		return
+	}
+
+	pending := &pendingRevert{level: previous}
+	pending.timer = time.AfterFunc(revertAfter, func() {
+		lv.mu.Lock()
+		defer lv.mu.Unlock()
+
+		if lv.reverts[key] != pending {
+			return
+		}
+
+		delete(lv.reverts, key)
+		lv.apply(key, pending.level)
+	})
+	lv.reverts[key] = pending
+}
+
+// current returns the level set for key, nil for a component without an
+// override. Must be called with lv.mu held.
+func (lv *Levels) current(key string) *slog.Level {
+	if key == "" {
+		level := lv.global
+		return &level
+	}
+
+	if level, ok := lv.components[key]; ok {
+		return &level
+	}
+
+	return nil
+}
+
+// apply sets the level for key. Must be called with lv.mu held.
+func (lv *Levels) apply(key string, level *slog.Level) {
+	switch {
+	case key == "":
+		if level != nil {
+			lv.global = *level
+		}
+	case level == nil:
+		delete(lv.components, key)
+	default:
+		lv.components[key] = *level
+	}
+}
+
+// levelName returns the configuration name of a level
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// componentHandler gates records by the level of its component
+type componentHandler struct {
+	slog.Handler
+
+	// levels decides which records are enabled
+	levels *Levels
+
+	// component names the logger, "" for the application logger
+	component string
+}
+
+// Enabled implements slog.Handler
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.levels.Enabled(h.component, level)
+}
+
+// WithAttrs implements slog.Handler
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &componentHandler{Handler: h.Handler.WithAttrs(attrs), levels: h.levels, component: h.component}
+}
+
+// WithGroup implements slog.Handler
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{Handler: h.Handler.WithGroup(name), levels: h.levels, component: h.component}
+}
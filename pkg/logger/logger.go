@@ -5,13 +5,24 @@
 package logger
 
 import (
+	"io"
 	"log/slog"
 	"os"
+	"time"
 )
 
 // Logger wraps slog.Logger with additional convenience methods
+//
+// Loggers derived with Component share their parent's output and Levels,
+// so the level of each component can be changed at runtime.
 type Logger struct {
 	*slog.Logger
+
+	// base is the output handler shared by all component loggers
+	base slog.Handler
+
+	// levels gates records by component
+	levels *Levels
 }
 
 // Config defines logger configuration options
@@ -21,6 +32,9 @@ type LoggerConfig struct {
 
 	// Format specifies output format (text, json)
 	Format string `yaml:"format"`
+
+	// Output receives the records, standard output when nil
+	Output io.Writer `yaml:"-"`
 }
 
 // New creates a new logger with the specified configuration
@@ -33,40 +47,66 @@ func New(cfg LoggerConfig) *Logger {
 		cfg.Format = "text"
 	}
 
-	// Parse log level
-	var level slog.Level
-	switch cfg.Level {
-	case "debug":
-		level = slog.LevelDebug
-
-	case "info":
-		level = slog.LevelInfo
-
-	case "warn":
-		level = slog.LevelWarn
-
-	case "error":
-		level = slog.LevelError
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
 
-	default:
+	// Parse log level
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
 		level = slog.LevelInfo
 	}
 
-	// Create handler based on format
+	// Create handler based on format. Filtering is left to Levels, so the
+	// handler itself accepts every record.
 	var handler slog.Handler
-	opts := &slog.HandlerOptions{Level: level}
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
 
 	if cfg.Format == "json" {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(cfg.Output, opts)
 	} else {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+		handler = slog.NewTextHandler(cfg.Output, opts)
 	}
 
+	levels := newLevels(level)
+
 	return &Logger{
-		Logger: slog.New(handler),
+		Logger: slog.New(&componentHandler{Handler: handler, levels: levels}),
+		base:   handler,
+		levels: levels,
 	}
 }
 
+// Component returns a logger for a named gateway component. Its records
+// carry a component attribute and are filtered by the component's level,
+// or by the global level if the component has none.
+func (l *Logger) Component(name string) *Logger {
+	handler := &componentHandler{Handler: l.base, levels: l.levels, component: name}
+
+	return &Logger{
+		Logger: slog.New(handler).With("component", name),
+		base:   l.base,
+		levels: l.levels,
+	}
+}
+
+// With returns a logger that adds args as attributes to every record and
+// keeps the component's level. Components derived from it keep the
+// attributes too.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{
+		Logger: l.Logger.With(args...),
+		base:   slog.New(l.base).With(args...).Handler(),
+		levels: l.levels,
+	}
+}
+
+// Levels returns the runtime-adjustable levels shared by this logger and
+// its components
+func (l *Logger) Levels() *Levels {
+	return l.levels
+}
+
 // Default creates a logger with default settings
 func Default() *Logger {
 	return New(LoggerConfig{Level: "info", Format: "text"})
@@ -99,3 +139,34 @@ func (l *Logger) LogProxyFailure(target string, err error) {
 func (l *Logger) LogAllTargetsFailed(method, path string) {
 	l.Error("All targets failed", "method", method, "path", path)
 }
+
+// LogTargetAdded logs a target joining the pool
+func (l *Logger) LogTargetAdded(target string) {
+	l.Info("Target added", "target", target)
+}
+
+// LogTargetDraining logs a removed target entering the drain phase
+func (l *Logger) LogTargetDraining(target string, inFlight int64) {
+	l.Info("Target draining", "target", target, "in_flight", inFlight)
+}
+
+// LogTargetDrained logs a removed target's connection pool being closed
+func (l *Logger) LogTargetDrained(target string, abandoned int64) {
+	if abandoned > 0 {
+		l.Warn("Target drain timed out", "target", target, "in_flight", abandoned)
+		return
+	}
+
+	l.Info("Target drained", "target", target)
+}
+
+// LogTargetEjected logs a target being removed from selection by outlier
+// detection
+func (l *Logger) LogTargetEjected(target, reason string, duration time.Duration) {
+	l.Warn("Target ejected", "target", target, "reason", reason, "duration", duration)
+}
+
+// LogTargetRestored logs an ejected target returning to selection
+func (l *Logger) LogTargetRestored(target string) {
+	l.Info("Target restored", "target", target)
+}
@@ -0,0 +1,184 @@
+// Package plugin writes out-of-process plugins for Velocity.
+//
+// A process plugin is an executable the gateway starts for every plugin of
+// type "process" in its configuration. The gateway sends it the headers of
+// each request on a route using it; the plugin answers whether the request
+// continues, with which headers added or removed, or is answered by the
+// plugin itself. Calls are JSON-RPC 1.0 over the plugin's standard input
+// and output, so plugins may be written in any language; standard error
+// is copied to the gateway's log.
+//
+// Example plugin rejecting requests without a tenant header:
+//
+//	func main() {
+//		plugin.Serve(func(config map[string]string) (plugin.Handler, error) {
+//			header := config["header"]
+//			return func(r *plugin.Request) (*plugin.Response, error) {
+//				if r.Header.Get(header) == "" {
+//					return plugin.Respond(http.StatusForbidden, "missing "+header), nil
+//				}
+//				return plugin.Continue(), nil
+//			}, nil
+//		})
+//	}
+//
+// Standard output belongs to the protocol: a plugin must log to standard
+// error only.
+package plugin
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync/atomic"
+)
+
+// RPC methods called by the gateway
+const (
+	// MethodInit passes the plugin its configuration once it started
+	MethodInit = "Plugin.Init"
+
+	// MethodHandle asks the plugin about a request
+	MethodHandle = "Plugin.Handle"
+)
+
+// Request describes a request passed to a plugin. Bodies are not passed.
+type Request struct {
+	// Method is the request method
+	Method string `json:"method"`
+
+	// URL is the request path and query
+	URL string `json:"url"`
+
+	// Host is the request's Host header
+	Host string `json:"host"`
+
+	// RemoteAddr is the client address, host:port
+	RemoteAddr string `json:"remote_addr"`
+
+	// Route is the name of the matched route, empty for global plugins,
+	// which run before routing
+	Route string `json:"route"`
+
+	// Header holds the request headers
+	Header http.Header `json:"header"`
+}
+
+// Response is a plugin's decision about a request
+type Response struct {
+	// Status answers the request with this status instead of continuing,
+	// zero to continue
+	Status int `json:"status,omitempty"`
+
+	// Header holds the headers of the answer
+	Header http.Header `json:"header,omitempty"`
+
+	// Body is the body of the answer
+	Body []byte `json:"body,omitempty"`
+
+	// SetHeaders replaces request headers before the request continues
+	SetHeaders http.Header `json:"set_headers,omitempty"`
+
+	// RemoveHeaders deletes request headers before the request continues
+	RemoveHeaders []string `json:"remove_headers,omitempty"`
+}
+
+// Continue returns a response letting the request continue unchanged
+func Continue() *Response {
+	return &Response{}
+}
+
+// Respond returns a response answering the request with status and a
+// plain text body
+func Respond(status int, body string) *Response {
+	return &Response{
+		Status: status,
+		Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:   []byte(body),
+	}
+}
+
+// Handler decides about one request. Handlers are called concurrently.
+type Handler func(r *Request) (*Response, error)
+
+// Factory creates the handler of a plugin from its configuration
+type Factory func(config map[string]string) (Handler, error)
+
+// Serve runs a plugin on standard input and output until the gateway
+// closes them
+func Serve(factory Factory) error {
+	return ServeConn(stdio{}, factory)
+}
+
+// ServeConn runs a plugin on conn, for tests and custom transports
+func ServeConn(conn io.ReadWriteCloser, factory Factory) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &service{factory: factory}); err != nil {
+		return err
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
+
+// service exposes a plugin over RPC
+type service struct {
+	// factory creates handler on Init
+	factory Factory
+
+	// handler serves Handle calls once initialized
+	handler atomic.Pointer[Handler]
+}
+
+// Init creates the plugin's handler. It is called once, before any
+// Handle call.
+func (s *service) Init(config map[string]string, _ *struct{}) error {
+	handler, err := s.factory(config)
+	if err != nil {
+		return err
+	}
+
+	s.handler.Store(&handler)
+	return nil
+}
+
+// Handle decides about a request
+func (s *service) Handle(r *Request, resp *Response) error {
+	handler := s.handler.Load()
+	if handler == nil {
+		return errors.New("plugin not initialized")
+	}
+
+	decision, err := (*handler)(r)
+	if err != nil {
+		return err
+	}
+
+	if decision != nil {
+		*resp = *decision
+	}
+
+	return nil
+}
+
+// stdio joins the process's standard input and output
+type stdio struct{}
+
+// Read implements io.Reader
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+// Write implements io.Writer
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// Close implements io.Closer
+func (stdio) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}